@@ -0,0 +1,14 @@
+// Command lmctl is the admin command line: it creates users, resets
+// passwords, requeues searches, and exports and backs up the database.
+// Run it with no arguments for the list of commands.
+package main
+
+import (
+	"os"
+
+	"blueleads-backend/internal/app"
+)
+
+func main() {
+	os.Exit(app.RunLmctl(os.Args[1:], os.Stdout))
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- ACTIVITY FEED ---
+const ACTIVITY_DEFAULT_LIMIT = 50
+const ACTIVITY_MAX_LIMIT = 200
+
+// ActivityEvent is one entry in a CRM lead's history. Type is one of call,
+// note_edit, added, column_move, status_change, snoozed, resurfaced,
+// tag_added or tag_removed; Detail depends on the type.
+type ActivityEvent struct {
+	Type     string          `json:"type"`
+	At       time.Time       `json:"at"`
+	UserID   int64           `json:"userId"`
+	UserName string          `json:"userName"`
+	Detail   json.RawMessage `json:"detail"`
+}
+
+// getLeadActivityHandler pages backwards through a lead's history: pass
+// the oldest "at" seen as before to fetch the next page.
+func getLeadActivityHandler(c *gin.Context) {
+	limit := ACTIVITY_DEFAULT_LIMIT
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > ACTIVITY_MAX_LIMIT {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+	before := time.Now().Add(time.Second)
+	if v := c.Query("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be an RFC 3339 timestamp"})
+			return
+		}
+		before = t
+	}
+
+	events, err := repoFrom(c).LeadActivity(c.Param("leadId"), before, limit)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load activity"})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
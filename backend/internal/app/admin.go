@@ -0,0 +1,156 @@
+package app
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/auth"
+)
+
+// --- ADMIN: USER MANAGEMENT ---
+
+type AdminUser struct {
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Email       string     `json:"email"`
+	IsAdmin     bool       `json:"isAdmin"`
+	DisabledAt  *time.Time `json:"disabledAt"`
+	SearchCount int        `json:"searchCount"`
+	LeadCount   int        `json:"leadCount"`
+	CrmCount    int        `json:"crmCount"`
+}
+
+func adminListUsersHandler(c *gin.Context) {
+	rows, err := db.QueryContext(c.Request.Context(), `
+        SELECT u.id, u.name, u.email, u.is_admin, u.disabled_at,
+            (SELECT COUNT(*) FROM searches s WHERE s.user_id = u.id AND s.deleted_at IS NULL),
+            (SELECT COUNT(*) FROM leads l JOIN searches s ON s.id = l.search_id WHERE s.user_id = u.id AND l.deleted_at IS NULL AND s.deleted_at IS NULL),
+            (SELECT COUNT(*) FROM crm_leads cl WHERE cl.user_id = u.id AND cl.deleted_at IS NULL)
+        FROM users u ORDER BY u.id
+    `)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+		return
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		var disabledAt sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.IsAdmin, &disabledAt, &u.SearchCount, &u.LeadCount, &u.CrmCount); err != nil {
+			log.Printf("Error scanning user row: %v", err)
+			continue
+		}
+		if disabledAt.Valid {
+			u.DisabledAt = &disabledAt.Time
+		}
+		users = append(users, u)
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// adminTargetUser parses :userId and checks the user exists, writing the
+// error response itself when it doesn't.
+func adminTargetUser(c *gin.Context) (int64, bool) {
+	targetID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+	var exists bool
+	if err := db.QueryRowContext(c.Request.Context(), "SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", targetID).Scan(&exists); err != nil || !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return 0, false
+	}
+	return targetID, true
+}
+
+func adminDisableUserHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	targetID, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+	if targetID == userID.(int64) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot disable your own account"})
+		return
+	}
+
+	// Revoking the user's sessions keeps their old tokens out even after
+	// the account is enabled again.
+	if _, err := db.ExecContext(c.Request.Context(), "UPDATE users SET disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP), token_version = token_version + 1 WHERE id = ?", targetID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable user"})
+		return
+	}
+	log.Printf("Admin %d disabled user %d", userID, targetID)
+	c.Status(http.StatusNoContent)
+}
+
+func adminEnableUserHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	targetID, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	if _, err := db.ExecContext(c.Request.Context(), "UPDATE users SET disabled_at = NULL WHERE id = ?", targetID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable user"})
+		return
+	}
+	log.Printf("Admin %d enabled user %d", userID, targetID)
+	c.Status(http.StatusNoContent)
+}
+
+func adminResetPasswordHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	targetID, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	checkPassword(fe, "password", input.Password)
+	if fe.respond(c) {
+		return
+	}
+
+	if err := authService(c.Request.Context()).SetPassword(targetID, input.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	log.Printf("Admin %d reset the password of user %d", userID, targetID)
+	c.Status(http.StatusNoContent)
+}
+
+func adminImpersonateHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	targetID, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	user, err := auth.NewRepository(c.Request.Context(), db).Get(targetID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	token, expiresAt, err := authService(c.Request.Context()).Impersonate(userID.(int64), targetID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	log.Printf("Admin %d is impersonating user %d", userID, targetID)
+	c.JSON(http.StatusOK, gin.H{"token": token, "expiresAt": expiresAt, "user": gin.H{"id": user.ID, "name": user.Name, "email": user.Email}})
+}
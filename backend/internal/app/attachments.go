@@ -0,0 +1,72 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- ATTACHMENTS ---
+//
+// Attachments are files kept alongside the database rather than in it, such
+// as lead screenshots. Each has a key like "screenshots/<leadId>" and lives
+// at that path under ATTACHMENTS_DIR. Writes go to a temporary file that's
+// renamed into place, so a reader never sees half a file.
+
+var attachmentsDir = envOrDefault("ATTACHMENTS_DIR", "attachments")
+
+// attachmentPath returns where the attachment with the key is stored.
+func attachmentPath(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid attachment key %q", key)
+	}
+	return filepath.Join(attachmentsDir, clean), nil
+}
+
+// putAttachment stores data under the key, replacing what was there.
+func putAttachment(key string, data []byte) error {
+	path, err := attachmentPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("creating attachment dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readAttachment returns the attachment's contents, or an error satisfying
+// os.IsNotExist when there's none.
+func readAttachment(key string) ([]byte, error) {
+	path, err := attachmentPath(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// deleteAttachment removes the attachment, if there is one.
+func deleteAttachment(key string) error {
+	path, err := attachmentPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- AUDIT REPORTS ---
+//
+// POST /api/crm/leads/:leadId/audit-report turns what we know about a
+// card's website into a report for the prospect: its Lighthouse scores and
+// the fixes that would speed it up most, its SSL certificate, the platform
+// it's built on and what it's missing. It's written to the business in
+// plain English, under the user's branding (see branding.go), as a PDF ({"format":
+// "pdf"}, the default) or an HTML page to send on. A site that hasn't been
+// audited yet is audited first.
+
+const SSL_EXPIRY_WARNING_DAYS = 30
+
+var sslDialTimeout = 10 * time.Second
+
+// SSLCheck is what a site's certificate said when the report was made.
+type SSLCheck struct {
+	// Checked is false when the site couldn't be found to ask. HTTPS is
+	// whether it answers on port 443 at all, and Valid whether browsers
+	// trust its certificate.
+	Checked   bool
+	HTTPS     bool
+	Valid     bool
+	Issuer    string
+	ExpiresAt *time.Time
+	Error     string
+}
+
+// checkSSL looks at a website's certificate; tests replace it.
+var checkSSL = tlsCertificate
+
+func tlsCertificate(ctx context.Context, website string) SSLCheck {
+	var check SSLCheck
+	host := websiteHost(website)
+	if host == "" {
+		check.Error = "no website"
+		return check
+	}
+	ctx, cancel := context.WithTimeout(ctx, sslDialTimeout)
+	defer cancel()
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: host}}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, "443"))
+	var notFound *net.DNSError
+	if errors.As(err, &notFound) {
+		check.Error = err.Error()
+		return check
+	}
+	check.Checked = true
+	var invalid *tls.CertificateVerificationError
+	if errors.As(err, &invalid) {
+		check.HTTPS = true
+		check.Error = invalid.Err.Error()
+		if len(invalid.UnverifiedCertificates) > 0 {
+			check.describe(invalid.UnverifiedCertificates[0])
+		}
+		return check
+	}
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	defer conn.Close()
+	check.HTTPS, check.Valid = true, true
+	if certs := conn.(*tls.Conn).ConnectionState().PeerCertificates; len(certs) > 0 {
+		check.describe(certs[0])
+	}
+	return check
+}
+
+func (s *SSLCheck) describe(cert *x509.Certificate) {
+	s.Issuer = cert.Issuer.CommonName
+	if len(cert.Issuer.Organization) > 0 {
+		s.Issuer = cert.Issuer.Organization[0]
+	}
+	expires := cert.NotAfter
+	s.ExpiresAt = &expires
+}
+
+// websiteHost returns the host name in a lead's website, which is often
+// stored without a scheme.
+func websiteHost(website string) string {
+	if !strings.HasPrefix(website, "http://") && !strings.HasPrefix(website, "https://") {
+		website = "http://" + website
+	}
+	u, err := url.Parse(website)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// auditReport is what goes into a prospect's website review.
+type auditReport struct {
+	Branding   Branding
+	Company    string
+	Website    string
+	Generated  time.Time
+	Audit      *LighthouseAudit
+	SSL        SSLCheck
+	Tech       []string
+	Features   *leads.SiteFeatures
+	Screenshot []byte
+}
+
+// auditFinding is one point the report makes, good or bad.
+type auditFinding struct {
+	Good   bool
+	Title  string
+	Detail string
+}
+
+type auditScore struct {
+	Label string
+	Score int
+}
+
+// buildAuditReport gathers the card's report. With audit set, a site that
+// hasn't been audited is audited first; otherwise the report goes without
+// scores.
+func buildAuditReport(ctx context.Context, repo *Repository, card CrmLead, now time.Time, audit bool) (auditReport, error) {
+	r := auditReport{Company: card.CompanyName, Website: card.Website, Generated: now}
+	var err error
+	if r.Branding, err = repo.Branding(); err != nil {
+		return r, err
+	}
+
+	stored, err := repo.LeadAudit(card.ID)
+	switch {
+	case err == nil:
+		r.Audit = &stored
+	case err != store.ErrNotFound:
+		return r, err
+	case audit:
+		if stored, err = auditLead(ctx, card.ID, card.Website); err == nil {
+			r.Audit = &stored
+		} else {
+			// The rest of the report still stands without the scores.
+			log.Printf("Failed to audit website for lead %s: %v", card.ID, err)
+		}
+	}
+
+	// A card whose lead was trashed has no platform or features to report.
+	lead, err := repo.Leads().Get(card.ID)
+	if err == nil {
+		r.Tech, r.Features = lead.Tech, lead.Features
+	} else if err != store.ErrNotFound {
+		return r, err
+	}
+
+	r.SSL = checkSSL(ctx, card.Website)
+	if key, err := repo.CrmScreenshot(card.ID); err == nil && key != "" {
+		r.Screenshot, _ = readAttachment(key)
+	}
+	return r, nil
+}
+
+func (r auditReport) scores() []auditScore {
+	var scores []auditScore
+	if r.Audit == nil {
+		return scores
+	}
+	for _, s := range []struct {
+		label string
+		score *int
+	}{
+		{"Performance", r.Audit.Performance}, {"SEO", r.Audit.SEO},
+		{"Accessibility", r.Audit.Accessibility}, {"Best practices", r.Audit.BestPractices},
+	} {
+		if s.score != nil {
+			scores = append(scores, auditScore{s.label, *s.score})
+		}
+	}
+	return scores
+}
+
+// scoreRating is Lighthouse's own banding of a score.
+func scoreRating(score int) string {
+	switch {
+	case score >= 90:
+		return "Good"
+	case score >= 50:
+		return "Needs work"
+	}
+	return "Poor"
+}
+
+// findings are the report's points, addressed to the business.
+func (r auditReport) findings() []auditFinding {
+	var f []auditFinding
+	bad := func(title, detail string) { f = append(f, auditFinding{Title: title, Detail: detail}) }
+	good := func(title, detail string) { f = append(f, auditFinding{Good: true, Title: title, Detail: detail}) }
+
+	switch {
+	case !r.SSL.Checked:
+	case !r.SSL.HTTPS:
+		bad("Your site isn't secure", `It isn't served over HTTPS, so browsers label it "Not secure" and some visitors leave before it loads.`)
+	case !r.SSL.Valid:
+		bad("Your security certificate isn't trusted", "Browsers show visitors a warning page instead of your site.")
+	case r.SSL.ExpiresAt != nil && r.SSL.ExpiresAt.Before(r.Generated.AddDate(0, 0, SSL_EXPIRY_WARNING_DAYS)):
+		bad("Your security certificate runs out soon", fmt.Sprintf("It expires on %s, after which browsers will warn visitors away.", r.SSL.ExpiresAt.Format("2 January 2006")))
+	default:
+		good("Your site is secure", "It's served over HTTPS with a valid certificate.")
+	}
+
+	if a := r.Audit; a != nil {
+		if p := a.Performance; p != nil {
+			switch {
+			case *p < 50:
+				bad("Your site is slow on phones", fmt.Sprintf("It scored %d out of 100 for mobile performance. Google recommends 90 or more, and most visitors give up on a page that takes more than three seconds to load.", *p))
+			case *p < 90:
+				bad("Your site could be faster on phones", fmt.Sprintf("It scored %d out of 100 for mobile performance, where Google recommends 90 or more.", *p))
+			default:
+				good("Your site is fast", fmt.Sprintf("It scored %d out of 100 for mobile performance.", *p))
+			}
+		}
+		if s := a.SEO; s != nil && *s < 90 {
+			bad("Search engines may be missing things", fmt.Sprintf("It scored %d out of 100 for SEO, which affects where you appear on Google.", *s))
+		}
+		if s := a.Accessibility; s != nil && *s < 90 {
+			bad("Some visitors may find your site hard to use", fmt.Sprintf("It scored %d out of 100 for accessibility.", *s))
+		}
+		if s := a.BestPractices; s != nil && *s < 90 {
+			bad("Your site is behind on best practices", fmt.Sprintf("It scored %d out of 100 for modern web best practices.", *s))
+		}
+	}
+
+	if sf := r.Features; sf != nil {
+		if !sf.MobileFriendly {
+			bad("Your site isn't built for phones", "It doesn't adapt to small screens, so phone visitors have to pinch and zoom.")
+		}
+		if !sf.OnlineBooking {
+			bad("Customers can't book online", "There's no way to book or make an appointment on your site, so every booking takes a phone call.")
+		}
+		if !sf.LiveChat {
+			bad("There's no live chat", "Visitors with a quick question can't ask it while they're on your site.")
+		}
+		if !sf.Analytics {
+			bad("You can't see who visits your site", "There's no analytics on it, so you can't tell how many people visit or where they come from.")
+		}
+	}
+	return f
+}
+
+// savings describes an opportunity's estimated saving.
+func (o LighthouseOpportunity) savings() string {
+	if o.SavingsMs >= 1000 {
+		return fmt.Sprintf("could save about %.1f seconds", float64(o.SavingsMs)/1000)
+	}
+	return fmt.Sprintf("could save about %d ms", o.SavingsMs)
+}
+
+func (r auditReport) renderPDF() []byte {
+	w := newPDFWriter()
+	r.Branding.applyPDF(w)
+	w.Title("Website review for " + r.Company)
+	w.Line(fmt.Sprintf("%s, prepared by %s on %s", r.Website, r.Branding.name(), r.Generated.Format("2 January 2006")))
+	if len(r.Tech) > 0 {
+		w.Line("Built with " + strings.Join(r.Tech, ", ") + ".")
+	}
+
+	if scores := r.scores(); len(scores) > 0 {
+		w.Section("Google Lighthouse scores (mobile)")
+		widths := []float64{200, 80, 120}
+		for _, s := range scores {
+			w.Row(widths, false, s.Label, fmt.Sprintf("%d / 100", s.Score), scoreRating(s.Score))
+		}
+	}
+
+	w.Section("What we found")
+	for _, f := range r.findings() {
+		mark := "Needs attention: "
+		if f.Good {
+			mark = "Good: "
+		}
+		w.Row([]float64{pdfPageWidth - 2*pdfMargin}, true, mark+f.Title)
+		w.Paragraph(f.Detail)
+	}
+
+	if r.Audit != nil && len(r.Audit.Opportunities) > 0 {
+		w.Section("Quickest wins")
+		for _, o := range r.Audit.Opportunities {
+			w.Paragraph(fmt.Sprintf("%s: %s.", o.Title, o.savings()))
+		}
+	}
+	return w.Bytes()
+}
+
+var auditReportTemplate = template.Must(template.New("audit-report").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Website review for {{.Company}}</title></head>
+<body style="font-family: sans-serif; max-width: 44rem; margin: 3rem auto; padding: 0 1rem; color: #222">
+{{if .Logo}}<img src="{{.Logo}}" alt="{{.Brand}}" style="max-height: 4rem; max-width: 15rem">{{end}}
+<h1 style="color: {{.Primary}}">Website review for {{.Company}}</h1>
+<p>{{.Website}}, prepared by {{.Brand}} on {{.Date}}.{{if .Tech}} Built with {{.Tech}}.{{end}}</p>
+{{if .Screenshot}}<img src="{{.Screenshot}}" alt="Your homepage" style="max-width: 100%; border: 1px solid #ddd">{{end}}
+{{if .Scores}}
+<h2 style="color: {{.Primary}}">Google Lighthouse scores (mobile)</h2>
+<table style="border-collapse: collapse">
+{{range .Scores}}<tr><td style="padding: 0.25rem 1rem 0.25rem 0">{{.Label}}</td><td style="padding: 0.25rem 1rem 0.25rem 0"><strong>{{.Score}}</strong> / 100</td><td>{{.Rating}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2 style="color: {{.Primary}}">What we found</h2>
+{{range .Findings}}<div style="margin-bottom: 1rem; padding-left: 0.75rem; border-left: 4px solid {{if .Good}}#2e7d32{{else}}#c62828{{end}}">
+<strong>{{.Title}}</strong><br>{{.Detail}}</div>
+{{end}}
+{{if .Opportunities}}
+<h2 style="color: {{.Primary}}">Quickest wins</h2>
+<ul>{{range .Opportunities}}<li>{{.Title}}: {{.Savings}}.</li>{{end}}</ul>
+{{end}}
+{{if .Footer}}<p style="margin-top: 2rem; padding-top: 1rem; border-top: 1px solid {{.Accent}}; color: #555; font-size: 0.875rem">{{.Footer}}</p>{{end}}
+</body>
+</html>
+`))
+
+func (r auditReport) renderHTML() ([]byte, error) {
+	type score struct {
+		auditScore
+		Rating string
+	}
+	type opportunity struct{ Title, Savings string }
+	data := struct {
+		Brand, Company, Website, Date, Tech string
+		Primary, Accent, Footer             string
+		Logo, Screenshot                    template.URL
+		Scores                              []score
+		Findings                            []auditFinding
+		Opportunities                       []opportunity
+	}{Brand: r.Branding.name(), Company: r.Company, Website: r.Website, Date: r.Generated.Format("2 January 2006"), Tech: strings.Join(r.Tech, ", "),
+		Primary: r.Branding.primary(), Accent: r.Branding.accent(), Footer: r.Branding.FooterText,
+		Logo: dataURI(r.Branding.logoImage()), Screenshot: dataURI(r.Screenshot), Findings: r.findings()}
+	for _, s := range r.scores() {
+		data.Scores = append(data.Scores, score{s, scoreRating(s.Score)})
+	}
+	if r.Audit != nil {
+		for _, o := range r.Audit.Opportunities {
+			data.Opportunities = append(data.Opportunities, opportunity{o.Title, o.savings()})
+		}
+	}
+	var buf bytes.Buffer
+	err := auditReportTemplate.Execute(&buf, data)
+	return buf.Bytes(), err
+}
+
+// auditReportHandler builds and returns a card's website review.
+func auditReportHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Format string `json:"format"`
+	}
+	if c.Request.ContentLength != 0 && !bindJSON(c, &input) {
+		return
+	}
+	if input.Format == "" {
+		input.Format = "pdf"
+	}
+	if input.Format != "pdf" && input.Format != "html" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be pdf or html"})
+		return
+	}
+	card, err := repo.Crm().Card(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	if card.Website == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The lead has no website"})
+		return
+	}
+
+	report, err := buildAuditReport(c.Request.Context(), repo, card, time.Now(), true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build audit report"})
+		return
+	}
+	var body []byte
+	contentType := "application/pdf"
+	if input.Format == "pdf" {
+		body = report.renderPDF()
+	} else {
+		contentType = "text/html; charset=utf-8"
+		if body, err = report.renderHTML(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build audit report"})
+			return
+		}
+	}
+	if err := repo.logActivity(card.ID, "audit_report", map[string]interface{}{"format": input.Format}); err != nil {
+		log.Printf("Failed to log audit report for lead %s: %v", card.ID, err)
+	}
+	filename := fmt.Sprintf("website-review-%s.%s", report.Generated.Format("2006-01-02"), input.Format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, contentType, body)
+}
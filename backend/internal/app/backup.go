@@ -0,0 +1,239 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- BACKUPS ---
+//
+// Backups are consistent online snapshots taken with VACUUM INTO, written to
+// BACKUP_DIR and optionally uploaded to S3 (or any S3-compatible store).
+// To restore, stop the server and start it once with -restore:
+//
+//	./blueleads-backend -restore backups/leads-20250101T030000Z.db
+//
+// which replaces leads.db with the snapshot before opening it.
+
+var backupDir = envOrDefault("BACKUP_DIR", "backups")
+var backupIntervalHours = envInt("BACKUP_INTERVAL_HOURS", 24)
+var backupKeep = envInt("BACKUP_KEEP", 7)
+
+var backupMu sync.Mutex
+
+type BackupResult struct {
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	S3Key    string    `json:"s3Key,omitempty"`
+	TakenAt  time.Time `json:"takenAt"`
+	Duration string    `json:"duration"`
+}
+
+// createBackup snapshots the database, uploads it if S3 is configured and
+// prunes old local copies.
+func createBackup() (BackupResult, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	start := time.Now()
+	if err := os.MkdirAll(backupDir, 0o700); err != nil {
+		return BackupResult{}, fmt.Errorf("creating backup dir: %w", err)
+	}
+	name := fmt.Sprintf("leads-%s.db", start.UTC().Format("20060102T150405Z"))
+	path := filepath.Join(backupDir, name)
+
+	if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+		return BackupResult{}, fmt.Errorf("snapshotting database: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	result := BackupResult{File: path, Size: info.Size(), TakenAt: start}
+
+	if s3 := s3ConfigFromEnv(); s3 != nil {
+		key := strings.TrimPrefix(s3.prefix+"/"+name, "/")
+		if err := s3.upload(path, key); err != nil {
+			return result, fmt.Errorf("uploading backup to S3: %w", err)
+		}
+		result.S3Key = key
+	}
+
+	pruneBackups()
+	result.Duration = time.Since(start).Round(time.Millisecond).String()
+	return result, nil
+}
+
+func pruneBackups() {
+	if backupKeep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(backupDir, "leads-*.db"))
+	if err != nil {
+		return
+	}
+	// Timestamped names sort chronologically.
+	sort.Strings(matches)
+	for len(matches) > backupKeep {
+		if err := os.Remove(matches[0]); err != nil {
+			log.Printf("Failed to remove old backup %s: %v", matches[0], err)
+		}
+		matches = matches[1:]
+	}
+}
+
+func scheduledBackup() {
+	result, err := createBackup()
+	if err != nil {
+		log.Printf("Scheduled backup failed: %v", err)
+		return
+	}
+	log.Printf("Backup written to %s (%d bytes)", result.File, result.Size)
+}
+
+func backupHandler(c *gin.Context) {
+	result, err := createBackup()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Backup failed", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, result)
+}
+
+// restoreDatabase replaces the database file with a backup. It must run
+// before initDB opens the database.
+func restoreDatabase(backupPath string) error {
+	src, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := DB_FILE + ".restore"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Stale WAL files belong to the old database and must not be replayed.
+	os.Remove(DB_FILE + "-wal")
+	os.Remove(DB_FILE + "-shm")
+	return os.Rename(tmp, DB_FILE)
+}
+
+// --- S3 UPLOAD ---
+type s3Config struct {
+	bucket    string
+	region    string
+	endpoint  string
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+func s3ConfigFromEnv() *s3Config {
+	bucket := os.Getenv("BACKUP_S3_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	return &s3Config{
+		bucket:    bucket,
+		region:    envOrDefault("BACKUP_S3_REGION", "us-east-1"),
+		endpoint:  os.Getenv("BACKUP_S3_ENDPOINT"),
+		prefix:    strings.Trim(os.Getenv("BACKUP_S3_PREFIX"), "/"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+}
+
+// upload PUTs the file using AWS Signature Version 4. A custom endpoint
+// (MinIO, R2, B2...) is addressed path-style.
+func (s *s3Config) upload(path, key string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var target *url.URL
+	if s.endpoint != "" {
+		target, err = url.Parse(strings.TrimRight(s.endpoint, "/") + "/" + s.bucket + "/" + key)
+	} else {
+		target, err = url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, key))
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", target.Host, payloadHash, amzDate)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{http.MethodPut, target.EscapedPath(), "", canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, s.region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), dateStamp)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req, err := http.NewRequest(http.MethodPut, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 returned status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
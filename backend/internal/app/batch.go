@@ -0,0 +1,147 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- BATCH REQUESTS ---
+//
+// POST /api/batch runs a list of API requests in one round trip, for bulk
+// actions in the UI such as tagging fifty cards at once. Each one goes
+// through the router like any other request, with the batch's token, so
+// it's authorized, validated and rate limited the same way. They run one
+// after another, in order; one failing doesn't stop the rest, and each
+// gets its own status and body in the response.
+
+const BATCH_MAX_REQUESTS = 100
+
+// batchExcludedPaths can't be reached from inside a batch.
+var batchExcludedPaths = map[string]bool{
+	"/api/batch":  true,
+	"/api/crm/ws": true,
+}
+
+// batchHeaders are the only headers a request in a batch can set. Anything
+// else, such as Authorization, Cookie or X-Forwarded-For, would let one
+// request act differently from the batch it came in.
+var batchHeaders = map[string]bool{
+	"If-Match": true, "If-None-Match": true, "Idempotency-Key": true,
+}
+
+var batchMethods = map[string]bool{
+	http.MethodGet: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+}
+
+type batchRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body"`
+	// Headers can only be those in batchHeaders; the batch's own
+	// Authorization always applies.
+	Headers map[string]string `json:"headers"`
+}
+
+type batchResult struct {
+	Status int `json:"status"`
+	// Body is the response as JSON, or as a string when it isn't JSON.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// batchRecorder collects a sub-request's response.
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchRecorder) Header() http.Header { return w.header }
+
+func (w *batchRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *batchRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *batchRecorder) result() batchResult {
+	res := batchResult{Status: w.status}
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	switch body := bytes.TrimSpace(w.body.Bytes()); {
+	case len(body) == 0:
+	case json.Valid(body):
+		res.Body = body
+	default:
+		res.Body, _ = json.Marshal(string(body))
+	}
+	return res
+}
+
+func batchHandler(router http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var requests []batchRequest
+		if !bindJSON(c, &requests) {
+			return
+		}
+		fe := fieldErrors{}
+		fe.check(len(requests) > 0, "requests", "can't be empty")
+		fe.check(len(requests) <= BATCH_MAX_REQUESTS, "requests", fmt.Sprintf("can't be more than %d", BATCH_MAX_REQUESTS))
+		for i, req := range requests {
+			field := fmt.Sprintf("[%d]", i)
+			fe.check(batchMethods[strings.ToUpper(req.Method)], field+".method", "must be GET, POST, PUT, PATCH or DELETE")
+			u, err := url.Parse(req.Path)
+			fe.check(err == nil && u.Host == "" && strings.HasPrefix(u.Path, "/api/") && !batchExcludedPaths[u.Path], field+".path", "must be an /api/ path other than /api/batch")
+			for name := range req.Headers {
+				fe.check(batchHeaders[http.CanonicalHeaderKey(name)], field+".headers", "can only be If-Match, If-None-Match and Idempotency-Key")
+			}
+		}
+		if fe.respond(c) {
+			return
+		}
+
+		results := make([]batchResult, len(requests))
+		for i, req := range requests {
+			results[i] = runBatchRequest(c, router, req)
+		}
+		c.JSON(http.StatusOK, results)
+	}
+}
+
+func runBatchRequest(c *gin.Context, router http.Handler, req batchRequest) batchResult {
+	var body bytes.Buffer
+	if len(req.Body) > 0 && string(req.Body) != "null" {
+		body.Write(req.Body)
+	}
+	sub, err := http.NewRequestWithContext(c.Request.Context(), strings.ToUpper(req.Method), req.Path, &body)
+	if err != nil {
+		res, _ := json.Marshal(gin.H{"error": "Invalid request"})
+		return batchResult{Status: http.StatusBadRequest, Body: res}
+	}
+	for name, value := range req.Headers {
+		if batchHeaders[http.CanonicalHeaderKey(name)] {
+			sub.Header.Set(name, value)
+		}
+	}
+	sub.Header.Set("Content-Type", "application/json")
+	sub.Header.Set("Authorization", c.GetHeader("Authorization"))
+	sub.Header.Set("Accept-Language", c.GetHeader("Accept-Language"))
+	sub.RemoteAddr = c.Request.RemoteAddr
+
+	w := &batchRecorder{header: http.Header{}}
+	router.ServeHTTP(w, sub)
+	return w.result()
+}
@@ -0,0 +1,403 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/auth"
+	"blueleads-backend/internal/store"
+)
+
+// --- PLANS ---
+const FREE_PLAN = "free"
+
+type Plan struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	StripePriceID string `json:"-"`
+	Quotas        Quotas `json:"quotas"`
+	TeamSeats     int    `json:"teamSeats"`
+	Integrations  bool   `json:"integrations"`
+}
+
+// seedPlans creates the built-in plans. Paid plan limits can be tuned in the
+// table afterwards; the free plan follows the QUOTA_* variables and price
+// IDs follow STRIPE_PRICE_* on every start.
+func seedPlans() {
+	plans := []Plan{
+		{ID: FREE_PLAN, Name: "Free", Quotas: defaultQuotas, TeamSeats: 1},
+		{ID: "pro", Name: "Pro", Quotas: Quotas{SearchesPerMonth: 200, MaxLeads: 20000, MaxConcurrentScrapes: 3}, TeamSeats: 1, Integrations: true},
+		{ID: "agency", Name: "Agency", Quotas: Quotas{SearchesPerMonth: 1000, MaxLeads: 100000, MaxConcurrentScrapes: 10}, TeamSeats: 10, Integrations: true},
+	}
+	for _, p := range plans {
+		_, err := db.Exec(`INSERT OR IGNORE INTO plans (id, name, searches_per_month, max_leads, max_concurrent_scrapes, team_seats, integrations)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`, p.ID, p.Name, p.Quotas.SearchesPerMonth, p.Quotas.MaxLeads, p.Quotas.MaxConcurrentScrapes, p.TeamSeats, p.Integrations)
+		if err != nil {
+			log.Fatal("Failed to seed plans:", err)
+		}
+	}
+
+	_, err := db.Exec("UPDATE plans SET searches_per_month = ?, max_leads = ?, max_concurrent_scrapes = ? WHERE id = ?",
+		defaultQuotas.SearchesPerMonth, defaultQuotas.MaxLeads, defaultQuotas.MaxConcurrentScrapes, FREE_PLAN)
+	if err != nil {
+		log.Fatal("Failed to update free plan:", err)
+	}
+	for planID, env := range map[string]string{"pro": "STRIPE_PRICE_PRO", "agency": "STRIPE_PRICE_AGENCY"} {
+		if price := os.Getenv(env); price != "" {
+			if _, err := db.Exec("UPDATE plans SET stripe_price_id = ? WHERE id = ?", price, planID); err != nil {
+				log.Fatal("Failed to set plan price:", err)
+			}
+		}
+	}
+}
+
+const planSelectColumns = "p.id, p.name, p.stripe_price_id, p.searches_per_month, p.max_leads, p.max_concurrent_scrapes, p.team_seats, p.integrations"
+
+func scanPlan(row store.RowScanner) (Plan, error) {
+	var p Plan
+	err := row.Scan(&p.ID, &p.Name, &p.StripePriceID, &p.Quotas.SearchesPerMonth, &p.Quotas.MaxLeads, &p.Quotas.MaxConcurrentScrapes, &p.TeamSeats, &p.Integrations)
+	return p, err
+}
+
+// planForUser falls back to the free plan if the user's plan was removed.
+func planForUser(ctx context.Context, userID int64) (Plan, error) {
+	plan, err := scanPlan(db.QueryRowContext(ctx, "SELECT "+planSelectColumns+" FROM users u JOIN plans p ON p.id = u.plan_id WHERE u.id = ?", userID))
+	if err == sql.ErrNoRows {
+		return scanPlan(db.QueryRowContext(ctx, "SELECT "+planSelectColumns+" FROM plans p WHERE p.id = ?", FREE_PLAN))
+	}
+	return plan, err
+}
+
+// requireIntegrations guards routes that connect to third-party services,
+// which only paid plans include.
+func requireIntegrations() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		plan, err := planForUser(c.Request.Context(), userID.(int64))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load plan"})
+			return
+		}
+		if !plan.Integrations {
+			c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": fmt.Sprintf("Integrations are not included in the %s plan", plan.Name)})
+			return
+		}
+		c.Next()
+	}
+}
+
+func getMeHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	var user auth.User
+	var isAdmin bool
+	var subscriptionStatus string
+	err := db.QueryRowContext(c.Request.Context(), "SELECT id, name, email, is_admin, subscription_status FROM users WHERE id = ?", userID).Scan(&user.ID, &user.Name, &user.Email, &isAdmin, &subscriptionStatus)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	plan, err := planForUser(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load plan"})
+		return
+	}
+	features, err := featuresFor(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load features"})
+		return
+	}
+
+	me := gin.H{"id": user.ID, "name": user.Name, "email": user.Email, "isAdmin": isAdmin, "plan": plan, "subscriptionStatus": subscriptionStatus,
+		"teamId": tenantFrom(c).OrgID, "features": features}
+	if adminID, ok := c.Get("impersonatedBy"); ok {
+		me["impersonatedBy"] = adminID
+	}
+	c.JSON(http.StatusOK, me)
+}
+
+// --- STRIPE ---
+const STRIPE_API_URL = "https://api.stripe.com/v1"
+
+// Webhooks signed longer ago than this are rejected as possible replays.
+const STRIPE_WEBHOOK_TOLERANCE = 5 * time.Minute
+
+var stripeSecretKey = os.Getenv("STRIPE_SECRET_KEY")
+var stripeWebhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+var billingReturnURL = envOrDefault("BILLING_RETURN_URL", "http://localhost:5173/settings")
+var stripeClient = &http.Client{Timeout: 20 * time.Second}
+
+// stripePost calls a Stripe API endpoint with form-encoded params and
+// decodes the JSON response into out.
+func stripePost(path string, params url.Values, out interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, STRIPE_API_URL+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+stripeSecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := stripeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("stripe returned status %d: %s", resp.StatusCode, apiErr.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func createCheckoutHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	if stripeSecretKey == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Billing is not configured"})
+		return
+	}
+	var input struct {
+		Plan string `json:"plan" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	plan, err := scanPlan(db.QueryRowContext(c.Request.Context(), "SELECT "+planSelectColumns+" FROM plans p WHERE p.id = ?", input.Plan))
+	if err != nil || plan.StripePriceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Plan '%s' cannot be purchased", input.Plan)})
+		return
+	}
+
+	var email string
+	var customerID sql.NullString
+	if err := db.QueryRowContext(c.Request.Context(), "SELECT email, stripe_customer_id FROM users WHERE id = ?", userID).Scan(&email, &customerID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	uid := strconv.FormatInt(userID.(int64), 10)
+	params := url.Values{}
+	params.Set("mode", "subscription")
+	params.Set("line_items[0][price]", plan.StripePriceID)
+	params.Set("line_items[0][quantity]", "1")
+	params.Set("success_url", billingReturnURL+"?checkout=success")
+	params.Set("cancel_url", billingReturnURL+"?checkout=cancelled")
+	params.Set("client_reference_id", uid)
+	params.Set("subscription_data[metadata][user_id]", uid)
+	if customerID.Valid && customerID.String != "" {
+		params.Set("customer", customerID.String)
+	} else {
+		params.Set("customer_email", email)
+	}
+
+	var session struct {
+		URL string `json:"url"`
+	}
+	if err := stripePost("/checkout/sessions", params, &session); err != nil {
+		log.Printf("Failed to create checkout session for user %s: %v", uid, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to start checkout"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": session.URL})
+}
+
+// createBillingPortalHandler sends subscribers to Stripe's portal to change
+// plan, update their card or cancel.
+func createBillingPortalHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	if stripeSecretKey == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Billing is not configured"})
+		return
+	}
+	var customerID sql.NullString
+	if err := db.QueryRowContext(c.Request.Context(), "SELECT stripe_customer_id FROM users WHERE id = ?", userID).Scan(&customerID); err != nil || !customerID.Valid || customerID.String == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You don't have a subscription yet"})
+		return
+	}
+
+	params := url.Values{}
+	params.Set("customer", customerID.String)
+	params.Set("return_url", billingReturnURL)
+	var session struct {
+		URL string `json:"url"`
+	}
+	if err := stripePost("/billing_portal/sessions", params, &session); err != nil {
+		log.Printf("Failed to create billing portal session for user %d: %v", userID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to open billing portal"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": session.URL})
+}
+
+// verifyStripeSignature checks the Stripe-Signature header, which holds a
+// timestamp and one or more HMAC-SHA256 signatures of "timestamp.payload".
+func verifyStripeSignature(payload []byte, header string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("malformed signature header")
+	}
+	if now.Sub(time.Unix(ts, 0)).Abs() > STRIPE_WEBHOOK_TOLERANCE {
+		return fmt.Errorf("signature timestamp outside tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(stripeWebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, sig := range signatures {
+		if got, err := hex.DecodeString(sig); err == nil && hmac.Equal(got, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching signature")
+}
+
+type stripeSubscription struct {
+	ID       string `json:"id"`
+	Customer string `json:"customer"`
+	Status   string `json:"status"`
+	Metadata struct {
+		UserID string `json:"user_id"`
+	} `json:"metadata"`
+	Items struct {
+		Data []struct {
+			Price struct {
+				ID string `json:"id"`
+			} `json:"price"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+func stripeWebhookHandler(c *gin.Context) {
+	if stripeWebhookSecret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Billing is not configured"})
+		return
+	}
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+		return
+	}
+	if err := verifyStripeSignature(payload, c.GetHeader("Stripe-Signature"), time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event"})
+		return
+	}
+
+	// Stripe delivers events at least once, and a captured request can be
+	// resent within the signature tolerance; each event is applied only once.
+	res, err := db.ExecContext(c.Request.Context(), "INSERT OR IGNORE INTO stripe_events (id) VALUES (?)", event.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle event"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusOK, gin.H{"received": true})
+		return
+	}
+
+	switch event.Type {
+	case "checkout.session.completed":
+		var session struct {
+			ClientReferenceID string `json:"client_reference_id"`
+			Customer          string `json:"customer"`
+			Subscription      string `json:"subscription"`
+		}
+		if err = json.Unmarshal(event.Data.Object, &session); err == nil {
+			_, err = db.ExecContext(c.Request.Context(), "UPDATE users SET stripe_customer_id = ?, stripe_subscription_id = ? WHERE id = ?", session.Customer, session.Subscription, session.ClientReferenceID)
+		}
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var sub stripeSubscription
+		if err = json.Unmarshal(event.Data.Object, &sub); err == nil {
+			err = applySubscription(c.Request.Context(), sub, event.Type == "customer.subscription.deleted")
+		}
+	}
+	if err != nil {
+		// A non-2xx makes Stripe retry the event later.
+		log.Printf("Failed to handle Stripe event %s (%s): %v", event.ID, event.Type, err)
+		// Forget the event so the retry is applied.
+		if _, err := db.ExecContext(context.WithoutCancel(c.Request.Context()), "DELETE FROM stripe_events WHERE id = ?", event.ID); err != nil {
+			log.Printf("Failed to release Stripe event %s: %v", event.ID, err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle event"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// applySubscription moves the subscriber onto the plan matching the
+// subscription's price while it is in good standing, and back to free
+// otherwise.
+func applySubscription(ctx context.Context, sub stripeSubscription, deleted bool) error {
+	if deleted {
+		// Only the user's current subscription ending downgrades them; an old
+		// one being cleaned up after a plan change must not.
+		_, err := db.ExecContext(ctx, "UPDATE users SET plan_id = ?, subscription_status = 'canceled' WHERE stripe_subscription_id = ?", FREE_PLAN, sub.ID)
+		return err
+	}
+
+	planID := FREE_PLAN
+	if (sub.Status == "active" || sub.Status == "trialing") && len(sub.Items.Data) > 0 {
+		err := db.QueryRowContext(ctx, "SELECT id FROM plans WHERE stripe_price_id = ? AND stripe_price_id != ''", sub.Items.Data[0].Price.ID).Scan(&planID)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no plan has price %s", sub.Items.Data[0].Price.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Subscriptions from checkout carry the user ID; ones created in the
+	// Stripe dashboard are matched on the customer instead.
+	res, err := db.ExecContext(ctx, `UPDATE users SET plan_id = ?, subscription_status = ?, stripe_subscription_id = ?, stripe_customer_id = ?
+        WHERE id = ? OR (? = '' AND stripe_customer_id = ?)`, planID, sub.Status, sub.ID, sub.Customer, sub.Metadata.UserID, sub.Metadata.UserID, sub.Customer)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("Stripe subscription %s matches no user", sub.ID)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/store"
+)
+
+// --- BOARD COLUMNS ---
+
+func crmService(c *gin.Context) crm.Service {
+	return crm.NewService(repoFrom(c).Crm())
+}
+
+func getCrmColumnsHandler(c *gin.Context) {
+	columns, err := crmService(c).Columns()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load columns"})
+		return
+	}
+	c.JSON(http.StatusOK, columns)
+}
+
+func createCrmColumnHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Title string `json:"title" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	col, err := crmService(c).CreateColumn(input.Title)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create column"})
+		return
+	}
+	crmChanged(c, repo)
+	c.JSON(http.StatusCreated, col)
+}
+
+// updateCrmColumnHandler renames a column, moves it to a new zero-based
+// position and/or changes its WIP limit.
+func updateCrmColumnHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input crm.ColumnUpdate
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if err := input.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	columns, err := crmService(c).UpdateColumn(c.Param("columnId"), input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Column not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update column"})
+		return
+	}
+	crmChanged(c, repo)
+	c.JSON(http.StatusOK, columns)
+}
+
+func deleteCrmColumnHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+	err := crmService(c).DeleteColumn(c.Param("columnId"))
+	switch err {
+	case nil:
+		crmChanged(c, repo)
+		c.Status(http.StatusNoContent)
+	case store.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Column not found"})
+	case crm.ErrBuiltInColumn:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Built-in columns can't be deleted"})
+	case crm.ErrColumnInUse:
+		c.JSON(http.StatusConflict, gin.H{"error": "Move the leads out of this column before deleting it"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete column"})
+	}
+}
+
+// --- TAGS ---
+
+func addCrmTagHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Tag string `json:"tag" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tag, err := crm.NormalizeTag(input.Tag)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	err = repo.AddCrmTag(c.Param("leadId"), tag, nil)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to tag lead"})
+		return
+	}
+	version := crmChanged(c, repo)
+	c.JSON(http.StatusOK, gin.H{"tag": tag, "version": version})
+}
+
+func removeCrmTagHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+	err := repo.RemoveCrmTag(c.Param("leadId"), c.Param("tag"), nil)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found on lead"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove tag"})
+		return
+	}
+	crmChanged(c, repo)
+	c.Status(http.StatusNoContent)
+}
+
+// --- PRIORITY ---
+//
+// Every card is hot, warm (the default) or cold, set by hand or by an
+// automation rule. Hot cards come first in their column on the board and
+// in the dialer queue, and the callbacks view can put them first too.
+
+const (
+	PRIORITY_HOT  = "hot"
+	PRIORITY_WARM = "warm"
+	PRIORITY_COLD = "cold"
+)
+
+var priorities = []string{PRIORITY_HOT, PRIORITY_WARM, PRIORITY_COLD}
+
+var priorityTitles = map[string]string{PRIORITY_HOT: "Hot", PRIORITY_WARM: "Warm", PRIORITY_COLD: "Cold"}
+
+// priorityRank orders priorities hottest first.
+func priorityRank(priority string) int {
+	for i, p := range priorities {
+		if p == priority {
+			return i
+		}
+	}
+	return len(priorities)
+}
+
+// priorityOrderSQL ranks a crm_leads priority column the way priorityRank
+// does, for ORDER BY.
+func priorityOrderSQL(column string) string {
+	return "CASE " + column + " WHEN '" + PRIORITY_HOT + "' THEN 0 WHEN '" + PRIORITY_WARM + "' THEN 1 ELSE 2 END"
+}
+
+func setCrmPriorityHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Priority string `json:"priority" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if priorityRank(input.Priority) == len(priorities) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "priority must be one of " + strings.Join(priorities, ", ")})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	err := repo.SetCrmPriority(c.Param("leadId"), input.Priority, nil)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set priority"})
+		return
+	}
+	version := crmChanged(c, repo)
+	c.JSON(http.StatusOK, gin.H{"priority": input.Priority, "version": version})
+}
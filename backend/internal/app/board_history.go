@@ -0,0 +1,138 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- BOARD HISTORY ---
+//
+// Once an hour every board's column counts are written down against the
+// current UTC day, so the last snapshot of a day is how the board looked
+// at its end. Together with the column moves already in the activity log,
+// that shows how the pipeline changed over time.
+
+// snapshotBoards records today's card count for every column of every
+// organization's board, including empty columns.
+func snapshotBoards() {
+	day := time.Now().UTC().Format("2006-01-02")
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to snapshot boards: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM crm_board_snapshots WHERE day = ?", day); err != nil {
+		log.Printf("Failed to snapshot boards: %v", err)
+		return
+	}
+	_, err = tx.Exec(`
+        INSERT INTO crm_board_snapshots (org_id, day, column_id, cards)
+        SELECT col.org_id, ?, col.id,
+               (SELECT COUNT(*) FROM crm_leads l WHERE l.org_id = col.org_id AND l.column_id = col.id AND l.deleted_at IS NULL)
+        FROM crm_columns col
+    `, day)
+	if err != nil {
+		log.Printf("Failed to snapshot boards: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to snapshot boards: %v", err)
+	}
+}
+
+// BoardPeriod is one day or week of board history. Columns holds the
+// counts from the period's last snapshot, and is null if none was taken.
+type BoardPeriod struct {
+	Start   string         `json:"start"`
+	Columns map[string]int `json:"columns"`
+	Moves   []ColumnMove   `json:"moves"`
+}
+
+// getBoardHistoryHandler returns the board's history between ?from and
+// ?to (UTC dates, default the last twelve weeks) by ?interval=week (the
+// default, weeks starting Monday) or day.
+func getBoardHistoryHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	interval := c.DefaultQuery("interval", "week")
+	if interval != "week" && interval != "day" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be week or day"})
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	to := today
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date (YYYY-MM-DD)"})
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -7*12+1)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date (YYYY-MM-DD)"})
+			return
+		}
+		from = t
+	}
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+		return
+	}
+	if interval == "week" {
+		from = from.AddDate(0, 0, -(int(from.Weekday())+6)%7)
+	}
+
+	fromDay, toDay := from.Format("2006-01-02"), to.Format("2006-01-02")
+	snapshots, err := repo.BoardSnapshots(fromDay, toDay)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load board history"})
+		return
+	}
+	moves, err := repo.ColumnMoves(fromDay, toDay)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load board history"})
+		return
+	}
+
+	step := 1
+	if interval == "week" {
+		step = 7
+	}
+	var periods []BoardPeriod
+	for start := from; !start.After(to); start = start.AddDate(0, 0, step) {
+		p := BoardPeriod{Start: start.Format("2006-01-02"), Moves: []ColumnMove{}}
+		end := start.AddDate(0, 0, step-1)
+		for day := start; !day.After(end) && !day.After(to); day = day.AddDate(0, 0, 1) {
+			if counts, ok := snapshots[day.Format("2006-01-02")]; ok {
+				p.Columns = counts
+			}
+		}
+		endDay := end.Format("2006-01-02")
+		totals := map[[2]string]int{}
+		for _, m := range moves {
+			if m.Day >= p.Start && m.Day <= endDay {
+				totals[[2]string{m.From, m.To}] += m.Count
+			}
+		}
+		for k, n := range totals {
+			p.Moves = append(p.Moves, ColumnMove{From: k[0], To: k[1], Count: n})
+		}
+		sort.Slice(p.Moves, func(i, j int) bool {
+			if p.Moves[i].Count != p.Moves[j].Count {
+				return p.Moves[i].Count > p.Moves[j].Count
+			}
+			return p.Moves[i].From+p.Moves[i].To < p.Moves[j].From+p.Moves[j].To
+		})
+		periods = append(periods, p)
+	}
+	c.JSON(http.StatusOK, gin.H{"interval": interval, "periods": periods})
+}
@@ -0,0 +1,564 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- BOOKING PAGES ---
+//
+// Each user can publish a booking page at /book/<slug> where prospects
+// pick a time for a call themselves. Free slots come from the user's
+// weekly availability, in their timezone setting, minus the callbacks on
+// their cards and what's already booked. A booking is logged as
+// meeting_booked on the CRM card whose email matches the prospect's, and
+// goes into the user's calendar when their connected mail account has one.
+// An address can hold one upcoming booking per page, so nobody can fill
+// the diary from a single form. Since anyone can post the form, it's
+// limited per client IP and asks for the captcha when one is configured.
+
+// bookingURL is this server's public /book/ address, which booking links
+// are built on.
+var bookingURL = envOrDefault("BOOKING_URL", "http://localhost:8080/book/")
+
+var bookingSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Each client IP may post booking forms this many times per window.
+var bookingIPLimit = envInt("BOOKING_IP_LIMIT", 10)
+var bookingIPWindow = time.Duration(envInt("BOOKING_IP_WINDOW_MINUTES", 60)) * time.Minute
+
+var errBookingSlotTaken = errors.New("the slot isn't free")
+var errAlreadyBooked = errors.New("the address already has an upcoming booking")
+
+// defaultBookingAvailability is weekday office hours.
+var defaultBookingAvailability = map[string][]string{
+	"monday": {"9:00-17:00"}, "tuesday": {"9:00-17:00"}, "wednesday": {"9:00-17:00"}, "thursday": {"9:00-17:00"}, "friday": {"9:00-17:00"},
+}
+
+// BookingPage is a user's public booking page.
+type BookingPage struct {
+	Slug            string `json:"slug"`
+	Title           string `json:"title"`
+	Intro           string `json:"intro"`
+	DurationMinutes int    `json:"durationMinutes"`
+	// Availability is when calls can be booked each week, in the same
+	// form as a lead's opening hours: {"monday": ["9:00-12:00", ...]}.
+	Availability   map[string][]string `json:"availability"`
+	MinNoticeHours int                 `json:"minNoticeHours"`
+	HorizonDays    int                 `json:"horizonDays"`
+	Enabled        bool                `json:"enabled"`
+	URL            string              `json:"url"`
+
+	userID int64
+	orgID  int64
+}
+
+func (p *BookingPage) validate(fe fieldErrors) {
+	p.Slug = strings.ToLower(strings.TrimSpace(p.Slug))
+	fe.check(bookingSlugPattern.MatchString(p.Slug) && len(p.Slug) >= 3 && len(p.Slug) <= 40, "slug", "must be 3 to 40 letters, digits and single hyphens")
+	checkLength(fe, "title", p.Title, 1, 100)
+	checkLength(fe, "intro", p.Intro, 0, 1000)
+	if p.DurationMinutes == 0 {
+		p.DurationMinutes = 30
+	}
+	fe.check(p.DurationMinutes >= 10 && p.DurationMinutes <= 240, "durationMinutes", "must be between 10 and 240")
+	if p.Availability == nil {
+		p.Availability = defaultBookingAvailability
+	}
+	for day, ranges := range p.Availability {
+		_, ok := leads.ParseWeekday(day)
+		fe.check(ok, "availability", fmt.Sprintf("%q isn't a day of the week", day))
+		for _, r := range ranges {
+			_, ok := leads.ParseHoursRange(r)
+			fe.check(ok, "availability", fmt.Sprintf("%q isn't a time range like 9:00-17:00", r))
+		}
+	}
+	fe.check(p.MinNoticeHours >= 0 && p.MinNoticeHours <= 168, "minNoticeHours", "must be between 0 and 168")
+	if p.HorizonDays == 0 {
+		p.HorizonDays = 14
+	}
+	fe.check(p.HorizonDays >= 1 && p.HorizonDays <= 60, "horizonDays", "must be between 1 and 60")
+}
+
+// Booking is a call a prospect booked.
+type Booking struct {
+	ID        string    `json:"id"`
+	LeadID    string    `json:"leadId"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Company   string    `json:"company"`
+	Phone     string    `json:"phone"`
+	Notes     string    `json:"notes"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// bookingSlots lists the free start times from the page's notice period
+// up to its horizon. busy holds the start and end of everything already
+// in the diary.
+func bookingSlots(page BookingPage, loc *time.Location, busy [][2]time.Time, now time.Time) []time.Time {
+	hours := leads.ParseOpeningHours(page.Availability)
+	duration := time.Duration(page.DurationMinutes) * time.Minute
+	earliest := now.Add(time.Duration(page.MinNoticeHours) * time.Hour)
+	today := now.In(loc)
+	var slots []time.Time
+	for offset := 0; offset < page.HorizonDays; offset++ {
+		day := time.Date(today.Year(), today.Month(), today.Day()+offset, 0, 0, 0, 0, loc)
+		for _, iv := range hours.IntervalsOn(day.Weekday()) {
+			for m := iv[0]; m+page.DurationMinutes <= iv[1]; m += page.DurationMinutes {
+				// Built from the wall clock rather than midnight plus an
+				// offset, so slots keep their times across DST changes.
+				start := time.Date(day.Year(), day.Month(), day.Day(), m/60, m%60, 0, 0, loc)
+				if start.Before(earliest) || overlapsBusy(start, start.Add(duration), busy) {
+					continue
+				}
+				slots = append(slots, start)
+			}
+		}
+	}
+	return slots
+}
+
+func overlapsBusy(start, end time.Time, busy [][2]time.Time) bool {
+	for _, b := range busy {
+		if start.Before(b[1]) && b[0].Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// freeBookingSlots loads the owner's diary and works out the page's free
+// slots.
+func freeBookingSlots(repo *Repository, page BookingPage, loc *time.Location, now time.Time) ([]time.Time, error) {
+	busy, err := repo.BusyTimes(now)
+	if err != nil {
+		return nil, err
+	}
+	return bookingSlots(page, loc, busy, now), nil
+}
+
+// bookSlot saves a booking for a slot that's still free and logs it on
+// the prospect's card, if they have one.
+func bookSlot(repo *Repository, page BookingPage, loc *time.Location, b *Booking, now time.Time) error {
+	tx, err := db.BeginTx(repo.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	slots, err := freeBookingSlots(txRepo, page, loc, now)
+	if err != nil {
+		return err
+	}
+	free := false
+	for _, s := range slots {
+		free = free || s.Equal(b.StartsAt)
+	}
+	if !free {
+		return errBookingSlotTaken
+	}
+	if booked, err := txRepo.HasUpcomingBooking(b.Email, now); err != nil || booked {
+		if err == nil {
+			err = errAlreadyBooked
+		}
+		return err
+	}
+	if b.LeadID, err = txRepo.LeadByEmail(b.Email); err != nil && err != store.ErrNotFound {
+		return err
+	}
+	b.ID = uuid.New().String()
+	b.EndsAt = b.StartsAt.Add(time.Duration(page.DurationMinutes) * time.Minute)
+	b.CreatedAt = now
+	if err := txRepo.CreateBooking(*b); err != nil {
+		return err
+	}
+	if b.LeadID != "" {
+		// The booking becomes a meeting on the card, which logs it.
+		m := newMeeting(txRepo.Tenant(), b.LeadID, meetingInput{
+			Title: page.Title, StartsAt: b.StartsAt, EndsAt: b.EndsAt, Attendees: []string{b.Name + " <" + b.Email + ">"}, Outcome: MEETING_SCHEDULED, Notes: b.Notes,
+		}, b.ID)
+		if err := createMeeting(txRepo, m); err != nil {
+			return err
+		}
+		if _, err := txRepo.Crm().BumpVersion(); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addBookingToCalendar puts the booking in the owner's calendar, when
+// their mail account has one. Failing only costs the event, so it's
+// logged rather than returned.
+func addBookingToCalendar(repo *Repository, page BookingPage, b Booking) {
+	account, err := repo.MailAccount()
+	if err != nil {
+		return
+	}
+	p := mailProviders[account.Provider]
+	if p == nil || p.calendar == nil {
+		return
+	}
+	token, err := mailAccountToken(repo, p, account)
+	if err != nil {
+		repo.SetMailAccountError(err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(repo.ctx, 15*time.Second)
+	defer cancel()
+
+	who := b.Name
+	if b.Company != "" {
+		who += " (" + b.Company + ")"
+	}
+	description := fmt.Sprintf("Booked through %s%s\nEmail: %s\n", bookingURL, page.Slug, b.Email)
+	if b.Phone != "" {
+		description += "Phone: " + b.Phone + "\n"
+	}
+	if b.Notes != "" {
+		description += "\n" + b.Notes + "\n"
+	}
+	if b.LeadID != "" {
+		description += "\n" + appURL + "/crm?lead=" + b.LeadID + "\n"
+	}
+	eventID, err := p.calendar.save(ctx, token, "", calendarEvent{Subject: page.Title + ": " + who, Description: description, Start: b.StartsAt, Duration: b.EndsAt.Sub(b.StartsAt)})
+	if err == nil {
+		err = repo.SetBookingEvent(b.ID, eventID)
+	}
+	if err != nil {
+		log.Printf("Failed to add booking %s to the calendar of user %d: %v", b.ID, repo.Tenant().UserID, err)
+	}
+}
+
+// --- BOOKING PAGE HANDLERS ---
+
+func getBookingPageHandler(c *gin.Context) {
+	page, err := repoFrom(c).BookingPage()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No booking page is set up"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load booking page"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// putBookingPageHandler sets up the user's booking page or changes it.
+// Changing the slug retires the old link.
+func putBookingPageHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input BookingPage
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) {
+		return
+	}
+	err := repo.SaveBookingPage(input)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		c.JSON(http.StatusConflict, gin.H{"error": "That booking link is taken"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save booking page"})
+		return
+	}
+	page, err := repo.BookingPage()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load booking page"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+func deleteBookingPageHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteBookingPage()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No booking page is set up"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete booking page"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listBookingsHandler returns the user's bookings that haven't ended yet,
+// soonest first.
+func listBookingsHandler(c *gin.Context) {
+	bookings, err := repoFrom(c).Bookings(time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load bookings"})
+		return
+	}
+	c.JSON(http.StatusOK, bookings)
+}
+
+// --- PUBLIC BOOKING PAGE ---
+
+var bookingPageTemplate = template.Must(template.New("booking").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{if .Found}}{{.Title}}{{else}}Booking{{end}}</title></head>
+<body style="font-family: sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem">
+{{if .Logo}}<img src="{{.Logo}}" alt="{{.Agency}}" style="max-height: 4rem; max-width: 15rem">{{end}}
+{{if not .Found}}
+<h1>Link not recognised</h1>
+<p>This booking link isn't active.</p>
+{{else if .Booked}}
+<h1 style="color: {{.Primary}}">You're booked</h1>
+<p>{{.Booked}} ({{.Timezone}}) with {{.Owner}}{{if .Agency}} of {{.Agency}}{{end}}. See you then.</p>
+{{else}}
+<h1 style="color: {{.Primary}}">{{.Title}}</h1>
+<p>A {{.Duration}}-minute call with {{.Owner}}{{if .Agency}} of {{.Agency}}{{end}}.{{if .Intro}} {{.Intro}}{{end}}</p>
+{{if .Error}}<p style="color: #b00020">{{.Error}}</p>{{end}}
+{{if .Days}}
+<form method="post">
+<p>Times are in {{.Timezone}}.</p>
+{{range .Days}}
+<fieldset style="margin-bottom: 1rem"><legend>{{.Label}}</legend>
+{{range .Slots}}<label style="display: inline-block; margin: 0 1rem 0.5rem 0"><input type="radio" name="slot" value="{{.Value}}" required{{if .Checked}} checked{{end}}> {{.Label}}</label>{{end}}
+</fieldset>
+{{end}}
+<p><label>Your name<br><input name="name" value="{{.Form.Name}}" required maxlength="100"></label></p>
+<p><label>Email<br><input type="email" name="email" value="{{.Form.Email}}" required maxlength="254"></label></p>
+<p><label>Company<br><input name="company" value="{{.Form.Company}}" maxlength="200"></label></p>
+<p><label>Phone<br><input type="tel" name="phone" value="{{.Form.Phone}}" maxlength="50"></label></p>
+<p><label>Anything we should know?<br><textarea name="notes" rows="3" maxlength="1000">{{.Form.Notes}}</textarea></label></p>
+{{with .Captcha}}<script src="{{.Script}}" async defer></script>
+<div class="{{.Class}}" data-sitekey="{{.SiteKey}}" style="margin-bottom: 1rem"></div>{{end}}
+<button type="submit" style="background: {{.Accent}}; color: #fff; border: 0; border-radius: 4px; padding: 0.5rem 1.5rem">Book</button>
+</form>
+{{else}}
+<p>There are no free times at the moment. Please check back later.</p>
+{{end}}
+{{end}}
+{{if .Footer}}<p style="margin-top: 2rem; color: #555; font-size: 0.875rem">{{.Footer}}</p>{{end}}
+</body>
+</html>
+`))
+
+type bookingSlotOption struct {
+	Value   string
+	Label   string
+	Checked bool
+}
+
+type bookingDay struct {
+	Label string
+	Slots []bookingSlotOption
+}
+
+type bookingPageData struct {
+	Found    bool
+	Title    string
+	Intro    string
+	Owner    string
+	Duration int
+	Timezone string
+	Days     []bookingDay
+	Form     Booking
+	Chosen   string
+	Error    string
+	Booked   string
+	Captcha  *captchaWidget
+
+	// The owner's branding; see branding.go.
+	Agency  string
+	Logo    template.URL
+	Primary string
+	Accent  string
+	Footer  string
+}
+
+func renderBookingPage(c *gin.Context, status int, data bookingPageData) {
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	if err := bookingPageTemplate.Execute(c.Writer, data); err != nil {
+		log.Printf("Failed to render booking page: %v", err)
+	}
+}
+
+// loadPublicBookingPage finds the enabled page for the slug and its
+// owner's details, writing the error page itself when it can't.
+func loadPublicBookingPage(c *gin.Context) (BookingPage, *Repository, *time.Location, bookingPageData, bool) {
+	page, err := bookingPageBySlug(c.Request.Context(), c.Param("slug"))
+	if err == nil && !page.Enabled {
+		err = store.ErrNotFound
+	}
+	if err == store.ErrNotFound {
+		renderBookingPage(c, http.StatusNotFound, bookingPageData{})
+		return page, nil, nil, bookingPageData{}, false
+	}
+	var owner string
+	var settings UserSettings
+	if err == nil {
+		err = db.QueryRowContext(c.Request.Context(), "SELECT name FROM users WHERE id = ?", page.userID).Scan(&owner)
+	}
+	if err == nil {
+		settings, err = getUserSettings(c.Request.Context(), page.userID)
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return page, nil, nil, bookingPageData{}, false
+	}
+	repo := newRepository(Tenant{OrgID: page.orgID, UserID: page.userID})
+	branding, err := repo.Branding()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return page, nil, nil, bookingPageData{}, false
+	}
+	loc := settings.location()
+	data := bookingPageData{Found: true, Title: page.Title, Intro: page.Intro, Owner: owner, Duration: page.DurationMinutes, Timezone: loc.String(),
+		Agency: branding.AgencyName, Logo: dataURI(branding.logoImage()), Primary: branding.primary(), Accent: branding.accent(), Footer: branding.FooterText,
+		Captcha: formCaptcha()}
+	return page, repo, loc, data, true
+}
+
+// countBookingAttempt counts a booking form posted from ip and reports
+// whether the IP is still within its limit for the window.
+func countBookingAttempt(ctx context.Context, ip string, now time.Time) (bool, error) {
+	var attempts int
+	windowStart := now.Add(-bookingIPWindow)
+	err := db.QueryRowContext(ctx, `
+        INSERT INTO booking_attempts (ip, attempts, window_start) VALUES (?, 1, ?)
+        ON CONFLICT (ip) DO UPDATE SET
+            attempts = CASE WHEN window_start < ? THEN 1 ELSE attempts + 1 END,
+            window_start = CASE WHEN window_start < ? THEN excluded.window_start ELSE window_start END
+        RETURNING attempts
+    `, ip, now, windowStart, windowStart).Scan(&attempts)
+	return attempts <= bookingIPLimit, err
+}
+
+// purgeBookingAttempts drops counts whose window has ended.
+func purgeBookingAttempts() {
+	if _, err := db.Exec("DELETE FROM booking_attempts WHERE window_start < ?", time.Now().UTC().Add(-bookingIPWindow)); err != nil {
+		log.Printf("Failed to purge booking attempts: %v", err)
+	}
+}
+
+// fillBookingDays lists the free slots on the page, grouped by day.
+func fillBookingDays(repo *Repository, page BookingPage, loc *time.Location, data *bookingPageData) error {
+	slots, err := freeBookingSlots(repo, page, loc, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, s := range slots {
+		local := s.In(loc)
+		label := local.Format("Monday 2 January")
+		if len(data.Days) == 0 || data.Days[len(data.Days)-1].Label != label {
+			data.Days = append(data.Days, bookingDay{Label: label})
+		}
+		value := s.UTC().Format(time.RFC3339)
+		day := &data.Days[len(data.Days)-1]
+		day.Slots = append(day.Slots, bookingSlotOption{Value: value, Label: local.Format("15:04"), Checked: value == data.Chosen})
+	}
+	return nil
+}
+
+func bookingPageHandler(c *gin.Context) {
+	page, repo, loc, data, ok := loadPublicBookingPage(c)
+	if !ok {
+		return
+	}
+	if err := fillBookingDays(repo, page, loc, &data); err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	renderBookingPage(c, http.StatusOK, data)
+}
+
+// bookHandler takes a booking from the page's form. Problems re-show the
+// page with what the prospect entered.
+func bookHandler(c *gin.Context) {
+	page, repo, loc, data, ok := loadPublicBookingPage(c)
+	if !ok {
+		return
+	}
+	allowed, err := countBookingAttempt(c.Request.Context(), c.ClientIP(), time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to count booking attempt on page %s: %v", page.Slug, err)
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	captchaSolved := true
+	if allowed && data.Captcha != nil {
+		captchaSolved, err = verifyCaptcha(c.Request.Context(), c.PostForm(data.Captcha.field), c.ClientIP())
+		if err != nil {
+			log.Printf("Failed to verify captcha: %v", err)
+			c.String(http.StatusServiceUnavailable, "Couldn't check the captcha; please try again.")
+			return
+		}
+	}
+	b := Booking{
+		Name:    strings.TrimSpace(c.PostForm("name")),
+		Email:   strings.TrimSpace(c.PostForm("email")),
+		Company: strings.TrimSpace(c.PostForm("company")),
+		Phone:   strings.TrimSpace(c.PostForm("phone")),
+		Notes:   strings.TrimSpace(c.PostForm("notes")),
+	}
+	data.Form, data.Chosen = b, c.PostForm("slot")
+	fe := fieldErrors{}
+	checkLength(fe, "name", b.Name, 1, 100)
+	fe.check(validEmail(b.Email), "email", "must be a valid email address")
+	checkLength(fe, "company", b.Company, 0, 200)
+	checkLength(fe, "phone", b.Phone, 0, 50)
+	checkLength(fe, "notes", b.Notes, 0, 1000)
+	startsAt, err := time.Parse(time.RFC3339, data.Chosen)
+	fe.check(err == nil, "slot", "pick a time")
+	b.StartsAt = startsAt.UTC()
+
+	status := http.StatusBadRequest
+	switch {
+	case !allowed:
+		status, data.Error = http.StatusTooManyRequests, "There have been too many booking attempts from your network. Please try again later."
+	case !captchaSolved:
+		data.Error = "Please complete the captcha check."
+	case len(fe) > 0:
+		data.Error = "Please pick a time and enter your name and a valid email address."
+	default:
+		err = bookSlot(repo, page, loc, &b, time.Now().UTC())
+		switch err {
+		case nil:
+			addBookingToCalendar(repo, page, b)
+			notifyUser(page.userID, pushMessage{Title: "New booking", Body: fmt.Sprintf("%s booked %s", b.Name, b.StartsAt.In(loc).Format("Mon 2 Jan 15:04")), URL: "/bookings", Tag: "booking-" + b.ID})
+			data.Booked = b.StartsAt.In(loc).Format("Monday 2 January at 15:04")
+			renderBookingPage(c, http.StatusOK, data)
+			return
+		case errBookingSlotTaken:
+			status, data.Error = http.StatusConflict, "Sorry, that time has just gone. Please pick another."
+		case errAlreadyBooked:
+			status, data.Error = http.StatusConflict, "You already have a call booked. Get in touch if you need to change it."
+		default:
+			log.Printf("Failed to book slot on page %s: %v", page.Slug, err)
+			c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+			return
+		}
+	}
+	if err := fillBookingDays(repo, page, loc, &data); err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	renderBookingPage(c, status, data)
+}
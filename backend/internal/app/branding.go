@@ -0,0 +1,271 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- WHITE-LABEL BRANDING ---
+//
+// Agencies send what they make here to their own prospects, so each user
+// can brand it as theirs: an agency name (the organization's name until
+// set), a logo, a primary colour for headings, an accent colour and a
+// footer line. Audit and pipeline reports, the public booking page and
+// emails sent on the user's behalf all carry it. The logo is kept as an
+// attachment and served from /api/settings/branding/logo.
+
+const (
+	BRANDING_LOGO_MAX_BYTES  = 256 * 1024
+	BRANDING_LOGO_MAX_PIXELS = 2000
+
+	DEFAULT_PRIMARY_COLOR = "#222222"
+	DEFAULT_ACCENT_COLOR  = "#1a73e8"
+)
+
+var brandColorRe = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+type Branding struct {
+	AgencyName string `json:"agencyName"`
+	// Colours are #rrggbb, empty for the defaults.
+	PrimaryColor string `json:"primaryColor"`
+	AccentColor  string `json:"accentColor"`
+	FooterText   string `json:"footerText"`
+	// Logo is the path to fetch the logo from, empty when there's none.
+	Logo string `json:"logo"`
+
+	orgName string
+	logoKey string
+}
+
+func brandingLogoKey(userID int64) string {
+	return fmt.Sprintf("logos/%d", userID)
+}
+
+// name is who reports and pages are from.
+func (b Branding) name() string {
+	if b.AgencyName != "" {
+		return b.AgencyName
+	}
+	return b.orgName
+}
+
+func (b Branding) primary() string {
+	if b.PrimaryColor != "" {
+		return b.PrimaryColor
+	}
+	return DEFAULT_PRIMARY_COLOR
+}
+
+func (b Branding) accent() string {
+	if b.AccentColor != "" {
+		return b.AccentColor
+	}
+	return DEFAULT_ACCENT_COLOR
+}
+
+// logoImage returns the logo's bytes, nil when there's none. A logo that
+// has gone missing just leaves it off.
+func (b Branding) logoImage() []byte {
+	if b.logoKey == "" {
+		return nil
+	}
+	data, err := readAttachment(b.logoKey)
+	if err != nil {
+		log.Printf("Failed to read logo %s: %v", b.logoKey, err)
+		return nil
+	}
+	return data
+}
+
+// dataURI embeds an image in a page, so it shows without a login.
+func dataURI(image []byte) template.URL {
+	if len(image) == 0 {
+		return ""
+	}
+	return template.URL("data:" + http.DetectContentType(image) + ";base64," + base64.StdEncoding.EncodeToString(image))
+}
+
+// applyPDF colours the report's headings, sets its footer and draws the
+// logo at the top of the page.
+func (b Branding) applyPDF(w *pdfWriter) {
+	w.SetColors(b.primary(), b.accent())
+	w.SetFooter(b.FooterText)
+	if logo := b.logoImage(); logo != nil {
+		if err := w.Image(logo, 160, 48); err != nil {
+			log.Printf("Failed to draw logo %s: %v", b.logoKey, err)
+		}
+	}
+}
+
+// sender puts the agency name on a From address.
+func (b Branding) sender(address string) string {
+	if b.AgencyName == "" {
+		return address
+	}
+	return (&mail.Address{Name: b.AgencyName, Address: envelopeAddress(address)}).String()
+}
+
+// emailFooter goes under the body of an email sent as the user.
+func (b Branding) emailFooter() string {
+	if b.FooterText == "" {
+		return ""
+	}
+	return "\n\n" + b.FooterText
+}
+
+func getBrandingHandler(c *gin.Context) {
+	b, err := repoFrom(c).Branding()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load branding"})
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+// updateBrandingHandler changes the branding's text and colours; fields
+// left out keep their values, and an empty colour goes back to the
+// default.
+func updateBrandingHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		AgencyName   *string `json:"agencyName"`
+		PrimaryColor *string `json:"primaryColor"`
+		AccentColor  *string `json:"accentColor"`
+		FooterText   *string `json:"footerText"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	b, err := repo.Branding()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load branding"})
+		return
+	}
+
+	fe := fieldErrors{}
+	if input.AgencyName != nil {
+		b.AgencyName = strings.TrimSpace(*input.AgencyName)
+		checkLength(fe, "agencyName", b.AgencyName, 0, 100)
+	}
+	for _, color := range []struct {
+		field string
+		in    *string
+		out   *string
+	}{{"primaryColor", input.PrimaryColor, &b.PrimaryColor}, {"accentColor", input.AccentColor, &b.AccentColor}} {
+		if color.in != nil {
+			*color.out = strings.ToLower(strings.TrimSpace(*color.in))
+			fe.check(*color.out == "" || brandColorRe.MatchString(*color.out), color.field, "must be a colour like #1a73e8")
+		}
+	}
+	if input.FooterText != nil {
+		b.FooterText = strings.TrimSpace(*input.FooterText)
+		checkLength(fe, "footerText", b.FooterText, 0, 500)
+	}
+	if fe.respond(c) {
+		return
+	}
+
+	if err := repo.SaveBranding(b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save branding"})
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+func getBrandingLogoHandler(c *gin.Context) {
+	b, err := repoFrom(c).Branding()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load branding"})
+		return
+	}
+	if b.logoKey == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No logo uploaded"})
+		return
+	}
+	logo, err := readAttachment(b.logoKey)
+	if os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No logo uploaded"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load logo"})
+		return
+	}
+	c.Header("Cache-Control", "private, no-cache")
+	c.Data(http.StatusOK, http.DetectContentType(logo), logo)
+}
+
+// uploadBrandingLogoHandler replaces the logo with the PNG or JPEG in the
+// multipart field "logo".
+func uploadBrandingLogoHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	file, err := c.FormFile("logo")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload the logo as the multipart field \"logo\""})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read logo"})
+		return
+	}
+	logo, err := io.ReadAll(io.LimitReader(f, BRANDING_LOGO_MAX_BYTES+1))
+	f.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read logo"})
+		return
+	}
+	if len(logo) > BRANDING_LOGO_MAX_BYTES {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("The logo must be at most %d KB", BRANDING_LOGO_MAX_BYTES/1024)})
+		return
+	}
+	if kind := http.DetectContentType(logo); kind != "image/png" && kind != "image/jpeg" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The logo must be a PNG or JPEG image"})
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(logo))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The logo must be a PNG or JPEG image"})
+		return
+	}
+	if config.Width > BRANDING_LOGO_MAX_PIXELS || config.Height > BRANDING_LOGO_MAX_PIXELS {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The logo must be at most %d pixels on each side", BRANDING_LOGO_MAX_PIXELS)})
+		return
+	}
+
+	key := brandingLogoKey(repo.Tenant().UserID)
+	if err := putAttachment(key, logo); err != nil {
+		log.Printf("Failed to store logo %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save logo"})
+		return
+	}
+	if err := repo.SetBrandingLogo(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save logo"})
+		return
+	}
+	getBrandingHandler(c)
+}
+
+func deleteBrandingLogoHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if err := repo.SetBrandingLogo(""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete logo"})
+		return
+	}
+	if err := deleteAttachment(brandingLogoKey(repo.Tenant().UserID)); err != nil {
+		log.Printf("Failed to delete logo for user %d: %v", repo.Tenant().UserID, err)
+	}
+	c.Status(http.StatusNoContent)
+}
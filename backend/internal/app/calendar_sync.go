@@ -0,0 +1,148 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- CALENDAR SYNC ---
+//
+// A user whose connected mail account has a calendar (Microsoft 365) can
+// turn on calendarSync to keep their callbacks there as events with a
+// reminder. A background job adds an event when a callback is booked,
+// moves it when the callback is rescheduled and deletes it when the
+// callback is cleared or the card leaves the board. A user's callbacks are
+// those on the cards they put on the board, the same ones they get push
+// notifications for. Callbacks already past when the job first sees them
+// aren't added.
+
+const CALENDAR_SYNC_INTERVAL = time.Minute
+const CALENDAR_EVENT_DURATION = 15 * time.Minute
+const CALENDAR_REMINDER_MINUTES = 10
+
+// calendarAPI is a provider's calendar.
+type calendarAPI struct {
+	// save updates the event with eventID, or creates one when eventID is
+	// empty or the event is gone, returning its ID.
+	save   func(ctx context.Context, accessToken, eventID string, ev calendarEvent) (string, error)
+	remove func(ctx context.Context, accessToken, eventID string) error
+}
+
+type calendarEvent struct {
+	Subject     string
+	Description string
+	Start       time.Time
+	Duration    time.Duration
+}
+
+// calendarChange is a callback whose event needs saving or, when
+// callbackAt is nil, deleting.
+type calendarChange struct {
+	leadID      string
+	companyName string
+	callbackAt  *time.Time
+	eventID     string
+}
+
+// syncCalendars is the background job that brings every synced calendar
+// up to date.
+func syncCalendars() {
+	tenants, err := calendarSyncTenants()
+	if err != nil {
+		log.Printf("Failed to load synced calendars: %v", err)
+		return
+	}
+	for _, t := range tenants {
+		if err := syncCalendar(newRepository(t)); err != nil {
+			log.Printf("Failed to sync the calendar of user %d: %v", t.UserID, err)
+		}
+	}
+}
+
+// syncCalendar saves or deletes the events of the tenant user's callbacks
+// that have changed since the last sync.
+func syncCalendar(repo *Repository) error {
+	account, err := repo.MailAccount()
+	if err != nil {
+		return err
+	}
+	p := mailProviders[account.Provider]
+	if p == nil || p.calendar == nil || !account.CalendarSync {
+		return nil
+	}
+	changes, err := repo.CalendarChanges()
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	token, err := mailAccountToken(repo, p, account)
+	if err != nil {
+		return repo.SetMailAccountError(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(repo.ctx, time.Minute)
+	defer cancel()
+	now := time.Now()
+	for _, ch := range changes {
+		if ch.callbackAt == nil {
+			if ch.eventID != "" {
+				if err := p.calendar.remove(ctx, token, ch.eventID); err != nil {
+					return err
+				}
+			}
+			if err := repo.DeleteCalendarEvent(ch.leadID); err != nil {
+				return err
+			}
+			continue
+		}
+		eventID := ch.eventID
+		if eventID != "" || ch.callbackAt.After(now) {
+			eventID, err = p.calendar.save(ctx, token, eventID, calendarEvent{
+				Subject:     "Call back " + ch.companyName,
+				Description: "Callback booked in BlueLeads: " + appURL + "/crm?lead=" + ch.leadID,
+				Start:       *ch.callbackAt,
+				Duration:    CALENDAR_EVENT_DURATION,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := repo.SaveCalendarEvent(ch.leadID, eventID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func calendarSyncTenants() ([]Tenant, error) {
+	rows, err := db.Query("SELECT org_id, user_id FROM mail_accounts WHERE calendar_sync = 1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tenants []Tenant
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.OrgID, &t.UserID); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// scanCalendarChange reads one row of CalendarChanges.
+func scanCalendarChange(s store.RowScanner) (calendarChange, error) {
+	var ch calendarChange
+	var callbackAt sql.NullTime
+	if err := s.Scan(&ch.leadID, &ch.companyName, &callbackAt, &ch.eventID); err != nil {
+		return ch, err
+	}
+	if callbackAt.Valid {
+		ch.callbackAt = &callbackAt.Time
+	}
+	return ch, nil
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- CALLBACKS ---
+//
+// The callbacks view lists every card with a callback booked, across all
+// columns, so reps don't have to scan the board for red dates. Days are
+// the user's own, as in the daily digest.
+
+// callbackRange returns the span of callback times a ?due= value covers:
+// "overdue" is anything before today, "today" is today and "week" is today
+// and the six days after. Either end may be nil.
+func callbackRange(due string, loc *time.Location, now time.Time) (from, to *time.Time, ok bool) {
+	local := now.In(loc)
+	startOfDay := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	switch due {
+	case "":
+		return nil, nil, true
+	case "overdue":
+		return nil, &startOfDay, true
+	case "today":
+		end := startOfDay.AddDate(0, 0, 1)
+		return &startOfDay, &end, true
+	case "week":
+		end := startOfDay.AddDate(0, 0, 7)
+		return &startOfDay, &end, true
+	}
+	return nil, nil, false
+}
+
+// getCallbacksHandler returns the cards whose callback falls in ?due=
+// (overdue, today or week; every booked callback if it's left out),
+// soonest first, or hottest first and then soonest with ?sort=priority.
+func getCallbacksHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	from, to, ok := callbackRange(c.Query("due"), settings.location(), time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "due must be overdue, today or week"})
+		return
+	}
+	byPriority := c.Query("sort") == "priority"
+	if v := c.Query("sort"); v != "" && !byPriority {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be priority"})
+		return
+	}
+
+	leads, err := repo.CallbackCrmLeads()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch callbacks"})
+		return
+	}
+	due := []CrmLead{}
+	for _, l := range leads {
+		if from != nil && l.CallBackDate.Before(*from) {
+			continue
+		}
+		if to != nil && !l.CallBackDate.Before(*to) {
+			continue
+		}
+		due = append(due, l)
+	}
+	if byPriority {
+		sort.SliceStable(due, func(i, j int) bool { return priorityRank(due[i].Priority) < priorityRank(due[j].Priority) })
+	}
+	c.JSON(http.StatusOK, due)
+}
@@ -0,0 +1,578 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/store"
+)
+
+// --- EMAIL CAMPAIGNS ---
+//
+// A campaign emails one template to every card on the board that matches
+// a filter (a column, a tag, a status and/or a segment). Starting it fixes the
+// recipients and copies the template, so later edits to either don't
+// change what goes out. Cards without a usable address are kept as
+// excluded recipients with the reason: no email, a malformed one, one
+// verification found undeliverable, one on the suppression list, or one
+// another card already gets.
+//
+// A background job sends to queued recipients from the start time on,
+// never more than the campaign's hourly limit in any hour and spread
+// across the hour rather than all at once. Suppressions are checked again
+// just before each email, so a do-not-contact request made mid-campaign
+// is honoured. Emails go out through the creator's connected mail
+// account when they have one, within its daily limit.
+
+const (
+	CAMPAIGN_DRAFT     = "draft"
+	CAMPAIGN_SCHEDULED = "scheduled" // started; sends from StartAt until every recipient is done
+	CAMPAIGN_PAUSED    = "paused"
+	CAMPAIGN_COMPLETED = "completed"
+	CAMPAIGN_CANCELLED = "cancelled"
+)
+
+const (
+	RECIPIENT_QUEUED   = "queued"
+	RECIPIENT_SENT     = "sent"
+	RECIPIENT_FAILED   = "failed"
+	RECIPIENT_EXCLUDED = "excluded"
+)
+
+// Why a recipient was excluded.
+const (
+	EXCLUDED_NO_EMAIL      = "no_email"
+	EXCLUDED_INVALID_EMAIL = "invalid_email"
+	EXCLUDED_UNDELIVERABLE = "undeliverable"
+	EXCLUDED_SUPPRESSED    = "suppressed"
+	EXCLUDED_DUPLICATE     = "duplicate"
+	EXCLUDED_REMOVED       = "removed" // the card left the board before its turn
+	EXCLUDED_CANCELLED     = "cancelled"
+)
+
+const CAMPAIGN_SEND_INTERVAL = time.Minute
+const CAMPAIGN_DEFAULT_HOURLY_LIMIT = 50
+const CAMPAIGN_MAX_HOURLY_LIMIT = 1000
+const CAMPAIGN_RECIPIENTS_LIMIT = 500
+
+// CampaignFilter picks the cards a campaign goes to; empty fields match
+// every card.
+type CampaignFilter struct {
+	Column   string `json:"column"`
+	Tag      string `json:"tag"`
+	StatusID string `json:"statusId"`
+	// SegmentID narrows the campaign to the segment's members when it
+	// starts.
+	SegmentID string `json:"segmentId"`
+}
+
+type Campaign struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	TemplateID  string         `json:"templateId"`
+	Filter      CampaignFilter `json:"filter"`
+	HourlyLimit int            `json:"hourlyLimit"`
+	// StartAt is when sending begins; nil means as soon as it's started.
+	StartAt     *time.Time `json:"startAt"`
+	Status      string     `json:"status"`
+	CreatedBy   int64      `json:"createdBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	StartedAt   *time.Time `json:"startedAt"`
+	CompletedAt *time.Time `json:"completedAt"`
+	// Subject and Body are the template as it was when the campaign
+	// started.
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+	// Counts has the number of recipients in each status.
+	Counts map[string]int `json:"counts"`
+}
+
+type CampaignRecipient struct {
+	LeadID      string     `json:"leadId"`
+	CompanyName string     `json:"companyName"`
+	Email       string     `json:"email"`
+	Status      string     `json:"status"`
+	Reason      string     `json:"reason,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	SentAt      *time.Time `json:"sentAt"`
+	// UnsubscribedAt is when they used the email's unsubscribe link.
+	UnsubscribedAt *time.Time `json:"unsubscribedAt"`
+	// RepliedAt is when their first reply arrived, if a mailbox is
+	// connected.
+	RepliedAt *time.Time `json:"repliedAt"`
+
+	unsubscribeToken string
+}
+
+type campaignInput struct {
+	Name        string         `json:"name" binding:"required"`
+	TemplateID  string         `json:"templateId" binding:"required,uuid"`
+	Filter      CampaignFilter `json:"filter"`
+	HourlyLimit int            `json:"hourlyLimit"`
+	StartAt     *time.Time     `json:"startAt"`
+}
+
+func (in *campaignInput) validate(fe fieldErrors, repo *Repository) {
+	in.Name = strings.TrimSpace(in.Name)
+	checkLength(fe, "name", in.Name, 1, 100)
+	tpl, err := repo.MessageTemplate(in.TemplateID)
+	fe.check(err == nil, "templateId", "must be one of your templates")
+	if err == nil {
+		fe.check(tpl.Channel == TEMPLATE_EMAIL, "templateId", "must be an email template")
+	}
+	if in.Filter.Column != "" {
+		fe.check(repo.Crm().HasColumn(in.Filter.Column), "filter.column", "must be one of the board's columns")
+	}
+	if in.Filter.Tag != "" {
+		tag, err := crm.NormalizeTag(in.Filter.Tag)
+		if err != nil {
+			fe.check(false, "filter.tag", err.Error())
+		}
+		in.Filter.Tag = tag
+	}
+	if in.Filter.StatusID != "" {
+		fe.check(repo.Crm().HasStatus(in.Filter.StatusID), "filter.statusId", "must be one of the board's statuses")
+	}
+	if in.Filter.SegmentID != "" {
+		_, err := repo.Segment(in.Filter.SegmentID)
+		fe.check(err == nil, "filter.segmentId", "must be one of your segments")
+	}
+	if in.HourlyLimit == 0 {
+		in.HourlyLimit = CAMPAIGN_DEFAULT_HOURLY_LIMIT
+	}
+	fe.check(in.HourlyLimit >= 1 && in.HourlyLimit <= CAMPAIGN_MAX_HOURLY_LIMIT, "hourlyLimit", "must be between 1 and 1000")
+}
+
+// campaignRecipient decides whether a card gets the campaign. verification
+// is the verifier's verdict on the card's address, if it was checked, and
+// seen holds the addresses already taken by other cards.
+func campaignRecipient(l CrmLead, verification string, suppressions suppressionSet, seen map[string]bool) CampaignRecipient {
+	email := strings.TrimSpace(l.Email)
+	r := CampaignRecipient{LeadID: l.ID, CompanyName: l.CompanyName, Email: email, Status: RECIPIENT_EXCLUDED}
+	key := strings.ToLower(email)
+	switch {
+	case email == "":
+		r.Reason = EXCLUDED_NO_EMAIL
+	case !validEmail(email):
+		r.Reason = EXCLUDED_INVALID_EMAIL
+	case verification == EMAIL_INVALID:
+		r.Reason = EXCLUDED_UNDELIVERABLE
+	case suppressions.has(SUPPRESS_EMAIL, email):
+		r.Reason = EXCLUDED_SUPPRESSED
+	case seen[key]:
+		r.Reason = EXCLUDED_DUPLICATE
+	default:
+		seen[key] = true
+		r.Status = RECIPIENT_QUEUED
+	}
+	return r
+}
+
+// campaignBatchSize is how many emails a campaign may send on one pass of
+// the job: its share of the hourly limit per interval, and no more than
+// what's left of the limit for the past hour.
+func campaignBatchSize(hourlyLimit, sentLastHour int) int {
+	perPass := (hourlyLimit*int(CAMPAIGN_SEND_INTERVAL/time.Second) + 3599) / 3600
+	if left := hourlyLimit - sentLastHour; left < perPass {
+		return left
+	}
+	return perPass
+}
+
+// sendDueCampaigns is the background job that sends the next batch of
+// every campaign that's due, as the user who created it.
+func sendDueCampaigns() {
+	sendCampaignBatches(time.Now().UTC())
+}
+
+// campaignSender sends one campaign email; userMailSender in production.
+type campaignSender func(to, subject, body string, headers map[string]string) error
+
+func sendCampaignBatches(now time.Time) {
+	rows, err := db.Query("SELECT id, org_id, user_id FROM campaigns WHERE status = ? AND (start_at IS NULL OR start_at <= ?)", CAMPAIGN_SCHEDULED, now)
+	if err != nil {
+		log.Printf("Failed to load due campaigns: %v", err)
+		return
+	}
+	type due struct {
+		id     string
+		tenant Tenant
+	}
+	var campaigns []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.tenant.OrgID, &d.tenant.UserID); err != nil {
+			log.Printf("Error scanning campaign: %v", err)
+			continue
+		}
+		campaigns = append(campaigns, d)
+	}
+	rows.Close()
+
+	for _, d := range campaigns {
+		repo := newRepository(d.tenant)
+		if !canSendMail(repo) {
+			continue
+		}
+		if err := sendCampaignBatch(repo, d.id, now, userMailSender(repo)); err != nil {
+			log.Printf("Failed to send campaign %s: %v", d.id, err)
+		}
+	}
+}
+
+// sendCampaignBatch sends one pass's worth of a campaign's queued emails,
+// and marks the campaign completed once none are left. When the sender's
+// mail account is over its daily limit or can't be used, the rest stay
+// queued for a later pass.
+func sendCampaignBatch(repo *Repository, campaignID string, now time.Time, send campaignSender) error {
+	campaign, err := repo.Campaign(campaignID)
+	if err != nil {
+		return err
+	}
+	sent, err := repo.CampaignSentSince(campaignID, now.Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	limit := campaignBatchSize(campaign.HourlyLimit, sent)
+	if limit <= 0 {
+		return nil
+	}
+	recipients, err := repo.QueuedCampaignRecipients(campaignID, limit)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return repo.SetCampaignStatus(campaignID, CAMPAIGN_COMPLETED)
+	}
+	suppressions, err := loadSuppressions(db, repo.Tenant().OrgID)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range recipients {
+		if !repo.Crm().HasCard(r.LeadID) || r.Email == "" {
+			err = repo.SetCampaignRecipientStatus(campaignID, r.LeadID, RECIPIENT_EXCLUDED, EXCLUDED_REMOVED, "")
+		} else if suppressions.has(SUPPRESS_EMAIL, r.Email) {
+			err = repo.SetCampaignRecipientStatus(campaignID, r.LeadID, RECIPIENT_EXCLUDED, EXCLUDED_SUPPRESSED, "")
+		} else {
+			err = sendCampaignEmail(repo, campaign, r, send)
+		}
+		if errors.Is(err, errMailAccountDailyLimit) || errors.Is(err, errMailAccountUnavailable) {
+			log.Printf("Pausing campaign %s until its mail account can send: %v", campaignID, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendCampaignEmail fills the campaign in for one recipient and sends it
+// with the user's branded footer and the recipient's unsubscribe link,
+// recording whether it went.
+func sendCampaignEmail(repo *Repository, campaign Campaign, r CampaignRecipient, send campaignSender) error {
+	values, err := leadTemplateValues(context.Background(), repo, r.LeadID)
+	if err != nil {
+		return err
+	}
+	msg := renderTemplate(MessageTemplate{Channel: TEMPLATE_EMAIL, Subject: campaign.Subject, Body: campaign.Body}, r.LeadID, values)
+	headers := unsubscribeHeaders(r.unsubscribeToken)
+	// The Message-ID is kept so replies can be matched to the email.
+	headers["Message-ID"] = newMessageID()
+	branding, err := repo.Branding()
+	if err != nil {
+		return err
+	}
+	err = send(r.Email, msg.Subject, msg.Body+branding.emailFooter()+unsubscribeFooter(r.unsubscribeToken), headers)
+	if errors.Is(err, errMailAccountDailyLimit) || errors.Is(err, errMailAccountUnavailable) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to send campaign %s to lead %s: %v", campaign.ID, r.LeadID, err)
+		return repo.SetCampaignRecipientStatus(campaign.ID, r.LeadID, RECIPIENT_FAILED, "", err.Error())
+	}
+	if err := repo.SetCampaignRecipientStatus(campaign.ID, r.LeadID, RECIPIENT_SENT, "", ""); err != nil {
+		return err
+	}
+	if err := repo.SetCampaignRecipientMessageID(campaign.ID, r.LeadID, headers["Message-ID"]); err != nil {
+		return err
+	}
+	return repo.logActivity(r.LeadID, "email_sent", map[string]interface{}{"campaignId": campaign.ID, "subject": msg.Subject})
+}
+
+// campaignResponse loads a campaign for a handler to return, writing the
+// error response itself when it can't.
+func campaignResponse(c *gin.Context, repo *Repository, campaignID string) (Campaign, bool) {
+	campaign, err := repo.Campaign(campaignID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return campaign, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load campaign"})
+		return campaign, false
+	}
+	return campaign, true
+}
+
+func getCampaignsHandler(c *gin.Context) {
+	campaigns, err := repoFrom(c).Campaigns()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve campaigns"})
+		return
+	}
+	c.JSON(http.StatusOK, campaigns)
+}
+
+func getCampaignHandler(c *gin.Context) {
+	if campaign, ok := campaignResponse(c, repoFrom(c), c.Param("campaignId")); ok {
+		c.JSON(http.StatusOK, campaign)
+	}
+}
+
+func createCampaignHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input campaignInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe, repo)
+	if fe.respond(c) {
+		return
+	}
+
+	id := uuid.New().String()
+	if err := repo.CreateCampaign(id, input); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create campaign"})
+		return
+	}
+	if campaign, ok := campaignResponse(c, repo, id); ok {
+		c.JSON(http.StatusCreated, campaign)
+	}
+}
+
+// updateCampaignHandler changes a campaign that hasn't started yet.
+func updateCampaignHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	campaignID := c.Param("campaignId")
+	var input campaignInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe, repo)
+	if fe.respond(c) {
+		return
+	}
+
+	err := repo.UpdateCampaign(campaignID, input)
+	if err == store.ErrNotFound {
+		if _, ok := campaignResponse(c, repo, campaignID); ok {
+			c.JSON(http.StatusConflict, gin.H{"error": "Campaign has already started"})
+		}
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update campaign"})
+		return
+	}
+	if campaign, ok := campaignResponse(c, repo, campaignID); ok {
+		c.JSON(http.StatusOK, campaign)
+	}
+}
+
+func deleteCampaignHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteCampaign(c.Param("campaignId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete campaign"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// startCampaignHandler fixes a draft campaign's recipients and template
+// and schedules it.
+func startCampaignHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !canSendMail(repo) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email is not configured"})
+		return
+	}
+	campaignID := c.Param("campaignId")
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	campaign, ok := campaignResponse(c, txRepo, campaignID)
+	if !ok {
+		return
+	}
+	if campaign.Status != CAMPAIGN_DRAFT {
+		c.JSON(http.StatusConflict, gin.H{"error": "Campaign has already started"})
+		return
+	}
+	tpl, err := txRepo.MessageTemplate(campaign.TemplateID)
+	fe := fieldErrors{}
+	fe.check(err == nil && tpl.Channel == TEMPLATE_EMAIL, "templateId", "must be an email template")
+	if fe.respond(c) {
+		return
+	}
+
+	if err := startCampaign(txRepo, campaign, tpl); err != nil {
+		log.Printf("Failed to start campaign %s: %v", campaignID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start campaign"})
+		return
+	}
+	if campaign, ok = campaignResponse(c, txRepo, campaignID); !ok {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start campaign"})
+		return
+	}
+	c.JSON(http.StatusOK, campaign)
+}
+
+// startCampaign queues or excludes every card matching the campaign's
+// filter and schedules it with tpl's subject and body.
+func startCampaign(repo *Repository, campaign Campaign, tpl MessageTemplate) error {
+	leads, err := repo.CampaignLeads(campaign.Filter)
+	if err != nil {
+		return err
+	}
+	if campaign.Filter.SegmentID != "" {
+		if leads, err = inSegment(repo, campaign.Filter.SegmentID, leads); err != nil {
+			return err
+		}
+	}
+	suppressions, err := loadSuppressions(repo.q, repo.Tenant().OrgID)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, l := range leads {
+		verification, err := repo.EmailVerification(l.ID, l.Email)
+		if err != nil {
+			return err
+		}
+		if err := repo.AddCampaignRecipient(campaign.ID, campaignRecipient(l, verification, suppressions, seen)); err != nil {
+			return err
+		}
+	}
+	return repo.ScheduleCampaign(campaign.ID, tpl.Subject, tpl.Body)
+}
+
+// inSegment keeps the leads that are in the segment.
+func inSegment(repo *Repository, segmentID string, leads []CrmLead) ([]CrmLead, error) {
+	_, members, err := segmentMembers(repo, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	isMember := make(map[string]bool, len(members))
+	for _, m := range members {
+		isMember[m.ID] = true
+	}
+	kept := leads[:0]
+	for _, l := range leads {
+		if isMember[l.ID] {
+			kept = append(kept, l)
+		}
+	}
+	return kept, nil
+}
+
+// setCampaignStatusHandler returns a handler that moves a campaign from
+// one of the from statuses to status.
+func setCampaignStatusHandler(status string, from ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo := repoFrom(c)
+		campaignID := c.Param("campaignId")
+		campaign, ok := campaignResponse(c, repo, campaignID)
+		if !ok {
+			return
+		}
+		allowed := false
+		for _, s := range from {
+			allowed = allowed || campaign.Status == s
+		}
+		if !allowed {
+			c.JSON(http.StatusConflict, gin.H{"error": "Campaign can't be " + status + " while " + campaign.Status})
+			return
+		}
+		if err := repo.SetCampaignStatus(campaignID, status); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update campaign"})
+			return
+		}
+		if campaign, ok = campaignResponse(c, repo, campaignID); ok {
+			c.JSON(http.StatusOK, campaign)
+		}
+	}
+}
+
+// getCampaignRecipientsHandler pages through a campaign's recipients with
+// limit and offset, optionally only those with ?status=.
+func getCampaignRecipientsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	campaignID := c.Param("campaignId")
+	limit, offset := CAMPAIGN_RECIPIENTS_LIMIT, 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > CAMPAIGN_RECIPIENTS_LIMIT {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+			return
+		}
+		limit = n
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a whole number"})
+			return
+		}
+		offset = n
+	}
+	if _, ok := campaignResponse(c, repo, campaignID); !ok {
+		return
+	}
+	recipients, err := repo.CampaignRecipients(campaignID, c.Query("status"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load recipients"})
+		return
+	}
+	c.JSON(http.StatusOK, recipients)
+}
+
+// scanCampaignTimes fills in a campaign's optional times.
+func scanCampaignTimes(campaign *Campaign, startAt, startedAt, completedAt sql.NullTime) {
+	if startAt.Valid {
+		campaign.StartAt = &startAt.Time
+	}
+	if startedAt.Valid {
+		campaign.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		campaign.CompletedAt = &completedAt.Time
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- REGISTRATION CAPTCHA ---
+//
+// Public deployments can make sign-ups solve an hCaptcha or Cloudflare
+// Turnstile challenge, so bots can't create accounts and use up scraper
+// capacity. The frontend renders the widget with the site key from
+// GET /captcha and sends its token as captchaToken; the server checks the
+// token with the provider before creating the account. Public booking
+// pages render the same widget themselves (see booking.go).
+
+var captchaVerifyURLs = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+var captchaProvider = strings.ToLower(os.Getenv("CAPTCHA_PROVIDER"))
+var captchaSiteKey = os.Getenv("CAPTCHA_SITE_KEY")
+var captchaSecret = os.Getenv("CAPTCHA_SECRET")
+
+// captchaWidget is how a provider's challenge goes on a server-rendered
+// form: the script to load, the element it fills in, and the form field
+// the solved token is posted in.
+type captchaWidget struct {
+	Script  string
+	Class   string
+	SiteKey string
+	field   string
+}
+
+var captchaWidgets = map[string]captchaWidget{
+	"hcaptcha":  {Script: "https://js.hcaptcha.com/1/api.js", Class: "h-captcha", field: "h-captcha-response"},
+	"turnstile": {Script: "https://challenges.cloudflare.com/turnstile/v0/api.js", Class: "cf-turnstile", field: "cf-turnstile-response"},
+}
+
+// formCaptcha returns the configured provider's widget, or nil when the
+// captcha is off.
+func formCaptcha() *captchaWidget {
+	if !captchaEnabled() {
+		return nil
+	}
+	w := captchaWidgets[captchaProvider]
+	w.SiteKey = captchaSiteKey
+	return &w
+}
+
+// captchaVerifyURL can be pointed elsewhere for testing.
+var captchaVerifyURL = envOrDefault("CAPTCHA_VERIFY_URL", captchaVerifyURLs[captchaProvider])
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+func captchaEnabled() bool {
+	return captchaProvider != ""
+}
+
+// checkCaptchaConfig stops the server at startup if the captcha is only
+// half set up, rather than failing every sign-up.
+func checkCaptchaConfig() {
+	if !captchaEnabled() {
+		return
+	}
+	if _, ok := captchaVerifyURLs[captchaProvider]; !ok {
+		log.Fatalf("CAPTCHA_PROVIDER must be hcaptcha or turnstile, not %q", captchaProvider)
+	}
+	if captchaSiteKey == "" || captchaSecret == "" {
+		log.Fatal("CAPTCHA_PROVIDER needs CAPTCHA_SITE_KEY and CAPTCHA_SECRET")
+	}
+}
+
+// getCaptchaHandler tells the frontend which widget to show, if any.
+func getCaptchaHandler(c *gin.Context) {
+	if !captchaEnabled() {
+		c.JSON(http.StatusOK, gin.H{"provider": nil})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"provider": captchaProvider, "siteKey": captchaSiteKey})
+}
+
+// verifyCaptcha asks the provider whether token is a solved challenge.
+// An error means the provider couldn't be asked, not that the token is bad.
+func verifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error) {
+	form := url.Values{"secret": {captchaSecret}, "response": {token}, "sitekey": {captchaSiteKey}, "remoteip": {remoteIP}}
+	if captchaProvider == "turnstile" {
+		form.Del("sitekey")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, captchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s returned %s", captchaProvider, resp.Status)
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	if !result.Success && len(result.ErrorCodes) > 0 {
+		log.Printf("Captcha rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return result.Success, nil
+}
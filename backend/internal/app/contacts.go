@@ -0,0 +1,80 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// selectCrmContactHandler lets a rep choose which of a lead's known email
+// addresses and phone numbers the CRM card should use.
+func selectCrmContactHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	leadID := c.Param("leadId")
+
+	var input struct {
+		Email *string `json:"email"`
+		Phone *string `json:"phone"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Email == nil && input.Phone == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide an email or phone to use"})
+		return
+	}
+
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+	// Only look at a lead's contact details once it's known to be ours.
+	if !repo.Crm().HasCard(leadID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+
+	contacts, err := repo.Leads().Contacts([]string{leadID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead contacts"})
+		return
+	}
+	if input.Email != nil && !containsEmail(contacts.Emails[leadID], *input.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is not one of this lead's addresses"})
+		return
+	}
+	if input.Phone != nil && !containsPhone(contacts.Phones[leadID], *input.Phone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Phone is not one of this lead's numbers"})
+		return
+	}
+
+	err = repo.Crm().SetContact(leadID, input.Email, input.Phone)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update lead contact", "details": err.Error()})
+		return
+	}
+	version := crmChanged(c, repo)
+	c.JSON(http.StatusOK, gin.H{"message": "Lead contact updated", "version": version})
+}
+
+func containsEmail(emails []leads.Email, email string) bool {
+	for _, e := range emails {
+		if strings.EqualFold(e.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPhone(phones []leads.Phone, phone string) bool {
+	for _, p := range phones {
+		if p.Phone == phone {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+)
+
+// --- CORS ---
+//
+// Which sites may call the API from a browser is set with
+// CORS_ALLOWED_ORIGINS, a comma-separated list of origins. An entry may be
+// an exact origin, "https://*.example.com" for any subdomain of
+// example.com (for white-label hosts), or "*" for any origin at all.
+
+const DEFAULT_CORS_ORIGINS = "http://localhost:5173,http://localhost:3000"
+
+// corsBaseHeaders are the request headers the frontend itself sends;
+// CORS_ALLOWED_HEADERS adds to them.
+var corsBaseHeaders = []string{"Origin", "Content-Type", "Authorization", "Idempotency-Key", "If-Match", "If-None-Match"}
+
+type originRule struct {
+	scheme string
+	host   string // includes the port, if any
+	// wildcard matches any subdomain of host, but not host itself.
+	wildcard bool
+}
+
+func parseOriginRule(origin string) (originRule, error) {
+	origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok || (scheme != "http" && scheme != "https") {
+		return originRule{}, fmt.Errorf("%q must start with http:// or https://", origin)
+	}
+	rule := originRule{scheme: scheme, host: host}
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		rule.host, rule.wildcard = rest, true
+	}
+	if rule.host == "" || strings.ContainsAny(rule.host, "*/?#@") {
+		return originRule{}, fmt.Errorf("%q is not an origin; use scheme://host[:port] or scheme://*.host", origin)
+	}
+	return rule, nil
+}
+
+func (r originRule) matches(origin string) bool {
+	scheme, host, ok := strings.Cut(strings.ToLower(origin), "://")
+	if !ok || scheme != r.scheme {
+		return false
+	}
+	if r.wildcard {
+		return strings.HasSuffix(host, "."+r.host) && !strings.ContainsAny(host, "/?#@")
+	}
+	return host == r.host
+}
+
+// corsConfig builds the CORS policy from the environment. Bad settings stop
+// the server at startup rather than leaving it unreachable from browsers.
+func corsConfig() cors.Config {
+	config := cors.Config{
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:     append([]string{}, corsBaseHeaders...),
+		ExposeHeaders:    []string{"Content-Length", "Idempotent-Replayed", "ETag", "X-Total-Count", "X-Page", "X-Page-Size"},
+		AllowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") != "false",
+		MaxAge:           12 * time.Hour,
+	}
+	for _, h := range strings.Split(os.Getenv("CORS_ALLOWED_HEADERS"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			config.AllowHeaders = append(config.AllowHeaders, h)
+		}
+	}
+
+	var rules []originRule
+	for _, origin := range strings.Split(envOrDefault("CORS_ALLOWED_ORIGINS", DEFAULT_CORS_ORIGINS), ",") {
+		origin = strings.TrimSpace(origin)
+		switch origin {
+		case "":
+			continue
+		case "*":
+			config.AllowAllOrigins = true
+			continue
+		}
+		rule, err := parseOriginRule(origin)
+		if err != nil {
+			log.Fatalf("Invalid CORS_ALLOWED_ORIGINS entry: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	switch {
+	case config.AllowAllOrigins && config.AllowCredentials:
+		log.Fatal("CORS_ALLOWED_ORIGINS=* lets any site make credentialed requests; set CORS_ALLOW_CREDENTIALS=false or list the origins")
+	case config.AllowAllOrigins:
+		return config
+	case len(rules) == 0:
+		log.Fatal("CORS_ALLOWED_ORIGINS has no origins")
+	}
+	config.AllowOriginFunc = func(origin string) bool {
+		for _, r := range rules {
+			if r.matches(origin) {
+				return true
+			}
+		}
+		return false
+	}
+	return config
+}
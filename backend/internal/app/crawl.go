@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"html"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// --- EMAIL CRAWLER ---
+//
+// Most map listings have a website but no email. For those leads the
+// enrichment pass follows the homepage's contact and about links (and
+// theirs, up to CRAWL_MAX_DEPTH) and collects the addresses it finds.
+// Every fetch goes through fetchPage, so robots.txt is honored.
+
+const CRAWL_MAX_DEPTH = 2
+const CRAWL_MAX_PAGES = 5
+const CRAWL_MAX_EMAILS = 5
+
+var (
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	hrefRe  = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["'][^>]*>(.*?)</a>`)
+	// contactLinkRe matches link targets or text worth following.
+	contactLinkRe = regexp.MustCompile(`(?i)contact|about|team|staff|get-in-touch|get in touch|impressum|enquir|reach-us`)
+)
+
+// Addresses that turn up in page source but never belong to the business:
+// placeholders, platform error reporting and image file names.
+var junkEmailDomains = map[string]bool{
+	"example.com": true, "example.org": true, "domain.com": true, "email.com": true, "yourdomain.com": true,
+	"sentry.io": true, "wixpress.com": true, "sentry.wixpress.com": true, "sentry-next.wixpress.com": true,
+}
+var junkEmailSuffixes = []string{".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp", ".css", ".js"}
+
+// extractEmails finds plausible addresses in an HTML page, including
+// entity-encoded and percent-encoded mailto links.
+func extractEmails(page string) []string {
+	text := html.UnescapeString(strings.ReplaceAll(page, "%40", "@"))
+	seen := map[string]bool{}
+	var emails []string
+	for _, m := range emailRe.FindAllString(text, -1) {
+		email := strings.ToLower(strings.Trim(m, "."))
+		domain := email[strings.LastIndex(email, "@")+1:]
+		if seen[email] || junkEmailDomains[domain] {
+			continue
+		}
+		junk := false
+		for _, suffix := range junkEmailSuffixes {
+			if strings.HasSuffix(email, suffix) {
+				junk = true
+				break
+			}
+		}
+		if junk {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+	return emails
+}
+
+// contactLinks returns same-site links from page that look like contact or
+// about pages, resolved against base.
+func contactLinks(base *url.URL, page string) []*url.URL {
+	host := strings.TrimPrefix(strings.ToLower(base.Hostname()), "www.")
+	var links []*url.URL
+	for _, m := range hrefRe.FindAllStringSubmatch(page, -1) {
+		if !contactLinkRe.MatchString(m[1]) && !contactLinkRe.MatchString(m[2]) {
+			continue
+		}
+		link, err := base.Parse(html.UnescapeString(strings.TrimSpace(m[1])))
+		if err != nil || (link.Scheme != "http" && link.Scheme != "https") {
+			continue
+		}
+		if strings.TrimPrefix(strings.ToLower(link.Hostname()), "www.") != host {
+			continue
+		}
+		link.Fragment = ""
+		links = append(links, link)
+	}
+	return links
+}
+
+// crawlForEmails searches a site breadth-first from its already fetched
+// homepage, stopping once it has found addresses or used its page budget.
+// Addresses on the site's own domain come first.
+func crawlForEmails(ctx context.Context, home *url.URL, homePage string) []string {
+	type visit struct {
+		url   *url.URL
+		depth int
+	}
+	seen := map[string]bool{home.String(): true}
+	found := extractEmails(homePage)
+	queue := []visit{}
+	for _, link := range contactLinks(home, homePage) {
+		queue = append(queue, visit{link, 1})
+	}
+
+	fetched := 1
+	for len(queue) > 0 && len(found) == 0 && fetched < CRAWL_MAX_PAGES {
+		next := queue[0]
+		queue = queue[1:]
+		if seen[next.url.String()] {
+			continue
+		}
+		seen[next.url.String()] = true
+
+		page, pageURL, err := fetchPage(ctx, next.url.String())
+		fetched++
+		if err != nil {
+			continue
+		}
+		found = append(found, extractEmails(page)...)
+		if next.depth < CRAWL_MAX_DEPTH {
+			for _, link := range contactLinks(pageURL, page) {
+				queue = append(queue, visit{link, next.depth + 1})
+			}
+		}
+	}
+
+	siteDomain := normalizeDomain(home.String())
+	sort.SliceStable(found, func(i, j int) bool {
+		return strings.HasSuffix(found[i], "@"+siteDomain) && !strings.HasSuffix(found[j], "@"+siteDomain)
+	})
+	if len(found) > CRAWL_MAX_EMAILS {
+		found = found[:CRAWL_MAX_EMAILS]
+	}
+	return found
+}
+
+// saveCrawledEmails records addresses found on a lead's website, making the
+// first one the lead's primary email if it has none. It reports whether
+// any were saved.
+func saveCrawledEmails(ctx context.Context, leadID string, emails []string) bool {
+	emails = unsuppressedEmails(ctx, leadID, emails)
+	if len(emails) == 0 {
+		return false
+	}
+	for _, email := range emails {
+		if _, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO lead_emails (lead_id, email, type) VALUES (?, ?, 'website')", leadID, seal(email)); err != nil {
+			log.Printf("Failed to save crawled email for lead %s: %v", leadID, err)
+			return false
+		}
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE leads SET email = ? WHERE id = ? AND (email IS NULL OR email = '')", seal(emails[0]), leadID); err != nil {
+		log.Printf("Failed to set email for lead %s: %v", leadID, err)
+	}
+	return true
+}
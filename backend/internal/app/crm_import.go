@@ -0,0 +1,107 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- SEARCH IMPORT ---
+
+// searchImportFilter narrows which of a search's leads are added to the
+// CRM. PageSpeedBelow skips leads with no page speed score.
+type searchImportFilter struct {
+	HasPhone          bool `json:"hasPhone"`
+	PageSpeedBelow    *int `json:"pageSpeedBelow"`
+	ExcludeDuplicates bool `json:"excludeDuplicates"`
+}
+
+// importSearchHandler adds a whole search to the CRM in one statement, so
+// the client doesn't have to download every lead and post it back.
+func importSearchHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	searchID := c.Param("searchId")
+
+	var filter searchImportFilter
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+	}
+	if !repo.Searches().Owns(searchID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search not found"})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	added, err := txRepo.ImportSearch(searchID, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add search to CRM", "details": err.Error()})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add search to CRM"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": len(added), "leadIds": added, "version": version})
+}
+
+// importLeadListHandler is importSearchHandler for a list. Duplicates are
+// always left out, as they are from the list itself.
+func importLeadListHandler(c *gin.Context) {
+	repo := repoFrom(c)
+
+	var filter searchImportFilter
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+	}
+	list, err := repo.LeadList(c.Param("listId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load list"})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	added, err := txRepo.ImportLeadList(list, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add list to CRM", "details": err.Error()})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add list to CRM"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": len(added), "leadIds": added, "version": version})
+}
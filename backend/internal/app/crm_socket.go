@@ -0,0 +1,219 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// --- REAL-TIME BOARD SYNC ---
+//
+// GET /api/crm/ws is a WebSocket that tells every open board in an
+// organization when the CRM changes, so two tabs or two teammates see a move
+// straight away instead of overwriting each other. Browsers can't set an
+// Authorization header on a WebSocket, so the token goes in as a
+// subprotocol: new WebSocket(url, ["bearer", token]).
+//
+// Each message is a crmEvent. The first, "hello", carries the current board
+// version; after that, "crm_changed" arrives after each committed change.
+// A client should refetch the board when the version is newer than the one
+// it has. Changes are only broadcast within this server process.
+
+const CRM_SOCKET_PROTOCOL = "bearer"
+const CRM_SOCKET_PING_INTERVAL = 30 * time.Second
+const CRM_SOCKET_WRITE_TIMEOUT = 10 * time.Second
+
+// crmChangeKey is where crmChanged leaves the new board version for
+// crmBroadcastMiddleware.
+const crmChangeKey = "crmVersion"
+
+type crmEvent struct {
+	Type    string `json:"type"`
+	Version int64  `json:"version,omitempty"`
+	// Action is what happened: added, moved, edited, removed or changed.
+	Action string `json:"action,omitempty"`
+	LeadID string `json:"leadId,omitempty"`
+	UserID int64  `json:"userId,omitempty"`
+}
+
+// crmEventActions names the change each CRM route makes; others are
+// "changed".
+var crmEventActions = map[string]string{
+	"POST /api/crm/leads":                                             "added",
+	"POST /api/crm/import-search/:searchId":                           "added",
+	"POST /api/crm/import-list/:listId":                               "added",
+	"PUT /api/crm/state":                                              "moved",
+	"POST /api/crm/undo":                                              "moved",
+	"PUT /api/crm/leads/:leadId":                                      "edited",
+	"PUT /api/crm/leads/:leadId/contact":                              "edited",
+	"DELETE /api/crm/leads/:leadId":                                   "removed",
+	"POST /api/crm/leads/:leadId/calls":                               "edited",
+	"POST /api/crm/leads/:leadId/meetings":                            "edited",
+	"PUT /api/crm/leads/:leadId/snooze":                               "edited",
+	"DELETE /api/crm/leads/:leadId/snooze":                            "edited",
+	"POST /api/crm/leads/:leadId/tags":                                "edited",
+	"DELETE /api/crm/leads/:leadId/tags/:tag":                         "edited",
+	"PUT /api/crm/leads/:leadId/priority":                             "edited",
+	"POST /api/leads/:searchId/forget":                                "edited",
+	"POST /api/crm/leads/:leadId/notes/revisions/:revisionId/restore": "edited",
+}
+
+type crmSubscriber struct {
+	send chan []byte
+	// gone is closed when the subscriber fell too far behind; it has to
+	// reconnect and refetch.
+	gone     chan struct{}
+	goneOnce sync.Once
+}
+
+// crmSocketHub keeps the open sockets of each organization.
+type crmSocketHub struct {
+	mu   sync.Mutex
+	subs map[int64]map[*crmSubscriber]bool
+}
+
+var crmHub = &crmSocketHub{subs: map[int64]map[*crmSubscriber]bool{}}
+
+func (h *crmSocketHub) subscribe(orgID int64) *crmSubscriber {
+	sub := &crmSubscriber{send: make(chan []byte, 16), gone: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[orgID] == nil {
+		h.subs[orgID] = map[*crmSubscriber]bool{}
+	}
+	h.subs[orgID][sub] = true
+	return sub
+}
+
+func (h *crmSocketHub) unsubscribe(orgID int64, sub *crmSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[orgID], sub)
+	if len(h.subs[orgID]) == 0 {
+		delete(h.subs, orgID)
+	}
+}
+
+func (h *crmSocketHub) publish(orgID int64, e crmEvent) {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode CRM event: %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[orgID] {
+		select {
+		case sub.send <- msg:
+		default:
+			sub.goneOnce.Do(func() { close(sub.gone) })
+		}
+	}
+}
+
+// crmBroadcastMiddleware tells the organization's open boards about a CRM
+// change once the handler has committed it.
+func crmBroadcastMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		version := c.GetInt64(crmChangeKey)
+		if version == 0 || c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		tenant := repoFrom(c).Tenant()
+		action := crmEventActions[c.Request.Method+" "+c.FullPath()]
+		if action == "" {
+			action = "changed"
+		}
+		crmHub.publish(tenant.OrgID, crmEvent{Type: "crm_changed", Version: version, Action: action, LeadID: c.Param("leadId"), UserID: tenant.UserID})
+	}
+}
+
+// socketTokenMiddleware moves a token sent as a WebSocket subprotocol into
+// the Authorization header, for authMiddleware.
+func socketTokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			return
+		}
+		protocols := strings.Split(c.GetHeader("Sec-WebSocket-Protocol"), ",")
+		if len(protocols) == 2 && strings.TrimSpace(protocols[0]) == CRM_SOCKET_PROTOCOL {
+			c.Request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(protocols[1]))
+		}
+	}
+}
+
+func crmSocketHandler(c *gin.Context) {
+	if !c.IsWebsocket() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a WebSocket upgrade"})
+		return
+	}
+	repo := repoFrom(c)
+	version, err := repo.Crm().Version()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load board version"})
+		return
+	}
+	server := websocket.Server{
+		// The token, not the origin, is what authenticates the socket.
+		Handshake: func(cfg *websocket.Config, _ *http.Request) error {
+			cfg.Protocol = nil
+			if c.GetHeader("Sec-WebSocket-Protocol") != "" {
+				cfg.Protocol = []string{CRM_SOCKET_PROTOCOL}
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) { serveCrmSocket(ws, repo.Tenant().OrgID, version) },
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+func serveCrmSocket(ws *websocket.Conn, orgID, version int64) {
+	defer ws.Close()
+	sub := crmHub.subscribe(orgID)
+	defer crmHub.unsubscribe(orgID, sub)
+
+	send := func(msg []byte) bool {
+		ws.SetWriteDeadline(time.Now().Add(CRM_SOCKET_WRITE_TIMEOUT))
+		return websocket.Message.Send(ws, string(msg)) == nil
+	}
+	hello, _ := json.Marshal(crmEvent{Type: "hello", Version: version})
+	if !send(hello) {
+		return
+	}
+
+	// Clients don't send anything; reading is only to notice them leave.
+	closed := make(chan struct{})
+	go func() {
+		var discard string
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(closed)
+	}()
+
+	ping, _ := json.Marshal(crmEvent{Type: "ping"})
+	ticker := time.NewTicker(CRM_SOCKET_PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-sub.send:
+			if !send(msg) {
+				return
+			}
+		case <-ticker.C:
+			if !send(ping) {
+				return
+			}
+		case <-sub.gone:
+			return
+		case <-closed:
+			return
+		}
+	}
+}
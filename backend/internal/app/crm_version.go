@@ -0,0 +1,61 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- CRM BOARD VERSIONING ---
+
+func crmETag(version int64) string {
+	return fmt.Sprintf(`W/"crm-%d"`, version)
+}
+
+// etagMatches implements the If-None-Match / If-Match list comparison.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCrmIfMatch rejects a CRM mutation with 412 when the client sent an
+// If-Match header for a board version that is no longer current.
+func checkCrmIfMatch(c *gin.Context, repo *Repository) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	version, err := repo.Crm().Version()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check board version"})
+		return false
+	}
+	if !etagMatches(ifMatch, crmETag(version)) {
+		c.Header("ETag", crmETag(version))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "The board has changed since it was loaded", "version": version})
+		return false
+	}
+	return true
+}
+
+// crmChanged records a CRM write and sets the new board ETag on the
+// response, returning the new version. Open boards hear about it once the
+// handler is done; see crm_socket.go.
+func crmChanged(c *gin.Context, repo *Repository) int64 {
+	version, err := repo.Crm().BumpVersion()
+	if err != nil {
+		log.Printf("Failed to bump CRM board version for organization %d: %v", repo.Tenant().OrgID, err)
+		return 0
+	}
+	c.Header("ETag", crmETag(version))
+	c.Set(crmChangeKey, version)
+	return version
+}
@@ -0,0 +1,456 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- DUPLICATE DETECTION ---
+//
+// The same business often turns up in several searches under different
+// lead IDs. Two leads are treated as the same business when their phone
+// numbers or website domains match after normalization.
+
+// sharedHosts are domains many unrelated businesses use as their
+// "website", so matching on them would merge strangers.
+var sharedHosts = map[string]bool{
+	"facebook.com":      true,
+	"instagram.com":     true,
+	"linkedin.com":      true,
+	"twitter.com":       true,
+	"x.com":             true,
+	"google.com":        true,
+	"business.site":     true,
+	"sites.google.com":  true,
+	"wixsite.com":       true,
+	"squarespace.com":   true,
+	"yell.com":          true,
+	"checkatrade.com":   true,
+	"linktr.ee":         true,
+	"wordpress.com":     true,
+	"godaddysites.com":  true,
+	"yelp.com":          true,
+	"tripadvisor.co.uk": true,
+}
+
+// normalizePhone keeps the last ten digits of a number, so national and
+// international formats of the same line compare equal. Numbers too short
+// to be a real line return "".
+func normalizePhone(phone string) string {
+	digits := make([]byte, 0, len(phone))
+	for i := 0; i < len(phone); i++ {
+		if phone[i] >= '0' && phone[i] <= '9' {
+			digits = append(digits, phone[i])
+		}
+	}
+	if len(digits) < 7 {
+		return ""
+	}
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return string(digits)
+}
+
+// normalizeDomain reduces a website to its lowercased host without "www.",
+// or "" if it has none or it is a shared host.
+func normalizeDomain(website string) string {
+	website = strings.TrimSpace(website)
+	if website == "" {
+		return ""
+	}
+	if !strings.Contains(website, "://") {
+		website = "http://" + website
+	}
+	u, err := url.Parse(website)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host == "" || !strings.Contains(host, ".") {
+		return ""
+	}
+	for shared := range sharedHosts {
+		if host == shared || strings.HasSuffix(host, "."+shared) {
+			return ""
+		}
+	}
+	return host
+}
+
+// registerSQLFunctions exposes the normalizers to SQL as normalize_phone
+// and normalize_domain, so bulk queries can match duplicates in place, and
+// field encryption as seal and unseal. normalize_phone unseals its argument
+// first, since phones are stored sealed.
+func registerSQLFunctions(conn *sqlite3.SQLiteConn) error {
+	normalizeSealedPhone := func(phone string) string { return normalizePhone(unseal(phone)) }
+	if err := conn.RegisterFunc("normalize_phone", normalizeSealedPhone, true); err != nil {
+		return err
+	}
+	if err := conn.RegisterFunc("normalize_domain", normalizeDomain, true); err != nil {
+		return err
+	}
+	if err := conn.RegisterFunc("seal", seal, true); err != nil {
+		return err
+	}
+	return conn.RegisterFunc("unseal", unseal, true)
+}
+
+// CrmDuplicate is a lead that wasn't added to the CRM because a card for
+// the same business is already there.
+type CrmDuplicate struct {
+	LeadID      string `json:"leadId"`
+	DuplicateOf string `json:"duplicateOf"`
+	MatchedOn   string `json:"matchedOn"`
+}
+
+// duplicateIndex finds leads matching ones already seen.
+type duplicateIndex struct {
+	phones  map[string]string
+	domains map[string]string
+}
+
+func newDuplicateIndex() *duplicateIndex {
+	return &duplicateIndex{phones: map[string]string{}, domains: map[string]string{}}
+}
+
+func (d *duplicateIndex) add(leadID, phone, website string) {
+	if p := normalizePhone(phone); p != "" {
+		if _, ok := d.phones[p]; !ok {
+			d.phones[p] = leadID
+		}
+	}
+	if host := normalizeDomain(website); host != "" {
+		if _, ok := d.domains[host]; !ok {
+			d.domains[host] = leadID
+		}
+	}
+}
+
+// match returns the lead that phone or website duplicates, and which of
+// the two matched. A lead never duplicates itself.
+func (d *duplicateIndex) match(leadID, phone, website string) (string, string, bool) {
+	if p := normalizePhone(phone); p != "" {
+		if other, ok := d.phones[p]; ok && other != leadID {
+			return other, "phone", true
+		}
+	}
+	if host := normalizeDomain(website); host != "" {
+		if other, ok := d.domains[host]; ok && other != leadID {
+			return other, "domain", true
+		}
+	}
+	return "", "", false
+}
+
+// --- DUPLICATE AUDIT ---
+//
+// The audit looks across all of a tenant's live leads for probable
+// duplicates and groups them into clusters: leads sharing a phone or a
+// domain, directly or through another lead in the cluster. A cluster's ID
+// is derived from its members, so it changes when they do; ignoring a
+// cluster hides it until a new lead joins.
+
+// DuplicateLead is one member of a duplicate cluster.
+type DuplicateLead struct {
+	ID          string `json:"id"`
+	SearchID    string `json:"searchId"`
+	Keyword     string `json:"keyword"`
+	CompanyName string `json:"companyName"`
+	Phone       string `json:"phone"`
+	Website     string `json:"website"`
+	OnBoard     bool   `json:"onBoard"`
+}
+
+type DuplicateCluster struct {
+	ID        string          `json:"id"`
+	MatchedOn []string        `json:"matchedOn"`
+	Leads     []DuplicateLead `json:"leads"`
+}
+
+// clusterDuplicates groups leads that share a normalized phone or domain,
+// largest clusters first. Leads keep their given order within a cluster.
+func clusterDuplicates(leads []DuplicateLead) []DuplicateCluster {
+	parent := make([]int, len(leads))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	first := map[string]int{}
+	matched := map[int]map[string]bool{}
+	link := func(i int, key, kind string) {
+		j, ok := first[key]
+		if !ok {
+			first[key] = i
+			return
+		}
+		a, b := find(i), find(j)
+		if a != b {
+			parent[max(a, b)] = min(a, b)
+		}
+		for _, n := range []int{i, j} {
+			if matched[n] == nil {
+				matched[n] = map[string]bool{}
+			}
+			matched[n][kind] = true
+		}
+	}
+	for i, l := range leads {
+		if p := normalizePhone(l.Phone); p != "" {
+			link(i, "phone:"+p, "phone")
+		}
+		if host := normalizeDomain(l.Website); host != "" {
+			link(i, "domain:"+host, "domain")
+		}
+	}
+
+	groups := map[int]*DuplicateCluster{}
+	var roots []int
+	for i, l := range leads {
+		root := find(i)
+		c, ok := groups[root]
+		if !ok {
+			c = &DuplicateCluster{}
+			groups[root] = c
+			roots = append(roots, root)
+		}
+		c.Leads = append(c.Leads, l)
+		for kind := range matched[i] {
+			if !containsString(c.MatchedOn, kind) {
+				c.MatchedOn = append(c.MatchedOn, kind)
+			}
+		}
+	}
+
+	var clusters []DuplicateCluster
+	for _, root := range roots {
+		c := groups[root]
+		if len(c.Leads) < 2 {
+			continue
+		}
+		ids := make([]string, len(c.Leads))
+		for i, l := range c.Leads {
+			ids[i] = l.ID
+		}
+		sort.Strings(ids)
+		sum := sha256.Sum256([]byte(strings.Join(ids, ",")))
+		c.ID = hex.EncodeToString(sum[:8])
+		sort.Strings(c.MatchedOn)
+		clusters = append(clusters, *c)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool { return len(clusters[i].Leads) > len(clusters[j].Leads) })
+	return clusters
+}
+
+// getLeadDuplicatesHandler lists duplicate clusters. includeIgnored=true
+// brings back ones that were ignored.
+func getLeadDuplicatesHandler(c *gin.Context) {
+	clusters, err := repoFrom(c).DuplicateClusters(c.Query("includeIgnored") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find duplicate leads"})
+		return
+	}
+	c.JSON(http.StatusOK, clusters)
+}
+
+// findDuplicateCluster looks the cluster up again, ignored ones included,
+// so an action on a cluster that has since changed is refused.
+func findDuplicateCluster(repo *Repository, clusterID string) (DuplicateCluster, error) {
+	clusters, err := repo.DuplicateClusters(true)
+	if err != nil {
+		return DuplicateCluster{}, err
+	}
+	for _, cluster := range clusters {
+		if cluster.ID == clusterID {
+			return cluster, nil
+		}
+	}
+	return DuplicateCluster{}, store.ErrNotFound
+}
+
+// mergeLeadDuplicatesHandler keeps one lead of a cluster and folds the
+// rest into it. The lead kept is keepLeadId if given, otherwise the one on
+// the board, otherwise the oldest. Board cards aren't merged, so a cluster
+// with more than one on the board is refused.
+func mergeLeadDuplicatesHandler(c *gin.Context) {
+	var input struct {
+		KeepLeadID string `json:"keepLeadId"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge leads"})
+		return
+	}
+	defer tx.Rollback()
+	repo := repoFrom(c).WithTx(tx)
+
+	cluster, err := findDuplicateCluster(repo, c.Param("clusterId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Duplicate cluster not found; it may have changed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge leads"})
+		return
+	}
+
+	keep, onBoard := cluster.Leads[0].ID, ""
+	for _, l := range cluster.Leads {
+		if !l.OnBoard {
+			continue
+		}
+		if onBoard != "" {
+			c.JSON(http.StatusConflict, gin.H{"error": "More than one of these leads is on the board; remove the extra cards first"})
+			return
+		}
+		onBoard, keep = l.ID, l.ID
+	}
+	if input.KeepLeadID != "" {
+		if onBoard != "" && input.KeepLeadID != onBoard {
+			c.JSON(http.StatusConflict, gin.H{"error": "The lead on the board has to be the one kept"})
+			return
+		}
+		keep = ""
+		for _, l := range cluster.Leads {
+			if l.ID == input.KeepLeadID {
+				keep = l.ID
+			}
+		}
+		if keep == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "keepLeadId must be one of the cluster's leads"})
+			return
+		}
+	}
+
+	var merged []string
+	for _, l := range cluster.Leads {
+		if l.ID != keep {
+			merged = append(merged, l.ID)
+		}
+	}
+	if err := leads.NewService(repo.Leads()).Merge(keep, merged); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge leads"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge leads"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keptLeadId": keep, "mergedLeadIds": merged})
+}
+
+func ignoreLeadDuplicatesHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	cluster, err := findDuplicateCluster(repo, c.Param("clusterId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Duplicate cluster not found; it may have changed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to ignore duplicates"})
+		return
+	}
+	if err := repo.IgnoreDuplicateCluster(cluster.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to ignore duplicates"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// --- CONTACT WARNINGS ---
+//
+// Cards on the board are kept unique when leads are added, but a card can
+// still come to share a phone or domain with another one later: a number
+// edited in, or a lead added before the other was enriched. So when a rep
+// opens a card or the dialer hands one out, the other cards for the same
+// business are listed as warnings, with who has them and when they were
+// last called, so two reps don't pitch the same shop in one week.
+
+// CONTACT_WARNING_WINDOW is how recent a call on the other card has to be
+// for the warning to say the business was just called.
+const CONTACT_WARNING_WINDOW = 7 * 24 * time.Hour
+
+type ContactWarning struct {
+	LeadID       string `json:"leadId"`
+	CompanyName  string `json:"companyName"`
+	MatchedOn    string `json:"matchedOn"`
+	Assignee     int64  `json:"assignee"`
+	AssigneeName string `json:"assigneeName"`
+	// LastCalledAt and LastCalledBy are the other card's latest call, if
+	// it had one.
+	LastCalledAt *time.Time `json:"lastCalledAt"`
+	LastCalledBy int64      `json:"lastCalledBy,omitempty"`
+	// CalledRecently is set when that call was within the last week.
+	CalledRecently bool `json:"calledRecently"`
+}
+
+// contactWarnings returns the warnings for the card, most recently called
+// first.
+func contactWarnings(repo *Repository, lead CrmLead, now time.Time) ([]ContactWarning, error) {
+	warnings, err := repo.CrmContactMatches(lead.ID, normalizePhone(lead.Phone), normalizeDomain(lead.Website))
+	if err != nil {
+		return nil, err
+	}
+	for i := range warnings {
+		w := &warnings[i]
+		w.CalledRecently = w.LastCalledAt != nil && now.Sub(*w.LastCalledAt) < CONTACT_WARNING_WINDOW
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		a, b := warnings[i].LastCalledAt, warnings[j].LastCalledAt
+		return a != nil && (b == nil || a.After(*b))
+	})
+	return warnings, nil
+}
+
+// getCrmLeadHandler returns one card, with its emails, phones and contact
+// warnings, for a rep opening it.
+func getCrmLeadHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	lead, err := repo.Crm().Card(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	contacts, err := repo.Leads().Contacts([]string{lead.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead contacts"})
+		return
+	}
+	lead.Emails = contacts.Emails[lead.ID]
+	lead.Phones = contacts.Phones[lead.ID]
+	warnings, err := contactWarnings(repo, lead, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for duplicate contacts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lead": lead, "warnings": warnings})
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/auth"
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/scraper"
+	"blueleads-backend/internal/searches"
+)
+
+// --- DEMO DATA ---
+//
+// Starting the server with -demo gives a demo account a few finished
+// searches and a board that's been worked for a couple of weeks, so the
+// frontend can be developed and shown without running the scraper. The
+// data comes from a fixed seed and is the same every time. It's only added
+// once; delete the demo user to start over.
+//
+// Phone numbers are in Ofcom's ranges for drama, and websites and emails
+// use the reserved .example domain, so nobody real gets called or emailed.
+
+const DEMO_EMAIL = "demo@blueleads.example"
+const DEMO_PASSWORD = "demo-password-1"
+
+type demoCity struct {
+	name, areaCode   string
+	lat, lng         float64
+	streets, suburbs []string
+}
+
+var demoCities = []demoCity{
+	{"Leeds", "0113 496", 53.7997, -1.5492, []string{"Kirkstall Road", "Otley Road", "York Road", "Roundhay Road", "Wellington Street"}, []string{"Headingley", "Chapel Allerton", "Horsforth", "Armley"}},
+	{"Manchester", "0161 496", 53.4808, -2.2426, []string{"Oxford Road", "Deansgate", "Wilmslow Road", "Bury New Road", "Stockport Road"}, []string{"Didsbury", "Chorlton", "Salford", "Ancoats"}},
+	{"Bristol", "0117 496", 51.4545, -2.5879, []string{"Gloucester Road", "Whiteladies Road", "Bath Road", "North Street", "Coronation Road"}, []string{"Clifton", "Bedminster", "Redland", "Easton"}},
+}
+
+type demoTrade struct {
+	keyword, category string
+	suffixes          []string
+}
+
+var demoTrades = []demoTrade{
+	{"plumbers", "Plumber", []string{"Plumbing", "Plumbing & Heating", "Heating Services", "Bathrooms"}},
+	{"electricians", "Electrician", []string{"Electrical", "Electrics", "Electrical Contractors", "Sparks"}},
+	{"dentists", "Dentist", []string{"Dental Care", "Dental Practice", "Smile Studio", "Family Dentistry"}},
+}
+
+var demoNamePrefixes = []string{
+	"Aire Valley", "Northern", "Prestige", "Swift", "City", "Premier", "Rapid", "Greenway",
+	"Castle", "Riverside", "Apex", "Heritage", "Summit", "Oakwood", "Redbrick", "Beacon",
+	"Harbour", "Meadow", "Pennine", "Victoria", "Millstone", "Kingfisher", "Bridgewater", "Ashford",
+}
+
+var demoNotes = []string{
+	"Spoke to the owner, wants a quote for a new website. Call back after the school run.",
+	"Receptionist says the manager is in on Thursdays.",
+	"Already has an agency but unhappy with response times.",
+	"Interested in SEO, asked for case studies by email.",
+	"Site is slow on mobile; mention the page speed score.",
+	"",
+}
+
+// seedDemoData adds the demo account and its data, unless it's already
+// there.
+func seedDemoData() error {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", DEMO_EMAIL).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		log.Printf("Demo data is already loaded; log in as %s / %s", DEMO_EMAIL, DEMO_PASSWORD)
+		return nil
+	}
+	hashed, err := auth.HashPassword(DEMO_PASSWORD)
+	if err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	userID, orgID, err := createOwner(tx, "Demo User", DEMO_EMAIL, hashed, false)
+	if err != nil {
+		return err
+	}
+	repo := newRepository(Tenant{OrgID: orgID, UserID: userID}).WithTx(tx)
+
+	var firstSearch string
+	for i, city := range demoCities {
+		trade := demoTrades[i%len(demoTrades)]
+		search := searches.Search{ID: uuid.New().String(), Keyword: trade.keyword, Source: DEFAULT_SOURCE, Location: city.name, Status: "In Progress"}
+		if err := repo.Searches().Insert(search); err != nil {
+			return err
+		}
+		leads := demoLeads(rng, trade, city, 30+rng.Intn(25))
+		stored := storeLeadBatches(tx, search.ID, leads, func(sl scraper.Lead, err error) {
+			log.Printf("Skipped demo lead %q: %v", sl.Title, err)
+		})
+		finished := time.Now().Add(-time.Duration(len(demoCities)-i) * 72 * time.Hour)
+		_, err := tx.Exec("UPDATE searches SET status = 'Completed', leads_found = ?, created_at = ?, started_at = ?, finished_at = ? WHERE id = ?",
+			stored, finished.Add(-4*time.Minute), finished.Add(-4*time.Minute), finished, search.ID)
+		if err != nil {
+			return err
+		}
+		if firstSearch == "" {
+			firstSearch = search.ID
+		}
+	}
+
+	if err := seedDemoBoard(rng, repo, firstSearch); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Loaded demo data; log in as %s / %s", DEMO_EMAIL, DEMO_PASSWORD)
+	return nil
+}
+
+func demoLeads(rng *rand.Rand, trade demoTrade, city demoCity, n int) []scraper.Lead {
+	leads := make([]scraper.Lead, 0, n)
+	used := map[string]bool{}
+	for len(leads) < n {
+		name := demoNamePrefixes[rng.Intn(len(demoNamePrefixes))] + " " + trade.suffixes[rng.Intn(len(trade.suffixes))]
+		if used[name] {
+			continue
+		}
+		used[name] = true
+		lead := scraper.Lead{
+			Title:       name,
+			Phone:       fmt.Sprintf("%s %04d", city.areaCode, len(leads)*7+rng.Intn(7)),
+			Rating:      float64(30+rng.Intn(21)) / 10,
+			ReviewCount: rng.Intn(240),
+			Category:    trade.category,
+			Address:     fmt.Sprintf("%d %s, %s, %s", 1+rng.Intn(220), city.streets[rng.Intn(len(city.streets))], city.suburbs[rng.Intn(len(city.suburbs))], city.name),
+			Latitude:    city.lat + (rng.Float64()-0.5)*0.12,
+			Longitude:   city.lng + (rng.Float64()-0.5)*0.2,
+			OpenHours:   demoOpenHours(rng),
+		}
+		// A third of small businesses still have no website.
+		if rng.Intn(3) > 0 {
+			domain := nonSlugChars.ReplaceAllString(strings.ToLower(name), "") + ".example"
+			lead.Website = "https://www." + domain
+			lead.Emails = []string{"info@" + domain}
+			if rng.Intn(4) == 0 {
+				lead.Emails = append(lead.Emails, "office@"+domain)
+			}
+		}
+		leads = append(leads, lead)
+	}
+	return leads
+}
+
+func demoOpenHours(rng *rand.Rand) map[string][]string {
+	open := []string{"8 am–5 pm", "8:30 am–5:30 pm", "9 am–6 pm"}[rng.Intn(3)]
+	hours := map[string][]string{"Sunday": {"Closed"}}
+	for _, day := range []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday"} {
+		hours[day] = []string{open}
+	}
+	hours["Saturday"] = []string{"Closed"}
+	if rng.Intn(2) == 0 {
+		hours["Saturday"] = []string{"9 am–1 pm"}
+	}
+	return hours
+}
+
+// seedDemoBoard puts some of a search's leads on the board and works them:
+// calls with outcomes, notes, tags, callbacks and a couple of extra
+// columns.
+func seedDemoBoard(rng *rand.Rand, repo *Repository, searchID string) error {
+	rows, err := repo.q.QueryContext(repo.ctx, "SELECT "+leads.SELECT_COLUMNS+" FROM leads WHERE search_id = ? ORDER BY rowid LIMIT 24", searchID)
+	if err != nil {
+		return err
+	}
+	var picked []leads.Lead
+	for rows.Next() {
+		l, err := leads.Scan(rows, fieldCodec{})
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		picked = append(picked, l)
+	}
+	rows.Close()
+	if _, err := repo.AddCrmLeads(picked); err != nil {
+		return err
+	}
+
+	for _, title := range []string{"Meeting Booked", "Proposal Sent"} {
+		if _, err := repo.Crm().CreateColumn(title); err != nil {
+			return err
+		}
+	}
+	tags := []string{"hot", "follow-up", "no-website", "agency"}
+	for i, l := range picked {
+		if i < 8 {
+			continue // left to call
+		}
+		disposition := dispositions[rng.Intn(len(dispositions))].ID
+		call, _, err := repo.RecordCall(l.ID, disposition, demoNotes[rng.Intn(len(demoNotes))], 30+rng.Intn(400), defaultDispositionRules[disposition])
+		if err != nil {
+			return err
+		}
+		// Spread the calls over the last two weeks' working hours.
+		calledAt := time.Now().UTC().Truncate(24 * time.Hour).Add(-time.Duration(rng.Intn(14))*24*time.Hour + time.Duration(9+rng.Intn(8))*time.Hour)
+		if _, err := repo.q.ExecContext(repo.ctx, "UPDATE crm_calls SET called_at = ? WHERE id = ?", calledAt, call.ID); err != nil {
+			return err
+		}
+		if _, err := repo.q.ExecContext(repo.ctx, "UPDATE crm_leads SET last_called_at = ? WHERE org_id = ? AND lead_id = ?", calledAt, repo.tenant.OrgID, l.ID); err != nil {
+			return err
+		}
+		switch {
+		case i >= 20:
+			err = repo.MoveCrmLead(l.ID, "proposal-sent")
+		case i >= 16:
+			err = repo.MoveCrmLead(l.ID, "meeting-booked")
+		}
+		if err != nil {
+			return err
+		}
+		card := CrmLead{Notes: demoNotes[rng.Intn(len(demoNotes))]}
+		if i%3 == 0 {
+			callback := time.Now().Add(time.Duration(1+rng.Intn(7)) * 24 * time.Hour).Truncate(time.Hour)
+			card.CallBackDate = &callback
+		}
+		if err := repo.UpdateCrmLead(l.ID, card); err != nil {
+			return err
+		}
+		if i%2 == 0 {
+			if err := repo.AddCrmTag(l.ID, tags[rng.Intn(len(tags))], nil); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = repo.Crm().BumpVersion()
+	return err
+}
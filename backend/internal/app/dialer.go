@@ -0,0 +1,365 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- POWER DIALER ---
+//
+// The dialer hands each rep the next card worth calling and claims it for
+// a while so two reps working the same board never ring the same business.
+// Claims lapse on their own, so a rep who walks away doesn't lock a lead.
+
+const DIALER_CLAIM_TTL = 10 * time.Minute
+
+// dialerCandidate is a card the dialer could hand out, before the calling
+// window and callback time are checked.
+type dialerCandidate struct {
+	callTarget
+	CallBackDate *time.Time
+}
+
+// rankDialerCandidates drops cards whose callback is still in the future
+// and puts due callbacks first, otherwise keeping the board order the
+// candidates came in.
+func rankDialerCandidates(candidates []dialerCandidate, now time.Time) []dialerCandidate {
+	ranked := make([]dialerCandidate, 0, len(candidates))
+	for _, cand := range candidates {
+		if cand.CallBackDate != nil && cand.CallBackDate.After(now) {
+			continue
+		}
+		ranked = append(ranked, cand)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].CallBackDate != nil && ranked[j].CallBackDate == nil
+	})
+	return ranked
+}
+
+// getDialerNextHandler claims and returns the best card to call now from
+// the columns given as ?columns=a,b (default "tobe-called"), passing over
+// ?skip=leadId. Any card the rep already held is released first. When
+// nothing can be called the lead is null and nextCallableAt says when
+// something will be.
+func getDialerNextHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	columns := []string{"tobe-called"}
+	if v := c.Query("columns"); v != "" {
+		columns = strings.Split(v, ",")
+	}
+	for _, col := range columns {
+		if !repo.Crm().HasColumn(col) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown column '%s'", col)})
+			return
+		}
+	}
+
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	if err := repo.Crm().ReleaseClaims(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release previous lead"})
+		return
+	}
+	candidates, err := repo.DialerCandidates(columns)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load call queue"})
+		return
+	}
+
+	window := settings.callingWindow()
+	now := time.Now()
+	var nextCallable *time.Time
+	for _, cand := range rankDialerCandidates(candidates, now) {
+		if cand.LeadID == c.Query("skip") {
+			continue
+		}
+		next, ok := window.nextCallable(cand.Timezone, cand.Hours, now)
+		if !ok {
+			continue
+		}
+		if !next.Equal(now) {
+			if nextCallable == nil || next.Before(*nextCallable) {
+				nextCallable = &next
+			}
+			continue
+		}
+
+		until := now.Add(DIALER_CLAIM_TTL).UTC()
+		claimed, err := repo.Crm().Claim(cand.LeadID, until)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim lead"})
+			return
+		}
+		if !claimed {
+			// Another rep got there first.
+			continue
+		}
+		lead, err := repo.Crm().Card(cand.LeadID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+			return
+		}
+		contacts, err := repo.Leads().Contacts([]string{lead.ID})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead contacts"})
+			return
+		}
+		lead.Emails = contacts.Emails[lead.ID]
+		lead.Phones = contacts.Phones[lead.ID]
+		warnings, err := contactWarnings(repo, lead, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for duplicate contacts"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"lead": lead, "claimedUntil": until, "warnings": warnings})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lead": nil, "nextCallableAt": nextCallable})
+}
+
+// completeDialerCallHandler records the outcome of a dialer call, the same
+// way as recording a call from the board, and releases the claim.
+func completeDialerCallHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		LeadID string `json:"leadId" binding:"required"`
+		callInput
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	holder, err := txRepo.Crm().ClaimHolder(input.LeadID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record call"})
+		return
+	}
+	if holder != 0 && holder != repo.Tenant().UserID {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another rep is calling this lead"})
+		return
+	}
+
+	call, columnID, warning, err := recordCall(txRepo, input.LeadID, input.callInput)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record call"})
+		return
+	}
+	if err := txRepo.Crm().ReleaseClaims(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release lead"})
+		return
+	}
+
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record call"})
+		return
+	}
+	response := gin.H{"call": call, "columnId": columnID, "version": version}
+	if warning != "" {
+		response["warning"] = warning
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// releaseDialerHandler gives back the rep's current lead without calling
+// it, e.g. when they stop dialing.
+func releaseDialerHandler(c *gin.Context) {
+	if err := repoFrom(c).Crm().ReleaseClaims(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release lead"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// --- DIALER SESSIONS ---
+//
+// A session groups the calls a rep makes in one sitting, from start to
+// stop, so we can say how fast they dialed and how often someone answered.
+
+// DialerStats totals a run of calls. Elapsed is the time spent dialing,
+// up to now for a session that's still open.
+type DialerStats struct {
+	Dials          int           `json:"dials"`
+	Connects       int           `json:"connects"`
+	TalkSeconds    int           `json:"talkSeconds"`
+	Elapsed        time.Duration `json:"-"`
+	ElapsedSeconds int           `json:"elapsedSeconds"`
+	ConnectRate    float64       `json:"connectRate"`
+	DialsPerHour   float64       `json:"dialsPerHour"`
+}
+
+// finish fills in the figures derived from the totals.
+func (s *DialerStats) finish() {
+	s.ElapsedSeconds = int(s.Elapsed / time.Second)
+	s.ConnectRate = percentOf(s.Connects, s.Dials)
+	s.DialsPerHour = 0
+	if hours := s.Elapsed.Hours(); hours > 0 {
+		s.DialsPerHour = math.Round(float64(s.Dials)/hours*10) / 10
+	}
+}
+
+func (s *DialerStats) add(o DialerStats) {
+	s.Dials += o.Dials
+	s.Connects += o.Connects
+	s.TalkSeconds += o.TalkSeconds
+	s.Elapsed += o.Elapsed
+	s.finish()
+}
+
+type DialerSession struct {
+	ID        int64      `json:"id"`
+	UserID    int64      `json:"userId"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt"`
+	DialerStats
+}
+
+// startDialerSessionHandler starts a session; calls the rep records until
+// they stop it are counted towards it. Starting while a session is already
+// open returns that session.
+func startDialerSessionHandler(c *gin.Context) {
+	session, started, err := repoFrom(c).StartDialerSession()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start dialer session"})
+		return
+	}
+	if !started {
+		c.JSON(http.StatusOK, session)
+		return
+	}
+	c.JSON(http.StatusCreated, session)
+}
+
+// stopDialerSessionHandler ends the open session, gives back any lead the
+// rep still holds, and returns the session's stats.
+func stopDialerSessionHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	session, err := txRepo.StopDialerSession()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No dialer session is open"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop dialer session"})
+		return
+	}
+	if err := txRepo.Crm().ReleaseClaims(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release lead"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop dialer session"})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// getDialerSessionsHandler lists the rep's last 50 sessions, newest first.
+func getDialerSessionsHandler(c *gin.Context) {
+	sessions, err := repoFrom(c).DialerSessions(50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load dialer sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+// getDialerAnalyticsHandler totals the organization's dialer sessions
+// started between ?from and ?to (inclusive dates in the user's timezone),
+// overall and per rep.
+func getDialerAnalyticsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	loc := settings.location()
+
+	var from, to *time.Time
+	if v := c.Query("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date (YYYY-MM-DD)"})
+			return
+		}
+		from = &t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date (YYYY-MM-DD)"})
+			return
+		}
+		t = t.AddDate(0, 0, 1)
+		to = &t
+	}
+
+	sessions, err := repo.OrgDialerSessions(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load dialer analytics"})
+		return
+	}
+
+	type repStats struct {
+		UserID   int64 `json:"userId"`
+		Sessions int   `json:"sessions"`
+		DialerStats
+	}
+	var total DialerStats
+	byRep := map[int64]*repStats{}
+	reps := []*repStats{}
+	for _, s := range sessions {
+		total.add(s.DialerStats)
+		rs, ok := byRep[s.UserID]
+		if !ok {
+			rs = &repStats{UserID: s.UserID}
+			byRep[s.UserID] = rs
+			reps = append(reps, rs)
+		}
+		rs.Sessions++
+		rs.add(s.DialerStats)
+	}
+	sort.Slice(reps, func(i, j int) bool { return reps[i].UserID < reps[j].UserID })
+	c.JSON(http.StatusOK, gin.H{"sessions": len(sessions), "totals": total, "reps": reps})
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- DAILY DIGEST ---
+
+// The digest job wakes up this often and sends to everyone whose chosen
+// hour has arrived in their own timezone and who hasn't had today's yet.
+const DIGEST_CHECK_INTERVAL = 10 * time.Minute
+
+// Each section of the email lists at most this many leads.
+const DIGEST_SECTION_LIMIT = 20
+
+type digest struct {
+	dueToday  []CrmLead
+	overdue   []CrmLead
+	stale     []CrmLead
+	staleDays int
+}
+
+func (d digest) empty() bool {
+	return len(d.dueToday) == 0 && len(d.overdue) == 0 && len(d.stale) == 0
+}
+
+// buildDigest sorts the tenant's open CRM leads into the digest sections.
+// Leads already in the contacted column are left out.
+func buildDigest(repo *Repository, settings UserSettings, now time.Time) (digest, error) {
+	d := digest{staleDays: settings.StaleAfterDays}
+	leads, err := repo.CrmLeads()
+	if err != nil {
+		return d, err
+	}
+
+	loc := settings.location()
+	local := now.In(loc)
+	startOfDay := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	endOfDay := startOfDay.AddDate(0, 0, 1)
+	staleBefore := now.AddDate(0, 0, -settings.StaleAfterDays)
+
+	for _, l := range leads {
+		if l.ColumnID == "contacted" {
+			continue
+		}
+		switch {
+		case l.CallBackDate != nil && l.CallBackDate.Before(startOfDay):
+			d.overdue = append(d.overdue, l)
+		case l.CallBackDate != nil && l.CallBackDate.Before(endOfDay):
+			d.dueToday = append(d.dueToday, l)
+		case l.CallBackDate == nil && l.UpdatedAt != nil && l.UpdatedAt.Before(staleBefore):
+			d.stale = append(d.stale, l)
+		}
+	}
+
+	byCallback := func(leads []CrmLead) {
+		sort.Slice(leads, func(i, j int) bool { return leads[i].CallBackDate.Before(*leads[j].CallBackDate) })
+	}
+	byCallback(d.dueToday)
+	byCallback(d.overdue)
+	sort.Slice(d.stale, func(i, j int) bool { return d.stale[i].UpdatedAt.Before(*d.stale[j].UpdatedAt) })
+	return d, nil
+}
+
+func (d digest) render(name string, loc *time.Location, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n", name)
+
+	section := func(title string, leads []CrmLead, line func(CrmLead) string) {
+		if len(leads) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n%s (%d)\n", title, len(leads))
+		for i, l := range leads {
+			if i == DIGEST_SECTION_LIMIT {
+				fmt.Fprintf(&b, "  ...and %d more\n", len(leads)-i)
+				break
+			}
+			fmt.Fprintf(&b, "  - %s\n", line(l))
+		}
+	}
+	contact := func(l CrmLead) string {
+		if l.Phone != "" {
+			return fmt.Sprintf("%s, %s", l.CompanyName, l.Phone)
+		}
+		return l.CompanyName
+	}
+
+	section("Callbacks due today", d.dueToday, func(l CrmLead) string {
+		return fmt.Sprintf("%s  %s", l.CallBackDate.In(loc).Format("15:04"), contact(l))
+	})
+	section("Overdue callbacks", d.overdue, func(l CrmLead) string {
+		return fmt.Sprintf("%s  %s", l.CallBackDate.In(loc).Format("Mon 2 Jan"), contact(l))
+	})
+	section(fmt.Sprintf("Leads untouched for %d+ days", d.staleDays), d.stale, func(l CrmLead) string {
+		return fmt.Sprintf("%s (last touched %d days ago)", contact(l), int(now.Sub(*l.UpdatedAt).Hours()/24))
+	})
+
+	b.WriteString("\nYou can turn these emails off or change when they arrive in Settings.\n")
+	return b.String()
+}
+
+// sendDueDigests emails every user whose digest is due. A user's day is
+// marked as done even when there was nothing to report, so they get at most
+// one email a day.
+func sendDueDigests() {
+	if !mailConfigured() {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT u.id, u.org_id, u.name, u.email, COALESCE(s.last_digest_date, '')
+        FROM users u LEFT JOIN user_settings s ON s.user_id = u.id
+        WHERE u.disabled_at IS NULL AND COALESCE(s.digest_enabled, 1) = 1
+    `)
+	if err != nil {
+		log.Printf("Failed to load digest recipients: %v", err)
+		return
+	}
+	type recipient struct {
+		tenant      Tenant
+		name, email string
+		lastSent    string
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.tenant.UserID, &r.tenant.OrgID, &r.name, &r.email, &r.lastSent); err != nil {
+			log.Printf("Error scanning digest recipient: %v", err)
+			continue
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, r := range recipients {
+		settings, err := getUserSettings(context.Background(), r.tenant.UserID)
+		if err != nil {
+			log.Printf("Failed to load settings for user %d: %v", r.tenant.UserID, err)
+			continue
+		}
+		loc := settings.location()
+		local := now.In(loc)
+		today := local.Format("2006-01-02")
+		if local.Hour() < settings.DigestHour || r.lastSent == today {
+			continue
+		}
+
+		d, err := buildDigest(newRepository(r.tenant), settings, now)
+		if err != nil {
+			log.Printf("Failed to build digest for user %d: %v", r.tenant.UserID, err)
+			continue
+		}
+		if !d.empty() {
+			subject := fmt.Sprintf("Your calls for %s", local.Format("Monday 2 January"))
+			if err := sendMail(r.email, subject, d.render(r.name, loc, now)); err != nil {
+				// Leave the day unmarked so the next run tries again.
+				log.Printf("Failed to send digest to user %d: %v", r.tenant.UserID, err)
+				continue
+			}
+		}
+
+		_, err = db.Exec(`
+            INSERT INTO user_settings (user_id, last_digest_date) VALUES (?, ?)
+            ON CONFLICT(user_id) DO UPDATE SET last_digest_date = excluded.last_digest_date
+        `, r.tenant.UserID, today)
+		if err != nil {
+			log.Printf("Failed to record digest for user %d: %v", r.tenant.UserID, err)
+		}
+	}
+}
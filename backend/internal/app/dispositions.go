@@ -0,0 +1,262 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- CALL DISPOSITIONS ---
+//
+// Every dial is recorded as a call with the outcome the rep picked, rather
+// than by bumping a bare counter. times_called is kept in step with the
+// number of recorded calls, plus whatever was counted before calls were
+// recorded individually.
+
+type Disposition struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+var dispositions = []Disposition{
+	{"no_answer", "No answer"},
+	{"voicemail", "Voicemail"},
+	{"gatekeeper", "Gatekeeper"},
+	{"interested", "Interested"},
+	{"not_interested", "Not interested"},
+	{"wrong_number", "Wrong number"},
+}
+
+// defaultDispositionRules move a lead off the call list once someone has
+// actually been reached; an organization can override each one, and an
+// empty column means the lead stays where it is.
+var defaultDispositionRules = map[string]string{
+	"no_answer":      "",
+	"voicemail":      "",
+	"gatekeeper":     "",
+	"interested":     "contacted",
+	"not_interested": "contacted",
+	"wrong_number":   "contacted",
+}
+
+// connectedDispositions are the outcomes where somebody picked up.
+var connectedDispositions = []string{"gatekeeper", "interested", "not_interested"}
+
+// Call is one recorded dial. DurationSeconds is the talk time, when the
+// rep gave it; SessionID is the dialer session the call was made in.
+type Call struct {
+	ID              int64     `json:"id"`
+	LeadID          string    `json:"leadId"`
+	UserID          int64     `json:"userId"`
+	Disposition     string    `json:"disposition"`
+	Notes           string    `json:"notes"`
+	DurationSeconds int       `json:"durationSeconds"`
+	SessionID       *int64    `json:"sessionId,omitempty"`
+	CalledAt        time.Time `json:"calledAt"`
+}
+
+type callInput struct {
+	Disposition     string `json:"disposition" binding:"required"`
+	Notes           string `json:"notes"`
+	DurationSeconds int    `json:"durationSeconds"`
+}
+
+func (in callInput) validate() error {
+	if !isDisposition(in.Disposition) {
+		return fmt.Errorf("unknown disposition '%s'", in.Disposition)
+	}
+	if in.DurationSeconds < 0 {
+		return fmt.Errorf("durationSeconds cannot be negative")
+	}
+	return nil
+}
+
+func isDisposition(id string) bool {
+	for _, d := range dispositions {
+		if d.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func getDispositionsHandler(c *gin.Context) {
+	rules, err := repoFrom(c).DispositionRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load disposition rules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dispositions": dispositions, "rules": rules})
+}
+
+// updateDispositionRulesHandler takes a map of disposition to column ID;
+// dispositions left out keep their current rule.
+func updateDispositionRulesHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input map[string]string
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	for disposition, column := range input {
+		if !isDisposition(disposition) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown disposition '%s'", disposition)})
+			return
+		}
+		if column != "" && !repo.Crm().HasColumn(column) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown column '%s'", column)})
+			return
+		}
+	}
+
+	if err := repo.SetDispositionRules(input); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save disposition rules"})
+		return
+	}
+	rules, err := repo.DispositionRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load disposition rules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dispositions": dispositions, "rules": rules})
+}
+
+// recordCallHandler logs a call against a CRM lead and applies the
+// organization's column rule for its disposition.
+func recordCallHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	leadID := c.Param("leadId")
+
+	var input callInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	call, columnID, warning, err := recordCall(txRepo, leadID, input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record call"})
+		return
+	}
+
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record call"})
+		return
+	}
+	response := gin.H{"call": call, "columnId": columnID, "version": version}
+	if warning != "" {
+		response["warning"] = warning
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// recordCall records a call and applies the disposition's rule. The call
+// is always recorded, but a rule can't push a card into a column that has
+// been deleted or is full with moves rejected; warning says why.
+func recordCall(repo *Repository, leadID string, in callInput) (call Call, columnID, warning string, err error) {
+	rules, err := repo.DispositionRules()
+	if err != nil {
+		return call, "", "", err
+	}
+	moveTo := rules[in.Disposition]
+	if moveTo != "" {
+		wip, err := repo.Crm().CheckWIP(moveTo, leadID)
+		switch {
+		case err == store.ErrNotFound:
+			moveTo = ""
+		case err != nil:
+			return call, "", "", err
+		case wip.Rejects():
+			moveTo, warning = "", wip.Message()+", so the card stayed put"
+		case wip.Exceeded():
+			warning = wip.Message()
+		}
+	}
+	call, columnID, err = repo.RecordCall(leadID, in.Disposition, in.Notes, in.DurationSeconds, moveTo)
+	return call, columnID, warning, err
+}
+
+func getLeadCallsHandler(c *gin.Context) {
+	calls, err := repoFrom(c).LeadCalls(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load calls"})
+		return
+	}
+	c.JSON(http.StatusOK, calls)
+}
+
+// getDispositionAnalyticsHandler counts calls per disposition between the
+// optional from and to dates (YYYY-MM-DD, inclusive, in the caller's
+// timezone). Every disposition is present in the result, zero or not.
+func getDispositionAnalyticsHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	settings, err := getUserSettings(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	loc := settings.location()
+
+	var from, to *time.Time
+	if v := c.Query("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date (YYYY-MM-DD)"})
+			return
+		}
+		from = &t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date (YYYY-MM-DD)"})
+			return
+		}
+		t = t.AddDate(0, 0, 1)
+		to = &t
+	}
+
+	counts, err := repoFrom(c).DispositionCounts(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load call analytics"})
+		return
+	}
+	total := 0
+	for _, d := range dispositions {
+		total += counts[d.ID]
+	}
+	goal, err := dialGoalFor(repoFrom(c), settings, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load call analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "counts": counts, "streaks": goal.Streaks})
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// --- ENCRYPTION AT REST ---
+//
+// When DB_ENCRYPTION_KEY is set every connection is keyed with SQLCipher's
+// PRAGMA key, so the whole database file (and its WAL) is encrypted. This
+// needs go-sqlite3 linked against libsqlcipher instead of its bundled
+// SQLite; see the README for the build flags.
+
+const DB_DRIVER = "sqlite3_keyed"
+
+var dbEncryptionKey = os.Getenv("DB_ENCRYPTION_KEY")
+
+func init() {
+	sql.Register(DB_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := registerSQLFunctions(conn); err != nil {
+				return err
+			}
+			if dbEncryptionKey == "" {
+				return nil
+			}
+			// PRAGMA arguments can't be bound, so quote the key as a literal.
+			_, err := conn.Exec("PRAGMA key = '"+strings.ReplaceAll(dbEncryptionKey, "'", "''")+"'", nil)
+			return err
+		},
+	})
+}
+
+// checkEncryption refuses to start with a key that would silently be
+// ignored by plain SQLite, or one that doesn't open the existing file.
+func checkEncryption() {
+	if dbEncryptionKey == "" {
+		return
+	}
+
+	var cipherVersion string
+	err := db.QueryRow("PRAGMA cipher_version").Scan(&cipherVersion)
+	if err == sql.ErrNoRows || (err == nil && cipherVersion == "") {
+		log.Fatal("DB_ENCRYPTION_KEY is set but SQLite was built without SQLCipher; refusing to store data unencrypted")
+	}
+	if err != nil {
+		log.Fatal("Failed to check SQLCipher version:", err)
+	}
+
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		log.Fatal("Failed to open encrypted database (wrong DB_ENCRYPTION_KEY, or the file is not encrypted yet?):", err)
+	}
+	log.Printf("Database encryption enabled (SQLCipher %s)", cipherVersion)
+}
@@ -0,0 +1,311 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/scraper"
+)
+
+// --- WEBSITE ENRICHMENT ---
+const ENRICH_WORKERS = 4
+const ENRICH_MAX_PAGE_BYTES = 2 * 1024 * 1024
+
+var enrichClient = &http.Client{Timeout: 15 * time.Second}
+
+// postProcessSearch runs the background steps that follow ingestion.
+func postProcessSearch(searchID string) {
+	enrichSearchLeads(searchID)
+	geocodeSearchLeads(searchID)
+	assignLeadTimezones()
+	lookupSearchPhones(searchID)
+	lookupSearchFirmographics(searchID)
+	captureSearchScreenshots(searchID)
+	auditSearchLeads(searchID)
+}
+
+type enrichTarget struct {
+	id       string
+	userID   int64
+	website  string
+	hasEmail bool
+}
+
+// enrichSearchLeads fetches each lead's homepage and extracts whatever
+// extra signals it can, a few sites at a time.
+func enrichSearchLeads(searchID string) {
+	rows, err := db.Query(`
+        SELECT id, (SELECT user_id FROM searches WHERE id = leads.search_id), website,
+               COALESCE(email, '') != '' OR EXISTS (SELECT 1 FROM lead_emails e WHERE e.lead_id = leads.id)
+        FROM leads WHERE search_id = ? AND website IS NOT NULL AND website != ''
+    `, searchID)
+	if err != nil {
+		log.Printf("Failed to load leads to enrich for search %s: %v", searchID, err)
+		return
+	}
+	var targets []enrichTarget
+	for rows.Next() {
+		var t enrichTarget
+		if err := rows.Scan(&t.id, &t.userID, &t.website, &t.hasEmail); err != nil {
+			log.Printf("Error scanning lead to enrich: %v", err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+
+	jobs := make(chan enrichTarget)
+	var wg sync.WaitGroup
+	for i := 0; i < ENRICH_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				enrichLead(context.Background(), t)
+			}
+		}()
+	}
+	for _, t := range targets {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+	log.Printf("Enriched %d leads for search %s", len(targets), searchID)
+}
+
+func enrichLead(ctx context.Context, t enrichTarget) {
+	// A business whose only "website" is a social profile has nothing more to fetch.
+	if socials := extractSocialProfiles(t.website); !socials.Empty() {
+		saveSocialProfiles(t.id, socials)
+		return
+	}
+
+	page, pageURL, err := fetchPage(ctx, t.website)
+	if err != nil {
+		log.Printf("Failed to fetch website for lead %s: %v", t.id, err)
+		return
+	}
+	saveSocialProfiles(t.id, extractSocialProfiles(page))
+	saveTech(t.id, detectTech(page))
+	saveSiteFeatures(t.id, detectSiteFeatures(page))
+	if !t.hasEmail && !saveCrawledEmails(ctx, t.id, crawlForEmails(ctx, pageURL, page)) && emailGuessingEnabled {
+		guessLeadEmails(ctx, t.userID, t.id, t.website)
+	}
+}
+
+// fetchPage downloads an HTML page for analysis, honoring robots.txt. It
+// also returns the page's URL after redirects, for resolving its links.
+func fetchPage(ctx context.Context, rawURL string) (string, *url.URL, error) {
+	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		rawURL = "http://" + rawURL
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	allowed, err := scraper.RobotsAllowed(ctx, enrichClient, target)
+	if err != nil {
+		return "", nil, err
+	}
+	if !allowed {
+		return "", nil, fmt.Errorf("robots.txt disallows %s", target.Path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("User-Agent", scraper.UserAgent)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := enrichClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, ENRICH_MAX_PAGE_BYTES))
+	if err != nil {
+		return "", nil, err
+	}
+	return string(body), resp.Request.URL, nil
+}
+
+// --- SOCIAL PROFILES ---
+var (
+	facebookRe  = regexp.MustCompile(`(?i)https?://(?:www\.|m\.|business\.)?facebook\.com/([A-Za-z0-9_.\-]+(?:/[A-Za-z0-9_.\-]+)?)`)
+	instagramRe = regexp.MustCompile(`(?i)https?://(?:www\.)?instagram\.com/([A-Za-z0-9_.]+)`)
+	linkedInRe  = regexp.MustCompile(`(?i)https?://(?:[a-z]{2,3}\.)?linkedin\.com/(company|in)/([A-Za-z0-9_\-%]+)`)
+)
+
+// Paths on the social networks that are share buttons, embeds or tracking
+// pixels rather than a business's own profile.
+var facebookNonProfiles = map[string]bool{
+	"sharer": true, "sharer.php": true, "share.php": true, "plugins": true, "tr": true,
+	"dialog": true, "login": true, "policies": true, "help": true,
+}
+var instagramNonProfiles = map[string]bool{"p": true, "explore": true, "accounts": true, "reel": true}
+
+func extractSocialProfiles(text string) leads.SocialProfiles {
+	var s leads.SocialProfiles
+	for _, m := range facebookRe.FindAllStringSubmatch(text, -1) {
+		first := strings.ToLower(strings.SplitN(m[1], "/", 2)[0])
+		if facebookNonProfiles[first] {
+			continue
+		}
+		s.Facebook = "https://www.facebook.com/" + strings.TrimSuffix(m[1], "/")
+		break
+	}
+	for _, m := range instagramRe.FindAllStringSubmatch(text, -1) {
+		if instagramNonProfiles[strings.ToLower(m[1])] {
+			continue
+		}
+		s.Instagram = "https://www.instagram.com/" + m[1]
+		break
+	}
+	if m := linkedInRe.FindStringSubmatch(text); m != nil {
+		s.LinkedIn = fmt.Sprintf("https://www.linkedin.com/%s/%s", strings.ToLower(m[1]), m[2])
+	}
+	return s
+}
+
+// saveSocialProfiles fills in any profile links the lead doesn't have yet.
+func saveSocialProfiles(leadID string, s leads.SocialProfiles) {
+	if s.Empty() {
+		return
+	}
+	_, err := db.Exec(`
+        UPDATE leads SET
+            facebook_url = COALESCE(NULLIF(facebook_url, ''), NULLIF(?, '')),
+            instagram_url = COALESCE(NULLIF(instagram_url, ''), NULLIF(?, '')),
+            linkedin_url = COALESCE(NULLIF(linkedin_url, ''), NULLIF(?, ''))
+        WHERE id = ?
+    `, s.Facebook, s.Instagram, s.LinkedIn, leadID)
+	if err != nil {
+		log.Printf("Failed to save social profiles for lead %s: %v", leadID, err)
+	}
+}
+
+// --- TECH DETECTION ---
+
+// techSignatures are markers a site builder or CMS leaves in its pages.
+// Reps pitch a WordPress site differently from a Wix one.
+var techSignatures = []struct {
+	name    string
+	markers []string
+}{
+	{"WordPress", []string{"/wp-content/", "/wp-includes/"}},
+	{"Wix", []string{"static.wixstatic.com", "wix.com website builder"}},
+	{"Squarespace", []string{"static1.squarespace.com", "squarespace-cdn.com"}},
+	{"Shopify", []string{"cdn.shopify.com", "shopify.theme"}},
+	{"Webflow", []string{"webflow.js", "data-wf-site"}},
+	{"GoDaddy", []string{"img1.wsimg.com", "godaddy website builder"}},
+	{"Weebly", []string{"editmysite.com", "weebly.com"}},
+	{"Joomla", []string{"/media/jui/", "content=\"joomla"}},
+	{"Drupal", []string{"drupal.settings", "/sites/default/files/"}},
+}
+
+func detectTech(page string) []string {
+	page = strings.ToLower(page)
+	var found []string
+	for _, sig := range techSignatures {
+		for _, marker := range sig.markers {
+			if strings.Contains(page, marker) {
+				found = append(found, sig.name)
+				break
+			}
+		}
+	}
+	return found
+}
+
+func saveTech(leadID string, tech []string) {
+	if len(tech) == 0 {
+		return
+	}
+	if _, err := db.Exec("UPDATE leads SET tech = ? WHERE id = ?", strings.Join(tech, ","), leadID); err != nil {
+		log.Printf("Failed to save tech for lead %s: %v", leadID, err)
+	}
+}
+
+// --- SITE FEATURES ---
+
+// siteFeatureSignatures are markers the widgets and tags behind each
+// feature leave in a page.
+var siteFeatureSignatures = []struct {
+	feature func(*leads.SiteFeatures) *bool
+	markers []string
+}{
+	{func(f *leads.SiteFeatures) *bool { return &f.LiveChat }, []string{
+		"widget.intercom.io", "js.driftt.com", "embed.tawk.to", "cdn.livechatinc.com", "static.zdassets.com",
+		"client.crisp.chat", "code.tidio.co", "static.olark.com", "wchat.freshchat.com",
+	}},
+	{func(f *leads.SiteFeatures) *bool { return &f.OnlineBooking }, []string{
+		"calendly.com/", "acuityscheduling.com", "squareup.com/appointments", "fresha.com", "setmore.com",
+		"simplybook.", "booksy.com", "opentable.", "resdiary.com", "gettimely.com", "youcanbook.me", "mindbodyonline.com",
+		"book online", "book an appointment",
+	}},
+	{func(f *leads.SiteFeatures) *bool { return &f.ECommerce }, []string{
+		"cdn.shopify.com", "woocommerce", "bigcommerce.com", "ecwid.com", "mage/cookies", "prestashop", "snipcart",
+		"add to cart", "add to basket", "add-to-cart",
+	}},
+	{func(f *leads.SiteFeatures) *bool { return &f.Analytics }, []string{
+		"googletagmanager.com", "google-analytics.com", "gtag(", "plausible.io", "matomo.js", "static.hotjar.com",
+		"clarity.ms", "cdn.usefathom.com", "connect.facebook.net",
+	}},
+}
+
+var viewportRe = regexp.MustCompile(`(?i)<meta[^>]*name\s*=\s*["']?viewport[^>]*>`)
+
+// detectSiteFeatures reads the features off a homepage. A site counts as
+// mobile friendly when it sizes its viewport to the device.
+func detectSiteFeatures(page string) leads.SiteFeatures {
+	page = strings.ToLower(page)
+	var f leads.SiteFeatures
+	for _, sig := range siteFeatureSignatures {
+		for _, marker := range sig.markers {
+			if strings.Contains(page, marker) {
+				*sig.feature(&f) = true
+				break
+			}
+		}
+	}
+	for _, tag := range viewportRe.FindAllString(page, -1) {
+		if strings.Contains(strings.ReplaceAll(tag, " ", ""), "width=device-width") {
+			f.MobileFriendly = true
+		}
+	}
+	return f
+}
+
+func saveSiteFeatures(leadID string, f leads.SiteFeatures) {
+	_, err := db.Exec("UPDATE leads SET has_live_chat = ?, has_online_booking = ?, has_ecommerce = ?, has_analytics = ?, mobile_friendly = ? WHERE id = ?",
+		f.LiveChat, f.OnlineBooking, f.ECommerce, f.Analytics, f.MobileFriendly, leadID)
+	if err != nil {
+		log.Printf("Failed to save site features for lead %s: %v", leadID, err)
+	}
+}
+
+// siteFeatureFilters are the leads list and board filters on site
+// features, e.g. onlineBooking=false, and the columns they read. Leads whose
+// site hasn't been analysed match neither true nor false.
+var siteFeatureFilters = []struct{ param, column string }{
+	{"liveChat", "has_live_chat"},
+	{"onlineBooking", "has_online_booking"},
+	{"ecommerce", "has_ecommerce"},
+	{"analytics", "has_analytics"},
+	{"mobileFriendly", "mobile_friendly"},
+}
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- FEATURE FLAGS ---
+//
+// Flags let a risky subsystem ship dark and be turned on for some accounts
+// before everyone. A flag is on for a user when an admin has turned it on
+// or off for them specifically; otherwise when it's on globally; otherwise
+// when the user falls in its rollout percentage. Which users fall in a
+// percentage depends on the flag, so raising it only ever adds users, and
+// one flag's early users aren't every flag's early users. A flag that was
+// never created is off.
+//
+// GET /api/me lists every flag with whether it's on for the user, and
+// routes behind requireFeature answer 404 to users without the flag.
+
+var featureKeyRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+type FeatureFlag struct {
+	Key            string    `json:"key"`
+	Description    string    `json:"description"`
+	Enabled        bool      `json:"enabled"`
+	RolloutPercent int       `json:"rolloutPercent"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+	// Users maps user IDs to the per-user setting that overrides the rest.
+	Users map[int64]bool `json:"users"`
+}
+
+type FeatureFlagInput struct {
+	Description    string `json:"description"`
+	Enabled        bool   `json:"enabled"`
+	RolloutPercent int    `json:"rolloutPercent"`
+}
+
+// inFeatureRollout says whether userID is among the first percent of users
+// for key.
+func inFeatureRollout(key string, userID int64, percent int) bool {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d", key, userID)
+	return int(h.Sum32()%100) < percent
+}
+
+// featuresFor returns every flag and whether it's on for userID.
+func featuresFor(ctx context.Context, userID int64) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT f.key, f.enabled, f.rollout_percent, u.enabled
+        FROM feature_flags f
+        LEFT JOIN feature_flag_users u ON u.flag_key = f.key AND u.user_id = ?
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	features := map[string]bool{}
+	for rows.Next() {
+		var key string
+		var enabled bool
+		var percent int
+		var override sql.NullBool
+		if err := rows.Scan(&key, &enabled, &percent, &override); err != nil {
+			return nil, err
+		}
+		if override.Valid {
+			features[key] = override.Bool
+		} else {
+			features[key] = enabled || inFeatureRollout(key, userID, percent)
+		}
+	}
+	return features, rows.Err()
+}
+
+// featureEnabled says whether key is on for userID.
+func featureEnabled(ctx context.Context, key string, userID int64) (bool, error) {
+	var enabled bool
+	var percent int
+	var override sql.NullBool
+	err := db.QueryRowContext(ctx, `
+        SELECT f.enabled, f.rollout_percent, u.enabled
+        FROM feature_flags f
+        LEFT JOIN feature_flag_users u ON u.flag_key = f.key AND u.user_id = ?
+        WHERE f.key = ?
+    `, userID, key).Scan(&enabled, &percent, &override)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if override.Valid {
+		return override.Bool, nil
+	}
+	return enabled || inFeatureRollout(key, userID, percent), nil
+}
+
+// requireFeature hides routes from users without the key flag, as if they
+// didn't exist.
+func requireFeature(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		on, err := featureEnabled(c.Request.Context(), key, userID.(int64))
+		if err != nil {
+			log.Printf("Failed to check feature %s for user %v: %v", key, userID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check features"})
+			return
+		}
+		if !on {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func adminListFeaturesHandler(c *gin.Context) {
+	rows, err := db.QueryContext(c.Request.Context(), "SELECT key, description, enabled, rollout_percent, updated_at FROM feature_flags ORDER BY key")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve feature flags"})
+		return
+	}
+	flags := []FeatureFlag{}
+	for rows.Next() {
+		f := FeatureFlag{Users: map[int64]bool{}}
+		if err := rows.Scan(&f.Key, &f.Description, &f.Enabled, &f.RolloutPercent, &f.UpdatedAt); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve feature flags"})
+			return
+		}
+		flags = append(flags, f)
+	}
+	rows.Close()
+	byKey := map[string]*FeatureFlag{}
+	for i := range flags {
+		byKey[flags[i].Key] = &flags[i]
+	}
+
+	rows, err = db.QueryContext(c.Request.Context(), "SELECT flag_key, user_id, enabled FROM feature_flag_users")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve feature flags"})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var userID int64
+		var enabled bool
+		if err := rows.Scan(&key, &userID, &enabled); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve feature flags"})
+			return
+		}
+		if f, ok := byKey[key]; ok {
+			f.Users[userID] = enabled
+		}
+	}
+	c.JSON(http.StatusOK, flags)
+}
+
+func adminPutFeatureHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	key := c.Param("key")
+	var input FeatureFlagInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	fe.check(featureKeyRe.MatchString(key), "key", "must be lowercase letters, digits, - and _, at most 50")
+	fe.check(input.RolloutPercent >= 0 && input.RolloutPercent <= 100, "rolloutPercent", "must be between 0 and 100")
+	checkLength(fe, "description", input.Description, 0, 500)
+	if fe.respond(c) {
+		return
+	}
+
+	_, err := db.ExecContext(c.Request.Context(), `
+        INSERT INTO feature_flags (key, description, enabled, rollout_percent, updated_at) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT (key) DO UPDATE SET description = excluded.description, enabled = excluded.enabled,
+            rollout_percent = excluded.rollout_percent, updated_at = excluded.updated_at
+    `, key, input.Description, input.Enabled, input.RolloutPercent, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feature flag"})
+		return
+	}
+	log.Printf("Admin %d set feature %s: enabled %v, rollout %d%%", userID, key, input.Enabled, input.RolloutPercent)
+	c.Status(http.StatusNoContent)
+}
+
+func adminDeleteFeatureHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	key := c.Param("key")
+	res, err := db.ExecContext(c.Request.Context(), "DELETE FROM feature_flags WHERE key = ?", key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete feature flag"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feature flag not found"})
+		return
+	}
+	if _, err := db.ExecContext(c.Request.Context(), "DELETE FROM feature_flag_users WHERE flag_key = ?", key); err != nil {
+		log.Printf("Failed to delete user settings of feature %s: %v", key, err)
+	}
+	log.Printf("Admin %d deleted feature %s", userID, key)
+	c.Status(http.StatusNoContent)
+}
+
+// adminPutFeatureUserHandler turns a flag on or off for one user,
+// whatever the flag's own settings.
+func adminPutFeatureUserHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	key := c.Param("key")
+	targetID, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(c.Request.Context(), "SELECT EXISTS(SELECT 1 FROM feature_flags WHERE key = ?)", key).Scan(&exists); err != nil || !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feature flag not found"})
+		return
+	}
+	_, err := db.ExecContext(c.Request.Context(), `
+        INSERT INTO feature_flag_users (flag_key, user_id, enabled) VALUES (?, ?, ?)
+        ON CONFLICT (flag_key, user_id) DO UPDATE SET enabled = excluded.enabled
+    `, key, targetID, *input.Enabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feature flag"})
+		return
+	}
+	log.Printf("Admin %d set feature %s to %v for user %d", userID, key, *input.Enabled, targetID)
+	c.Status(http.StatusNoContent)
+}
+
+// adminDeleteFeatureUserHandler puts a user back on the flag's own
+// settings.
+func adminDeleteFeatureUserHandler(c *gin.Context) {
+	targetID, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+	if _, err := db.ExecContext(c.Request.Context(), "DELETE FROM feature_flag_users WHERE flag_key = ? AND user_id = ?", c.Param("key"), targetID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feature flag"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// --- FIELD ENCRYPTION ---
+//
+// With FIELD_ENCRYPTION_KEY set, contact details are sealed with AES-GCM
+// before they're written: lead and CRM phones and emails, CRM notes, call
+// notes and note history, and so are the passwords of connected mailboxes,
+// the OAuth tokens of connected mail accounts and SSO client secrets. A
+// leaked copy of the database file then doesn't give away the prospect list
+// or anyone's mail or SSO login, with or without SQLCipher. Repositories unseal the values as they
+// read them, and SQL that needs the plain value calls unseal()
+// (normalize_phone does it itself).
+//
+// The nonce is an HMAC of the value, so the same value always seals to the
+// same text. That shows which rows share a phone number, but it keeps
+// UNIQUE constraints, equality lookups and copies between tables working.
+//
+// Sealed values start with SEALED_PREFIX; anything else is plain text from
+// before the key was set, and is sealed at startup.
+
+const SEALED_PREFIX = "enc1:"
+
+// sealedColumns are the table and column of every sealed field.
+var sealedColumns = [][2]string{
+	{"leads", "phone"}, {"leads", "email"},
+	{"lead_phones", "phone"}, {"lead_emails", "email"},
+	{"crm_leads", "phone"}, {"crm_leads", "email"}, {"crm_leads", "notes"},
+	{"crm_calls", "notes"}, {"crm_note_revisions", "previous_notes"},
+	{"campaign_recipients", "email"},
+	{"bookings", "email"}, {"bookings", "phone"}, {"bookings", "notes"},
+	{"meetings", "attendees"}, {"meetings", "notes"},
+	{"mailboxes", "password"},
+	{"mail_accounts", "access_token"}, {"mail_accounts", "refresh_token"},
+	{"sso_configs", "client_secret"},
+}
+
+type fieldSealer struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// sealer is nil when field encryption is off.
+var sealer *fieldSealer
+
+// initFieldEncryption loads the key, stopping the server if it's malformed
+// rather than writing contact details in the clear.
+func initFieldEncryption() {
+	key, err := fieldEncryptionKey()
+	if err != nil {
+		log.Fatal("Invalid field encryption key: ", err)
+	}
+	if key == nil {
+		sealer = nil
+		return
+	}
+	block, err := aes.NewCipher(deriveFieldKey(key, "blueleads field encryption"))
+	if err != nil {
+		log.Fatal("Failed to set up field encryption:", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal("Failed to set up field encryption:", err)
+	}
+	sealer = &fieldSealer{aead: aead, macKey: deriveFieldKey(key, "blueleads field nonce")}
+}
+
+// fieldEncryptionKey reads the base64 key from FIELD_ENCRYPTION_KEY, or
+// from the file named by FIELD_ENCRYPTION_KEY_FILE, which is where a KMS
+// or secrets manager agent would put it. It's nil when neither is set.
+func fieldEncryptionKey() ([]byte, error) {
+	encoded := os.Getenv("FIELD_ENCRYPTION_KEY")
+	if path := os.Getenv("FIELD_ENCRYPTION_KEY_FILE"); path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(raw)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("it must be base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("it must be 32 bytes, not %d", len(key))
+	}
+	return key, nil
+}
+
+func deriveFieldKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// seal encrypts a contact detail for storage. Empty values stay empty, so
+// "has a phone" checks don't need the key.
+func seal(value string) string {
+	if sealer == nil || value == "" {
+		return value
+	}
+	mac := hmac.New(sha256.New, sealer.macKey)
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:sealer.aead.NonceSize()]
+	sealed := sealer.aead.Seal(nil, nonce, []byte(value), nil)
+	return SEALED_PREFIX + base64.RawStdEncoding.EncodeToString(append(nonce, sealed...))
+}
+
+// sealPtr seals an optional value, leaving nil alone.
+func sealPtr(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	sealed := seal(*value)
+	return &sealed
+}
+
+// unseal reverses seal. Plain text comes back as it is, and so does a
+// value that won't open, which is logged (without the value).
+func unseal(value string) string {
+	if sealer == nil || !strings.HasPrefix(value, SEALED_PREFIX) {
+		return value
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(value[len(SEALED_PREFIX):])
+	n := sealer.aead.NonceSize()
+	if err == nil && len(raw) > n {
+		if plain, err := sealer.aead.Open(nil, raw[:n], raw[n:], nil); err == nil {
+			return string(plain)
+		}
+	}
+	log.Printf("Failed to unseal a field; was it sealed with another key?")
+	return value
+}
+
+// fieldCodec hands seal and unseal to the storage packages.
+type fieldCodec struct{}
+
+func (fieldCodec) Seal(value string) string   { return seal(value) }
+func (fieldCodec) Unseal(value string) string { return unseal(value) }
+
+// sealExistingFields seals contact details written before the key was set.
+// It refuses to start when sealed values are there but the key doesn't open
+// them, or there's no key, since they'd be shown as gibberish.
+func sealExistingFields() {
+	sealed := int64(0)
+	for _, col := range sealedColumns {
+		table, column := col[0], col[1]
+		var sample string
+		err := db.QueryRow("SELECT "+column+" FROM "+table+" WHERE "+column+" LIKE ? LIMIT 1", SEALED_PREFIX+"%").Scan(&sample)
+		if err != nil && err != sql.ErrNoRows {
+			log.Fatalf("Failed to check %s.%s for sealed values: %v", table, column, err)
+		}
+		if err == nil && unseal(sample) == sample {
+			log.Fatalf("%s.%s holds sealed values that can't be opened; is FIELD_ENCRYPTION_KEY set to the key they were sealed with?", table, column)
+		}
+		if sealer == nil {
+			continue
+		}
+		// Where a lead has the same email both plain and sealed, say from a
+		// copy made before a restart, the two rows become one.
+		res, err := db.Exec("UPDATE OR REPLACE "+table+" SET "+column+" = seal("+column+") WHERE "+column+" != '' AND "+column+" NOT LIKE ?", SEALED_PREFIX+"%")
+		if err != nil {
+			log.Fatalf("Failed to seal %s.%s: %v", table, column, err)
+		}
+		n, _ := res.RowsAffected()
+		sealed += n
+	}
+	if sealed == 0 {
+		return
+	}
+	// The plain values are still in free pages and the WAL until both are
+	// rewritten.
+	if _, err := db.Exec("VACUUM"); err != nil {
+		log.Printf("Failed to vacuum after sealing contact details: %v", err)
+	}
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		log.Printf("Failed to checkpoint after sealing contact details: %v", err)
+	}
+	log.Printf("Sealed %d existing contact details", sealed)
+}
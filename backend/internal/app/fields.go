@@ -0,0 +1,123 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- SPARSE FIELDSETS ---
+//
+// Heavy listings accept ?fields=companyName,phone,... to return only those
+// fields of each item, which keeps large boards small on mobile. The id
+// always comes back so items can still be told apart.
+
+// fieldSet is the set of JSON fields a client asked for. A nil fieldSet
+// means every field.
+type fieldSet map[string]bool
+
+// requestedFields reads ?fields= for a listing of items shaped like
+// sample, rejecting names that aren't fields of it.
+func requestedFields(c *gin.Context, sample interface{}) (fieldSet, error) {
+	raw := c.Query("fields")
+	if raw == "" {
+		return nil, nil
+	}
+	known := jsonFieldNames(reflect.TypeOf(sample))
+	fs := fieldSet{"id": true}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			names := make([]string, 0, len(known))
+			for n := range known {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown field %q; fields are %s", name, strings.Join(names, ", "))
+		}
+		fs[name] = true
+	}
+	return fs, nil
+}
+
+// jsonFieldNames lists the JSON names of a struct's fields, including
+// those of embedded structs.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" {
+			for n := range jsonFieldNames(f.Type) {
+				names[n] = true
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// has reports whether the field was asked for.
+func (fs fieldSet) has(name string) bool {
+	return fs == nil || fs[name]
+}
+
+// trim returns v with only the requested fields, or v itself when every
+// field is wanted.
+func (fs fieldSet) trim(v interface{}) (interface{}, error) {
+	if fs == nil {
+		return v, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	for name := range fields {
+		if !fs[name] {
+			delete(fields, name)
+		}
+	}
+	return fields, nil
+}
+
+// trimList is trim for a slice of items.
+func (fs fieldSet) trimList(v interface{}) (interface{}, error) {
+	if fs == nil {
+		return v, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+	for _, fields := range items {
+		for name := range fields {
+			if !fs[name] {
+				delete(fields, name)
+			}
+		}
+	}
+	return items, nil
+}
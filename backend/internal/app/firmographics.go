@@ -0,0 +1,338 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- FIRMOGRAPHICS ---
+//
+// A firmographics provider fills in what a company register or data vendor
+// knows about a business: its legal name, how many people it employs and
+// when it was incorporated. Like phone lookups, users choose a provider
+// and supply their own key in settings, and each lead with a website is
+// looked up once, after a search finishes or on demand. Providers know
+// different things, so any of the three may stay empty.
+
+type FirmographicsProvider interface {
+	Info() VerifierInfo
+	// Lookup finds the company behind domain, called companyName in the
+	// search results; ok is false when the provider doesn't know it.
+	Lookup(ctx context.Context, apiKey, domain, companyName string) (f leads.Firmographics, ok bool, err error)
+}
+
+var firmographicsProviders = map[string]FirmographicsProvider{}
+
+func registerFirmographicsProvider(p FirmographicsProvider) {
+	firmographicsProviders[p.Info().ID] = p
+}
+
+func registerFirmographicsProviders() {
+	client := &http.Client{Timeout: 15 * time.Second}
+	registerFirmographicsProvider(&clearbitProvider{client: client})
+	registerFirmographicsProvider(&companiesHouseProvider{client: client})
+}
+
+// firmographicsFor returns the user's provider, or nil if they haven't set
+// one up.
+func firmographicsFor(settings UserSettings) FirmographicsProvider {
+	p, ok := firmographicsProviders[settings.FirmographicsProvider]
+	if !ok || settings.FirmographicsAPIKey == "" {
+		return nil
+	}
+	return p
+}
+
+// lookupFirmographics looks up every lead of the given ones with a website
+// that hasn't been looked up yet and returns how many the provider knew.
+func lookupFirmographics(ctx context.Context, userID int64, leadIDs []string) (int, error) {
+	settings, err := getUserSettings(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("loading settings: %w", err)
+	}
+	provider := firmographicsFor(settings)
+	if provider == nil {
+		return 0, fmt.Errorf("choose a firmographics provider and add its API key in settings")
+	}
+	if len(leadIDs) == 0 {
+		return 0, nil
+	}
+
+	placeholders, args := store.InList(leadIDs)
+	rows, err := db.Query("SELECT id, COALESCE(company_name, ''), website FROM leads WHERE firmographics_at IS NULL AND COALESCE(website, '') != '' AND id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id, companyName, domain string
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		var website string
+		if err := rows.Scan(&p.id, &p.companyName, &website); err != nil {
+			log.Printf("Error scanning lead to look up: %v", err)
+			continue
+		}
+		// Shared hosts like facebook.com say nothing about the company.
+		if p.domain = normalizeDomain(website); p.domain != "" {
+			todo = append(todo, p)
+		}
+	}
+	rows.Close()
+
+	found := 0
+	for _, p := range todo {
+		f, ok, err := provider.Lookup(ctx, settings.FirmographicsAPIKey, p.domain, p.companyName)
+		if err != nil {
+			return found, err
+		}
+		if !ok {
+			f = leads.Firmographics{}
+		}
+		_, err = db.Exec("UPDATE leads SET legal_name = ?, employee_count = ?, incorporated_on = ?, firmographics_at = ? WHERE id = ?",
+			f.LegalName, f.EmployeeCount, f.IncorporatedOn, time.Now(), p.id)
+		if err != nil {
+			return found, err
+		}
+		if ok {
+			found++
+		}
+	}
+	return found, nil
+}
+
+// lookupSearchFirmographics runs after ingestion for users with a provider
+// set up.
+func lookupSearchFirmographics(searchID string) {
+	var userID int64
+	if err := db.QueryRow("SELECT user_id FROM searches WHERE id = ?", searchID).Scan(&userID); err != nil {
+		log.Printf("Failed to load search %s for firmographics: %v", searchID, err)
+		return
+	}
+	settings, err := getUserSettings(context.Background(), userID)
+	if err != nil || firmographicsFor(settings) == nil {
+		return
+	}
+
+	rows, err := db.Query("SELECT id FROM leads WHERE search_id = ? AND deleted_at IS NULL", searchID)
+	if err != nil {
+		log.Printf("Failed to load leads for firmographics in search %s: %v", searchID, err)
+		return
+	}
+	var leadIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			leadIDs = append(leadIDs, id)
+		}
+	}
+	rows.Close()
+
+	// Keep each query's IN list well under SQLite's variable limit.
+	found := 0
+	for start := 0; start < len(leadIDs); start += 500 {
+		end := start + 500
+		if end > len(leadIDs) {
+			end = len(leadIDs)
+		}
+		n, err := lookupFirmographics(context.Background(), userID, leadIDs[start:end])
+		found += n
+		if err != nil {
+			log.Printf("Firmographics lookups stopped for search %s: %v", searchID, err)
+			break
+		}
+	}
+	log.Printf("Found firmographics for %d leads in search %s", found, searchID)
+}
+
+// getFirmographicsProvidersHandler lists the providers and which one the
+// user has chosen.
+func getFirmographicsProvidersHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	settings, err := getUserSettings(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+
+	type providerStatus struct {
+		VerifierInfo
+		Selected bool `json:"selected"`
+	}
+	providers := make([]providerStatus, 0, len(firmographicsProviders))
+	for _, p := range firmographicsProviders {
+		info := p.Info()
+		providers = append(providers, providerStatus{VerifierInfo: info, Selected: info.ID == settings.FirmographicsProvider})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].ID < providers[j].ID })
+	c.JSON(http.StatusOK, providers)
+}
+
+// lookupLeadFirmographicsHandler looks a lead up if it hasn't been yet and
+// returns what's known, or null.
+func lookupLeadFirmographicsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	lead, err := repo.Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+
+	if _, err := lookupFirmographics(c.Request.Context(), repo.Tenant().UserID, []string{lead.ID}); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Firmographics lookup failed", "details": err.Error()})
+		return
+	}
+	if lead, err = repo.Leads().Get(lead.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	c.JSON(http.StatusOK, lead.Firmographics)
+}
+
+// --- CLEARBIT ---
+const CLEARBIT_COMPANY_URL = "https://company.clearbit.com/v2/companies/find"
+
+type clearbitProvider struct {
+	client *http.Client
+}
+
+func (p *clearbitProvider) Info() VerifierInfo {
+	return VerifierInfo{ID: "clearbit", Name: "Clearbit", RequiresAPIKey: true, Paid: true}
+}
+
+func (p *clearbitProvider) Lookup(ctx context.Context, apiKey, domain, companyName string) (leads.Firmographics, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, CLEARBIT_COMPANY_URL+"?domain="+url.QueryEscape(domain), nil)
+	if err != nil {
+		return leads.Firmographics{}, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	var resp struct {
+		LegalName   string `json:"legalName"`
+		FoundedYear int    `json:"foundedYear"`
+		Metrics     struct {
+			Employees int `json:"employees"`
+		} `json:"metrics"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	httpResp, err := p.client.Do(req)
+	if err != nil {
+		return leads.Firmographics{}, false, err
+	}
+	defer httpResp.Body.Close()
+	// 404 is an unknown domain; 202 means Clearbit has only just started
+	// looking, which is as good as unknown for a one-off lookup.
+	if httpResp.StatusCode == http.StatusNotFound || httpResp.StatusCode == http.StatusAccepted {
+		return leads.Firmographics{}, false, nil
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return leads.Firmographics{}, false, fmt.Errorf("Clearbit: status %d", httpResp.StatusCode)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		if resp.Error != nil {
+			return leads.Firmographics{}, false, fmt.Errorf("Clearbit: %s", resp.Error.Message)
+		}
+		return leads.Firmographics{}, false, fmt.Errorf("Clearbit: status %d", httpResp.StatusCode)
+	}
+
+	f := leads.Firmographics{LegalName: resp.LegalName, EmployeeCount: resp.Metrics.Employees}
+	if resp.FoundedYear > 0 {
+		f.IncorporatedOn = fmt.Sprintf("%04d", resp.FoundedYear)
+	}
+	return f, !f.Empty(), nil
+}
+
+// --- COMPANIES HOUSE ---
+//
+// The UK register is searched by name, since it doesn't know websites; a
+// result only counts when its name is the lead's once suffixes like "Ltd"
+// are set aside. The register has no headcounts.
+const COMPANIES_HOUSE_SEARCH_URL = "https://api.company-information.service.gov.uk/search/companies"
+
+type companiesHouseProvider struct {
+	client *http.Client
+}
+
+func (p *companiesHouseProvider) Info() VerifierInfo {
+	return VerifierInfo{ID: "companies_house", Name: "Companies House", RequiresAPIKey: true, Paid: false}
+}
+
+func (p *companiesHouseProvider) Lookup(ctx context.Context, apiKey, domain, companyName string) (leads.Firmographics, bool, error) {
+	name := companyNameKey(companyName)
+	if name == "" {
+		return leads.Firmographics{}, false, nil
+	}
+	params := url.Values{}
+	params.Set("q", companyName)
+	params.Set("items_per_page", "10")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, COMPANIES_HOUSE_SEARCH_URL+"?"+params.Encode(), nil)
+	if err != nil {
+		return leads.Firmographics{}, false, err
+	}
+	// The key is the username, with no password.
+	req.SetBasicAuth(apiKey, "")
+
+	var resp struct {
+		Items []struct {
+			Title          string `json:"title"`
+			DateOfCreation string `json:"date_of_creation"`
+			CompanyStatus  string `json:"company_status"`
+		} `json:"items"`
+	}
+	httpResp, err := p.client.Do(req)
+	if err != nil {
+		return leads.Firmographics{}, false, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return leads.Firmographics{}, false, fmt.Errorf("Companies House: status %d", httpResp.StatusCode)
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return leads.Firmographics{}, false, fmt.Errorf("Companies House: %v", err)
+	}
+	for _, item := range resp.Items {
+		if item.CompanyStatus == "active" && companyNameKey(item.Title) == name {
+			return leads.Firmographics{LegalName: item.Title, IncorporatedOn: item.DateOfCreation}, true, nil
+		}
+	}
+	return leads.Firmographics{}, false, nil
+}
+
+var (
+	companyNamePunctuation = regexp.MustCompile(`[^a-z0-9&]+`)
+	companyNameSuffixes    = map[string]bool{"ltd": true, "limited": true, "plc": true, "llp": true, "lp": true, "cic": true, "the": true}
+)
+
+// companyNameKey reduces a company name to its lowercased words without
+// punctuation or legal suffixes, so "Acme Plumbing Ltd." and "ACME
+// PLUMBING LIMITED" compare equal.
+func companyNameKey(name string) string {
+	words := strings.Fields(companyNamePunctuation.ReplaceAllString(strings.ToLower(name), " "))
+	kept := words[:0]
+	for _, w := range words {
+		if !companyNameSuffixes[w] {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
@@ -0,0 +1,281 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- FULL-TEXT SEARCH ---
+//
+// The index is an FTS5 virtual table kept in sync by triggers. FTS5 is only
+// compiled into go-sqlite3 with the sqlite_fts5 build tag:
+//
+//	go build -tags sqlite_fts5
+//
+// Without it the /api/search endpoint falls back to LIKE matching.
+//
+// CRM notes are indexed unsealed, since sealed text can't be matched; with
+// field encryption on, the index holds the words of every card's notes.
+
+const FULLTEXT_DEFAULT_LIMIT = 25
+const FULLTEXT_MAX_LIMIT = 100
+
+var fullTextEnabled bool
+
+type FullTextResult struct {
+	Kind        string `json:"kind"`
+	ID          string `json:"id"`
+	SearchID    string `json:"searchId,omitempty"`
+	Keyword     string `json:"keyword,omitempty"`
+	ColumnID    string `json:"columnId,omitempty"`
+	CompanyName string `json:"companyName"`
+	Website     string `json:"website"`
+	Snippet     string `json:"snippet"`
+}
+
+var fullTextTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS leads_fts_insert AFTER INSERT ON leads BEGIN
+        INSERT INTO search_index (kind, item_id, org_id, company_name, notes, website)
+        VALUES ('lead', new.id, (SELECT org_id FROM searches WHERE id = new.search_id), COALESCE(new.company_name, ''), '', COALESCE(new.website, ''));
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS leads_fts_update AFTER UPDATE OF company_name, website ON leads BEGIN
+        UPDATE search_index SET company_name = COALESCE(new.company_name, ''), website = COALESCE(new.website, '')
+        WHERE kind = 'lead' AND item_id = new.id;
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS leads_fts_delete AFTER DELETE ON leads BEGIN
+        DELETE FROM search_index WHERE kind = 'lead' AND item_id = old.id;
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS crm_leads_fts_insert AFTER INSERT ON crm_leads BEGIN
+        INSERT INTO search_index (kind, item_id, org_id, company_name, notes, website)
+        VALUES ('crm', new.lead_id, new.org_id, COALESCE(new.company_name, ''), unseal(COALESCE(new.notes, '')), COALESCE(new.website, ''));
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS crm_leads_fts_update AFTER UPDATE OF company_name, notes, website ON crm_leads BEGIN
+        UPDATE search_index SET company_name = COALESCE(new.company_name, ''), notes = unseal(COALESCE(new.notes, '')), website = COALESCE(new.website, '')
+        WHERE kind = 'crm' AND item_id = new.lead_id AND org_id = new.org_id;
+    END`,
+	`CREATE TRIGGER IF NOT EXISTS crm_leads_fts_delete AFTER DELETE ON crm_leads BEGIN
+        DELETE FROM search_index WHERE kind = 'crm' AND item_id = old.lead_id AND org_id = old.org_id;
+    END`,
+}
+
+var fullTextTriggerNames = []string{
+	"leads_fts_insert", "leads_fts_update", "leads_fts_delete",
+	"crm_leads_fts_insert", "crm_leads_fts_update", "crm_leads_fts_delete",
+}
+
+// initFullTextIndex creates the FTS5 index and its triggers, rebuilding it
+// from existing rows whenever it or any trigger was missing. It leaves
+// fullTextEnabled false when SQLite was built without FTS5.
+func initFullTextIndex() {
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		log.Fatal("Failed to inspect SQLite build:", err)
+	}
+	if !fts5 {
+		// A database last opened by an FTS5 build still has triggers that
+		// write to the index; they would make every lead write fail here.
+		for _, name := range fullTextTriggerNames {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				log.Fatal("Failed to drop full-text trigger:", err)
+			}
+		}
+		log.Printf("SQLite was built without FTS5; full-text search will use slower LIKE matching. Build with -tags sqlite_fts5 to enable it.")
+		return
+	}
+
+	var existing, triggers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'search_index'").Scan(&existing); err != nil {
+		log.Fatal("Failed to inspect schema:", err)
+	}
+	if existing > 0 {
+		// Indexes built before organizations existed were keyed by user.
+		if _, err := db.Exec("SELECT org_id FROM search_index LIMIT 0"); err != nil {
+			dropFullTextIndex()
+			existing = 0
+		}
+	}
+	// Triggers from before notes were sealed indexed the sealed text; they're
+	// replaced and the index rebuilt.
+	var stale int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name IN ('crm_leads_fts_insert', 'crm_leads_fts_update') AND sql NOT LIKE '%unseal(%'").Scan(&stale); err != nil {
+		log.Fatal("Failed to inspect schema:", err)
+	}
+	if stale > 0 {
+		for _, name := range fullTextTriggerNames {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				log.Fatal("Failed to drop full-text trigger:", err)
+			}
+		}
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE '%_fts_%'").Scan(&triggers); err != nil {
+		log.Fatal("Failed to inspect schema:", err)
+	}
+
+	_, err := db.Exec(`
+        CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5(
+            kind UNINDEXED, item_id UNINDEXED, org_id UNINDEXED,
+            company_name, notes, website,
+            tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3'
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create search_index table:", err)
+	}
+
+	for _, trigger := range fullTextTriggers {
+		if _, err := db.Exec(trigger); err != nil {
+			log.Fatal("Failed to create full-text trigger:", err)
+		}
+	}
+
+	if existing == 0 || triggers < len(fullTextTriggerNames) {
+		_, err := db.Exec("DELETE FROM search_index")
+		if err == nil {
+			_, err = db.Exec(`
+            INSERT INTO search_index (kind, item_id, org_id, company_name, notes, website)
+            SELECT 'lead', l.id, s.org_id, COALESCE(l.company_name, ''), '', COALESCE(l.website, '')
+            FROM leads l JOIN searches s ON s.id = l.search_id
+        `)
+		}
+		if err == nil {
+			_, err = db.Exec(`
+                INSERT INTO search_index (kind, item_id, org_id, company_name, notes, website)
+                SELECT 'crm', lead_id, org_id, COALESCE(company_name, ''), unseal(COALESCE(notes, '')), COALESCE(website, '')
+                FROM crm_leads
+            `)
+		}
+		if err != nil {
+			log.Fatal("Failed to build search_index:", err)
+		}
+	}
+	fullTextEnabled = true
+}
+
+func dropFullTextIndex() {
+	for _, name := range fullTextTriggerNames {
+		if _, err := db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+			log.Fatal("Failed to drop full-text trigger:", err)
+		}
+	}
+	if _, err := db.Exec("DROP TABLE IF EXISTS search_index"); err != nil {
+		log.Fatal("Failed to drop search_index:", err)
+	}
+}
+
+// ftsMatchQuery turns free text into an FTS5 query that ANDs every word,
+// treating the last one as a prefix so results appear while typing.
+func ftsMatchQuery(q string) string {
+	words := strings.Fields(q)
+	terms := make([]string, 0, len(words))
+	for i, w := range words {
+		term := `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+		if i == len(words)-1 {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+func fullTextSearchHandler(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	limit := FULLTEXT_DEFAULT_LIMIT
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > FULLTEXT_MAX_LIMIT {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", FULLTEXT_MAX_LIMIT)})
+			return
+		}
+		limit = n
+	}
+
+	results, err := repoFrom(c).FullTextSearch(q, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+func searchFullTextIndex(ctx context.Context, orgID int64, q string, limit int) ([]FullTextResult, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT f.kind, f.item_id, COALESCE(l.search_id, ''), COALESCE(s.keyword, ''), COALESCE(cl.column_id, ''),
+               f.company_name, f.website, snippet(search_index, -1, '[', ']', '…', 12)
+        FROM search_index f
+        LEFT JOIN leads l ON f.kind = 'lead' AND l.id = f.item_id
+        LEFT JOIN searches s ON s.id = l.search_id
+        LEFT JOIN crm_leads cl ON f.kind = 'crm' AND cl.lead_id = f.item_id AND cl.org_id = f.org_id
+        WHERE search_index MATCH ? AND f.org_id = ?
+          AND (f.kind != 'lead' OR (l.deleted_at IS NULL AND s.deleted_at IS NULL))
+          AND (f.kind != 'crm' OR cl.deleted_at IS NULL)
+        ORDER BY rank
+        LIMIT ?`, ftsMatchQuery(q), orgID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanFullTextResults(rows)
+}
+
+// searchFullTextFallback covers builds without FTS5 using LIKE on each word.
+func searchFullTextFallback(ctx context.Context, orgID int64, q string, limit int) ([]FullTextResult, error) {
+	var leadConds, crmConds []string
+	var leadArgs, crmArgs []interface{}
+	for _, w := range strings.Fields(q) {
+		pattern := "%" + store.EscapeLike(w) + "%"
+		leadConds = append(leadConds, `(l.company_name LIKE ? ESCAPE '\' OR l.website LIKE ? ESCAPE '\')`)
+		leadArgs = append(leadArgs, pattern, pattern)
+		crmConds = append(crmConds, `(company_name LIKE ? ESCAPE '\' OR unseal(COALESCE(notes, '')) LIKE ? ESCAPE '\' OR website LIKE ? ESCAPE '\')`)
+		crmArgs = append(crmArgs, pattern, pattern, pattern)
+	}
+
+	args := append([]interface{}{orgID}, leadArgs...)
+	args = append(args, orgID)
+	args = append(args, crmArgs...)
+	args = append(args, limit)
+	rows, err := db.QueryContext(ctx, `
+        SELECT 'lead', l.id, l.search_id, s.keyword, '', COALESCE(l.company_name, ''), COALESCE(l.website, ''), COALESCE(l.company_name, '')
+        FROM leads l JOIN searches s ON s.id = l.search_id
+        WHERE s.org_id = ? AND l.deleted_at IS NULL AND s.deleted_at IS NULL AND `+strings.Join(leadConds, " AND ")+`
+        UNION ALL
+        SELECT 'crm', lead_id, '', '', column_id, COALESCE(company_name, ''), COALESCE(website, ''), unseal(COALESCE(notes, ''))
+        FROM crm_leads
+        WHERE org_id = ? AND deleted_at IS NULL AND `+strings.Join(crmConds, " AND ")+`
+        LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanFullTextResults(rows)
+}
+
+type rowsScanner interface {
+	store.RowScanner
+	Next() bool
+	Err() error
+}
+
+func scanFullTextResults(rows rowsScanner) ([]FullTextResult, error) {
+	results := []FullTextResult{}
+	for rows.Next() {
+		var r FullTextResult
+		if err := rows.Scan(&r.Kind, &r.ID, &r.SearchID, &r.Keyword, &r.ColumnID, &r.CompanyName, &r.Website, &r.Snippet); err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			continue
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
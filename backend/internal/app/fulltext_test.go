@@ -0,0 +1,86 @@
+//go:build sqlite_fts5
+
+package app
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"blueleads-backend/internal/leads"
+)
+
+func TestFullTextSearchMatchesSealedNotes(t *testing.T) {
+	t.Setenv("FIELD_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	initFieldEncryption()
+	t.Cleanup(func() { sealer = nil })
+	setupTestDB(t)
+	if !fullTextEnabled {
+		t.Fatal("the index wasn't created in an FTS5 build")
+	}
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.UpdateCrmLead(leadID, CrmLead{Notes: "Wants a quote for the boiler"}); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT notes FROM crm_leads WHERE lead_id = ?", leadID).Scan(&stored); err != nil || !strings.HasPrefix(stored, SEALED_PREFIX) {
+		t.Fatalf("notes stored as %q (err %v), want them sealed", stored, err)
+	}
+
+	found := func(q string) bool {
+		t.Helper()
+		results, err := alice.FullTextSearch(q, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range results {
+			if r.Kind == "crm" && r.ID == leadID {
+				if !strings.Contains(r.Snippet, "[") {
+					t.Errorf("snippet %q doesn't mark the match", r.Snippet)
+				}
+				return true
+			}
+		}
+		return false
+	}
+	if !found("boiler") {
+		t.Fatal("a word in the card's notes didn't find it")
+	}
+	if found("enc1") {
+		t.Fatal("the sealed text was indexed")
+	}
+	if err := alice.UpdateCrmLead(leadID, CrmLead{Notes: "Booked a survey"}); err != nil {
+		t.Fatal(err)
+	}
+	if found("boiler") || !found("survey") {
+		t.Fatal("the index didn't follow the notes")
+	}
+
+	// An index whose triggers indexed the sealed text is rebuilt from the
+	// cards at startup.
+	if _, err := db.Exec("DROP TRIGGER crm_leads_fts_update"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TRIGGER crm_leads_fts_update AFTER UPDATE OF notes ON crm_leads BEGIN
+        UPDATE search_index SET notes = COALESCE(new.notes, '') WHERE kind = 'crm' AND item_id = new.lead_id;
+    END`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE search_index SET notes = ? WHERE kind = 'crm'", stored); err != nil {
+		t.Fatal(err)
+	}
+	initFullTextIndex()
+	if !found("survey") {
+		t.Fatal("the rebuilt index doesn't match the unsealed notes")
+	}
+	if err := alice.UpdateCrmLead(leadID, CrmLead{Notes: "Sent the invoice"}); err != nil {
+		t.Fatal(err)
+	}
+	if !found("invoice") {
+		t.Fatal("the replaced trigger doesn't index unsealed notes")
+	}
+}
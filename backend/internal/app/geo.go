@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/scraper"
+)
+
+// --- GEOCODING ---
+
+// Nominatim's usage policy allows at most one request per second.
+const GEOCODER_REQUEST_INTERVAL = time.Second
+
+var geocoderURL = envOrDefault("GEOCODER_URL", "https://nominatim.openstreetmap.org/search")
+var geocoderClient = &http.Client{Timeout: 15 * time.Second}
+var geocoderLimiter = scraper.NewRateLimiter(GEOCODER_REQUEST_INTERVAL)
+
+// geocodeAddress resolves a free-form address to coordinates. ok is false
+// when the geocoder has no match.
+func geocodeAddress(ctx context.Context, address string) (lat, lng float64, ok bool, err error) {
+	if err := geocoderLimiter.Wait(ctx); err != nil {
+		return 0, 0, false, err
+	}
+
+	params := url.Values{}
+	params.Set("q", address)
+	params.Set("format", "json")
+	params.Set("limit", "1")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, geocoderURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	req.Header.Set("User-Agent", scraper.UserAgent)
+
+	resp, err := geocoderClient.Do(req)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, false, fmt.Errorf("geocoder returned status %d", resp.StatusCode)
+	}
+
+	var results []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return 0, 0, false, err
+	}
+	if len(results) == 0 {
+		return 0, 0, false, nil
+	}
+
+	lat, err = strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	lng, err = strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return lat, lng, true, nil
+}
+
+// geocodeSearchLeads fills in coordinates for a search's leads that have an
+// address but came back from their source without a location.
+func geocodeSearchLeads(searchID string) {
+	rows, err := db.Query("SELECT id, address FROM leads WHERE search_id = ? AND latitude IS NULL AND address IS NOT NULL AND address != ''", searchID)
+	if err != nil {
+		log.Printf("Failed to load leads to geocode for search %s: %v", searchID, err)
+		return
+	}
+	type pending struct{ id, address string }
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.address); err != nil {
+			log.Printf("Error scanning lead to geocode: %v", err)
+			continue
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+
+	if len(todo) == 0 {
+		return
+	}
+
+	geocoded := 0
+	for _, p := range todo {
+		lat, lng, ok, err := geocodeAddress(context.Background(), p.address)
+		if err != nil {
+			log.Printf("Geocoding failed for lead %s: %v", p.id, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if _, err := db.Exec("UPDATE leads SET latitude = ?, longitude = ?, timezone = NULL WHERE id = ?", lat, lng, p.id); err != nil {
+			log.Printf("Failed to store coordinates for lead %s: %v", p.id, err)
+			continue
+		}
+		geocoded++
+	}
+	log.Printf("Geocoded %d of %d leads for search %s", geocoded, len(todo), searchID)
+}
+
+// --- GEOJSON ---
+type geoJSONFeature struct {
+	Type       string       `json:"type"`
+	Geometry   geoJSONPoint `json:"geometry"`
+	Properties leads.Lead   `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+func getLeadsGeoHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	searchID := c.Param("searchId")
+
+	if !repo.Searches().Owns(searchID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	lq, err := buildLeadQuery(repo, searchID, c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	leads, err := leadService(c).List(lq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve leads"})
+		return
+	}
+
+	features := []geoJSONFeature{}
+	for _, l := range leads {
+		if l.Latitude == nil || l.Longitude == nil {
+			continue
+		}
+		features = append(features, geoJSONFeature{
+			Type: "Feature",
+			// GeoJSON positions are [longitude, latitude].
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: [2]float64{*l.Longitude, *l.Latitude}},
+			Properties: l,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"type": "FeatureCollection", "features": features})
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// --- GMAIL ---
+//
+// Gmail accounts send with the Gmail API's messages.send, which only needs
+// the gmail.send scope; the address comes from the OpenID userinfo
+// endpoint. The client is a Google Cloud OAuth web client with
+// MAIL_ACCOUNT_CALLBACK_URL as a redirect URI.
+
+const MAIL_GMAIL = "gmail"
+
+var gmailAPIURL = "https://gmail.googleapis.com"
+var googleUserinfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+
+var gmailProvider = &mailProvider{
+	name:     "Gmail",
+	authURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+	tokenURL: "https://oauth2.googleapis.com/token",
+	scopes:   "openid email https://www.googleapis.com/auth/gmail.send",
+	// Offline access with a fresh consent screen is what gets Google to
+	// issue a refresh token every time.
+	authParams:   url.Values{"access_type": {"offline"}, "prompt": {"consent"}},
+	clientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+	clientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+	// Consumer Gmail allows about 500 recipients a day and Workspace 2000.
+	defaultDailyLimit: 400,
+	maxDailyLimit:     2000,
+	address:           gmailAddress,
+	send:              gmailSend,
+}
+
+func gmailAddress(ctx context.Context, accessToken string) (string, error) {
+	var info struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := mailAPIRequest(ctx, http.MethodGet, googleUserinfoURL, accessToken, nil, &info); err != nil {
+		return "", err
+	}
+	if info.Email == "" || !info.EmailVerified {
+		return "", errors.New("no verified email address from Google")
+	}
+	return info.Email, nil
+}
+
+func gmailSend(ctx context.Context, accessToken string, msg []byte) error {
+	payload := map[string]string{"raw": base64.URLEncoding.EncodeToString(msg)}
+	return mailAPIRequest(ctx, http.MethodPost, gmailAPIURL+"/gmail/v1/users/me/messages/send", accessToken, payload, nil)
+}
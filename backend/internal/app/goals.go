@@ -0,0 +1,113 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- DAILY GOALS ---
+//
+// A user can set how many calls they aim to make a day. Days run midnight
+// to midnight in their timezone, and a streak is the run of days the goal
+// was met; without a goal any day with a call counts. Weekends only count
+// for users who call on weekends, so a quiet Saturday doesn't break a run.
+
+// STREAK_LOOKBACK_DAYS bounds how far back streaks are counted.
+const STREAK_LOOKBACK_DAYS = 365
+
+// DialGoal is today's progress towards the daily goal.
+type DialGoal struct {
+	Date      string `json:"date"`
+	Goal      int    `json:"goal"`
+	Dials     int    `json:"dials"`
+	Remaining int    `json:"remaining"`
+	Met       bool   `json:"met"`
+	Streaks
+}
+
+// Streaks counts days in a row the goal was met. Current includes today
+// once it's met but isn't broken by today still being in progress.
+type Streaks struct {
+	Current int `json:"currentStreak"`
+	Longest int `json:"longestStreak"`
+}
+
+// dialsByDay counts the user's calls per local day over the lookback
+// period, keyed by YYYY-MM-DD.
+func dialsByDay(repo *Repository, loc *time.Location, now time.Time) (map[string]int, error) {
+	local := now.In(loc)
+	since := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, -STREAK_LOOKBACK_DAYS)
+	times, err := repo.CallTimes(since)
+	if err != nil {
+		return nil, err
+	}
+	days := map[string]int{}
+	for _, t := range times {
+		days[t.In(loc).Format("2006-01-02")]++
+	}
+	return days, nil
+}
+
+// countStreaks walks back from today over days that count towards a
+// streak.
+func countStreaks(days map[string]int, settings UserSettings, now time.Time) Streaks {
+	target := max(settings.DailyDialGoal, 1)
+	local := now.In(settings.location())
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+
+	var s Streaks
+	run, current := 0, true
+	for offset := 0; offset <= STREAK_LOOKBACK_DAYS; offset++ {
+		day := today.AddDate(0, 0, -offset)
+		if !settings.CallOnWeekends && (day.Weekday() == time.Saturday || day.Weekday() == time.Sunday) {
+			continue
+		}
+		if days[day.Format("2006-01-02")] >= target {
+			run++
+			s.Longest = max(s.Longest, run)
+			continue
+		}
+		if offset > 0 && current {
+			s.Current = run
+			current = false
+		}
+		if offset > 0 {
+			run = 0
+		}
+	}
+	if current {
+		s.Current = run
+	}
+	return s
+}
+
+func dialGoalFor(repo *Repository, settings UserSettings, now time.Time) (DialGoal, error) {
+	days, err := dialsByDay(repo, settings.location(), now)
+	if err != nil {
+		return DialGoal{}, err
+	}
+	date := now.In(settings.location()).Format("2006-01-02")
+	g := DialGoal{Date: date, Goal: settings.DailyDialGoal, Dials: days[date], Streaks: countStreaks(days, settings, now)}
+	g.Remaining = max(g.Goal-g.Dials, 0)
+	g.Met = g.Goal > 0 && g.Dials >= g.Goal
+	return g, nil
+}
+
+// getTodayGoalHandler reports today's dials against the user's goal, with
+// their streaks.
+func getTodayGoalHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	goal, err := dialGoalFor(repo, settings, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load today's calls"})
+		return
+	}
+	c.JSON(http.StatusOK, goal)
+}
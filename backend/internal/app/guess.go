@@ -0,0 +1,203 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- EMAIL GUESSING ---
+//
+// When neither the source nor the website gave up an address, the guesser
+// tries the mailboxes small businesses usually have (info@, firstname@ ...)
+// against the verifier. Guesses are stored with type "guessed" and their
+// verdict, so the UI can tell them apart from addresses actually seen.
+
+// EMAIL_GUESSING turns on guessing during enrichment. It is off by default
+// because verification needs outbound port 25.
+var emailGuessingEnabled = os.Getenv("EMAIL_GUESSING") == "true"
+
+var genericMailboxes = []string{"info", "hello", "contact", "enquiries", "office", "admin", "sales"}
+
+type GuessedEmail struct {
+	Email        string `json:"email"`
+	Verification string `json:"verification"`
+}
+
+// nameParts lowercases a person's name and keeps only ASCII letters in
+// each word, since that is what mailbox names are made of.
+func nameParts(name string) []string {
+	var parts []string
+	for _, word := range strings.Fields(strings.ToLower(name)) {
+		var b strings.Builder
+		for _, r := range word {
+			if r >= 'a' && r <= 'z' {
+				b.WriteRune(r)
+			}
+		}
+		if b.Len() > 0 {
+			parts = append(parts, b.String())
+		}
+	}
+	return parts
+}
+
+// guessLocalParts lists candidate mailboxes, most likely first: patterns
+// built from the owner's name when known, then generic ones.
+func guessLocalParts(ownerName string) []string {
+	var locals []string
+	parts := nameParts(ownerName)
+	if len(parts) >= 1 {
+		first := parts[0]
+		locals = append(locals, first)
+		if len(parts) >= 2 {
+			last := parts[len(parts)-1]
+			locals = append(locals, first+"."+last, first+last, first[:1]+last, first[:1]+"."+last, last)
+		}
+	}
+	return append(locals, genericMailboxes...)
+}
+
+// guessEmails verifies the candidate addresses at domain with the user's
+// verifier. Paid verifiers are asked about one candidate at a time until
+// one is confirmed, so a guess costs as few credits as possible. Catch-all
+// domains can't confirm anything, so only the first candidate is returned
+// for them.
+func guessEmails(ctx context.Context, userID int64, domain, ownerName string) ([]GuessedEmail, error) {
+	settings, err := getUserSettings(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	for _, local := range guessLocalParts(ownerName) {
+		candidates = append(candidates, local+"@"+domain)
+	}
+
+	verdicts := map[string]string{}
+	if verifierFor(settings.EmailVerifier).Info().Paid {
+		for _, email := range candidates {
+			found, verifyErr := verifyEmails(ctx, userID, []string{email})
+			err = verifyErr
+			if verifyErr != nil {
+				break
+			}
+			verdicts[email] = found[email]
+			if found[email] == EMAIL_VALID || found[email] == EMAIL_CATCH_ALL {
+				break
+			}
+		}
+	} else {
+		verdicts, err = verifyEmails(ctx, userID, candidates)
+	}
+
+	guesses := make([]GuessedEmail, 0, len(candidates))
+	for _, email := range candidates {
+		verdict := verdicts[email]
+		if verdict == "" {
+			verdict = EMAIL_UNKNOWN
+		}
+		guesses = append(guesses, GuessedEmail{Email: email, Verification: verdict})
+	}
+	if len(guesses) > 0 && guesses[0].Verification == EMAIL_CATCH_ALL {
+		guesses = guesses[:1]
+	}
+	return guesses, err
+}
+
+// saveGuessedEmails keeps the guesses worth calling on: verified ones, or
+// the single guess for a catch-all domain. It returns how many it kept.
+func saveGuessedEmails(ctx context.Context, leadID string, guesses []GuessedEmail) int {
+	candidates := []string{}
+	for _, g := range guesses {
+		candidates = append(candidates, g.Email)
+	}
+	allowed := map[string]bool{}
+	for _, e := range unsuppressedEmails(ctx, leadID, candidates) {
+		allowed[e] = true
+	}
+	kept := 0
+	for _, g := range guesses {
+		if !allowed[g.Email] || (g.Verification != EMAIL_VALID && g.Verification != EMAIL_CATCH_ALL) {
+			continue
+		}
+		_, err := db.ExecContext(ctx, `
+            INSERT INTO lead_emails (lead_id, email, type, verification) VALUES (?, ?, 'guessed', ?)
+            ON CONFLICT (lead_id, email) DO UPDATE SET verification = excluded.verification
+        `, leadID, seal(g.Email), g.Verification)
+		if err != nil {
+			log.Printf("Failed to save guessed email for lead %s: %v", leadID, err)
+			continue
+		}
+		kept++
+		if g.Verification == EMAIL_VALID {
+			if _, err := db.ExecContext(ctx, "UPDATE leads SET email = ? WHERE id = ? AND (email IS NULL OR email = '')", seal(g.Email), leadID); err != nil {
+				log.Printf("Failed to set email for lead %s: %v", leadID, err)
+			}
+		}
+	}
+	return kept
+}
+
+// guessLeadEmails is the enrichment step for leads that still have no email.
+func guessLeadEmails(ctx context.Context, userID int64, leadID, website string) {
+	domain := normalizeDomain(website)
+	if domain == "" {
+		return
+	}
+	guesses, err := guessEmails(ctx, userID, domain, "")
+	if err != nil {
+		log.Printf("Email guessing for lead %s: %v", leadID, err)
+	}
+	saveGuessedEmails(ctx, leadID, guesses)
+}
+
+// guessLeadEmailsHandler guesses on demand, optionally with the owner's
+// name, and returns every candidate with its verdict.
+func guessLeadEmailsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		OwnerName string `json:"ownerName"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+	}
+
+	lead, err := repo.Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	if lead.Forgotten {
+		c.JSON(http.StatusConflict, gin.H{"error": "This lead has been forgotten"})
+		return
+	}
+	domain := normalizeDomain(lead.Website)
+	if domain == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Lead has no website domain to guess from"})
+		return
+	}
+
+	guesses, err := guessEmails(c.Request.Context(), repo.Tenant().UserID, domain, input.OwnerName)
+	if err == errVerificationQuota {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Monthly email verification limit reached"})
+		return
+	}
+	response := gin.H{"guesses": guesses, "saved": saveGuessedEmails(c.Request.Context(), lead.ID, guesses)}
+	if err != nil {
+		response["warning"] = "Verification was incomplete: " + err.Error()
+	}
+	c.JSON(http.StatusOK, response)
+}
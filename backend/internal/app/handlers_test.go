@@ -0,0 +1,4213 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/scraper"
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+)
+
+// setupTestServer gives a test a fresh database and the full router.
+func setupTestServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	setupTestDB(t)
+	prevSecret := JWT_SECRET
+	JWT_SECRET = []byte("test-secret-that-is-at-least-32-bytes")
+	t.Cleanup(func() { JWT_SECRET = prevSecret })
+	return newRouter()
+}
+
+// doRequest sends body as JSON, authenticated with token if there is one.
+func doRequest(r *gin.Engine, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	return doRequestWithHeaders(r, method, path, token, body, nil)
+}
+
+// doRequestWithHeaders is doRequest with extra request headers, such as
+// Idempotency-Key or If-Match.
+func doRequestWithHeaders(r *gin.Engine, method, path, token string, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// registerTestUser signs a user up through the API and returns their token
+// and a repository for their tenant.
+func registerTestUser(t *testing.T, r *gin.Engine, email string) (string, *Repository) {
+	t.Helper()
+	w := doRequest(r, "POST", "/register", "", gin.H{"name": email, "email": email, "password": "Password123!"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register %s: %d %s", email, w.Code, w.Body)
+	}
+	var resp struct {
+		Token string `json:"token"`
+		User  struct {
+			ID int64 `json:"id"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var orgID int64
+	if err := db.QueryRow("SELECT org_id FROM users WHERE id = ?", resp.User.ID).Scan(&orgID); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token, newRepository(Tenant{OrgID: orgID, UserID: resp.User.ID})
+}
+
+// stubProvider finds the same leads for every search.
+type stubProvider struct {
+	info  scraper.Info
+	leads []scraper.Lead
+}
+
+func (p stubProvider) Info() scraper.Info { return p.info }
+
+func (p stubProvider) Search(ctx context.Context, q scraper.Query) ([]scraper.Lead, error) {
+	q.Logf("Stub search for %s", q.Text())
+	return p.leads, nil
+}
+
+// funcProvider runs each search with its search function, for sources
+// that need to do more than return leads.
+type funcProvider struct {
+	info   scraper.Info
+	search func(ctx context.Context, q scraper.Query) ([]scraper.Lead, error)
+}
+
+func (p funcProvider) Info() scraper.Info { return p.info }
+
+func (p funcProvider) Search(ctx context.Context, q scraper.Query) ([]scraper.Lead, error) {
+	return p.search(ctx, q)
+}
+
+// runTestSearch runs a search through the API against a source that finds
+// found, and returns it once it and the work that follows it are done.
+func runTestSearch(t *testing.T, r *gin.Engine, token string, found []scraper.Lead) searches.Search {
+	t.Helper()
+	leadProviders.Register(stubProvider{info: scraper.Info{ID: "stub", Name: "Stub"}, leads: found})
+	t.Cleanup(func() { leadProviders.Unregister("stub") })
+	return runTestSearchOn(t, r, token, "stub")
+}
+
+// runTestSearchOn is runTestSearch against an already registered source.
+func runTestSearchOn(t *testing.T, r *gin.Engine, token, source string) searches.Search {
+	t.Helper()
+	w := doRequest(r, "POST", "/api/searches", token, gin.H{"keyword": "plumbers", "location": "Leeds", "source": source})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("start search: %d %s", w.Code, w.Body)
+	}
+	var search searches.Search
+	json.Unmarshal(w.Body.Bytes(), &search)
+	searchWork.Wait()
+	json.Unmarshal(doRequest(r, "GET", "/api/searches/"+search.ID, token, nil).Body.Bytes(), &search)
+	return search
+}
+
+// testLeads lists a search's leads through the API.
+func testLeads(t *testing.T, r *gin.Engine, token, searchID, query string) []leads.Lead {
+	t.Helper()
+	w := doRequest(r, "GET", "/api/leads/"+searchID+query, token, nil)
+	var found []leads.Lead
+	if err := json.Unmarshal(w.Body.Bytes(), &found); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("leads%s: %d %s", query, w.Code, w.Body)
+	}
+	return found
+}
+
+// fakeVerifier gives the verdicts it was set up with, calling any other
+// address invalid, and records the addresses it was asked about.
+type fakeVerifier struct {
+	info     VerifierInfo
+	verdicts map[string]string
+
+	mu      sync.Mutex
+	checked []string
+}
+
+func (v *fakeVerifier) Info() VerifierInfo { return v.info }
+
+func (v *fakeVerifier) Verify(_ context.Context, _ string, emails []string) (map[string]string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	found := map[string]string{}
+	for _, email := range emails {
+		v.checked = append(v.checked, email)
+		found[email] = EMAIL_INVALID
+		if verdict, ok := v.verdicts[email]; ok {
+			found[email] = verdict
+		}
+	}
+	return found, nil
+}
+
+// registerTestVerifier makes v available to the test's users.
+func registerTestVerifier(t *testing.T, v *fakeVerifier) {
+	t.Helper()
+	registerEmailVerifier(v)
+	t.Cleanup(func() { delete(emailVerifiers, v.info.ID) })
+}
+
+// roundTripFunc lets a function stand in for an http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// redirectClient sends every request to server, whichever host it was
+// addressed to, so integrations with fixed endpoints can be faked.
+func redirectClient(server *httptest.Server) *http.Client {
+	target, _ := url.Parse(server.URL)
+	return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return server.Client().Transport.RoundTrip(req)
+	})}
+}
+
+// startTestSMTP points outgoing mail at a local relay and returns the
+// messages it receives.
+func startTestSMTP(t *testing.T) <-chan string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	prevHost, prevPort := smtpHost, smtpPort
+	smtpHost, smtpPort = host, port
+	t.Cleanup(func() { smtpHost, smtpPort = prevHost, prevPort })
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				in := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 localhost\r\n")
+				for {
+					line, err := in.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+					case "DATA":
+						fmt.Fprint(conn, "354 go ahead\r\n")
+						var msg strings.Builder
+						for {
+							l, err := in.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if l == ".\r\n" {
+								break
+							}
+							msg.WriteString(l)
+						}
+						messages <- msg.String()
+						fmt.Fprint(conn, "250 queued\r\n")
+					case "QUIT":
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return messages
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	r := setupTestServer(t)
+
+	if w := doRequest(r, "GET", "/api/searches", "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: got %d, want 401", w.Code)
+	}
+	if w := doRequest(r, "GET", "/api/searches", "not-a-token", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bad token: got %d, want 401", w.Code)
+	}
+}
+
+func TestRegisterRejectsDuplicateEmail(t *testing.T) {
+	r := setupTestServer(t)
+	registerTestUser(t, r, "a@example.com")
+
+	w := doRequest(r, "POST", "/register", "", gin.H{"name": "A", "email": "a@example.com", "password": "Password123!"})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got %d, want 409", w.Code)
+	}
+}
+
+func TestSearchHandlersAreIsolated(t *testing.T) {
+	r := setupTestServer(t)
+	tokenA, repoA := registerTestUser(t, r, "a@example.com")
+	tokenB, _ := registerTestUser(t, r, "b@example.com")
+
+	searchID := uuid.New().String()
+	if err := repoA.Searches().Insert(searches.Search{ID: searchID, Keyword: "plumbers", Source: DEFAULT_SOURCE, Status: "Completed", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/searches/" + searchID
+
+	if w := doRequest(r, "GET", path, tokenB, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("other tenant GET: got %d, want 404", w.Code)
+	}
+	if w := doRequest(r, "PUT", path, tokenB, gin.H{"title": "Mine now"}); w.Code != http.StatusNotFound {
+		t.Fatalf("other tenant PUT: got %d, want 404", w.Code)
+	}
+	if w := doRequest(r, "PUT", path, tokenA, gin.H{"title": "Leeds plumbers"}); w.Code != http.StatusOK {
+		t.Fatalf("owner PUT: got %d %s", w.Code, w.Body)
+	}
+
+	w := doRequest(r, "GET", path, tokenA, nil)
+	var search searches.Search
+	if err := json.Unmarshal(w.Body.Bytes(), &search); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || search.Title != "Leeds plumbers" {
+		t.Fatalf("owner GET: got %d with title %q", w.Code, search.Title)
+	}
+}
+
+func TestPanicsBecomeErrorResponses(t *testing.T) {
+	r := setupTestServer(t)
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	w := doRequest(r, "GET", "/panic", "", nil)
+	var resp struct {
+		ErrorID string `json:"errorId"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusInternalServerError || resp.ErrorID == "" {
+		t.Fatalf("got %d %s, want a 500 with an error ID", w.Code, w.Body)
+	}
+}
+
+func TestTimedOutRequestsGet504(t *testing.T) {
+	r := setupTestServer(t)
+	prev := readTimeout
+	readTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { readTimeout = prev })
+	r.GET("/slow", func(c *gin.Context) {
+		<-c.Request.Context().Done()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load"})
+	})
+
+	if w := doRequest(r, "GET", "/slow", "", nil); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("got %d %s, want 504", w.Code, w.Body)
+	}
+}
+
+func TestCORSAllowsConfiguredSubdomains(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.blueleads.test, https://*.agency.test")
+	r := setupTestServer(t)
+
+	for origin, allowed := range map[string]bool{
+		"https://app.blueleads.test":    true,
+		"https://acme.agency.test":      true,
+		"https://agency.test":           false,
+		"https://acme.agency.test.evil": false,
+		"http://acme.agency.test":       false,
+		"http://localhost:5173":         false,
+	} {
+		req := httptest.NewRequest("OPTIONS", "/api/searches", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Errorf("%s: allowed = %v, want %v", origin, got, allowed)
+		}
+	}
+}
+
+func TestOversizedBodiesGet413(t *testing.T) {
+	r := setupTestServer(t)
+	prev := maxBodyBytes
+	maxBodyBytes = 64
+	t.Cleanup(func() { maxBodyBytes = prev })
+	body := `{"name":"A","email":"a@example.com","password":"` + strings.Repeat("x", 100) + `"}`
+
+	// With a Content-Length the body is refused before it's read.
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("declared size: got %d %s, want 413", w.Code, w.Body)
+	}
+
+	// Without one it's cut off while the handler reads it.
+	req = httptest.NewRequest("POST", "/register", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("streamed: got %d %s, want 413", w.Code, w.Body)
+	}
+}
+
+func TestInvalidInputIsReportedPerField(t *testing.T) {
+	r := setupTestServer(t)
+
+	w := doRequest(r, "POST", "/register", "", gin.H{"name": "A", "email": "not an email", "password": "short"})
+	var resp struct {
+		Fields map[string]string `json:"fields"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusBadRequest || resp.Fields["email"] == "" || resp.Fields["password"] == "" || resp.Fields["name"] != "" {
+		t.Fatalf("register: got %d %s", w.Code, w.Body)
+	}
+
+	token, _ := registerTestUser(t, r, "a@example.com")
+	w = doRequest(r, "GET", "/api/searches/not-a-uuid", token, nil)
+	resp.Fields = nil
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusBadRequest || resp.Fields["searchId"] == "" {
+		t.Fatalf("search ID: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestFailedLoginsAreThrottled(t *testing.T) {
+	r := setupTestServer(t)
+	registerTestUser(t, r, "a@example.com")
+	wrong := gin.H{"email": "a@example.com", "password": "Wrong-password1"}
+
+	if w := doRequest(r, "POST", "/login", "", wrong); w.Code != http.StatusUnauthorized {
+		t.Fatalf("first failure: got %d, want 401", w.Code)
+	}
+	// Two more failures make the next attempt wait four seconds.
+	now := time.Now().UTC()
+	recordLoginFailure(context.Background(), "a@example.com", "192.0.2.1", now)
+	recordLoginFailure(context.Background(), "a@example.com", "192.0.2.1", now)
+	w := doRequest(r, "POST", "/login", "", wrong)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("retry during the delay: got %d, want 429 with Retry-After", w.Code)
+	}
+
+	// Reaching the threshold locks the email out, whatever the IP.
+	for i := 3; i < loginLockoutThreshold; i++ {
+		recordLoginFailure(context.Background(), "a@example.com", "192.0.2.1", now)
+	}
+	wait, err := loginWait(context.Background(), "A@example.com", "198.51.100.7", now)
+	if err != nil || wait < loginLockout-time.Second {
+		t.Fatalf("after %d failures: wait %s, want the %s lockout", loginLockoutThreshold, wait, loginLockout)
+	}
+}
+
+func TestRegistrationChecksCaptcha(t *testing.T) {
+	r := setupTestServer(t)
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		json.NewEncoder(w).Encode(gin.H{"success": req.PostForm.Get("response") == "solved"})
+	}))
+	defer verifier.Close()
+	prevProvider, prevURL := captchaProvider, captchaVerifyURL
+	captchaProvider, captchaVerifyURL = "turnstile", verifier.URL
+	t.Cleanup(func() { captchaProvider, captchaVerifyURL = prevProvider, prevURL })
+
+	signup := gin.H{"name": "A", "email": "a@example.com", "password": "Password123!", "captchaToken": "forged"}
+	if w := doRequest(r, "POST", "/register", "", signup); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad token: got %d %s, want 400", w.Code, w.Body)
+	}
+	signup["captchaToken"] = "solved"
+	if w := doRequest(r, "POST", "/register", "", signup); w.Code != http.StatusCreated {
+		t.Fatalf("solved: got %d %s, want 201", w.Code, w.Body)
+	}
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	r := setupTestServer(t)
+	ownerToken, ownerRepo := registerTestUser(t, r, "owner@example.com")
+	inviteOnly = true
+	t.Cleanup(func() { inviteOnly = false })
+
+	signup := gin.H{"name": "B", "email": "b@example.com", "password": "Password123!"}
+	if w := doRequest(r, "POST", "/register", "", signup); w.Code != http.StatusForbidden {
+		t.Fatalf("no code: got %d %s, want 403", w.Code, w.Body)
+	}
+
+	teamPath := fmt.Sprintf("/api/teams/%d/invitations", ownerRepo.Tenant().OrgID)
+	w := doRequest(r, "POST", teamPath, ownerToken, gin.H{"email": "b@example.com"})
+	var inv Invitation
+	json.Unmarshal(w.Body.Bytes(), &inv)
+	if w.Code != http.StatusCreated || inv.Code == "" {
+		t.Fatalf("create invitation: got %d %s", w.Code, w.Body)
+	}
+
+	signup["inviteCode"] = inv.Code
+	signup["email"] = "c@example.com"
+	if w := doRequest(r, "POST", "/register", "", signup); w.Code != http.StatusForbidden {
+		t.Fatalf("someone else's invitation: got %d %s, want 403", w.Code, w.Body)
+	}
+	signup["email"] = "b@example.com"
+	if w := doRequest(r, "POST", "/register", "", signup); w.Code != http.StatusCreated {
+		t.Fatalf("invited: got %d %s, want 201", w.Code, w.Body)
+	}
+	team, err := ownerRepo.Team()
+	if err != nil || len(team.Members) != 2 {
+		t.Fatalf("invited user should have joined the team: %+v %v", team, err)
+	}
+
+	if w := doRequest(r, "POST", "/register", "", signup); w.Code != http.StatusForbidden {
+		t.Fatalf("used invitation: got %d %s, want 403", w.Code, w.Body)
+	}
+}
+
+func TestSSOProvisionsTeamMembers(t *testing.T) {
+	r := setupTestServer(t)
+	ownerToken, ownerRepo := registerTestUser(t, r, "owner@example.com")
+
+	// A minimal OIDC provider that signs whatever nonce the last
+	// authorization request asked for.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce string
+	email := "rep@acme.test"
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(gin.H{"issuer": idp.URL, "authorization_endpoint": idp.URL + "/authorize", "token_endpoint": idp.URL + "/token", "jwks_uri": idp.URL + "/jwks"})
+		case "/jwks":
+			e := big.NewInt(int64(key.E)).Bytes()
+			json.NewEncoder(w).Encode(gin.H{"keys": []gin.H{{"kid": "k1", "kty": "RSA", "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()), "e": base64.RawURLEncoding.EncodeToString(e)}}})
+		case "/token":
+			idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+				"iss": idp.URL, "aud": "blueleads", "exp": time.Now().Add(time.Minute).Unix(), "nonce": nonce,
+				"email": email, "email_verified": true, "name": "Rep", "groups": []string{"sales-leads"},
+			})
+			idToken.Header["kid"] = "k1"
+			signed, _ := idToken.SignedString(key)
+			json.NewEncoder(w).Encode(gin.H{"id_token": signed})
+		}
+	}))
+	defer idp.Close()
+
+	teamPath := fmt.Sprintf("/api/teams/%d/sso", ownerRepo.Tenant().OrgID)
+	cfg := gin.H{"issuer": idp.URL, "clientId": "blueleads", "clientSecret": "s3cret", "domains": []string{"acme.test"}, "groupRoles": gin.H{"sales-leads": "manager"}}
+	w := doRequest(r, "PUT", teamPath, ownerToken, cfg)
+	var saved SSOConfig
+	json.Unmarshal(w.Body.Bytes(), &saved)
+	if w.Code != http.StatusOK || len(saved.DomainStatus) != 1 || saved.DomainStatus[0].Verified {
+		t.Fatalf("configure SSO: got %d %s, want one unverified domain", w.Code, w.Body)
+	}
+	if w := doRequest(r, "POST", "/sso/start", "", gin.H{"email": "rep@acme.test"}); w.Code != http.StatusNotFound {
+		t.Fatalf("start before verifying the domain: got %d, want 404", w.Code)
+	}
+
+	// Another team can't take the domain by claiming it too.
+	otherToken, otherRepo := registerTestUser(t, r, "mallory@example.com")
+	otherPath := fmt.Sprintf("/api/teams/%d/sso", otherRepo.Tenant().OrgID)
+	if w := doRequest(r, "PUT", otherPath, otherToken, cfg); w.Code != http.StatusOK {
+		t.Fatalf("second claim: got %d %s", w.Code, w.Body)
+	}
+
+	records := map[string][]string{}
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if rs, ok := records[name]; ok {
+			return rs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	t.Cleanup(func() { lookupTXT = net.DefaultResolver.LookupTXT })
+	if w := doRequest(r, "POST", teamPath+"/domains/acme.test/verify", ownerToken, nil); w.Code != http.StatusConflict {
+		t.Fatalf("verify without the record: got %d %s, want 409", w.Code, w.Body)
+	}
+	records[saved.DomainStatus[0].RecordName] = []string{saved.DomainStatus[0].RecordValue}
+	if w := doRequest(r, "POST", otherPath+"/domains/acme.test/verify", otherToken, nil); w.Code != http.StatusConflict {
+		t.Fatalf("verify with someone else's record: got %d %s, want 409", w.Code, w.Body)
+	}
+	if w := doRequest(r, "POST", teamPath+"/domains/acme.test/verify", ownerToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("verify: got %d %s", w.Code, w.Body)
+	}
+
+	signIn := func() string {
+		t.Helper()
+		w := doRequest(r, "POST", "/sso/start", "", gin.H{"email": email})
+		var start struct {
+			URL string `json:"url"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &start)
+		authURL, err := url.Parse(start.URL)
+		if w.Code != http.StatusOK || err != nil {
+			t.Fatalf("start: got %d %s", w.Code, w.Body)
+		}
+		nonce = authURL.Query().Get("nonce")
+		w = doRequest(r, "GET", "/sso/callback?code=abc&state="+url.QueryEscape(authURL.Query().Get("state")), "", nil)
+		if w.Code != http.StatusFound {
+			t.Fatalf("callback: got %d", w.Code)
+		}
+		return w.Header().Get("Location")
+	}
+	location := signIn()
+	if !strings.Contains(location, "#ssoToken=") {
+		t.Fatalf("callback redirected to %s", location)
+	}
+	team, err := ownerRepo.Team()
+	if err != nil || len(team.Members) != 2 {
+		t.Fatalf("SSO user should have joined the team: %+v %v", team, err)
+	}
+	for _, m := range team.Members {
+		if m.Name == "Rep" && m.Role != TEAM_ROLE_MANAGER {
+			t.Fatalf("SSO user got role %q, want manager from their group", m.Role)
+		}
+	}
+
+	// The same state can't be used twice.
+	w = doRequest(r, "POST", "/sso/start", "", gin.H{"email": email})
+	var start struct {
+		URL string `json:"url"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &start)
+	authURL, _ := url.Parse(start.URL)
+	nonce = authURL.Query().Get("nonce")
+	state := url.QueryEscape(authURL.Query().Get("state"))
+	doRequest(r, "GET", "/sso/callback?code=abc&state="+state, "", nil)
+	w = doRequest(r, "GET", "/sso/callback?code=abc&state="+state, "", nil)
+	if !strings.Contains(w.Header().Get("Location"), "#ssoError=") {
+		t.Fatalf("replayed callback: redirected to %s", w.Header().Get("Location"))
+	}
+
+	// The IdP can't sign into a password account, an admin's included,
+	// until its owner links it, and even then gets no admin access.
+	email = "owner@acme.test"
+	ownerID := ownerRepo.Tenant().UserID
+	if _, err := db.Exec("UPDATE users SET email = ?, is_admin = 1 WHERE id = ?", email, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	if location := signIn(); !strings.Contains(location, "#ssoError=") {
+		t.Fatalf("SSO into an unlinked password account: redirected to %s", location)
+	}
+	if w := doRequest(r, "POST", "/api/me/sso-link", ownerToken, gin.H{"password": "wrong"}); w.Code != http.StatusForbidden {
+		t.Fatalf("link with the wrong password: got %d, want 403", w.Code)
+	}
+	if w := doRequest(r, "POST", "/api/me/sso-link", ownerToken, gin.H{"password": "Password123!"}); w.Code != http.StatusNoContent {
+		t.Fatalf("link: got %d %s", w.Code, w.Body)
+	}
+	location = signIn()
+	_, ssoToken, found := strings.Cut(location, "#ssoToken=")
+	if !found {
+		t.Fatalf("SSO into a linked account: redirected to %s", location)
+	}
+	ssoToken, _ = url.QueryUnescape(ssoToken)
+	if w := doRequest(r, "GET", "/api/admin/users", ssoToken, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("admin route with an SSO session: got %d, want 403", w.Code)
+	}
+}
+
+func TestSSOProviderChangesNeedTheOwner(t *testing.T) {
+	r := setupTestServer(t)
+	t.Setenv("FIELD_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	initFieldEncryption()
+	t.Cleanup(func() { sealer = nil })
+	ownerToken, ownerRepo := registerTestUser(t, r, "owner@example.com")
+	managerToken, managerRepo := registerTestUser(t, r, "manager@example.com")
+	orgID := ownerRepo.Tenant().OrgID
+	if _, err := db.Exec("UPDATE users SET org_id = ?, team_role = ? WHERE id = ?", orgID, TEAM_ROLE_MANAGER, managerRepo.Tenant().UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every path on this server is the issuer of its own provider.
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if issuer, ok := strings.CutSuffix(req.URL.Path, "/.well-known/openid-configuration"); ok {
+			json.NewEncoder(w).Encode(gin.H{"issuer": idp.URL + issuer, "authorization_endpoint": idp.URL + "/authorize", "token_endpoint": idp.URL + "/token", "jwks_uri": idp.URL + "/jwks"})
+			return
+		}
+		json.NewEncoder(w).Encode(gin.H{"keys": []gin.H{{"kid": "k1", "kty": "RSA", "n": "AQAB", "e": "AQAB"}}})
+	}))
+	defer idp.Close()
+
+	teamPath := fmt.Sprintf("/api/teams/%d/sso", orgID)
+	cfg := gin.H{"issuer": idp.URL + "/a", "clientId": "blueleads", "clientSecret": "s3cret", "domains": []string{"acme.test"}}
+	if w := doRequest(r, "PUT", teamPath, managerToken, cfg); w.Code != http.StatusForbidden {
+		t.Fatalf("manager sets up a provider: got %d %s, want 403", w.Code, w.Body)
+	}
+	if w := doRequest(r, "PUT", teamPath, ownerToken, cfg); w.Code != http.StatusOK {
+		t.Fatalf("owner sets up a provider: got %d %s", w.Code, w.Body)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT client_secret FROM sso_configs WHERE org_id = ?", orgID).Scan(&stored); err != nil || !strings.HasPrefix(stored, SEALED_PREFIX) {
+		t.Fatalf("client secret stored as %q (err %v), want it sealed", stored, err)
+	}
+	if saved, err := ownerRepo.SSOConfig(); err != nil || saved.ClientSecret != "s3cret" {
+		t.Fatalf("client secret read back as %q (err %v)", saved.ClientSecret, err)
+	}
+
+	// A manager can still change the rest of the settings.
+	cfg["clientSecret"], cfg["defaultRole"] = "", TEAM_ROLE_MANAGER
+	if w := doRequest(r, "PUT", teamPath, managerToken, cfg); w.Code != http.StatusOK {
+		t.Fatalf("manager changes the default role: got %d %s", w.Code, w.Body)
+	}
+
+	linked := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE org_id = ? AND sso_linked_at IS NOT NULL", orgID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, token := range []string{ownerToken, managerToken} {
+		if w := doRequest(r, "POST", "/api/me/sso-link", token, gin.H{"password": "Password123!"}); w.Code != http.StatusNoContent {
+			t.Fatalf("link: got %d %s", w.Code, w.Body)
+		}
+	}
+	if w := doRequest(r, "PUT", teamPath, managerToken, cfg); w.Code != http.StatusOK || linked() != 2 {
+		t.Fatalf("saving the same provider: got %d, %d accounts still linked, want 2", w.Code, linked())
+	}
+
+	for _, change := range []gin.H{{"issuer": idp.URL + "/b"}, {"clientId": "other"}} {
+		next := gin.H{}
+		for k, v := range cfg {
+			next[k] = v
+		}
+		for k, v := range change {
+			next[k] = v
+		}
+		if w := doRequest(r, "PUT", teamPath, managerToken, next); w.Code != http.StatusForbidden {
+			t.Fatalf("manager changes %v: got %d %s, want 403", change, w.Code, w.Body)
+		}
+		if linked() != 2 {
+			t.Fatalf("a refused change unlinked accounts")
+		}
+		if w := doRequest(r, "PUT", teamPath, ownerToken, next); w.Code != http.StatusOK {
+			t.Fatalf("owner changes %v: got %d %s", change, w.Code, w.Body)
+		}
+		if n := linked(); n != 0 {
+			t.Fatalf("after changing %v: %d accounts still linked, want 0", change, n)
+		}
+		cfg = next
+		for _, token := range []string{ownerToken, managerToken} {
+			doRequest(r, "POST", "/api/me/sso-link", token, gin.H{"password": "Password123!"})
+		}
+	}
+}
+
+func TestSearchWebhookIsSigned(t *testing.T) {
+	r := setupTestServer(t)
+	webhookAllowPrivate = true
+	t.Cleanup(func() { webhookAllowPrivate = false })
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- req
+		bodies <- body
+	}))
+	defer hook.Close()
+
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"searchWebhookUrl": hook.URL}); w.Code != http.StatusBadRequest {
+		t.Fatalf("webhook without a secret: got %d, want 400", w.Code)
+	}
+	secret := "0123456789abcdef"
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"searchWebhookUrl": hook.URL, "searchWebhookSecret": secret}); w.Code != http.StatusOK {
+		t.Fatalf("set webhook: %d %s", w.Code, w.Body)
+	}
+	searchID := uuid.New().String()
+	if err := repo.Searches().Insert(searches.Search{ID: searchID, Keyword: "plumbers", Source: DEFAULT_SOURCE, Status: "Completed", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	notifySearchWebhook(searchID)
+	req, body := <-received, <-bodies
+	var payload SearchWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.SearchID != searchID || payload.Status != "Completed" {
+		t.Fatalf("payload %s (err %v)", body, err)
+	}
+	var ts int64
+	fmt.Sscanf(req.Header.Get("X-BlueLeads-Signature"), "t=%d,", &ts)
+	if got, want := req.Header.Get("X-BlueLeads-Signature"), signWebhook(secret, time.Unix(ts, 0), body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+}
+
+func TestCrmSocketBroadcastsChanges(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "socket@example.com")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/crm/ws", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Protocol = []string{"bearer", token}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var hello crmEvent
+	if err := websocket.JSON.Receive(ws, &hello); err != nil || hello.Type != "hello" {
+		t.Fatalf("expected hello, got %+v (%v)", hello, err)
+	}
+	if w := doRequest(r, "POST", "/api/crm/columns", token, gin.H{"title": "Follow up"}); w.Code != http.StatusCreated {
+		t.Fatalf("create column: %d %s", w.Code, w.Body)
+	}
+	var changed crmEvent
+	if err := websocket.JSON.Receive(ws, &changed); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if changed.Type != "crm_changed" || changed.Version <= hello.Version {
+		t.Fatalf("expected a newer crm_changed, got %+v after %+v", changed, hello)
+	}
+
+	cfg.Protocol = []string{"bearer", "not-a-token"}
+	if _, err := websocket.DialConfig(cfg); err == nil {
+		t.Fatal("expected a bad token to be refused")
+	}
+}
+
+func TestBatchRunsEachRequest(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "batch@example.com")
+
+	w := doRequest(r, "POST", "/api/batch", token, []gin.H{
+		{"method": "POST", "path": "/api/crm/columns", "body": gin.H{"title": "Follow up"}},
+		{"method": "POST", "path": "/api/crm/columns", "body": gin.H{}},
+		{"method": "GET", "path": "/api/crm/columns"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+	var results []struct {
+		Status int             `json:"status"`
+		Body   json.RawMessage `json:"body"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Status != http.StatusCreated || results[1].Status != http.StatusBadRequest || results[2].Status != http.StatusOK {
+		t.Fatalf("unexpected results: %s", w.Body)
+	}
+	if !strings.Contains(string(results[2].Body), "Follow up") {
+		t.Fatalf("later requests should see earlier ones: %s", results[2].Body)
+	}
+
+	w = doRequest(r, "POST", "/api/batch", token, []gin.H{{"method": "POST", "path": "/api/batch", "body": []gin.H{}}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("nested batch: expected 400, got %d %s", w.Code, w.Body)
+	}
+
+	// Only the conditional and idempotency headers reach a request.
+	w = doRequest(r, "POST", "/api/batch", token, []gin.H{{"method": "GET", "path": "/api/crm/columns", "headers": gin.H{"X-Forwarded-For": "203.0.113.9"}}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("batch with a spoofed header: expected 400, got %d %s", w.Code, w.Body)
+	}
+	w = doRequest(r, "POST", "/api/batch", token, []gin.H{
+		{"method": "POST", "path": "/api/crm/columns", "body": gin.H{"title": "Stale"}, "headers": gin.H{"if-match": crmETag(0)}},
+	})
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Status != http.StatusPreconditionFailed {
+		t.Fatalf("batch with a stale If-Match: %d %s, want its request to get 412", w.Code, w.Body)
+	}
+	w = doRequest(r, "POST", "/api/batch", "", []gin.H{{"method": "GET", "path": "/api/crm/columns"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("batch without a token: expected 401, got %d", w.Code)
+	}
+}
+
+func TestMockProviderRunsSearches(t *testing.T) {
+	r := setupTestServer(t)
+	t.Setenv("SCRAPER_PROVIDER", "mock")
+	t.Setenv("MOCK_SCRAPER_DELAY_MS", "0")
+	t.Setenv("MOCK_SCRAPER_RESULTS", "12")
+	previous, hadDefault := leadProviders.Get(DEFAULT_SOURCE)
+	t.Cleanup(func() {
+		leadProviders.Unregister(MOCK_SOURCE)
+		leadProviders.Unregister(DEFAULT_SOURCE)
+		if hadDefault {
+			leadProviders.Register(previous)
+		}
+	})
+	if !registerMockProvider() {
+		t.Fatal("mock provider not registered")
+	}
+
+	query := scraper.Query{Keyword: "roofers", Location: "York"}
+	mock, _ := leadProviders.Get(MOCK_SOURCE)
+	first, err := mock.Search(context.Background(), query)
+	if err != nil || len(first) != 12 {
+		t.Fatalf("got %d leads (err %v), want 12", len(first), err)
+	}
+	standIn, _ := leadProviders.Get(DEFAULT_SOURCE)
+	again, _ := standIn.Search(context.Background(), query)
+	if again[0].Title != first[0].Title || !strings.HasSuffix(first[0].Address, "York") {
+		t.Errorf("leads differ between runs: %q, %q at %q", first[0].Title, again[0].Title, first[0].Address)
+	}
+
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	w := doRequest(r, "POST", "/api/searches", token, gin.H{"keyword": "roofers mock:fail", "source": MOCK_SOURCE})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("start search: %d %s", w.Code, w.Body)
+	}
+	var started searches.Search
+	json.Unmarshal(w.Body.Bytes(), &started)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		var got searches.Search
+		json.Unmarshal(doRequest(r, "GET", "/api/searches/"+started.ID, token, nil).Body.Bytes(), &got)
+		if got.Status == "Failed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("search status %q, want Failed", got.Status)
+		}
+	}
+}
+
+func TestDirectorySourcesNeedALocation(t *testing.T) {
+	r := setupTestServer(t)
+	for _, p := range scraper.DirectoryProviders() {
+		id := p.Info().ID
+		leadProviders.Register(p)
+		t.Cleanup(func() { leadProviders.Unregister(id) })
+	}
+	token, _ := registerTestUser(t, r, "alice@example.com")
+
+	var sources []scraper.Info
+	json.Unmarshal(doRequest(r, "GET", "/api/sources", token, nil).Body.Bytes(), &sources)
+	offered := map[string]bool{}
+	for _, s := range sources {
+		offered[s.ID] = s.RequiresLocation
+	}
+	if !offered["yell"] || !offered["yellow_pages"] {
+		t.Fatalf("sources %+v, want Yell.com and Yellow Pages, both needing a location", sources)
+	}
+
+	if w := doRequest(r, "POST", "/api/searches", token, gin.H{"keyword": "plumbers", "source": "yellow_pages"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Yellow Pages search without a location: got %d, want 400", w.Code)
+	}
+	if w := doRequest(r, "POST", "/api/searches", token, gin.H{"keyword": "plumbers", "location": "Leeds", "source": "phone_book"}); w.Code != http.StatusBadRequest {
+		t.Errorf("search with an unknown source: got %d, want 400", w.Code)
+	}
+	var list []searches.Search
+	json.Unmarshal(doRequest(r, "GET", "/api/searches", token, nil).Body.Bytes(), &list)
+	if len(list) != 0 {
+		t.Errorf("refused searches were recorded: %+v", list)
+	}
+}
+
+func TestPlacesSourceNeedsTheUsersKey(t *testing.T) {
+	r := setupTestServer(t)
+	leadProviders.Register(scraper.NewPlacesProvider(placesAPIKey))
+	t.Cleanup(func() { leadProviders.Unregister("google_places") })
+	token, alice := registerTestUser(t, r, "alice@example.com")
+
+	var sources []scraper.Info
+	json.Unmarshal(doRequest(r, "GET", "/api/sources", token, nil).Body.Bytes(), &sources)
+	if len(sources) != 1 || sources[0].ID != "google_places" || sources[0].EstimatedCost <= 0 {
+		t.Fatalf("sources %+v, want Google Places with its cost per search", sources)
+	}
+
+	w := doRequest(r, "POST", "/api/searches", token, gin.H{"keyword": "plumbers", "location": "Leeds", "source": "google_places"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "API key") {
+		t.Fatalf("Places search without a key: got %d %s, want 400 asking for one", w.Code, w.Body)
+	}
+
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"googlePlacesApiKey": "AIza-test-key-1234"}); w.Code != http.StatusOK {
+		t.Fatalf("save key: %d %s", w.Code, w.Body)
+	}
+	var settings UserSettings
+	json.Unmarshal(doRequest(r, "GET", "/api/settings", token, nil).Body.Bytes(), &settings)
+	if settings.GooglePlacesAPIKey != "**************1234" {
+		t.Errorf("settings show the key as %q, want it masked", settings.GooglePlacesAPIKey)
+	}
+	if key, err := placesAPIKey(context.Background(), alice.Tenant().UserID); err != nil || key != "AIza-test-key-1234" {
+		t.Errorf("the provider gets key %q (err %v)", key, err)
+	}
+}
+
+func TestLeadsKeepRatingsAndCategories(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Acme Plumbing", Rating: 4.8, ReviewCount: 120, Category: "Plumber", Address: "1 High St, Leeds", Latitude: 53.8, Longitude: -1.55},
+		{Title: "Bodge & Co", Rating: 3.1, ReviewCount: 4, Category: "Plumber", Address: "2 Low St, Leeds", Latitude: 53.8, Longitude: -1.55},
+		{Title: "Sparks Ltd", Rating: 4.2, ReviewCount: 40, Category: "Electrician", Address: "3 Mill St, Leeds", Latitude: 53.8, Longitude: -1.55},
+	})
+	if search.Status != "Completed" {
+		t.Fatalf("search status %q", search.Status)
+	}
+
+	names := func(found []leads.Lead) string {
+		var n []string
+		for _, l := range found {
+			n = append(n, l.CompanyName)
+		}
+		return strings.Join(n, ", ")
+	}
+	sorted := testLeads(t, r, token, search.ID, "?sort=rating&order=desc")
+	if got := names(sorted); got != "Acme Plumbing, Sparks Ltd, Bodge & Co" {
+		t.Errorf("by rating: %s", got)
+	}
+	if l := sorted[0]; l.Rating != 4.8 || l.ReviewCount != 120 || l.Category != "Plumber" || l.Address != "1 High St, Leeds" {
+		t.Errorf("stored lead %+v", l)
+	}
+	if got := names(testLeads(t, r, token, search.ID, "?minRating=4&category=plumber")); got != "Acme Plumbing" {
+		t.Errorf("rated 4+ plumbers: %s", got)
+	}
+	if got := names(testLeads(t, r, token, search.ID, "?minReviews=10&sort=reviewCount")); got != "Sparks Ltd, Acme Plumbing" {
+		t.Errorf("10+ reviews by review count: %s", got)
+	}
+	if w := doRequest(r, "GET", "/api/leads/"+search.ID+"?sort=phone", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("sort by an unsortable field: got %d, want 400", w.Code)
+	}
+}
+
+func TestSearchLeadsAreGeocodedAndMapped(t *testing.T) {
+	r := setupTestServer(t)
+	geocoder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("q") == "1 High St, Leeds" {
+			w.Write([]byte(`[{"lat": "53.7997", "lon": "-1.5492"}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer geocoder.Close()
+	prevURL := geocoderURL
+	geocoderURL = geocoder.URL
+	t.Cleanup(func() { geocoderURL = prevURL })
+
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Acme Plumbing", Address: "1 High St, Leeds"},
+		{Title: "Pinned Plumbing", Address: "Somewhere", Latitude: 53.48, Longitude: -2.24},
+		{Title: "Lost Plumbing", Address: "Nowhere at all"},
+	})
+
+	w := doRequest(r, "GET", "/api/leads/"+search.ID+"/geo", token, nil)
+	var geo struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string     `json:"type"`
+				Coordinates [2]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties leads.Lead `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &geo); err != nil || w.Code != http.StatusOK || geo.Type != "FeatureCollection" {
+		t.Fatalf("geo: %d %s", w.Code, w.Body)
+	}
+	points := map[string][2]float64{}
+	for _, f := range geo.Features {
+		if f.Geometry.Type != "Point" {
+			t.Errorf("%s is a %s", f.Properties.CompanyName, f.Geometry.Type)
+		}
+		points[f.Properties.CompanyName] = f.Geometry.Coordinates
+	}
+	want := map[string][2]float64{"Acme Plumbing": {-1.5492, 53.7997}, "Pinned Plumbing": {-2.24, 53.48}}
+	if len(points) != len(want) || points["Acme Plumbing"] != want["Acme Plumbing"] || points["Pinned Plumbing"] != want["Pinned Plumbing"] {
+		t.Errorf("map points %v, want %v as [lng, lat]", points, want)
+	}
+	otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+	if w := doRequest(r, "GET", "/api/leads/"+search.ID+"/geo", otherToken, nil); w.Code != http.StatusForbidden {
+		t.Errorf("another tenant's map: got %d, want 403", w.Code)
+	}
+}
+
+func TestLeadsFilterByRadiusAndTerritory(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Manchester Plumbing", Latitude: 53.480, Longitude: -2.240},
+		{Title: "Salford Plumbing", Latitude: 53.488, Longitude: -2.290},
+		{Title: "Leeds Plumbing", Latitude: 53.800, Longitude: -1.549},
+	})
+	names := func(query string) string {
+		t.Helper()
+		var n []string
+		for _, l := range testLeads(t, r, token, search.ID, query+"&sort=companyName") {
+			n = append(n, l.CompanyName)
+		}
+		return strings.Join(n, ", ")
+	}
+
+	if got := names("?near=53.48,-2.24&radiusKm=10"); got != "Manchester Plumbing, Salford Plumbing" {
+		t.Errorf("within 10km of Manchester: %s", got)
+	}
+	if got := names("?near=53.48,-2.24&radiusKm=1"); got != "Manchester Plumbing" {
+		t.Errorf("within 1km of Manchester: %s", got)
+	}
+	if w := doRequest(r, "GET", "/api/leads/"+search.ID+"?near=53.48,-2.24", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("near without a radius: got %d, want 400", w.Code)
+	}
+
+	if w := doRequest(r, "POST", "/api/territories", token, gin.H{"name": "Line", "polygon": [][2]float64{{-1.7, 53.7}, {-1.4, 53.9}}}); w.Code != http.StatusBadRequest {
+		t.Errorf("two-point territory: got %d, want 400", w.Code)
+	}
+	w := doRequest(r, "POST", "/api/territories", token, gin.H{"name": "Leeds", "assignee": "Bob", "polygon": [][2]float64{{-1.7, 53.7}, {-1.4, 53.7}, {-1.4, 53.9}, {-1.7, 53.9}}})
+	var leeds Territory
+	json.Unmarshal(w.Body.Bytes(), &leeds)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create territory: %d %s", w.Code, w.Body)
+	}
+	if got := names("?territory=" + leeds.ID); got != "Leeds Plumbing" {
+		t.Errorf("in the Leeds territory: %s", got)
+	}
+	otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+	var theirs []Territory
+	json.Unmarshal(doRequest(r, "GET", "/api/territories", otherToken, nil).Body.Bytes(), &theirs)
+	if len(theirs) != 0 {
+		t.Errorf("another tenant sees territories %+v", theirs)
+	}
+	if w := doRequest(r, "GET", "/api/leads/"+search.ID+"?territory=nowhere", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown territory: got %d, want 400", w.Code)
+	}
+}
+
+func TestLeadsSayWhenToCall(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	// Open only three days from now, so the shop is shut whatever the clock says.
+	laterDay := time.Now().AddDate(0, 0, 3).Weekday().String()
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Always Open", Latitude: 53.8, Longitude: -1.55, OpenHours: map[string][]string{
+			"Monday": {"Open 24 hours"}, "Tuesday": {"Open 24 hours"}, "Wednesday": {"Open 24 hours"}, "Thursday": {"Open 24 hours"},
+			"Friday": {"Open 24 hours"}, "Saturday": {"Open 24 hours"}, "Sunday": {"Open 24 hours"},
+		}},
+		{Title: "Later This Week", Latitude: 53.8, Longitude: -1.55, OpenHours: map[string][]string{laterDay: {"9:00 am–5 pm"}}},
+		{Title: "No Hours", Latitude: 53.8, Longitude: -1.55},
+	})
+
+	byName := map[string]leads.Lead{}
+	for _, l := range testLeads(t, r, token, search.ID, "") {
+		byName[l.CompanyName] = l
+	}
+	if l := byName["Always Open"]; l.IsOpenNow == nil || !*l.IsOpenNow || l.BestTimeToCall != "now" {
+		t.Errorf("always open: isOpenNow %v, bestTimeToCall %q", l.IsOpenNow, l.BestTimeToCall)
+	}
+	later := byName["Later This Week"]
+	if later.IsOpenNow == nil || *later.IsOpenNow {
+		t.Errorf("later this week: isOpenNow %v, want false", later.IsOpenNow)
+	}
+	if want := laterDay + " at 09:00"; later.BestTimeToCall != want {
+		t.Errorf("later this week: bestTimeToCall %q, want %q", later.BestTimeToCall, want)
+	}
+	if got := later.OpenHours[laterDay]; len(got) != 1 {
+		t.Errorf("stored hours %v", later.OpenHours)
+	}
+	if l := byName["No Hours"]; l.IsOpenNow != nil || l.BestTimeToCall != "" {
+		t.Errorf("no hours: isOpenNow %v, bestTimeToCall %q", l.IsOpenNow, l.BestTimeToCall)
+	}
+}
+
+func TestLeadsPickUpSocialProfiles(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/robots.txt" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprint(w, `<html><body>
+			<a href="https://www.facebook.com/sharer.php?u=example">Share</a>
+			<a href="https://www.instagram.com/smithplumbing">Instagram</a>
+			<a href="https://uk.linkedin.com/company/smith-plumbing">LinkedIn</a>
+		</body></html>`)
+	}))
+	defer site.Close()
+
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Smith Plumbing", Website: site.URL, Latitude: 53.8, Longitude: -1.55},
+		{Title: "Facebook Only", Website: "https://m.facebook.com/facebookonlyplumbing/", Latitude: 53.8, Longitude: -1.55},
+		{Title: "Offline Plumbing", Latitude: 53.8, Longitude: -1.55},
+	})
+
+	byName := map[string]leads.Lead{}
+	for _, l := range testLeads(t, r, token, search.ID, "") {
+		byName[l.CompanyName] = l
+	}
+	want := leads.SocialProfiles{Instagram: "https://www.instagram.com/smithplumbing", LinkedIn: "https://www.linkedin.com/company/smith-plumbing"}
+	if got := byName["Smith Plumbing"].Socials; got != want {
+		t.Errorf("from the website: %+v, want %+v", got, want)
+	}
+	if got := byName["Facebook Only"].Socials; got != (leads.SocialProfiles{Facebook: "https://www.facebook.com/facebookonlyplumbing"}) {
+		t.Errorf("from a social website: %+v", got)
+	}
+	if got := byName["Offline Plumbing"].Socials; !got.Empty() {
+		t.Errorf("no website: %+v", got)
+	}
+}
+
+func TestLeadsKeepEveryEmailAndPhone(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Smith Plumbing", Phone: "0113 496 0000", Emails: []string{"info@smith.example", "sales@smith.example"}, Latitude: 53.8, Longitude: -1.55},
+	})
+	found := testLeads(t, r, token, search.ID, "")
+	if len(found) != 1 {
+		t.Fatalf("%d leads, want 1", len(found))
+	}
+	lead := found[0]
+	wantEmails := []leads.Email{{Email: "info@smith.example", Type: "scraped"}, {Email: "sales@smith.example", Type: "scraped"}}
+	if !reflect.DeepEqual(lead.Emails, wantEmails) || len(lead.Phones) != 1 || lead.Phones[0].Phone != "0113 496 0000" || lead.Phones[0].Type != "main" {
+		t.Fatalf("contacts: emails %+v, phones %+v", lead.Emails, lead.Phones)
+	}
+
+	if w := doRequest(r, "POST", "/api/crm/leads", token, []leads.Lead{lead}); w.Code != http.StatusOK {
+		t.Fatalf("add to CRM: %d %s", w.Code, w.Body)
+	}
+	card := func() crm.Card {
+		t.Helper()
+		var board struct{ Leads map[string]crm.Card }
+		json.Unmarshal(doRequest(r, "GET", "/api/crm?fields=email,emails,phones", token, nil).Body.Bytes(), &board)
+		return board.Leads[lead.ID]
+	}
+	if got := card(); got.Email != "info@smith.example" || len(got.Emails) != 2 || len(got.Phones) != 1 {
+		t.Fatalf("card before choosing: %+v", got)
+	}
+
+	path := "/api/crm/leads/" + lead.ID + "/contact"
+	if w := doRequest(r, "PUT", path, token, gin.H{"email": "sales@smith.example"}); w.Code != http.StatusOK {
+		t.Fatalf("choose email: %d %s", w.Code, w.Body)
+	}
+	if got := card(); got.Email != "sales@smith.example" {
+		t.Errorf("card email %q, want the chosen one", got.Email)
+	}
+	if w := doRequest(r, "PUT", path, token, gin.H{"email": "someone@elsewhere.example"}); w.Code != http.StatusBadRequest {
+		t.Errorf("an address the lead doesn't have: got %d, want 400", w.Code)
+	}
+	if w := doRequest(r, "PUT", path, token, gin.H{}); w.Code != http.StatusBadRequest {
+		t.Errorf("nothing to choose: got %d, want 400", w.Code)
+	}
+	otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+	if w := doRequest(r, "PUT", path, otherToken, gin.H{"phone": "0113 496 0000"}); w.Code != http.StatusNotFound {
+		t.Errorf("another tenant's card: got %d, want 404", w.Code)
+	}
+}
+
+func TestTrashRestoresAndPurgesLeads(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Kept Plumbing", Latitude: 53.8, Longitude: -1.55},
+		{Title: "Old Plumbing", Latitude: 53.8, Longitude: -1.55},
+	})
+	ids := map[string]string{}
+	for _, l := range testLeads(t, r, token, search.ID, "") {
+		ids[l.CompanyName] = l.ID
+	}
+	deleteLead := func(name string) {
+		t.Helper()
+		if w := doRequest(r, "DELETE", "/api/searches/"+search.ID+"/leads/"+ids[name], token, nil); w.Code != http.StatusNoContent {
+			t.Fatalf("delete %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	var trash struct {
+		Leads         []TrashedLead
+		RetentionDays int
+	}
+	readTrash := func() {
+		t.Helper()
+		json.Unmarshal(doRequest(r, "GET", "/api/trash", token, nil).Body.Bytes(), &trash)
+	}
+
+	deleteLead("Kept Plumbing")
+	if got := testLeads(t, r, token, search.ID, ""); len(got) != 1 || got[0].CompanyName != "Old Plumbing" {
+		t.Fatalf("leads after delete: %+v", got)
+	}
+	readTrash()
+	if len(trash.Leads) != 1 || trash.Leads[0].ID != ids["Kept Plumbing"] || trash.RetentionDays != trashRetentionDays {
+		t.Fatalf("trash: %+v", trash)
+	}
+	restore := "/api/trash/leads/" + ids["Kept Plumbing"] + "/restore"
+	if w := doRequest(r, "POST", restore, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if got := testLeads(t, r, token, search.ID, ""); len(got) != 2 {
+		t.Errorf("%d leads after restore, want 2", len(got))
+	}
+	if w := doRequest(r, "POST", restore, token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("restore twice: got %d, want 404", w.Code)
+	}
+	if w := doRequest(r, "POST", "/api/trash/widgets/"+ids["Kept Plumbing"]+"/restore", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown kind: got %d, want 400", w.Code)
+	}
+
+	// Only what has been in the trash longer than the retention period goes.
+	deleteLead("Kept Plumbing")
+	deleteLead("Old Plumbing")
+	if _, err := db.Exec("UPDATE leads SET deleted_at = ? WHERE id = ?", time.Now().UTC().AddDate(0, 0, -trashRetentionDays-1).Format("2006-01-02 15:04:05"), ids["Old Plumbing"]); err != nil {
+		t.Fatal(err)
+	}
+	purgeTrash()
+	readTrash()
+	if len(trash.Leads) != 1 || trash.Leads[0].ID != ids["Kept Plumbing"] {
+		t.Errorf("trash after purge: %+v", trash.Leads)
+	}
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM leads WHERE id = ?", ids["Old Plumbing"]).Scan(&left)
+	if left != 0 {
+		t.Error("purge left the expired lead behind")
+	}
+	if w := doRequest(r, "POST", restore, token, nil); w.Code != http.StatusOK {
+		t.Errorf("restore after purge: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyKeysReplayTheFirstResponse(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	_, leadID := createTestLead(t, repo)
+	_, otherLeadID := createTestLead(t, repo)
+	crmVersion := func() int64 {
+		var board struct{ Version int64 }
+		json.Unmarshal(doRequest(r, "GET", "/api/crm", token, nil).Body.Bytes(), &board)
+		return board.Version
+	}
+	add := func(key, id string) *httptest.ResponseRecorder {
+		return doRequestWithHeaders(r, "POST", "/api/crm/leads", token, []leads.Lead{{ID: id, CompanyName: "Acme Plumbing"}}, map[string]string{"Idempotency-Key": key})
+	}
+
+	first := add("retry-1", leadID)
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: %d %s", first.Code, first.Body)
+	}
+	version := crmVersion()
+	replay := add("retry-1", leadID)
+	if replay.Code != first.Code || replay.Body.String() != first.Body.String() || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replay: %d %s, want the first response %s", replay.Code, replay.Body, first.Body)
+	}
+	if got := crmVersion(); got != version {
+		t.Errorf("replay changed the board: version %d, want %d", got, version)
+	}
+
+	if w := add("retry-1", otherLeadID); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for a different body: got %d, want 422", w.Code)
+	}
+	if repo.Crm().HasCard(otherLeadID) {
+		t.Error("a rejected reuse of the key still added the lead")
+	}
+	if w := add(strings.Repeat("k", IDEMPOTENCY_MAX_KEY_LENGTH+1), otherLeadID); w.Code != http.StatusBadRequest {
+		t.Errorf("over-long key: got %d, want 400", w.Code)
+	}
+
+	// Keys belong to the user who sent them.
+	otherToken, otherRepo := registerTestUser(t, r, "bob@example.com")
+	_, bobsLead := createTestLead(t, otherRepo)
+	w := doRequestWithHeaders(r, "POST", "/api/crm/leads", otherToken, []leads.Lead{{ID: bobsLead, CompanyName: "Acme Plumbing"}}, map[string]string{"Idempotency-Key": "retry-1"})
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another user's key: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCrmBoardVersionGuardsWrites(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	w := doRequest(r, "GET", "/api/crm", token, nil)
+	loaded := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || loaded == "" {
+		t.Fatalf("load board: %d, ETag %q", w.Code, loaded)
+	}
+	if w := doRequestWithHeaders(r, "GET", "/api/crm", token, nil, map[string]string{"If-None-Match": loaded}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("unchanged board: got %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+
+	w = doRequestWithHeaders(r, "POST", "/api/crm/columns", token, gin.H{"title": "Follow up"}, map[string]string{"If-Match": loaded})
+	changed := w.Header().Get("ETag")
+	if w.Code != http.StatusCreated || changed == "" || changed == loaded {
+		t.Fatalf("write with the current version: %d, ETag %q", w.Code, changed)
+	}
+	w = doRequestWithHeaders(r, "POST", "/api/crm/columns", token, gin.H{"title": "Stale"}, map[string]string{"If-Match": loaded})
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != changed {
+		t.Errorf("write with a stale version: got %d, ETag %q; want 412 with %q", w.Code, w.Header().Get("ETag"), changed)
+	}
+	var columns []crm.Column
+	json.Unmarshal(doRequest(r, "GET", "/api/crm/columns", token, nil).Body.Bytes(), &columns)
+	titles := map[string]bool{}
+	for _, col := range columns {
+		titles[col.Title] = true
+	}
+	if !titles["Follow up"] || titles["Stale"] {
+		t.Errorf("columns %+v: want the current write and not the stale one", columns)
+	}
+
+	if w := doRequestWithHeaders(r, "GET", "/api/crm", token, nil, map[string]string{"If-None-Match": loaded}); w.Code != http.StatusOK {
+		t.Errorf("changed board with the old ETag: got %d, want 200", w.Code)
+	}
+	if w := doRequestWithHeaders(r, "GET", "/api/crm", token, nil, map[string]string{"If-None-Match": changed}); w.Code != http.StatusNotModified {
+		t.Errorf("board with the new ETag: got %d, want 304", w.Code)
+	}
+}
+
+func TestSearchesListIsPagedAndFiltered(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	for i, s := range []struct{ keyword, status, createdAt string }{
+		{"plumbers", "Completed", "2026-01-01 09:00:00"},
+		{"roofers", "Failed", "2026-01-02 09:00:00"},
+		{"plumbers", "Completed", "2026-01-03 09:00:00"},
+		{"electricians", "Completed", "2026-01-04 09:00:00"},
+		{"plumbers", "Pending", "2026-01-05 09:00:00"},
+	} {
+		id := fmt.Sprintf("search-%d", i+1)
+		if err := repo.Searches().Insert(searches.Search{ID: id, Keyword: s.keyword, Source: DEFAULT_SOURCE, Status: s.status}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE searches SET created_at = ? WHERE id = ?", s.createdAt, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(query string) (string, string) {
+		t.Helper()
+		w := doRequest(r, "GET", "/api/searches"+query, token, nil)
+		var found []searches.Search
+		if err := json.Unmarshal(w.Body.Bytes(), &found); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("searches%s: %d %s", query, w.Code, w.Body)
+		}
+		var ids []string
+		for _, s := range found {
+			ids = append(ids, s.ID)
+		}
+		return strings.Join(ids, ","), w.Header().Get("X-Total-Count")
+	}
+
+	for _, tc := range []struct{ query, ids, total string }{
+		{"", "search-5,search-4,search-3,search-2,search-1", "5"},
+		{"?pageSize=2&page=2", "search-3,search-2", "5"},
+		{"?pageSize=2&page=4", "", "5"},
+		{"?status=Completed", "search-4,search-3,search-1", "3"},
+		{"?q=plumb", "search-5,search-3,search-1", "3"},
+		{"?q=plumb&status=Completed&pageSize=1", "search-3", "2"},
+		{"?from=2026-01-02&to=2026-01-04", "search-4,search-3,search-2", "3"},
+	} {
+		if ids, total := list(tc.query); ids != tc.ids || total != tc.total {
+			t.Errorf("searches%s: %q of %s, want %q of %s", tc.query, ids, total, tc.ids, tc.total)
+		}
+	}
+	for _, query := range []string{"?page=0", "?pageSize=1000", "?from=yesterday"} {
+		if w := doRequest(r, "GET", "/api/searches"+query, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("searches%s: got %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestFullTextSearchFindsLeadsAndCards(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		name := "LIKE fallback"
+		if indexed {
+			name = "FTS5 index"
+		}
+		t.Run(name, func(t *testing.T) {
+			r := setupTestServer(t)
+			if indexed && !fullTextEnabled {
+				t.Skip("SQLite was built without FTS5; run with -tags sqlite_fts5")
+			}
+			saved := fullTextEnabled
+			fullTextEnabled = indexed
+			defer func() { fullTextEnabled = saved }()
+
+			token, repo := registerTestUser(t, r, "alice@example.com")
+			search := runTestSearch(t, r, token, []scraper.Lead{
+				{Title: "Acme Plumbing", Website: "https://acme-plumbing.example", Latitude: 53.8, Longitude: -1.55},
+				{Title: "Bolt Roofing", Latitude: 53.8, Longitude: -1.55},
+				{Title: "Gone Roofing", Latitude: 53.8, Longitude: -1.55},
+			})
+			ids := map[string]string{}
+			for _, l := range testLeads(t, r, token, search.ID, "") {
+				ids[l.CompanyName] = l.ID
+			}
+			if _, err := repo.AddCrmLeads([]leads.Lead{{ID: ids["Acme Plumbing"], CompanyName: "Acme Plumbing", Website: "https://acme-plumbing.example"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.UpdateCrmLead(ids["Acme Plumbing"], CrmLead{Notes: "Wants a boiler quote"}); err != nil {
+				t.Fatal(err)
+			}
+			if w := doRequest(r, "DELETE", "/api/searches/"+search.ID+"/leads/"+ids["Gone Roofing"], token, nil); w.Code != http.StatusNoContent {
+				t.Fatalf("delete lead: %d", w.Code)
+			}
+
+			find := func(token, q string) string {
+				t.Helper()
+				w := doRequest(r, "GET", "/api/search?q="+url.QueryEscape(q), token, nil)
+				var results []FullTextResult
+				if err := json.Unmarshal(w.Body.Bytes(), &results); w.Code != http.StatusOK || err != nil {
+					t.Fatalf("search %q: %d %s", q, w.Code, w.Body)
+				}
+				var found []string
+				for _, res := range results {
+					found = append(found, res.Kind+":"+res.CompanyName)
+				}
+				sort.Strings(found)
+				return strings.Join(found, ", ")
+			}
+			for q, want := range map[string]string{
+				"acme":          "crm:Acme Plumbing, lead:Acme Plumbing",
+				"boiler":        "crm:Acme Plumbing",
+				"plumbing boil": "crm:Acme Plumbing",
+				"roof":          "lead:Bolt Roofing",
+				"acme-plumbing": "crm:Acme Plumbing, lead:Acme Plumbing",
+				"carpenters":    "",
+			} {
+				if got := find(token, q); got != want {
+					t.Errorf("search %q: %q, want %q", q, got, want)
+				}
+			}
+			otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+			if got := find(otherToken, "acme"); got != "" {
+				t.Errorf("another tenant found %q", got)
+			}
+			if w := doRequest(r, "GET", "/api/search?q=acme&limit=0", token, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("limit 0: got %d, want 400", w.Code)
+			}
+			if w := doRequest(r, "GET", "/api/search", token, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("no query: got %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestBackupRestoresTheDatabase(t *testing.T) {
+	r := setupTestServer(t)
+	prevDir := backupDir
+	backupDir = t.TempDir()
+	t.Cleanup(func() { backupDir = prevDir })
+
+	_, admin := registerTestUser(t, r, "alice@example.com")
+	userToken, _ := registerTestUser(t, r, "bob@example.com")
+	if _, err := db.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", admin.tenant.UserID); err != nil {
+		t.Fatal(err)
+	}
+	w := doRequest(r, "POST", "/login", "", gin.H{"email": "alice@example.com", "password": "Password123!"})
+	var login struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &login)
+	kept, _ := createTestLead(t, admin)
+
+	if w := doRequest(r, "POST", "/api/admin/backup", userToken, nil); w.Code != http.StatusForbidden {
+		t.Errorf("backup without admin rights: got %d, want 403", w.Code)
+	}
+	w = doRequest(r, "POST", "/api/admin/backup", login.Token, nil)
+	var backup BackupResult
+	json.Unmarshal(w.Body.Bytes(), &backup)
+	if w.Code != http.StatusCreated || filepath.Dir(backup.File) != backupDir || backup.Size == 0 {
+		t.Fatalf("backup: %d %s", w.Code, w.Body)
+	}
+
+	// Lose the search that was backed up and add one that wasn't.
+	if _, err := db.Exec("DELETE FROM lead_emails; DELETE FROM leads; DELETE FROM searches WHERE id = ?", kept); err != nil {
+		t.Fatal(err)
+	}
+	added, _ := createTestLead(t, admin)
+
+	db.Close()
+	if err := restoreDatabase(backup.File); err != nil {
+		t.Fatal(err)
+	}
+	initDB()
+	var list []searches.Search
+	json.Unmarshal(doRequest(r, "GET", "/api/searches", login.Token, nil).Body.Bytes(), &list)
+	if len(list) != 1 || list[0].ID != kept {
+		t.Errorf("searches after restore: %+v, want only %s and not %s", list, kept, added)
+	}
+	if found := testLeads(t, r, login.Token, kept, ""); len(found) != 1 {
+		t.Errorf("%d leads after restore, want 1", len(found))
+	}
+}
+
+func TestContactDetailsAreServedUnsealed(t *testing.T) {
+	r := setupTestServer(t)
+	t.Setenv("FIELD_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	initFieldEncryption()
+	t.Cleanup(func() { sealer = nil })
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Acme Plumbing", Phone: "01632 960001", Emails: []string{"owner@acme.test"}, Latitude: 53.8, Longitude: -1.55},
+	})
+	found := testLeads(t, r, token, search.ID, "")
+	if len(found) != 1 || found[0].Phone != "01632 960001" || found[0].Email != "owner@acme.test" {
+		t.Fatalf("leads: %+v", found)
+	}
+	lead := found[0]
+	if w := doRequest(r, "POST", "/api/crm/leads", token, []leads.Lead{lead}); w.Code != http.StatusOK {
+		t.Fatalf("add to CRM: %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, "PUT", "/api/crm/leads/"+lead.ID, token, gin.H{"notes": "Spoke to Jane"}); w.Code != http.StatusOK {
+		t.Fatalf("update notes: %d %s", w.Code, w.Body)
+	}
+
+	var stored []string
+	for _, query := range []string{
+		"SELECT phone FROM leads WHERE id = ?", "SELECT email FROM leads WHERE id = ?",
+		"SELECT phone FROM lead_phones WHERE lead_id = ?", "SELECT email FROM lead_emails WHERE lead_id = ?",
+		"SELECT phone FROM crm_leads WHERE lead_id = ?", "SELECT email FROM crm_leads WHERE lead_id = ?", "SELECT notes FROM crm_leads WHERE lead_id = ?",
+	} {
+		var v string
+		if err := db.QueryRow(query, lead.ID).Scan(&v); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		stored = append(stored, v)
+	}
+	for _, v := range stored {
+		if !strings.HasPrefix(v, SEALED_PREFIX) {
+			t.Errorf("stored %q in the clear", v)
+		}
+	}
+
+	var board struct{ Leads map[string]crm.Card }
+	json.Unmarshal(doRequest(r, "GET", "/api/crm", token, nil).Body.Bytes(), &board)
+	if card := board.Leads[lead.ID]; card.Phone != "01632 960001" || card.Email != "owner@acme.test" || card.Notes != "Spoke to Jane" {
+		t.Errorf("card wasn't unsealed: %+v", card)
+	}
+}
+
+func TestSearchQuotasAndUsage(t *testing.T) {
+	r := setupTestServer(t)
+	if _, err := db.Exec("UPDATE plans SET searches_per_month = 3, max_leads = 0, max_concurrent_scrapes = 1 WHERE id = ?", FREE_PLAN); err != nil {
+		t.Fatal(err)
+	}
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Acme Plumbing", Latitude: 53.8, Longitude: -1.55},
+		{Title: "Bolt Plumbing", Latitude: 53.8, Longitude: -1.55},
+	})
+
+	var usage Usage
+	json.Unmarshal(doRequest(r, "GET", "/api/me/usage", token, nil).Body.Bytes(), &usage)
+	if usage.Searches.Used != 1 || usage.Searches.Limit == nil || *usage.Searches.Limit != 3 {
+		t.Errorf("searches usage %+v, want 1 of 3", usage.Searches)
+	}
+	if usage.Leads.Used != 2 || usage.Leads.Limit != nil {
+		t.Errorf("leads usage %+v, want 2 with no limit", usage.Leads)
+	}
+	if now := time.Now().UTC(); usage.PeriodStart.Month() != now.Month() || usage.PeriodStart.Day() != 1 {
+		t.Errorf("period starts %s", usage.PeriodStart)
+	}
+
+	start := func() *httptest.ResponseRecorder {
+		return doRequest(r, "POST", "/api/searches", token, gin.H{"keyword": "roofers", "location": "Leeds", "source": "stub"})
+	}
+	if err := repo.Searches().Insert(searches.Search{ID: "running", Keyword: "roofers", Source: DEFAULT_SOURCE, Status: "In Progress"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := start(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("with a scrape running: got %d %s, want 429", w.Code, w.Body)
+	}
+	if _, err := db.Exec("UPDATE searches SET status = 'Completed' WHERE id = 'running'"); err != nil {
+		t.Fatal(err)
+	}
+	if w := start(); w.Code != http.StatusAccepted {
+		t.Fatalf("third search of the month: got %d %s, want 202", w.Code, w.Body)
+	}
+	searchWork.Wait()
+	if w := start(); w.Code != http.StatusPaymentRequired {
+		t.Errorf("with the month's searches used: got %d %s, want 402", w.Code, w.Body)
+	}
+	otherToken, _ := registerTestUser(t, r, "bob@example.com")
+	json.Unmarshal(doRequest(r, "GET", "/api/me/usage", otherToken, nil).Body.Bytes(), &usage)
+	if usage.Searches.Used != 0 || usage.Leads.Used != 0 {
+		t.Errorf("another user's usage %+v", usage)
+	}
+}
+
+func TestPlansGateIntegrationsAndCheckout(t *testing.T) {
+	r := setupTestServer(t)
+	token, alice := registerTestUser(t, r, "alice@example.com")
+	var me struct {
+		Plan Plan `json:"plan"`
+	}
+	json.Unmarshal(doRequest(r, "GET", "/api/me", token, nil).Body.Bytes(), &me)
+	if me.Plan.ID != FREE_PLAN || me.Plan.Integrations {
+		t.Fatalf("new user's plan %+v, want free", me.Plan)
+	}
+	for _, path := range []string{"/api/mailbox", "/api/mail-account/google/connect"} {
+		method := "PUT"
+		if strings.HasSuffix(path, "/connect") {
+			method = "POST"
+		}
+		if w := doRequest(r, method, path, token, gin.H{}); w.Code != http.StatusPaymentRequired {
+			t.Errorf("%s %s on the free plan: got %d, want 402", method, path, w.Code)
+		}
+	}
+
+	if _, err := db.Exec("UPDATE users SET plan_id = 'pro' WHERE id = ?", alice.tenant.UserID); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(doRequest(r, "GET", "/api/me", token, nil).Body.Bytes(), &me)
+	if me.Plan.ID != "pro" || !me.Plan.Integrations || me.Plan.Quotas.SearchesPerMonth != 200 {
+		t.Errorf("pro plan %+v", me.Plan)
+	}
+	if w := doRequest(r, "PUT", "/api/mailbox", token, gin.H{}); w.Code == http.StatusPaymentRequired {
+		t.Errorf("mailbox on the pro plan: got 402")
+	}
+
+	if w := doRequest(r, "POST", "/api/billing/checkout", token, gin.H{"plan": "agency"}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("checkout without Stripe: got %d, want 503", w.Code)
+	}
+	prevKey := stripeSecretKey
+	stripeSecretKey = "sk_test"
+	t.Cleanup(func() { stripeSecretKey = prevKey })
+	if w := doRequest(r, "POST", "/api/billing/checkout", token, gin.H{"plan": FREE_PLAN}); w.Code != http.StatusBadRequest {
+		t.Errorf("checkout for the free plan: got %d, want 400", w.Code)
+	}
+	if w := doRequest(r, "POST", "/api/billing/portal", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("portal without a subscription: got %d, want 400", w.Code)
+	}
+}
+
+func TestDigestEmailsCallbacksAndStaleLeads(t *testing.T) {
+	r := setupTestServer(t)
+	mail := startTestSMTP(t)
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 1, 0, 0, time.UTC)
+
+	token, alice := registerTestUser(t, r, "alice@example.com")
+	optedOutToken, bob := registerTestUser(t, r, "bob@example.com")
+	for _, tok := range []string{token, optedOutToken} {
+		if w := doRequest(r, "PUT", "/api/settings", tok, gin.H{"timezone": "UTC", "digestHour": 0, "staleAfterDays": 7}); w.Code != http.StatusOK {
+			t.Fatalf("settings: %d %s", w.Code, w.Body)
+		}
+	}
+	if w := doRequest(r, "PUT", "/api/settings", optedOutToken, gin.H{"digestEnabled": false}); w.Code != http.StatusOK {
+		t.Fatalf("opt out: %d %s", w.Code, w.Body)
+	}
+	card := func(repo *Repository, name string, callback *time.Time) string {
+		t.Helper()
+		_, leadID := createTestLead(t, repo)
+		if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: name}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.UpdateCrmLead(leadID, CrmLead{CallBackDate: callback}); err != nil {
+			t.Fatal(err)
+		}
+		return leadID
+	}
+	yesterday, later := today.AddDate(0, 0, -1), today
+	card(alice, "Overdue Plumbing", &yesterday)
+	card(alice, "Today Plumbing", &later)
+	stale := card(alice, "Stale Plumbing", nil)
+	card(alice, "Fresh Plumbing", nil)
+	if _, err := db.Exec("UPDATE crm_leads SET updated_at = ? WHERE lead_id = ?", now.AddDate(0, 0, -10).Format("2006-01-02 15:04:05"), stale); err != nil {
+		t.Fatal(err)
+	}
+	card(bob, "Bob's Overdue Plumbing", &yesterday)
+
+	sendDueDigests()
+	var msg string
+	select {
+	case msg = <-mail:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no digest was sent")
+	}
+	if !strings.Contains(msg, "To: alice@example.com") {
+		t.Fatalf("digest went to the wrong user:\n%s", msg)
+	}
+	for _, want := range []string{"Callbacks due today (1)", "Today Plumbing", "Overdue callbacks (1)", "Overdue Plumbing", "Leads untouched for 7+ days (1)", "Stale Plumbing"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("digest is missing %q:\n%s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "Fresh Plumbing") {
+		t.Errorf("digest lists a lead touched today:\n%s", msg)
+	}
+
+	// One a day, and none for users who opted out. Sending is synchronous,
+	// so anything else sent is already waiting.
+	sendDueDigests()
+	select {
+	case extra := <-mail:
+		t.Errorf("unexpected second digest:\n%s", extra)
+	default:
+	}
+}
+
+func TestPushNotifiesSubscribedBrowsers(t *testing.T) {
+	r := setupTestServer(t)
+	token, alice := registerTestUser(t, r, "alice@example.com")
+	if w := doRequest(r, "GET", "/api/push/vapid-key", token, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("vapid key without push configured: got %d, want 503", w.Code)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevKey, prevClient := vapidKey, pushClient
+	vapidKey = key
+	t.Cleanup(func() { vapidKey, pushClient = prevKey, prevClient })
+
+	// The browser's side of the subscription, used to decrypt what arrives.
+	browserKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	decrypt := func(body []byte) (pushMessage, error) {
+		var msg pushMessage
+		salt, keyLen := body[:16], int(body[20])
+		serverKey, err := ecdh.P256().NewPublicKey(body[21 : 21+keyLen])
+		if err != nil {
+			return msg, err
+		}
+		shared, _ := browserKey.ECDH(serverKey)
+		ikm, _ := hkdf.Key(sha256.New, shared, authSecret, "WebPush: info\x00"+string(browserKey.PublicKey().Bytes())+string(serverKey.Bytes()), 32)
+		prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+		cek, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+		nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		plain, err := gcm.Open(nil, nonce, body[21+keyLen:], nil)
+		if err != nil {
+			return msg, err
+		}
+		err = json.Unmarshal(bytes.TrimSuffix(plain, []byte{0x02}), &msg)
+		return msg, err
+	}
+
+	pushes := make(chan pushMessage, 10)
+	service := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		vapid, ok := strings.CutPrefix(req.Header.Get("Authorization"), "vapid t=")
+		signed, _, _ := strings.Cut(vapid, ",")
+		if _, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil }); !ok || err != nil {
+			t.Errorf("push without a valid VAPID token: %v", err)
+		}
+		body, _ := io.ReadAll(req.Body)
+		msg, err := decrypt(body)
+		if err != nil {
+			t.Errorf("undecryptable push: %v", err)
+		}
+		pushes <- msg
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer service.Close()
+	pushClient = service.Client()
+
+	var vapid struct{ PublicKey string }
+	json.Unmarshal(doRequest(r, "GET", "/api/push/vapid-key", token, nil).Body.Bytes(), &vapid)
+	if raw, err := decodeBase64URL(vapid.PublicKey); err != nil || len(raw) != 65 {
+		t.Errorf("vapid public key %q", vapid.PublicKey)
+	}
+	subscribe := func(endpoint string) *httptest.ResponseRecorder {
+		return doRequest(r, "POST", "/api/push/subscriptions", token, gin.H{"endpoint": endpoint, "keys": gin.H{
+			"p256dh": base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(authSecret),
+		}})
+	}
+	if w := subscribe("http://push.example/alice"); w.Code != http.StatusBadRequest {
+		t.Errorf("plain http endpoint: got %d, want 400", w.Code)
+	}
+	if w := subscribe(service.URL + "/alice"); w.Code != http.StatusNoContent {
+		t.Fatalf("subscribe: %d %s", w.Code, w.Body)
+	}
+
+	var sent struct{ Delivered int }
+	json.Unmarshal(doRequest(r, "POST", "/api/push/test", token, nil).Body.Bytes(), &sent)
+	if msg := <-pushes; sent.Delivered != 1 || msg.Body != "Push notifications are working" {
+		t.Errorf("test push: delivered %d, message %+v", sent.Delivered, msg)
+	}
+
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	due := time.Now().Add(-5 * time.Minute)
+	if err := alice.UpdateCrmLead(leadID, CrmLead{CallBackDate: &due}); err != nil {
+		t.Fatal(err)
+	}
+	dispatchCallbackPushes()
+	select {
+	case msg := <-pushes:
+		if msg.Title != "Callback due" || msg.Body != "Time to call Acme Plumbing back" || msg.Tag != "callback-"+leadID {
+			t.Errorf("callback push %+v", msg)
+		}
+	default:
+		t.Fatal("no push for a callback that came due")
+	}
+	dispatchCallbackPushes()
+	select {
+	case msg := <-pushes:
+		t.Errorf("the same callback was pushed again: %+v", msg)
+	default:
+	}
+
+	// Subscriptions the push service has expired are forgotten.
+	if w := subscribe(service.URL + "/gone"); w.Code != http.StatusNoContent {
+		t.Fatalf("subscribe: %d", w.Code)
+	}
+	json.Unmarshal(doRequest(r, "POST", "/api/push/test", token, nil).Body.Bytes(), &sent)
+	<-pushes
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM push_subscriptions WHERE user_id = ?", alice.tenant.UserID).Scan(&left)
+	if sent.Delivered != 1 || left != 1 {
+		t.Errorf("after an expired subscription: delivered %d, %d subscriptions left", sent.Delivered, left)
+	}
+}
+
+func TestCallScriptsRenderForALead(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Acme Plumbing", Category: "Plumber", Rating: 4.5, Latitude: 53.8, Longitude: -1.55},
+	})
+	if _, err := db.Exec("UPDATE leads SET page_speed = 34, tech = 'WordPress,jQuery' WHERE search_id = ?", search.ID); err != nil {
+		t.Fatal(err)
+	}
+	lead := testLeads(t, r, token, search.ID, "")[0]
+	if w := doRequest(r, "POST", "/api/crm/leads", token, []leads.Lead{lead}); w.Code != http.StatusOK {
+		t.Fatalf("add to CRM: %d %s", w.Code, w.Body)
+	}
+
+	if w := doRequest(r, "POST", "/api/scripts", token, gin.H{"name": "Bad", "body": "Hi {{firstName}}"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown variable: got %d, want 400", w.Code)
+	}
+	w := doRequest(r, "POST", "/api/scripts", token, gin.H{"name": "Opener",
+		"body": "Hi, is that {{companyName}}? I'm {{repName}}. Your {{tech}} site scores {{pageSpeed}} on PageSpeed and you're rated {{rating}}. Best to email {{email|you}}? {{phone}}"})
+	var script CallScript
+	json.Unmarshal(w.Body.Bytes(), &script)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create script: %d %s", w.Code, w.Body)
+	}
+
+	path := "/api/crm/leads/" + lead.ID + "/script/" + script.ID
+	var rendered struct {
+		Rendered string
+		Missing  []string
+	}
+	w = doRequest(r, "GET", path, token, nil)
+	json.Unmarshal(w.Body.Bytes(), &rendered)
+	want := "Hi, is that Acme Plumbing? I'm alice@example.com. Your WordPress, jQuery site scores 34 on PageSpeed and you're rated 4.5. Best to email you? "
+	if w.Code != http.StatusOK || rendered.Rendered != want || !reflect.DeepEqual(rendered.Missing, []string{"phone"}) {
+		t.Errorf("rendered %q missing %v, want %q missing [phone]", rendered.Rendered, rendered.Missing, want)
+	}
+
+	if w := doRequest(r, "PUT", "/api/scripts/"+script.ID, token, gin.H{"name": "Opener", "body": "Hello {{companyName}}"}); w.Code != http.StatusOK {
+		t.Fatalf("update script: %d %s", w.Code, w.Body)
+	}
+	json.Unmarshal(doRequest(r, "GET", path, token, nil).Body.Bytes(), &rendered)
+	if rendered.Rendered != "Hello Acme Plumbing" {
+		t.Errorf("rendered after update: %q", rendered.Rendered)
+	}
+	otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+	if w := doRequest(r, "GET", "/api/scripts/"+script.ID, otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another tenant's script: got %d, want 404", w.Code)
+	}
+	if w := doRequest(r, "DELETE", "/api/scripts/"+script.ID, token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete script: %d", w.Code)
+	}
+	if w := doRequest(r, "GET", path, token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("render a deleted script: got %d, want 404", w.Code)
+	}
+}
+
+func TestNotesRenderMarkdownAndKeepRevisions(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/crm/leads/" + leadID
+	var notes struct{ Notes, HTML string }
+	setNotes := func(text string) {
+		t.Helper()
+		if w := doRequest(r, "PUT", path, token, gin.H{"notes": text}); w.Code != http.StatusOK {
+			t.Fatalf("update notes: %d %s", w.Code, w.Body)
+		}
+	}
+
+	setNotes("# First call\n- **Budget** agreed")
+	json.Unmarshal(doRequest(r, "GET", path+"/notes", token, nil).Body.Bytes(), &notes)
+	if !strings.Contains(notes.HTML, "<h1>First call</h1>") || !strings.Contains(notes.HTML, "<li><strong>Budget</strong> agreed</li>") {
+		t.Errorf("rendered notes: %s", notes.HTML)
+	}
+	setNotes("<script>alert(1)</script> [site](javascript:alert(1))")
+	json.Unmarshal(doRequest(r, "GET", path+"/notes", token, nil).Body.Bytes(), &notes)
+	if strings.Contains(notes.HTML, "<script>") || strings.Contains(notes.HTML, `href="javascript:`) {
+		t.Errorf("notes HTML isn't safe: %s", notes.HTML)
+	}
+
+	var revisions []NoteRevision
+	json.Unmarshal(doRequest(r, "GET", path+"/notes/revisions", token, nil).Body.Bytes(), &revisions)
+	// Newest first; the oldest is the empty notes the card started with.
+	if len(revisions) != 2 || revisions[0].PreviousNotes != "# First call\n- **Budget** agreed" || revisions[0].EditedBy != repo.Tenant().UserID || revisions[1].PreviousNotes != "" {
+		t.Fatalf("revisions: %+v", revisions)
+	}
+	w := doRequest(r, "POST", fmt.Sprintf("%s/notes/revisions/%d/restore", path, revisions[0].ID), token, nil)
+	json.Unmarshal(w.Body.Bytes(), &notes)
+	if w.Code != http.StatusOK || notes.Notes != "# First call\n- **Budget** agreed" {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	// The restore keeps what it replaced, so it can be undone too.
+	json.Unmarshal(doRequest(r, "GET", path+"/notes/revisions", token, nil).Body.Bytes(), &revisions)
+	if len(revisions) != 3 || !strings.HasPrefix(revisions[0].PreviousNotes, "<script>") {
+		t.Errorf("revisions after restoring: %+v", revisions)
+	}
+
+	otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+	if w := doRequest(r, "GET", path+"/notes/revisions", otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another tenant's revisions: got %d, want 404", w.Code)
+	}
+	if w := doRequest(r, "POST", fmt.Sprintf("%s/notes/revisions/%d/restore", path, revisions[0].ID), otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("restore another tenant's revision: got %d, want 404", w.Code)
+	}
+}
+
+func TestLeadActivityFeedCollectsEveryEvent(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	_, leadID := createTestLead(t, repo)
+	path := "/api/crm/leads/" + leadID
+	for _, step := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"POST", "/api/crm/leads", []leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}},
+		{"PUT", "/api/crm/state", gin.H{"leadId": leadID, "newColumnId": "contacted"}},
+		{"PUT", path, gin.H{"notes": "Asked for a quote"}},
+		{"POST", path + "/calls", gin.H{"disposition": "no_answer", "notes": "Rang out"}},
+		{"POST", path + "/tags", gin.H{"tag": "boilers"}},
+	} {
+		if w := doRequest(r, step.method, step.path, token, step.body); w.Code >= 300 {
+			t.Fatalf("%s %s: %d %s", step.method, step.path, w.Code, w.Body)
+		}
+	}
+
+	var events []ActivityEvent
+	w := doRequest(r, "GET", path+"/activity", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &events)
+	seen := map[string]bool{}
+	for i, e := range events {
+		seen[e.Type] = true
+		if e.UserID != repo.Tenant().UserID || e.UserName != "alice@example.com" {
+			t.Errorf("event %+v isn't attributed to alice", e)
+		}
+		if i > 0 && e.At.After(events[i-1].At) {
+			t.Errorf("events out of order: %s after %s", e.At, events[i-1].At)
+		}
+	}
+	for _, want := range []string{"added", "column_move", "note_edit", "call", "tag_added"} {
+		if !seen[want] {
+			t.Errorf("activity is missing a %s event: %s", want, w.Body)
+		}
+	}
+
+	json.Unmarshal(doRequest(r, "GET", path+"/activity?limit=2", token, nil).Body.Bytes(), &events)
+	if len(events) != 2 {
+		t.Errorf("%d events with limit=2", len(events))
+	}
+	if w := doRequest(r, "GET", path+"/activity?limit=0", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0: got %d, want 400", w.Code)
+	}
+	if w := doRequest(r, "GET", path+"/activity?before=yesterday", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unparseable before: got %d, want 400", w.Code)
+	}
+	otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+	if w := doRequest(r, "GET", path+"/activity", otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another tenant's activity: got %d, want 404", w.Code)
+	}
+}
+
+func TestSnoozedLeadsLeaveTheBoardUntilTheyResurface(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	_, snoozed := createTestLead(t, repo)
+	_, other := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: snoozed, CompanyName: "Acme Plumbing"}, {ID: other, CompanyName: "Bolt Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	onBoard := func(leadID string) bool {
+		t.Helper()
+		var board struct{ Leads map[string]crm.Card }
+		json.Unmarshal(doRequest(r, "GET", "/api/crm", token, nil).Body.Bytes(), &board)
+		_, ok := board.Leads[leadID]
+		return ok
+	}
+	snoozedList := func() []CrmLead {
+		t.Helper()
+		var list []CrmLead
+		json.Unmarshal(doRequest(r, "GET", "/api/crm/snoozed", token, nil).Body.Bytes(), &list)
+		return list
+	}
+	path := "/api/crm/leads/" + snoozed + "/snooze"
+
+	for _, until := range []string{time.Now().Add(-time.Hour).Format(time.RFC3339), "next week"} {
+		if w := doRequest(r, "PUT", path, token, gin.H{"until": until}); w.Code != http.StatusBadRequest {
+			t.Errorf("snooze until %q: got %d, want 400", until, w.Code)
+		}
+	}
+	if w := doRequest(r, "PUT", path, token, gin.H{"until": time.Now().AddDate(0, 0, 7).Format("2006-01-02")}); w.Code != http.StatusOK {
+		t.Fatalf("snooze: %d %s", w.Code, w.Body)
+	}
+	if onBoard(snoozed) || !onBoard(other) {
+		t.Error("the snoozed lead is still on the board, or the other one isn't")
+	}
+	if list := snoozedList(); len(list) != 1 || list[0].ID != snoozed {
+		t.Errorf("snoozed leads: %+v", list)
+	}
+	otherToken, _ := registerTestUser(t, r, "mallory@example.com")
+	if w := doRequest(r, "DELETE", path, otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unsnooze another tenant's lead: got %d, want 404", w.Code)
+	}
+
+	// Once the date passes the lead comes back by itself.
+	if _, err := db.Exec("UPDATE crm_leads SET snoozed_until = ? WHERE lead_id = ?", time.Now().Add(-time.Minute).UTC(), snoozed); err != nil {
+		t.Fatal(err)
+	}
+	resurfaceSnoozedLeads()
+	if !onBoard(snoozed) || len(snoozedList()) != 0 {
+		t.Error("the lead didn't resurface when its snooze ran out")
+	}
+	var events []ActivityEvent
+	json.Unmarshal(doRequest(r, "GET", "/api/crm/leads/"+snoozed+"/activity", token, nil).Body.Bytes(), &events)
+	types := map[string]bool{}
+	for _, e := range events {
+		types[e.Type] = true
+	}
+	if !types["snoozed"] || !types["resurfaced"] {
+		t.Errorf("activity %+v, want snoozed and resurfaced", events)
+	}
+	if w := doRequest(r, "DELETE", path, token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unsnooze a lead that isn't snoozed: got %d, want 404", w.Code)
+	}
+}
+
+func TestColumnWIPLimitsAndCardAging(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	var ids []string
+	for i := 0; i < 3; i++ {
+		_, leadID := createTestLead(t, repo)
+		ids = append(ids, leadID)
+	}
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: ids[0], CompanyName: "A"}, {ID: ids[1], CompanyName: "B"}, {ID: ids[2], CompanyName: "C"}}); err != nil {
+		t.Fatal(err)
+	}
+	setLimit := func(body gin.H) *httptest.ResponseRecorder {
+		return doRequest(r, "PUT", "/api/crm/columns/contacted", token, body)
+	}
+	move := func(leadID string) *httptest.ResponseRecorder {
+		return doRequest(r, "PUT", "/api/crm/state", token, gin.H{"leadId": leadID, "newColumnId": "contacted"})
+	}
+
+	for _, bad := range []gin.H{{"wipLimit": -1}, {"wipPolicy": "shout"}} {
+		if w := setLimit(bad); w.Code != http.StatusBadRequest {
+			t.Errorf("column update %v: got %d, want 400", bad, w.Code)
+		}
+	}
+	if w := setLimit(gin.H{"wipLimit": 1, "wipPolicy": "reject"}); w.Code != http.StatusOK {
+		t.Fatalf("set limit: %d %s", w.Code, w.Body)
+	}
+	if w := move(ids[0]); w.Code != http.StatusOK {
+		t.Fatalf("move within the limit: %d %s", w.Code, w.Body)
+	}
+	if w := move(ids[1]); w.Code != http.StatusConflict {
+		t.Errorf("move past a rejecting limit: got %d, want 409", w.Code)
+	}
+	if w := move(ids[0]); w.Code != http.StatusOK {
+		t.Errorf("moving a card already in the full column: got %d, want 200", w.Code)
+	}
+
+	if w := setLimit(gin.H{"wipPolicy": "warn"}); w.Code != http.StatusOK {
+		t.Fatalf("set policy: %d %s", w.Code, w.Body)
+	}
+	w := move(ids[1])
+	var moved struct{ Warning string }
+	json.Unmarshal(w.Body.Bytes(), &moved)
+	if w.Code != http.StatusOK || moved.Warning == "" {
+		t.Errorf("move past a warning limit: %d %s, want 200 with a warning", w.Code, w.Body)
+	}
+
+	if _, err := db.Exec("UPDATE crm_leads SET column_changed_at = ? WHERE lead_id = ?", time.Now().UTC().AddDate(0, 0, -5).Format("2006-01-02 15:04:05"), ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	var board struct {
+		Leads   map[string]crm.Card
+		Columns map[string]struct {
+			WIPLimit  int    `json:"wipLimit"`
+			WIPPolicy string `json:"wipPolicy"`
+		}
+	}
+	json.Unmarshal(doRequest(r, "GET", "/api/crm", token, nil).Body.Bytes(), &board)
+	if got := board.Leads[ids[0]].DaysInColumn; got != 5 {
+		t.Errorf("daysInColumn %d, want 5", got)
+	}
+	if got := board.Leads[ids[1]].DaysInColumn; got != 0 {
+		t.Errorf("daysInColumn of a card just moved: %d", got)
+	}
+	if col := board.Columns["contacted"]; col.WIPLimit != 1 || col.WIPPolicy != "warn" {
+		t.Errorf("board column %+v", col)
+	}
+}
+
+func TestSearchStatsJudgeAKeyword(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "<html><body>Acme</body></html>")
+	}))
+	defer site.Close()
+
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Acme Plumbing", Phone: "0113 496 0000", Website: site.URL, Emails: []string{"owner@acme.test"}, Latitude: 53.8, Longitude: -1.5},
+		{Title: "Best Boilers", Phone: "0113 496 0001", Latitude: 53.8, Longitude: -1.5},
+		{Title: "Acme Plumbing Ltd", Phone: "(0113) 4960000", Latitude: 53.8, Longitude: -1.5},
+		{Title: "Quiet Pipes", Latitude: 53.8, Longitude: -1.5},
+	})
+	for _, lead := range testLeads(t, r, token, search.ID, "") {
+		speed := map[string]int{"Acme Plumbing": 40, "Best Boilers": 60}[lead.CompanyName]
+		if speed == 0 {
+			continue
+		}
+		if _, err := db.Exec("UPDATE leads SET page_speed = ? WHERE id = ?", speed, lead.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := doRequest(r, "GET", "/api/searches/"+search.ID+"/stats", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("stats: %d %s", w.Code, w.Body)
+	}
+	var stats SearchStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	avg := 50.0
+	want := SearchStats{Leads: 4, WithEmailPct: 25, WithWebsitePct: 25, WithPhonePct: 75, AvgPageSpeed: &avg, Duplicates: 1, DuplicateRate: 25}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+
+	bob, _ := registerTestUser(t, r, "bob@example.com")
+	if w := doRequest(r, "GET", "/api/searches/"+search.ID+"/stats", bob, nil); w.Code != http.StatusForbidden {
+		t.Errorf("another tenant's stats: got %d, want 403", w.Code)
+	}
+}
+
+func TestCrawlerFindsEmailsOnContactPages(t *testing.T) {
+	var mu sync.Mutex
+	requested := map[string]bool{}
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requested[req.URL.Path] = true
+		mu.Unlock()
+		switch req.URL.Path {
+		case "/robots.txt":
+			fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+		case "/":
+			fmt.Fprint(w, `<html><body><a href="/private/about">About us</a> <a href="/contact">Contact</a> <a href="/prices">Prices</a></body></html>`)
+		case "/contact":
+			fmt.Fprint(w, `<html><body>Write to <a href="mailto:hello&#64;smith.example">us</a> or logo@2x.png</body></html>`)
+		default:
+			fmt.Fprint(w, `<html><body>owner@smith.example</body></html>`)
+		}
+	}))
+	defer site.Close()
+
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Smith Plumbing", Website: site.URL, Latitude: 53.8, Longitude: -1.55},
+		{Title: "Listed Email", Website: site.URL + "/contact", Emails: []string{"info@listed.example"}, Latitude: 53.8, Longitude: -1.55},
+	})
+
+	byName := map[string]leads.Lead{}
+	for _, l := range testLeads(t, r, token, search.ID, "") {
+		byName[l.CompanyName] = l
+	}
+	crawled := byName["Smith Plumbing"]
+	if want := []leads.Email{{Email: "hello@smith.example", Type: "website"}}; !reflect.DeepEqual(crawled.Emails, want) || crawled.Email != "hello@smith.example" {
+		t.Errorf("crawled: email %q, emails %+v, want %+v", crawled.Email, crawled.Emails, want)
+	}
+	if listed := byName["Listed Email"]; len(listed.Emails) != 1 || listed.Emails[0].Type != "scraped" {
+		t.Errorf("a lead with a scraped email was crawled: %+v", listed.Emails)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requested["/private/about"] {
+		t.Error("crawler fetched a page robots.txt disallows")
+	}
+	if requested["/prices"] {
+		t.Error("crawler followed a link that is not a contact page")
+	}
+}
+
+func TestGuessedEmailsAreVerifiedAndFlagged(t *testing.T) {
+	r := setupTestServer(t)
+	verifier := &fakeVerifier{
+		info:     VerifierInfo{ID: "fake", Name: "Fake"},
+		verdicts: map[string]string{"jane@smith.example": EMAIL_VALID, "info@smith.example": EMAIL_VALID},
+	}
+	registerTestVerifier(t, verifier)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"emailVerifier": "fake"}); w.Code != http.StatusOK {
+		t.Fatalf("settings: %d %s", w.Code, w.Body)
+	}
+	searchID, leadID := createTestLead(t, repo)
+	if _, err := db.Exec("UPDATE leads SET website = 'https://www.smith.example/' WHERE id = ?", leadID); err != nil {
+		t.Fatal(err)
+	}
+	guessPath := "/api/searches/" + searchID + "/leads/" + leadID + "/guess-emails"
+
+	w := doRequest(r, "POST", guessPath, token, gin.H{"ownerName": "Jane Smith"})
+	var resp struct {
+		Guesses []GuessedEmail
+		Saved   int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("guess: %d %s", w.Code, w.Body)
+	}
+	wantFirst := []GuessedEmail{
+		{Email: "jane@smith.example", Verification: EMAIL_VALID},
+		{Email: "jane.smith@smith.example", Verification: EMAIL_INVALID},
+		{Email: "janesmith@smith.example", Verification: EMAIL_INVALID},
+	}
+	if len(resp.Guesses) != len(guessLocalParts("Jane Smith")) || !reflect.DeepEqual(resp.Guesses[:3], wantFirst) || resp.Saved != 2 {
+		t.Fatalf("guesses %+v, saved %d", resp.Guesses, resp.Saved)
+	}
+	if len(verifier.checked) != len(resp.Guesses) {
+		t.Errorf("a free verifier checked %d addresses, want all %d in one go", len(verifier.checked), len(resp.Guesses))
+	}
+
+	found := testLeads(t, r, token, searchID, "")
+	var guessed []leads.Email
+	for _, e := range found[0].Emails {
+		if e.Type == "guessed" {
+			guessed = append(guessed, e)
+		} else if e.Email != "owner@acme.test" {
+			t.Errorf("unexpected email %+v", e)
+		}
+	}
+	sort.Slice(guessed, func(i, j int) bool { return guessed[i].Email < guessed[j].Email })
+	want := []leads.Email{
+		{Email: "info@smith.example", Type: "guessed", Verification: EMAIL_VALID},
+		{Email: "jane@smith.example", Type: "guessed", Verification: EMAIL_VALID},
+	}
+	if !reflect.DeepEqual(guessed, want) {
+		t.Errorf("saved guesses %+v, want %+v", guessed, want)
+	}
+
+	noSiteSearch, noSiteLead := createTestLead(t, repo)
+	if w := doRequest(r, "POST", "/api/searches/"+noSiteSearch+"/leads/"+noSiteLead+"/guess-emails", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("guess without a website: got %d, want 400", w.Code)
+	}
+	bob, _ := registerTestUser(t, r, "bob@example.com")
+	if w := doRequest(r, "POST", guessPath, bob, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another tenant's lead: got %d, want 404", w.Code)
+	}
+}
+
+func TestPaidVerifiersAreMeteredPerProvider(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		mu.Lock()
+		asked = append(asked, req.URL.Path+" "+q.Get("email"))
+		mu.Unlock()
+		switch req.URL.Path {
+		case "/v2/validate":
+			if q.Get("api_key") != "zb-key" {
+				fmt.Fprint(w, `{"error": "Invalid API key"}`)
+				return
+			}
+			status := map[string]string{"info@smith.example": "do_not_mail", "hello@smith.example": "valid"}[q.Get("email")]
+			if status == "" {
+				status = "invalid"
+			}
+			fmt.Fprintf(w, `{"status": %q}`, status)
+		case "/v4/single/check":
+			fmt.Fprint(w, `{"status": "success", "result": "catchall"}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer service.Close()
+	registerEmailVerifier(&zeroBounceVerifier{client: redirectClient(service)})
+	registerEmailVerifier(&neverBounceVerifier{client: redirectClient(service)})
+	t.Cleanup(func() { delete(emailVerifiers, "zerobounce"); delete(emailVerifiers, "neverbounce") })
+
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	searchID, leadID := createTestLead(t, repo)
+	if _, err := db.Exec("UPDATE leads SET website = 'https://smith.example' WHERE id = ?", leadID); err != nil {
+		t.Fatal(err)
+	}
+	leadPath := "/api/searches/" + searchID + "/leads/" + leadID
+	settings := func(body gin.H) {
+		t.Helper()
+		if w := doRequest(r, "PUT", "/api/settings", token, body); w.Code != http.StatusOK {
+			t.Fatalf("settings %v: %d %s", body, w.Code, w.Body)
+		}
+	}
+	usage := func() map[string]usageCounter {
+		var list []struct {
+			ID       string
+			Selected bool
+			Usage    usageCounter
+		}
+		json.Unmarshal(doRequest(r, "GET", "/api/verifiers", token, nil).Body.Bytes(), &list)
+		byID := map[string]usageCounter{}
+		for _, v := range list {
+			byID[v.ID] = v.Usage
+		}
+		return byID
+	}
+
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"emailVerifier": "nosuchverifier"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown verifier: got %d, want 400", w.Code)
+	}
+	settings(gin.H{"emailVerifier": "zerobounce"})
+	w := doRequest(r, "POST", leadPath+"/guess-emails", token, nil)
+	var guessed struct {
+		Saved   int
+		Warning string
+	}
+	json.Unmarshal(w.Body.Bytes(), &guessed)
+	if w.Code != http.StatusOK || guessed.Saved != 0 || !strings.Contains(guessed.Warning, "API key") || len(asked) != 0 {
+		t.Fatalf("guess without a key: %d %s, asked %v", w.Code, w.Body, asked)
+	}
+
+	// A paid verifier is asked one address at a time and stops at the
+	// first good one.
+	settings(gin.H{"emailVerifierApiKey": "zb-key", "emailVerifierMonthlyLimit": 3})
+	w = doRequest(r, "POST", leadPath+"/guess-emails", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &guessed)
+	if want := []string{"/v2/validate info@smith.example", "/v2/validate hello@smith.example"}; w.Code != http.StatusOK || guessed.Saved != 1 || !reflect.DeepEqual(asked, want) {
+		t.Fatalf("guess: %d %s, asked %v, want %v", w.Code, w.Body, asked, want)
+	}
+	if got := usage()["zerobounce"]; got.Used != 2 || got.Limit == nil || *got.Limit != 3 {
+		t.Errorf("zerobounce usage %+v, want 2 of 3", got)
+	}
+
+	// The lead now has two addresses, which would go over the limit.
+	if w := doRequest(r, "POST", leadPath+"/verify-emails", token, nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("verify over the limit: got %d, want 429", w.Code)
+	}
+
+	settings(gin.H{"emailVerifier": "neverbounce", "emailVerifierApiKey": "nb-key"})
+	w = doRequest(r, "POST", leadPath+"/verify-emails", token, nil)
+	var emails []leads.Email
+	json.Unmarshal(w.Body.Bytes(), &emails)
+	if w.Code != http.StatusOK || len(emails) != 2 {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	for _, e := range emails {
+		if e.Verification != EMAIL_CATCH_ALL {
+			t.Errorf("%s verified as %q, want %q", e.Email, e.Verification, EMAIL_CATCH_ALL)
+		}
+	}
+	counts := usage()
+	if counts["neverbounce"].Used != 2 || counts["zerobounce"].Used != 2 {
+		t.Errorf("usage %+v, want 2 checks on each provider", counts)
+	}
+}
+
+func TestPhoneLookupsMarkLineTypes(t *testing.T) {
+	var mu sync.Mutex
+	lookups := 0
+	twilio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		lookups++
+		mu.Unlock()
+		if sid, token, _ := req.BasicAuth(); sid != "AC123" || token != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "Authenticate"}`)
+			return
+		}
+		switch strings.TrimPrefix(req.URL.Path, "/v2/PhoneNumbers/") {
+		case "07700 900123":
+			fmt.Fprint(w, `{"valid": true, "line_type_intelligence": {"type": "mobile", "carrier_name": "EE"}}`)
+		case "0113 496 0000":
+			fmt.Fprint(w, `{"valid": true, "line_type_intelligence": {"type": "landline", "carrier_name": "BT"}}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer twilio.Close()
+	registerPhoneLookupProvider(&twilioLookupProvider{client: redirectClient(twilio)})
+	t.Cleanup(func() { delete(phoneLookupProviders, "twilio") })
+
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"phoneLookupProvider": "nosuchprovider"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown provider: got %d, want 400", w.Code)
+	}
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"phoneLookupProvider": "twilio", "phoneLookupApiKey": "AC123:secret"}); w.Code != http.StatusOK {
+		t.Fatalf("settings: %d %s", w.Code, w.Body)
+	}
+
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Mobile Plumber", Phone: "07700 900123", Latitude: 53.8, Longitude: -1.55},
+		{Title: "Office Plumber", Phone: "0113 496 0000", Latitude: 53.8, Longitude: -1.55},
+		{Title: "Wrong Number", Phone: "12345", Latitude: 53.8, Longitude: -1.55},
+	})
+	byName := map[string]leads.Lead{}
+	for _, l := range testLeads(t, r, token, search.ID, "") {
+		byName[l.CompanyName] = l
+	}
+	valid, invalid := true, false
+	want := map[string]leads.Phone{
+		"Mobile Plumber": {Phone: "07700 900123", Type: "main", Valid: &valid, LineType: PHONE_MOBILE, Carrier: "EE"},
+		"Office Plumber": {Phone: "0113 496 0000", Type: "main", Valid: &valid, LineType: PHONE_LANDLINE, Carrier: "BT"},
+		"Wrong Number":   {Phone: "12345", Type: "main", Valid: &invalid},
+	}
+	for name, phone := range want {
+		if got := byName[name].Phones; len(got) != 1 || !reflect.DeepEqual(got[0], phone) {
+			t.Errorf("%s: phones %+v, want %+v", name, got, phone)
+		}
+	}
+
+	if mobile := testLeads(t, r, token, search.ID, "?lineType=mobile"); len(mobile) != 1 || mobile[0].CompanyName != "Mobile Plumber" {
+		t.Errorf("lineType=mobile: %+v", mobile)
+	}
+	if w := doRequest(r, "GET", "/api/leads/"+search.ID+"?lineType=fax", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown lineType: got %d, want 400", w.Code)
+	}
+
+	// Numbers are only looked up once.
+	leadPath := "/api/searches/" + search.ID + "/leads/" + byName["Mobile Plumber"].ID + "/lookup-phones"
+	if w := doRequest(r, "POST", leadPath, token, nil); w.Code != http.StatusOK || lookups != 3 {
+		t.Errorf("lookup again: %d %s after %d lookups, want 3", w.Code, w.Body, lookups)
+	}
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"phoneLookupProvider": ""}); w.Code != http.StatusOK {
+		t.Fatalf("clear provider: %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, "POST", leadPath, token, nil); w.Code != http.StatusBadGateway {
+		t.Errorf("lookup without a provider: got %d, want 502", w.Code)
+	}
+}
+
+func TestLeadsAreOnlyCallableInTheirLocalHours(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	search := runTestSearch(t, r, token, []scraper.Lead{
+		{Title: "Leeds Plumbing", Phone: "0113 496 0000", Latitude: 53.8, Longitude: -1.55},
+		{Title: "LA Plumbing", Phone: "+1 213 555 0100", Latitude: 34.05, Longitude: -118.24},
+		{Title: "Tokyo Plumbing", Phone: "+81 3 1234 5678", Latitude: 35.68, Longitude: 139.69},
+		{Title: "Somewhere Plumbing", Latitude: -45, Longitude: -140},
+	})
+	found := testLeads(t, r, token, search.ID, "")
+	zones := map[string]string{}
+	for _, l := range found {
+		zones[l.CompanyName] = l.Timezone
+	}
+	want := map[string]string{"Leeds Plumbing": "Europe/London", "LA Plumbing": "America/Los_Angeles", "Tokyo Plumbing": "Asia/Tokyo", "Somewhere Plumbing": ""}
+	if !reflect.DeepEqual(zones, want) {
+		t.Fatalf("timezones %v, want %v", zones, want)
+	}
+
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"callingHoursStart": 17, "callingHoursEnd": 9}); w.Code != http.StatusBadRequest {
+		t.Errorf("window ending before it starts: got %d, want 400", w.Code)
+	}
+	// A two-hour window starting now in London; leads with no timezone
+	// follow the user's, which is half a world away.
+	london, _ := time.LoadLocation("Europe/London")
+	hour := time.Now().In(london).Hour()
+	settings := gin.H{"timezone": "Pacific/Auckland", "callingHoursStart": hour, "callingHoursEnd": min(hour+2, 24), "callOnWeekends": true}
+	if w := doRequest(r, "PUT", "/api/settings", token, settings); w.Code != http.StatusOK {
+		t.Fatalf("settings: %d %s", w.Code, w.Body)
+	}
+
+	if callable := testLeads(t, r, token, search.ID, "?callableNow=true"); len(callable) != 1 || callable[0].CompanyName != "Leeds Plumbing" {
+		t.Errorf("callableNow=true: %+v", callable)
+	}
+
+	if w := doRequest(r, "POST", "/api/crm/leads", token, found); w.Code != http.StatusOK {
+		t.Fatalf("add to CRM: %d %s", w.Code, w.Body)
+	}
+	var board []CallableLead
+	json.Unmarshal(doRequest(r, "GET", "/api/crm/callable", token, nil).Body.Bytes(), &board)
+	byName := map[string]CallableLead{}
+	for _, l := range found {
+		for _, cl := range board {
+			if cl.LeadID == l.ID {
+				byName[l.CompanyName] = cl
+			}
+		}
+	}
+	if len(byName) != 4 {
+		t.Fatalf("callable board %+v", board)
+	}
+	for name, cl := range byName {
+		if cl.CallableNow != (name == "Leeds Plumbing") || cl.Timezone != want[name] || cl.NextCallableAt == nil {
+			t.Errorf("%s: %+v", name, cl)
+			continue
+		}
+		if name == "Leeds Plumbing" {
+			continue
+		}
+		loc, _ := time.LoadLocation(cmp.Or(want[name], "Pacific/Auckland"))
+		if next := cl.NextCallableAt.In(loc); !next.After(time.Now()) || next.Hour() != hour || next.Minute() != 0 {
+			t.Errorf("%s: next callable at %v local time, want %02d:00", name, next, hour)
+		}
+	}
+}
+
+func TestCallbacksAreListedByWhenTheyAreDue(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, time.UTC)
+	callbacks := []struct {
+		name     string
+		at       time.Time
+		priority string
+	}{
+		{"long overdue", today.AddDate(0, 0, -2), PRIORITY_COLD},
+		{"overdue", today.AddDate(0, 0, -1), PRIORITY_HOT},
+		{"today", today, ""},
+		{"this week", today.AddDate(0, 0, 3), ""},
+		{"next month", today.AddDate(0, 1, 0), ""},
+		{"none", time.Time{}, ""},
+	}
+	ids := map[string]string{}
+	for _, cb := range callbacks {
+		_, leadID := createTestLead(t, repo)
+		ids[leadID] = cb.name
+		if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: cb.name}}); err != nil {
+			t.Fatal(err)
+		}
+		if !cb.at.IsZero() {
+			if w := doRequest(r, "PUT", "/api/crm/leads/"+leadID, token, gin.H{"callBackDate": cb.at}); w.Code != http.StatusOK {
+				t.Fatalf("book callback: %d %s", w.Code, w.Body)
+			}
+		}
+		if cb.priority != "" {
+			if w := doRequest(r, "PUT", "/api/crm/leads/"+leadID+"/priority", token, gin.H{"priority": cb.priority}); w.Code != http.StatusOK {
+				t.Fatalf("priority: %d %s", w.Code, w.Body)
+			}
+		}
+	}
+
+	list := func(tok, query string) []string {
+		t.Helper()
+		w := doRequest(r, "GET", "/api/crm/callbacks"+query, tok, nil)
+		var cards []CrmLead
+		if err := json.Unmarshal(w.Body.Bytes(), &cards); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("callbacks%s: %d %s", query, w.Code, w.Body)
+		}
+		names := []string{}
+		for _, c := range cards {
+			names = append(names, ids[c.ID])
+		}
+		return names
+	}
+	for query, want := range map[string][]string{
+		"":                           {"long overdue", "overdue", "today", "this week", "next month"},
+		"?due=overdue":               {"long overdue", "overdue"},
+		"?due=today":                 {"today"},
+		"?due=week":                  {"today", "this week"},
+		"?due=overdue&sort=priority": {"overdue", "long overdue"},
+	} {
+		if got := list(token, query); !reflect.DeepEqual(got, want) {
+			t.Errorf("callbacks%s: %v, want %v", query, got, want)
+		}
+	}
+	for _, query := range []string{"?due=yesterday", "?sort=name"} {
+		if w := doRequest(r, "GET", "/api/crm/callbacks"+query, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("callbacks%s: got %d, want 400", query, w.Code)
+		}
+	}
+	bob, _ := registerTestUser(t, r, "bob@example.com")
+	if got := list(bob, ""); len(got) != 0 {
+		t.Errorf("another tenant sees callbacks %v", got)
+	}
+}
+
+func TestPipelineReportSummarizesTheBoard(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	ids := map[string]string{}
+	for _, name := range []string{"Hot Prospect", "Callback Soon", "Callback Later", "Napping"} {
+		_, leadID := createTestLead(t, repo)
+		ids[name] = leadID
+		if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []struct {
+		path string
+		body gin.H
+	}{
+		{ids["Hot Prospect"] + "/calls", gin.H{"disposition": "interested"}},
+		{ids["Callback Soon"], gin.H{"callBackDate": time.Now().AddDate(0, 0, 2)}},
+		{ids["Callback Later"], gin.H{"callBackDate": time.Now().AddDate(0, 0, 10)}},
+		{ids["Napping"] + "/snooze", gin.H{"until": time.Now().AddDate(0, 0, 3).Format("2006-01-02")}},
+	}
+	for _, step := range steps {
+		method := "PUT"
+		if strings.HasSuffix(step.path, "/calls") {
+			method = "POST"
+		}
+		if w := doRequest(r, method, "/api/crm/leads/"+step.path, token, step.body); w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("%s %s: %d %s", method, step.path, w.Code, w.Body)
+		}
+	}
+
+	report := func(tok string) string {
+		t.Helper()
+		w := doRequest(r, "GET", "/api/reports/pipeline.pdf", tok, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pdf" || !strings.HasPrefix(w.Body.String(), "%PDF-") {
+			t.Fatalf("report: %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		if want := "pipeline-" + time.Now().UTC().Format("2006-01-02") + ".pdf"; !strings.Contains(w.Header().Get("Content-Disposition"), want) {
+			t.Errorf("Content-Disposition %q, want a %s attachment", w.Header().Get("Content-Disposition"), want)
+		}
+		return w.Body.String()
+	}
+	pdf := report(token)
+	for _, want := range []string{"(Board)", "(3)", "(1 more snoozed and off the board.)", "(Interested)", "(Hot Prospect)", "(Callback Soon)"} {
+		if !strings.Contains(pdf, want+" Tj") {
+			t.Errorf("report is missing %s", want)
+		}
+	}
+	for _, unwanted := range []string{"(Callback Later)", "(Napping)", "(No calls yet this week.)"} {
+		if strings.Contains(pdf, unwanted+" Tj") {
+			t.Errorf("report shouldn't show %s", unwanted)
+		}
+	}
+
+	bob, _ := registerTestUser(t, r, "bob@example.com")
+	pdf = report(bob)
+	for _, want := range []string{"(No calls yet this week.)", "(No leads have said they're interested yet.)", "(No callbacks booked.)"} {
+		if !strings.Contains(pdf, want+" Tj") {
+			t.Errorf("another tenant's report is missing %s", want)
+		}
+	}
+	if strings.Contains(pdf, "(Hot Prospect)") {
+		t.Error("another tenant's report shows the first tenant's leads")
+	}
+}
+
+func TestDailyGoalsTrackDialsAndStreaks(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "alice@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"dailyDialGoal": 1001}); w.Code != http.StatusBadRequest {
+		t.Errorf("goal over 1000: got %d, want 400", w.Code)
+	}
+	if w := doRequest(r, "PUT", "/api/settings", token, gin.H{"dailyDialGoal": 2, "callOnWeekends": true}); w.Code != http.StatusOK {
+		t.Fatalf("settings: %d %s", w.Code, w.Body)
+	}
+
+	// Two runs of met goals, broken by a day with one call.
+	now := time.Now().UTC()
+	noon := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, time.UTC)
+	for daysAgo, calls := range map[int]int{1: 2, 2: 3, 3: 1, 4: 2, 5: 2, 6: 2, 7: 2} {
+		for i := 0; i < calls; i++ {
+			_, err := db.Exec("INSERT INTO crm_calls (org_id, user_id, lead_id, disposition, called_at) VALUES (?, ?, ?, 'no_answer', ?)",
+				repo.Tenant().OrgID, repo.Tenant().UserID, leadID, noon.AddDate(0, 0, -daysAgo))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	today := func(tok string) DialGoal {
+		t.Helper()
+		var goal DialGoal
+		w := doRequest(r, "GET", "/api/goals/today", tok, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &goal); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("goals: %d %s", w.Code, w.Body)
+		}
+		return goal
+	}
+	call := func() {
+		t.Helper()
+		if w := doRequest(r, "POST", "/api/crm/leads/"+leadID+"/calls", token, gin.H{"disposition": "no_answer"}); w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("call: %d %s", w.Code, w.Body)
+		}
+	}
+
+	call()
+	date := now.Format("2006-01-02")
+	if got, want := today(token), (DialGoal{Date: date, Goal: 2, Dials: 1, Remaining: 1, Streaks: Streaks{Current: 2, Longest: 4}}); got != want {
+		t.Errorf("goal in progress: %+v, want %+v", got, want)
+	}
+	call()
+	if got, want := today(token), (DialGoal{Date: date, Goal: 2, Dials: 2, Met: true, Streaks: Streaks{Current: 3, Longest: 4}}); got != want {
+		t.Errorf("goal met: %+v, want %+v", got, want)
+	}
+
+	var analytics struct{ Streaks Streaks }
+	json.Unmarshal(doRequest(r, "GET", "/api/analytics/dispositions", token, nil).Body.Bytes(), &analytics)
+	if analytics.Streaks != (Streaks{Current: 3, Longest: 4}) {
+		t.Errorf("analytics streaks %+v", analytics.Streaks)
+	}
+
+	bob, _ := registerTestUser(t, r, "bob@example.com")
+	if got := today(bob); got.Dials != 0 || got.Streaks != (Streaks{}) {
+		t.Errorf("another user's goal: %+v", got)
+	}
+}
+
+func TestSearchesRecordScraperMetrics(t *testing.T) {
+	leadProviders.Register(funcProvider{info: scraper.Info{ID: "binary", Name: "Binary"}, search: func(ctx context.Context, q scraper.Query) ([]scraper.Lead, error) {
+		q.Log.Output("scraped 2 places")
+		q.Log.Exited(0, 2048)
+		return []scraper.Lead{
+			{Title: "Acme Plumbing", Latitude: 53.8, Longitude: -1.55},
+			{Title: "Best Boilers", Latitude: 53.8, Longitude: -1.55},
+		}, nil
+	}})
+	leadProviders.Register(funcProvider{info: scraper.Info{ID: "crashing", Name: "Crashing"}, search: func(ctx context.Context, q scraper.Query) ([]scraper.Lead, error) {
+		q.Log.Exited(2, 17)
+		return nil, errors.New("scraper exited with status 2")
+	}})
+	t.Cleanup(func() { leadProviders.Unregister("binary"); leadProviders.Unregister("crashing") })
+
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	before := time.Now().Add(-time.Second)
+
+	search := runTestSearchOn(t, r, token, "binary")
+	m := search.Metrics
+	if search.Status != "Completed" || m.StartedAt == nil || m.FinishedAt == nil || m.StartedAt.Before(before) || m.FinishedAt.Before(*m.StartedAt) {
+		t.Fatalf("completed search: status %q, metrics %+v", search.Status, m)
+	}
+	if m.DurationSeconds == nil || *m.DurationSeconds < 0 || m.IngestSeconds == nil || m.LeadsPerSecond == nil {
+		t.Errorf("timings %+v", m)
+	}
+	if m.ExitCode == nil || *m.ExitCode != 0 || m.OutputBytes == nil || *m.OutputBytes != 2048 {
+		t.Errorf("process metrics %+v", m)
+	}
+
+	failed := runTestSearchOn(t, r, token, "crashing")
+	if m := failed.Metrics; failed.Status != "Failed" || m.FinishedAt == nil || m.ExitCode == nil || *m.ExitCode != 2 || m.OutputBytes == nil || *m.OutputBytes != 17 {
+		t.Errorf("failed search: status %q, metrics %+v", failed.Status, m)
+	}
+
+	// Sources that don't run a process have no exit code or output size.
+	stub := runTestSearch(t, r, token, []scraper.Lead{{Title: "Acme Plumbing", Latitude: 53.8, Longitude: -1.55}})
+	if m := stub.Metrics; m.ExitCode != nil || m.OutputBytes != nil || m.FinishedAt == nil {
+		t.Errorf("stub search metrics %+v", m)
+	}
+}
+
+func TestSearchLogsExplainWhatHappened(t *testing.T) {
+	leadProviders.Register(funcProvider{info: scraper.Info{ID: "crashing", Name: "Crashing"}, search: func(ctx context.Context, q scraper.Query) ([]scraper.Lead, error) {
+		q.Log.Output("panic: browser did not start")
+		return nil, errors.New("exit status 2")
+	}})
+	leadProviders.Register(funcProvider{info: scraper.Info{ID: "chatty", Name: "Chatty"}, search: func(ctx context.Context, q scraper.Query) ([]scraper.Lead, error) {
+		for i := 1; i <= 50; i++ {
+			q.Log.Output(fmt.Sprintf("scraped page %d", i))
+		}
+		return []scraper.Lead{{Title: "Acme Plumbing", Latitude: 53.8, Longitude: -1.55}}, nil
+	}})
+	t.Cleanup(func() { leadProviders.Unregister("crashing"); leadProviders.Unregister("chatty") })
+
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	logOf := func(searchID string) searches.Log {
+		t.Helper()
+		var l searches.Log
+		w := doRequest(r, "GET", "/api/searches/"+searchID+"/logs", token, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &l); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("logs: %d %s", w.Code, w.Body)
+		}
+		return l
+	}
+
+	failed := runTestSearchOn(t, r, token, "crashing")
+	l := logOf(failed.ID)
+	for _, want := range []string{"Starting crashing search", "panic: browser did not start\n", "Lead provider crashing failed for search " + failed.ID + ": exit status 2"} {
+		if !strings.Contains(l.Output, want) {
+			t.Errorf("failed search log is missing %q:\n%s", want, l.Output)
+		}
+	}
+	if l.Truncated || l.UpdatedAt == nil {
+		t.Errorf("failed search log: truncated %v, updated %v", l.Truncated, l.UpdatedAt)
+	}
+
+	// Only the end of a long log is kept.
+	prevMax := searchLogMaxBytes
+	searchLogMaxBytes = 300
+	t.Cleanup(func() { searchLogMaxBytes = prevMax })
+	chatty := runTestSearchOn(t, r, token, "chatty")
+	l = logOf(chatty.ID)
+	if !l.Truncated || len(l.Output) > 300 || strings.Contains(l.Output, "scraped page 1\n") || !strings.Contains(l.Output, "Successfully processed and stored 1 leads") {
+		t.Errorf("long log: truncated %v, %d bytes:\n%s", l.Truncated, len(l.Output), l.Output)
+	}
+
+	bob, _ := registerTestUser(t, r, "bob@example.com")
+	if w := doRequest(r, "GET", "/api/searches/"+failed.ID+"/logs", bob, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another tenant's search log: got %d, want 404", w.Code)
+	}
+}
+
+// rejectLeadsNamed makes storing any lead whose name starts with prefix
+// fail, as a row the database won't take would.
+func rejectLeadsNamed(t *testing.T, prefix string) {
+	t.Helper()
+	_, err := db.Exec(`CREATE TRIGGER reject_test_leads BEFORE INSERT ON leads WHEN NEW.company_name LIKE '` + prefix + `%'
+        BEGIN SELECT RAISE(ABORT, 'rejected by test'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestionSkipsBadRows(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	rejectLeadsNamed(t, "Bad")
+	lead := func(name string) scraper.Lead {
+		return scraper.Lead{Title: name, Latitude: 53.8, Longitude: -1.55}
+	}
+
+	search := runTestSearch(t, r, token, []scraper.Lead{lead("Acme Plumbing"), lead("Bad Row"), lead("Best Boilers"), lead("Bad Again"), lead("Cosy Heating")})
+	if search.Status != "Completed with warnings" || search.LeadsFound != 3 || search.ErrorCount != 2 {
+		t.Fatalf("search: status %q, %d leads, %d errors", search.Status, search.LeadsFound, search.ErrorCount)
+	}
+	if len(search.ErrorSamples) != 2 || !strings.HasPrefix(search.ErrorSamples[0], `"Bad Row": `) || !strings.Contains(search.ErrorSamples[0], "rejected by test") {
+		t.Errorf("error samples %q", search.ErrorSamples)
+	}
+	var names []string
+	for _, l := range testLeads(t, r, token, search.ID, "") {
+		names = append(names, l.CompanyName)
+	}
+	sort.Strings(names)
+	if want := []string{"Acme Plumbing", "Best Boilers", "Cosy Heating"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("stored %v, want %v", names, want)
+	}
+	var l searches.Log
+	json.Unmarshal(doRequest(r, "GET", "/api/searches/"+search.ID+"/logs", token, nil).Body.Bytes(), &l)
+	if !strings.Contains(l.Output, "Skipped 2 leads") {
+		t.Errorf("log doesn't mention the skipped leads:\n%s", l.Output)
+	}
+
+	// Only the first few errors are kept.
+	var bad []scraper.Lead
+	for i := 0; i < SEARCH_ERROR_SAMPLES+3; i++ {
+		bad = append(bad, lead(fmt.Sprintf("Bad %d", i)))
+	}
+	failed := runTestSearch(t, r, token, bad)
+	if failed.Status != "Failed" || failed.LeadsFound != 0 || failed.ErrorCount != len(bad) || len(failed.ErrorSamples) != SEARCH_ERROR_SAMPLES {
+		t.Errorf("all rows bad: status %q, %d leads, %d errors, %d samples", failed.Status, failed.LeadsFound, failed.ErrorCount, len(failed.ErrorSamples))
+	}
+}
+
+func TestIngestionInsertsLeadsInBatches(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	lead := func(i int, name string) scraper.Lead {
+		return scraper.Lead{
+			Title: name, Phone: fmt.Sprintf("0113 496 %04d", i), Emails: []string{fmt.Sprintf("lead%d@example.test", i)},
+			Latitude: 53.8, Longitude: -1.55,
+		}
+	}
+
+	// A large scrape goes in with the default batch size.
+	var many []scraper.Lead
+	for i := 0; i < 1200; i++ {
+		many = append(many, lead(i, fmt.Sprintf("Plumber %d", i)))
+	}
+	search := runTestSearch(t, r, token, many)
+	if m := search.Metrics; search.Status != "Completed" || search.LeadsFound != len(many) || m.IngestSeconds == nil || m.LeadsPerSecond == nil || *m.LeadsPerSecond <= 0 {
+		t.Fatalf("large scrape: status %q, %d leads, metrics %+v", search.Status, search.LeadsFound, m)
+	}
+	var l searches.Log
+	json.Unmarshal(doRequest(r, "GET", "/api/searches/"+search.ID+"/logs", token, nil).Body.Bytes(), &l)
+	if !regexp.MustCompile(`stored 1200 leads for search \S+ in [0-9.]+s \([0-9]+ leads/s\)`).MatchString(l.Output) {
+		t.Errorf("log doesn't report throughput:\n%s", l.Output)
+	}
+
+	// A batch with a bad row is retried a row at a time, and every lead
+	// keeps its own contacts.
+	prevSize := leadInsertBatchSize
+	leadInsertBatchSize = 2
+	t.Cleanup(func() { leadInsertBatchSize = prevSize })
+	rejectLeadsNamed(t, "Bad")
+	few := []scraper.Lead{lead(0, "Lead 0"), lead(1, "Lead 1"), lead(2, "Lead 2"), lead(3, "Bad 3"), lead(4, "Lead 4")}
+	search = runTestSearch(t, r, token, few)
+	if search.LeadsFound != 4 || search.ErrorCount != 1 {
+		t.Fatalf("small batches: %d leads, %d errors", search.LeadsFound, search.ErrorCount)
+	}
+	stored := testLeads(t, r, token, search.ID, "")
+	if len(stored) != 4 {
+		t.Fatalf("%d leads stored, want 4", len(stored))
+	}
+	for _, got := range stored {
+		var i int
+		fmt.Sscanf(got.CompanyName, "Lead %d", &i)
+		want := lead(i, got.CompanyName)
+		if got.Phone != want.Phone || len(got.Emails) != 1 || got.Emails[0].Email != want.Emails[0] || len(got.Phones) != 1 || got.Phones[0].Phone != want.Phone {
+			t.Errorf("%s: phone %q, emails %+v, phones %+v", got.CompanyName, got.Phone, got.Emails, got.Phones)
+		}
+	}
+}
+
+func TestBuiltInTLSServesTheAPIOverHTTPS(t *testing.T) {
+	t.Setenv("TLS_DOMAINS", "")
+	if autocertManager() != nil {
+		t.Fatal("without TLS_DOMAINS the server should leave TLS to a proxy")
+	}
+	cacheDir := t.TempDir()
+	t.Setenv("TLS_DOMAINS", " Leads.Example.com, ,api.example.com")
+	t.Setenv("TLS_CACHE_DIR", cacheDir)
+	m := autocertManager()
+	if m == nil {
+		t.Fatal("TLS_DOMAINS should turn on built-in TLS")
+	}
+	for host, allowed := range map[string]bool{"leads.example.com": true, "api.example.com": true, "other.example.com": false} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != allowed {
+			t.Errorf("host policy for %s: %v", host, err)
+		}
+	}
+
+	// A certificate already in the cache is served without asking Let's
+	// Encrypt for one.
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "leads.example.com"},
+		DNSNames:     []string{"leads.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	cached := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(filepath.Join(cacheDir, "leads.example.com"), cached, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	srv := httptest.NewUnstartedServer(r)
+	srv.TLS = m.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	leaf, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "leads.example.com"}}}
+	req, _ := http.NewRequest("GET", srv.URL+"/api/settings", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("HTTPS request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "leads.example.com" {
+		t.Errorf("HTTPS request: %d, tls %v", resp.StatusCode, resp.TLS != nil)
+	}
+
+	// Plain HTTP only redirects to HTTPS.
+	w := httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "http://leads.example.com/api/settings", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://leads.example.com/api/settings" {
+		t.Errorf("plain HTTP: %d to %q, want a redirect to HTTPS", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestResponsesAreCompressedAndTrimmed(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "alice@example.com")
+	var found []scraper.Lead
+	for i := 0; i < 20; i++ {
+		found = append(found, scraper.Lead{Title: fmt.Sprintf("Plumber %d", i), Phone: fmt.Sprintf("0113 496 %04d", i), Category: "Plumber", Latitude: 53.8, Longitude: -1.55})
+	}
+	search := runTestSearch(t, r, token, found)
+	if w := doRequest(r, "POST", "/api/crm/leads", token, testLeads(t, r, token, search.ID, "")); w.Code != http.StatusOK {
+		t.Fatalf("add to CRM: %d %s", w.Code, w.Body)
+	}
+	gzipped := map[string]string{"Accept-Encoding": "gzip, deflate"}
+
+	leadsPath := "/api/leads/" + search.ID
+	plain := doRequest(r, "GET", leadsPath, token, nil)
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Errorf("compressed for a client that didn't ask: %q", plain.Header().Get("Content-Encoding"))
+	}
+	w := doRequestWithHeaders(r, "GET", leadsPath, token, nil, gzipped)
+	if w.Header().Get("Content-Encoding") != "gzip" || !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") || w.Body.Len() >= plain.Body.Len() {
+		t.Fatalf("gzip: encoding %q, vary %q, %d bytes vs %d", w.Header().Get("Content-Encoding"), w.Header().Get("Vary"), w.Body.Len(), plain.Body.Len())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped, _ := io.ReadAll(zr)
+	if !bytes.Equal(unzipped, plain.Body.Bytes()) {
+		t.Error("gzipped body differs from the plain one")
+	}
+	if w := doRequestWithHeaders(r, "GET", "/api/reports/pipeline.pdf", token, nil, gzipped); w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(w.Body.String(), "%PDF-") {
+		t.Errorf("a PDF was compressed again: %q", w.Header().Get("Content-Encoding"))
+	}
+
+	keysOf := func(v map[string]json.RawMessage) []string {
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	var trimmed []map[string]json.RawMessage
+	w = doRequest(r, "GET", leadsPath+"?fields=companyName,phone", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &trimmed)
+	if len(trimmed) != len(found) || !reflect.DeepEqual(keysOf(trimmed[0]), []string{"companyName", "id", "phone"}) {
+		t.Fatalf("trimmed leads: %s", w.Body)
+	}
+	if w.Body.Len()*2 > plain.Body.Len() {
+		t.Errorf("trimmed leads are %d bytes, full ones %d", w.Body.Len(), plain.Body.Len())
+	}
+
+	var board struct {
+		Leads map[string]map[string]json.RawMessage
+	}
+	json.Unmarshal(doRequest(r, "GET", "/api/crm?fields=companyName", token, nil).Body.Bytes(), &board)
+	if len(board.Leads) != len(found) {
+		t.Fatalf("trimmed board has %d cards", len(board.Leads))
+	}
+	for _, card := range board.Leads {
+		if !reflect.DeepEqual(keysOf(card), []string{"companyName", "id"}) {
+			t.Errorf("trimmed card has %v", keysOf(card))
+			break
+		}
+	}
+
+	for _, path := range []string{leadsPath + "?fields=companyName,password", "/api/crm?fields=secret"} {
+		if w := doRequest(r, "GET", path, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", path, w.Code)
+		}
+	}
+}
+
+func TestFeatureFlagsRollOutPerUser(t *testing.T) {
+	r := setupTestServer(t)
+	_, admin := registerTestUser(t, r, "alice@example.com")
+	bobToken, bob := registerTestUser(t, r, "bob@example.com")
+	if _, err := db.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", admin.tenant.UserID); err != nil {
+		t.Fatal(err)
+	}
+	w := doRequest(r, "POST", "/login", "", gin.H{"email": "alice@example.com", "password": "Password123!"})
+	var login struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &login)
+
+	features := func(token string) map[string]bool {
+		var me struct{ Features map[string]bool }
+		json.Unmarshal(doRequest(r, "GET", "/api/me", token, nil).Body.Bytes(), &me)
+		return me.Features
+	}
+	if w := doRequest(r, "PUT", "/api/admin/features/sequences", bobToken, gin.H{"enabled": true}); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admin set a flag: %d", w.Code)
+	}
+	if w := doRequest(r, "PUT", "/api/admin/features/sequences", login.Token, gin.H{"description": "Email sequences"}); w.Code != http.StatusNoContent {
+		t.Fatalf("create flag: %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, "PUT", fmt.Sprintf("/api/admin/features/sequences/users/%d", bob.tenant.UserID), login.Token, gin.H{"enabled": true}); w.Code != http.StatusNoContent {
+		t.Fatalf("enable for bob: %d %s", w.Code, w.Body)
+	}
+	if got := features(bobToken); !got["sequences"] {
+		t.Errorf("bob's features %v, want sequences on", got)
+	}
+	if got := features(login.Token); got["sequences"] {
+		t.Errorf("alice's features %v, want sequences off", got)
+	}
+
+	doRequest(r, "PUT", "/api/admin/features/sequences", login.Token, gin.H{"rolloutPercent": 100})
+	if on, err := featureEnabled(context.Background(), "sequences", admin.tenant.UserID); err != nil || !on {
+		t.Errorf("at 100%% rollout: %v (err %v), want on", on, err)
+	}
+	if on, _ := featureEnabled(context.Background(), "dialer-mode", bob.tenant.UserID); on {
+		t.Error("a flag that doesn't exist is on")
+	}
+}
+
+func TestAdminRoutesIgnoreTokenClaims(t *testing.T) {
+	r := setupTestServer(t)
+	_, alice := registerTestUser(t, r, "alice@example.com")
+	_, bob := registerTestUser(t, r, "bob@example.com")
+	sign := func(claims jwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(JWT_SECRET)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	forged := sign(jwt.MapClaims{"user_id": alice.tenant.UserID, "admin": true})
+	if w := doRequest(r, "GET", "/api/admin/users", forged, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("admin claim without the role: %d, want 403", w.Code)
+	}
+
+	if _, err := db.Exec("UPDATE users SET is_admin = 1 WHERE id IN (?, ?)", alice.tenant.UserID, bob.tenant.UserID); err != nil {
+		t.Fatal(err)
+	}
+	plain := sign(jwt.MapClaims{"user_id": alice.tenant.UserID})
+	if w := doRequest(r, "GET", "/api/admin/users", plain, nil); w.Code != http.StatusOK {
+		t.Fatalf("admin without a claim: %d %s, want 200", w.Code, w.Body)
+	}
+	impersonating := sign(jwt.MapClaims{"user_id": bob.tenant.UserID, "impersonated_by": alice.tenant.UserID})
+	if w := doRequest(r, "GET", "/api/admin/users", impersonating, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("impersonating an admin: %d, want 403", w.Code)
+	}
+
+	if _, err := db.Exec("UPDATE users SET is_admin = 0 WHERE id = ?", alice.tenant.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, "GET", "/api/admin/users", plain, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("revoked admin: %d, want 403", w.Code)
+	}
+}
+
+func TestAdminActionsRevokeSessions(t *testing.T) {
+	r := setupTestServer(t)
+	adminToken, admin := registerTestUser(t, r, "alice@example.com")
+	bobToken, bob := registerTestUser(t, r, "bob@example.com")
+	if _, err := db.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", admin.tenant.UserID); err != nil {
+		t.Fatal(err)
+	}
+	userPath := fmt.Sprintf("/api/admin/users/%d", bob.tenant.UserID)
+	signedIn := func(token string) bool {
+		t.Helper()
+		return doRequest(r, "GET", "/api/me", token, nil).Code == http.StatusOK
+	}
+	login := func(password string) string {
+		t.Helper()
+		w := doRequest(r, "POST", "/login", "", gin.H{"email": "bob@example.com", "password": password})
+		var resp struct{ Token string }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login: got %d %s", w.Code, w.Body)
+		}
+		return resp.Token
+	}
+
+	w := doRequest(r, "POST", userPath+"/impersonate", adminToken, nil)
+	var imp struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &imp)
+	if w.Code != http.StatusOK || !signedIn(imp.Token) {
+		t.Fatalf("impersonate: got %d %s", w.Code, w.Body)
+	}
+
+	// A password reset signs the user out everywhere, the admin's
+	// impersonation included.
+	if w := doRequest(r, "POST", userPath+"/password", adminToken, gin.H{"password": "NewPassword456!"}); w.Code != http.StatusNoContent {
+		t.Fatalf("reset password: got %d %s", w.Code, w.Body)
+	}
+	if signedIn(bobToken) {
+		t.Error("a session from before the password reset still works")
+	}
+	if signedIn(imp.Token) {
+		t.Error("an impersonation from before the password reset still works")
+	}
+	bobToken = login("NewPassword456!")
+	if !signedIn(bobToken) {
+		t.Fatal("a session from the new password doesn't work")
+	}
+
+	// Enabling the account again doesn't bring its old sessions back.
+	if w := doRequest(r, "POST", userPath+"/disable", adminToken, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("disable: got %d %s", w.Code, w.Body)
+	}
+	if signedIn(bobToken) {
+		t.Error("a disabled user's session still works")
+	}
+	if w := doRequest(r, "POST", userPath+"/enable", adminToken, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("enable: got %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, "GET", "/api/me", bobToken, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("a session from before the account was disabled: got %d, want 401", w.Code)
+	}
+	if !signedIn(login("NewPassword456!")) {
+		t.Error("signing in again after being enabled doesn't work")
+	}
+}
+
+func TestStripeWebhookMovesThePlan(t *testing.T) {
+	r := setupTestServer(t)
+	prevSecret := stripeWebhookSecret
+	stripeWebhookSecret = "whsec_test"
+	t.Cleanup(func() { stripeWebhookSecret = prevSecret })
+	if _, err := db.Exec("UPDATE plans SET stripe_price_id = 'price_' || id WHERE id != ?", FREE_PLAN); err != nil {
+		t.Fatal(err)
+	}
+	token, alice := registerTestUser(t, r, "alice@example.com")
+
+	sign := func(secret string, at time.Time, payload []byte) string {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(payload)
+		return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	send := func(signature string, payload []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/stripe/webhook", bytes.NewReader(payload))
+		req.Header.Set("Stripe-Signature", signature)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	event := func(id, typ, price string) []byte {
+		payload, _ := json.Marshal(gin.H{"id": id, "type": typ, "data": gin.H{"object": gin.H{
+			"id": "sub_1", "customer": "cus_1", "status": "active",
+			"metadata": gin.H{"user_id": strconv.FormatInt(alice.tenant.UserID, 10)},
+			"items":    gin.H{"data": []gin.H{{"price": gin.H{"id": price}}}},
+		}}})
+		return payload
+	}
+	deliver := func(payload []byte) *httptest.ResponseRecorder {
+		return send(sign("whsec_test", time.Now(), payload), payload)
+	}
+	plan := func() (string, string) {
+		w := doRequest(r, "GET", "/api/me", token, nil)
+		var me struct {
+			Plan struct {
+				ID string `json:"id"`
+			} `json:"plan"`
+			SubscriptionStatus string `json:"subscriptionStatus"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil {
+			t.Fatal(err)
+		}
+		return me.Plan.ID, me.SubscriptionStatus
+	}
+
+	created := event("evt_1", "customer.subscription.created", "price_pro")
+	for name, signature := range map[string]string{
+		"wrong secret": sign("whsec_other", time.Now(), created),
+		"expired":      sign("whsec_test", time.Now().Add(-2*STRIPE_WEBHOOK_TOLERANCE), created),
+		"unsigned":     "",
+	} {
+		if w := send(signature, created); w.Code != http.StatusBadRequest {
+			t.Errorf("%s signature: %d, want 400", name, w.Code)
+		}
+	}
+	if id, _ := plan(); id != FREE_PLAN {
+		t.Fatalf("plan after rejected events = %q, want free", id)
+	}
+
+	if w := deliver(created); w.Code != http.StatusOK {
+		t.Fatalf("created: %d %s", w.Code, w.Body)
+	}
+	if id, status := plan(); id != "pro" || status != "active" {
+		t.Fatalf("plan after created = %q (%q), want pro", id, status)
+	}
+	if w := deliver(event("evt_2", "customer.subscription.updated", "price_agency")); w.Code != http.StatusOK {
+		t.Fatalf("updated: %d %s", w.Code, w.Body)
+	}
+	if id, _ := plan(); id != "agency" {
+		t.Fatalf("plan after updated = %q, want agency", id)
+	}
+
+	// A replayed event, freshly signed or not, changes nothing.
+	if w := deliver(created); w.Code != http.StatusOK {
+		t.Fatalf("replayed event: %d, want 200", w.Code)
+	}
+	if id, _ := plan(); id != "agency" {
+		t.Fatalf("plan after replayed created = %q, want agency", id)
+	}
+
+	// An event that fails is applied when Stripe retries it.
+	downgrade := event("evt_3", "customer.subscription.updated", "price_unknown")
+	if w := deliver(downgrade); w.Code != http.StatusInternalServerError {
+		t.Fatalf("unknown price: %d, want 500", w.Code)
+	}
+	if _, err := db.Exec("UPDATE plans SET stripe_price_id = 'price_unknown' WHERE id = 'pro'"); err != nil {
+		t.Fatal(err)
+	}
+	if w := deliver(downgrade); w.Code != http.StatusOK {
+		t.Fatalf("retried event: %d %s", w.Code, w.Body)
+	}
+	if id, _ := plan(); id != "pro" {
+		t.Fatalf("plan after retried event = %q, want pro", id)
+	}
+
+	if w := deliver(event("evt_4", "customer.subscription.deleted", "price_unknown")); w.Code != http.StatusOK {
+		t.Fatalf("deleted: %d %s", w.Code, w.Body)
+	}
+	if id, status := plan(); id != FREE_PLAN || status != "canceled" {
+		t.Fatalf("plan after deleted = %q (%q), want free and canceled", id, status)
+	}
+}
+
+func TestErrorsAreLocalized(t *testing.T) {
+	r := setupTestServer(t)
+	send := func(method, path, lang string, body interface{}) map[string]interface{} {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(body)
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var payload map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &payload); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, w.Body)
+		}
+		return payload
+	}
+
+	got := send("POST", "/register", "de-CH, de;q=0.9, en;q=0.8", gin.H{"name": "Ann", "email": "ann@example.com", "password": "short"})
+	if got["code"] != "invalid_fields" || got["error"] != "Einige Felder sind ungültig" {
+		t.Errorf("register in German: %v", got)
+	}
+	fields, _ := got["fields"].(map[string]interface{})
+	codes, _ := got["fieldCodes"].(map[string]interface{})
+	if fields["password"] != "muss mindestens 8 Zeichen lang sein" || codes["password"] != "password_too_short" {
+		t.Errorf("password field in German: %v, %v", fields, codes)
+	}
+
+	got = send("GET", "/api/searches", "fr, es;q=0.5", nil)
+	if got["code"] != "auth_required" || got["error"] != "Se requiere la cabecera Authorization" {
+		t.Errorf("unauthorized in Spanish: %v", got)
+	}
+	got = send("GET", "/api/searches", "", nil)
+	if got["code"] != "auth_required" || got["error"] != "Authorization header required" {
+		t.Errorf("unauthorized without a language: %v", got)
+	}
+}
+
+func TestTemplatePreviewListsMissingVariables(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	_, leadID := createTestLead(t, repo)
+
+	w := doRequest(r, "POST", "/api/templates", token, gin.H{
+		"name": "Intro", "channel": "email",
+		"subject": "Quick question for {{companyName}}",
+		"body":    "Hi {{companyName}}, your {{rating}} stars caught my eye. {{tech|Your site}} could be faster.",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create template: %d %s", w.Code, w.Body)
+	}
+	var tpl MessageTemplate
+	json.Unmarshal(w.Body.Bytes(), &tpl)
+
+	w = doRequest(r, "POST", "/api/templates", token, gin.H{"name": "Bad", "channel": "sms", "body": "Hi {{nickname}}"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown variable: expected 400, got %d %s", w.Code, w.Body)
+	}
+
+	w = doRequest(r, "POST", "/api/templates/"+tpl.ID+"/preview", token, gin.H{"leadId": leadID})
+	if w.Code != http.StatusOK {
+		t.Fatalf("preview: %d %s", w.Code, w.Body)
+	}
+	var preview TemplatePreview
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if preview.Subject != "Quick question for Acme Plumbing" {
+		t.Errorf("subject = %q", preview.Subject)
+	}
+	if !strings.Contains(preview.Body, "Your site could be faster") {
+		t.Errorf("fallback not used: %q", preview.Body)
+	}
+	if len(preview.Missing) != 1 || preview.Missing[0] != "rating" {
+		t.Errorf("missing = %v, want [rating]", preview.Missing)
+	}
+
+	otherToken, _ := registerTestUser(t, r, "other@example.com")
+	if w := doRequest(r, "POST", "/api/templates/"+tpl.ID+"/preview", otherToken, gin.H{"leadId": leadID}); w.Code != http.StatusNotFound {
+		t.Errorf("other tenant's preview: expected 404, got %d", w.Code)
+	}
+
+	if w := doRequest(r, "POST", "/api/templates/"+tpl.ID+"/test-send", token, gin.H{"leadId": leadID}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("test send without SMTP: expected 503, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUnsubscribeLinkSuppressesAddress(t *testing.T) {
+	r := setupTestServer(t)
+	_, repo := registerTestUser(t, r, "rep@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Email: "owner@acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	tpl := MessageTemplate{ID: uuid.New().String(), Name: "Intro", Channel: TEMPLATE_EMAIL, Subject: "Hello", Body: "Hi", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := repo.CreateMessageTemplate(tpl); err != nil {
+		t.Fatal(err)
+	}
+	start := func() Campaign {
+		id := uuid.New().String()
+		if err := repo.CreateCampaign(id, campaignInput{Name: "Spring", TemplateID: tpl.ID, HourlyLimit: 50}); err != nil {
+			t.Fatal(err)
+		}
+		campaign, err := repo.Campaign(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := startCampaign(repo, campaign, tpl); err != nil {
+			t.Fatal(err)
+		}
+		return campaign
+	}
+	campaign := start()
+	recipients, err := repo.CampaignRecipients(campaign.ID, "", 10, 0)
+	if err != nil || len(recipients) != 1 {
+		t.Fatalf("recipients %+v (err %v)", recipients, err)
+	}
+	link := "/u/" + recipients[0].unsubscribeToken
+
+	if w := doRequest(r, "GET", "/u/not-a-token", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown token: expected 404, got %d", w.Code)
+	}
+	w := doRequest(r, "GET", link, "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "owner@acme.test") {
+		t.Fatalf("confirmation page: %d %s", w.Code, w.Body)
+	}
+	suppressions, _ := loadSuppressions(db, repo.Tenant().OrgID)
+	if suppressions.has(SUPPRESS_EMAIL, "owner@acme.test") {
+		t.Fatal("opening the link unsubscribed without confirmation")
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := doRequest(r, "POST", link, "", nil); w.Code != http.StatusOK {
+			t.Fatalf("unsubscribe: %d %s", w.Code, w.Body)
+		}
+	}
+	suppressions, _ = loadSuppressions(db, repo.Tenant().OrgID)
+	if !suppressions.has(SUPPRESS_EMAIL, "owner@acme.test") {
+		t.Error("unsubscribed address isn't suppressed")
+	}
+	if recipients, _ := repo.CampaignRecipients(campaign.ID, "", 10, 0); recipients[0].Status != RECIPIENT_EXCLUDED || recipients[0].UnsubscribedAt == nil {
+		t.Errorf("recipient after unsubscribing: %+v", recipients[0])
+	}
+
+	next := start()
+	if recipients, _ := repo.CampaignRecipients(next.ID, "", 10, 0); recipients[0].Reason != EXCLUDED_SUPPRESSED {
+		t.Errorf("later campaign recipient: %+v", recipients[0])
+	}
+}
+
+func TestBookingPageTakesOneBookingPerSlot(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Email: "owner@acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	w := doRequest(r, "PUT", "/api/booking-page", token, gin.H{
+		"slug": "Rep-Calls", "title": "Intro call", "durationMinutes": 30, "minNoticeHours": 0, "horizonDays": 7, "enabled": true,
+		"availability": gin.H{"monday": []string{"9:00-17:00"}, "tuesday": []string{"9:00-17:00"}, "wednesday": []string{"9:00-17:00"},
+			"thursday": []string{"9:00-17:00"}, "friday": []string{"9:00-17:00"}, "saturday": []string{"9:00-17:00"}, "sunday": []string{"9:00-17:00"}},
+	})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"slug":"rep-calls"`) {
+		t.Fatalf("save page: %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, "GET", "/book/nobody", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown page: expected 404, got %d", w.Code)
+	}
+	w = doRequest(r, "GET", "/book/rep-calls", "", nil)
+	slots := regexp.MustCompile(`name="slot" value="([^"]+)"`).FindAllStringSubmatch(w.Body.String(), -1)
+	if w.Code != http.StatusOK || len(slots) < 2 {
+		t.Fatalf("booking page: %d with %d slots", w.Code, len(slots))
+	}
+
+	book := func(slot, email string) *httptest.ResponseRecorder {
+		form := url.Values{"slot": {slot}, "name": {"Pat Owner"}, "email": {email}, "company": {"Acme Plumbing"}}
+		req := httptest.NewRequest("POST", "/book/rep-calls", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := book(slots[0][1], "Owner@Acme.test"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "You're booked") {
+		t.Fatalf("booking: %d %s", w.Code, w.Body)
+	}
+	if w := book(slots[0][1], "someone@else.test"); w.Code != http.StatusConflict {
+		t.Errorf("booking a taken slot: expected 409, got %d", w.Code)
+	}
+	if w := book(slots[1][1], "owner@acme.test"); w.Code != http.StatusConflict {
+		t.Errorf("booking twice from one address: expected 409, got %d", w.Code)
+	}
+
+	w = doRequest(r, "GET", "/api/bookings", token, nil)
+	var bookings []Booking
+	json.Unmarshal(w.Body.Bytes(), &bookings)
+	if len(bookings) != 1 || bookings[0].LeadID != leadID || bookings[0].StartsAt.Format(time.RFC3339) != slots[0][1] {
+		t.Fatalf("bookings = %+v, want one on lead %s at %s", bookings, leadID, slots[0][1])
+	}
+	var logged int
+	db.QueryRow("SELECT COUNT(*) FROM crm_activity WHERE lead_id = ? AND kind = 'meeting_booked'", leadID).Scan(&logged)
+	if logged != 1 {
+		t.Errorf("%d meeting_booked activities, want 1", logged)
+	}
+}
+
+func TestBookingPageChecksCaptchaAndLimitsEachIP(t *testing.T) {
+	r := setupTestServer(t)
+	token, _ := registerTestUser(t, r, "rep@example.com")
+	w := doRequest(r, "PUT", "/api/booking-page", token, gin.H{
+		"slug": "rep-calls", "title": "Intro call", "durationMinutes": 30, "minNoticeHours": 0, "horizonDays": 7, "enabled": true,
+		"availability": gin.H{"monday": []string{"9:00-17:00"}, "tuesday": []string{"9:00-17:00"}, "wednesday": []string{"9:00-17:00"},
+			"thursday": []string{"9:00-17:00"}, "friday": []string{"9:00-17:00"}, "saturday": []string{"9:00-17:00"}, "sunday": []string{"9:00-17:00"}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("save page: %d %s", w.Code, w.Body)
+	}
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		json.NewEncoder(w).Encode(gin.H{"success": req.PostForm.Get("response") == "solved"})
+	}))
+	defer verifier.Close()
+	prevProvider, prevSiteKey, prevURL, prevLimit := captchaProvider, captchaSiteKey, captchaVerifyURL, bookingIPLimit
+	captchaProvider, captchaSiteKey, captchaVerifyURL, bookingIPLimit = "turnstile", "site-key", verifier.URL, 3
+	t.Cleanup(func() {
+		captchaProvider, captchaSiteKey, captchaVerifyURL, bookingIPLimit = prevProvider, prevSiteKey, prevURL, prevLimit
+	})
+
+	w = doRequest(r, "GET", "/book/rep-calls", "", nil)
+	if !strings.Contains(w.Body.String(), `class="cf-turnstile" data-sitekey="site-key"`) {
+		t.Fatalf("booking page has no captcha widget: %s", w.Body)
+	}
+	slots := regexp.MustCompile(`name="slot" value="([^"]+)"`).FindAllStringSubmatch(w.Body.String(), -1)
+	if len(slots) < 2 {
+		t.Fatalf("booking page has %d slots", len(slots))
+	}
+	book := func(ip, slot, email, captcha string) *httptest.ResponseRecorder {
+		form := url.Values{"slot": {slot}, "name": {"Pat Owner"}, "email": {email}, "cf-turnstile-response": {captcha}}
+		req := httptest.NewRequest("POST", "/book/rep-calls", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := book("192.0.2.1", slots[0][1], "owner@acme.test", "forged"); w.Code != http.StatusBadRequest {
+		t.Errorf("unsolved captcha: expected 400, got %d", w.Code)
+	}
+	if w := book("192.0.2.1", slots[0][1], "owner@acme.test", "solved"); w.Code != http.StatusOK {
+		t.Fatalf("solved captcha: %d %s", w.Code, w.Body)
+	}
+	if w := book("192.0.2.1", slots[1][1], "other@acme.test", "solved"); w.Code != http.StatusOK {
+		t.Fatalf("second booking: %d %s", w.Code, w.Body)
+	}
+	if w := book("192.0.2.1", slots[1][1], "third@acme.test", "solved"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("over the IP limit: expected 429, got %d", w.Code)
+	}
+	if w := book("198.51.100.7", slots[1][1], "third@acme.test", "solved"); w.Code != http.StatusConflict {
+		t.Errorf("another IP: expected the taken slot's 409, got %d", w.Code)
+	}
+	var bookings int
+	db.QueryRow("SELECT COUNT(*) FROM bookings").Scan(&bookings)
+	if bookings != 2 {
+		t.Errorf("%d bookings, want 2", bookings)
+	}
+}
+
+func TestMeetingsCountInAnalyticsAndFeed(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, err := repo.RecordCall(leadID, "no_answer", "", 30, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	starts := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	w := doRequest(r, "POST", "/api/crm/leads/"+leadID+"/meetings", token, gin.H{
+		"title": "Demo, with Pat", "startsAt": starts, "attendees": []string{"Pat Owner <owner@acme.test>", " "}, "notes": "Bring pricing",
+	})
+	var m Meeting
+	json.Unmarshal(w.Body.Bytes(), &m)
+	if w.Code != http.StatusCreated || m.Outcome != MEETING_SCHEDULED || !m.EndsAt.Equal(starts.Add(30*time.Minute)) || len(m.Attendees) != 1 {
+		t.Fatalf("create meeting: %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, "PUT", "/api/meetings/"+m.ID, token, gin.H{"title": m.Title, "startsAt": starts, "outcome": "maybe"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown outcome: expected 400, got %d", w.Code)
+	}
+	w = doRequest(r, "PUT", "/api/meetings/"+m.ID, token, gin.H{"title": m.Title, "startsAt": starts, "attendees": m.Attendees, "outcome": MEETING_HELD})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"outcome":"held"`) {
+		t.Fatalf("update meeting: %d %s", w.Code, w.Body)
+	}
+	var logged int
+	db.QueryRow("SELECT COUNT(*) FROM crm_activity WHERE lead_id = ? AND kind IN ('meeting_booked', 'meeting_outcome')", leadID).Scan(&logged)
+	if logged != 2 {
+		t.Errorf("%d meeting activities, want 2", logged)
+	}
+
+	w = doRequest(r, "GET", "/api/analytics/meetings", token, nil)
+	var stats struct {
+		Totals MeetingStats `json:"totals"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if stats.Totals.Calls != 4 || stats.Totals.MeetingsBooked != 1 || stats.Totals.Outcomes[MEETING_HELD] != 1 || stats.Totals.CallsPerMeeting != 4 {
+		t.Errorf("meeting analytics = %+v", stats.Totals)
+	}
+
+	if w := doRequest(r, "GET", "/api/calendar-feed", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("feed before turning it on: expected 404, got %d", w.Code)
+	}
+	w = doRequest(r, "POST", "/api/calendar-feed", token, nil)
+	var feed struct {
+		URL string `json:"url"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &feed)
+	path := strings.TrimPrefix(feed.URL, "http://localhost:8080")
+	w = doRequest(r, "GET", path, "", nil)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "UID:meeting-"+m.ID+"@blueleads\r\n") || !strings.Contains(body, `SUMMARY:Demo\, with Pat`) ||
+		!strings.Contains(body, "DTSTART:"+starts.Format("20060102T150405Z")) {
+		t.Fatalf("feed: %d %s", w.Code, body)
+	}
+
+	if w := doRequest(r, "POST", "/api/calendar-feed", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("rotate feed: %d", w.Code)
+	}
+	if w := doRequest(r, "GET", path, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("rotated-out feed: expected 404, got %d", w.Code)
+	}
+	if w := doRequest(r, "DELETE", "/api/meetings/"+m.ID, token, nil); w.Code != http.StatusNoContent {
+		t.Errorf("delete meeting: %d", w.Code)
+	}
+}
+
+func TestTodayTasksListOpenTasksDueByToday(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, outsider := registerTestUser(t, r, "other@example.com")
+
+	// Dates in UTC, the default timezone, so they can't straddle midnight
+	// differently here and in the handler.
+	today := time.Now().UTC()
+	create := func(body gin.H) Task {
+		t.Helper()
+		w := doRequest(r, "POST", "/api/tasks", token, body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create task %v: %d %s", body, w.Code, w.Body)
+		}
+		var task Task
+		json.Unmarshal(w.Body.Bytes(), &task)
+		return task
+	}
+	overdue := create(gin.H{"title": "Send proposal", "leadId": leadID, "dueDate": today.AddDate(0, 0, -1).Format("2006-01-02")})
+	create(gin.H{"title": "Check new site", "dueDate": today.AddDate(0, 0, 1).Format("2006-01-02")})
+	create(gin.H{"title": "Already done", "dueDate": today.Format("2006-01-02"), "done": true})
+	create(gin.H{"title": "Someday"})
+
+	if w := doRequest(r, "POST", "/api/tasks", token, gin.H{"title": "Not theirs", "assignee": outsider.Tenant().UserID}); w.Code != http.StatusBadRequest {
+		t.Errorf("assigning outside the team: expected 400, got %d", w.Code)
+	}
+
+	w := doRequest(r, "GET", "/api/tasks/today", token, nil)
+	var day struct {
+		Overdue int    `json:"overdue"`
+		Tasks   []Task `json:"tasks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &day)
+	if w.Code != http.StatusOK || day.Overdue != 1 || len(day.Tasks) != 1 || day.Tasks[0].ID != overdue.ID {
+		t.Fatalf("today: %d %s", w.Code, w.Body)
+	}
+
+	w = doRequest(r, "PUT", "/api/tasks/"+overdue.ID, token, gin.H{"title": overdue.Title, "leadId": leadID, "dueDate": overdue.DueDate, "done": true})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"done":true`) {
+		t.Fatalf("complete task: %d %s", w.Code, w.Body)
+	}
+	var logged int
+	db.QueryRow("SELECT COUNT(*) FROM crm_activity WHERE lead_id = ? AND kind = 'task_completed'", leadID).Scan(&logged)
+	if logged != 1 {
+		t.Errorf("%d task_completed activities, want 1", logged)
+	}
+	w = doRequest(r, "GET", "/api/crm/leads/"+leadID+"/tasks", token, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), overdue.ID) {
+		t.Errorf("lead tasks: %d %s", w.Code, w.Body)
+	}
+	w = doRequest(r, "GET", "/api/tasks/today", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &day)
+	if len(day.Tasks) != 0 {
+		t.Errorf("today after completing: %s", w.Body)
+	}
+}
+
+func TestCrmBoardGroupsIntoSwimlanes(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	_, tagged := createTestLead(t, repo)
+	_, untagged := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: tagged, CompanyName: "Acme Plumbing"}, {ID: untagged, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AddCrmTag(tagged, "roofers", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := doRequest(r, "GET", "/api/crm?lanes=colour", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown grouping: expected 400, got %d", w.Code)
+	}
+	var board struct {
+		ColumnOrder []string  `json:"columnOrder"`
+		Lanes       []crmLane `json:"lanes"`
+	}
+	w := doRequest(r, "GET", "/api/crm?lanes=tag", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &board)
+	first := board.ColumnOrder[0]
+	if w.Code != http.StatusOK || len(board.Lanes) != 2 || board.Lanes[0].ID != "roofers" || board.Lanes[1].ID != "" ||
+		len(board.Lanes[0].Columns[first]) != 1 || board.Lanes[0].Columns[first][0] != tagged || board.Lanes[1].Columns[first][0] != untagged {
+		t.Fatalf("tag lanes: %d %s", w.Code, w.Body)
+	}
+	w = doRequest(r, "GET", "/api/crm?lanes=assignee", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &board)
+	if len(board.Lanes) != 1 || board.Lanes[0].ID != strconv.FormatInt(repo.Tenant().UserID, 10) || len(board.Lanes[0].Columns[first]) != 2 {
+		t.Fatalf("assignee lanes: %s", w.Body)
+	}
+}
+
+func TestSavedViewAppliesToLeadsListAndBoard(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	searchID, manchester := createTestLead(t, repo)
+	leeds := uuid.New().String()
+	if _, err := db.Exec("INSERT INTO leads (id, search_id, company_name, address) VALUES (?, ?, 'Leeds Plumbing', '1 Park Row, Leeds')", leeds, searchID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE leads SET address = '2 Deansgate, Manchester' WHERE id = ?", manchester); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: manchester, CompanyName: "Acme Plumbing"}, {ID: leeds, CompanyName: "Leeds Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := doRequest(r, "POST", "/api/views", token, map[string]interface{}{"name": "Bad", "filters": map[string]string{"colour": "blue"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown filter: expected 400, got %d", w.Code)
+	}
+	if w := doRequest(r, "POST", "/api/views", token, map[string]interface{}{"name": "Bad", "filters": map[string]string{"called": "sometimes"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad filter value: expected 400, got %d", w.Code)
+	}
+	w := doRequest(r, "POST", "/api/views", token, map[string]interface{}{
+		"name": "No website, Manchester, not called yet", "filters": map[string]string{"hasWebsite": "false", "address": "manchester", "called": "false"},
+	})
+	var view SavedView
+	json.Unmarshal(w.Body.Bytes(), &view)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create view: %d %s", w.Code, w.Body)
+	}
+
+	var found []leads.Lead
+	w = doRequest(r, "GET", "/api/leads/"+searchID+"?view="+view.ID, token, nil)
+	json.Unmarshal(w.Body.Bytes(), &found)
+	if w.Code != http.StatusOK || len(found) != 1 || found[0].ID != manchester {
+		t.Fatalf("leads through the view: %d %s", w.Code, w.Body)
+	}
+	w = doRequest(r, "GET", "/api/leads/"+searchID+"?view="+view.ID+"&address=leeds", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &found)
+	if len(found) != 1 || found[0].ID != leeds {
+		t.Fatalf("a filter given alongside should override the view's: %s", w.Body)
+	}
+
+	var board struct {
+		Leads map[string]CrmLead `json:"leads"`
+	}
+	w = doRequest(r, "GET", "/api/crm?view="+view.ID, token, nil)
+	json.Unmarshal(w.Body.Bytes(), &board)
+	if _, ok := board.Leads[manchester]; w.Code != http.StatusOK || len(board.Leads) != 1 || !ok {
+		t.Fatalf("board through the view: %d %s", w.Code, w.Body)
+	}
+	if _, err := db.Exec("UPDATE crm_leads SET times_called = 1 WHERE lead_id = ?", manchester); err != nil {
+		t.Fatal(err)
+	}
+	board.Leads = nil
+	w = doRequest(r, "GET", "/api/crm?view="+view.ID, token, nil)
+	json.Unmarshal(w.Body.Bytes(), &board)
+	if len(board.Leads) != 0 {
+		t.Fatalf("a called card should drop out of the view: %s", w.Body)
+	}
+
+	otherToken, _ := registerTestUser(t, r, "other@example.com")
+	if w := doRequest(r, "GET", "/api/crm?view="+view.ID, otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("someone else's view: expected 404, got %d", w.Code)
+	}
+}
+
+func TestSegmentMembershipFollowsTheBoard(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	_, slow := createTestLead(t, repo)
+	_, fast := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: slow, CompanyName: "Slow Plumbing", PageSpeed: 35}, {ID: fast, CompanyName: "Fast Plumbing", PageSpeed: 90}}); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := map[string]interface{}{"name": "Bad", "conditions": []map[string]interface{}{{"field": "pageSpeed", "op": "has", "value": 50}}}
+	if w := doRequest(r, "POST", "/api/segments", token, bad); w.Code != http.StatusBadRequest {
+		t.Errorf("bad condition: expected 400, got %d", w.Code)
+	}
+	w := doRequest(r, "POST", "/api/segments", token, map[string]interface{}{
+		"name": "Slow sites, no email",
+		"conditions": []map[string]interface{}{
+			{"field": "pageSpeed", "op": "<", "value": 50},
+			{"field": "hasEmail", "op": "==", "value": false},
+			{"field": "column", "op": "==", "value": "tobe-called"},
+		},
+	})
+	var segment Segment
+	json.Unmarshal(w.Body.Bytes(), &segment)
+	if w.Code != http.StatusCreated || segment.Members != 1 {
+		t.Fatalf("create segment: %d %s", w.Code, w.Body)
+	}
+
+	w = doRequest(r, "GET", "/api/segments/"+segment.ID+"/export", token, nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "Company,") || !strings.Contains(w.Body.String(), "Slow Plumbing") || strings.Contains(w.Body.String(), "Fast Plumbing") {
+		t.Fatalf("export: %d %s", w.Code, w.Body)
+	}
+
+	w = doRequest(r, "POST", "/api/segments/"+segment.ID+"/actions", token, map[string]string{"type": "tag", "tag": "site-rebuild"})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"applied":1`) {
+		t.Fatalf("bulk action: %d %s", w.Code, w.Body)
+	}
+	if card, err := repo.Crm().Card(slow); err != nil || !containsString(card.Tags, "site-rebuild") {
+		t.Fatalf("the member should be tagged: %+v %v", card, err)
+	}
+
+	if _, err := db.Exec("UPDATE crm_leads SET email = ? WHERE lead_id = ?", seal("owner@slow.test"), slow); err != nil {
+		t.Fatal(err)
+	}
+	var members []CrmLead
+	w = doRequest(r, "GET", "/api/segments/"+segment.ID+"/leads", token, nil)
+	json.Unmarshal(w.Body.Bytes(), &members)
+	if w.Code != http.StatusOK || len(members) != 0 {
+		t.Fatalf("a card that gained an email should leave the segment: %s", w.Body)
+	}
+
+	otherToken, _ := registerTestUser(t, r, "other@example.com")
+	if w := doRequest(r, "GET", "/api/segments/"+segment.ID+"/leads", otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another organization's segment: expected 404, got %d", w.Code)
+	}
+}
+
+func TestLeadScreenshotIsServedWithTheLeadAndCard(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "rep@example.com")
+	otherToken, _ := registerTestUser(t, r, "other@example.com")
+	searchID, leadID := createTestLead(t, repo)
+	if _, err := db.Exec("UPDATE leads SET website = 'acme.test' WHERE id = ?", leadID); err != nil {
+		t.Fatal(err)
+	}
+	png := []byte("\x89PNG\r\n\x1a\n fake image")
+	previousDir, previousChrome, previousCapture := attachmentsDir, screenshotChrome, captureScreenshot
+	t.Cleanup(func() {
+		attachmentsDir, screenshotChrome, captureScreenshot = previousDir, previousChrome, previousCapture
+	})
+	attachmentsDir, screenshotChrome = t.TempDir(), "chrome"
+	captureScreenshot = func(ctx context.Context, website string) ([]byte, error) {
+		if website != "acme.test" {
+			return nil, fmt.Errorf("unexpected website %s", website)
+		}
+		return png, nil
+	}
+
+	path := "/api/searches/" + searchID + "/leads/" + leadID + "/screenshot"
+	if w := doRequest(r, "GET", path, token, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("before capture: expected 404, got %d", w.Code)
+	}
+	w := doRequest(r, "POST", path, token, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), path) {
+		t.Fatalf("capture: %d %s", w.Code, w.Body)
+	}
+	w = doRequest(r, "GET", path, token, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || !bytes.Equal(w.Body.Bytes(), png) {
+		t.Fatalf("screenshot: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	card, err := repo.Crm().Card(leadID)
+	if err != nil || card.Screenshot != "/api/crm/leads/"+leadID+"/screenshot" {
+		t.Fatalf("card screenshot %q (err %v)", card.Screenshot, err)
+	}
+	if w := doRequest(r, "GET", card.Screenshot, token, nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), png) {
+		t.Fatalf("card screenshot: %d", w.Code)
+	}
+	if w := doRequest(r, "GET", card.Screenshot, otherToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another tenant's card screenshot: expected 404, got %d", w.Code)
+	}
+}
+
+func TestAuditReportCompilesFindingsForTheProspect(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "agency@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Website: "acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	saveTech(leadID, []string{"WordPress"})
+	saveSiteFeatures(leadID, leads.SiteFeatures{MobileFriendly: true, Analytics: true})
+
+	previousLighthouse, previousSSL := runLighthouse, checkSSL
+	t.Cleanup(func() { runLighthouse, checkSSL = previousLighthouse, previousSSL })
+	audits := 0
+	runLighthouse = func(ctx context.Context, website string) (LighthouseAudit, error) {
+		audits++
+		performance := 31
+		return LighthouseAudit{Performance: &performance, Strategy: LIGHTHOUSE_STRATEGY, Opportunities: []LighthouseOpportunity{
+			{ID: "uses-optimized-images", Title: "Efficiently encode images", SavingsMs: 3200},
+		}}, nil
+	}
+	checkSSL = func(ctx context.Context, website string) SSLCheck {
+		return SSLCheck{Checked: true}
+	}
+
+	path := "/api/crm/leads/" + leadID + "/audit-report"
+	if w := doRequest(r, "POST", path, token, map[string]string{"format": "docx"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: expected 400, got %d", w.Code)
+	}
+	w := doRequest(r, "POST", path, token, map[string]string{"format": "html"})
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("html report: %d %s", w.Code, body)
+	}
+	for _, want := range []string{"Website review for Acme Plumbing", "Built with WordPress", "<strong>31</strong> / 100", "isn&#39;t secure", "can&#39;t book online", "Efficiently encode images: could save about 3.2 seconds"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("html report is missing %q", want)
+		}
+	}
+	if strings.Contains(body, "built for phones") {
+		t.Error("a mobile-friendly site shouldn't be told it isn't")
+	}
+
+	w = doRequest(r, "POST", path, token, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pdf" || !strings.HasPrefix(w.Body.String(), "%PDF-") {
+		t.Fatalf("pdf report: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if audits != 1 {
+		t.Errorf("the site was audited %d times, want once", audits)
+	}
+}
+
+func TestShareLinksOpenWithoutAnAccountUntilRevokedOrExpired(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "agency@example.com")
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Website: "acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	previousLighthouse, previousSSL := runLighthouse, checkSSL
+	t.Cleanup(func() { runLighthouse, checkSSL = previousLighthouse, previousSSL })
+	audits := 0
+	runLighthouse = func(ctx context.Context, website string) (LighthouseAudit, error) {
+		audits++
+		performance := 42
+		return LighthouseAudit{Performance: &performance, Strategy: LIGHTHOUSE_STRATEGY}, nil
+	}
+	checkSSL = func(ctx context.Context, website string) SSLCheck { return SSLCheck{} }
+
+	path := "/api/crm/leads/" + leadID + "/share-links"
+	if w := doRequest(r, "POST", path, token, gin.H{"kind": "invoice"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown kind: expected 400, got %d", w.Code)
+	}
+	if w := doRequest(r, "POST", path, token, gin.H{"kind": "lead_summary", "expiresInDays": 0}); w.Code != http.StatusBadRequest {
+		t.Errorf("zero days: expected 400, got %d", w.Code)
+	}
+	create := func(body gin.H) ShareLink {
+		t.Helper()
+		w := doRequest(r, "POST", path, token, body)
+		var link ShareLink
+		if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &link) != nil || !strings.HasPrefix(link.URL, shareURL) {
+			t.Fatalf("create share link: %d %s", w.Code, w.Body.String())
+		}
+		return link
+	}
+	view := func(link ShareLink) *httptest.ResponseRecorder {
+		return doRequest(r, "GET", "/share/"+strings.TrimPrefix(link.URL, shareURL), "", nil)
+	}
+
+	report := create(gin.H{"kind": "audit_report"})
+	if audits != 1 {
+		t.Errorf("sharing an unaudited site should audit it once, got %d", audits)
+	}
+	if w := view(report); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Website review for Acme Plumbing") || !strings.Contains(w.Body.String(), "<strong>42</strong>") {
+		t.Fatalf("shared report: %d %s", w.Code, w.Body.String())
+	}
+
+	summary := create(gin.H{"kind": "lead_summary", "expiresInDays": 7})
+	if summary.ExpiresAt == nil || summary.ExpiresAt.Before(time.Now().AddDate(0, 0, 6)) {
+		t.Errorf("expiresAt = %v, want a week from now", summary.ExpiresAt)
+	}
+	for i := 0; i < 2; i++ {
+		if w := view(summary); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<h1 style=\"color: #222222\">Acme Plumbing</h1>") {
+			t.Fatalf("shared summary: %d %s", w.Code, w.Body.String())
+		}
+	}
+	var viewed int
+	db.QueryRow("SELECT COUNT(*) FROM crm_activity WHERE lead_id = ? AND kind = 'share_viewed'", leadID).Scan(&viewed)
+	if viewed != 2 {
+		t.Errorf("first views logged = %d, want one per link", viewed)
+	}
+
+	if w := doRequest(r, "DELETE", "/api/share-links/"+summary.ID, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body.String())
+	}
+	if w := view(summary); w.Code != http.StatusGone {
+		t.Errorf("revoked link: expected 410, got %d", w.Code)
+	}
+	db.Exec("UPDATE share_links SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute), report.ID)
+	if w := view(report); w.Code != http.StatusGone {
+		t.Errorf("expired link: expected 410, got %d", w.Code)
+	}
+	if w := doRequest(r, "GET", "/share/not-a-token", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown token: expected 404, got %d", w.Code)
+	}
+
+	w := doRequest(r, "GET", path, token, nil)
+	var links []ShareLink
+	json.Unmarshal(w.Body.Bytes(), &links)
+	if len(links) != 2 || links[0].ID != summary.ID || links[0].RevokedAt == nil || links[0].Views != 2 {
+		t.Errorf("share links: %s", w.Body.String())
+	}
+	_, other := registerTestUser(t, r, "rival@example.com")
+	if _, err := other.RevokeShareLink(report.ID); err != store.ErrNotFound {
+		t.Errorf("another organization revoked the link: %v", err)
+	}
+}
+
+func TestBrandingIsAppliedToReportsAndEmails(t *testing.T) {
+	r := setupTestServer(t)
+	token, repo := registerTestUser(t, r, "agency@example.com")
+	previousDir, previousSSL := attachmentsDir, checkSSL
+	t.Cleanup(func() { attachmentsDir, checkSSL = previousDir, previousSSL })
+	attachmentsDir = t.TempDir()
+	checkSSL = func(ctx context.Context, website string) SSLCheck { return SSLCheck{} }
+
+	if w := doRequest(r, "PUT", "/api/settings/branding", token, gin.H{"primaryColor": "blue"}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad colour: expected 400, got %d", w.Code)
+	}
+	w := doRequest(r, "PUT", "/api/settings/branding", token, gin.H{"agencyName": "Bright Web Co", "primaryColor": "#0A3D62", "footerText": "Bright Web Co, 1 High St"})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"primaryColor":"#0a3d62"`) {
+		t.Fatalf("update branding: %d %s", w.Code, w.Body.String())
+	}
+
+	upload := func(name string, data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("logo", name)
+		part.Write(data)
+		mw.Close()
+		req := httptest.NewRequest("PUT", "/api/settings/branding/logo", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := upload("logo.txt", []byte("not an image")); w.Code != http.StatusBadRequest {
+		t.Errorf("text logo: expected 400, got %d", w.Code)
+	}
+	var logo bytes.Buffer
+	png.Encode(&logo, image.NewRGBA(image.Rect(0, 0, 4, 2)))
+	if w := upload("logo.png", logo.Bytes()); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"logo":"/api/settings/branding/logo"`) {
+		t.Fatalf("upload logo: %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(r, "GET", "/api/settings/branding/logo", token, nil); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("get logo: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	_, leadID := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Website: "acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	w = doRequest(r, "POST", "/api/crm/leads/"+leadID+"/audit-report", token, map[string]string{"format": "html"})
+	body := w.Body.String()
+	for _, want := range []string{"prepared by Bright Web Co", "color: #0a3d62", "Bright Web Co, 1 High St", `src="data:image/png;base64,`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("html report is missing %q", want)
+		}
+	}
+	w = doRequest(r, "POST", "/api/crm/leads/"+leadID+"/audit-report", token, nil)
+	if !strings.Contains(w.Body.String(), "/Subtype /Image") || !strings.Contains(w.Body.String(), "(Bright Web Co, 1 High St) Tj") {
+		t.Error("the pdf report should carry the logo and footer")
+	}
+
+	b, err := repo.Branding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := b.sender("sales@bright.test"); from != `"Bright Web Co" <sales@bright.test>` {
+		t.Errorf("sender = %q", from)
+	}
+	if footer := b.emailFooter(); footer != "\n\nBright Web Co, 1 High St" {
+		t.Errorf("email footer = %q", footer)
+	}
+
+	if w := doRequest(r, "DELETE", "/api/settings/branding/logo", token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete logo: %d", w.Code)
+	}
+	if w := doRequest(r, "GET", "/api/settings/branding/logo", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("deleted logo: expected 404, got %d", w.Code)
+	}
+}
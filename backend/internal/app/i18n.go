@@ -0,0 +1,337 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- LOCALIZED ERRORS ---
+//
+// Handlers write their errors in English. On the way out, every JSON error
+// response gets a machine-readable code next to the message, and the
+// message, and those in "fields", are translated into the language the
+// client asked for with Accept-Language when there's a translation.
+// Frontends should branch on "code", which doesn't change when the wording
+// does.
+//
+// Messages not in errorCatalog get a code from their status, such as
+// "not_found". Their text stays English, except that server errors, which
+// the user can't act on anyway, become a translated "Internal server
+// error".
+
+var supportedLanguages = []string{"en", "es", "de"}
+
+type errorMessage struct {
+	code string
+	// translations are by language. Arguments of a formatted message are
+	// put back in order, each with %s.
+	translations map[string]string
+}
+
+// errorCatalog is keyed by the English message, or for formatted messages
+// the format handlers pass to fmt.Sprintf.
+var errorCatalog = map[string]errorMessage{
+	// Requests and accounts
+	"Authorization header required": {"auth_required", map[string]string{"es": "Se requiere la cabecera Authorization", "de": "Authorization-Header erforderlich"}},
+	"Invalid token":                 {"invalid_token", map[string]string{"es": "Token no válido", "de": "Ungültiges Token"}},
+	"Invalid credentials":           {"invalid_credentials", map[string]string{"es": "Correo electrónico o contraseña incorrectos", "de": "E-Mail-Adresse oder Passwort ist falsch"}},
+	"Account is disabled":           {"account_disabled", map[string]string{"es": "La cuenta está desactivada", "de": "Das Konto ist deaktiviert"}},
+	"Admin access required":         {"admin_required", map[string]string{"es": "Se requiere acceso de administrador", "de": "Administratorzugriff erforderlich"}},
+	"Access denied":                 {"access_denied", map[string]string{"es": "Acceso denegado", "de": "Zugriff verweigert"}},
+	"User with this email already exists": {"email_taken", map[string]string{
+		"es": "Ya existe un usuario con este correo electrónico", "de": "Es gibt bereits einen Benutzer mit dieser E-Mail-Adresse"}},
+	"Registration is by invitation only": {"invitation_required", map[string]string{"es": "El registro es solo por invitación", "de": "Die Registrierung ist nur mit Einladung möglich"}},
+	"This invitation code isn't valid or has expired": {"invitation_invalid", map[string]string{
+		"es": "Este código de invitación no es válido o ha caducado", "de": "Dieser Einladungscode ist ungültig oder abgelaufen"}},
+	"This invitation is for a different email address": {"invitation_wrong_email", map[string]string{
+		"es": "Esta invitación es para otra dirección de correo", "de": "Diese Einladung gilt für eine andere E-Mail-Adresse"}},
+	"Too many failed attempts; try again in %d seconds": {"too_many_attempts", map[string]string{
+		"es": "Demasiados intentos fallidos; inténtalo de nuevo en %s segundos", "de": "Zu viele Fehlversuche; versuche es in %s Sekunden erneut"}},
+	"Invalid input":           {"invalid_input", map[string]string{"es": "Datos no válidos", "de": "Ungültige Eingabe"}},
+	"Invalid request":         {"invalid_request", map[string]string{"es": "Solicitud no válida", "de": "Ungültige Anfrage"}},
+	"Some fields are invalid": {"invalid_fields", map[string]string{"es": "Algunos campos no son válidos", "de": "Einige Felder sind ungültig"}},
+	"Not found":               {"not_found", map[string]string{"es": "No encontrado", "de": "Nicht gefunden"}},
+	"Internal server error":   {"internal_error", map[string]string{"es": "Error interno del servidor", "de": "Interner Serverfehler"}},
+	"Request timed out":       {"timeout", map[string]string{"es": "La solicitud ha tardado demasiado", "de": "Zeitüberschreitung der Anfrage"}},
+	"Request body is larger than %d bytes": {"body_too_large", map[string]string{
+		"es": "El cuerpo de la solicitud supera los %s bytes", "de": "Der Anfragetext ist größer als %s Bytes"}},
+
+	// Plans and quotas
+	"Billing is not configured": {"billing_not_configured", map[string]string{"es": "La facturación no está configurada", "de": "Die Abrechnung ist nicht eingerichtet"}},
+	"Integrations are not included in the %s plan": {"plan_excludes_integrations", map[string]string{
+		"es": "Las integraciones no están incluidas en el plan %s", "de": "Integrationen sind im Tarif %s nicht enthalten"}},
+	"You have used all %d searches for this month; the allowance resets on %s": {"quota_searches", map[string]string{
+		"es": "Has usado las %s búsquedas de este mes; el límite se restablece el %s", "de": "Du hast alle %s Suchen für diesen Monat verbraucht; das Kontingent wird am %s zurückgesetzt"}},
+	"You have reached your limit of %d stored leads; delete some searches to start another": {"quota_leads", map[string]string{
+		"es": "Has alcanzado tu límite de %s leads guardados; elimina algunas búsquedas para empezar otra", "de": "Du hast dein Limit von %s gespeicherten Leads erreicht; lösche einige Suchen, um eine neue zu starten"}},
+	"You already have %d searches running; wait for one to finish": {"quota_concurrent", map[string]string{
+		"es": "Ya tienes %s búsquedas en curso; espera a que termine una", "de": "Es laufen bereits %s Suchen; warte, bis eine fertig ist"}},
+
+	// Searches, leads and the board
+	"Search not found":             {"search_not_found", map[string]string{"es": "Búsqueda no encontrada", "de": "Suche nicht gefunden"}},
+	"This search is still running": {"search_running", map[string]string{"es": "Esta búsqueda todavía está en curso", "de": "Diese Suche läuft noch"}},
+	"Unknown lead source '%s'":     {"unknown_source", map[string]string{"es": "Fuente de leads desconocida '%s'", "de": "Unbekannte Lead-Quelle '%s'"}},
+	"A location is required for %s searches": {"location_required", map[string]string{
+		"es": "Las búsquedas de %s necesitan una ubicación", "de": "Für %s-Suchen ist ein Ort erforderlich"}},
+	"Lead not found":                   {"lead_not_found", map[string]string{"es": "Lead no encontrado", "de": "Lead nicht gefunden"}},
+	"Lead not found in CRM":            {"crm_lead_not_found", map[string]string{"es": "El lead no está en el CRM", "de": "Der Lead ist nicht im CRM"}},
+	"The lead hasn't been audited yet": {"audit_not_found", map[string]string{"es": "El sitio del lead aún no se ha auditado", "de": "Die Website des Leads wurde noch nicht geprüft"}},
+	"No screenshot yet":                {"screenshot_not_found", map[string]string{"es": "Todavía no hay captura de pantalla", "de": "Noch kein Screenshot vorhanden"}},
+	"Share link not found":             {"share_link_not_found", map[string]string{"es": "No se encontró el enlace compartido", "de": "Freigabelink nicht gefunden"}},
+	"No logo uploaded":                 {"logo_not_found", map[string]string{"es": "No se ha subido ningún logotipo", "de": "Kein Logo hochgeladen"}},
+	"The logo must be a PNG or JPEG image": {"logo_invalid", map[string]string{
+		"es": "El logotipo debe ser una imagen PNG o JPEG", "de": "Das Logo muss ein PNG- oder JPEG-Bild sein"}},
+	"Screenshots are not configured": {"screenshots_not_configured", map[string]string{
+		"es": "Las capturas de pantalla no están configuradas", "de": "Screenshots sind nicht eingerichtet"}},
+	"This lead has been forgotten": {"lead_forgotten", map[string]string{
+		"es": "Los datos de este lead se han borrado a petición suya", "de": "Die Daten dieses Leads wurden auf Wunsch gelöscht"}},
+	"List not found":                {"list_not_found", map[string]string{"es": "Lista no encontrada", "de": "Liste nicht gefunden"}},
+	"Campaign not found":            {"campaign_not_found", map[string]string{"es": "Campaña no encontrada", "de": "Kampagne nicht gefunden"}},
+	"Campaign has already started":  {"campaign_started", map[string]string{"es": "La campaña ya ha comenzado", "de": "Die Kampagne hat bereits begonnen"}},
+	"No mailbox is connected":       {"mailbox_not_connected", map[string]string{"es": "No hay ningún buzón conectado", "de": "Kein Postfach verbunden"}},
+	"No email account is connected": {"mail_account_not_connected", map[string]string{"es": "No hay ninguna cuenta de correo conectada", "de": "Kein E-Mail-Konto verbunden"}},
+	"Your email account has reached its daily sending limit": {"mail_account_daily_limit", map[string]string{
+		"es": "Tu cuenta de correo ha alcanzado su límite de envíos diario", "de": "Dein E-Mail-Konto hat sein tägliches Versandlimit erreicht"}},
+	"No booking page is set up":           {"booking_page_not_found", map[string]string{"es": "No hay ninguna página de reservas configurada", "de": "Keine Buchungsseite eingerichtet"}},
+	"That booking link is taken":          {"booking_slug_taken", map[string]string{"es": "Ese enlace de reservas ya está en uso", "de": "Dieser Buchungslink ist bereits vergeben"}},
+	"Only repeating tasks can be skipped": {"task_not_repeating", map[string]string{"es": "Solo se pueden omitir las tareas recurrentes", "de": "Nur wiederkehrende Aufgaben können übersprungen werden"}},
+	"The task is already done":            {"task_done", map[string]string{"es": "La tarea ya está hecha", "de": "Die Aufgabe ist bereits erledigt"}},
+	"Segment not found":                   {"segment_not_found", map[string]string{"es": "Segmento no encontrado", "de": "Segment nicht gefunden"}},
+	"A draft campaign uses this segment":  {"segment_in_use", map[string]string{"es": "Una campaña en borrador usa este segmento", "de": "Ein Kampagnenentwurf verwendet dieses Segment"}},
+	"View not found":                      {"view_not_found", map[string]string{"es": "Vista no encontrada", "de": "Ansicht nicht gefunden"}},
+	"Task not found":                      {"task_not_found", map[string]string{"es": "Tarea no encontrada", "de": "Aufgabe nicht gefunden"}},
+	"Meeting not found":                   {"meeting_not_found", map[string]string{"es": "Reunión no encontrada", "de": "Termin nicht gefunden"}},
+	"The calendar feed is off":            {"calendar_feed_off", map[string]string{"es": "El calendario suscrito está desactivado", "de": "Der Kalender-Feed ist ausgeschaltet"}},
+	"Template not found":                  {"template_not_found", map[string]string{"es": "Plantilla no encontrada", "de": "Vorlage nicht gefunden"}},
+	"Status not found":                    {"status_not_found", map[string]string{"es": "Estado no encontrado", "de": "Status nicht gefunden"}},
+	"Column not found":                    {"column_not_found", map[string]string{"es": "Columna no encontrada", "de": "Spalte nicht gefunden"}},
+	"Built-in columns can't be deleted": {"column_built_in", map[string]string{
+		"es": "Las columnas predeterminadas no se pueden eliminar", "de": "Standardspalten können nicht gelöscht werden"}},
+	"Move the leads out of this column before deleting it": {"column_not_empty", map[string]string{
+		"es": "Mueve los leads fuera de esta columna antes de eliminarla", "de": "Verschiebe die Leads aus dieser Spalte, bevor du sie löschst"}},
+	"The board has changed since it was loaded": {"board_changed", map[string]string{
+		"es": "El tablero ha cambiado desde que se cargó", "de": "Das Board hat sich seit dem Laden geändert"}},
+	"Another rep is calling this lead": {"lead_claimed", map[string]string{
+		"es": "Otro comercial está llamando a este lead", "de": "Ein anderer Vertriebsmitarbeiter ruft diesen Lead gerade an"}},
+	"Nothing to undo": {"nothing_to_undo", map[string]string{"es": "No hay nada que deshacer", "de": "Es gibt nichts rückgängig zu machen"}},
+	"Team not found":  {"team_not_found", map[string]string{"es": "Equipo no encontrado", "de": "Team nicht gefunden"}},
+	"Only the team owner or a manager can do that": {"team_manager_required", map[string]string{
+		"es": "Solo el propietario del equipo o un responsable puede hacer eso", "de": "Das kann nur der Teaminhaber oder ein Manager"}},
+
+	// Field messages
+	"is required":                   {"required", map[string]string{"es": "es obligatorio", "de": "ist erforderlich"}},
+	"is invalid":                    {"invalid", map[string]string{"es": "no es válido", "de": "ist ungültig"}},
+	"is too long":                   {"too_long", map[string]string{"es": "es demasiado largo", "de": "ist zu lang"}},
+	"can't be empty":                {"empty", map[string]string{"es": "no puede estar vacío", "de": "darf nicht leer sein"}},
+	"must be a valid email address": {"invalid_email", map[string]string{"es": "debe ser una dirección de correo válida", "de": "muss eine gültige E-Mail-Adresse sein"}},
+	"must be at least 8 characters": {"password_too_short", map[string]string{"es": "debe tener al menos 8 caracteres", "de": "muss mindestens 8 Zeichen lang sein"}},
+	"must be at most 72 bytes":      {"password_too_long", map[string]string{"es": "debe tener como máximo 72 bytes", "de": "darf höchstens 72 Bytes lang sein"}},
+	"must be a UUID":                {"invalid_uuid", map[string]string{"es": "debe ser un UUID", "de": "muss eine UUID sein"}},
+	"must be an https URL":          {"invalid_https_url", map[string]string{"es": "debe ser una URL https", "de": "muss eine https-URL sein"}},
+	"must be between 0 and 100":     {"out_of_range", map[string]string{"es": "debe estar entre 0 y 100", "de": "muss zwischen 0 und 100 liegen"}},
+	"must be email addresses":       {"invalid_emails", map[string]string{"es": "deben ser direcciones de correo", "de": "müssen E-Mail-Adressen sein"}},
+	"must be phone numbers":         {"invalid_phones", map[string]string{"es": "deben ser números de teléfono", "de": "müssen Telefonnummern sein"}},
+	"must contain a letter and a digit or symbol": {"password_too_weak", map[string]string{
+		"es": "debe contener una letra y un número o un símbolo", "de": "muss einen Buchstaben und eine Ziffer oder ein Sonderzeichen enthalten"}},
+	"was not accepted; solve the captcha again": {"captcha_rejected", map[string]string{
+		"es": "no se ha aceptado; resuelve el captcha otra vez", "de": "wurde nicht akzeptiert; löse das Captcha erneut"}},
+}
+
+type errorPattern struct {
+	re      *regexp.Regexp
+	message errorMessage
+}
+
+var formatVerbRe = regexp.MustCompile(`%[sdv]`)
+
+// errorPatterns match the formatted messages in errorCatalog, capturing
+// their arguments.
+var errorPatterns = func() []errorPattern {
+	var patterns []errorPattern
+	for format, message := range errorCatalog {
+		if !formatVerbRe.MatchString(format) {
+			continue
+		}
+		parts := formatVerbRe.Split(format, -1)
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		patterns = append(patterns, errorPattern{regexp.MustCompile("^" + strings.Join(parts, "(.+?)") + "$"), message})
+	}
+	return patterns
+}()
+
+// lookupError finds message in the catalog and returns its code and its
+// translation into lang, if it has one.
+func lookupError(message, lang string) (code, translated string, ok bool) {
+	if m, found := errorCatalog[message]; found {
+		if t, has := m.translations[lang]; has {
+			return m.code, t, true
+		}
+		return m.code, message, true
+	}
+	for _, p := range errorPatterns {
+		args := p.re.FindStringSubmatch(message)
+		if args == nil {
+			continue
+		}
+		t, has := p.message.translations[lang]
+		if !has {
+			return p.message.code, message, true
+		}
+		values := make([]interface{}, len(args)-1)
+		for i, a := range args[1:] {
+			values[i] = a
+		}
+		return p.message.code, fmt.Sprintf(t, values...), true
+	}
+	return "", message, false
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// statusErrorCode is the code for a message that isn't in the catalog.
+func statusErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return nonSlugChars.ReplaceAllString(strings.ToLower(text), "_")
+}
+
+// requestLanguage picks the supported language the client prefers most,
+// from an Accept-Language header such as "de-CH, de;q=0.9, en;q=0.8".
+func requestLanguage(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		for _, lang := range supportedLanguages {
+			if primary == lang && q > 0 {
+				choices = append(choices, choice{lang, q})
+			}
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) == 0 {
+		return supportedLanguages[0]
+	}
+	return choices[0].lang
+}
+
+// localizeError rewrites a JSON error body in lang, adding codes. Bodies
+// that aren't an object with an "error" string come back unchanged.
+func localizeError(body []byte, status int, lang string) []byte {
+	var payload map[string]interface{}
+	if json.Unmarshal(body, &payload) != nil {
+		return body
+	}
+	message, ok := payload["error"].(string)
+	if !ok {
+		return body
+	}
+	code, translated, found := lookupError(message, lang)
+	if !found {
+		code = statusErrorCode(status)
+		if status >= 500 && lang != supportedLanguages[0] {
+			_, translated, _ = lookupError("Internal server error", lang)
+		}
+	}
+	if _, has := payload["code"]; !has {
+		payload["code"] = code
+	}
+	payload["error"] = translated
+
+	if fields, ok := payload["fields"].(map[string]interface{}); ok {
+		codes := map[string]string{}
+		for field, v := range fields {
+			message, ok := v.(string)
+			if !ok {
+				continue
+			}
+			code, translated, found := lookupError(message, lang)
+			if !found {
+				code = "invalid"
+			}
+			fields[field], codes[field] = translated, code
+		}
+		payload["fieldCodes"] = codes
+	}
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// localizingWriter holds back a JSON error response so it can be
+// translated once the handler is done.
+type localizingWriter struct {
+	gin.ResponseWriter
+	decided, holding bool
+	body             bytes.Buffer
+}
+
+func (w *localizingWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		mediaType, _, _ := strings.Cut(w.Header().Get("Content-Type"), ";")
+		w.holding = w.Status() >= 400 && strings.TrimSpace(mediaType) == "application/json"
+	}
+	if w.holding {
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *localizingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *localizingWriter) Written() bool {
+	return w.body.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *localizingWriter) Flush() {
+	if !w.holding {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func localizeErrorsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Language")
+		if c.IsWebsocket() {
+			c.Next()
+			return
+		}
+		lang := requestLanguage(c.GetHeader("Accept-Language"))
+		w := &localizingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		if w.holding {
+			c.Header("Content-Language", lang)
+			w.ResponseWriter.Write(localizeError(w.body.Bytes(), w.Status(), lang))
+		}
+	}
+}
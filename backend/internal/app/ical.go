@@ -0,0 +1,194 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- ICAL FEED ---
+//
+// Each user can turn on a private iCalendar feed of their callbacks and
+// the meetings they booked, to subscribe to from Google Calendar, Outlook
+// or Apple Calendar without connecting an account. The feed's address
+// carries a secret token, since calendar apps can't send credentials;
+// rotating it retires the old address.
+
+// icalURL is this server's public /ical/ address, which feed addresses are
+// built on.
+var icalURL = envOrDefault("ICAL_URL", "http://localhost:8080/ical/")
+
+// ICAL_MEETING_HISTORY is how far back the feed lists meetings.
+const ICAL_MEETING_HISTORY = 90 * 24 * time.Hour
+
+func newCalendarFeedToken() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func getCalendarFeedHandler(c *gin.Context) {
+	token, err := repoFrom(c).CalendarFeedToken()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The calendar feed is off"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load calendar feed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": icalURL + token + ".ics"})
+}
+
+// rotateCalendarFeedHandler turns the feed on, or gives it a new address
+// when it's already on.
+func rotateCalendarFeedHandler(c *gin.Context) {
+	token, err := newCalendarFeedToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create calendar feed"})
+		return
+	}
+	if err := repoFrom(c).SaveCalendarFeedToken(token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create calendar feed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": icalURL + token + ".ics"})
+}
+
+func deleteCalendarFeedHandler(c *gin.Context) {
+	if err := repoFrom(c).DeleteCalendarFeed(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to turn off calendar feed"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// calendarFeedHandler serves the feed at /ical/:token, with or without an
+// .ics extension.
+func calendarFeedHandler(c *gin.Context) {
+	tenant, err := calendarFeedTenant(c.Request.Context(), strings.TrimSuffix(c.Param("token"), ".ics"))
+	if err == store.ErrNotFound {
+		c.String(http.StatusNotFound, "Calendar feed not found")
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	repo := newRepository(tenant)
+	now := time.Now().UTC()
+	callbacks, err := repo.FeedCallbacks()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	meetings, err := repo.FeedMeetings(now.Add(-ICAL_MEETING_HISTORY))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(buildCalendarFeed(callbacks, meetings, now)))
+}
+
+// buildCalendarFeed writes the callbacks and meetings as an iCalendar
+// (RFC 5545) document, every time in UTC.
+func buildCalendarFeed(callbacks []calendarChange, meetings []Meeting, now time.Time) string {
+	var b strings.Builder
+	line := func(name, value string) {
+		b.WriteString(foldICalLine(name + ":" + value))
+	}
+	stamp := icalTime(now)
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//BlueLeads//Calendar feed//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	line("X-WR-CALNAME", "BlueLeads")
+	for _, ch := range callbacks {
+		line("BEGIN", "VEVENT")
+		line("UID", "callback-"+ch.leadID+"@blueleads")
+		line("DTSTAMP", stamp)
+		line("DTSTART", icalTime(*ch.callbackAt))
+		line("DTEND", icalTime(ch.callbackAt.Add(CALENDAR_EVENT_DURATION)))
+		line("SUMMARY", icalText("Call back "+ch.companyName))
+		line("DESCRIPTION", icalText("Callback booked in BlueLeads: "+appURL+"/crm?lead="+ch.leadID))
+		line("BEGIN", "VALARM")
+		line("ACTION", "DISPLAY")
+		line("DESCRIPTION", icalText("Call back "+ch.companyName))
+		line("TRIGGER", fmt.Sprintf("-PT%dM", CALENDAR_REMINDER_MINUTES))
+		line("END", "VALARM")
+		line("END", "VEVENT")
+	}
+	for _, m := range meetings {
+		description := "Meeting booked in BlueLeads: " + appURL + "/crm?lead=" + m.LeadID
+		if len(m.Attendees) > 0 {
+			description += "\nAttendees: " + strings.Join(m.Attendees, ", ")
+		}
+		if m.Notes != "" {
+			description += "\n\n" + m.Notes
+		}
+		status := "CONFIRMED"
+		if m.Outcome == MEETING_CANCELLED {
+			status = "CANCELLED"
+		}
+		line("BEGIN", "VEVENT")
+		line("UID", "meeting-"+m.ID+"@blueleads")
+		line("DTSTAMP", stamp)
+		line("LAST-MODIFIED", icalTime(m.UpdatedAt))
+		line("DTSTART", icalTime(m.StartsAt))
+		line("DTEND", icalTime(m.EndsAt))
+		line("SUMMARY", icalText(m.Title))
+		if m.Location != "" {
+			line("LOCATION", icalText(m.Location))
+		}
+		line("DESCRIPTION", icalText(description))
+		line("STATUS", status)
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return b.String()
+}
+
+func icalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icalText escapes a TEXT value.
+var icalTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+func icalText(s string) string {
+	return icalTextEscaper.Replace(s)
+}
+
+// foldICalLine ends a content line with CRLF, folding it so no line is
+// longer than 75 octets without splitting a character.
+func foldICalLine(s string) string {
+	var b strings.Builder
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		// Continuation lines start with the space, which counts.
+		limit = 74
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- IDEMPOTENCY KEYS ---
+const IDEMPOTENCY_KEY_TTL = 24 * time.Hour
+const IDEMPOTENCY_MAX_KEY_LENGTH = 255
+
+// responseRecorder keeps a copy of everything the handler writes so it can
+// be replayed for a retried request.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyMiddleware replays the stored response when a client retries a
+// request with the same Idempotency-Key, so a flaky connection can't create
+// the same search or CRM insert twice. Requests without the header pass
+// straight through.
+func idempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > IDEMPOTENCY_MAX_KEY_LENGTH {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+		userID, _ := c.Get("userID")
+		ctx := c.Request.Context()
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(append([]byte(c.Request.Method+" "+c.FullPath()+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+
+		var storedHash string
+		var statusCode sql.NullInt64
+		var responseBody []byte
+		err = db.QueryRowContext(ctx, "SELECT request_hash, status_code, response_body FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?", userID, key).
+			Scan(&storedHash, &statusCode, &responseBody)
+		switch {
+		case err == nil && storedHash != requestHash:
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key has already been used for a different request"})
+			return
+		case err == nil && !statusCode.Valid:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			return
+		case err == nil:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(int(statusCode.Int64), "application/json; charset=utf-8", responseBody)
+			c.Abort()
+			return
+		case err != sql.ErrNoRows:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			return
+		}
+
+		// Claim the key before running the handler; a concurrent retry loses
+		// the insert race and is told the request is in progress.
+		_, err = db.ExecContext(ctx, "INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash) VALUES (?, ?, ?)", userID, key, requestHash)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		status := recorder.Status()
+		if status >= 500 || ctx.Err() != nil {
+			// Server errors and abandoned requests are safe to retry, so
+			// release the key. The release mustn't be cancelled along with
+			// the request, or the key would stay claimed until it expires.
+			if _, err := db.ExecContext(context.WithoutCancel(ctx), "DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?", userID, key); err != nil {
+				log.Printf("Failed to release idempotency key: %v", err)
+			}
+			return
+		}
+		_, err = db.ExecContext(ctx, "UPDATE idempotency_keys SET status_code = ?, response_body = ? WHERE user_id = ? AND idempotency_key = ?", status, recorder.body.Bytes(), userID, key)
+		if err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+		}
+	}
+}
+
+func purgeIdempotencyKeys() {
+	cutoff := time.Now().UTC().Add(-IDEMPOTENCY_KEY_TTL).Format("2006-01-02 15:04:05")
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", cutoff); err != nil {
+		log.Printf("Failed to purge idempotency keys: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- IMAP CLIENT ---
+//
+// Just enough IMAP4rev1 (RFC 3501) to read the headers of new messages in
+// one folder: log in, open the folder read-only, and fetch headers by UID.
+// Nothing is marked read or changed in the mailbox.
+
+const (
+	IMAP_TLS      = "tls"      // TLS from the start, usually port 993
+	IMAP_STARTTLS = "starttls" // upgraded with STARTTLS, usually port 143
+	IMAP_NONE     = "none"     // unencrypted, for servers on a trusted network
+)
+
+const IMAP_TIMEOUT = time.Minute
+
+// IMAP_ALLOW_PRIVATE lets mailboxes be on private and loopback addresses,
+// for self-hosted mail servers on the same network.
+var imapAllowPrivate = os.Getenv("IMAP_ALLOW_PRIVATE") == "true"
+
+var errPrivateIMAPAddress = errors.New("mail server resolves to a private address")
+
+// imapHeaderFields are the headers fetched for each message.
+const imapHeaderFields = "FROM MESSAGE-ID IN-REPLY-TO REFERENCES SUBJECT DATE"
+
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is one untagged response, with the contents of any literals
+// in it.
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+type imapMessage struct {
+	uid    uint32
+	header mail.Header
+}
+
+var imapLiteralPattern = regexp.MustCompile(`\{(\d+)\+?\}$`)
+var imapUIDPattern = regexp.MustCompile(`\bUID (\d+)`)
+var imapUIDValidityPattern = regexp.MustCompile(`\[UIDVALIDITY (\d+)\]`)
+var imapUIDNextPattern = regexp.MustCompile(`\[UIDNEXT (\d+)\]`)
+
+// dialIMAP connects and reads the server's greeting, upgrading to TLS as
+// security says.
+func dialIMAP(ctx context.Context, host string, port int, security string) (*imapClient, error) {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if !imapAllowPrivate && internalAddress(address) {
+				return errPrivateIMAPAddress
+			}
+			return nil
+		},
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	var conn net.Conn
+	var err error
+	if security == IMAP_TLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(IMAP_TIMEOUT))
+
+	greeting, err := c.readResponse()
+	if err == nil && !strings.HasPrefix(greeting.line, "* OK") && !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		err = fmt.Errorf("unexpected greeting %q", greeting.line)
+	}
+	if err == nil && security == IMAP_STARTTLS {
+		if _, err = c.command("STARTTLS"); err == nil {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+			c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+			err = tlsConn.HandshakeContext(ctx)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// readResponse reads one response line, along with any literals it
+// carries.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+		m := imapLiteralPattern.FindStringSubmatch(line)
+		if m == nil {
+			return resp, nil
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n > 10<<20 {
+			return resp, fmt.Errorf("literal of %s bytes", m[1])
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// command sends a command and returns its untagged responses, or an error
+// when the server doesn't answer OK.
+func (c *imapClient) command(cmd string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%03d", c.tag)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, cmd); err != nil {
+		return nil, err
+	}
+	var responses []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return responses, err
+		}
+		if rest, ok := strings.CutPrefix(resp.line, tag+" "); ok {
+			if !strings.HasPrefix(rest, "OK") {
+				return responses, fmt.Errorf("%s: %s", strings.Fields(cmd)[0], rest)
+			}
+			return responses, nil
+		}
+		responses = append(responses, resp)
+	}
+}
+
+// imapQuote makes s an IMAP quoted string.
+func imapQuote(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n") {
+		return "", errors.New("line breaks aren't allowed")
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`, nil
+}
+
+func (c *imapClient) login(username, password string) error {
+	user, err := imapQuote(username)
+	if err != nil {
+		return err
+	}
+	pass, err := imapQuote(password)
+	if err != nil {
+		return err
+	}
+	_, err = c.command("LOGIN " + user + " " + pass)
+	return err
+}
+
+// examine opens folder read-only and returns its UIDVALIDITY and UIDNEXT.
+func (c *imapClient) examine(folder string) (validity, next uint32, err error) {
+	name, err := imapQuote(folder)
+	if err != nil {
+		return 0, 0, err
+	}
+	responses, err := c.command("EXAMINE " + name)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, resp := range responses {
+		if m := imapUIDValidityPattern.FindStringSubmatch(resp.line); m != nil {
+			v, _ := strconv.ParseUint(m[1], 10, 32)
+			validity = uint32(v)
+		}
+		if m := imapUIDNextPattern.FindStringSubmatch(resp.line); m != nil {
+			n, _ := strconv.ParseUint(m[1], 10, 32)
+			next = uint32(n)
+		}
+	}
+	if validity == 0 || next == 0 {
+		return 0, 0, errors.New("server didn't report UIDVALIDITY and UIDNEXT")
+	}
+	return validity, next, nil
+}
+
+// headersAfter fetches the headers of messages with a UID above lastUID.
+func (c *imapClient) headersAfter(lastUID uint32) ([]imapMessage, error) {
+	responses, err := c.command(fmt.Sprintf("UID FETCH %d:* (UID BODY.PEEK[HEADER.FIELDS (%s)])", lastUID+1, imapHeaderFields))
+	if err != nil {
+		return nil, err
+	}
+	var messages []imapMessage
+	for _, resp := range responses {
+		m := imapUIDPattern.FindStringSubmatch(resp.line)
+		if m == nil || !strings.Contains(resp.line, " FETCH ") || len(resp.literals) == 0 {
+			continue
+		}
+		uid, err := strconv.ParseUint(m[1], 10, 32)
+		// "n:*" always includes the newest message, even when it's older
+		// than n.
+		if err != nil || uint32(uid) <= lastUID {
+			continue
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(append(resp.literals[0], "\r\n"...)))
+		if err != nil {
+			continue
+		}
+		messages = append(messages, imapMessage{uid: uint32(uid), header: msg.Header})
+	}
+	return messages, nil
+}
+
+func (c *imapClient) logout() {
+	c.command("LOGOUT")
+	c.conn.Close()
+}
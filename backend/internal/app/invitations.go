@@ -0,0 +1,240 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- INVITATIONS ---
+//
+// Private deployments set INVITE_ONLY=true to close open registration:
+// signing up then needs an invitation code, and anything else is a 403.
+// Admins create invitations for new organizations (or for an existing
+// team), and team owners and managers create them for their own team. A
+// team invitation puts the new user in that team instead of giving them one
+// of their own, which works in open mode too.
+//
+// A code can be used once, and only by the email it was made for when it
+// was made for one. Only a hash of the code is stored, so the code is shown
+// once, when it's created.
+
+var inviteOnly = os.Getenv("INVITE_ONLY") == "true"
+var invitationTTL = time.Duration(envInt("INVITATION_TTL_DAYS", 14)) * 24 * time.Hour
+
+var invitationCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type Invitation struct {
+	ID string `json:"id"`
+	// Code is only filled in when the invitation is created.
+	Code      string    `json:"code,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	TeamID    *int64    `json:"teamId"`
+	CreatedBy int64     `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type InvitationInput struct {
+	Email string `json:"email"`
+	// TeamID is only read from admins; teams always invite to themselves.
+	TeamID *int64 `json:"teamId"`
+}
+
+// pendingInvitationColumns are the columns scanInvitations expects.
+const pendingInvitationColumns = "id, email, org_id, created_by, created_at, expires_at"
+
+func hashInvitationCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// insertInvitation makes a new code. orgID is nil for an invitation that
+// gets the new user an organization of their own.
+func insertInvitation(ctx context.Context, q store.Querier, orgID *int64, email string, createdBy int64) (Invitation, error) {
+	raw := make([]byte, 15)
+	if _, err := rand.Read(raw); err != nil {
+		return Invitation{}, err
+	}
+	now := time.Now().UTC()
+	inv := Invitation{
+		ID:        uuid.New().String(),
+		Code:      invitationCodeEncoding.EncodeToString(raw),
+		Email:     email,
+		TeamID:    orgID,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(invitationTTL),
+	}
+	_, err := q.ExecContext(ctx, "INSERT INTO invitations (id, code_hash, org_id, email, created_by, created_at, expires_at) VALUES (?, ?, ?, NULLIF(?, ''), ?, ?, ?)",
+		inv.ID, hashInvitationCode(inv.Code), orgID, email, createdBy, inv.CreatedAt, inv.ExpiresAt)
+	return inv, err
+}
+
+func scanInvitations(rows *sql.Rows) ([]Invitation, error) {
+	defer rows.Close()
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		var email sql.NullString
+		var orgID sql.NullInt64
+		if err := rows.Scan(&inv.ID, &email, &orgID, &inv.CreatedBy, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			return nil, err
+		}
+		inv.Email = email.String
+		if orgID.Valid {
+			inv.TeamID = &orgID.Int64
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// findInvitation returns the unused, unexpired invitation with code, or
+// store.ErrNotFound.
+func findInvitation(ctx context.Context, code string, now time.Time) (Invitation, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+pendingInvitationColumns+" FROM invitations WHERE code_hash = ? AND used_at IS NULL AND expires_at > ?", hashInvitationCode(code), now)
+	if err != nil {
+		return Invitation{}, err
+	}
+	invitations, err := scanInvitations(rows)
+	if err != nil {
+		return Invitation{}, err
+	}
+	if len(invitations) == 0 {
+		return Invitation{}, store.ErrNotFound
+	}
+	return invitations[0], nil
+}
+
+// redeemInvitation marks an invitation used by userID. It fails with
+// store.ErrNotFound if someone else got there first.
+func redeemInvitation(tx *sql.Tx, id string, userID int64, now time.Time) error {
+	return store.ExpectOne(tx.Exec("UPDATE invitations SET used_by = ?, used_at = ? WHERE id = ? AND used_at IS NULL AND expires_at > ?", userID, now, id, now))
+}
+
+// checkInvitationInput validates the body of a create-invitation request.
+func checkInvitationInput(c *gin.Context, input *InvitationInput) bool {
+	if !bindJSON(c, input) {
+		return false
+	}
+	input.Email = strings.TrimSpace(input.Email)
+	fe := fieldErrors{}
+	fe.check(input.Email == "" || validEmail(input.Email), "email", "must be a valid email address")
+	return !fe.respond(c)
+}
+
+// getRegistrationHandler tells the sign-up form whether it needs a code.
+func getRegistrationHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"inviteOnly": inviteOnly})
+}
+
+func adminCreateInvitationHandler(c *gin.Context) {
+	var input InvitationInput
+	if !checkInvitationInput(c, &input) {
+		return
+	}
+	if input.TeamID != nil {
+		var exists bool
+		if err := db.QueryRowContext(c.Request.Context(), "SELECT EXISTS(SELECT 1 FROM organizations WHERE id = ?)", *input.TeamID).Scan(&exists); err != nil || !exists {
+			fieldErrors{"teamId": "is not a team"}.respond(c)
+			return
+		}
+	}
+	userID := c.GetInt64("userID")
+	inv, err := insertInvitation(c.Request.Context(), db, input.TeamID, input.Email, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+	log.Printf("Admin %d created invitation %s", userID, inv.ID)
+	c.JSON(http.StatusCreated, inv)
+}
+
+// adminListInvitationsHandler lists every invitation that can still be used.
+func adminListInvitationsHandler(c *gin.Context) {
+	rows, err := db.QueryContext(c.Request.Context(), "SELECT "+pendingInvitationColumns+" FROM invitations WHERE used_at IS NULL AND expires_at > ? ORDER BY created_at DESC", time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invitations"})
+		return
+	}
+	invitations, err := scanInvitations(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invitations"})
+		return
+	}
+	c.JSON(http.StatusOK, invitations)
+}
+
+func adminDeleteInvitationHandler(c *gin.Context) {
+	err := store.ExpectOne(db.ExecContext(c.Request.Context(), "DELETE FROM invitations WHERE id = ? AND used_at IS NULL", c.Param("invitationId")))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invitation"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func createTeamInvitationHandler(c *gin.Context) {
+	repo, _, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	var input InvitationInput
+	if !checkInvitationInput(c, &input) {
+		return
+	}
+	inv, err := repo.CreateInvitation(input.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+	c.JSON(http.StatusCreated, inv)
+}
+
+func getTeamInvitationsHandler(c *gin.Context) {
+	repo, _, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	invitations, err := repo.Invitations()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invitations"})
+		return
+	}
+	c.JSON(http.StatusOK, invitations)
+}
+
+func deleteTeamInvitationHandler(c *gin.Context) {
+	repo, _, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	err := repo.DeleteInvitation(c.Param("invitationId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invitation"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
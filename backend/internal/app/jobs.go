@@ -0,0 +1,52 @@
+package app
+
+import (
+	"log"
+	"time"
+)
+
+// --- BACKGROUND JOBS ---
+
+// startBackgroundJobs launches the periodic maintenance tasks.
+func startBackgroundJobs() {
+	runPeriodically("trash purge", time.Hour, purgeTrash)
+	runPeriodically("idempotency key purge", time.Hour, purgeIdempotencyKeys)
+	runPeriodically("login attempt purge", time.Hour, purgeLoginAttempts)
+	runPeriodically("booking attempt purge", time.Hour, purgeBookingAttempts)
+	runPeriodically("daily digest", DIGEST_CHECK_INTERVAL, sendDueDigests)
+	runPeriodically("weekly summary", DIGEST_CHECK_INTERVAL, sendDueWeeklySummaries)
+	runPeriodically("callback push", PUSH_CALLBACK_CHECK_INTERVAL, dispatchCallbackPushes)
+	runPeriodically("snooze wake-up", SNOOZE_CHECK_INTERVAL, resurfaceSnoozedLeads)
+	runPeriodically("automation rules", RULES_CHECK_INTERVAL, runAllAutomationRules)
+	runPeriodically("lead timezones", time.Hour, assignLeadTimezones)
+	runPeriodically("undo history purge", time.Hour, purgeUndoHistory)
+	runPeriodically("board snapshots", time.Hour, snapshotBoards)
+	runPeriodically("queued searches", QUEUED_SEARCH_CHECK_INTERVAL, startQueuedSearches)
+	runPeriodically("email campaigns", CAMPAIGN_SEND_INTERVAL, sendDueCampaigns)
+	runPeriodically("reply detection", IMAP_POLL_INTERVAL, pollMailboxes)
+	runPeriodically("calendar sync", CALENDAR_SYNC_INTERVAL, syncCalendars)
+	runPeriodically("repeating tasks", TASK_REPEAT_INTERVAL, scheduleRepeatingTasks)
+	if backupIntervalHours > 0 {
+		runPeriodically("database backup", time.Duration(backupIntervalHours)*time.Hour, scheduledBackup)
+	}
+}
+
+// runPeriodically runs job once immediately and then every interval, in
+// its own goroutine. A panicking job is logged and retried next tick.
+func runPeriodically(name string, interval time.Duration, job func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("Background job %q panicked: %v", name, r)
+					}
+				}()
+				job()
+			}()
+			<-ticker.C
+		}
+	}()
+}
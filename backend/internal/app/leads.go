@@ -0,0 +1,189 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- LEAD QUERIES ---
+
+// leadSortColumns maps the API's sort keys onto leads table columns.
+var leadSortColumns = map[string]string{
+	"companyName": "company_name",
+	"pageSpeed":   "page_speed",
+	"rating":      "rating",
+	"reviewCount": "review_count",
+	"category":    "category",
+	"employees":   "employee_count",
+}
+
+func leadService(c *gin.Context) leads.Service {
+	return leads.NewService(repoFrom(c).Leads())
+}
+
+// buildLeadQuery turns the lead listing query string into a leads.Query.
+// Supported parameters are sort, order (asc|desc), minRating, minReviews,
+// category, lineType, hasWebsite, address (a substring), called,
+// minEmployees, maxEmployees, the site features (liveChat, onlineBooking,
+// ecommerce, analytics, mobileFriendly), callableNow=true, near=lat,lng
+// with radiusKm, territory, and new=true|false for re-runs. The
+// repository only ever matches leads in its tenant's searches.
+func buildLeadQuery(repo *Repository, searchID string, params url.Values) (leads.Query, error) {
+	return buildLeadQueryIn(repo, []string{searchID}, params)
+}
+
+// buildLeadQueryIn is buildLeadQuery across several searches.
+func buildLeadQueryIn(repo *Repository, searchIDs []string, params url.Values) (leads.Query, error) {
+	lq := leads.Query{SearchIDs: searchIDs}
+
+	if v := params.Get("minRating"); v != "" {
+		minRating, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("minRating must be a number")
+		}
+		lq.Where = append(lq.Where, "rating >= ?")
+		lq.Args = append(lq.Args, minRating)
+	}
+	if v := params.Get("minReviews"); v != "" {
+		minReviews, err := strconv.Atoi(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("minReviews must be an integer")
+		}
+		lq.Where = append(lq.Where, "review_count >= ?")
+		lq.Args = append(lq.Args, minReviews)
+	}
+	if v := params.Get("category"); v != "" {
+		lq.Where = append(lq.Where, "category = ? COLLATE NOCASE")
+		lq.Args = append(lq.Args, v)
+	}
+	// lineType matches leads with at least one valid number of that type.
+	if v := params.Get("lineType"); v != "" {
+		if !containsString(phoneLineTypes, v) {
+			return leads.Query{}, fmt.Errorf("lineType must be one of %s", strings.Join(phoneLineTypes, ", "))
+		}
+		lq.Where = append(lq.Where, "EXISTS (SELECT 1 FROM lead_phones p WHERE p.lead_id = leads.id AND p.line_type = ? AND p.valid)")
+		lq.Args = append(lq.Args, v)
+	}
+	if v := params.Get("hasWebsite"); v != "" {
+		hasWebsite, err := strconv.ParseBool(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("hasWebsite must be true or false")
+		}
+		lq.Where = append(lq.Where, "(COALESCE(website, '') != '') = ?")
+		lq.Args = append(lq.Args, hasWebsite)
+	}
+	if v := strings.TrimSpace(params.Get("address")); v != "" {
+		lq.Where = append(lq.Where, "address LIKE ? ESCAPE '\\'")
+		lq.Args = append(lq.Args, "%"+store.EscapeLike(v)+"%")
+	}
+	for _, sf := range siteFeatureFilters {
+		if v := params.Get(sf.param); v != "" {
+			has, err := strconv.ParseBool(v)
+			if err != nil {
+				return leads.Query{}, fmt.Errorf("%s must be true or false", sf.param)
+			}
+			lq.Where = append(lq.Where, sf.column+" = ?")
+			lq.Args = append(lq.Args, has)
+		}
+	}
+	// Company size only matches leads whose headcount a provider found.
+	if v := params.Get("minEmployees"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("minEmployees must be an integer")
+		}
+		lq.Where = append(lq.Where, "employee_count >= ? AND employee_count > 0")
+		lq.Args = append(lq.Args, n)
+	}
+	if v := params.Get("maxEmployees"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("maxEmployees must be an integer")
+		}
+		lq.Where = append(lq.Where, "employee_count <= ? AND employee_count > 0")
+		lq.Args = append(lq.Args, n)
+	}
+	// called matches leads whose card on the board has been called.
+	if v := params.Get("called"); v != "" {
+		called, err := strconv.ParseBool(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("called must be true or false")
+		}
+		lq.Where = append(lq.Where, "EXISTS (SELECT 1 FROM crm_leads cl WHERE cl.org_id = ? AND cl.lead_id = leads.id AND cl.deleted_at IS NULL AND cl.times_called > 0) = ?")
+		lq.Args = append(lq.Args, repo.Tenant().OrgID, called)
+	}
+
+	// new picks out a re-run's net-new leads, or the ones already known.
+	if v := params.Get("new"); v != "" {
+		isNew, err := strconv.ParseBool(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("new must be true or false")
+		}
+		lq.Where = append(lq.Where, "is_new = ?")
+		lq.Args = append(lq.Args, isNew)
+	}
+
+	if v := params.Get("callableNow"); v == "true" {
+		settings, err := getUserSettings(repo.ctx, repo.Tenant().UserID)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("failed to load calling hours")
+		}
+		window, now := settings.callingWindow(), time.Now()
+		lq.Filters = append(lq.Filters, func(l leads.Lead) bool {
+			return window.callableAt(l.Timezone, leads.ParseOpeningHours(l.OpenHours), now)
+		})
+	}
+
+	if v := params.Get("near"); v != "" {
+		center, err := parseLatLng(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("near must be in the form lat,lng")
+		}
+		radiusKm, err := strconv.ParseFloat(params.Get("radiusKm"), 64)
+		if err != nil || radiusKm <= 0 {
+			return leads.Query{}, fmt.Errorf("radiusKm must be a positive number when near is given")
+		}
+		box := boundingBox(center, radiusKm)
+		lq.Where = append(lq.Where, "latitude BETWEEN ? AND ?", "longitude BETWEEN ? AND ?")
+		lq.Args = append(lq.Args, box.minLat, box.maxLat, box.minLng, box.maxLng)
+		lq.Filters = append(lq.Filters, func(l leads.Lead) bool {
+			return haversineKm(center, latLng{*l.Latitude, *l.Longitude}) <= radiusKm
+		})
+	}
+
+	if v := params.Get("territory"); v != "" {
+		t, err := repo.Territory(v)
+		if err != nil {
+			return leads.Query{}, fmt.Errorf("unknown territory '%s'", v)
+		}
+		box := t.Polygon.bounds()
+		lq.Where = append(lq.Where, "latitude BETWEEN ? AND ?", "longitude BETWEEN ? AND ?")
+		lq.Args = append(lq.Args, box.minLat, box.maxLat, box.minLng, box.maxLng)
+		lq.Filters = append(lq.Filters, func(l leads.Lead) bool {
+			return t.Polygon.contains(latLng{*l.Latitude, *l.Longitude})
+		})
+	}
+
+	if v := params.Get("sort"); v != "" {
+		column, ok := leadSortColumns[v]
+		if !ok {
+			return leads.Query{}, fmt.Errorf("cannot sort by '%s'", v)
+		}
+		direction := "ASC"
+		if strings.EqualFold(params.Get("order"), "desc") {
+			direction = "DESC"
+		}
+		// Leads without a value always sort last, whichever the direction.
+		lq.OrderBy = fmt.Sprintf("%s IS NULL, %s %s", column, column, direction)
+	}
+
+	return lq, nil
+}
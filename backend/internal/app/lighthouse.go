@@ -0,0 +1,324 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- LIGHTHOUSE AUDITS ---
+//
+// A lead's site can be put through Lighthouse, by way of Google's PageSpeed
+// Insights API, for its four category scores (0 to 100) and the
+// opportunities that would speed it up most, which reps quote in the pitch
+// ("your site takes 4 seconds longer than it should to show anything").
+// The performance score is also the lead's and its card's pageSpeed. With
+// LIGHTHOUSE_AUDITS=true each lead with a website is audited after its
+// search finishes; PAGESPEED_API_KEY raises the API's rate limit.
+
+const PAGESPEED_API_URL = "https://www.googleapis.com/pagespeedonline/v5/runPagespeed"
+const LIGHTHOUSE_WORKERS = 2
+const LIGHTHOUSE_STRATEGY = "mobile"
+const LIGHTHOUSE_TOP_OPPORTUNITIES = 5
+
+var lighthouseEnabled = os.Getenv("LIGHTHOUSE_AUDITS") == "true"
+var pageSpeedAPIKey = os.Getenv("PAGESPEED_API_KEY")
+
+// A Lighthouse run routinely takes 20 seconds or more.
+var lighthouseClient = &http.Client{Timeout: 90 * time.Second}
+
+// lighthouseCategories maps the API's category IDs onto the audit's scores.
+var lighthouseCategories = []struct {
+	id    string
+	score func(*LighthouseAudit) **int
+}{
+	{"performance", func(a *LighthouseAudit) **int { return &a.Performance }},
+	{"seo", func(a *LighthouseAudit) **int { return &a.SEO }},
+	{"accessibility", func(a *LighthouseAudit) **int { return &a.Accessibility }},
+	{"best-practices", func(a *LighthouseAudit) **int { return &a.BestPractices }},
+}
+
+// LighthouseAudit is a lead's latest audit. A score is null when Lighthouse
+// couldn't work it out.
+type LighthouseAudit struct {
+	Performance   *int                    `json:"performance"`
+	SEO           *int                    `json:"seo"`
+	Accessibility *int                    `json:"accessibility"`
+	BestPractices *int                    `json:"bestPractices"`
+	Opportunities []LighthouseOpportunity `json:"opportunities"`
+	Strategy      string                  `json:"strategy"`
+	AuditedAt     time.Time               `json:"auditedAt"`
+}
+
+// LighthouseOpportunity is a change Lighthouse estimates would make the page
+// load faster, e.g. "Properly size images", most saving first.
+type LighthouseOpportunity struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	DisplayValue string `json:"displayValue"`
+	SavingsMs    int    `json:"savingsMs"`
+}
+
+// runLighthouse audits a website; tests replace it.
+var runLighthouse = pageSpeedInsights
+
+func pageSpeedInsights(ctx context.Context, website string) (LighthouseAudit, error) {
+	if !strings.HasPrefix(website, "http://") && !strings.HasPrefix(website, "https://") {
+		website = "http://" + website
+	}
+	params := url.Values{"url": {website}, "strategy": {LIGHTHOUSE_STRATEGY}}
+	for _, cat := range lighthouseCategories {
+		params.Add("category", cat.id)
+	}
+	if pageSpeedAPIKey != "" {
+		params.Set("key", pageSpeedAPIKey)
+	}
+	var resp struct {
+		LighthouseResult struct {
+			Categories map[string]struct {
+				Score *float64 `json:"score"`
+			} `json:"categories"`
+			Audits map[string]struct {
+				Title        string `json:"title"`
+				DisplayValue string `json:"displayValue"`
+				Details      struct {
+					Type             string  `json:"type"`
+					OverallSavingsMs float64 `json:"overallSavingsMs"`
+				} `json:"details"`
+			} `json:"audits"`
+		} `json:"lighthouseResult"`
+	}
+	if err := getJSON(ctx, lighthouseClient, PAGESPEED_API_URL+"?"+params.Encode(), &resp); err != nil {
+		return LighthouseAudit{}, fmt.Errorf("PageSpeed Insights: %w", err)
+	}
+
+	audit := LighthouseAudit{Strategy: LIGHTHOUSE_STRATEGY, Opportunities: []LighthouseOpportunity{}}
+	for _, cat := range lighthouseCategories {
+		if c, ok := resp.LighthouseResult.Categories[cat.id]; ok && c.Score != nil {
+			score := int(math.Round(*c.Score * 100))
+			*cat.score(&audit) = &score
+		}
+	}
+	for id, a := range resp.LighthouseResult.Audits {
+		if a.Details.Type == "opportunity" && a.Details.OverallSavingsMs >= 1 {
+			audit.Opportunities = append(audit.Opportunities, LighthouseOpportunity{
+				ID: id, Title: a.Title, DisplayValue: a.DisplayValue, SavingsMs: int(math.Round(a.Details.OverallSavingsMs)),
+			})
+		}
+	}
+	sort.Slice(audit.Opportunities, func(i, j int) bool {
+		if audit.Opportunities[i].SavingsMs != audit.Opportunities[j].SavingsMs {
+			return audit.Opportunities[i].SavingsMs > audit.Opportunities[j].SavingsMs
+		}
+		return audit.Opportunities[i].ID < audit.Opportunities[j].ID
+	})
+	if len(audit.Opportunities) > LIGHTHOUSE_TOP_OPPORTUNITIES {
+		audit.Opportunities = audit.Opportunities[:LIGHTHOUSE_TOP_OPPORTUNITIES]
+	}
+	return audit, nil
+}
+
+// auditLead runs Lighthouse on the lead's website and stores the result,
+// copying the performance score onto the lead and its cards.
+func auditLead(ctx context.Context, leadID, website string) (LighthouseAudit, error) {
+	audit, err := runLighthouse(ctx, website)
+	if err != nil {
+		return audit, err
+	}
+	audit.AuditedAt = time.Now().UTC()
+	opportunities, err := json.Marshal(audit.Opportunities)
+	if err != nil {
+		return audit, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return audit, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+        INSERT INTO lead_audits (lead_id, strategy, performance, seo, accessibility, best_practices, opportunities, audited_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(lead_id) DO UPDATE SET strategy = excluded.strategy, performance = excluded.performance, seo = excluded.seo,
+            accessibility = excluded.accessibility, best_practices = excluded.best_practices,
+            opportunities = excluded.opportunities, audited_at = excluded.audited_at
+    `, leadID, audit.Strategy, audit.Performance, audit.SEO, audit.Accessibility, audit.BestPractices, string(opportunities), audit.AuditedAt)
+	if err != nil {
+		return audit, err
+	}
+	if audit.Performance != nil {
+		if _, err := tx.Exec("UPDATE leads SET page_speed = ? WHERE id = ?", *audit.Performance, leadID); err != nil {
+			return audit, err
+		}
+		// Every board the lead is on changes with it.
+		rows, err := tx.Query("UPDATE crm_leads SET page_speed = ? WHERE lead_id = ? AND deleted_at IS NULL AND COALESCE(page_speed, -1) != ? RETURNING org_id", *audit.Performance, leadID, *audit.Performance)
+		if err != nil {
+			return audit, err
+		}
+		var orgs []int64
+		for rows.Next() {
+			var orgID int64
+			if err := rows.Scan(&orgID); err == nil {
+				orgs = append(orgs, orgID)
+			}
+		}
+		rows.Close()
+		for _, orgID := range orgs {
+			if _, err := newRepository(Tenant{OrgID: orgID}).WithTx(tx).Crm().BumpVersion(); err != nil {
+				return audit, err
+			}
+		}
+	}
+	return audit, tx.Commit()
+}
+
+// auditSearchLeads audits the search's leads with a website that haven't
+// been audited yet, a few at a time.
+func auditSearchLeads(searchID string) {
+	if !lighthouseEnabled {
+		return
+	}
+	rows, err := db.Query(`
+        SELECT id, website FROM leads
+        WHERE search_id = ? AND deleted_at IS NULL AND COALESCE(website, '') != ''
+          AND NOT EXISTS (SELECT 1 FROM lead_audits a WHERE a.lead_id = leads.id)
+    `, searchID)
+	if err != nil {
+		log.Printf("Failed to load leads to audit for search %s: %v", searchID, err)
+		return
+	}
+	type target struct{ id, website string }
+	var targets []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.id, &t.website); err != nil {
+			log.Printf("Error scanning lead to audit: %v", err)
+			continue
+		}
+		// A social profile isn't the business's own site.
+		if extractSocialProfiles(t.website).Empty() {
+			targets = append(targets, t)
+		}
+	}
+	rows.Close()
+
+	jobs := make(chan target)
+	var wg sync.WaitGroup
+	for i := 0; i < LIGHTHOUSE_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				if _, err := auditLead(context.Background(), t.id, t.website); err != nil {
+					log.Printf("Failed to audit website for lead %s: %v", t.id, err)
+				}
+			}
+		}()
+	}
+	for _, t := range targets {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+	log.Printf("Audited %d leads for search %s", len(targets), searchID)
+}
+
+// scanLighthouseAudit reads a lead_audits row.
+func scanLighthouseAudit(row store.RowScanner) (LighthouseAudit, error) {
+	var a LighthouseAudit
+	var performance, seo, accessibility, bestPractices sql.NullInt64
+	var opportunities string
+	if err := row.Scan(&a.Strategy, &performance, &seo, &accessibility, &bestPractices, &opportunities, &a.AuditedAt); err != nil {
+		return a, err
+	}
+	for _, s := range []struct {
+		v   sql.NullInt64
+		dst **int
+	}{{performance, &a.Performance}, {seo, &a.SEO}, {accessibility, &a.Accessibility}, {bestPractices, &a.BestPractices}} {
+		if s.v.Valid {
+			score := int(s.v.Int64)
+			*s.dst = &score
+		}
+	}
+	if err := json.Unmarshal([]byte(opportunities), &a.Opportunities); err != nil || a.Opportunities == nil {
+		a.Opportunities = []LighthouseOpportunity{}
+	}
+	return a, nil
+}
+
+func auditResponse(c *gin.Context, audit LighthouseAudit, err error) {
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The lead hasn't been audited yet"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load audit"})
+		return
+	}
+	c.JSON(http.StatusOK, audit)
+}
+
+func getLeadAuditHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	lead, err := repo.Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	audit, err := repo.LeadAudit(lead.ID)
+	auditResponse(c, audit, err)
+}
+
+// getCrmAuditHandler returns the audit of a card's lead, for the pitch.
+func getCrmAuditHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !repo.Crm().HasCard(c.Param("leadId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	audit, err := repo.LeadAudit(c.Param("leadId"))
+	auditResponse(c, audit, err)
+}
+
+// auditLeadHandler audits the lead's website now.
+func auditLeadHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	lead, err := repo.Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	if lead.Website == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The lead has no website"})
+		return
+	}
+
+	audit, err := auditLead(c.Request.Context(), lead.ID, lead.Website)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Lighthouse audit failed", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, audit)
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- LEAD LISTS ---
+//
+// A list combines several searches, e.g. every trades search in one city
+// for a quarter, into one set of leads. It's virtual: the leads stay in
+// their searches and the list is worked out when asked for, with
+// duplicates across the searches dropped, so it follows any later edits.
+
+const MAX_LIST_SEARCHES = 50
+
+type LeadList struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	SearchIDs []string  `json:"searchIds"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type leadListInput struct {
+	Name      string   `json:"name" binding:"required"`
+	SearchIDs []string `json:"searchIds" binding:"required"`
+}
+
+// validate checks the list's size and drops repeated searches.
+func (in *leadListInput) validate() error {
+	if len(in.SearchIDs) == 0 || len(in.SearchIDs) > MAX_LIST_SEARCHES {
+		return fmt.Errorf("searchIds must have between 1 and %d searches", MAX_LIST_SEARCHES)
+	}
+	seen := map[string]bool{}
+	unique := in.SearchIDs[:0]
+	for _, id := range in.SearchIDs {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	in.SearchIDs = unique
+	return nil
+}
+
+// dedupeLeads keeps the first lead for each business, by phone or domain,
+// and returns how many it dropped.
+func dedupeLeads(all []leads.Lead) ([]leads.Lead, int) {
+	index := newDuplicateIndex()
+	kept := []leads.Lead{}
+	for _, l := range all {
+		if _, _, dup := index.match(l.ID, l.Phone, l.Website); dup {
+			continue
+		}
+		index.add(l.ID, l.Phone, l.Website)
+		kept = append(kept, l)
+	}
+	return kept, len(all) - len(kept)
+}
+
+func getLeadListsHandler(c *gin.Context) {
+	lists, err := repoFrom(c).LeadLists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve lists"})
+		return
+	}
+	c.JSON(http.StatusOK, lists)
+}
+
+// getLeadListHandler returns a list with how many leads it holds once
+// duplicates are dropped.
+func getLeadListHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	list, err := repo.LeadList(c.Param("listId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load list"})
+		return
+	}
+	lq, err := buildLeadQueryIn(repo, list.SearchIDs, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load list"})
+		return
+	}
+	leads, err := leadService(c).List(lq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load list"})
+		return
+	}
+	leads, duplicates := dedupeLeads(leads)
+	c.JSON(http.StatusOK, gin.H{"id": list.ID, "name": list.Name, "searchIds": list.SearchIDs, "createdAt": list.CreatedAt,
+		"leads": len(leads), "duplicates": duplicates})
+}
+
+func createLeadListHandler(c *gin.Context) {
+	var input leadListInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create list"})
+		return
+	}
+	defer tx.Rollback()
+	list := LeadList{ID: uuid.New().String(), Name: input.Name, SearchIDs: input.SearchIDs, CreatedAt: time.Now()}
+	err = repoFrom(c).WithTx(tx).CreateLeadList(list)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "searchIds must all be your searches"})
+		return
+	}
+	if err != nil || tx.Commit() != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create list"})
+		return
+	}
+	c.JSON(http.StatusCreated, list)
+}
+
+func updateLeadListHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	listID := c.Param("listId")
+	var input leadListInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := repo.LeadList(listID); err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update list"})
+		return
+	}
+	defer tx.Rollback()
+	err = repo.WithTx(tx).UpdateLeadList(listID, input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "searchIds must all be your searches"})
+		return
+	}
+	if err != nil || tx.Commit() != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update list"})
+		return
+	}
+
+	list, err := repo.LeadList(listID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load list"})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func deleteLeadListHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteLeadList(c.Param("listId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete list"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getLeadListLeadsHandler lists the combined leads, taking the same
+// filters and sorting as a search's leads. When two leads are the same
+// business the first in that order is kept.
+func getLeadListLeadsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	list, err := repo.LeadList(c.Param("listId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load list"})
+		return
+	}
+	params, ok := applyView(c, repo, leadViewFilters)
+	if !ok {
+		return
+	}
+	lq, err := buildLeadQueryIn(repo, list.SearchIDs, params)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fields, err := requestedFields(c, leads.Lead{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	found, err := leadService(c).List(lq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve leads"})
+		return
+	}
+	found, _ = dedupeLeads(found)
+	body, err := fields.trimList(found)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve leads"})
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
@@ -0,0 +1,375 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"blueleads-backend/internal/auth"
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+)
+
+// --- LMCTL ---
+//
+// lmctl is the admin command line, for jobs that used to mean editing the
+// SQLite file by hand. Its binary is built from cmd/lmctl, but the commands
+// live here so they open the database through the same code and settings
+// (FIELD_ENCRYPTION_KEY and the rest) as the server:
+//
+//	lmctl create-user -email ann@example.com -name Ann -admin
+//	lmctl -db /srv/blueleads/leads.db requeue-searches -stuck-for 2h
+//
+// Every command migrates the database first, as the server does on start.
+
+type lmctlCommand struct {
+	usage   string
+	summary string
+	run     func(args []string, out io.Writer) error
+}
+
+var lmctlCommands = map[string]lmctlCommand{
+	"migrate":          {"", "bring the database schema up to date", lmctlMigrate},
+	"create-user":      {"-email EMAIL -name NAME [-password P] [-team ORG_ID] [-admin]", "add a user", lmctlCreateUser},
+	"reset-password":   {"-email EMAIL [-password P]", "set a user's password", lmctlResetPassword},
+	"requeue-searches": {"[-stuck-for 2h] [-failed] [SEARCH_ID...]", "have the server run searches again", lmctlRequeueSearches},
+	"export":           {"-org ORG_ID | -email EMAIL [-out FILE]", "write an organization's data as JSON", lmctlExport},
+	"backup":           {"", "snapshot the database into BACKUP_DIR", lmctlBackup},
+}
+
+// RunLmctl runs one lmctl command and returns the process exit code.
+func RunLmctl(args []string, out io.Writer) int {
+	global := lmctlFlags("", out)
+	global.StringVar(&DB_FILE, "db", DB_FILE, "the database file")
+	global.Usage = func() { lmctlUsage(out) }
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	args = global.Args()
+	if len(args) == 0 || args[0] == "help" {
+		lmctlUsage(out)
+		return 2
+	}
+	cmd, ok := lmctlCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(out, "lmctl: unknown command %q\n\n", args[0])
+		lmctlUsage(out)
+		return 2
+	}
+	initDB()
+	defer db.Close()
+	if err := cmd.run(args[1:], out); err != nil {
+		fmt.Fprintf(out, "lmctl %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func lmctlUsage(out io.Writer) {
+	names := make([]string, 0, len(lmctlCommands))
+	for name := range lmctlCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out, "usage: lmctl [-db FILE] COMMAND [FLAGS]")
+	for _, name := range names {
+		cmd := lmctlCommands[name]
+		fmt.Fprintf(out, "  %-17s %s\n", name, cmd.summary)
+		if cmd.usage != "" {
+			fmt.Fprintf(out, "  %-17s   %s\n", "", cmd.usage)
+		}
+	}
+}
+
+func lmctlFlags(name string, out io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(strings.TrimSpace("lmctl "+name), flag.ContinueOnError)
+	fs.SetOutput(out)
+	return fs
+}
+
+func lmctlMigrate(args []string, out io.Writer) error {
+	fmt.Fprintf(out, "%s is up to date\n", DB_FILE)
+	return nil
+}
+
+// randomPassword makes a password that passes checkPassword, for when an
+// admin doesn't pick one.
+func randomPassword() (string, error) {
+	for {
+		raw := make([]byte, 12)
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		password := base64.RawURLEncoding.EncodeToString(raw)
+		fe := fieldErrors{}
+		checkPassword(fe, "password", password)
+		if len(fe) == 0 {
+			return password, nil
+		}
+	}
+}
+
+// lmctlPassword checks the password given on the command line, or makes
+// one up and says so.
+func lmctlPassword(password string, out io.Writer) (string, error) {
+	if password == "" {
+		generated, err := randomPassword()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(out, "Password: %s\n", generated)
+		return generated, nil
+	}
+	fe := fieldErrors{}
+	checkPassword(fe, "password", password)
+	if msg, bad := fe["password"]; bad {
+		return "", fmt.Errorf("password %s", msg)
+	}
+	return password, nil
+}
+
+func lmctlCreateUser(args []string, out io.Writer) error {
+	fs := lmctlFlags("create-user", out)
+	email := fs.String("email", "", "the user's email address")
+	name := fs.String("name", "", "the user's name")
+	password := fs.String("password", "", "their password; one is generated and printed if left out")
+	team := fs.Int64("team", 0, "add them to this organization instead of giving them their own")
+	admin := fs.Bool("admin", false, "make them a site admin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !validEmail(*email) {
+		return errors.New("-email must be a valid email address")
+	}
+	fe := fieldErrors{}
+	checkLength(fe, "name", *name, 1, MAX_NAME_LENGTH)
+	if msg, bad := fe["name"]; bad {
+		return fmt.Errorf("-name %s", msg)
+	}
+	if *team != 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM organizations WHERE id = ?)", *team).Scan(&exists); err != nil || !exists {
+			return fmt.Errorf("there's no organization %d", *team)
+		}
+	}
+	pw, err := lmctlPassword(*password, out)
+	if err != nil {
+		return err
+	}
+	hashed, err := auth.HashPassword(pw)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var userID, orgID int64
+	if *team == 0 {
+		userID, orgID, err = createOwner(tx, *name, *email, hashed, *admin)
+	} else {
+		orgID = *team
+		userID, err = auth.NewRepository(context.Background(), tx).Create(auth.User{Name: *name, Email: *email, PasswordHash: hashed, OrgID: orgID, IsAdmin: *admin})
+	}
+	if err == auth.ErrEmailTaken {
+		return fmt.Errorf("a user with email %s already exists", *email)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Created user %d (%s) in organization %d\n", userID, *email, orgID)
+	return nil
+}
+
+func lmctlResetPassword(args []string, out io.Writer) error {
+	fs := lmctlFlags("reset-password", out)
+	email := fs.String("email", "", "the user's email address")
+	password := fs.String("password", "", "the new password; one is generated and printed if left out")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	users := auth.NewRepository(context.Background(), db)
+	user, err := users.ByEmail(*email)
+	if err == store.ErrNotFound {
+		return fmt.Errorf("there's no user with email %q", *email)
+	}
+	if err != nil {
+		return err
+	}
+	pw, err := lmctlPassword(*password, out)
+	if err != nil {
+		return err
+	}
+	hashed, err := auth.HashPassword(pw)
+	if err != nil {
+		return err
+	}
+	if err := users.SetPasswordHash(user.ID, hashed); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Reset the password of user %d (%s)\n", user.ID, *email)
+	return nil
+}
+
+// lmctlRequeueSearches hands searches back to the server to run again. It
+// only takes searches that never stored any leads: failed ones, and ones
+// whose scraper has been "In Progress" for longer than any should take.
+func lmctlRequeueSearches(args []string, out io.Writer) error {
+	fs := lmctlFlags("requeue-searches", out)
+	stuckFor := fs.Duration("stuck-for", 0, "requeue searches started at least this long ago that are still in progress")
+	failed := fs.Bool("failed", false, "requeue failed searches")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ids := fs.Args()
+	if len(ids) == 0 && *stuckFor == 0 && !*failed {
+		return errors.New("name the searches to requeue, or pass -stuck-for or -failed")
+	}
+
+	var conds []string
+	var condArgs []interface{}
+	if *stuckFor > 0 {
+		conds = append(conds, "(status = 'In Progress' AND COALESCE(started_at, created_at) <= ?)")
+		condArgs = append(condArgs, time.Now().Add(-*stuckFor))
+	}
+	if *failed {
+		conds = append(conds, "status = 'Failed'")
+	}
+	if len(ids) > 0 {
+		in, idArgs := store.InList(ids)
+		conds = append(conds, "(id IN ("+in+") AND status IN ('In Progress', 'Failed'))")
+		condArgs = append(condArgs, idArgs...)
+	}
+	res, err := db.Exec(`
+        UPDATE searches SET status = ?, started_at = NULL, finished_at = NULL, exit_code = NULL
+        WHERE deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM leads WHERE leads.search_id = searches.id)
+          AND (`+strings.Join(conds, " OR ")+")", append([]interface{}{searches.QUEUED}, condArgs...)...)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	fmt.Fprintf(out, "Requeued %d searches; the server starts them within %s\n", n, QUEUED_SEARCH_CHECK_INTERVAL)
+	return nil
+}
+
+// OrganizationExport is everything an organization has, as lmctl export
+// writes it.
+type OrganizationExport struct {
+	OrgID      int64             `json:"orgId"`
+	Name       string            `json:"name"`
+	ExportedAt time.Time         `json:"exportedAt"`
+	Searches   []searches.Search `json:"searches"`
+	Leads      []leads.Lead      `json:"leads"`
+	CrmLeads   []CrmLead         `json:"crmLeads"`
+	Columns    []crm.Column      `json:"columns"`
+	Calls      []Call            `json:"calls"`
+}
+
+func lmctlExport(args []string, out io.Writer) error {
+	fs := lmctlFlags("export", out)
+	orgID := fs.Int64("org", 0, "the organization to export")
+	email := fs.String("email", "", "export this user's organization")
+	outFile := fs.String("out", "", "write to this file instead of standard output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email != "" {
+		if err := db.QueryRow("SELECT org_id FROM users WHERE email = ?", *email).Scan(orgID); err != nil {
+			return fmt.Errorf("there's no user with email %q", *email)
+		}
+	}
+	if *orgID == 0 {
+		return errors.New("pass -org or -email")
+	}
+
+	export := OrganizationExport{OrgID: *orgID, ExportedAt: time.Now().UTC()}
+	var ownerID sql.NullInt64
+	if err := db.QueryRow("SELECT name, owner_id FROM organizations WHERE id = ?", *orgID).Scan(&export.Name, &ownerID); err != nil {
+		return fmt.Errorf("there's no organization %d", *orgID)
+	}
+	repo := newRepository(Tenant{OrgID: *orgID, UserID: ownerID.Int64})
+	searchIDs, err := db.Query("SELECT id FROM searches WHERE org_id = ? AND deleted_at IS NULL ORDER BY created_at", *orgID)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for searchIDs.Next() {
+		var id string
+		if err := searchIDs.Scan(&id); err != nil {
+			searchIDs.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	searchIDs.Close()
+	export.Searches = []searches.Search{}
+	for _, id := range ids {
+		s, err := repo.Searches().Get(id)
+		if err != nil {
+			return err
+		}
+		export.Searches = append(export.Searches, s)
+	}
+
+	// The sync log already knows every live lead, card, column and call.
+	export.Leads, export.CrmLeads, export.Columns, export.Calls = []leads.Lead{}, []CrmLead{}, []crm.Column{}, []Call{}
+	for cursor := int64(0); ; {
+		page, err := repo.SyncChanges(cursor, SYNC_MAX_LIMIT)
+		if err != nil {
+			return err
+		}
+		export.Leads = append(export.Leads, page.Leads...)
+		export.CrmLeads = append(export.CrmLeads, page.CrmLeads...)
+		export.Columns = append(export.Columns, page.Columns...)
+		export.Calls = append(export.Calls, page.Calls...)
+		if !page.HasMore {
+			break
+		}
+		cursor = page.Cursor
+	}
+
+	w := out
+	if *outFile != "" {
+		f, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		return err
+	}
+	if *outFile != "" {
+		fmt.Fprintf(out, "Exported %d searches, %d leads and %d CRM cards to %s\n", len(export.Searches), len(export.Leads), len(export.CrmLeads), *outFile)
+	}
+	return nil
+}
+
+func lmctlBackup(args []string, out io.Writer) error {
+	result, err := createBackup()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Backed up to %s (%d bytes)\n", result.File, result.Size)
+	return nil
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// --- LOGIN THROTTLING ---
+//
+// Failed logins are counted per email address and per client IP. After
+// each failure the next attempt has to wait twice as long as the last,
+// from one second up to a minute. Too many failures within
+// LOGIN_LOCKOUT_MINUTES lock the email or IP out for that long, and the
+// account's owner is emailed when their account is locked.
+
+var loginLockoutThreshold = envInt("LOGIN_LOCKOUT_THRESHOLD", 10)
+var loginIPLockoutThreshold = envInt("LOGIN_IP_LOCKOUT_THRESHOLD", 50)
+var loginLockout = time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+
+const LOGIN_MAX_DELAY = time.Minute
+
+func loginEmailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginDelay is how long to wait after the given number of failures.
+func loginDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	return min(time.Second<<min(failures-1, 6), LOGIN_MAX_DELAY)
+}
+
+// loginWait returns how long the client must wait before it may try to log
+// in as email again, or zero if it may try now.
+func loginWait(ctx context.Context, email, ip string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range []string{loginEmailKey(email), loginIPKey(ip)} {
+		var failures int
+		var lastFailure time.Time
+		var lockedUntil sql.NullTime
+		err := db.QueryRowContext(ctx, "SELECT failures, last_failure, locked_until FROM login_attempts WHERE key = ?", key).
+			Scan(&failures, &lastFailure, &lockedUntil)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(now) {
+			wait = max(wait, lockedUntil.Time.Sub(now))
+			continue
+		}
+		if next := lastFailure.Add(loginDelay(failures)); next.After(now) {
+			wait = max(wait, next.Sub(now))
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login against the email and the IP,
+// locking out either once it reaches its threshold. It detaches from the
+// request's cancellation, so abandoning a request doesn't stop it counting.
+func recordLoginFailure(ctx context.Context, email, ip string, now time.Time) {
+	ctx = context.WithoutCancel(ctx)
+	for _, k := range []struct {
+		key       string
+		threshold int
+	}{{loginEmailKey(email), loginLockoutThreshold}, {loginIPKey(ip), loginIPLockoutThreshold}} {
+		// Failures older than the lockout period no longer count.
+		var failures int
+		err := db.QueryRowContext(ctx, `
+            INSERT INTO login_attempts (key, failures, last_failure) VALUES (?, 1, ?)
+            ON CONFLICT (key) DO UPDATE SET
+                failures = CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END,
+                last_failure = excluded.last_failure
+            RETURNING failures
+        `, k.key, now, now.Add(-loginLockout)).Scan(&failures)
+		if err != nil {
+			log.Printf("Failed to record login failure for %s: %v", k.key, err)
+			continue
+		}
+		if failures < k.threshold {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "UPDATE login_attempts SET failures = 0, locked_until = ? WHERE key = ?", now.Add(loginLockout), k.key); err != nil {
+			log.Printf("Failed to lock out %s: %v", k.key, err)
+			continue
+		}
+		log.Printf("Locked out %s for %s after %d failed logins", k.key, loginLockout, failures)
+		if k.key == loginEmailKey(email) {
+			go notifyLockout(ctx, email, ip)
+		}
+	}
+}
+
+// clearLoginFailures forgets an email's failures after a successful login.
+// The IP's count stays, so one good account can't reset a guessing spree.
+func clearLoginFailures(ctx context.Context, email string) {
+	if _, err := db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = ?", loginEmailKey(email)); err != nil {
+		log.Printf("Failed to clear login failures for %s: %v", email, err)
+	}
+}
+
+// notifyLockout tells an account's owner it has been locked, if the
+// account exists.
+func notifyLockout(ctx context.Context, email, ip string) {
+	if !mailConfigured() {
+		return
+	}
+	var name string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM users WHERE email = ?", email).Scan(&name); err != nil {
+		return
+	}
+	body := fmt.Sprintf(`Hi %s,
+
+Your BlueLeads account was locked for %d minutes after %d failed sign-in
+attempts, the last from %s.
+
+If that was you, wait and try again. If it wasn't, someone may be trying
+to guess your password; once the lock ends, sign in and change it.
+`, name, int(loginLockout.Minutes()), loginLockoutThreshold, ip)
+	if err := sendMail(email, "Your BlueLeads account was locked", body); err != nil {
+		log.Printf("Failed to send lockout email to %s: %v", email, err)
+	}
+}
+
+// purgeLoginAttempts drops failures that no longer count and expired locks.
+func purgeLoginAttempts() {
+	now := time.Now().UTC()
+	_, err := db.Exec("DELETE FROM login_attempts WHERE last_failure < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-loginLockout), now)
+	if err != nil {
+		log.Printf("Failed to purge login attempts: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- OUTGOING EMAIL ---
+//
+// Mail goes out through an SMTP relay; net/smtp upgrades to TLS with
+// STARTTLS when the server offers it, so use the submission port (587).
+// Email sent on a user's behalf goes through their connected mail account
+// instead, when they have one (see mail_accounts.go).
+
+var smtpHost = os.Getenv("SMTP_HOST")
+var smtpPort = envOrDefault("SMTP_PORT", "587")
+var smtpUsername = os.Getenv("SMTP_USERNAME")
+var smtpPassword = os.Getenv("SMTP_PASSWORD")
+var mailFrom = envOrDefault("MAIL_FROM", "BlueLeads <no-reply@localhost>")
+
+func mailConfigured() bool {
+	return smtpHost != ""
+}
+
+// sendMail sends a plain-text email to a single recipient.
+func sendMail(to, subject, body string) error {
+	return sendMailWithHeaders(to, subject, body, nil)
+}
+
+// sendMailWithHeaders sends a plain-text email with extra headers, such
+// as List-Unsubscribe.
+func sendMailWithHeaders(to, subject, body string, headers map[string]string) error {
+	return sendMailFrom(mailFrom, to, subject, body, headers)
+}
+
+// sendMailFrom sends through the SMTP relay with the given From header,
+// whose address must be one the relay accepts.
+func sendMailFrom(from, to, subject, body string, headers map[string]string) error {
+	if !mailConfigured() {
+		return fmt.Errorf("SMTP_HOST is not set")
+	}
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)
+	}
+	msg := buildMessage(from, to, subject, body, headers)
+	return smtp.SendMail(net.JoinHostPort(smtpHost, smtpPort), auth, envelopeAddress(from), []string{to}, msg)
+}
+
+// buildMessage renders a plain-text email as RFC 5322 text, ready for an
+// SMTP relay or a mail provider's API.
+func buildMessage(from, to, subject, body string, headers map[string]string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if headers["Message-ID"] == "" {
+		fmt.Fprintf(&msg, "Message-ID: %s\r\n", newMessageID())
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, headers[name])
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return msg.Bytes()
+}
+
+// newMessageID returns a Message-ID header value for an outgoing email.
+func newMessageID() string {
+	host := smtpHost
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("<%s@%s>", uuid.New().String(), host)
+}
+
+// envelopeAddress extracts the bare address from a "Name <addr>" header.
+func envelopeAddress(header string) string {
+	if start := strings.LastIndex(header, "<"); start >= 0 {
+		return strings.TrimSuffix(header[start+1:], ">")
+	}
+	return header
+}
@@ -0,0 +1,449 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- CONNECTED MAIL ACCOUNTS ---
+//
+// A user can connect their own mail account with OAuth, so the emails the
+// platform sends for them (campaigns and test sends) come from their real
+// address through the provider's API rather than the shared SMTP relay.
+// Access tokens are refreshed as they expire. Providers limit how much an
+// account may send a day, so each account has a daily cap, counted per UTC
+// day; campaign emails over it wait for the next day instead of failing.
+// Providers with a calendar can also keep callbacks in it (see
+// calendar_sync.go).
+
+const MAIL_ACCOUNT_STATE_TTL = 10 * time.Minute
+
+// mailAccountCallbackURL is where providers send the browser back to after
+// the user grants access; it must be registered with each provider.
+var mailAccountCallbackURL = envOrDefault("MAIL_ACCOUNT_CALLBACK_URL", "http://localhost:8080/oauth/mail/callback")
+
+// mailAccountReturnURL is the frontend page the browser ends up on, with
+// #mailAccount=connected or #mailAccountError=<message>.
+var mailAccountReturnURL = envOrDefault("MAIL_ACCOUNT_RETURN_URL", "http://localhost:5173/settings")
+
+var mailAccountClient = &http.Client{Timeout: 20 * time.Second}
+
+var errMailAccountDailyLimit = errors.New("the mail account has reached its daily sending limit")
+var errMailAccountUnavailable = errors.New("the mail account can't be used")
+
+// mailProvider is a mail service users can connect an account at.
+type mailProvider struct {
+	name         string
+	authURL      string
+	tokenURL     string
+	scopes       string
+	authParams   url.Values
+	clientID     string
+	clientSecret string
+	// defaultDailyLimit is set on new accounts, comfortably inside the
+	// provider's own limit; maxDailyLimit is the most a user may raise it to.
+	defaultDailyLimit int
+	maxDailyLimit     int
+	// address returns the email address the token belongs to.
+	address func(ctx context.Context, accessToken string) (string, error)
+	// send sends an RFC 5322 message from the account.
+	send func(ctx context.Context, accessToken string, msg []byte) error
+	// calendar is nil for providers whose calendar isn't supported.
+	calendar *calendarAPI
+}
+
+var mailProviders = map[string]*mailProvider{
+	MAIL_GMAIL:     gmailProvider,
+	MAIL_MICROSOFT: microsoftProvider,
+}
+
+// MailAccount is a user's connected sending account.
+type MailAccount struct {
+	Provider   string `json:"provider"`
+	Email      string `json:"email"`
+	DailyLimit int    `json:"dailyLimit"`
+	SentToday  int    `json:"sentToday"`
+	LastError  string `json:"lastError"`
+	// CalendarSync keeps the user's callbacks in the account's calendar.
+	CalendarSync bool      `json:"calendarSync"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+
+	accessToken    string
+	refreshToken   string
+	tokenExpiresAt time.Time
+}
+
+// mailDay is the UTC day that daily sending limits count against.
+func mailDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// mailTokens is a provider token endpoint's answer.
+type mailTokens struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// requestMailTokens posts a grant to the provider's token endpoint.
+func requestMailTokens(ctx context.Context, p *mailProvider, form url.Values) (mailTokens, error) {
+	var tokens mailTokens
+	form.Set("client_id", p.clientID)
+	form.Set("client_secret", p.clientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokens, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := mailAccountClient.Do(req)
+	if err != nil {
+		return tokens, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return tokens, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if tokens.Error != "" {
+		return tokens, fmt.Errorf("token endpoint: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.AccessToken == "" {
+		return tokens, fmt.Errorf("token endpoint returned no access token")
+	}
+	return tokens, nil
+}
+
+// mailAPIError is a provider API's refusal of a request.
+type mailAPIError struct {
+	status int
+	detail string
+}
+
+func (e *mailAPIError) Error() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.status), e.detail)
+}
+
+// mailAPIStatus is the HTTP status a provider refused a request with, or 0.
+func mailAPIStatus(err error) int {
+	var apiErr *mailAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.status
+	}
+	return 0
+}
+
+// mailAPIRequest makes an authorized JSON call to a provider's API,
+// decoding the answer into out when it's given.
+func mailAPIRequest(ctx context.Context, method, endpoint, accessToken string, in, out interface{}) error {
+	var payload []byte
+	contentType := ""
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+	return mailAPIRawRequest(ctx, method, endpoint, accessToken, contentType, payload, out)
+}
+
+// mailAPIRawRequest is mailAPIRequest with a body that isn't JSON.
+func mailAPIRawRequest(ctx context.Context, method, endpoint, accessToken, contentType string, payload []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := mailAccountClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return &mailAPIError{status: resp.StatusCode, detail: strings.TrimSpace(string(detail))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// mailAccountToken returns a usable access token for the account,
+// refreshing it first when it's about to expire.
+func mailAccountToken(repo *Repository, p *mailProvider, account MailAccount) (string, error) {
+	if time.Now().Add(time.Minute).Before(account.tokenExpiresAt) {
+		return account.accessToken, nil
+	}
+	if account.refreshToken == "" {
+		return "", errors.New("no refresh token; reconnect the account")
+	}
+	tokens, err := requestMailTokens(repo.ctx, p, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {account.refreshToken},
+	})
+	if err != nil {
+		return "", err
+	}
+	// Some providers hand out a new refresh token each time.
+	if tokens.RefreshToken == "" {
+		tokens.RefreshToken = account.refreshToken
+	}
+	expiresAt := time.Now().UTC().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	if err := repo.SaveMailAccountTokens(tokens.AccessToken, tokens.RefreshToken, expiresAt); err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// canSendMail reports whether email can go out for the tenant user, either
+// through their mail account or the SMTP relay.
+func canSendMail(repo *Repository) bool {
+	if mailConfigured() {
+		return true
+	}
+	_, err := repo.MailAccount()
+	return err == nil
+}
+
+// sendUserMail sends an email for the tenant user: through their connected
+// mail account when they have one, otherwise through the SMTP relay. It
+// goes out under their agency name, if they've branded themselves.
+func sendUserMail(repo *Repository, to, subject, body string, headers map[string]string) error {
+	branding, err := repo.Branding()
+	if err != nil {
+		return err
+	}
+	account, err := repo.MailAccount()
+	if err == store.ErrNotFound {
+		return sendMailFrom(branding.sender(mailFrom), to, subject, body, headers)
+	}
+	if err != nil {
+		return err
+	}
+	p := mailProviders[account.Provider]
+	if p == nil {
+		return fmt.Errorf("%w: unknown provider %q", errMailAccountUnavailable, account.Provider)
+	}
+
+	day := mailDay(time.Now())
+	reserved, err := repo.ReserveMailAccountSend(day)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return errMailAccountDailyLimit
+	}
+	token, err := mailAccountToken(repo, p, account)
+	if err != nil {
+		repo.ReleaseMailAccountSend(day)
+		repo.SetMailAccountError(err.Error())
+		return fmt.Errorf("%w: %v", errMailAccountUnavailable, err)
+	}
+	if err := p.send(repo.ctx, token, buildMessage(branding.sender(account.Email), to, subject, body, headers)); err != nil {
+		repo.ReleaseMailAccountSend(day)
+		return err
+	}
+	return nil
+}
+
+// userMailSender sends campaign emails as the tenant user.
+func userMailSender(repo *Repository) campaignSender {
+	return func(to, subject, body string, headers map[string]string) error {
+		return sendUserMail(repo, to, subject, body, headers)
+	}
+}
+
+func getMailAccountHandler(c *gin.Context) {
+	account, err := repoFrom(c).MailAccount()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No email account is connected"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load email account"})
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+// updateMailAccountHandler changes the account's daily sending limit and
+// whether callbacks are synced to its calendar. Fields left out keep their
+// values.
+func updateMailAccountHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	account, err := repo.MailAccount()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No email account is connected"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load email account"})
+		return
+	}
+	var input struct {
+		DailyLimit   *int  `json:"dailyLimit"`
+		CalendarSync *bool `json:"calendarSync"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	p := mailProviders[account.Provider]
+	if p == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load email account"})
+		return
+	}
+	fe := fieldErrors{}
+	if input.DailyLimit != nil {
+		account.DailyLimit = *input.DailyLimit
+		fe.check(account.DailyLimit >= 1 && account.DailyLimit <= p.maxDailyLimit, "dailyLimit", fmt.Sprintf("must be between 1 and %d", p.maxDailyLimit))
+	}
+	if input.CalendarSync != nil {
+		account.CalendarSync = *input.CalendarSync
+		fe.check(!account.CalendarSync || p.calendar != nil, "calendarSync", "isn't available for "+p.name)
+	}
+	if fe.respond(c) {
+		return
+	}
+	if err := repo.UpdateMailAccountSettings(account.DailyLimit, account.CalendarSync); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email account"})
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+// deleteMailAccountHandler disconnects the account; email goes through
+// the SMTP relay again. Access can also be revoked at the provider.
+func deleteMailAccountHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteMailAccount()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No email account is connected"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disconnect email account"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// connectMailAccountHandler returns the provider's consent page for the
+// frontend to send the browser to.
+func connectMailAccountHandler(c *gin.Context) {
+	providerID := c.Param("provider")
+	p := mailProviders[providerID]
+	if p == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown email provider"})
+		return
+	}
+	if p.clientID == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Connecting this email provider isn't set up on this server"})
+		return
+	}
+	ctx := c.Request.Context()
+	tenant := tenantFrom(c)
+	now := time.Now().UTC()
+	state, verifier := randomSSOValue(), randomSSOValue()
+	db.ExecContext(ctx, "DELETE FROM mail_account_states WHERE expires_at <= ?", now)
+	if _, err := db.ExecContext(ctx, "INSERT INTO mail_account_states (state, user_id, org_id, provider, verifier, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		state, tenant.UserID, tenant.OrgID, providerID, verifier, now.Add(MAIL_ACCOUNT_STATE_TTL)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start connecting"})
+		return
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {mailAccountCallbackURL},
+		"scope":                 {p.scopes},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	for name, values := range p.authParams {
+		query[name] = values
+	}
+	c.JSON(http.StatusOK, gin.H{"url": p.authURL + "?" + query.Encode()})
+}
+
+// mailAccountFail sends the browser back to the frontend with an error to
+// show.
+func mailAccountFail(c *gin.Context, message string) {
+	c.Redirect(http.StatusFound, mailAccountReturnURL+"#mailAccountError="+url.QueryEscape(message))
+}
+
+// mailAccountCallbackHandler finishes connecting: it swaps the code for
+// tokens, looks up the account's address and saves the account.
+func mailAccountCallbackHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	if e := c.Query("error"); e != "" {
+		mailAccountFail(c, "Access to your email account wasn't granted: "+e)
+		return
+	}
+	var tenant Tenant
+	var providerID, verifier string
+	err := db.QueryRowContext(ctx, "DELETE FROM mail_account_states WHERE state = ? AND expires_at > ? RETURNING user_id, org_id, provider, verifier",
+		c.Query("state"), time.Now().UTC()).Scan(&tenant.UserID, &tenant.OrgID, &providerID, &verifier)
+	if err != nil {
+		mailAccountFail(c, "That link has expired; try connecting again")
+		return
+	}
+	p := mailProviders[providerID]
+	if p == nil {
+		mailAccountFail(c, "Unknown email provider")
+		return
+	}
+	tokens, err := requestMailTokens(ctx, p, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {c.Query("code")},
+		"redirect_uri":  {mailAccountCallbackURL},
+		"code_verifier": {verifier},
+	})
+	var address string
+	if err == nil {
+		address, err = p.address(ctx, tokens.AccessToken)
+	}
+	if err != nil {
+		log.Printf("Connecting a %s account for user %d failed: %v", p.name, tenant.UserID, err)
+		mailAccountFail(c, "Couldn't connect your "+p.name+" account")
+		return
+	}
+	if tokens.RefreshToken == "" {
+		mailAccountFail(c, p.name+" didn't allow offline access; remove BlueLeads from your account's connected apps and try again")
+		return
+	}
+	account := MailAccount{
+		Provider:       providerID,
+		Email:          address,
+		DailyLimit:     p.defaultDailyLimit,
+		accessToken:    tokens.AccessToken,
+		refreshToken:   tokens.RefreshToken,
+		tokenExpiresAt: time.Now().UTC().Add(time.Duration(tokens.ExpiresIn) * time.Second),
+	}
+	if err := newRepository(tenant).SaveMailAccount(account); err != nil {
+		mailAccountFail(c, "Failed to save your email account")
+		return
+	}
+	c.Redirect(http.StatusFound, mailAccountReturnURL+"#mailAccount=connected")
+}
@@ -0,0 +1,2237 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/auth"
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/scraper"
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+)
+
+// --- CONFIGURATION ---
+var DB_FILE = "leads.db"
+
+// JWT_SECRET signs session tokens. It comes from the JWT_SECRET environment
+// variable; loadJWTSecret refuses to start the server without one.
+var JWT_SECRET []byte
+
+const DEFAULT_SOURCE = "google_maps"
+
+// SHUTDOWN_GRACE_PERIOD is how long in-flight requests get to finish on
+// shutdown before their contexts are cancelled.
+const SHUTDOWN_GRACE_PERIOD = 15 * time.Second
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// searchWork tracks scrapes and the notifications and enrichment that
+// follow them. Shutdown gives them the grace period too, and tests wait for
+// them before closing the database.
+var searchWork sync.WaitGroup
+
+// goSearchWork runs fn in the background as part of searchWork.
+func goSearchWork(fn func()) {
+	searchWork.Add(1)
+	go func() {
+		defer searchWork.Done()
+		fn()
+	}()
+}
+
+// --- DATABASE SETUP ---
+var db *sql.DB
+
+func initDB() {
+	var err error
+	initFieldEncryption()
+	loadSuppressionKey()
+	db, err = sql.Open(DB_DRIVER, DB_FILE)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	checkEncryption()
+
+	_, err = db.Exec("PRAGMA journal_mode=WAL;")
+	if err != nil {
+		log.Fatal("Failed to set WAL mode:", err)
+	}
+
+	createTables()
+	migrateTables()
+	seedPlans()
+	initFullTextIndex()
+	sealExistingFields()
+	rekeySuppressions()
+	initSyncLog()
+}
+
+func createTables() {
+	err := auth.Migrate(db)
+	if err != nil {
+		log.Fatal("Failed to create users table:", err)
+	}
+
+	if err := searches.Migrate(db); err != nil {
+		log.Fatal("Failed to create search tables:", err)
+	}
+	if err := leads.Migrate(db); err != nil {
+		log.Fatal("Failed to create lead tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS user_settings (
+            user_id INTEGER PRIMARY KEY,
+            google_places_api_key TEXT NOT NULL DEFAULT '',
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create user_settings table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS territories (
+            id TEXT PRIMARY KEY,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            assignee TEXT NOT NULL DEFAULT '',
+            polygon TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create territories table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS lead_audits (
+            lead_id TEXT PRIMARY KEY,
+            strategy TEXT NOT NULL,
+            performance INTEGER,
+            seo INTEGER,
+            accessibility INTEGER,
+            best_practices INTEGER,
+            opportunities TEXT NOT NULL DEFAULT '[]',
+            audited_at DATETIME NOT NULL,
+            FOREIGN KEY (lead_id) REFERENCES leads (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create lead_audits table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS brandings (
+            user_id INTEGER PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            agency_name TEXT NOT NULL DEFAULT '',
+            primary_color TEXT NOT NULL DEFAULT '',
+            accent_color TEXT NOT NULL DEFAULT '',
+            footer_text TEXT NOT NULL DEFAULT '',
+            logo TEXT NOT NULL DEFAULT '',
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (user_id) REFERENCES users (id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create brandings table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS share_links (
+            id TEXT PRIMARY KEY,
+            token TEXT NOT NULL UNIQUE,
+            org_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            created_by INTEGER NOT NULL,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME,
+            revoked_at DATETIME,
+            views INTEGER NOT NULL DEFAULT 0,
+            last_viewed_at DATETIME,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (created_by) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS share_links_org_lead ON share_links (org_id, lead_id);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create share_links table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS idempotency_keys (
+            user_id INTEGER NOT NULL,
+            idempotency_key TEXT NOT NULL,
+            request_hash TEXT NOT NULL,
+            status_code INTEGER,
+            response_body BLOB,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (user_id, idempotency_key),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create idempotency_keys table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS organizations (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create organizations table:", err)
+	}
+
+	if err := crm.Migrate(db); err != nil {
+		log.Fatal("Failed to create board tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS plans (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL,
+            stripe_price_id TEXT NOT NULL DEFAULT '',
+            searches_per_month INTEGER NOT NULL DEFAULT 0,
+            max_leads INTEGER NOT NULL DEFAULT 0,
+            max_concurrent_scrapes INTEGER NOT NULL DEFAULT 0,
+            team_seats INTEGER NOT NULL DEFAULT 1,
+            integrations INTEGER NOT NULL DEFAULT 0
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create plans table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS stripe_events (
+            id TEXT PRIMARY KEY,
+            received_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create stripe_events table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS push_subscriptions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            endpoint TEXT NOT NULL UNIQUE,
+            p256dh TEXT NOT NULL,
+            auth TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create push_subscriptions table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS crm_calls (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            disposition TEXT NOT NULL,
+            notes TEXT NOT NULL DEFAULT '',
+            called_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS crm_calls_org_lead ON crm_calls (org_id, lead_id);
+        CREATE INDEX IF NOT EXISTS crm_calls_org_called_at ON crm_calls (org_id, called_at);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create crm_calls table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS disposition_rules (
+            org_id INTEGER NOT NULL,
+            disposition TEXT NOT NULL,
+            column_id TEXT NOT NULL DEFAULT '',
+            PRIMARY KEY (org_id, disposition),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create disposition_rules table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS call_scripts (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            body TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create call_scripts table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS message_templates (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            channel TEXT NOT NULL,
+            subject TEXT NOT NULL DEFAULT '',
+            body TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create message_templates table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS campaigns (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            template_id TEXT NOT NULL,
+            filter_column TEXT NOT NULL DEFAULT '',
+            filter_tag TEXT NOT NULL DEFAULT '',
+            filter_status TEXT NOT NULL DEFAULT '',
+            hourly_limit INTEGER NOT NULL,
+            start_at DATETIME,
+            status TEXT NOT NULL,
+            subject TEXT NOT NULL DEFAULT '',
+            body TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            started_at DATETIME,
+            completed_at DATETIME,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+        CREATE TABLE IF NOT EXISTS campaign_recipients (
+            campaign_id TEXT NOT NULL,
+            lead_id TEXT NOT NULL,
+            company_name TEXT NOT NULL DEFAULT '',
+            email TEXT NOT NULL DEFAULT '',
+            status TEXT NOT NULL,
+            reason TEXT NOT NULL DEFAULT '',
+            error TEXT NOT NULL DEFAULT '',
+            sent_at DATETIME,
+            PRIMARY KEY (campaign_id, lead_id),
+            FOREIGN KEY (campaign_id) REFERENCES campaigns (id)
+        );
+        CREATE INDEX IF NOT EXISTS campaign_recipients_campaign_status ON campaign_recipients (campaign_id, status);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create campaign tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS mailboxes (
+            user_id INTEGER PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            host TEXT NOT NULL,
+            port INTEGER NOT NULL,
+            security TEXT NOT NULL,
+            username TEXT NOT NULL,
+            password TEXT NOT NULL,
+            folder TEXT NOT NULL,
+            uid_validity INTEGER NOT NULL DEFAULT 0,
+            last_uid INTEGER NOT NULL DEFAULT 0,
+            last_polled_at DATETIME,
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY (user_id) REFERENCES users (id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+        CREATE TABLE IF NOT EXISTS email_replies (
+            org_id INTEGER NOT NULL,
+            message_id TEXT NOT NULL,
+            campaign_id TEXT NOT NULL,
+            lead_id TEXT NOT NULL,
+            subject TEXT NOT NULL DEFAULT '',
+            received_at DATETIME NOT NULL,
+            PRIMARY KEY (org_id, message_id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create mailbox tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS mail_accounts (
+            user_id INTEGER PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            provider TEXT NOT NULL,
+            email TEXT NOT NULL,
+            access_token TEXT NOT NULL,
+            refresh_token TEXT NOT NULL,
+            token_expires_at DATETIME NOT NULL,
+            daily_limit INTEGER NOT NULL,
+            sent_today INTEGER NOT NULL DEFAULT 0,
+            sent_day TEXT NOT NULL DEFAULT '',
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY (user_id) REFERENCES users (id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+        CREATE TABLE IF NOT EXISTS mail_account_states (
+            state TEXT PRIMARY KEY,
+            user_id INTEGER NOT NULL,
+            org_id INTEGER NOT NULL,
+            provider TEXT NOT NULL,
+            verifier TEXT NOT NULL,
+            expires_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create mail account tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS calendar_events (
+            user_id INTEGER NOT NULL,
+            org_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            event_id TEXT NOT NULL,
+            synced_for DATETIME,
+            PRIMARY KEY (user_id, lead_id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create calendar events table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS booking_pages (
+            user_id INTEGER PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            slug TEXT NOT NULL UNIQUE,
+            title TEXT NOT NULL,
+            intro TEXT NOT NULL DEFAULT '',
+            duration_minutes INTEGER NOT NULL,
+            availability TEXT NOT NULL,
+            min_notice_hours INTEGER NOT NULL,
+            horizon_days INTEGER NOT NULL,
+            enabled INTEGER NOT NULL DEFAULT 1,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (user_id) REFERENCES users (id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+        CREATE TABLE IF NOT EXISTS bookings (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL DEFAULT '',
+            name TEXT NOT NULL,
+            email TEXT NOT NULL,
+            company TEXT NOT NULL DEFAULT '',
+            phone TEXT NOT NULL DEFAULT '',
+            notes TEXT NOT NULL DEFAULT '',
+            starts_at DATETIME NOT NULL,
+            ends_at DATETIME NOT NULL,
+            event_id TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS bookings_user_start ON bookings (user_id, starts_at);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create booking tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS meetings (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            title TEXT NOT NULL,
+            starts_at DATETIME NOT NULL,
+            ends_at DATETIME NOT NULL,
+            location TEXT NOT NULL DEFAULT '',
+            attendees TEXT NOT NULL DEFAULT '[]',
+            outcome TEXT NOT NULL,
+            notes TEXT NOT NULL DEFAULT '',
+            booking_id TEXT NOT NULL DEFAULT '',
+            created_by INTEGER NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (created_by) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS meetings_org_starts ON meetings (org_id, starts_at);
+        CREATE INDEX IF NOT EXISTS meetings_org_lead ON meetings (org_id, lead_id);
+        CREATE TABLE IF NOT EXISTS calendar_feeds (
+            user_id INTEGER PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            token TEXT NOT NULL UNIQUE,
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY (user_id) REFERENCES users (id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create meeting tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS tasks (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            title TEXT NOT NULL,
+            notes TEXT NOT NULL DEFAULT '',
+            lead_id TEXT NOT NULL DEFAULT '',
+            assignee INTEGER NOT NULL,
+            due_date TEXT NOT NULL DEFAULT '',
+            done_at DATETIME,
+            created_by INTEGER NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (assignee) REFERENCES users (id),
+            FOREIGN KEY (created_by) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS tasks_org_assignee ON tasks (org_id, assignee, done_at);
+        CREATE INDEX IF NOT EXISTS tasks_org_lead ON tasks (org_id, lead_id);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create tasks table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS segments (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            conditions TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS segments_org ON segments (org_id);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create segments table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS saved_views (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            filters TEXT NOT NULL DEFAULT '{}',
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS saved_views_org_user ON saved_views (org_id, user_id);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create saved_views table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS crm_note_revisions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            org_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            edited_by INTEGER NOT NULL,
+            edited_at DATETIME NOT NULL,
+            previous_notes TEXT NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (edited_by) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS crm_note_revisions_org_lead ON crm_note_revisions (org_id, lead_id);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create crm_note_revisions table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS crm_activity (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            org_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            user_id INTEGER NOT NULL,
+            kind TEXT NOT NULL,
+            detail TEXT NOT NULL DEFAULT 'null',
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS crm_activity_org_lead ON crm_activity (org_id, lead_id, created_at);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create crm_activity table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS crm_lead_tags (
+            org_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            tag TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (org_id, lead_id, tag),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create crm_lead_tags table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS automation_rules (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            enabled INTEGER NOT NULL DEFAULT 1,
+            conditions TEXT NOT NULL,
+            action TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create automation_rules table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS automation_rule_runs (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            org_id INTEGER NOT NULL,
+            rule_id TEXT NOT NULL,
+            lead_id TEXT NOT NULL,
+            action TEXT NOT NULL,
+            executed_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+        CREATE INDEX IF NOT EXISTS automation_rule_runs_org ON automation_rule_runs (org_id, executed_at);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create automation_rule_runs table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS email_verification_usage (
+            user_id INTEGER NOT NULL,
+            provider TEXT NOT NULL,
+            period TEXT NOT NULL,
+            checked INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY (user_id, provider, period),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create email_verification_usage table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS dialer_sessions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            started_at DATETIME NOT NULL,
+            ended_at DATETIME,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS dialer_sessions_org_user ON dialer_sessions (org_id, user_id, started_at);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create dialer_sessions table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS crm_undo_moves (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            from_column TEXT NOT NULL,
+            to_column TEXT NOT NULL,
+            column_changed_at DATETIME,
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+        CREATE INDEX IF NOT EXISTS crm_undo_moves_org_user ON crm_undo_moves (org_id, user_id, id);
+    `)
+	if err != nil {
+		log.Fatal("Failed to create crm_undo_moves table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS crm_board_snapshots (
+            org_id INTEGER NOT NULL,
+            day TEXT NOT NULL,
+            column_id TEXT NOT NULL,
+            cards INTEGER NOT NULL,
+            PRIMARY KEY (org_id, day, column_id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create crm_board_snapshots table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS lead_duplicate_ignores (
+            org_id INTEGER NOT NULL,
+            cluster_id TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (org_id, cluster_id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create lead_duplicate_ignores table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS lead_lists (
+            id TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (org_id) REFERENCES organizations (id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create lead_lists table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS lead_list_searches (
+            list_id TEXT NOT NULL,
+            search_id TEXT NOT NULL,
+            position INTEGER NOT NULL,
+            PRIMARY KEY (list_id, search_id),
+            FOREIGN KEY (list_id) REFERENCES lead_lists (id),
+            FOREIGN KEY (search_id) REFERENCES searches (id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create lead_list_searches table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS login_attempts (
+            key TEXT PRIMARY KEY,
+            failures INTEGER NOT NULL DEFAULT 0,
+            last_failure DATETIME NOT NULL,
+            locked_until DATETIME
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create login_attempts table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS booking_attempts (
+            ip TEXT PRIMARY KEY,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            window_start DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create booking_attempts table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS invitations (
+            id TEXT PRIMARY KEY,
+            code_hash TEXT NOT NULL UNIQUE,
+            org_id INTEGER REFERENCES organizations (id) ON DELETE CASCADE,
+            email TEXT,
+            created_by INTEGER NOT NULL REFERENCES users (id),
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL,
+            used_by INTEGER REFERENCES users (id),
+            used_at DATETIME
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create invitations table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS sso_configs (
+            org_id INTEGER PRIMARY KEY REFERENCES organizations (id) ON DELETE CASCADE,
+            issuer TEXT NOT NULL,
+            client_id TEXT NOT NULL,
+            client_secret TEXT NOT NULL,
+            groups_claim TEXT NOT NULL DEFAULT 'groups',
+            group_roles TEXT NOT NULL DEFAULT '{}',
+            default_role TEXT NOT NULL DEFAULT 'member',
+            updated_at DATETIME NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS sso_domains (
+            domain TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL REFERENCES organizations (id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS sso_domain_claims (
+            org_id INTEGER NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+            domain TEXT NOT NULL,
+            token TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (org_id, domain)
+        );
+        CREATE TABLE IF NOT EXISTS sso_states (
+            state TEXT PRIMARY KEY,
+            org_id INTEGER NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+            nonce TEXT NOT NULL,
+            verifier TEXT NOT NULL,
+            expires_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create single sign-on tables:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS suppressions (
+            org_id INTEGER NOT NULL REFERENCES organizations (id),
+            kind TEXT NOT NULL,
+            value_hash TEXT NOT NULL,
+            reason TEXT NOT NULL DEFAULT '',
+            created_by INTEGER REFERENCES users (id),
+            created_at DATETIME NOT NULL,
+            PRIMARY KEY (org_id, value_hash)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create suppressions table:", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS feature_flags (
+            key TEXT PRIMARY KEY,
+            description TEXT NOT NULL DEFAULT '',
+            enabled BOOLEAN NOT NULL DEFAULT 0,
+            rollout_percent INTEGER NOT NULL DEFAULT 0,
+            updated_at DATETIME NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS feature_flag_users (
+            flag_key TEXT NOT NULL REFERENCES feature_flags (key) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+            enabled BOOLEAN NOT NULL,
+            PRIMARY KEY (flag_key, user_id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create feature flag tables:", err)
+	}
+}
+
+// migrateTables adds columns introduced after the initial schema to existing databases.
+func migrateTables() {
+	addColumnIfMissing("territories", "org_id", "INTEGER REFERENCES organizations (id)")
+	addColumnIfMissing("user_settings", "timezone", "TEXT NOT NULL DEFAULT 'UTC'")
+	addColumnIfMissing("user_settings", "digest_enabled", "INTEGER NOT NULL DEFAULT 1")
+	addColumnIfMissing("user_settings", "digest_hour", "INTEGER NOT NULL DEFAULT 8")
+	addColumnIfMissing("user_settings", "stale_after_days", "INTEGER NOT NULL DEFAULT 7")
+	addColumnIfMissing("user_settings", "last_digest_date", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "email_verifier", "TEXT NOT NULL DEFAULT 'smtp'")
+	addColumnIfMissing("user_settings", "email_verifier_api_key", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "email_verifier_monthly_limit", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("user_settings", "phone_lookup_provider", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "phone_lookup_api_key", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "search_webhook_url", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "search_webhook_secret", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "calling_hours_start", "INTEGER NOT NULL DEFAULT 9")
+	addColumnIfMissing("user_settings", "calling_hours_end", "INTEGER NOT NULL DEFAULT 17")
+	addColumnIfMissing("user_settings", "call_on_weekends", "BOOLEAN NOT NULL DEFAULT 0")
+	addColumnIfMissing("crm_calls", "duration_seconds", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("crm_calls", "session_id", "INTEGER")
+	addColumnIfMissing("user_settings", "weekly_summary", "TEXT NOT NULL DEFAULT 'off'")
+	addColumnIfMissing("user_settings", "last_weekly_summary", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "daily_dial_goal", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("organizations", "owner_id", "INTEGER REFERENCES users (id)")
+	addColumnIfMissing("organizations", "leaderboard_enabled", "BOOLEAN NOT NULL DEFAULT 1")
+	addColumnIfMissing("organizations", "statuses_seeded", "BOOLEAN NOT NULL DEFAULT 0")
+	addColumnIfMissing("campaign_recipients", "unsubscribe_token", "TEXT")
+	addColumnIfMissing("campaign_recipients", "unsubscribed_at", "DATETIME")
+	// Recipients queued before unsubscribe links existed still need one.
+	if _, err := db.Exec("UPDATE campaign_recipients SET unsubscribe_token = LOWER(HEX(RANDOMBLOB(24))) WHERE unsubscribe_token IS NULL"); err != nil {
+		log.Fatal("Failed to backfill campaign_recipients.unsubscribe_token:", err)
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS campaign_recipients_unsubscribe_token ON campaign_recipients (unsubscribe_token)"); err != nil {
+		log.Fatal("Failed to index campaign_recipients.unsubscribe_token:", err)
+	}
+	addColumnIfMissing("campaign_recipients", "message_id", "TEXT")
+	addColumnIfMissing("campaign_recipients", "replied_at", "DATETIME")
+	addColumnIfMissing("mail_accounts", "calendar_sync", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("tasks", "repeat_every", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("tasks", "repeat_unit", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("tasks", "skipped", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("tasks", "next_task_id", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("campaigns", "filter_segment", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "firmographics_provider", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("user_settings", "firmographics_api_key", "TEXT NOT NULL DEFAULT ''")
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS campaign_recipients_message_id ON campaign_recipients (message_id)"); err != nil {
+		log.Fatal("Failed to index campaign_recipients.message_id:", err)
+	}
+	addColumnIfMissing("sso_domains", "verified_at", "DATETIME")
+	addColumnIfMissing("suppressions", "keyed", "INTEGER NOT NULL DEFAULT 0")
+	// SSO domains saved before DNS verification existed go back to being
+	// claims, so their owners have to prove control before SSO resumes.
+	if _, err := db.Exec(`
+        INSERT OR IGNORE INTO sso_domain_claims (org_id, domain, token)
+        SELECT org_id, domain, LOWER(HEX(RANDOMBLOB(24))) FROM sso_domains WHERE verified_at IS NULL
+    `); err != nil {
+		log.Fatal("Failed to move unverified SSO domains to claims:", err)
+	}
+	if _, err := db.Exec("DELETE FROM sso_domains WHERE verified_at IS NULL"); err != nil {
+		log.Fatal("Failed to remove unverified SSO domains:", err)
+	}
+	backfillTenants()
+	if err := crm.Backfill(db); err != nil {
+		log.Fatal("Failed to backfill boards:", err)
+	}
+
+	// Organizations made before owners were recorded belong to their first user.
+	if _, err := db.Exec("UPDATE organizations SET owner_id = (SELECT MIN(id) FROM users WHERE users.org_id = organizations.id) WHERE owner_id IS NULL"); err != nil {
+		log.Fatal("Failed to backfill organizations.owner_id:", err)
+	}
+
+	// Leads moved since the activity log existed have their last move on
+	// record; older ones fall back to their last update.
+	if _, err := db.Exec(`
+        UPDATE crm_leads SET column_changed_at = COALESCE(
+            (SELECT MAX(created_at) FROM crm_activity a
+             WHERE a.org_id = crm_leads.org_id AND a.lead_id = crm_leads.lead_id AND a.kind IN ('added', 'column_move')),
+            updated_at)
+        WHERE column_changed_at IS NULL
+    `); err != nil {
+		log.Fatal("Failed to backfill crm_leads.column_changed_at:", err)
+	}
+
+	// Leads stored before lead_emails/lead_phones existed only kept one of each.
+	if _, err := db.Exec("INSERT OR IGNORE INTO lead_emails (lead_id, email) SELECT id, email FROM leads WHERE email IS NOT NULL AND email != ''"); err != nil {
+		log.Fatal("Failed to backfill lead_emails:", err)
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO lead_phones (lead_id, phone) SELECT id, phone FROM leads WHERE phone IS NOT NULL AND phone != ''"); err != nil {
+		log.Fatal("Failed to backfill lead_phones:", err)
+	}
+}
+
+func addColumnIfMissing(table, column, definition string) {
+	if err := store.AddColumnIfMissing(db, table, column, definition); err != nil {
+		log.Fatal("Failed to migrate schema: ", err)
+	}
+}
+
+// --- MODELS ---
+type RegisterInput struct {
+	Name         string `json:"name" binding:"required"`
+	Email        string `json:"email" binding:"required"`
+	Password     string `json:"password" binding:"required"`
+	CaptchaToken string `json:"captchaToken"`
+	InviteCode   string `json:"inviteCode"`
+}
+
+type LoginInput struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// CrmLead is a card on the board.
+type CrmLead = crm.Card
+
+// --- AUTHENTICATION ---
+
+// loadJWTSecret reads JWT_SECRET from the environment and stops the server
+// if it's missing or too short to resist guessing.
+func loadJWTSecret() {
+	secret, err := auth.LoadSecret(os.Getenv("JWT_SECRET"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	JWT_SECRET = secret
+}
+
+// authService signs people in against the database, with JWT_SECRET.
+func authService(ctx context.Context) auth.Service {
+	return auth.NewService(auth.NewRepository(ctx, db), JWT_SECRET)
+}
+
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			return
+		}
+
+		session, err := authService(c.Request.Context()).Session(strings.TrimPrefix(authHeader, "Bearer "))
+		switch err {
+		case nil:
+		case auth.ErrInvalidToken:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		case auth.ErrNoUserID:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
+			return
+		case auth.ErrRevoked:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked; please sign in again"})
+			return
+		default:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Account is disabled"})
+			return
+		}
+		c.Set("session", session)
+		c.Set("userID", session.UserID)
+		c.Set("tenant", session.Tenant)
+		if session.ImpersonatedBy != 0 {
+			c.Set("impersonatedBy", session.ImpersonatedBy)
+		}
+		if session.SSO {
+			c.Set("ssoSession", true)
+		}
+		c.Next()
+	}
+}
+
+// adminMiddleware must run after authMiddleware. Admin rights come from the
+// database on every request, never from the token, so revoked admins lose
+// access at once. Impersonation and single sign-on sessions never get admin
+// access, even when the user is an admin.
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, _ := c.MustGet("session").(auth.Session)
+		isAdmin, err := authService(c.Request.Context()).IsAdmin(session)
+		if err != nil || !isAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// promoteAdmins grants admin rights to the comma-separated ADMIN_EMAILS.
+func promoteAdmins() {
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		if _, err := db.Exec("UPDATE users SET is_admin = 1 WHERE email = ?", email); err != nil {
+			log.Printf("Failed to promote %s to admin: %v", email, err)
+		}
+	}
+}
+
+// --- HANDLERS ---
+func registerHandler(c *gin.Context) {
+	var input RegisterInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	checkLength(fe, "name", input.Name, 1, MAX_NAME_LENGTH)
+	fe.check(validEmail(input.Email), "email", "must be a valid email address")
+	checkPassword(fe, "password", input.Password)
+	if captchaEnabled() {
+		fe.check(input.CaptchaToken != "", "captchaToken", "is required")
+	}
+	if fe.respond(c) {
+		return
+	}
+	// A team invitation works in open mode too; in invite-only mode one is
+	// required.
+	var invitation Invitation
+	if input.InviteCode != "" || inviteOnly {
+		if input.InviteCode == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Registration is by invitation only"})
+			return
+		}
+		var err error
+		invitation, err = findInvitation(c.Request.Context(), input.InviteCode, time.Now().UTC())
+		if err == store.ErrNotFound {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This invitation code isn't valid or has expired"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check invitation"})
+			return
+		}
+		if invitation.Email != "" && !strings.EqualFold(invitation.Email, input.Email) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This invitation is for a different email address"})
+			return
+		}
+	}
+	if captchaEnabled() {
+		ok, err := verifyCaptcha(c.Request.Context(), input.CaptchaToken, c.ClientIP())
+		if err != nil {
+			log.Printf("Failed to verify captcha: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Couldn't check the captcha; try again"})
+			return
+		}
+		fe.check(ok, "captchaToken", "was not accepted; solve the captcha again")
+		if fe.respond(c) {
+			return
+		}
+	}
+
+	hashedPassword, err := auth.HashPassword(input.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	defer tx.Rollback()
+
+	var orgID int64
+	if invitation.TeamID != nil {
+		orgID = *invitation.TeamID
+	} else if orgID, err = createOrganization(tx, input.Name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	userID, err := auth.NewRepository(c.Request.Context(), tx).Create(auth.User{Name: input.Name, Email: input.Email, PasswordHash: hashedPassword, OrgID: orgID})
+	if err == auth.ErrEmailTaken {
+		c.JSON(http.StatusConflict, gin.H{"error": "User with this email already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	if invitation.ID != "" {
+		err := redeemInvitation(tx, invitation.ID, userID, time.Now().UTC())
+		if err == store.ErrNotFound {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This invitation code isn't valid or has expired"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+			return
+		}
+	}
+	if invitation.TeamID == nil {
+		if _, err := tx.Exec("UPDATE organizations SET owner_id = ? WHERE id = ?", userID, orgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	token, _ := authService(c.Request.Context()).Issue(userID)
+	c.JSON(http.StatusCreated, gin.H{"token": token, "user": gin.H{"id": userID, "name": input.Name, "email": input.Email}})
+}
+
+func loginHandler(c *gin.Context) {
+	var input LoginInput
+	if !bindJSON(c, &input) {
+		return
+	}
+
+	ip, now := c.ClientIP(), time.Now().UTC()
+	wait, err := loginWait(c.Request.Context(), input.Email, ip, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Too many failed attempts; try again in %d seconds", seconds), "retryAfter": seconds})
+		return
+	}
+
+	users := authService(c.Request.Context())
+	user, err := users.Authenticate(input.Email, input.Password)
+	if err == auth.ErrBadCredentials {
+		recordLoginFailure(c.Request.Context(), input.Email, ip, now)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if err != nil && err != auth.ErrDisabled {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	clearLoginFailures(c.Request.Context(), input.Email)
+	if err == auth.ErrDisabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	token, _ := users.Issue(user.ID)
+	c.JSON(http.StatusOK, gin.H{"token": token, "user": gin.H{"id": user.ID, "name": user.Name, "email": user.Email}})
+}
+
+func startSearchHandler(c *gin.Context) {
+	var input struct {
+		Keyword  string `json:"keyword" binding:"required"`
+		Source   string `json:"source"`
+		Location string `json:"location"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	checkLength(fe, "keyword", input.Keyword, 1, MAX_KEYWORD_LENGTH)
+	checkLength(fe, "location", input.Location, 0, MAX_LOCATION_LENGTH)
+	if fe.respond(c) {
+		return
+	}
+
+	if input.Source == "" {
+		input.Source = DEFAULT_SOURCE
+	}
+	launchSearch(c, searches.Search{Keyword: input.Keyword, Source: input.Source, Location: strings.TrimSpace(input.Location)})
+}
+
+// launchSearch checks the source and the user's quota, then records search
+// and starts scraping it in the background.
+func launchSearch(c *gin.Context, search searches.Search) {
+	userID, _ := c.Get("userID")
+	provider, ok := leadProviders.Get(search.Source)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown lead source '%s'", search.Source)})
+		return
+	}
+	if info := provider.Info(); info.RequiresLocation && search.Location == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A location is required for %s searches", info.Name)})
+		return
+	}
+	if v, ok := provider.(scraper.Validator); ok {
+		if err := v.Validate(c.Request.Context(), userID.(int64)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	status, message, err := checkSearchQuota(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check usage"})
+		return
+	}
+	if status != http.StatusOK {
+		if status == http.StatusTooManyRequests {
+			c.Header("Retry-After", "60")
+		}
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	search.ID = uuid.New().String()
+	search.UserID = userID.(int64)
+	search.Status = "In Progress"
+	search.CreatedAt = time.Now()
+	search.Labels = []searches.Label{}
+	if e, ok := provider.(scraper.CostEstimator); ok {
+		search.EstimatedCost = e.EstimateCost()
+	}
+
+	if err := repoFrom(c).Searches().Insert(search); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create search job", "details": err.Error()})
+		return
+	}
+
+	goSearchWork(func() { runScraper(search) })
+	c.JSON(http.StatusAccepted, search)
+}
+
+func getSearchesHandler(c *gin.Context) {
+	q, err := searches.ParseListQuery(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list, total, err := searchService(c).List(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve searches"})
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Header("X-Page", strconv.Itoa(q.Page()))
+	c.Header("X-Page-Size", strconv.Itoa(q.PageSize()))
+	c.JSON(http.StatusOK, list)
+}
+
+func getLeadsForSearchHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	searchID := c.Param("searchId")
+
+	if !repo.Searches().Owns(searchID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	params, ok := applyView(c, repo, leadViewFilters)
+	if !ok {
+		return
+	}
+	lq, err := buildLeadQuery(repo, searchID, params)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fields, err := requestedFields(c, leads.Lead{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	found, err := leadService(c).List(lq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve leads"})
+		return
+	}
+	body, err := fields.trimList(found)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve leads"})
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+func getCrmHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	fields, err := requestedFields(c, CrmLead{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	params, ok := applyView(c, repo, boardViewFilters)
+	if !ok {
+		return
+	}
+	filter, err := buildCrmFilter(params)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	lanesBy := params.Get("lanes")
+	if lanesBy != "" && !validSwimlaneGrouping(lanesBy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "lanes must be one of " + strings.Join(swimlaneGroupings, ", ")})
+		return
+	}
+
+	version, err := repo.Crm().Version()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch CRM data", "details": err.Error()})
+		return
+	}
+	// The ETag is the board's version whatever the filters, since writes
+	// check it with If-Match. A saved view can change without the board
+	// changing, so a board seen through one is always sent in full.
+	etag := crmETag(version)
+	c.Header("ETag", etag)
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) && c.Query("view") == "" {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	board, err := repo.FilteredCrmLeads(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch CRM data", "details": err.Error()})
+		return
+	}
+	// Hot cards lead their column.
+	sort.SliceStable(board, func(i, j int) bool { return priorityRank(board[i].Priority) < priorityRank(board[j].Priority) })
+
+	boardColumns, err := repo.Crm().Columns()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch CRM data", "details": err.Error()})
+		return
+	}
+	statuses, err := repo.Crm().Statuses()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch CRM data", "details": err.Error()})
+		return
+	}
+
+	crmLeads := make(map[string]CrmLead)
+	columns := make(map[string][]string, len(boardColumns))
+	for _, col := range boardColumns {
+		columns[col.ID] = []string{}
+	}
+	for _, cl := range board {
+		crmLeads[cl.ID] = cl
+		if _, ok := columns[cl.ColumnID]; ok {
+			columns[cl.ColumnID] = append(columns[cl.ColumnID], cl.ID)
+		}
+	}
+
+	if fields.has("emails") || fields.has("phones") {
+		leadIDs := make([]string, 0, len(crmLeads))
+		for id := range crmLeads {
+			leadIDs = append(leadIDs, id)
+		}
+		contacts, err := repo.Leads().Contacts(leadIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch lead contacts", "details": err.Error()})
+			return
+		}
+		for id, cl := range crmLeads {
+			cl.Emails = contacts.Emails[id]
+			cl.Phones = contacts.Phones[id]
+			crmLeads[id] = cl
+		}
+	}
+	leadsByID := make(map[string]interface{}, len(crmLeads))
+	for id, cl := range crmLeads {
+		trimmed, err := fields.trim(cl)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch CRM data", "details": err.Error()})
+			return
+		}
+		leadsByID[id] = trimmed
+	}
+
+	columnsByID := gin.H{}
+	columnOrder := make([]string, 0, len(boardColumns))
+	for _, col := range boardColumns {
+		columnsByID[col.ID] = gin.H{"id": col.ID, "title": col.Title, "leadIds": columns[col.ID], "wipLimit": col.WIPLimit, "wipPolicy": col.WIPPolicy}
+		columnOrder = append(columnOrder, col.ID)
+	}
+
+	response := gin.H{
+		"leads":       leadsByID,
+		"columns":     columnsByID,
+		"columnOrder": columnOrder,
+		"statuses":    statuses,
+		"version":     version,
+	}
+	if lanesBy != "" {
+		names, err := repo.MemberNames()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch CRM data", "details": err.Error()})
+			return
+		}
+		response["lanes"] = crmSwimlanes(lanesBy, board, boardColumns, names)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func addLeadsToCrmHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var leadsToAdd []leads.Lead
+	if err := c.ShouldBindJSON(&leadsToAdd); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	txRepo := repo.WithTx(tx)
+	duplicates, err := txRepo.AddCrmLeads(leadsToAdd)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add lead to CRM"})
+		return
+	}
+
+	version := crmChanged(c, txRepo)
+	tx.Commit()
+	c.JSON(http.StatusOK, gin.H{"message": "Leads added to CRM successfully", "version": version, "skippedDuplicates": duplicates})
+}
+
+func updateCrmStateHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		LeadID      string `json:"leadId"`
+		NewColumnID string `json:"newColumnId"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !repo.Crm().HasColumn(input.NewColumnID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown column '%s'", input.NewColumnID)})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	wip, err := txRepo.Crm().CheckWIP(input.NewColumnID, input.LeadID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update CRM state"})
+		return
+	}
+	if wip.Rejects() {
+		c.JSON(http.StatusConflict, gin.H{"error": wip.Message(), "wipLimit": wip.Limit})
+		return
+	}
+
+	err = txRepo.MoveCrmLead(input.LeadID, input.NewColumnID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update CRM state"})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update CRM state"})
+		return
+	}
+	response := gin.H{"message": "CRM state updated", "version": version}
+	if wip.Exceeded() {
+		response["warning"] = wip.Message()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func updateCrmLeadHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	leadID := c.Param("leadId")
+
+	var updatedLead CrmLead
+	if err := c.ShouldBindJSON(&updatedLead); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	err = txRepo.UpdateCrmLead(leadID, updatedLead)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update lead details", "details": err.Error()})
+		return
+	}
+	crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update lead details", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, updatedLead)
+}
+
+// --- SCRAPER LOGIC ---
+func runScraper(search searches.Search) {
+	provider, ok := leadProviders.Get(search.Source)
+	if !ok {
+		failSearch(search.ID, "No lead provider registered for source '%s' (search %s)", search.Source, search.ID)
+		return
+	}
+
+	searchLogf(search.ID, "Starting %s search for search ID %s, keyword: '%s'", search.Source, search.ID, search.Keyword)
+	if _, err := db.Exec("UPDATE searches SET started_at = ? WHERE id = ?", time.Now(), search.ID); err != nil {
+		log.Printf("Failed to record start of search %s: %v", search.ID, err)
+	}
+	scrapedLeads, err := provider.Search(context.Background(), scraper.Query{
+		SearchID: search.ID,
+		UserID:   search.UserID,
+		Keyword:  search.Keyword,
+		Location: search.Location,
+		Log:      searchLog(search.ID),
+	})
+	if err != nil {
+		failSearch(search.ID, "Lead provider %s failed for search %s: %v", search.Source, search.ID, err)
+		return
+	}
+
+	searchLogf(search.ID, "Found %d leads for search %s", len(scrapedLeads), search.ID)
+	storeScrapedLeads(search.ID, scrapedLeads)
+}
+
+// *** FIXED SCRAPER PROCESSING FUNCTION ***
+func storeScrapedLeads(searchID string, scrapedLeads []scraper.Lead) {
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		failSearch(searchID, "Failed to begin transaction for search %s: %v", searchID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	scrapedLeads, suppressed, err := withoutSuppressedLeads(tx, searchID, scrapedLeads)
+	if err != nil {
+		failSearch(searchID, "Failed to check search %s against the suppression list: %v", searchID, err)
+		return
+	}
+	if suppressed > 0 {
+		searchLogf(searchID, "Left out %d leads on the suppression list", suppressed)
+	}
+
+	// Bad rows are skipped rather than failing the whole search; a few
+	// of their errors are kept so the user can see what went wrong.
+	ingestStart := time.Now()
+	skipped := 0
+	samples := []string{}
+	stored := storeLeadBatches(tx, searchID, scrapedLeads, func(sl scraper.Lead, err error) {
+		skipped++
+		if len(samples) < SEARCH_ERROR_SAMPLES {
+			samples = append(samples, fmt.Sprintf("%q: %v", sl.Title, err))
+		}
+	})
+	rawSamples, _ := json.Marshal(samples)
+
+	if stored == 0 && skipped > 0 {
+		tx.Rollback()
+		if _, err := db.Exec("UPDATE searches SET error_count = ?, error_samples = ? WHERE id = ?", skipped, string(rawSamples), searchID); err != nil {
+			log.Printf("Failed to record errors for search %s: %v", searchID, err)
+		}
+		logSkippedLeads(searchID, skipped, samples)
+		failSearch(searchID, "None of the %d leads for search %s could be stored", skipped, searchID)
+		return
+	}
+
+	if err := markNewLeads(tx, searchID); err != nil {
+		tx.Rollback()
+		failSearch(searchID, "Failed to compare search %s with its previous runs: %v", searchID, err)
+		return
+	}
+
+	status := "Completed"
+	if skipped > 0 {
+		status = "Completed with warnings"
+	}
+	ingestSeconds := time.Since(ingestStart).Seconds()
+	_, err = tx.Exec("UPDATE searches SET status = ?, leads_found = ?, error_count = ?, error_samples = ?, ingest_seconds = ?, finished_at = ? WHERE id = ?",
+		status, stored, skipped, string(rawSamples), ingestSeconds, time.Now(), searchID)
+	if err != nil {
+		log.Printf("Failed to update search status for %s: %v", searchID, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		failSearch(searchID, "Failed to commit transaction for search %s: %v", searchID, err)
+		return
+	}
+
+	logSkippedLeads(searchID, skipped, samples)
+	searchLogf(searchID, "Successfully processed and stored %d leads for search %s in %.2fs (%.0f leads/s)", stored, searchID, ingestSeconds, searches.LeadsPerSecond(stored, ingestSeconds))
+	goSearchWork(func() { notifySearchFinished(searchID) })
+	goSearchWork(func() { notifySearchWebhook(searchID) })
+	goSearchWork(func() { postProcessSearch(searchID) })
+}
+
+// MAX_LEAD_INSERT_BATCH_SIZE keeps a batch's leads INSERT under SQLite's
+// limit of 32766 bound parameters.
+const MAX_LEAD_INSERT_BATCH_SIZE = 2000
+
+// leadInsertBatchSize is how many leads go into each INSERT statement.
+var leadInsertBatchSize = envInt("LEAD_INSERT_BATCH_SIZE", 500)
+
+// storeLeadBatches stores the leads a batch at a time. A batch that fails
+// is retried a row at a time, so only the rows that are actually bad are
+// skipped; each skipped row's error is passed to skip.
+func storeLeadBatches(tx *sql.Tx, searchID string, leads []scraper.Lead, skip func(scraper.Lead, error)) int {
+	size := leadInsertBatchSize
+	if size < 1 || size > MAX_LEAD_INSERT_BATCH_SIZE {
+		size = MAX_LEAD_INSERT_BATCH_SIZE
+	}
+	stored := 0
+	for start := 0; start < len(leads); start += size {
+		batch := leads[start:min(start+size, len(leads))]
+		err := storeLeadBatch(tx, searchID, batch)
+		if err == nil {
+			stored += len(batch)
+			continue
+		}
+		if len(batch) == 1 {
+			skip(batch[0], err)
+			continue
+		}
+		for i := range batch {
+			if err := storeLeadBatch(tx, searchID, batch[i:i+1]); err != nil {
+				skip(batch[i], err)
+				continue
+			}
+			stored++
+		}
+	}
+	return stored
+}
+
+// storeLeadBatch inserts leads and their contacts with one multi-row
+// statement per table, under a savepoint so a failure undoes the whole
+// batch and nothing else.
+func storeLeadBatch(tx *sql.Tx, searchID string, leads []scraper.Lead) error {
+	if _, err := tx.Exec("SAVEPOINT lead_batch"); err != nil {
+		return err
+	}
+	leadArgs := make([]interface{}, 0, len(leads)*16)
+	var emailArgs, phoneArgs []interface{}
+	for _, sl := range leads {
+		leadID := uuid.New().String()
+		email := ""
+		if len(sl.Emails) > 0 {
+			email = sl.Emails[0]
+		}
+		var lat, lng interface{}
+		if sl.Latitude != 0 || sl.Longitude != 0 {
+			lat, lng = sl.Latitude, sl.Longitude
+		}
+		var openHours interface{}
+		if len(sl.OpenHours) > 0 {
+			raw, _ := json.Marshal(sl.OpenHours)
+			openHours = string(raw)
+		}
+		socials := extractSocialProfiles(sl.Website)
+		leadArgs = append(leadArgs, leadID, searchID, sl.Title, seal(sl.Phone), sl.Website, seal(email), sl.Rating, sl.ReviewCount, sl.Category, sl.Address, lat, lng, openHours, socials.Facebook, socials.Instagram, socials.LinkedIn)
+		for _, e := range sl.Emails {
+			if e = strings.TrimSpace(e); e != "" {
+				emailArgs = append(emailArgs, leadID, seal(e))
+			}
+		}
+		if p := strings.TrimSpace(sl.Phone); p != "" {
+			phoneArgs = append(phoneArgs, leadID, seal(p))
+		}
+	}
+
+	err := insertRows(tx, "INSERT INTO leads (id, search_id, company_name, phone, website, email, rating, review_count, category, address, latitude, longitude, open_hours, facebook_url, instagram_url, linkedin_url) VALUES ",
+		"(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", 16, leadArgs)
+	if err == nil {
+		err = insertRows(tx, "INSERT OR IGNORE INTO lead_emails (lead_id, email, type) VALUES ", "(?, ?, 'scraped')", 2, emailArgs)
+	}
+	if err == nil {
+		err = insertRows(tx, "INSERT OR IGNORE INTO lead_phones (lead_id, phone, type) VALUES ", "(?, ?, 'main')", 2, phoneArgs)
+	}
+	if err != nil {
+		tx.Exec("ROLLBACK TO lead_batch")
+		tx.Exec("RELEASE lead_batch")
+		return err
+	}
+	_, err = tx.Exec("RELEASE lead_batch")
+	return err
+}
+
+// insertRows runs a multi-row INSERT of args, width values per row, split
+// into statements of at most MAX_LEAD_INSERT_BATCH_SIZE rows.
+func insertRows(tx *sql.Tx, prefix, row string, width int, args []interface{}) error {
+	for start := 0; start < len(args); start += MAX_LEAD_INSERT_BATCH_SIZE * width {
+		chunk := args[start:min(start+MAX_LEAD_INSERT_BATCH_SIZE*width, len(args))]
+		rows := strings.TrimSuffix(strings.Repeat(row+",", len(chunk)/width), ",")
+		if _, err := tx.Exec(prefix+rows, chunk...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateSearchStatus(searchID, status string) {
+	_, err := db.Exec("UPDATE searches SET status = ?, finished_at = ? WHERE id = ?", status, time.Now(), searchID)
+	if err != nil {
+		log.Printf("Failed to update search status to '%s' for search ID %s: %v", status, searchID, err)
+		return
+	}
+	if status == "Failed" {
+		goSearchWork(func() { notifySearchFinished(searchID) })
+		goSearchWork(func() { notifySearchWebhook(searchID) })
+	}
+}
+
+// failInterruptedSearches marks searches that were still running when the
+// server last stopped as failed; nothing will ever finish them.
+func failInterruptedSearches() {
+	res, err := db.Exec("UPDATE searches SET status = 'Failed' WHERE status = 'In Progress'")
+	if err != nil {
+		log.Printf("Failed to clean up interrupted searches: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Marked %d interrupted searches as failed", n)
+	}
+}
+
+const QUEUED_SEARCH_CHECK_INTERVAL = 30 * time.Second
+
+// startQueuedSearches starts scraping each queued search, claiming it first
+// so two servers on one database don't both run it.
+func startQueuedSearches() {
+	rows, err := db.Query("SELECT id FROM searches WHERE status = ? AND deleted_at IS NULL", searches.QUEUED)
+	if err != nil {
+		log.Printf("Failed to load queued searches: %v", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		res, err := db.Exec("UPDATE searches SET status = 'In Progress' WHERE id = ? AND status = ?", id, searches.QUEUED)
+		if err != nil {
+			log.Printf("Failed to claim queued search %s: %v", id, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		search, err := searches.Scan(db.QueryRow("SELECT "+searches.SELECT_COLUMNS+" FROM searches WHERE id = ?", id))
+		if err == nil {
+			err = db.QueryRow("SELECT user_id FROM searches WHERE id = ?", id).Scan(&search.UserID)
+		}
+		if err != nil {
+			failSearch(id, "Failed to load queued search %s: %v", id, err)
+			continue
+		}
+		searchLogf(id, "Requeued search %s is starting again", id)
+		goSearchWork(func() { runScraper(search) })
+	}
+}
+
+// --- MAIN ---
+
+// Main runs the API server until it's told to stop.
+func Main() {
+	restoreFrom := flag.String("restore", "", "replace the database with this backup file before starting")
+	genVAPID := flag.Bool("generate-vapid-keys", false, "print a new VAPID key pair for push notifications and exit")
+	demo := flag.Bool("demo", false, "add a demo account with sample searches, leads and a worked CRM board")
+	flag.Parse()
+
+	if *genVAPID {
+		if err := generateVAPIDKeys(); err != nil {
+			log.Fatalf("Failed to generate VAPID keys: %v", err)
+		}
+		return
+	}
+
+	if *restoreFrom != "" {
+		if err := restoreDatabase(*restoreFrom); err != nil {
+			log.Fatalf("Failed to restore database from %s: %v", *restoreFrom, err)
+		}
+		log.Printf("Restored database from %s", *restoreFrom)
+	}
+
+	loadJWTSecret()
+	checkCaptchaConfig()
+	initDB()
+	defer db.Close()
+	promoteAdmins()
+	failInterruptedSearches()
+	if *demo {
+		if err := seedDemoData(); err != nil {
+			log.Fatalf("Failed to load demo data: %v", err)
+		}
+	}
+
+	if !registerMockProvider() {
+		if _, err := exec.LookPath(scraper.GOOGLE_MAPS_COMMAND); err != nil {
+			log.Printf("'%s' command not found; the Google Maps source is disabled. Install gosom/google-maps-scraper and ensure it's in your PATH to enable it, or set SCRAPER_PROVIDER=mock for made-up results.", scraper.GOOGLE_MAPS_COMMAND)
+		} else {
+			leadProviders.Register(scraper.GoogleMapsProvider{})
+		}
+	}
+	for _, p := range scraper.DirectoryProviders() {
+		leadProviders.Register(p)
+	}
+	leadProviders.Register(scraper.NewPlacesProvider(placesAPIKey))
+	registerEmailVerifiers()
+	registerPhoneLookupProviders()
+	registerFirmographicsProviders()
+
+	startBackgroundJobs()
+
+	// Every request's context derives from this one, so cancelling it
+	// aborts whatever queries are still running at shutdown.
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Addr:        ":" + envOrDefault("PORT", "8080"),
+		Handler:     newRouter(),
+		BaseContext: func(net.Listener) context.Context { return requestsCtx },
+	}
+	servers := []*http.Server{srv}
+	// With built-in TLS the API moves to HTTPS_PORT, and PORT only answers
+	// ACME challenges and redirects to HTTPS.
+	if m := autocertManager(); m != nil {
+		srv.Addr = ":" + envOrDefault("HTTPS_PORT", "443")
+		srv.TLSConfig = m.TLSConfig()
+		servers = append(servers, &http.Server{Addr: ":" + envOrDefault("PORT", "80"), Handler: m.HTTPHandler(nil)})
+	}
+
+	stopCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, s := range servers {
+		go serve(s)
+	}
+	<-stopCtx.Done()
+
+	log.Printf("Shutting down; waiting up to %s for requests to finish", SHUTDOWN_GRACE_PERIOD)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_GRACE_PERIOD)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Cancelling requests still running after the grace period: %v", err)
+		}
+	}
+	finished := make(chan struct{})
+	go func() {
+		searchWork.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-shutdownCtx.Done():
+		log.Printf("Stopping with searches still running; they'll be marked failed at the next start")
+	}
+}
+
+// newRouter sets up the middleware and every route. It's separate from
+// main so tests can drive the handlers through httptest.
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.MaxMultipartMemory = multipartMemory
+	// X-Forwarded-For is only believed from TRUSTED_PROXIES, so clients
+	// can't pick their own IP to dodge login throttling.
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	r.Use(gin.Logger(), gzipMiddleware(), localizeErrorsMiddleware(), recoveryMiddleware())
+
+	r.Use(cors.New(corsConfig()))
+	r.Use(bodyLimitMiddleware(), timeoutMiddleware())
+
+	r.GET("/captcha", getCaptchaHandler)
+	r.GET("/registration", getRegistrationHandler)
+	r.POST("/sso/start", startSSOHandler)
+	r.GET("/sso/callback", ssoCallbackHandler)
+	r.POST("/register", registerHandler)
+	r.POST("/login", loginHandler)
+	r.POST("/stripe/webhook", stripeWebhookHandler)
+	r.GET("/u/:token", unsubscribePageHandler)
+	r.POST("/u/:token", unsubscribeHandler)
+	r.GET("/oauth/mail/callback", mailAccountCallbackHandler)
+	r.GET("/book/:slug", bookingPageHandler)
+	r.POST("/book/:slug", bookHandler)
+	r.GET("/ical/:token", calendarFeedHandler)
+	r.GET("/share/:token", sharePageHandler)
+
+	r.GET("/api/crm/ws", socketTokenMiddleware(), authMiddleware(), crmSocketHandler)
+
+	api := r.Group("/api")
+	api.Use(authMiddleware(), uuidParamsMiddleware(), crmBroadcastMiddleware())
+	{
+		api.POST("/searches", idempotencyMiddleware(), startSearchHandler)
+		api.GET("/searches", getSearchesHandler)
+		api.GET("/searches/:searchId", getSearchHandler)
+		api.PUT("/searches/:searchId", updateSearchHandler)
+		api.POST("/searches/:searchId/archive", archiveSearchHandler)
+		api.POST("/searches/:searchId/unarchive", unarchiveSearchHandler)
+		api.DELETE("/searches/:searchId", deleteSearchHandler)
+		api.GET("/search-labels", getSearchLabelsHandler)
+		api.PUT("/search-labels/:label", updateSearchLabelHandler)
+		api.POST("/searches/:searchId/rerun", idempotencyMiddleware(), rerunSearchHandler)
+		api.DELETE("/searches/:searchId/leads/:leadId", deleteLeadHandler)
+		api.GET("/searches/:searchId/stats", getSearchStatsHandler)
+		api.GET("/searches/:searchId/logs", getSearchLogsHandler)
+		api.POST("/searches/:searchId/leads/:leadId/guess-emails", guessLeadEmailsHandler)
+		api.POST("/searches/:searchId/leads/:leadId/verify-emails", verifyLeadEmailsHandler)
+		api.POST("/searches/:searchId/leads/:leadId/lookup-phones", lookupLeadPhonesHandler)
+		api.GET("/verifiers", getVerifiersHandler)
+		api.GET("/phone-lookup-providers", getPhoneLookupProvidersHandler)
+		api.POST("/searches/:searchId/leads/:leadId/firmographics", lookupLeadFirmographicsHandler)
+		api.GET("/firmographics-providers", getFirmographicsProvidersHandler)
+		api.GET("/searches/:searchId/leads/:leadId/screenshot", getLeadScreenshotHandler)
+		api.POST("/searches/:searchId/leads/:leadId/screenshot", captureLeadScreenshotHandler)
+		api.GET("/searches/:searchId/leads/:leadId/audit", getLeadAuditHandler)
+		api.POST("/searches/:searchId/leads/:leadId/audit", auditLeadHandler)
+		api.GET("/sources", getSourcesHandler)
+		api.GET("/me", getMeHandler)
+		api.GET("/me/usage", getUsageHandler)
+		api.POST("/me/sso-link", linkSSOHandler)
+		api.DELETE("/me/sso-link", unlinkSSOHandler)
+		api.POST("/billing/checkout", createCheckoutHandler)
+		api.POST("/billing/portal", createBillingPortalHandler)
+		api.GET("/search", fullTextSearchHandler)
+		api.GET("/sync", syncHandler)
+		api.POST("/batch", batchHandler(r))
+		api.GET("/settings", getSettingsHandler)
+		api.PUT("/settings", updateSettingsHandler)
+		api.GET("/settings/branding", getBrandingHandler)
+		api.PUT("/settings/branding", updateBrandingHandler)
+		api.GET("/settings/branding/logo", getBrandingLogoHandler)
+		api.PUT("/settings/branding/logo", uploadBrandingLogoHandler)
+		api.DELETE("/settings/branding/logo", deleteBrandingLogoHandler)
+		api.GET("/leads/duplicates", getLeadDuplicatesHandler)
+		api.POST("/leads/duplicates/:clusterId/merge", mergeLeadDuplicatesHandler)
+		api.POST("/leads/duplicates/:clusterId/ignore", ignoreLeadDuplicatesHandler)
+		api.GET("/leads/:searchId", getLeadsForSearchHandler)
+		api.GET("/leads/:searchId/geo", getLeadsGeoHandler)
+		// Takes a lead ID; gin needs it named like the wildcard above.
+		api.POST("/leads/:searchId/forget", forgetLeadHandler)
+		api.GET("/suppressions", getSuppressionsHandler)
+		api.POST("/suppressions", addSuppressionsHandler)
+		api.GET("/lists", getLeadListsHandler)
+		api.POST("/lists", createLeadListHandler)
+		api.GET("/lists/:listId", getLeadListHandler)
+		api.PUT("/lists/:listId", updateLeadListHandler)
+		api.DELETE("/lists/:listId", deleteLeadListHandler)
+		api.GET("/lists/:listId/leads", getLeadListLeadsHandler)
+		api.GET("/views", listViewsHandler)
+		api.POST("/views", createViewHandler)
+		api.GET("/views/:viewId", getViewHandler)
+		api.PUT("/views/:viewId", updateViewHandler)
+		api.DELETE("/views/:viewId", deleteViewHandler)
+		api.GET("/segments", listSegmentsHandler)
+		api.POST("/segments", createSegmentHandler)
+		api.GET("/segments/:segmentId", getSegmentHandler)
+		api.PUT("/segments/:segmentId", updateSegmentHandler)
+		api.DELETE("/segments/:segmentId", deleteSegmentHandler)
+		api.GET("/segments/:segmentId/leads", getSegmentLeadsHandler)
+		api.GET("/segments/:segmentId/export", exportSegmentHandler)
+		api.POST("/segments/:segmentId/actions", segmentActionHandler)
+		api.GET("/territories", getTerritoriesHandler)
+		api.POST("/territories", createTerritoryHandler)
+		api.PUT("/territories/:territoryId", updateTerritoryHandler)
+		api.DELETE("/territories/:territoryId", deleteTerritoryHandler)
+		api.GET("/crm", getCrmHandler)
+		api.POST("/crm/leads", idempotencyMiddleware(), addLeadsToCrmHandler)
+		api.POST("/crm/import-search/:searchId", idempotencyMiddleware(), importSearchHandler)
+		api.POST("/crm/import-list/:listId", idempotencyMiddleware(), importLeadListHandler)
+		api.PUT("/crm/state", updateCrmStateHandler)
+		api.POST("/crm/undo", undoCrmMoveHandler)
+		api.GET("/crm/history", getBoardHistoryHandler)
+		api.GET("/crm/leads/:leadId", getCrmLeadHandler)
+		api.PUT("/crm/leads/:leadId", updateCrmLeadHandler)
+		api.PUT("/crm/leads/:leadId/contact", selectCrmContactHandler)
+		api.DELETE("/crm/leads/:leadId", deleteCrmLeadHandler)
+		api.GET("/crm/leads/:leadId/screenshot", getCrmScreenshotHandler)
+		api.GET("/crm/leads/:leadId/audit", getCrmAuditHandler)
+		api.POST("/crm/leads/:leadId/audit-report", auditReportHandler)
+		api.GET("/crm/leads/:leadId/share-links", listShareLinksHandler)
+		api.POST("/crm/leads/:leadId/share-links", createShareLinkHandler)
+		api.DELETE("/share-links/:linkId", revokeShareLinkHandler)
+		api.GET("/crm/leads/:leadId/notes", getCrmNotesHandler)
+		api.GET("/crm/leads/:leadId/notes/revisions", getNoteRevisionsHandler)
+		api.POST("/crm/leads/:leadId/notes/revisions/:revisionId/restore", restoreNoteRevisionHandler)
+		api.GET("/crm/columns", getCrmColumnsHandler)
+		api.POST("/crm/columns", createCrmColumnHandler)
+		api.PUT("/crm/columns/:columnId", updateCrmColumnHandler)
+		api.DELETE("/crm/columns/:columnId", deleteCrmColumnHandler)
+		api.GET("/crm/statuses", getCrmStatusesHandler)
+		api.POST("/crm/statuses", createCrmStatusHandler)
+		api.PUT("/crm/statuses/:statusId", updateCrmStatusHandler)
+		api.DELETE("/crm/statuses/:statusId", deleteCrmStatusHandler)
+		api.PUT("/crm/leads/:leadId/status", setCrmLeadStatusHandler)
+		api.POST("/crm/leads/:leadId/tags", addCrmTagHandler)
+		api.DELETE("/crm/leads/:leadId/tags/:tag", removeCrmTagHandler)
+		api.PUT("/crm/leads/:leadId/priority", setCrmPriorityHandler)
+		api.GET("/crm/rules", getAutomationRulesHandler)
+		api.POST("/crm/rules", createAutomationRuleHandler)
+		api.PUT("/crm/rules/:ruleId", updateAutomationRuleHandler)
+		api.DELETE("/crm/rules/:ruleId", deleteAutomationRuleHandler)
+		api.GET("/crm/rules/log", getAutomationRuleLogHandler)
+		api.POST("/crm/rules/run", runAutomationRulesHandler)
+		api.GET("/crm/snoozed", getSnoozedCrmLeadsHandler)
+		api.GET("/crm/callable", getCallableLeadsHandler)
+		api.GET("/crm/callbacks", getCallbacksHandler)
+		api.GET("/dialer/next", getDialerNextHandler)
+		api.POST("/dialer/complete", idempotencyMiddleware(), completeDialerCallHandler)
+		api.POST("/dialer/release", releaseDialerHandler)
+		api.POST("/dialer/sessions/start", startDialerSessionHandler)
+		api.POST("/dialer/sessions/stop", stopDialerSessionHandler)
+		api.GET("/dialer/sessions", getDialerSessionsHandler)
+		api.PUT("/crm/leads/:leadId/snooze", snoozeCrmLeadHandler)
+		api.DELETE("/crm/leads/:leadId/snooze", unsnoozeCrmLeadHandler)
+		api.GET("/crm/leads/:leadId/activity", getLeadActivityHandler)
+		api.GET("/crm/leads/:leadId/calls", getLeadCallsHandler)
+		api.POST("/crm/leads/:leadId/calls", idempotencyMiddleware(), recordCallHandler)
+		api.GET("/crm/leads/:leadId/meetings", listLeadMeetingsHandler)
+		api.POST("/crm/leads/:leadId/meetings", createMeetingHandler)
+		api.GET("/crm/leads/:leadId/tasks", listLeadTasksHandler)
+		api.GET("/crm/leads/:leadId/script/:scriptId", renderCallScriptHandler)
+		api.GET("/scripts", getCallScriptsHandler)
+		api.POST("/scripts", createCallScriptHandler)
+		api.GET("/scripts/:scriptId", getCallScriptHandler)
+		api.PUT("/scripts/:scriptId", updateCallScriptHandler)
+		api.DELETE("/scripts/:scriptId", deleteCallScriptHandler)
+		api.GET("/templates", getTemplatesHandler)
+		api.POST("/templates", createTemplateHandler)
+		api.GET("/templates/:templateId", getTemplateHandler)
+		api.PUT("/templates/:templateId", updateTemplateHandler)
+		api.DELETE("/templates/:templateId", deleteTemplateHandler)
+		api.POST("/templates/:templateId/preview", previewTemplateHandler)
+		api.POST("/templates/:templateId/test-send", testSendTemplateHandler)
+		api.GET("/mailbox", getMailboxHandler)
+		api.PUT("/mailbox", requireIntegrations(), putMailboxHandler)
+		api.DELETE("/mailbox", deleteMailboxHandler)
+		api.GET("/mail-account", getMailAccountHandler)
+		api.PUT("/mail-account", updateMailAccountHandler)
+		api.DELETE("/mail-account", deleteMailAccountHandler)
+		api.POST("/mail-account/:provider/connect", requireIntegrations(), connectMailAccountHandler)
+		api.GET("/booking-page", getBookingPageHandler)
+		api.PUT("/booking-page", putBookingPageHandler)
+		api.DELETE("/booking-page", deleteBookingPageHandler)
+		api.GET("/bookings", listBookingsHandler)
+		api.GET("/calendar-feed", getCalendarFeedHandler)
+		api.POST("/calendar-feed", rotateCalendarFeedHandler)
+		api.DELETE("/calendar-feed", deleteCalendarFeedHandler)
+		api.GET("/tasks", listTasksHandler)
+		api.POST("/tasks", createTaskHandler)
+		api.GET("/tasks/today", getTodayTasksHandler)
+		api.GET("/tasks/:taskId", getTaskHandler)
+		api.PUT("/tasks/:taskId", updateTaskHandler)
+		api.DELETE("/tasks/:taskId", deleteTaskHandler)
+		api.POST("/tasks/:taskId/snooze", snoozeTaskHandler)
+		api.POST("/tasks/:taskId/skip", skipTaskHandler)
+		api.GET("/meetings", listMeetingsHandler)
+		api.GET("/meetings/:meetingId", getMeetingHandler)
+		api.PUT("/meetings/:meetingId", updateMeetingHandler)
+		api.DELETE("/meetings/:meetingId", deleteMeetingHandler)
+		api.GET("/campaigns", getCampaignsHandler)
+		api.POST("/campaigns", createCampaignHandler)
+		api.GET("/campaigns/:campaignId", getCampaignHandler)
+		api.PUT("/campaigns/:campaignId", updateCampaignHandler)
+		api.DELETE("/campaigns/:campaignId", deleteCampaignHandler)
+		api.GET("/campaigns/:campaignId/recipients", getCampaignRecipientsHandler)
+		api.POST("/campaigns/:campaignId/start", startCampaignHandler)
+		api.POST("/campaigns/:campaignId/pause", setCampaignStatusHandler(CAMPAIGN_PAUSED, CAMPAIGN_SCHEDULED))
+		api.POST("/campaigns/:campaignId/resume", setCampaignStatusHandler(CAMPAIGN_SCHEDULED, CAMPAIGN_PAUSED))
+		api.POST("/campaigns/:campaignId/cancel", setCampaignStatusHandler(CAMPAIGN_CANCELLED, CAMPAIGN_SCHEDULED, CAMPAIGN_PAUSED))
+		api.GET("/crm/dispositions", getDispositionsHandler)
+		api.PUT("/crm/dispositions/rules", updateDispositionRulesHandler)
+		api.GET("/analytics/dispositions", getDispositionAnalyticsHandler)
+		api.GET("/analytics/dialer", getDialerAnalyticsHandler)
+		api.GET("/analytics/meetings", getMeetingAnalyticsHandler)
+		api.GET("/goals/today", getTodayGoalHandler)
+		api.GET("/teams/:teamId", getTeamHandler)
+		api.PUT("/teams/:teamId", updateTeamHandler)
+		api.GET("/teams/:teamId/leaderboard", getLeaderboardHandler)
+		api.GET("/teams/:teamId/invitations", getTeamInvitationsHandler)
+		api.POST("/teams/:teamId/invitations", createTeamInvitationHandler)
+		api.DELETE("/teams/:teamId/invitations/:invitationId", deleteTeamInvitationHandler)
+		api.GET("/teams/:teamId/sso", getSSOConfigHandler)
+		api.PUT("/teams/:teamId/sso", updateSSOConfigHandler)
+		api.DELETE("/teams/:teamId/sso", deleteSSOConfigHandler)
+		api.POST("/teams/:teamId/sso/domains/:domain/verify", verifySSODomainHandler)
+		api.GET("/reports/pipeline.pdf", getPipelineReportHandler)
+		api.GET("/push/vapid-key", getVAPIDKeyHandler)
+		api.POST("/push/subscriptions", subscribePushHandler)
+		api.DELETE("/push/subscriptions", unsubscribePushHandler)
+		api.POST("/push/test", testPushHandler)
+		api.GET("/trash", getTrashHandler)
+		api.POST("/trash/:kind/:id/restore", restoreFromTrashHandler)
+	}
+
+	admin := api.Group("/admin")
+	admin.Use(adminMiddleware())
+	{
+		admin.POST("/backup", backupHandler)
+		admin.GET("/users", adminListUsersHandler)
+		admin.POST("/users/:userId/disable", adminDisableUserHandler)
+		admin.POST("/users/:userId/enable", adminEnableUserHandler)
+		admin.POST("/users/:userId/password", adminResetPasswordHandler)
+		admin.POST("/users/:userId/impersonate", adminImpersonateHandler)
+		admin.GET("/invitations", adminListInvitationsHandler)
+		admin.POST("/invitations", adminCreateInvitationHandler)
+		admin.DELETE("/invitations/:invitationId", adminDeleteInvitationHandler)
+		admin.GET("/features", adminListFeaturesHandler)
+		admin.PUT("/features/:key", adminPutFeatureHandler)
+		admin.DELETE("/features/:key", adminDeleteFeatureHandler)
+		admin.PUT("/features/:key/users/:userId", adminPutFeatureUserHandler)
+		admin.DELETE("/features/:key/users/:userId", adminDeleteFeatureUserHandler)
+	}
+	return r
+}
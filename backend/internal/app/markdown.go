@@ -0,0 +1,123 @@
+package app
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// --- MARKDOWN ---
+//
+// Notes are written in Markdown. renderMarkdown handles the subset reps
+// actually use (headings, lists, quotes, code, emphasis and links) and
+// escapes everything else, so the HTML is safe to display as-is.
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdBullet      = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdNumbered    = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdQuote       = regexp.MustCompile(`^>\s?(.*)$`)
+	mdLink        = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdBold        = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdItalic      = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+	mdSafeURL     = regexp.MustCompile(`^(?i)(https?:|mailto:|tel:)`)
+	mdInlineCode  = regexp.MustCompile("`([^`]+)`")
+	mdCodeFenceRe = regexp.MustCompile("^```")
+)
+
+func renderMarkdown(src string) string {
+	var out strings.Builder
+	var paragraph []string
+	list := "" // "ul" or "ol" while inside a list
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderInlineMarkdown(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(kind string) {
+		if list != kind {
+			closeList()
+			out.WriteString("<" + kind + ">\n")
+			list = kind
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case mdCodeFenceRe.MatchString(line):
+			flushParagraph()
+			closeList()
+			var code []string
+			for i++; i < len(lines) && !mdCodeFenceRe.MatchString(lines[i]); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case strings.TrimSpace(line) == "":
+			flushParagraph()
+			closeList()
+		case mdHeading.MatchString(line):
+			flushParagraph()
+			closeList()
+			m := mdHeading.FindStringSubmatch(line)
+			level := string(rune('0' + len(m[1])))
+			out.WriteString("<h" + level + ">" + renderInlineMarkdown(m[2]) + "</h" + level + ">\n")
+		case mdBullet.MatchString(line):
+			flushParagraph()
+			openList("ul")
+			out.WriteString("<li>" + renderInlineMarkdown(mdBullet.FindStringSubmatch(line)[1]) + "</li>\n")
+		case mdNumbered.MatchString(line):
+			flushParagraph()
+			openList("ol")
+			out.WriteString("<li>" + renderInlineMarkdown(mdNumbered.FindStringSubmatch(line)[1]) + "</li>\n")
+		case mdQuote.MatchString(line):
+			flushParagraph()
+			closeList()
+			out.WriteString("<blockquote>" + renderInlineMarkdown(mdQuote.FindStringSubmatch(line)[1]) + "</blockquote>\n")
+		default:
+			closeList()
+			paragraph = append(paragraph, line)
+		}
+	}
+	flushParagraph()
+	closeList()
+	return out.String()
+}
+
+// renderInlineMarkdown escapes text and applies inline formatting. Code
+// spans are rendered first and left untouched by the other rules.
+func renderInlineMarkdown(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range mdInlineCode.FindAllStringSubmatchIndex(text, -1) {
+		out.WriteString(renderInlineFormatting(text[last:loc[0]]))
+		out.WriteString("<code>" + html.EscapeString(text[loc[2]:loc[3]]) + "</code>")
+		last = loc[1]
+	}
+	out.WriteString(renderInlineFormatting(text[last:]))
+	return strings.ReplaceAll(out.String(), "\n", "<br>\n")
+}
+
+func renderInlineFormatting(text string) string {
+	text = html.EscapeString(text)
+	text = mdLink.ReplaceAllStringFunc(text, func(match string) string {
+		m := mdLink.FindStringSubmatch(match)
+		href := html.UnescapeString(m[2])
+		if !mdSafeURL.MatchString(href) {
+			return m[1]
+		}
+		return `<a href="` + html.EscapeString(href) + `" rel="noopener noreferrer">` + m[1] + "</a>"
+	})
+	text = mdBold.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = mdItalic.ReplaceAllString(text, "<em>$1$2</em>")
+	return text
+}
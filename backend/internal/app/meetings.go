@@ -0,0 +1,381 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- MEETINGS ---
+//
+// A meeting is what a cold call is meant to produce: a call or visit
+// booked with a lead, with who's attending and, once it's happened, how it
+// went. Meetings hang off CRM cards, show in their activity and in the
+// user's calendar feed, and GET /api/analytics/meetings counts how many
+// were booked against the calls made. Bookings taken on a booking page
+// become meetings when they match a card.
+
+const (
+	MEETING_SCHEDULED = "scheduled"
+	MEETING_HELD      = "held"
+	MEETING_NO_SHOW   = "no_show"
+	MEETING_CANCELLED = "cancelled"
+)
+
+var meetingOutcomes = []string{MEETING_SCHEDULED, MEETING_HELD, MEETING_NO_SHOW, MEETING_CANCELLED}
+
+const MAX_MEETING_ATTENDEES = 20
+
+type Meeting struct {
+	ID        string    `json:"id"`
+	LeadID    string    `json:"leadId"`
+	Title     string    `json:"title"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	Location  string    `json:"location"`
+	Attendees []string  `json:"attendees"`
+	Outcome   string    `json:"outcome"`
+	Notes     string    `json:"notes"`
+	// BookingID is set on meetings that came from the booking page.
+	BookingID string    `json:"bookingId,omitempty"`
+	CreatedBy int64     `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type meetingInput struct {
+	Title     string    `json:"title" binding:"required"`
+	StartsAt  time.Time `json:"startsAt" binding:"required"`
+	EndsAt    time.Time `json:"endsAt"`
+	Location  string    `json:"location"`
+	Attendees []string  `json:"attendees"`
+	Outcome   string    `json:"outcome"`
+	Notes     string    `json:"notes"`
+}
+
+func (in *meetingInput) validate(fe fieldErrors) {
+	in.Title = strings.TrimSpace(in.Title)
+	checkLength(fe, "title", in.Title, 1, 200)
+	if in.EndsAt.IsZero() {
+		in.EndsAt = in.StartsAt.Add(30 * time.Minute)
+	}
+	fe.check(in.EndsAt.After(in.StartsAt), "endsAt", "must be after startsAt")
+	fe.check(in.EndsAt.Sub(in.StartsAt) <= 24*time.Hour, "endsAt", "must be within a day of startsAt")
+	checkLength(fe, "location", in.Location, 0, 500)
+	fe.check(len(in.Attendees) <= MAX_MEETING_ATTENDEES, "attendees", "has too many entries")
+	attendees := []string{}
+	for _, a := range in.Attendees {
+		if a = strings.TrimSpace(a); a != "" {
+			fe.check(len(a) <= 200, "attendees", "entries must be at most 200 characters")
+			attendees = append(attendees, a)
+		}
+	}
+	in.Attendees = attendees
+	if in.Outcome == "" {
+		in.Outcome = MEETING_SCHEDULED
+	}
+	fe.check(validMeetingOutcome(in.Outcome), "outcome", "must be scheduled, held, no_show or cancelled")
+	checkLength(fe, "notes", in.Notes, 0, 10000)
+}
+
+func validMeetingOutcome(outcome string) bool {
+	for _, o := range meetingOutcomes {
+		if o == outcome {
+			return true
+		}
+	}
+	return false
+}
+
+// meetingResponse loads a meeting for a handler to return, writing the
+// error response itself when it can't.
+func meetingResponse(c *gin.Context, repo *Repository, meetingID string) (Meeting, bool) {
+	m, err := repo.Meeting(meetingID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Meeting not found"})
+		return m, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load meeting"})
+		return m, false
+	}
+	return m, true
+}
+
+// listMeetingsHandler returns the organization's meetings starting in
+// [from, to) (RFC 3339 times, both optional), earliest first.
+func listMeetingsHandler(c *gin.Context) {
+	var from, to *time.Time
+	for _, bound := range []struct {
+		name string
+		dest **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := c.Query(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": bound.name + " must be an RFC 3339 time"})
+				return
+			}
+			*bound.dest = &t
+		}
+	}
+	meetings, err := repoFrom(c).Meetings("", from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load meetings"})
+		return
+	}
+	c.JSON(http.StatusOK, meetings)
+}
+
+func listLeadMeetingsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	leadID := c.Param("leadId")
+	if !repo.Crm().HasCard(leadID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	meetings, err := repo.Meetings(leadID, nil, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load meetings"})
+		return
+	}
+	c.JSON(http.StatusOK, meetings)
+}
+
+func getMeetingHandler(c *gin.Context) {
+	if m, ok := meetingResponse(c, repoFrom(c), c.Param("meetingId")); ok {
+		c.JSON(http.StatusOK, m)
+	}
+}
+
+// createMeetingHandler books a meeting with the card's lead and logs it in
+// the card's activity.
+func createMeetingHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	leadID := c.Param("leadId")
+	var input meetingInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) {
+		return
+	}
+	if !repo.Crm().HasCard(leadID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	m := newMeeting(repo.Tenant(), leadID, input, "")
+	if err := createMeeting(repo.WithTx(tx), m); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create meeting"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create meeting"})
+		return
+	}
+	crmChanged(c, repo)
+	c.JSON(http.StatusCreated, m)
+}
+
+func newMeeting(t Tenant, leadID string, in meetingInput, bookingID string) Meeting {
+	now := time.Now().UTC()
+	return Meeting{
+		ID: uuid.New().String(), LeadID: leadID, Title: in.Title, StartsAt: in.StartsAt.UTC(), EndsAt: in.EndsAt.UTC(), Location: strings.TrimSpace(in.Location),
+		Attendees: in.Attendees, Outcome: in.Outcome, Notes: in.Notes, BookingID: bookingID, CreatedBy: t.UserID, CreatedAt: now, UpdatedAt: now,
+	}
+}
+
+// createMeeting saves a meeting and logs it on its card. Run it in a
+// transaction.
+func createMeeting(repo *Repository, m Meeting) error {
+	if err := repo.CreateMeeting(m); err != nil {
+		return err
+	}
+	return repo.logActivity(m.LeadID, "meeting_booked", map[string]interface{}{"meetingId": m.ID, "title": m.Title, "startsAt": m.StartsAt})
+}
+
+// updateMeetingHandler replaces a meeting's details. A changed outcome is
+// logged on the card.
+func updateMeetingHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	meetingID := c.Param("meetingId")
+	var input meetingInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) {
+		return
+	}
+	before, ok := meetingResponse(c, repo, meetingID)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+	if err := txRepo.UpdateMeeting(meetingID, input); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update meeting"})
+		return
+	}
+	if input.Outcome != before.Outcome && txRepo.Crm().HasCard(before.LeadID) {
+		err := txRepo.logActivity(before.LeadID, "meeting_outcome", map[string]interface{}{"meetingId": meetingID, "from": before.Outcome, "to": input.Outcome})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update meeting"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update meeting"})
+		return
+	}
+	crmChanged(c, repo)
+	if m, ok := meetingResponse(c, repo, meetingID); ok {
+		c.JSON(http.StatusOK, m)
+	}
+}
+
+func deleteMeetingHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	err := repo.DeleteMeeting(c.Param("meetingId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Meeting not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete meeting"})
+		return
+	}
+	crmChanged(c, repo)
+	c.Status(http.StatusNoContent)
+}
+
+// MeetingStats is what cold calling produced over a period, for the
+// organization and per rep.
+type MeetingStats struct {
+	Calls          int            `json:"calls"`
+	MeetingsBooked int            `json:"meetingsBooked"`
+	Outcomes       map[string]int `json:"outcomes"`
+	// CallsPerMeeting is Calls over MeetingsBooked, 0 when none were
+	// booked.
+	CallsPerMeeting float64 `json:"callsPerMeeting"`
+}
+
+// meetingCount is how many meetings a rep booked that now have outcome.
+type meetingCount struct {
+	userID  int64
+	outcome string
+	n       int
+}
+
+func newOutcomeCounts() map[string]int {
+	counts := make(map[string]int, len(meetingOutcomes))
+	for _, o := range meetingOutcomes {
+		counts[o] = 0
+	}
+	return counts
+}
+
+func (s *MeetingStats) finish() {
+	if s.MeetingsBooked > 0 {
+		s.CallsPerMeeting = float64(s.Calls) / float64(s.MeetingsBooked)
+	}
+}
+
+// getMeetingAnalyticsHandler counts the meetings booked in ?from= to ?to=
+// (dates in the user's timezone) against the calls made then. A meeting
+// counts when it was booked, whenever it takes place.
+func getMeetingAnalyticsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	loc := settings.location()
+
+	var from, to *time.Time
+	if v := c.Query("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date (YYYY-MM-DD)"})
+			return
+		}
+		from = &t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date (YYYY-MM-DD)"})
+			return
+		}
+		t = t.AddDate(0, 0, 1)
+		to = &t
+	}
+
+	meetings, err := repo.MeetingCounts(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load meeting analytics"})
+		return
+	}
+	calls, err := repo.CallCounts(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load meeting analytics"})
+		return
+	}
+
+	type repStats struct {
+		UserID int64 `json:"userId"`
+		MeetingStats
+	}
+	total := MeetingStats{Outcomes: newOutcomeCounts()}
+	byRep := map[int64]*repStats{}
+	reps := []*repStats{}
+	rep := func(userID int64) *repStats {
+		rs, ok := byRep[userID]
+		if !ok {
+			rs = &repStats{UserID: userID, MeetingStats: MeetingStats{Outcomes: newOutcomeCounts()}}
+			byRep[userID] = rs
+			reps = append(reps, rs)
+		}
+		return rs
+	}
+	for _, m := range meetings {
+		total.MeetingsBooked += m.n
+		total.Outcomes[m.outcome] += m.n
+		rs := rep(m.userID)
+		rs.MeetingsBooked += m.n
+		rs.Outcomes[m.outcome] += m.n
+	}
+	for userID, n := range calls {
+		total.Calls += n
+		rep(userID).Calls += n
+	}
+	total.finish()
+	for _, rs := range reps {
+		rs.finish()
+	}
+	sort.Slice(reps, func(i, j int) bool { return reps[i].UserID < reps[j].UserID })
+	c.JSON(http.StatusOK, gin.H{"totals": total, "reps": reps})
+}
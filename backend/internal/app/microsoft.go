@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// --- MICROSOFT 365 / OUTLOOK ---
+//
+// Microsoft accounts, work or personal, go through Microsoft Graph: mail
+// is sent as MIME with /me/sendMail, and callbacks can be kept as events
+// in the user's Outlook calendar. The client is an Entra ID app
+// registration with MAIL_ACCOUNT_CALLBACK_URL as a web redirect URI.
+
+const MAIL_MICROSOFT = "microsoft"
+
+// MICROSOFT_TENANT limits sign-in to one directory; "common" takes any
+// work or personal account.
+var microsoftTenant = envOrDefault("MICROSOFT_TENANT", "common")
+
+var graphAPIURL = "https://graph.microsoft.com/v1.0"
+
+var microsoftProvider = &mailProvider{
+	name:         "Microsoft 365",
+	authURL:      "https://login.microsoftonline.com/" + microsoftTenant + "/oauth2/v2.0/authorize",
+	tokenURL:     "https://login.microsoftonline.com/" + microsoftTenant + "/oauth2/v2.0/token",
+	scopes:       "openid email offline_access User.Read Mail.Send Calendars.ReadWrite",
+	clientID:     os.Getenv("MICROSOFT_CLIENT_ID"),
+	clientSecret: os.Getenv("MICROSOFT_CLIENT_SECRET"),
+	// Outlook.com allows about 300 recipients a day and Exchange Online
+	// 10,000.
+	defaultDailyLimit: 300,
+	maxDailyLimit:     10000,
+	address:           microsoftAddress,
+	send:              microsoftSend,
+	calendar:          &calendarAPI{save: outlookSaveEvent, remove: outlookDeleteEvent},
+}
+
+func microsoftAddress(ctx context.Context, accessToken string) (string, error) {
+	var me struct {
+		Mail              string `json:"mail"`
+		UserPrincipalName string `json:"userPrincipalName"`
+	}
+	if err := mailAPIRequest(ctx, http.MethodGet, graphAPIURL+"/me", accessToken, nil, &me); err != nil {
+		return "", err
+	}
+	// Personal accounts have no mail property; their sign-in name is the
+	// address.
+	if me.Mail != "" {
+		return me.Mail, nil
+	}
+	if validEmail(me.UserPrincipalName) {
+		return me.UserPrincipalName, nil
+	}
+	return "", errors.New("no email address from Microsoft")
+}
+
+func microsoftSend(ctx context.Context, accessToken string, msg []byte) error {
+	payload := []byte(base64.StdEncoding.EncodeToString(msg))
+	return mailAPIRawRequest(ctx, http.MethodPost, graphAPIURL+"/me/sendMail", accessToken, "text/plain", payload, nil)
+}
+
+// graphEvent is the part of a Graph calendar event that's set.
+type graphEvent struct {
+	Subject string `json:"subject"`
+	Body    struct {
+		ContentType string `json:"contentType"`
+		Content     string `json:"content"`
+	} `json:"body"`
+	Start                      graphDateTime `json:"start"`
+	End                        graphDateTime `json:"end"`
+	IsReminderOn               bool          `json:"isReminderOn"`
+	ReminderMinutesBeforeStart int           `json:"reminderMinutesBeforeStart"`
+}
+
+type graphDateTime struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+func graphTime(t time.Time) graphDateTime {
+	return graphDateTime{DateTime: t.UTC().Format("2006-01-02T15:04:05"), TimeZone: "UTC"}
+}
+
+// outlookSaveEvent updates the event, or creates it when there's none yet
+// or the user has deleted it in Outlook.
+func outlookSaveEvent(ctx context.Context, accessToken, eventID string, ev calendarEvent) (string, error) {
+	var body graphEvent
+	body.Subject = ev.Subject
+	body.Body.ContentType, body.Body.Content = "text", ev.Description
+	body.Start, body.End = graphTime(ev.Start), graphTime(ev.Start.Add(ev.Duration))
+	body.IsReminderOn, body.ReminderMinutesBeforeStart = true, CALENDAR_REMINDER_MINUTES
+
+	if eventID != "" {
+		err := mailAPIRequest(ctx, http.MethodPatch, graphAPIURL+"/me/events/"+url.PathEscape(eventID), accessToken, body, nil)
+		if mailAPIStatus(err) != http.StatusNotFound {
+			return eventID, err
+		}
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := mailAPIRequest(ctx, http.MethodPost, graphAPIURL+"/me/events", accessToken, body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// outlookDeleteEvent deletes the event; one already gone is fine.
+func outlookDeleteEvent(ctx context.Context, accessToken, eventID string) error {
+	err := mailAPIRequest(ctx, http.MethodDelete, graphAPIURL+"/me/events/"+url.PathEscape(eventID), accessToken, nil, nil)
+	if mailAPIStatus(err) == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// --- TIMEOUTS AND RECOVERY ---
+//
+// Every request runs under a deadline: short for reads, longer for writes,
+// and longest for the few routes that build a whole export or backup.
+// Queries use the request context, so they stop when it runs out and the
+// client gets a 504 instead of whatever error the handler reports.
+
+var readTimeout = time.Duration(envInt("READ_TIMEOUT_SECONDS", 10)) * time.Second
+var writeTimeout = time.Duration(envInt("WRITE_TIMEOUT_SECONDS", 30)) * time.Second
+var exportTimeout = time.Duration(envInt("EXPORT_TIMEOUT_SECONDS", 300)) * time.Second
+
+// exportRoutes get exportTimeout whatever their method.
+var exportRoutes = map[string]bool{
+	"/api/reports/pipeline.pdf":        true,
+	"/api/crm/import-search/:searchId": true,
+	"/api/crm/import-list/:listId":     true,
+	"/api/crm/rules/run":               true,
+	"/api/admin/backup":                true,
+	// Lighthouse can take most of a minute on a slow site.
+	"/api/searches/:searchId/leads/:leadId/audit": true,
+	"/api/crm/leads/:leadId/audit-report":         true,
+	"/api/crm/leads/:leadId/share-links":          true,
+	// A shared audit report checks the site's certificate as it's shown.
+	"/share/:token": true,
+	// A batch runs up to BATCH_MAX_REQUESTS writes, each under its own
+	// deadline.
+	"/api/batch": true,
+}
+
+func routeTimeout(c *gin.Context) time.Duration {
+	switch {
+	case exportRoutes[c.FullPath()]:
+		return exportTimeout
+	case c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead:
+		return readTimeout
+	}
+	return writeTimeout
+}
+
+// replacingWriter swaps a handler's error response for a fixed one when
+// replace returns a status, for failures a handler can't tell from its own
+// errors, such as the deadline passing mid-query.
+type replacingWriter struct {
+	gin.ResponseWriter
+	replace func(code int) (int, string)
+	body    string
+}
+
+func (w *replacingWriter) WriteHeader(code int) {
+	if newCode, body := w.replace(code); newCode != 0 {
+		code, w.body = newCode, body
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *replacingWriter) Write(data []byte) (int, error) {
+	if w.body != "" {
+		if !w.ResponseWriter.Written() {
+			w.ResponseWriter.Write([]byte(w.body))
+		}
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *replacingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func timeoutMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// WebSockets stay open for as long as the client wants.
+		if c.IsWebsocket() {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), routeTimeout(c))
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Writer = &replacingWriter{ResponseWriter: c.Writer, replace: func(code int) (int, string) {
+			if code >= 500 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return http.StatusGatewayTimeout, `{"error":"Request timed out"}`
+			}
+			return 0, ""
+		}}
+		c.Next()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("%s %s timed out after %s", c.Request.Method, c.Request.URL.Path, routeTimeout(c))
+		}
+	}
+}
+
+// --- BODY LIMITS ---
+//
+// Request bodies are capped: JSON bodies are small, while file uploads get
+// more room. A body that declares a size over the cap is refused before it's
+// read; one that only turns out too big while streaming is cut off and the
+// handler's error becomes a 413. Multipart uploads keep at most
+// multipartMemory in memory and spill the rest to temporary files.
+
+var maxBodyBytes = int64(envInt("MAX_BODY_BYTES", 1<<20))
+var maxUploadBytes = int64(envInt("MAX_UPLOAD_BYTES", 32<<20))
+
+const multipartMemory = 1 << 20
+
+// bodyLimit is the cap for a request's body: uploads are multipart forms
+// or CSV files, everything else is JSON.
+func bodyLimit(r *http.Request) int64 {
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	switch strings.TrimSpace(mediaType) {
+	case "multipart/form-data", "text/csv":
+		return maxUploadBytes
+	}
+	return maxBodyBytes
+}
+
+// limitedBody notes when a body went over its cap.
+type limitedBody struct {
+	io.ReadCloser
+	tooLarge bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+func bodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := bodyLimit(c.Request)
+		tooLarge := fmt.Sprintf(`{"error":"Request body is larger than %d bytes"}`, limit)
+		if c.Request.ContentLength > limit {
+			c.Header("Connection", "close")
+			c.Data(http.StatusRequestEntityTooLarge, "application/json; charset=utf-8", []byte(tooLarge))
+			c.Abort()
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, limit)}
+		c.Request.Body = body
+		c.Writer = &replacingWriter{ResponseWriter: c.Writer, replace: func(code int) (int, string) {
+			if code >= 400 && body.tooLarge {
+				return http.StatusRequestEntityTooLarge, tooLarge
+			}
+			return 0, ""
+		}}
+		c.Next()
+	}
+}
+
+// recoveryMiddleware answers a panicking handler with a 500 carrying an
+// error ID, and logs the panic and stack under that ID so a user's report
+// can be matched to it.
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				errorID := uuid.New().String()[:8]
+				log.Printf("Panic %s in %s %s: %v\n%s", errorID, c.Request.Method, c.Request.URL.Path, r, debug.Stack())
+				if c.Writer.Written() {
+					c.Abort()
+					return
+				}
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error", "errorId": errorID})
+			}
+		}()
+		c.Next()
+	}
+}
+
+// --- COMPRESSION ---
+
+// gzipWriter compresses the body if its content type is worth compressing,
+// deciding at the first write, once the handler has set its headers.
+type gzipWriter struct {
+	gin.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+
+// compressible is whether a content type benefits from gzip; images, PDFs
+// and archives are already compressed.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch mediaType = strings.TrimSpace(mediaType); {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/javascript", mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		h := w.Header()
+		if h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			w.gz = gzipWriters.Get().(*gzip.Writer)
+			w.gz.Reset(w.ResponseWriter)
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+	}
+}
+
+// gzipMiddleware compresses responses for clients that accept gzip.
+func gzipMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Vary", "Accept-Encoding")
+		if c.Request.Method == http.MethodHead || !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+			c.Next()
+			return
+		}
+		w := &gzipWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- CRM NOTES ---
+//
+// Notes are Markdown. Every change through PUT /api/crm/leads/:leadId or a
+// restore keeps the text it replaced as a revision.
+
+type NoteRevision struct {
+	ID            int64     `json:"id"`
+	EditedBy      int64     `json:"editedBy"`
+	EditorName    string    `json:"editorName"`
+	EditedAt      time.Time `json:"editedAt"`
+	PreviousNotes string    `json:"previousNotes"`
+}
+
+// getCrmNotesHandler returns a lead's notes with the Markdown rendered to
+// HTML that is safe to insert into the page.
+func getCrmNotesHandler(c *gin.Context) {
+	lead, err := repoFrom(c).Crm().Card(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load notes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notes": lead.Notes, "html": renderMarkdown(lead.Notes)})
+}
+
+func getNoteRevisionsHandler(c *gin.Context) {
+	revisions, err := repoFrom(c).NoteRevisions(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load note revisions"})
+		return
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+func restoreNoteRevisionHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	revisionID, err := strconv.ParseInt(c.Param("revisionId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	notes, err := txRepo.RestoreNoteRevision(c.Param("leadId"), revisionID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore notes"})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore notes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notes": notes, "html": renderMarkdown(notes), "version": version})
+}
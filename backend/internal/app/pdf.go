@@ -0,0 +1,311 @@
+package app
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	_ "image/jpeg" // logos may be JPEG or PNG
+	_ "image/png"
+	"strconv"
+	"strings"
+)
+
+// --- PDF ---
+//
+// A small writer for plain A4 reports: headings, lines of text and simple
+// table rows in the standard Helvetica fonts, flowing onto new pages as
+// needed, plus a logo, heading colours and a footer line for white-label
+// reports. It's enough for our reports without pulling in a PDF library.
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 50.0
+)
+
+type pdfWriter struct {
+	pages []*bytes.Buffer
+	y     float64
+
+	// headingColor and ruleColor are PDF RGB operands ("0.1 0.2 0.3"),
+	// black and light grey unless set.
+	headingColor string
+	ruleColor    string
+	footer       string
+	images       []pdfImage
+}
+
+// pdfImage is a decoded picture, stored as 8-bit RGB.
+type pdfImage struct {
+	width, height int
+	rgb           []byte
+}
+
+func newPDFWriter() *pdfWriter {
+	w := &pdfWriter{headingColor: "0 0 0", ruleColor: "0.75 0.75 0.75"}
+	w.newPage()
+	return w
+}
+
+func (w *pdfWriter) newPage() {
+	w.pages = append(w.pages, &bytes.Buffer{})
+	w.y = pdfPageHeight - pdfMargin
+}
+
+// ensure starts a new page unless h more points fit above the footer.
+func (w *pdfWriter) ensure(h float64) {
+	if w.y-h < pdfMargin+20 {
+		w.newPage()
+	}
+}
+
+func (w *pdfWriter) page() *bytes.Buffer {
+	return w.pages[len(w.pages)-1]
+}
+
+// text draws s with its baseline at the current y. Bold selects
+// Helvetica-Bold.
+func (w *pdfWriter) text(x float64, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(w.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, w.y, pdfEscape(s))
+}
+
+func (w *pdfWriter) rule() {
+	fmt.Fprintf(w.page(), "%s RG 0.5 w %.2f %.2f m %.2f %.2f l S 0 G\n", w.ruleColor, pdfMargin, w.y, pdfPageWidth-pdfMargin, w.y)
+}
+
+// heading draws bold text in the heading colour.
+func (w *pdfWriter) heading(size float64, s string) {
+	fmt.Fprintf(w.page(), "%s rg\n", w.headingColor)
+	w.text(pdfMargin, size, true, pdfFit(s, pdfPageWidth-2*pdfMargin, size))
+	w.page().WriteString("0 g\n")
+}
+
+// SetColors colours headings and the rules under sections. Each is a
+// #rrggbb colour; one that isn't keeps its default.
+func (w *pdfWriter) SetColors(heading, rule string) {
+	if rgb, ok := pdfColor(heading); ok {
+		w.headingColor = rgb
+	}
+	if rgb, ok := pdfColor(rule); ok {
+		w.ruleColor = rgb
+	}
+}
+
+// SetFooter puts a line of text beside the page number on every page.
+func (w *pdfWriter) SetFooter(s string) {
+	w.footer = strings.Join(strings.Fields(s), " ")
+}
+
+// Image draws a PNG or JPEG at the left margin, scaled down to fit within
+// maxWidth by maxHeight points.
+func (w *pdfWriter) Image(data []byte, maxWidth, maxHeight float64) error {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	pi := pdfImage{width: b.Dx(), height: b.Dy(), rgb: make([]byte, 0, 3*b.Dx()*b.Dy())}
+	if pi.width == 0 || pi.height == 0 {
+		return fmt.Errorf("image is empty")
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// Transparent pixels are laid over the white page.
+			r, g, bl, a := img.At(x, y).RGBA()
+			over := func(c uint32) byte { return byte((c + (0xffff - a)) >> 8) }
+			pi.rgb = append(pi.rgb, over(r), over(g), over(bl))
+		}
+	}
+
+	scale := min(maxWidth/float64(pi.width), maxHeight/float64(pi.height), 1)
+	width, height := float64(pi.width)*scale, float64(pi.height)*scale
+	w.ensure(height + 4)
+	w.y -= height
+	w.images = append(w.images, pi)
+	fmt.Fprintf(w.page(), "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width, height, pdfMargin, w.y, len(w.images))
+	w.y -= 4
+	return nil
+}
+
+// Title is the report's main heading.
+func (w *pdfWriter) Title(s string) {
+	w.ensure(30)
+	w.y -= 22
+	w.heading(20, s)
+	w.y -= 6
+}
+
+// Section starts a titled section, moving to a new page if there isn't
+// room for the heading and a few lines under it.
+func (w *pdfWriter) Section(s string) {
+	w.ensure(70)
+	w.y -= 26
+	w.heading(13, s)
+	w.y -= 6
+	w.rule()
+	w.y -= 2
+}
+
+// Line writes one line of body text, cut short if it doesn't fit.
+func (w *pdfWriter) Line(s string) {
+	w.ensure(14)
+	w.y -= 14
+	w.text(pdfMargin, 10, false, pdfFit(s, pdfPageWidth-2*pdfMargin, 10))
+}
+
+// Paragraph writes body text, wrapping it at word boundaries onto as many
+// lines as it takes.
+func (w *pdfWriter) Paragraph(s string) {
+	limit := pdfChars(pdfPageWidth-2*pdfMargin, 10)
+	line := ""
+	for _, word := range strings.Fields(s) {
+		if line != "" && len([]rune(line))+1+len([]rune(word)) > limit {
+			w.Line(line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		w.Line(line)
+	}
+}
+
+// Row writes a table row, one cell per width in points, cutting each cell
+// to its width.
+func (w *pdfWriter) Row(widths []float64, bold bool, cells ...string) {
+	w.ensure(14)
+	w.y -= 14
+	x := pdfMargin
+	for i, cell := range cells {
+		if i >= len(widths) {
+			break
+		}
+		w.text(x, 10, bold, pdfFit(cell, widths[i]-6, 10))
+		x += widths[i]
+	}
+}
+
+// Bytes lays out the finished document with a page number and the footer
+// at the foot of each page. Images come after the pages, so every page
+// can refer to them.
+func (w *pdfWriter) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(w.pages))
+	for i := range w.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(w.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	xobjects := ""
+	for i := range w.images {
+		xobjects += fmt.Sprintf(" /Im%d %d 0 R", i+1, 5+2*len(w.pages)+i)
+	}
+	if xobjects != "" {
+		xobjects = " /XObject <<" + xobjects + " >>"
+	}
+	for i, page := range w.pages {
+		content := page.String() + fmt.Sprintf("BT /F1 8 Tf %.2f 30 Td (Page %d of %d) Tj ET\n", pdfMargin, i+1, len(w.pages))
+		if w.footer != "" {
+			content += fmt.Sprintf("BT /F1 8 Tf %.2f 30 Td (%s) Tj ET\n", pdfMargin+80, pdfEscape(pdfFit(w.footer, pdfPageWidth-2*pdfMargin-80, 8)))
+		}
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >>%s >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, xobjects, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+	for _, img := range w.images {
+		var data bytes.Buffer
+		zw := zlib.NewWriter(&data)
+		zw.Write(img.rgb)
+		zw.Close()
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream",
+			img.width, img.height, data.Len(), data.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// winAnsiExtras are the characters WinAnsiEncoding puts in 0x80-0x9F,
+// where it differs from Latin-1.
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// pdfEscape encodes s for a PDF string in WinAnsiEncoding. Characters the
+// standard fonts can't show become '?'.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			if c, ok := winAnsiExtras[r]; ok {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// pdfColor turns a #rrggbb colour into PDF RGB operands.
+func pdfColor(hex string) (string, bool) {
+	if len(hex) != 7 || hex[0] != '#' {
+		return "", false
+	}
+	n, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(n>>16)/255, float64(n>>8&0xff)/255, float64(n&0xff)/255), true
+}
+
+// pdfChars is roughly how many characters fit width points at the given
+// font size. It uses Helvetica's average character width, which is close
+// enough for names, numbers and prose.
+func pdfChars(width, size float64) int {
+	return int(width / (size * 0.52))
+}
+
+// pdfFit cuts s to roughly fit width points at the given font size.
+func pdfFit(s string, width, size float64) string {
+	limit := pdfChars(width, size)
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	if limit < 1 {
+		return ""
+	}
+	return string(runes[:limit-1]) + "…"
+}
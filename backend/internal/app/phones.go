@@ -0,0 +1,339 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- PHONE LOOKUPS ---
+//
+// A lookup provider says whether each number is valid and whether it's a
+// landline, mobile or VoIP line. Users choose a provider and supply their
+// own key in settings; numbers are looked up once, after a search finishes
+// or on demand for a single lead.
+
+const (
+	PHONE_LANDLINE = "landline"
+	PHONE_MOBILE   = "mobile"
+	PHONE_VOIP     = "voip"
+	PHONE_OTHER    = "other"
+)
+
+var phoneLineTypes = []string{PHONE_LANDLINE, PHONE_MOBILE, PHONE_VOIP, PHONE_OTHER}
+
+// Numbers are stored as the source gave them, usually in national format.
+var phoneDefaultCountry = strings.ToUpper(envOrDefault("PHONE_DEFAULT_COUNTRY", "GB"))
+
+// PhoneLookup is what a provider knows about one number.
+type PhoneLookup struct {
+	Valid    bool
+	LineType string
+	Carrier  string
+}
+
+type PhoneLookupProvider interface {
+	Info() VerifierInfo
+	Lookup(ctx context.Context, apiKey, phone string) (PhoneLookup, error)
+}
+
+var phoneLookupProviders = map[string]PhoneLookupProvider{}
+
+func registerPhoneLookupProvider(p PhoneLookupProvider) {
+	phoneLookupProviders[p.Info().ID] = p
+}
+
+func registerPhoneLookupProviders() {
+	client := &http.Client{Timeout: 15 * time.Second}
+	registerPhoneLookupProvider(&twilioLookupProvider{client: client})
+	registerPhoneLookupProvider(&numverifyProvider{client: client})
+}
+
+// phoneLookupFor returns the user's provider, or nil if they haven't set
+// one up.
+func phoneLookupFor(settings UserSettings) PhoneLookupProvider {
+	p, ok := phoneLookupProviders[settings.PhoneLookupProvider]
+	if !ok || settings.PhoneLookupAPIKey == "" {
+		return nil
+	}
+	return p
+}
+
+// lookupPhones looks up every number of the given leads that hasn't been
+// looked up yet and returns how many it stored.
+func lookupPhones(ctx context.Context, userID int64, leadIDs []string) (int, error) {
+	settings, err := getUserSettings(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("loading settings: %w", err)
+	}
+	provider := phoneLookupFor(settings)
+	if provider == nil {
+		return 0, fmt.Errorf("choose a phone lookup provider and add its API key in settings")
+	}
+	if len(leadIDs) == 0 {
+		return 0, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(leadIDs)), ",")
+	args := make([]interface{}, len(leadIDs))
+	for i, id := range leadIDs {
+		args[i] = id
+	}
+	rows, err := db.Query("SELECT id, phone FROM lead_phones WHERE looked_up_at IS NULL AND lead_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id    int64
+		phone string
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.phone); err != nil {
+			log.Printf("Error scanning phone to look up: %v", err)
+			continue
+		}
+		p.phone = unseal(p.phone)
+		todo = append(todo, p)
+	}
+	rows.Close()
+
+	stored := 0
+	for _, p := range todo {
+		result, err := provider.Lookup(ctx, settings.PhoneLookupAPIKey, p.phone)
+		if err != nil {
+			return stored, err
+		}
+		_, err = db.Exec("UPDATE lead_phones SET valid = ?, line_type = ?, carrier = ?, looked_up_at = ? WHERE id = ?",
+			result.Valid, result.LineType, result.Carrier, time.Now(), p.id)
+		if err != nil {
+			return stored, err
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// lookupSearchPhones runs after ingestion for users with a provider set up.
+func lookupSearchPhones(searchID string) {
+	var userID int64
+	if err := db.QueryRow("SELECT user_id FROM searches WHERE id = ?", searchID).Scan(&userID); err != nil {
+		log.Printf("Failed to load search %s for phone lookups: %v", searchID, err)
+		return
+	}
+	settings, err := getUserSettings(context.Background(), userID)
+	if err != nil || phoneLookupFor(settings) == nil {
+		return
+	}
+
+	rows, err := db.Query("SELECT id FROM leads WHERE search_id = ? AND deleted_at IS NULL", searchID)
+	if err != nil {
+		log.Printf("Failed to load leads for phone lookups in search %s: %v", searchID, err)
+		return
+	}
+	var leadIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			leadIDs = append(leadIDs, id)
+		}
+	}
+	rows.Close()
+
+	// Keep each query's IN list well under SQLite's variable limit.
+	looked := 0
+	for start := 0; start < len(leadIDs); start += 500 {
+		end := start + 500
+		if end > len(leadIDs) {
+			end = len(leadIDs)
+		}
+		n, err := lookupPhones(context.Background(), userID, leadIDs[start:end])
+		looked += n
+		if err != nil {
+			log.Printf("Phone lookups stopped for search %s: %v", searchID, err)
+			break
+		}
+	}
+	log.Printf("Looked up %d phone numbers for search %s", looked, searchID)
+}
+
+// getPhoneLookupProvidersHandler lists the providers and which one the user
+// has chosen.
+func getPhoneLookupProvidersHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	settings, err := getUserSettings(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+
+	type providerStatus struct {
+		VerifierInfo
+		Selected bool `json:"selected"`
+	}
+	providers := make([]providerStatus, 0, len(phoneLookupProviders))
+	for _, p := range phoneLookupProviders {
+		info := p.Info()
+		providers = append(providers, providerStatus{VerifierInfo: info, Selected: info.ID == settings.PhoneLookupProvider})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].ID < providers[j].ID })
+	c.JSON(http.StatusOK, providers)
+}
+
+// lookupLeadPhonesHandler looks up a lead's numbers that haven't been
+// looked up yet and returns all of them.
+func lookupLeadPhonesHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	lead, err := repo.Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+
+	if _, err := lookupPhones(c.Request.Context(), repo.Tenant().UserID, []string{lead.ID}); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Phone lookup failed", "details": err.Error()})
+		return
+	}
+
+	contacts, err := repo.Leads().Contacts([]string{lead.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead phones"})
+		return
+	}
+	phones := contacts.Phones[lead.ID]
+	if phones == nil {
+		phones = []leads.Phone{}
+	}
+	c.JSON(http.StatusOK, phones)
+}
+
+// --- TWILIO LOOKUP ---
+const TWILIO_LOOKUP_URL = "https://lookups.twilio.com/v2/PhoneNumbers/"
+
+type twilioLookupProvider struct {
+	client *http.Client
+}
+
+func (p *twilioLookupProvider) Info() VerifierInfo {
+	return VerifierInfo{ID: "twilio", Name: "Twilio Lookup", RequiresAPIKey: true, Paid: true}
+}
+
+var twilioLineTypes = map[string]string{
+	"landline":     PHONE_LANDLINE,
+	"mobile":       PHONE_MOBILE,
+	"fixedVoip":    PHONE_VOIP,
+	"nonFixedVoip": PHONE_VOIP,
+}
+
+// Lookup expects the key as "AccountSID:AuthToken".
+func (p *twilioLookupProvider) Lookup(ctx context.Context, apiKey, phone string) (PhoneLookup, error) {
+	sid, token, ok := strings.Cut(apiKey, ":")
+	if !ok {
+		return PhoneLookup{}, fmt.Errorf("Twilio key must be AccountSID:AuthToken")
+	}
+	params := url.Values{}
+	params.Set("Fields", "line_type_intelligence")
+	params.Set("CountryCode", phoneDefaultCountry)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, TWILIO_LOOKUP_URL+url.PathEscape(phone)+"?"+params.Encode(), nil)
+	if err != nil {
+		return PhoneLookup{}, err
+	}
+	req.SetBasicAuth(sid, token)
+
+	var resp struct {
+		Valid                bool `json:"valid"`
+		LineTypeIntelligence *struct {
+			Type        string `json:"type"`
+			CarrierName string `json:"carrier_name"`
+		} `json:"line_type_intelligence"`
+		Message string `json:"message"`
+	}
+	httpResp, err := p.client.Do(req)
+	if err != nil {
+		return PhoneLookup{}, err
+	}
+	defer httpResp.Body.Close()
+	// Twilio answers 404 for numbers it can't parse at all.
+	if httpResp.StatusCode == http.StatusNotFound {
+		return PhoneLookup{Valid: false}, nil
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return PhoneLookup{}, fmt.Errorf("Twilio: status %d", httpResp.StatusCode)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return PhoneLookup{}, fmt.Errorf("Twilio: %s", resp.Message)
+	}
+
+	result := PhoneLookup{Valid: resp.Valid}
+	if lti := resp.LineTypeIntelligence; lti != nil {
+		result.Carrier = lti.CarrierName
+		if lti.Type != "" {
+			result.LineType = PHONE_OTHER
+			if t, ok := twilioLineTypes[lti.Type]; ok {
+				result.LineType = t
+			}
+		}
+	}
+	return result, nil
+}
+
+// --- NUMVERIFY ---
+const NUMVERIFY_VALIDATE_URL = "https://apilayer.net/api/validate"
+
+type numverifyProvider struct {
+	client *http.Client
+}
+
+func (p *numverifyProvider) Info() VerifierInfo {
+	return VerifierInfo{ID: "numverify", Name: "numverify", RequiresAPIKey: true, Paid: true}
+}
+
+func (p *numverifyProvider) Lookup(ctx context.Context, apiKey, phone string) (PhoneLookup, error) {
+	params := url.Values{}
+	params.Set("access_key", apiKey)
+	params.Set("number", phone)
+	params.Set("country_code", phoneDefaultCountry)
+
+	var resp struct {
+		Valid    bool   `json:"valid"`
+		LineType string `json:"line_type"`
+		Carrier  string `json:"carrier"`
+		Error    *struct {
+			Info string `json:"info"`
+		} `json:"error"`
+	}
+	if err := getJSON(ctx, p.client, NUMVERIFY_VALIDATE_URL+"?"+params.Encode(), &resp); err != nil {
+		return PhoneLookup{}, err
+	}
+	if resp.Error != nil {
+		return PhoneLookup{}, fmt.Errorf("numverify: %s", resp.Error.Info)
+	}
+
+	result := PhoneLookup{Valid: resp.Valid, Carrier: resp.Carrier}
+	switch resp.LineType {
+	case "":
+	case "landline":
+		result.LineType = PHONE_LANDLINE
+	case "mobile":
+		result.LineType = PHONE_MOBILE
+	default:
+		result.LineType = PHONE_OTHER
+	}
+	return result, nil
+}
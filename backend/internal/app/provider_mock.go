@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"blueleads-backend/internal/scraper"
+)
+
+// --- MOCK PROVIDER ---
+//
+// The mock source makes up plausible leads instead of scraping, for
+// development and CI machines without google-maps-scraper. It's turned on
+// with SCRAPER_PROVIDER=mock, which also has it stand in for the Google
+// Maps source so the frontend's default searches work. The same keyword
+// and location always give the same leads.
+//
+// MOCK_SCRAPER_RESULTS, MOCK_SCRAPER_DELAY_MS and
+// MOCK_SCRAPER_FAILURE_PERCENT set how many leads a search finds, roughly
+// how long it takes, and how often it fails. Keywords can also ask for an
+// outcome: one containing "mock:fail" always fails, "mock:empty" finds
+// nothing, and "mock:bad" adds a few leads with missing or malformed
+// fields, like real scrapers sometimes return.
+
+const MOCK_SOURCE = "mock"
+
+var errMockFailure = errors.New("mock scraper failure")
+
+type mockProvider struct {
+	info           scraper.Info
+	results        int
+	delay          time.Duration
+	failurePercent int
+}
+
+func newMockProvider(info scraper.Info) *mockProvider {
+	return &mockProvider{
+		info:           info,
+		results:        envInt("MOCK_SCRAPER_RESULTS", 40),
+		delay:          time.Duration(envInt("MOCK_SCRAPER_DELAY_MS", 2000)) * time.Millisecond,
+		failurePercent: envInt("MOCK_SCRAPER_FAILURE_PERCENT", 0),
+	}
+}
+
+// registerMockProvider registers the mock source when SCRAPER_PROVIDER asks
+// for it, in place of the Google Maps scraper.
+func registerMockProvider() bool {
+	if os.Getenv("SCRAPER_PROVIDER") != MOCK_SOURCE {
+		return false
+	}
+	leadProviders.Register(newMockProvider(scraper.Info{ID: MOCK_SOURCE, Name: "Mock"}))
+	leadProviders.Register(newMockProvider(scraper.Info{ID: DEFAULT_SOURCE, Name: "Google Maps (mock)"}))
+	log.Printf("SCRAPER_PROVIDER=mock: searches return made-up leads instead of scraping")
+	return true
+}
+
+func (p *mockProvider) Info() scraper.Info {
+	return p.info
+}
+
+func (p *mockProvider) Search(ctx context.Context, q scraper.Query) ([]scraper.Lead, error) {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(q.Keyword + "|" + q.Location)))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	// The delay comes in a few steps, like pages of results, and varies by
+	// half either way.
+	const steps = 4
+	if p.delay > 0 {
+		total := p.delay/2 + time.Duration(rng.Int63n(int64(p.delay)+1))
+		for i := 0; i < steps; i++ {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(total / steps):
+			}
+			q.Logf("Mock scraper: page %d of %d", i+1, steps)
+		}
+	}
+
+	keyword := strings.ToLower(q.Keyword)
+	if strings.Contains(keyword, "mock:fail") || rng.Intn(100) < p.failurePercent {
+		return nil, errMockFailure
+	}
+	if strings.Contains(keyword, "mock:empty") {
+		return []scraper.Lead{}, nil
+	}
+
+	leads := demoLeads(rng, mockTrade(q.Keyword), mockCity(rng, q.Location), p.results)
+	if strings.Contains(keyword, "mock:bad") && len(leads) > 0 {
+		leads = append(leads,
+			scraper.Lead{Phone: leads[0].Phone},
+			scraper.Lead{Title: leads[0].Title, Website: "not a url", Emails: []string{"info@", ""}},
+			scraper.Lead{Title: "   ", Phone: "n/a", Rating: -1, ReviewCount: -5, OpenHours: map[string][]string{"Someday": {}}},
+		)
+	}
+	return leads, nil
+}
+
+// mockTrade names businesses after the search keyword.
+func mockTrade(keyword string) demoTrade {
+	keyword = strings.TrimSpace(strings.ReplaceAll(strings.ToLower(keyword), "mock:bad", ""))
+	for _, t := range demoTrades {
+		if strings.Contains(keyword, strings.TrimSuffix(t.keyword, "s")) {
+			return t
+		}
+	}
+	word := strings.TrimSuffix(keyword, "s")
+	if word == "" {
+		word = "service"
+	}
+	category := strings.ToUpper(word[:1]) + word[1:]
+	return demoTrade{keyword: keyword, category: category, suffixes: []string{category, category + " Services", category + " & Co", category + " Ltd"}}
+}
+
+// mockCity puts leads in the searched location, with a demo city's
+// streets and coordinates.
+func mockCity(rng *rand.Rand, location string) demoCity {
+	for _, c := range demoCities {
+		if strings.EqualFold(c.name, strings.TrimSpace(location)) {
+			return c
+		}
+	}
+	c := demoCities[rng.Intn(len(demoCities))]
+	if location = strings.TrimSpace(location); location != "" {
+		c.name = location
+	}
+	return c
+}
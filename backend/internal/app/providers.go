@@ -0,0 +1,19 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/scraper"
+)
+
+// --- LEAD PROVIDERS ---
+
+// leadProviders holds the sources searches can run against; main registers
+// them at startup.
+var leadProviders = scraper.NewRegistry()
+
+func getSourcesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, leadProviders.Sources())
+}
@@ -0,0 +1,447 @@
+package app
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// --- WEB PUSH ---
+//
+// Browser notifications are sent with the Web Push protocol: payloads are
+// encrypted for each subscription (RFC 8291) and requests are signed with
+// the server's VAPID key (RFC 8292), so no push vendor account is needed.
+
+// How often the dispatcher looks for callbacks that have come due.
+const PUSH_CALLBACK_CHECK_INTERVAL = time.Minute
+
+// Callbacks that came due longer ago than this (e.g. while the server was
+// down) are marked as handled without sending a stale notification.
+const PUSH_CALLBACK_MAX_LATENESS = time.Hour
+
+// How long push services should hold a notification for an offline browser.
+const PUSH_TTL_SECONDS = 4 * 60 * 60
+
+var vapidSubject = envOrDefault("VAPID_SUBJECT", "mailto:admin@localhost")
+var vapidKey = loadVAPIDKey()
+var pushClient = &http.Client{Timeout: 15 * time.Second}
+
+type pushSubscriptionInput struct {
+	Endpoint string `json:"endpoint" binding:"required"`
+	Keys     struct {
+		P256dh string `json:"p256dh" binding:"required"`
+		Auth   string `json:"auth" binding:"required"`
+	} `json:"keys" binding:"required"`
+}
+
+type pushSubscription struct {
+	endpoint string
+	p256dh   []byte
+	auth     []byte
+}
+
+// pushMessage is the JSON payload handed to the service worker.
+type pushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+}
+
+// loadVAPIDKey reads VAPID_PRIVATE_KEY, the raw P-256 scalar in base64url as
+// printed by -generate-vapid-keys. Push is disabled when it is unset.
+func loadVAPIDKey() *ecdsa.PrivateKey {
+	encoded := strings.TrimSpace(os.Getenv("VAPID_PRIVATE_KEY"))
+	if encoded == "" {
+		return nil
+	}
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		log.Fatalf("VAPID_PRIVATE_KEY is not valid base64url: %v", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		log.Fatalf("VAPID_PRIVATE_KEY is not a P-256 private key: %v", err)
+	}
+	pub := key.PublicKey().Bytes()
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+}
+
+func pushConfigured() bool {
+	return vapidKey != nil
+}
+
+// vapidPublicKey is the uncompressed public key in base64url, which browsers
+// take as applicationServerKey when subscribing.
+func vapidPublicKey() string {
+	pub, err := vapidKey.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// generateVAPIDKeys prints a fresh key pair for VAPID_PRIVATE_KEY.
+func generateVAPIDKeys() error {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("VAPID_PRIVATE_KEY=%s\n", base64.RawURLEncoding.EncodeToString(key.Bytes()))
+	fmt.Printf("# public key: %s\n", base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()))
+	return nil
+}
+
+// decodeBase64URL accepts base64url with or without padding, which is how
+// browsers and key tools variously hand keys out.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// encryptPushPayload encrypts plaintext for one subscription using the
+// aes128gcm content coding, as a single record.
+func encryptPushPayload(sub pushSubscription, plaintext []byte) ([]byte, error) {
+	uaPublic, err := ecdh.P256().NewPublicKey(sub.p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription key: %w", err)
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := "WebPush: info\x00" + string(sub.p256dh) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, sub.auth, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last (and only) record; no padding follows.
+	record := gcm.Seal(nil, nonce, append(plaintext, 0x02), nil)
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(4096))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(record)
+	return body.Bytes(), nil
+}
+
+// vapidAuthorization signs a short-lived token for the push service that
+// owns endpoint.
+func vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": vapidSubject,
+	})
+	signed, err := token.SignedString(vapidKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", signed, vapidPublicKey()), nil
+}
+
+// sendPush delivers one message. gone is true when the push service says
+// the subscription no longer exists and it should be forgotten.
+func sendPush(sub pushSubscription, msg pushMessage) (gone bool, err error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return false, err
+	}
+	authorization, err := vapidAuthorization(sub.endpoint)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(PUSH_TTL_SECONDS))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return true, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("push service returned status %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// notifyUser pushes msg to every browser the user has subscribed and
+// prunes subscriptions the push service has expired. It returns how many
+// deliveries were accepted.
+func notifyUser(userID int64, msg pushMessage) int {
+	if !pushConfigured() {
+		return 0
+	}
+	rows, err := db.Query("SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = ?", userID)
+	if err != nil {
+		log.Printf("Failed to load push subscriptions for user %d: %v", userID, err)
+		return 0
+	}
+	var subs []pushSubscription
+	for rows.Next() {
+		var sub pushSubscription
+		var p256dh, auth string
+		if err := rows.Scan(&sub.endpoint, &p256dh, &auth); err != nil {
+			log.Printf("Error scanning push subscription: %v", err)
+			continue
+		}
+		sub.p256dh, _ = decodeBase64URL(p256dh)
+		sub.auth, _ = decodeBase64URL(auth)
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	delivered := 0
+	for _, sub := range subs {
+		gone, err := sendPush(sub, msg)
+		if err != nil {
+			log.Printf("Push to user %d failed: %v", userID, err)
+			continue
+		}
+		if gone {
+			if _, err := db.Exec("DELETE FROM push_subscriptions WHERE endpoint = ?", sub.endpoint); err != nil {
+				log.Printf("Failed to remove expired push subscription: %v", err)
+			}
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// notifySearchFinished tells the search's owner it has completed or failed.
+func notifySearchFinished(searchID string) {
+	if !pushConfigured() {
+		return
+	}
+	var userID int64
+	var keyword, location, status string
+	var leadsFound int
+	err := db.QueryRow("SELECT user_id, keyword, location, status, leads_found FROM searches WHERE id = ?", searchID).
+		Scan(&userID, &keyword, &location, &status, &leadsFound)
+	if err != nil {
+		log.Printf("Failed to load search %s for push notification: %v", searchID, err)
+		return
+	}
+
+	query := keyword
+	if location != "" {
+		query = fmt.Sprintf("%s in %s", keyword, location)
+	}
+	msg := pushMessage{Title: "Search finished", Body: fmt.Sprintf("%q found %d leads", query, leadsFound), URL: "/searches/" + searchID, Tag: "search-" + searchID}
+	if status == "Completed with warnings" {
+		msg.Body += " (some could not be saved)"
+	}
+	if status == "Failed" {
+		msg.Title = "Search failed"
+		msg.Body = fmt.Sprintf("%q could not be completed", query)
+	}
+	notifyUser(userID, msg)
+}
+
+// dispatchCallbackPushes notifies reps of CRM callbacks that have come due.
+// crm_leads.callback_pushed_for records which callback time was handled, so
+// rescheduling a callback makes it eligible again.
+func dispatchCallbackPushes() {
+	if !pushConfigured() {
+		return
+	}
+	rows, err := db.Query(`
+        SELECT user_id, lead_id, COALESCE(company_name, ''), callback_date FROM crm_leads
+        WHERE callback_date IS NOT NULL AND deleted_at IS NULL
+          AND callback_pushed_for IS NOT callback_date
+          AND user_id IN (SELECT user_id FROM push_subscriptions)
+    `)
+	if err != nil {
+		log.Printf("Failed to load due callbacks: %v", err)
+		return
+	}
+	type callback struct {
+		userID      int64
+		leadID      string
+		companyName string
+		at          time.Time
+	}
+	now := time.Now()
+	var due []callback
+	for rows.Next() {
+		var cb callback
+		if err := rows.Scan(&cb.userID, &cb.leadID, &cb.companyName, &cb.at); err != nil {
+			log.Printf("Error scanning callback: %v", err)
+			continue
+		}
+		if cb.at.After(now) {
+			continue
+		}
+		due = append(due, cb)
+	}
+	rows.Close()
+
+	for _, cb := range due {
+		if now.Sub(cb.at) <= PUSH_CALLBACK_MAX_LATENESS {
+			notifyUser(cb.userID, pushMessage{
+				Title: "Callback due",
+				Body:  fmt.Sprintf("Time to call %s back", cb.companyName),
+				URL:   "/crm?lead=" + cb.leadID,
+				Tag:   "callback-" + cb.leadID,
+			})
+		}
+		if _, err := db.Exec("UPDATE crm_leads SET callback_pushed_for = callback_date WHERE user_id = ? AND lead_id = ?", cb.userID, cb.leadID); err != nil {
+			log.Printf("Failed to mark callback for lead %s as pushed: %v", cb.leadID, err)
+		}
+	}
+}
+
+// --- PUSH HANDLERS ---
+func getVAPIDKeyHandler(c *gin.Context) {
+	if !pushConfigured() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Push notifications are not configured"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"publicKey": vapidPublicKey()})
+}
+
+func subscribePushHandler(c *gin.Context) {
+	if !pushConfigured() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Push notifications are not configured"})
+		return
+	}
+	var input pushSubscriptionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if u, err := url.Parse(input.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "endpoint must be an https URL"})
+		return
+	}
+	p256dh, err := decodeBase64URL(input.Keys.P256dh)
+	if err == nil {
+		_, err = ecdh.P256().NewPublicKey(p256dh)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keys.p256dh must be a base64url P-256 public key"})
+		return
+	}
+	if auth, err := decodeBase64URL(input.Keys.Auth); err != nil || len(auth) != 16 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keys.auth must be a 16-byte base64url secret"})
+		return
+	}
+
+	userID, _ := c.Get("userID")
+	_, err = db.ExecContext(c.Request.Context(), `
+        INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth) VALUES (?, ?, ?, ?)
+        ON CONFLICT (endpoint) DO UPDATE SET user_id = excluded.user_id, p256dh = excluded.p256dh, auth = excluded.auth
+    `, userID, input.Endpoint, input.Keys.P256dh, input.Keys.Auth)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save push subscription"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func unsubscribePushHandler(c *gin.Context) {
+	var input struct {
+		Endpoint string `json:"endpoint" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, _ := c.Get("userID")
+	if _, err := db.ExecContext(c.Request.Context(), "DELETE FROM push_subscriptions WHERE user_id = ? AND endpoint = ?", userID, input.Endpoint); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove push subscription"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// testPushHandler sends a notification to the caller's browsers so the
+// settings page can confirm push works end to end.
+func testPushHandler(c *gin.Context) {
+	if !pushConfigured() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Push notifications are not configured"})
+		return
+	}
+	userID, _ := c.Get("userID")
+	delivered := notifyUser(userID.(int64), pushMessage{Title: "BlueLeads", Body: "Push notifications are working", Tag: "test"})
+	c.JSON(http.StatusOK, gin.H{"delivered": delivered})
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- QUOTAS ---
+//
+// Limits of 0 mean unlimited.
+
+type Quotas struct {
+	SearchesPerMonth     int `json:"searchesPerMonth"`
+	MaxLeads             int `json:"maxLeads"`
+	MaxConcurrentScrapes int `json:"maxConcurrentScrapes"`
+}
+
+// defaultQuotas are the free plan's limits; paid plans keep theirs in the
+// plans table.
+var defaultQuotas = Quotas{
+	SearchesPerMonth:     envInt("QUOTA_SEARCHES_PER_MONTH", 0),
+	MaxLeads:             envInt("QUOTA_MAX_LEADS", 0),
+	MaxConcurrentScrapes: envInt("QUOTA_MAX_CONCURRENT_SCRAPES", 2),
+}
+
+func quotasFor(ctx context.Context, userID int64) (Quotas, error) {
+	plan, err := planForUser(ctx, userID)
+	if err != nil {
+		return Quotas{}, err
+	}
+	return plan.Quotas, nil
+}
+
+type usageCounter struct {
+	Used  int  `json:"used"`
+	Limit *int `json:"limit"`
+}
+
+func newUsageCounter(used, limit int) usageCounter {
+	u := usageCounter{Used: used}
+	if limit > 0 {
+		u.Limit = &limit
+	}
+	return u
+}
+
+func (u usageCounter) exhausted() bool {
+	return u.Limit != nil && u.Used >= *u.Limit
+}
+
+type Usage struct {
+	PeriodStart       time.Time    `json:"periodStart"`
+	PeriodEnd         time.Time    `json:"periodEnd"`
+	Searches          usageCounter `json:"searches"`
+	Leads             usageCounter `json:"leads"`
+	ConcurrentScrapes usageCounter `json:"concurrentScrapes"`
+}
+
+// getUsage measures a user against their quotas. Searches count towards
+// the month they were started in even if they are later deleted.
+func getUsage(ctx context.Context, userID int64) (Usage, error) {
+	var usage Usage
+	quotas, err := quotasFor(ctx, userID)
+	if err != nil {
+		return usage, err
+	}
+
+	now := time.Now().UTC()
+	usage.PeriodStart = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	usage.PeriodEnd = usage.PeriodStart.AddDate(0, 1, 0)
+
+	var searches, leads, running int
+	err = db.QueryRowContext(ctx, `
+        SELECT
+            (SELECT COUNT(*) FROM searches WHERE user_id = ? AND created_at >= ?),
+            (SELECT COUNT(*) FROM leads l JOIN searches s ON s.id = l.search_id WHERE s.user_id = ? AND l.deleted_at IS NULL AND s.deleted_at IS NULL),
+            (SELECT COUNT(*) FROM searches WHERE user_id = ? AND status = 'In Progress')
+    `, userID, usage.PeriodStart.Format("2006-01-02 15:04:05"), userID, userID).Scan(&searches, &leads, &running)
+	if err != nil {
+		return usage, err
+	}
+
+	usage.Searches = newUsageCounter(searches, quotas.SearchesPerMonth)
+	usage.Leads = newUsageCounter(leads, quotas.MaxLeads)
+	usage.ConcurrentScrapes = newUsageCounter(running, quotas.MaxConcurrentScrapes)
+	return usage, nil
+}
+
+// checkSearchQuota reports whether the user may start another search. Used
+// up allowances are 402 so the client can offer an upgrade; too many running
+// scrapes is a 429 that clears by itself.
+func checkSearchQuota(ctx context.Context, userID int64) (int, string, error) {
+	usage, err := getUsage(ctx, userID)
+	if err != nil {
+		return 0, "", err
+	}
+	switch {
+	case usage.Searches.exhausted():
+		return http.StatusPaymentRequired, fmt.Sprintf("You have used all %d searches for this month; the allowance resets on %s", *usage.Searches.Limit, usage.PeriodEnd.Format("2 January")), nil
+	case usage.Leads.exhausted():
+		return http.StatusPaymentRequired, fmt.Sprintf("You have reached your limit of %d stored leads; delete some searches to start another", *usage.Leads.Limit), nil
+	case usage.ConcurrentScrapes.exhausted():
+		return http.StatusTooManyRequests, fmt.Sprintf("You already have %d searches running; wait for one to finish", usage.ConcurrentScrapes.Used), nil
+	}
+	return http.StatusOK, "", nil
+}
+
+func getUsageHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	usage, err := getUsage(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
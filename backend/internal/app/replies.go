@@ -0,0 +1,288 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/store"
+)
+
+// --- REPLY DETECTION ---
+//
+// A user can connect the IMAP mailbox that replies to their campaigns
+// land in. A background job reads the headers of new messages there and
+// matches each to a campaign email, by the message IDs in In-Reply-To and
+// References, or failing that by the sender's address. A matched reply is
+// logged on the lead's activity and the card moves to a "Replied" column,
+// which is added to the board the first time it's needed. Mail that was
+// already in the mailbox when it was connected is ignored.
+
+const IMAP_POLL_INTERVAL = 5 * time.Minute
+const REPLIED_COLUMN_TITLE = "Replied"
+
+// Mailbox is a user's connected IMAP mailbox.
+type Mailbox struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Security string `json:"security"`
+	Username string `json:"username"`
+	// Password is never sent back; leaving it out of an update keeps the
+	// saved one.
+	Password     string     `json:"password,omitempty"`
+	Folder       string     `json:"folder"`
+	LastPolledAt *time.Time `json:"lastPolledAt"`
+	LastError    string     `json:"lastError"`
+
+	uidValidity uint32
+	lastUID     uint32
+}
+
+var mailHostPattern = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+func (m *Mailbox) validate(fe fieldErrors) {
+	m.Host = strings.TrimSpace(m.Host)
+	fe.check(mailHostPattern.MatchString(m.Host) && len(m.Host) <= 253, "host", "must be a host name like imap.example.com")
+	if m.Security == "" {
+		m.Security = IMAP_TLS
+	}
+	fe.check(m.Security == IMAP_TLS || m.Security == IMAP_STARTTLS || m.Security == IMAP_NONE, "security", "must be tls, starttls or none")
+	if m.Port == 0 {
+		m.Port = 993
+		if m.Security != IMAP_TLS {
+			m.Port = 143
+		}
+	}
+	fe.check(m.Port >= 1 && m.Port <= 65535, "port", "must be between 1 and 65535")
+	checkLength(fe, "username", m.Username, 1, 320)
+	checkLength(fe, "password", m.Password, 1, 1000)
+	if m.Folder = strings.TrimSpace(m.Folder); m.Folder == "" {
+		m.Folder = "INBOX"
+	}
+	checkLength(fe, "folder", m.Folder, 1, 200)
+}
+
+// openMailbox connects, logs in and opens the folder, returning its
+// UIDVALIDITY and UIDNEXT.
+func openMailbox(ctx context.Context, m Mailbox) (*imapClient, uint32, uint32, error) {
+	c, err := dialIMAP(ctx, m.Host, m.Port, m.Security)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if err := c.login(m.Username, m.Password); err != nil {
+		c.logout()
+		return nil, 0, 0, err
+	}
+	validity, next, err := c.examine(m.Folder)
+	if err != nil {
+		c.logout()
+		return nil, 0, 0, err
+	}
+	return c, validity, next, nil
+}
+
+// pollMailboxes is the background job that checks every connected mailbox
+// for replies.
+func pollMailboxes() {
+	tenants, err := mailboxTenants()
+	if err != nil {
+		log.Printf("Failed to load mailboxes: %v", err)
+		return
+	}
+	for _, t := range tenants {
+		repo := newRepository(t)
+		if err := pollMailbox(repo); err != nil {
+			log.Printf("Failed to check the mailbox of user %d: %v", t.UserID, err)
+		}
+	}
+}
+
+// pollMailbox records the replies among the new messages in the tenant
+// user's mailbox. Connection problems are saved for the user to see
+// rather than returned.
+func pollMailbox(repo *Repository) error {
+	m, err := repo.Mailbox()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), IMAP_TIMEOUT)
+	defer cancel()
+	c, validity, next, err := openMailbox(ctx, m)
+	if err != nil {
+		return repo.SaveMailboxPoll(m.uidValidity, m.lastUID, err.Error())
+	}
+	defer c.logout()
+
+	// A new UIDVALIDITY means the old UIDs mean nothing, so start again
+	// from what's there now.
+	if validity != m.uidValidity {
+		return repo.SaveMailboxPoll(validity, next-1, "")
+	}
+	messages, err := c.headersAfter(m.lastUID)
+	if err != nil {
+		return repo.SaveMailboxPoll(m.uidValidity, m.lastUID, err.Error())
+	}
+	lastUID := m.lastUID
+	for _, msg := range messages {
+		if err := recordReply(repo, msg, fmt.Sprintf("imap:%d:%d:%d", repo.Tenant().UserID, validity, msg.uid)); err != nil {
+			return err
+		}
+		if msg.uid > lastUID {
+			lastUID = msg.uid
+		}
+	}
+	return repo.SaveMailboxPoll(validity, lastUID, "")
+}
+
+// recordReply logs msg on its lead and moves the card to the Replied
+// column, if it's a reply to a campaign email that hasn't been recorded
+// yet. fallbackID identifies messages without a Message-ID.
+func recordReply(repo *Repository, msg imapMessage, fallbackID string) error {
+	var from string
+	if addr, err := mail.ParseAddress(msg.header.Get("From")); err == nil {
+		from = strings.ToLower(addr.Address)
+	}
+	refs := messageIDPattern.FindAllString(msg.header.Get("In-Reply-To")+" "+msg.header.Get("References"), -1)
+	campaignID, leadID, err := repo.ReplyRecipient(refs, from)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	messageID := strings.TrimSpace(msg.header.Get("Message-ID"))
+	if messageID == "" {
+		messageID = fallbackID
+	}
+	subject := msg.header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	receivedAt, err := msg.header.Date()
+	if err != nil {
+		receivedAt = time.Now()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+	recorded, err := txRepo.RecordEmailReply(messageID, campaignID, leadID, subject, receivedAt.UTC())
+	if err != nil || !recorded {
+		return err
+	}
+	if !txRepo.Crm().HasCard(leadID) {
+		return tx.Commit()
+	}
+	if err := txRepo.logActivity(leadID, "email_reply", map[string]interface{}{"campaignId": campaignID, "subject": subject}); err != nil {
+		return err
+	}
+	if err := moveToRepliedColumn(txRepo, leadID); err != nil {
+		return err
+	}
+	if _, err := txRepo.Crm().BumpVersion(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// moveToRepliedColumn moves a card to the Replied column, adding the
+// column if the board doesn't have one. A full column that rejects moves
+// leaves the card where it is.
+func moveToRepliedColumn(repo *Repository, leadID string) error {
+	columnID := crm.Slug(REPLIED_COLUMN_TITLE)
+	if !repo.Crm().HasColumn(columnID) {
+		if _, err := repo.Crm().CreateColumn(REPLIED_COLUMN_TITLE); err != nil {
+			return err
+		}
+	}
+	card, err := repo.Crm().Card(leadID)
+	if err != nil || card.ColumnID == columnID {
+		return err
+	}
+	wip, err := repo.Crm().CheckWIP(columnID, leadID)
+	if err != nil || wip.Rejects() {
+		return err
+	}
+	return repo.moveCrmLead(leadID, columnID, map[string]interface{}{"reply": true})
+}
+
+func getMailboxHandler(c *gin.Context) {
+	m, err := repoFrom(c).Mailbox()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No mailbox is connected"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mailbox"})
+		return
+	}
+	m.Password = ""
+	c.JSON(http.StatusOK, m)
+}
+
+// putMailboxHandler connects a mailbox, or changes the connected one,
+// after checking it can be logged into.
+func putMailboxHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input Mailbox
+	if !bindJSON(c, &input) {
+		return
+	}
+	if input.Password == "" {
+		if saved, err := repo.Mailbox(); err == nil {
+			input.Password = saved.Password
+		}
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), IMAP_TIMEOUT)
+	defer cancel()
+	client, validity, next, err := openMailbox(ctx, input)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Couldn't open the mailbox: " + err.Error()})
+		return
+	}
+	client.logout()
+
+	if err := repo.SaveMailbox(input, validity, next-1); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mailbox"})
+		return
+	}
+	m, err := repo.Mailbox()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mailbox"})
+		return
+	}
+	m.Password = ""
+	c.JSON(http.StatusOK, m)
+}
+
+func deleteMailboxHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteMailbox()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No mailbox is connected"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disconnect mailbox"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
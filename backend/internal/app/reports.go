@@ -0,0 +1,171 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/crm"
+)
+
+// --- REPORTS ---
+
+const (
+	REPORT_TOP_LEADS = 10
+	REPORT_CALLBACKS = 15
+)
+
+// pipelineReport is what goes into the pipeline PDF, gathered for one
+// organization as seen by one user.
+type pipelineReport struct {
+	branding  Branding
+	loc       *time.Location
+	now       time.Time
+	weekStart time.Time
+	columns   []crm.Column
+	cards     map[string]int
+	snoozed   int
+	calls     map[string]int
+	dialing   DialerStats
+	topLeads  []CrmLead
+	callbacks []CrmLead
+}
+
+func buildPipelineReport(repo *Repository, settings UserSettings, now time.Time) (pipelineReport, error) {
+	loc := settings.location()
+	r := pipelineReport{loc: loc, now: now, weekStart: weekStarting(now.In(loc)), cards: map[string]int{}}
+
+	var err error
+	if r.branding, err = repo.Branding(); err != nil {
+		return r, err
+	}
+	if r.columns, err = repo.Crm().Columns(); err != nil {
+		return r, err
+	}
+	leads, err := repo.CrmLeads()
+	if err != nil {
+		return r, err
+	}
+	snoozed, err := repo.SnoozedCrmLeads()
+	if err != nil {
+		return r, err
+	}
+	r.snoozed = len(snoozed)
+	if r.calls, err = repo.DispositionCounts(&r.weekStart, nil); err != nil {
+		return r, err
+	}
+	sessions, err := repo.OrgDialerSessions(&r.weekStart, nil)
+	if err != nil {
+		return r, err
+	}
+	for _, s := range sessions {
+		r.dialing.add(s.DialerStats)
+	}
+
+	// Top leads are the ones most recently marked interested.
+	for _, l := range leads {
+		r.cards[l.ColumnID]++
+		if l.LastDisposition == "interested" && l.LastCalledAt != nil {
+			r.topLeads = append(r.topLeads, l)
+		}
+	}
+	sort.Slice(r.topLeads, func(i, j int) bool { return r.topLeads[i].LastCalledAt.After(*r.topLeads[j].LastCalledAt) })
+	if len(r.topLeads) > REPORT_TOP_LEADS {
+		r.topLeads = r.topLeads[:REPORT_TOP_LEADS]
+	}
+
+	callbacks, err := repo.CallbackCrmLeads()
+	if err != nil {
+		return r, err
+	}
+	weekAhead := now.AddDate(0, 0, 7)
+	for _, l := range callbacks {
+		if !l.CallBackDate.Before(now) && l.CallBackDate.Before(weekAhead) && len(r.callbacks) < REPORT_CALLBACKS {
+			r.callbacks = append(r.callbacks, l)
+		}
+	}
+	return r, nil
+}
+
+func (r pipelineReport) render() []byte {
+	w := newPDFWriter()
+	r.branding.applyPDF(w)
+	w.Title(r.branding.name() + " pipeline report")
+	w.Line(fmt.Sprintf("Generated %s", r.now.In(r.loc).Format("Monday 2 January 2006, 15:04 MST")))
+
+	w.Section("Board")
+	widths := []float64{300, 80}
+	w.Row(widths, true, "Column", "Cards")
+	total := 0
+	for _, col := range r.columns {
+		w.Row(widths, false, col.Title, fmt.Sprint(r.cards[col.ID]))
+		total += r.cards[col.ID]
+	}
+	w.Row(widths, true, "Total", fmt.Sprint(total))
+	if r.snoozed > 0 {
+		w.Line(fmt.Sprintf("%d more snoozed and off the board.", r.snoozed))
+	}
+
+	w.Section("Calls this week, since " + r.weekStart.Format("Monday 2 January"))
+	calls := 0
+	for _, d := range dispositions {
+		calls += r.calls[d.ID]
+	}
+	if calls == 0 {
+		w.Line("No calls yet this week.")
+	} else {
+		w.Row(widths, true, "Outcome", "Calls")
+		for _, d := range dispositions {
+			w.Row(widths, false, d.Label, fmt.Sprint(r.calls[d.ID]))
+		}
+		w.Row(widths, true, "Total", fmt.Sprint(calls))
+	}
+	if r.dialing.Dials > 0 {
+		w.Line(fmt.Sprintf("Dialer: %d dials at %.1f an hour, %.1f%% connected, %s talk time.",
+			r.dialing.Dials, r.dialing.DialsPerHour, r.dialing.ConnectRate, time.Duration(r.dialing.TalkSeconds)*time.Second))
+	}
+
+	leadWidths := []float64{200, 110, 185}
+	w.Section("Top leads")
+	if len(r.topLeads) == 0 {
+		w.Line("No leads have said they're interested yet.")
+	} else {
+		w.Row(leadWidths, true, "Company", "Phone", "Marked interested")
+		for _, l := range r.topLeads {
+			w.Row(leadWidths, false, l.CompanyName, l.Phone, l.LastCalledAt.In(r.loc).Format("Mon 2 Jan 15:04"))
+		}
+	}
+
+	w.Section("Callbacks in the next seven days")
+	if len(r.callbacks) == 0 {
+		w.Line("No callbacks booked.")
+	} else {
+		w.Row(leadWidths, true, "Company", "Phone", "Callback")
+		for _, l := range r.callbacks {
+			w.Row(leadWidths, false, l.CompanyName, l.Phone, l.CallBackDate.In(r.loc).Format("Mon 2 Jan 15:04"))
+		}
+	}
+	return w.Bytes()
+}
+
+// getPipelineReportHandler renders a PDF summary of the board, this week's
+// calls, the hottest leads and upcoming callbacks, in the user's timezone.
+func getPipelineReportHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	report, err := buildPipelineReport(repo, settings, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build pipeline report"})
+		return
+	}
+	filename := fmt.Sprintf("pipeline-%s.pdf", report.now.In(report.loc).Format("2006-01-02"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "application/pdf", report.render())
+}
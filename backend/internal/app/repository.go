@@ -0,0 +1,3439 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+)
+
+// --- SCOPED REPOSITORY ---
+
+// errDomainTaken is returned when an email domain is already another
+// organization's for single sign-on.
+var errDomainTaken = errors.New("domain belongs to another organization")
+
+// errDomainUnverified means a claimed SSO domain's DNS doesn't carry the
+// verification record yet.
+var errDomainUnverified = errors.New("domain verification record not found")
+
+// Repository reads and writes tenant data on behalf of one organization.
+// Every method adds the organization scope itself, so handlers never build
+// ownership clauses and can't forget one. Queries run under ctx, so a
+// repository taken from a request stops working once the client goes away.
+type Repository struct {
+	tenant Tenant
+	q      store.Querier
+	ctx    context.Context
+}
+
+func newRepository(t Tenant) *Repository {
+	return &Repository{tenant: t, q: db, ctx: context.Background()}
+}
+
+func repoFrom(c *gin.Context) *Repository {
+	return &Repository{tenant: tenantFrom(c), q: db, ctx: c.Request.Context()}
+}
+
+// WithTx returns a copy of the repository that runs inside tx.
+func (r *Repository) WithTx(tx *sql.Tx) *Repository {
+	return &Repository{tenant: r.tenant, q: tx, ctx: r.ctx}
+}
+
+// OrganizationName returns the name of the tenant's organization.
+func (r *Repository) OrganizationName() (string, error) {
+	var name string
+	err := r.q.QueryRowContext(r.ctx, "SELECT name FROM organizations WHERE id = ?", r.tenant.OrgID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	return name, err
+}
+
+// Branding returns the tenant user's white-label branding, which is blank
+// until they set it.
+func (r *Repository) Branding() (Branding, error) {
+	var b Branding
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT o.name, COALESCE(b.agency_name, ''), COALESCE(b.primary_color, ''), COALESCE(b.accent_color, ''), COALESCE(b.footer_text, ''), COALESCE(b.logo, '')
+        FROM organizations o LEFT JOIN brandings b ON b.user_id = ?1 AND b.org_id = o.id
+        WHERE o.id = ?2`, r.tenant.UserID, r.tenant.OrgID).Scan(&b.orgName, &b.AgencyName, &b.PrimaryColor, &b.AccentColor, &b.FooterText, &b.logoKey)
+	if err == sql.ErrNoRows {
+		return b, store.ErrNotFound
+	}
+	if b.logoKey != "" {
+		b.Logo = "/api/settings/branding/logo"
+	}
+	return b, err
+}
+
+// SaveBranding stores the user's branding, keeping their logo.
+func (r *Repository) SaveBranding(b Branding) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO brandings (user_id, org_id, agency_name, primary_color, accent_color, footer_text, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (user_id) DO UPDATE SET org_id = excluded.org_id, agency_name = excluded.agency_name, primary_color = excluded.primary_color,
+            accent_color = excluded.accent_color, footer_text = excluded.footer_text, updated_at = excluded.updated_at
+    `, r.tenant.UserID, r.tenant.OrgID, b.AgencyName, b.PrimaryColor, b.AccentColor, b.FooterText, time.Now().UTC())
+	return err
+}
+
+// SetBrandingLogo records the attachment key of the user's logo, empty for
+// none.
+func (r *Repository) SetBrandingLogo(key string) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO brandings (user_id, org_id, logo, updated_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_id) DO UPDATE SET org_id = excluded.org_id, logo = excluded.logo, updated_at = excluded.updated_at
+    `, r.tenant.UserID, r.tenant.OrgID, key, time.Now().UTC())
+	return err
+}
+
+// Team returns the tenant's organization with its active members.
+func (r *Repository) Team() (Team, error) {
+	t := Team{ID: r.tenant.OrgID, Members: []TeamMember{}}
+	var ownerID sql.NullInt64
+	err := r.q.QueryRowContext(r.ctx, "SELECT name, owner_id, leaderboard_enabled FROM organizations WHERE id = ?", r.tenant.OrgID).Scan(&t.Name, &ownerID, &t.LeaderboardEnabled)
+	if err == sql.ErrNoRows {
+		return t, store.ErrNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+	t.OwnerID = ownerID.Int64
+
+	rows, err := r.q.QueryContext(r.ctx, "SELECT id, name, team_role FROM users WHERE org_id = ? AND disabled_at IS NULL ORDER BY name, id", r.tenant.OrgID)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m TeamMember
+		if err := rows.Scan(&m.ID, &m.Name, &m.Role); err != nil {
+			return t, err
+		}
+		t.Members = append(t.Members, m)
+	}
+	return t, rows.Err()
+}
+
+// MemberNames returns the name of every member of the organization,
+// including disabled ones.
+func (r *Repository) MemberNames() (map[int64]string, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT id, name FROM users WHERE org_id = ?", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+// HasMember reports whether userID is an active member of the tenant's
+// organization.
+func (r *Repository) HasMember(userID int64) (bool, error) {
+	var n int
+	err := r.q.QueryRowContext(r.ctx, "SELECT COUNT(*) FROM users WHERE id = ? AND org_id = ? AND disabled_at IS NULL", userID, r.tenant.OrgID).Scan(&n)
+	return n > 0, err
+}
+
+func (r *Repository) SetLeaderboardEnabled(enabled bool) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE organizations SET leaderboard_enabled = ? WHERE id = ?", enabled, r.tenant.OrgID))
+}
+
+// CreateInvitation makes a code that signs its user up into the tenant's
+// organization.
+func (r *Repository) CreateInvitation(email string) (Invitation, error) {
+	return insertInvitation(r.ctx, r.q, &r.tenant.OrgID, email, r.tenant.UserID)
+}
+
+// Invitations returns the organization's invitations that can still be used.
+func (r *Repository) Invitations() ([]Invitation, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+pendingInvitationColumns+" FROM invitations WHERE org_id = ? AND used_at IS NULL AND expires_at > ? ORDER BY created_at DESC", r.tenant.OrgID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return scanInvitations(rows)
+}
+
+func (r *Repository) DeleteInvitation(id string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM invitations WHERE id = ? AND org_id = ? AND used_at IS NULL", id, r.tenant.OrgID))
+}
+
+// SSOConfig returns the organization's single sign-on settings, or
+// store.ErrNotFound when it has none.
+func (r *Repository) SSOConfig() (SSOConfig, error) {
+	return loadSSOConfig(r.ctx, r.q, r.tenant.OrgID)
+}
+
+// SaveSSOConfig replaces the organization's single sign-on settings.
+// Domains it has already verified stay active; new ones become claims that
+// need VerifySSODomain before anyone can sign in with them. It fails with
+// errDomainTaken if another organization has verified one of the domains;
+// run it in a transaction so nothing is half-saved. Changing the issuer or
+// client unlinks every member's password account, since the links vouched
+// for the old provider.
+func (r *Repository) SaveSSOConfig(cfg SSOConfig) error {
+	groupRoles, err := json.Marshal(cfg.GroupRoles)
+	if err != nil {
+		return err
+	}
+	var issuer, clientID string
+	err = r.q.QueryRowContext(r.ctx, "SELECT issuer, client_id FROM sso_configs WHERE org_id = ?", r.tenant.OrgID).Scan(&issuer, &clientID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if issuer != cfg.Issuer || clientID != cfg.ClientID {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE users SET sso_linked_at = NULL WHERE org_id = ?", r.tenant.OrgID); err != nil {
+			return err
+		}
+	}
+	_, err = r.q.ExecContext(r.ctx, `
+        INSERT INTO sso_configs (org_id, issuer, client_id, client_secret, groups_claim, group_roles, default_role, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+        ON CONFLICT (org_id) DO UPDATE SET issuer = excluded.issuer, client_id = excluded.client_id, client_secret = excluded.client_secret,
+            groups_claim = excluded.groups_claim, group_roles = excluded.group_roles, default_role = excluded.default_role, updated_at = excluded.updated_at
+    `, r.tenant.OrgID, cfg.Issuer, cfg.ClientID, seal(cfg.ClientSecret), cfg.GroupsClaim, string(groupRoles), cfg.DefaultRole)
+	if err != nil {
+		return err
+	}
+	placeholders, args := store.InList(cfg.Domains)
+	args = append([]interface{}{r.tenant.OrgID}, args...)
+	if _, err := r.q.ExecContext(r.ctx, "DELETE FROM sso_domains WHERE org_id = ? AND domain NOT IN ("+placeholders+")", args...); err != nil {
+		return err
+	}
+	if _, err := r.q.ExecContext(r.ctx, "DELETE FROM sso_domain_claims WHERE org_id = ? AND domain NOT IN ("+placeholders+")", args...); err != nil {
+		return err
+	}
+	for _, d := range cfg.Domains {
+		var owner int64
+		err := r.q.QueryRowContext(r.ctx, "SELECT org_id FROM sso_domains WHERE domain = ?", d).Scan(&owner)
+		if err == nil && owner != r.tenant.OrgID {
+			return errDomainTaken
+		}
+		if err == nil {
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		_, err = r.q.ExecContext(r.ctx, "INSERT OR IGNORE INTO sso_domain_claims (org_id, domain, token) VALUES (?, ?, ?)", r.tenant.OrgID, d, randomSSOValue())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifySSODomain activates a claimed domain once its DNS proves the
+// organization controls it. It returns store.ErrNotFound if the organization
+// hasn't claimed the domain, errDomainTaken if another has verified it,
+// and errDomainUnverified if the TXT record isn't there yet.
+func (r *Repository) VerifySSODomain(domain string) error {
+	var token string
+	err := r.q.QueryRowContext(r.ctx, "SELECT token FROM sso_domain_claims WHERE org_id = ? AND domain = ?", r.tenant.OrgID, domain).Scan(&token)
+	if err == sql.ErrNoRows {
+		return store.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	ok, err := hasSSODomainRecord(r.ctx, domain, token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errDomainUnverified
+	}
+	var owner int64
+	err = r.q.QueryRowContext(r.ctx, "SELECT org_id FROM sso_domains WHERE domain = ?", domain).Scan(&owner)
+	if err == nil && owner != r.tenant.OrgID {
+		return errDomainTaken
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if _, err := r.q.ExecContext(r.ctx, "INSERT OR REPLACE INTO sso_domains (domain, org_id, verified_at) VALUES (?, ?, CURRENT_TIMESTAMP)", domain, r.tenant.OrgID); err != nil {
+		return err
+	}
+	_, err = r.q.ExecContext(r.ctx, "DELETE FROM sso_domain_claims WHERE org_id = ? AND domain = ?", r.tenant.OrgID, domain)
+	return err
+}
+
+func (r *Repository) DeleteSSOConfig() error {
+	if _, err := r.q.ExecContext(r.ctx, "DELETE FROM sso_domains WHERE org_id = ?", r.tenant.OrgID); err != nil {
+		return err
+	}
+	if _, err := r.q.ExecContext(r.ctx, "DELETE FROM sso_domain_claims WHERE org_id = ?", r.tenant.OrgID); err != nil {
+		return err
+	}
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM sso_configs WHERE org_id = ?", r.tenant.OrgID))
+}
+
+func (r *Repository) Tenant() Tenant {
+	return r.tenant
+}
+
+// --- SEARCHES ---
+
+// ownedSearchIDs is a subquery for the tenant's live searches; its single
+// argument is the organization ID.
+const ownedSearchIDs = searches.OWNED_IDS
+
+// Searches returns the tenant's searches, on the same connection or
+// transaction as r.
+func (r *Repository) Searches() searches.Repository {
+	return searches.NewRepository(r.ctx, r.q, r.tenant)
+}
+
+// --- LEADS ---
+
+// Leads returns the leads in the tenant's searches, on the same connection
+// or transaction as r.
+func (r *Repository) Leads() leads.Repository {
+	return leads.NewRepository(r.ctx, r.q, r.tenant, fieldCodec{})
+}
+
+// DuplicateClusters groups the tenant's live leads that share a phone
+// number or website domain. Clusters the tenant has ignored are left out
+// unless includeIgnored is set.
+func (r *Repository) DuplicateClusters(includeIgnored bool) ([]DuplicateCluster, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT l.id, l.search_id, s.keyword, COALESCE(l.company_name, ''), COALESCE(l.phone, ''), COALESCE(l.website, ''),
+               EXISTS (SELECT 1 FROM crm_leads c WHERE c.org_id = s.org_id AND c.lead_id = l.id AND c.deleted_at IS NULL)
+        FROM leads l JOIN searches s ON s.id = l.search_id
+        WHERE s.org_id = ? AND s.deleted_at IS NULL AND l.deleted_at IS NULL
+        ORDER BY l.rowid
+    `, r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	var leads []DuplicateLead
+	for rows.Next() {
+		var l DuplicateLead
+		if err := rows.Scan(&l.ID, &l.SearchID, &l.Keyword, &l.CompanyName, &l.Phone, &l.Website, &l.OnBoard); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		l.Phone = unseal(l.Phone)
+		leads = append(leads, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ignored := map[string]bool{}
+	if !includeIgnored {
+		rows, err := r.q.QueryContext(r.ctx, "SELECT cluster_id FROM lead_duplicate_ignores WHERE org_id = ?", r.tenant.OrgID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			ignored[id] = true
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	clusters := []DuplicateCluster{}
+	for _, c := range clusterDuplicates(leads) {
+		if !ignored[c.ID] {
+			clusters = append(clusters, c)
+		}
+	}
+	return clusters, nil
+}
+
+func (r *Repository) IgnoreDuplicateCluster(clusterID string) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT OR IGNORE INTO lead_duplicate_ignores (org_id, cluster_id) VALUES (?, ?)", r.tenant.OrgID, clusterID)
+	return err
+}
+
+// --- CRM ---
+
+// CrmLeads returns the board, leaving out leads that are snoozed.
+func (r *Repository) CrmLeads() ([]CrmLead, error) {
+	return r.FilteredCrmLeads(crmFilter{})
+}
+
+// FilteredCrmLeads returns the cards on the board that match the filter,
+// leaving out leads that are snoozed.
+func (r *Repository) FilteredCrmLeads(f crmFilter) ([]CrmLead, error) {
+	return r.Crm().Cards(" AND (snoozed_until IS NULL OR snoozed_until <= ?)"+f.cond, append([]interface{}{time.Now().UTC()}, f.args...)...)
+}
+
+func (r *Repository) SnoozedCrmLeads() ([]CrmLead, error) {
+	return r.Crm().Cards(" AND snoozed_until > ? ORDER BY snoozed_until", time.Now().UTC())
+}
+
+// CallbackCrmLeads returns the cards with a callback booked, soonest
+// first. Snoozed cards are left out.
+func (r *Repository) CallbackCrmLeads() ([]CrmLead, error) {
+	leads, err := r.Crm().Cards(" AND callback_date IS NOT NULL AND (snoozed_until IS NULL OR snoozed_until <= ?)", time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	// Callback dates keep whatever offset the client sent, so they only
+	// sort correctly once parsed.
+	sort.SliceStable(leads, func(i, j int) bool { return leads[i].CallBackDate.Before(*leads[j].CallBackDate) })
+	return leads, nil
+}
+
+// callTarget is what's needed to work out when a card can be called.
+type callTarget struct {
+	LeadID   string
+	Timezone string
+	Hours    leads.OpeningHours
+}
+
+// CallTargets returns every card on the board that isn't snoozed.
+func (r *Repository) CallTargets() ([]callTarget, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT c.lead_id, COALESCE(l.timezone, ''), COALESCE(l.open_hours, '')
+        FROM crm_leads c LEFT JOIN leads l ON l.id = c.lead_id
+        WHERE c.org_id = ? AND c.deleted_at IS NULL AND (c.snoozed_until IS NULL OR c.snoozed_until <= ?)
+    `, r.tenant.OrgID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []callTarget
+	for rows.Next() {
+		var t callTarget
+		var rawHours string
+		if err := rows.Scan(&t.LeadID, &t.Timezone, &rawHours); err != nil {
+			return nil, err
+		}
+		t.Hours = leads.ParseStoredHours(rawHours)
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// DialerCandidates returns the cards in the given columns that have a
+// phone number and aren't snoozed or claimed by someone else, in board
+// order: by column, then fewest calls, then longest since the last one.
+func (r *Repository) DialerCandidates(columns []string) ([]dialerCandidate, error) {
+	now := time.Now().UTC()
+	args := []interface{}{r.tenant.OrgID, now, now, r.tenant.UserID}
+	for _, col := range columns {
+		args = append(args, col)
+	}
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT c.lead_id, COALESCE(l.timezone, ''), COALESCE(l.open_hours, ''), c.callback_date
+        FROM crm_leads c
+        JOIN crm_columns col ON col.org_id = c.org_id AND col.id = c.column_id
+        LEFT JOIN leads l ON l.id = c.lead_id
+        WHERE c.org_id = ? AND c.deleted_at IS NULL
+          AND (c.snoozed_until IS NULL OR c.snoozed_until <= ?)
+          AND (c.claimed_until IS NULL OR c.claimed_until <= ? OR c.claimed_by = ?)
+          AND (COALESCE(c.phone, '') != '' OR EXISTS (SELECT 1 FROM lead_phones p WHERE p.lead_id = c.lead_id))
+          AND c.column_id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")+`)
+        ORDER BY col.position, `+priorityOrderSQL("c.priority")+`, COALESCE(c.times_called, 0), c.last_called_at IS NOT NULL, c.last_called_at, c.rowid
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []dialerCandidate
+	for rows.Next() {
+		var cand dialerCandidate
+		var rawHours string
+		var callbackDate sql.NullTime
+		if err := rows.Scan(&cand.LeadID, &cand.Timezone, &rawHours, &callbackDate); err != nil {
+			return nil, err
+		}
+		cand.Hours = leads.ParseStoredHours(rawHours)
+		if callbackDate.Valid {
+			cand.CallBackDate = &callbackDate.Time
+		}
+		candidates = append(candidates, cand)
+	}
+	return candidates, rows.Err()
+}
+
+// StartDialerSession opens a dialer session for the tenant's user, or
+// returns the one they already have open; started says which.
+func (r *Repository) StartDialerSession() (session DialerSession, started bool, err error) {
+	session, err = r.OpenDialerSession()
+	if err != store.ErrNotFound {
+		return session, false, err
+	}
+	now := time.Now().UTC()
+	res, err := r.q.ExecContext(r.ctx, "INSERT INTO dialer_sessions (org_id, user_id, started_at) VALUES (?, ?, ?)", r.tenant.OrgID, r.tenant.UserID, now)
+	if err != nil {
+		return DialerSession{}, false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return DialerSession{}, false, err
+	}
+	return DialerSession{ID: id, UserID: r.tenant.UserID, StartedAt: now}, true, nil
+}
+
+// OpenDialerSession returns the user's open session, with its stats so far.
+func (r *Repository) OpenDialerSession() (DialerSession, error) {
+	sessions, err := r.queryDialerSessions(" AND s.user_id = ? AND s.ended_at IS NULL", r.tenant.UserID)
+	if err != nil {
+		return DialerSession{}, err
+	}
+	if len(sessions) == 0 {
+		return DialerSession{}, store.ErrNotFound
+	}
+	return sessions[0], nil
+}
+
+// StopDialerSession ends the user's open session and returns it.
+func (r *Repository) StopDialerSession() (DialerSession, error) {
+	res, err := r.q.ExecContext(r.ctx, "UPDATE dialer_sessions SET ended_at = ? WHERE org_id = ? AND user_id = ? AND ended_at IS NULL",
+		time.Now().UTC(), r.tenant.OrgID, r.tenant.UserID)
+	if err := store.ExpectOne(res, err); err != nil {
+		return DialerSession{}, err
+	}
+	sessions, err := r.queryDialerSessions(" AND s.user_id = ? ORDER BY s.ended_at DESC, s.id DESC LIMIT 1", r.tenant.UserID)
+	if err != nil {
+		return DialerSession{}, err
+	}
+	if len(sessions) == 0 {
+		return DialerSession{}, store.ErrNotFound
+	}
+	return sessions[0], nil
+}
+
+// DialerSessions returns the user's most recent sessions, newest first.
+func (r *Repository) DialerSessions(limit int) ([]DialerSession, error) {
+	return r.queryDialerSessions(" AND s.user_id = ? ORDER BY s.started_at DESC, s.id DESC LIMIT ?", r.tenant.UserID, limit)
+}
+
+// OrgDialerSessions returns every session in the organization started in
+// [from, to); either bound may be nil.
+func (r *Repository) OrgDialerSessions(from, to *time.Time) ([]DialerSession, error) {
+	where := ""
+	var args []interface{}
+	if from != nil {
+		where += " AND s.started_at >= ?"
+		args = append(args, from.UTC())
+	}
+	if to != nil {
+		where += " AND s.started_at < ?"
+		args = append(args, to.UTC())
+	}
+	return r.queryDialerSessions(where+" ORDER BY s.started_at", args...)
+}
+
+// queryDialerSessions loads the organization's sessions matching where,
+// which may also carry ORDER BY and LIMIT, totalling each one's calls.
+func (r *Repository) queryDialerSessions(where string, args ...interface{}) ([]DialerSession, error) {
+	connected := strings.TrimSuffix(strings.Repeat("?,", len(connectedDispositions)), ",")
+	query := `
+        SELECT s.id, s.user_id, s.started_at, s.ended_at,
+               (SELECT COUNT(*) FROM crm_calls c WHERE c.session_id = s.id),
+               (SELECT COUNT(*) FROM crm_calls c WHERE c.session_id = s.id AND c.disposition IN (` + connected + `)),
+               (SELECT COALESCE(SUM(c.duration_seconds), 0) FROM crm_calls c WHERE c.session_id = s.id)
+        FROM dialer_sessions s
+        WHERE s.org_id = ?` + where
+	queryArgs := make([]interface{}, 0, len(connectedDispositions)+1+len(args))
+	for _, d := range connectedDispositions {
+		queryArgs = append(queryArgs, d)
+	}
+	queryArgs = append(queryArgs, r.tenant.OrgID)
+	rows, err := r.q.QueryContext(r.ctx, query, append(queryArgs, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	sessions := []DialerSession{}
+	for rows.Next() {
+		var s DialerSession
+		var endedAt sql.NullTime
+		if err := rows.Scan(&s.ID, &s.UserID, &s.StartedAt, &endedAt, &s.Dials, &s.Connects, &s.TalkSeconds); err != nil {
+			return nil, err
+		}
+		end := now
+		if endedAt.Valid {
+			s.EndedAt = &endedAt.Time
+			end = endedAt.Time
+		}
+		s.Elapsed = end.Sub(s.StartedAt)
+		s.DialerStats.finish()
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// LeadAudit returns the Lighthouse audit of a lead in one of the tenant's
+// searches or on its board.
+func (r *Repository) LeadAudit(leadID string) (LighthouseAudit, error) {
+	a, err := scanLighthouseAudit(r.q.QueryRowContext(r.ctx, `
+        SELECT strategy, performance, seo, accessibility, best_practices, opportunities, audited_at FROM lead_audits
+        WHERE lead_id = ?1 AND (lead_id IN (SELECT id FROM leads WHERE search_id IN (SELECT id FROM searches WHERE org_id = ?2 AND deleted_at IS NULL))
+            OR lead_id IN (SELECT lead_id FROM crm_leads WHERE org_id = ?2 AND deleted_at IS NULL))`, leadID, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return a, store.ErrNotFound
+	}
+	return a, err
+}
+
+// CrmScreenshot returns the attachment key of the card's screenshot, empty
+// when it has none.
+func (r *Repository) CrmScreenshot(leadID string) (string, error) {
+	var key string
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT COALESCE(l.screenshot, '') FROM crm_leads c LEFT JOIN leads l ON l.id = c.lead_id
+        WHERE c.org_id = ? AND c.lead_id = ? AND c.deleted_at IS NULL`, r.tenant.OrgID, leadID).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	return key, err
+}
+
+// shareLinkColumns are the columns scanShareLink expects.
+const shareLinkColumns = "id, token, org_id, lead_id, kind, created_by, created_at, expires_at, revoked_at, views, last_viewed_at"
+
+func scanShareLink(row interface{ Scan(...interface{}) error }) (ShareLink, error) {
+	var l ShareLink
+	err := row.Scan(&l.ID, &l.token, &l.orgID, &l.LeadID, &l.Kind, &l.CreatedBy, &l.CreatedAt, &l.ExpiresAt, &l.RevokedAt, &l.Views, &l.LastViewedAt)
+	l.URL = shareURL + l.token
+	return l, err
+}
+
+// CreateShareLink stores a new share link for one of the tenant's cards.
+func (r *Repository) CreateShareLink(l ShareLink) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO share_links (id, token, org_id, lead_id, kind, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		l.ID, l.token, r.tenant.OrgID, l.LeadID, l.Kind, l.CreatedBy, l.CreatedAt, l.ExpiresAt)
+	return err
+}
+
+// ShareLinks returns the organization's links to the card, newest first,
+// including expired and revoked ones.
+func (r *Repository) ShareLinks(leadID string) ([]ShareLink, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+shareLinkColumns+" FROM share_links WHERE org_id = ? AND lead_id = ? ORDER BY created_at DESC, id",
+		r.tenant.OrgID, leadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []ShareLink{}
+	for rows.Next() {
+		l, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// RevokeShareLink turns the link off for good. Revoking it again keeps
+// the first revocation's time.
+func (r *Repository) RevokeShareLink(id string) (ShareLink, error) {
+	l, err := scanShareLink(r.q.QueryRowContext(r.ctx, "UPDATE share_links SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ? AND org_id = ? RETURNING "+shareLinkColumns,
+		time.Now().UTC(), id, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return l, store.ErrNotFound
+	}
+	return l, err
+}
+
+// shareLinkByToken finds the link with the token, whether or not it's
+// still active.
+func shareLinkByToken(ctx context.Context, token string) (ShareLink, error) {
+	l, err := scanShareLink(db.QueryRowContext(ctx, "SELECT "+shareLinkColumns+" FROM share_links WHERE token = ?", token))
+	if err == sql.ErrNoRows {
+		return l, store.ErrNotFound
+	}
+	return l, err
+}
+
+// RecordShareView counts a view of the link and returns how many it has
+// had.
+func (r *Repository) RecordShareView(id string) (int, error) {
+	var views int
+	err := r.q.QueryRowContext(r.ctx, "UPDATE share_links SET views = views + 1, last_viewed_at = ? WHERE id = ? AND org_id = ? RETURNING views",
+		time.Now().UTC(), id, r.tenant.OrgID).Scan(&views)
+	return views, err
+}
+
+// AddCrmLeads puts leads on the board, skipping ones already there and
+// ones whose phone or domain matches another card, which it returns. Every
+// lead must come from one of the tenant's searches, otherwise nothing is
+// added and store.ErrNotFound is returned.
+func (r *Repository) AddCrmLeads(batch []leads.Lead) ([]CrmDuplicate, error) {
+	for _, lead := range batch {
+		owned, err := r.Leads().Owns(lead.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !owned {
+			return nil, store.ErrNotFound
+		}
+	}
+	index, err := r.crmDuplicateIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := []CrmDuplicate{}
+	for _, lead := range batch {
+		if other, on, ok := index.match(lead.ID, lead.Phone, lead.Website); ok {
+			duplicates = append(duplicates, CrmDuplicate{LeadID: lead.ID, DuplicateOf: other, MatchedOn: on})
+			continue
+		}
+		index.add(lead.ID, lead.Phone, lead.Website)
+
+		res, err := r.q.ExecContext(r.ctx, `
+            INSERT OR IGNORE INTO crm_leads (user_id, org_id, lead_id, column_id, company_name, phone, website, email, page_speed, updated_at, column_changed_at)
+            VALUES (?, ?, ?, 'tobe-called', ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+        `, r.tenant.UserID, r.tenant.OrgID, lead.ID, lead.CompanyName, seal(lead.Phone), lead.Website, seal(lead.Email), lead.PageSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			if err := r.logActivity(lead.ID, "added", nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return duplicates, nil
+}
+
+// ImportSearch adds the search's live leads that pass filter to the board
+// in a single INSERT ... SELECT and returns their IDs. Leads already on the
+// board are left alone. With ExcludeDuplicates, a lead is also skipped if
+// it matches a card or an earlier imported lead of the same search.
+func (r *Repository) ImportSearch(searchID string, filter searchImportFilter) ([]string, error) {
+	return r.importLeads([]string{searchID}, filter, map[string]interface{}{"searchId": searchID})
+}
+
+// ImportLeadList imports a list's searches as one set, without duplicates.
+func (r *Repository) ImportLeadList(list LeadList, filter searchImportFilter) ([]string, error) {
+	filter.ExcludeDuplicates = true
+	return r.importLeads(list.SearchIDs, filter, map[string]interface{}{"listId": list.ID})
+}
+
+// importLeads does the work of ImportSearch for any set of searches,
+// logging details with each card added.
+func (r *Repository) importLeads(searchIDs []string, filter searchImportFilter, details map[string]interface{}) ([]string, error) {
+	if len(searchIDs) == 0 {
+		return []string{}, nil
+	}
+	conds := "l.search_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(searchIDs)), ",") + ") AND l.deleted_at IS NULL AND l.search_id IN (" + ownedSearchIDs + ")"
+	var args []interface{}
+	for _, id := range searchIDs {
+		args = append(args, id)
+	}
+	args = append(args, r.tenant.OrgID)
+	if filter.HasPhone {
+		conds += " AND l.phone IS NOT NULL AND l.phone != ''"
+	}
+	if filter.PageSpeedBelow != nil {
+		conds += " AND l.page_speed IS NOT NULL AND l.page_speed < ?"
+		args = append(args, *filter.PageSpeedBelow)
+	}
+
+	dedupe := ""
+	if filter.ExcludeDuplicates {
+		dedupe = `
+          AND NOT EXISTS (SELECT 1 FROM board b WHERE (c.phone_key != '' AND b.phone_key = c.phone_key) OR (c.domain_key != '' AND b.domain_key = c.domain_key))
+          AND NOT EXISTS (SELECT 1 FROM candidates e WHERE e.rid < c.rid AND ((c.phone_key != '' AND e.phone_key = c.phone_key) OR (c.domain_key != '' AND e.domain_key = c.domain_key)))`
+	}
+
+	query := `
+        WITH candidates AS MATERIALIZED (
+            SELECT l.rowid AS rid, l.id, l.company_name, l.phone, l.website, l.email, l.page_speed,
+                   normalize_phone(COALESCE(l.phone, '')) AS phone_key, normalize_domain(COALESCE(l.website, '')) AS domain_key
+            FROM leads l
+            WHERE ` + conds + `
+        ),
+        board AS MATERIALIZED (
+            SELECT normalize_phone(COALESCE(phone, '')) AS phone_key, normalize_domain(COALESCE(website, '')) AS domain_key
+            FROM crm_leads WHERE org_id = ? AND deleted_at IS NULL
+        )
+        INSERT OR IGNORE INTO crm_leads (user_id, org_id, lead_id, column_id, company_name, phone, website, email, page_speed, updated_at, column_changed_at)
+        SELECT ?, ?, c.id, 'tobe-called', c.company_name, c.phone, c.website, c.email, c.page_speed, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+        FROM candidates c
+        WHERE NOT EXISTS (SELECT 1 FROM crm_leads cl WHERE cl.org_id = ? AND cl.lead_id = c.id)` + dedupe + `
+        ORDER BY c.rid
+        RETURNING lead_id`
+	args = append(args, r.tenant.OrgID, r.tenant.UserID, r.tenant.OrgID, r.tenant.OrgID)
+
+	rows, err := r.q.QueryContext(r.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	added := []string{}
+	for rows.Next() {
+		var leadID string
+		if err := rows.Scan(&leadID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		added = append(added, leadID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, leadID := range added {
+		if err := r.logActivity(leadID, "added", details); err != nil {
+			return nil, err
+		}
+	}
+	return added, nil
+}
+
+func (r *Repository) SearchStats(searchID string) (SearchStats, error) {
+	var stats SearchStats
+	var withEmail, withWebsite, withPhone, duplicates sql.NullInt64
+	var avgPageSpeed sql.NullFloat64
+	err := r.q.QueryRowContext(r.ctx, `
+        WITH search_leads AS MATERIALIZED (
+            SELECT l.rowid AS rid,
+                   COALESCE(l.email, '') != '' OR EXISTS (SELECT 1 FROM lead_emails e WHERE e.lead_id = l.id) AS has_email,
+                   COALESCE(l.website, '') != '' AS has_website,
+                   COALESCE(l.phone, '') != '' OR EXISTS (SELECT 1 FROM lead_phones p WHERE p.lead_id = l.id) AS has_phone,
+                   l.page_speed,
+                   normalize_phone(COALESCE(l.phone, '')) AS phone_key, normalize_domain(COALESCE(l.website, '')) AS domain_key
+            FROM leads l
+            WHERE l.search_id = ? AND l.deleted_at IS NULL AND l.search_id IN (`+ownedSearchIDs+`)
+        ),
+        other_leads AS MATERIALIZED (
+            SELECT normalize_phone(COALESCE(o.phone, '')) AS phone_key, normalize_domain(COALESCE(o.website, '')) AS domain_key
+            FROM leads o
+            WHERE o.search_id != ? AND o.deleted_at IS NULL AND o.search_id IN (`+ownedSearchIDs+`)
+        )
+        SELECT COUNT(*), SUM(has_email), SUM(has_website), SUM(has_phone), AVG(page_speed),
+               SUM(EXISTS (SELECT 1 FROM other_leads o WHERE (s.phone_key != '' AND o.phone_key = s.phone_key) OR (s.domain_key != '' AND o.domain_key = s.domain_key))
+                   OR EXISTS (SELECT 1 FROM search_leads e WHERE e.rid < s.rid AND ((s.phone_key != '' AND e.phone_key = s.phone_key) OR (s.domain_key != '' AND e.domain_key = s.domain_key))))
+        FROM search_leads s
+    `, searchID, r.tenant.OrgID, searchID, r.tenant.OrgID).Scan(&stats.Leads, &withEmail, &withWebsite, &withPhone, &avgPageSpeed, &duplicates)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.WithEmailPct = percentOf(int(withEmail.Int64), stats.Leads)
+	stats.WithWebsitePct = percentOf(int(withWebsite.Int64), stats.Leads)
+	stats.WithPhonePct = percentOf(int(withPhone.Int64), stats.Leads)
+	if avgPageSpeed.Valid {
+		avg := math.Round(avgPageSpeed.Float64*10) / 10
+		stats.AvgPageSpeed = &avg
+	}
+	stats.Duplicates = int(duplicates.Int64)
+	stats.DuplicateRate = percentOf(stats.Duplicates, stats.Leads)
+	return stats, nil
+}
+
+// crmDuplicateIndex indexes the phones and domains of the tenant's CRM
+// cards, snoozed ones included.
+func (r *Repository) crmDuplicateIndex() (*duplicateIndex, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT lead_id, COALESCE(phone, ''), COALESCE(website, '') FROM crm_leads WHERE org_id = ? AND deleted_at IS NULL", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	index := newDuplicateIndex()
+	for rows.Next() {
+		var leadID, phone, website string
+		if err := rows.Scan(&leadID, &phone, &website); err != nil {
+			return nil, err
+		}
+		index.add(leadID, unseal(phone), website)
+	}
+	return index, rows.Err()
+}
+
+// CrmContactMatches returns the other cards on the board with the
+// normalized phone or domain, either of which may be empty, each with its
+// assignee and latest call.
+func (r *Repository) CrmContactMatches(leadID, phone, domain string) ([]ContactWarning, error) {
+	if phone == "" && domain == "" {
+		return []ContactWarning{}, nil
+	}
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT c.lead_id, COALESCE(c.company_name, ''), c.user_id, COALESCE(u.name, ''),
+               ? != '' AND normalize_phone(COALESCE(c.phone, '')) = ?, k.called_at, k.user_id
+        FROM crm_leads c
+        LEFT JOIN users u ON u.id = c.user_id
+        LEFT JOIN crm_calls k ON k.id = (SELECT id FROM crm_calls WHERE org_id = c.org_id AND lead_id = c.lead_id ORDER BY called_at DESC, id DESC LIMIT 1)
+        WHERE c.org_id = ? AND c.deleted_at IS NULL AND c.lead_id != ?
+          AND ((? != '' AND normalize_phone(COALESCE(c.phone, '')) = ?) OR (? != '' AND normalize_domain(COALESCE(c.website, '')) = ?))
+    `, phone, phone, r.tenant.OrgID, leadID, phone, phone, domain, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warnings := []ContactWarning{}
+	for rows.Next() {
+		var w ContactWarning
+		var phoneMatched bool
+		var lastCalledAt sql.NullTime
+		var lastCalledBy sql.NullInt64
+		if err := rows.Scan(&w.LeadID, &w.CompanyName, &w.Assignee, &w.AssigneeName, &phoneMatched, &lastCalledAt, &lastCalledBy); err != nil {
+			return nil, err
+		}
+		w.MatchedOn = "domain"
+		if phoneMatched {
+			w.MatchedOn = "phone"
+		}
+		if lastCalledAt.Valid {
+			w.LastCalledAt = &lastCalledAt.Time
+			w.LastCalledBy = lastCalledBy.Int64
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings, rows.Err()
+}
+
+// MoveCrmLead moves a card the way a drag on the board does, remembering
+// where it came from so the user can undo it.
+func (r *Repository) MoveCrmLead(leadID, columnID string) error {
+	from, changedAt, err := r.Crm().CardColumn(leadID)
+	if err != nil {
+		return err
+	}
+	if err := r.moveCrmLead(leadID, columnID, nil); err != nil {
+		return err
+	}
+	if from == columnID {
+		return nil
+	}
+	return r.pushUndoMove(leadID, from, columnID, changedAt)
+}
+
+// pushUndoMove adds a move to the user's undo history, keeping only the
+// most recent CRM_UNDO_DEPTH.
+func (r *Repository) pushUndoMove(leadID, from, to string, changedAt sql.NullTime) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO crm_undo_moves (org_id, user_id, lead_id, from_column, to_column, column_changed_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		r.tenant.OrgID, r.tenant.UserID, leadID, from, to, changedAt, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = r.q.ExecContext(r.ctx, `
+        DELETE FROM crm_undo_moves WHERE org_id = ?1 AND user_id = ?2 AND id NOT IN
+            (SELECT id FROM crm_undo_moves WHERE org_id = ?1 AND user_id = ?2 ORDER BY id DESC LIMIT ?3)
+    `, r.tenant.OrgID, r.tenant.UserID, CRM_UNDO_DEPTH)
+	return err
+}
+
+// UndoCrmMove puts back the user's most recent move that's still within
+// CRM_UNDO_TTL, restoring how long the card had been in its old column.
+// It returns store.ErrNotFound when there's nothing to undo and errUndoStale,
+// dropping the entry, when the card has moved on or its old column is gone.
+func (r *Repository) UndoCrmMove() (UndoneMove, error) {
+	var id int64
+	var move UndoneMove
+	var changedAt sql.NullTime
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT id, lead_id, from_column, to_column, column_changed_at FROM crm_undo_moves
+        WHERE org_id = ? AND user_id = ? AND created_at > ?
+        ORDER BY id DESC LIMIT 1
+    `, r.tenant.OrgID, r.tenant.UserID, time.Now().UTC().Add(-CRM_UNDO_TTL)).Scan(&id, &move.LeadID, &move.ColumnID, &move.FromColumnID, &changedAt)
+	if err == sql.ErrNoRows {
+		return move, store.ErrNotFound
+	}
+	if err != nil {
+		return move, err
+	}
+	if _, err := r.q.ExecContext(r.ctx, "DELETE FROM crm_undo_moves WHERE id = ?", id); err != nil {
+		return move, err
+	}
+
+	current, _, err := r.Crm().CardColumn(move.LeadID)
+	if err == store.ErrNotFound || (err == nil && (current != move.FromColumnID || !r.Crm().HasColumn(move.ColumnID))) {
+		return move, errUndoStale
+	}
+	if err != nil {
+		return move, err
+	}
+	if err := r.moveCrmLead(move.LeadID, move.ColumnID, map[string]interface{}{"undo": true}); err != nil {
+		return move, err
+	}
+	return move, r.Crm().SetColumnChangedAt(move.LeadID, changedAt)
+}
+
+// moveCrmLead changes a lead's column and logs the move, with detail
+// describing what caused it when it wasn't a drag on the board.
+func (r *Repository) moveCrmLead(leadID, columnID string, detail map[string]interface{}) error {
+	from, err := r.Crm().MoveCard(leadID, columnID)
+	if err != nil {
+		return err
+	}
+	if from == columnID {
+		return nil
+	}
+	if detail == nil {
+		detail = map[string]interface{}{}
+	}
+	detail["from"], detail["to"] = from, columnID
+	return r.logActivity(leadID, "column_move", detail)
+}
+
+// UpdateCrmLead saves the editable card fields. The call count only moves
+// when a call is recorded, so TimesCalled is ignored here. Run it in a
+// transaction so the notes revision and the update land together.
+func (r *Repository) UpdateCrmLead(leadID string, l CrmLead) error {
+	if err := r.recordNoteRevision(leadID, l.Notes); err != nil {
+		return err
+	}
+	return r.Crm().UpdateCard(leadID, l.Notes, l.CallBackDate)
+}
+
+// recordNoteRevision keeps the lead's current notes as a revision if they
+// are about to be replaced with something different.
+func (r *Repository) recordNoteRevision(leadID, newNotes string) error {
+	current, err := r.Crm().Notes(leadID)
+	if err != nil || current == newNotes {
+		return err
+	}
+	_, err = r.q.ExecContext(r.ctx, "INSERT INTO crm_note_revisions (org_id, lead_id, edited_by, edited_at, previous_notes) VALUES (?, ?, ?, ?, ?)",
+		r.tenant.OrgID, leadID, r.tenant.UserID, time.Now().UTC(), seal(current))
+	return err
+}
+
+// NoteRevisions lists a CRM lead's earlier notes, newest first.
+func (r *Repository) NoteRevisions(leadID string) ([]NoteRevision, error) {
+	if !r.Crm().HasCard(leadID) {
+		return nil, store.ErrNotFound
+	}
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT nr.id, nr.edited_by, COALESCE(u.name, ''), nr.edited_at, nr.previous_notes
+        FROM crm_note_revisions nr LEFT JOIN users u ON u.id = nr.edited_by
+        WHERE nr.org_id = ? AND nr.lead_id = ?
+        ORDER BY nr.edited_at DESC, nr.id DESC
+    `, r.tenant.OrgID, leadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []NoteRevision{}
+	for rows.Next() {
+		var rev NoteRevision
+		if err := rows.Scan(&rev.ID, &rev.EditedBy, &rev.EditorName, &rev.EditedAt, &rev.PreviousNotes); err != nil {
+			log.Printf("Error scanning note revision: %v", err)
+			continue
+		}
+		rev.PreviousNotes = unseal(rev.PreviousNotes)
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// RestoreNoteRevision puts a revision's notes back on the lead. The notes
+// being replaced become a revision themselves, so a restore can be undone.
+func (r *Repository) RestoreNoteRevision(leadID string, revisionID int64) (string, error) {
+	var notes string
+	err := r.q.QueryRowContext(r.ctx, "SELECT previous_notes FROM crm_note_revisions WHERE id = ? AND org_id = ? AND lead_id = ?", revisionID, r.tenant.OrgID, leadID).Scan(&notes)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	notes = unseal(notes)
+	if err := r.recordNoteRevision(leadID, notes); err != nil {
+		return "", err
+	}
+	return notes, r.Crm().SetNotes(leadID, notes)
+}
+
+// SnoozeCrmLead hides a lead from the board until the given time; the
+// snoozing user is the one notified when it comes back.
+func (r *Repository) SnoozeCrmLead(leadID string, until time.Time) error {
+	if err := r.Crm().Snooze(leadID, until); err != nil {
+		return err
+	}
+	return r.logActivity(leadID, "snoozed", map[string]interface{}{"until": until.UTC()})
+}
+
+// UnsnoozeCrmLead puts a snoozed lead back on the board. automatic marks
+// a snooze that ran out rather than one cancelled by hand.
+func (r *Repository) UnsnoozeCrmLead(leadID string, automatic bool) error {
+	if err := r.Crm().Unsnooze(leadID); err != nil {
+		return err
+	}
+	return r.logActivity(leadID, "resurfaced", map[string]interface{}{"automatic": automatic})
+}
+
+// Crm returns the tenant's board layout, on the same connection or
+// transaction as r.
+func (r *Repository) Crm() crm.Repository {
+	return crm.NewRepository(r.ctx, r.q, r.tenant, fieldCodec{})
+}
+
+// --- LEAD STATUSES ---
+
+// SetCrmLeadStatus changes a card's status, "" for none, and records the
+// change in its activity.
+func (r *Repository) SetCrmLeadStatus(leadID, statusID string) error {
+	from, err := r.Crm().SetStatus(leadID, statusID)
+	if err != nil || from == statusID {
+		return err
+	}
+	return r.logActivity(leadID, "status_change", map[string]interface{}{"from": from, "to": statusID})
+}
+
+// --- TAGS ---
+
+// AddCrmTag tags a CRM lead; tagging it again is a no-op. detail is added
+// to the activity entry, e.g. to name the rule that applied the tag.
+func (r *Repository) AddCrmTag(leadID, tag string, detail map[string]interface{}) error {
+	if !r.Crm().HasCard(leadID) {
+		return store.ErrNotFound
+	}
+	res, err := r.q.ExecContext(r.ctx, "INSERT OR IGNORE INTO crm_lead_tags (org_id, lead_id, tag) VALUES (?, ?, ?)", r.tenant.OrgID, leadID, tag)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if detail == nil {
+		detail = map[string]interface{}{}
+	}
+	detail["tag"] = tag
+	return r.logActivity(leadID, "tag_added", detail)
+}
+
+func (r *Repository) RemoveCrmTag(leadID, tag string, detail map[string]interface{}) error {
+	if !r.Crm().HasCard(leadID) {
+		return store.ErrNotFound
+	}
+	if err := store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM crm_lead_tags WHERE org_id = ? AND lead_id = ? AND tag = ?", r.tenant.OrgID, leadID, tag)); err != nil {
+		return err
+	}
+	if detail == nil {
+		detail = map[string]interface{}{}
+	}
+	detail["tag"] = tag
+	return r.logActivity(leadID, "tag_removed", detail)
+}
+
+// --- PRIORITY ---
+
+// SetCrmPriority sets a CRM lead's priority, logging the change. Setting
+// the one it has is a no-op. detail is added to the activity entry.
+func (r *Repository) SetCrmPriority(leadID, priority string, detail map[string]interface{}) error {
+	from, err := r.Crm().SetPriority(leadID, priority)
+	if err != nil || from == priority {
+		return err
+	}
+	if detail == nil {
+		detail = map[string]interface{}{}
+	}
+	detail["from"], detail["to"] = from, priority
+	return r.logActivity(leadID, "priority_change", detail)
+}
+
+// --- PERFORMANCE ---
+
+// PerformanceStats is what one rep got done over a period.
+type PerformanceStats struct {
+	Searches   int
+	LeadsAdded int
+	Dials      int
+	Contacts   int
+	DealsWon   int
+}
+
+// Performance returns each of the organization's reps' stats for calls,
+// searches and card moves in [from, to), keyed by user ID. Reps who did
+// nothing are left out.
+func (r *Repository) Performance(from, to time.Time) (map[int64]*PerformanceStats, error) {
+	stats := map[int64]*PerformanceStats{}
+	connected := strings.TrimSuffix(strings.Repeat("?,", len(connectedDispositions)), ",")
+	var connectedArgs []interface{}
+	for _, d := range connectedDispositions {
+		connectedArgs = append(connectedArgs, d)
+	}
+	// Each query takes its leading args, then the org and period.
+	queries := []struct {
+		query   string
+		leading []interface{}
+		into    func(s *PerformanceStats) []interface{}
+	}{
+		{`SELECT user_id, COUNT(*) FROM searches WHERE org_id = ? AND created_at >= ? AND created_at < ? GROUP BY user_id`, nil,
+			func(s *PerformanceStats) []interface{} { return []interface{}{&s.Searches} }},
+		{`SELECT user_id, COUNT(*) FROM crm_activity WHERE org_id = ? AND created_at >= ? AND created_at < ? AND kind = 'added' GROUP BY user_id`, nil,
+			func(s *PerformanceStats) []interface{} { return []interface{}{&s.LeadsAdded} }},
+		{`SELECT user_id, COUNT(*), SUM(disposition IN (` + connected + `)) FROM crm_calls
+          WHERE org_id = ? AND called_at >= ? AND called_at < ? GROUP BY user_id`, connectedArgs,
+			func(s *PerformanceStats) []interface{} { return []interface{}{&s.Dials, &s.Contacts} }},
+		{`SELECT a.user_id, COUNT(*) FROM crm_activity a
+          JOIN crm_columns col ON col.org_id = a.org_id AND col.id = json_extract(a.detail, '$.to')
+          WHERE a.org_id = ? AND a.created_at >= ? AND a.created_at < ? AND a.kind = 'column_move' AND col.won
+          GROUP BY a.user_id`, nil,
+			func(s *PerformanceStats) []interface{} { return []interface{}{&s.DealsWon} }},
+	}
+	for _, q := range queries {
+		args := append(append([]interface{}{}, q.leading...), r.tenant.OrgID, from.UTC(), to.UTC())
+		rows, err := r.q.QueryContext(r.ctx, q.query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var userID int64
+			s := &PerformanceStats{}
+			if err := rows.Scan(append([]interface{}{&userID}, q.into(s)...)...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if stats[userID] == nil {
+				stats[userID] = &PerformanceStats{}
+			}
+			stats[userID].add(*s)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// --- BOARD HISTORY ---
+
+// BoardSnapshots returns the organization's daily column counts for days
+// from through to (YYYY-MM-DD), as day -> column -> cards.
+func (r *Repository) BoardSnapshots(from, to string) (map[string]map[string]int, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT day, column_id, cards FROM crm_board_snapshots WHERE org_id = ? AND day >= ? AND day <= ?", r.tenant.OrgID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := map[string]map[string]int{}
+	for rows.Next() {
+		var day, columnID string
+		var cards int
+		if err := rows.Scan(&day, &columnID, &cards); err != nil {
+			return nil, err
+		}
+		if days[day] == nil {
+			days[day] = map[string]int{}
+		}
+		days[day][columnID] = cards
+	}
+	return days, rows.Err()
+}
+
+// ColumnMove counts the cards moved between two columns on one day.
+type ColumnMove struct {
+	Day   string `json:"-"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+// ColumnMoves totals the organization's logged column moves per UTC day
+// for days from through to (YYYY-MM-DD).
+func (r *Repository) ColumnMoves(from, to string) ([]ColumnMove, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT substr(created_at, 1, 10) AS day, json_extract(detail, '$.from'), json_extract(detail, '$.to'), COUNT(*)
+        FROM crm_activity
+        WHERE org_id = ? AND kind = 'column_move' AND day >= ? AND day <= ?
+        GROUP BY 1, 2, 3
+        ORDER BY 1
+    `, r.tenant.OrgID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var moves []ColumnMove
+	for rows.Next() {
+		var m ColumnMove
+		if err := rows.Scan(&m.Day, &m.From, &m.To, &m.Count); err != nil {
+			return nil, err
+		}
+		moves = append(moves, m)
+	}
+	return moves, rows.Err()
+}
+
+// --- CALLS ---
+
+// RecordCall logs a call on a CRM lead, bumps its call count and, when
+// moveTo is set, moves it to that column. The call joins the user's open
+// dialer session, if any. It returns the call and the column the lead ends
+// up in.
+func (r *Repository) RecordCall(leadID, disposition, notes string, durationSeconds int, moveTo string) (Call, string, error) {
+	call := Call{LeadID: leadID, UserID: r.tenant.UserID, Disposition: disposition, Notes: notes, DurationSeconds: durationSeconds, CalledAt: time.Now().UTC()}
+	var columnID string
+	err := r.q.QueryRowContext(r.ctx, `
+        UPDATE crm_leads
+        SET times_called = COALESCE(times_called, 0) + 1, last_disposition = ?, last_called_at = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL
+        RETURNING column_id
+    `, disposition, call.CalledAt, r.tenant.OrgID, leadID).Scan(&columnID)
+	if err == sql.ErrNoRows {
+		return call, "", store.ErrNotFound
+	}
+	if err != nil {
+		return call, "", err
+	}
+	if moveTo != "" && moveTo != columnID {
+		if err := r.moveCrmLead(leadID, moveTo, map[string]interface{}{"disposition": disposition}); err != nil {
+			return call, "", err
+		}
+		columnID = moveTo
+	}
+
+	err = r.q.QueryRowContext(r.ctx, `
+        INSERT INTO crm_calls (org_id, user_id, lead_id, disposition, notes, duration_seconds, called_at, session_id)
+        VALUES (?, ?, ?, ?, ?, ?, ?, (SELECT id FROM dialer_sessions WHERE org_id = ? AND user_id = ? AND ended_at IS NULL))
+        RETURNING id, session_id
+    `, r.tenant.OrgID, r.tenant.UserID, leadID, disposition, seal(notes), durationSeconds, call.CalledAt, r.tenant.OrgID, r.tenant.UserID).Scan(&call.ID, &call.SessionID)
+	return call, columnID, err
+}
+
+// LeadCalls returns a CRM lead's call history, newest first.
+func (r *Repository) LeadCalls(leadID string) ([]Call, error) {
+	if !r.Crm().HasCard(leadID) {
+		return nil, store.ErrNotFound
+	}
+	rows, err := r.q.QueryContext(r.ctx, "SELECT id, lead_id, user_id, disposition, notes, duration_seconds, session_id, called_at FROM crm_calls WHERE org_id = ? AND lead_id = ? ORDER BY called_at DESC, id DESC", r.tenant.OrgID, leadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calls := []Call{}
+	for rows.Next() {
+		var call Call
+		if err := rows.Scan(&call.ID, &call.LeadID, &call.UserID, &call.Disposition, &call.Notes, &call.DurationSeconds, &call.SessionID, &call.CalledAt); err != nil {
+			log.Printf("Error scanning call: %v", err)
+			continue
+		}
+		call.Notes = unseal(call.Notes)
+		calls = append(calls, call)
+	}
+	return calls, rows.Err()
+}
+
+// CallTimes returns when the tenant's user made each call since the given
+// time, oldest first.
+func (r *Repository) CallTimes(since time.Time) ([]time.Time, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT called_at FROM crm_calls WHERE org_id = ? AND user_id = ? AND called_at >= ? ORDER BY called_at",
+		r.tenant.OrgID, r.tenant.UserID, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		times = append(times, t)
+	}
+	return times, rows.Err()
+}
+
+// DispositionCounts counts the organization's calls per disposition in
+// [from, to); either bound may be nil.
+func (r *Repository) DispositionCounts(from, to *time.Time) (map[string]int, error) {
+	query := "SELECT disposition, COUNT(*) FROM crm_calls WHERE org_id = ?"
+	args := []interface{}{r.tenant.OrgID}
+	if from != nil {
+		query += " AND called_at >= ?"
+		args = append(args, from.UTC())
+	}
+	if to != nil {
+		query += " AND called_at < ?"
+		args = append(args, to.UTC())
+	}
+	rows, err := r.q.QueryContext(r.ctx, query+" GROUP BY disposition", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int, len(dispositions))
+	for _, d := range dispositions {
+		counts[d.ID] = 0
+	}
+	for rows.Next() {
+		var disposition string
+		var n int
+		if err := rows.Scan(&disposition, &n); err != nil {
+			return nil, err
+		}
+		counts[disposition] = n
+	}
+	return counts, rows.Err()
+}
+
+// DispositionRules returns the column each disposition moves a lead to,
+// with the organization's overrides applied over the defaults.
+func (r *Repository) DispositionRules() (map[string]string, error) {
+	rules := make(map[string]string, len(defaultDispositionRules))
+	for disposition, column := range defaultDispositionRules {
+		rules[disposition] = column
+	}
+	rows, err := r.q.QueryContext(r.ctx, "SELECT disposition, column_id FROM disposition_rules WHERE org_id = ?", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var disposition, column string
+		if err := rows.Scan(&disposition, &column); err != nil {
+			return nil, err
+		}
+		rules[disposition] = column
+	}
+	return rules, rows.Err()
+}
+
+func (r *Repository) SetDispositionRules(rules map[string]string) error {
+	for disposition, column := range rules {
+		_, err := r.q.ExecContext(r.ctx, `
+            INSERT INTO disposition_rules (org_id, disposition, column_id) VALUES (?, ?, ?)
+            ON CONFLICT (org_id, disposition) DO UPDATE SET column_id = excluded.column_id
+        `, r.tenant.OrgID, disposition, column)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- ACTIVITY ---
+
+// logActivity appends an event to a CRM lead's activity log. Calls and
+// note edits have their own tables and are merged in when the feed is read.
+func (r *Repository) logActivity(leadID, kind string, detail map[string]interface{}) error {
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = r.q.ExecContext(r.ctx, "INSERT INTO crm_activity (org_id, lead_id, user_id, kind, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		r.tenant.OrgID, leadID, r.tenant.UserID, kind, string(raw), time.Now().UTC())
+	return err
+}
+
+// LeadActivity returns up to limit events for a CRM lead from before the
+// given time, newest first, drawn from calls, note revisions and the
+// activity log.
+func (r *Repository) LeadActivity(leadID string, before time.Time, limit int) ([]ActivityEvent, error) {
+	if !r.Crm().HasCard(leadID) {
+		return nil, store.ErrNotFound
+	}
+	sources := []struct {
+		kind  string
+		query string
+	}{
+		{"call", `SELECT a.called_at, a.user_id, COALESCE(u.name, ''), json_object('callId', a.id, 'disposition', a.disposition, 'notes', unseal(a.notes))
+            FROM crm_calls a LEFT JOIN users u ON u.id = a.user_id
+            WHERE a.org_id = ? AND a.lead_id = ? AND a.called_at < ? ORDER BY a.called_at DESC LIMIT ?`},
+		{"note_edit", `SELECT a.edited_at, a.edited_by, COALESCE(u.name, ''), json_object('revisionId', a.id, 'previousNotes', unseal(a.previous_notes))
+            FROM crm_note_revisions a LEFT JOIN users u ON u.id = a.edited_by
+            WHERE a.org_id = ? AND a.lead_id = ? AND a.edited_at < ? ORDER BY a.edited_at DESC LIMIT ?`},
+		{"", `SELECT a.created_at, a.user_id, COALESCE(u.name, ''), a.detail, a.kind
+            FROM crm_activity a LEFT JOIN users u ON u.id = a.user_id
+            WHERE a.org_id = ? AND a.lead_id = ? AND a.created_at < ? ORDER BY a.created_at DESC LIMIT ?`},
+	}
+
+	events := []ActivityEvent{}
+	for _, src := range sources {
+		rows, err := r.q.QueryContext(r.ctx, src.query, r.tenant.OrgID, leadID, before.UTC(), limit)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			e := ActivityEvent{Type: src.kind}
+			var detail string
+			dest := []interface{}{&e.At, &e.UserID, &e.UserName, &detail}
+			if src.kind == "" {
+				dest = append(dest, &e.Type)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				log.Printf("Error scanning activity: %v", err)
+				continue
+			}
+			e.Detail = json.RawMessage(detail)
+			events = append(events, e)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.After(events[j].At) })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// --- AUTOMATION RULES ---
+const automationRuleSelectColumns = "id, name, enabled, conditions, action, user_id, created_at, updated_at"
+
+func (r *Repository) AutomationRules() ([]AutomationRule, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+automationRuleSelectColumns+" FROM automation_rules WHERE org_id = ? ORDER BY created_at, id", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AutomationRule{}
+	for rows.Next() {
+		rule, err := scanAutomationRule(rows)
+		if err != nil {
+			log.Printf("Error scanning automation rule: %v", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (r *Repository) AutomationRule(ruleID string) (AutomationRule, error) {
+	rule, err := scanAutomationRule(r.q.QueryRowContext(r.ctx, "SELECT "+automationRuleSelectColumns+" FROM automation_rules WHERE id = ? AND org_id = ?", ruleID, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return rule, store.ErrNotFound
+	}
+	return rule, err
+}
+
+func (r *Repository) CreateAutomationRule(rule AutomationRule) error {
+	conditions, _ := json.Marshal(rule.Conditions)
+	action, _ := json.Marshal(rule.Action)
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO automation_rules (id, org_id, user_id, name, enabled, conditions, action, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		rule.ID, r.tenant.OrgID, r.tenant.UserID, rule.Name, rule.Enabled, string(conditions), string(action), rule.CreatedAt, rule.UpdatedAt)
+	return err
+}
+
+// UpdateAutomationRule replaces a rule's definition; Enabled is left alone
+// when the input doesn't set it.
+func (r *Repository) UpdateAutomationRule(ruleID string, in automationRuleInput) error {
+	conditions, _ := json.Marshal(in.Conditions)
+	action, _ := json.Marshal(in.Action)
+	var enabled interface{}
+	if in.Enabled != nil {
+		enabled = *in.Enabled
+	}
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE automation_rules SET name = ?, enabled = COALESCE(?, enabled), conditions = ?, action = ?, updated_at = ? WHERE id = ? AND org_id = ?",
+		in.Name, enabled, string(conditions), string(action), time.Now(), ruleID, r.tenant.OrgID))
+}
+
+func (r *Repository) DeleteAutomationRule(ruleID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM automation_rules WHERE id = ? AND org_id = ?", ruleID, r.tenant.OrgID))
+}
+
+func (r *Repository) LogRuleRun(ruleID, leadID, action string) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO automation_rule_runs (org_id, rule_id, lead_id, action, executed_at) VALUES (?, ?, ?, ?, ?)",
+		r.tenant.OrgID, ruleID, leadID, action, time.Now().UTC())
+	return err
+}
+
+// RuleRuns returns the execution log, newest first; ruleID may be empty.
+func (r *Repository) RuleRuns(ruleID string, limit int) ([]RuleRun, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT rr.id, rr.rule_id, COALESCE(ar.name, ''), rr.lead_id, COALESCE(cl.company_name, ''), rr.action, rr.executed_at
+        FROM automation_rule_runs rr
+        LEFT JOIN automation_rules ar ON ar.id = rr.rule_id
+        LEFT JOIN crm_leads cl ON cl.org_id = rr.org_id AND cl.lead_id = rr.lead_id
+        WHERE rr.org_id = ? AND (? = '' OR rr.rule_id = ?)
+        ORDER BY rr.executed_at DESC, rr.id DESC LIMIT ?
+    `, r.tenant.OrgID, ruleID, ruleID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []RuleRun{}
+	for rows.Next() {
+		var run RuleRun
+		if err := rows.Scan(&run.ID, &run.RuleID, &run.RuleName, &run.LeadID, &run.CompanyName, &run.Action, &run.ExecutedAt); err != nil {
+			log.Printf("Error scanning rule run: %v", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// ReachedLeadIDs returns the CRM leads where some call got through to a
+// decision maker.
+func (r *Repository) ReachedLeadIDs() (map[string]bool, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT DISTINCT lead_id FROM crm_calls WHERE org_id = ? AND disposition IN ('interested', 'not_interested')", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reached := map[string]bool{}
+	for rows.Next() {
+		var leadID string
+		if err := rows.Scan(&leadID); err != nil {
+			return nil, err
+		}
+		reached[leadID] = true
+	}
+	return reached, rows.Err()
+}
+
+// --- CALL SCRIPTS ---
+const callScriptSelectColumns = "id, name, body, created_at, updated_at"
+
+func scanCallScript(row store.RowScanner) (CallScript, error) {
+	var s CallScript
+	err := row.Scan(&s.ID, &s.Name, &s.Body, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
+func (r *Repository) CallScripts() ([]CallScript, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+callScriptSelectColumns+" FROM call_scripts WHERE org_id = ? ORDER BY name", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scripts := []CallScript{}
+	for rows.Next() {
+		s, err := scanCallScript(rows)
+		if err != nil {
+			log.Printf("Error scanning call script: %v", err)
+			continue
+		}
+		scripts = append(scripts, s)
+	}
+	return scripts, rows.Err()
+}
+
+func (r *Repository) CallScript(scriptID string) (CallScript, error) {
+	s, err := scanCallScript(r.q.QueryRowContext(r.ctx, "SELECT "+callScriptSelectColumns+" FROM call_scripts WHERE id = ? AND org_id = ?", scriptID, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return s, store.ErrNotFound
+	}
+	return s, err
+}
+
+func (r *Repository) CreateCallScript(s CallScript) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO call_scripts (id, org_id, user_id, name, body, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		s.ID, r.tenant.OrgID, r.tenant.UserID, s.Name, s.Body, s.CreatedAt, s.UpdatedAt)
+	return err
+}
+
+func (r *Repository) UpdateCallScript(scriptID string, in callScriptInput) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE call_scripts SET name = ?, body = ?, updated_at = ? WHERE id = ? AND org_id = ?", in.Name, in.Body, time.Now(), scriptID, r.tenant.OrgID))
+}
+
+func (r *Repository) DeleteCallScript(scriptID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM call_scripts WHERE id = ? AND org_id = ?", scriptID, r.tenant.OrgID))
+}
+
+// --- MESSAGE TEMPLATES ---
+const messageTemplateSelectColumns = "id, name, channel, subject, body, created_at, updated_at"
+
+func scanMessageTemplate(row store.RowScanner) (MessageTemplate, error) {
+	var t MessageTemplate
+	err := row.Scan(&t.ID, &t.Name, &t.Channel, &t.Subject, &t.Body, &t.CreatedAt, &t.UpdatedAt)
+	return t, err
+}
+
+func (r *Repository) MessageTemplates() ([]MessageTemplate, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+messageTemplateSelectColumns+" FROM message_templates WHERE org_id = ? ORDER BY name", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []MessageTemplate{}
+	for rows.Next() {
+		t, err := scanMessageTemplate(rows)
+		if err != nil {
+			log.Printf("Error scanning message template: %v", err)
+			continue
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+func (r *Repository) MessageTemplate(templateID string) (MessageTemplate, error) {
+	t, err := scanMessageTemplate(r.q.QueryRowContext(r.ctx, "SELECT "+messageTemplateSelectColumns+" FROM message_templates WHERE id = ? AND org_id = ?", templateID, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return t, store.ErrNotFound
+	}
+	return t, err
+}
+
+func (r *Repository) CreateMessageTemplate(t MessageTemplate) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO message_templates (id, org_id, user_id, name, channel, subject, body, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		t.ID, r.tenant.OrgID, r.tenant.UserID, t.Name, t.Channel, t.Subject, t.Body, t.CreatedAt, t.UpdatedAt)
+	return err
+}
+
+func (r *Repository) UpdateMessageTemplate(templateID string, in templateInput) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE message_templates SET name = ?, channel = ?, subject = ?, body = ?, updated_at = ? WHERE id = ? AND org_id = ?",
+		in.Name, in.Channel, in.Subject, in.Body, time.Now(), templateID, r.tenant.OrgID))
+}
+
+func (r *Repository) DeleteMessageTemplate(templateID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM message_templates WHERE id = ? AND org_id = ?", templateID, r.tenant.OrgID))
+}
+
+// --- CAMPAIGNS ---
+const campaignSelectColumns = "id, name, template_id, filter_column, filter_tag, filter_status, filter_segment, hourly_limit, start_at, status, user_id, created_at, updated_at, started_at, completed_at, subject, body"
+
+func (r *Repository) queryCampaigns(cond string, args ...interface{}) ([]Campaign, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+campaignSelectColumns+" FROM campaigns WHERE org_id = ?"+cond+" ORDER BY created_at DESC", append([]interface{}{r.tenant.OrgID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	campaigns := []Campaign{}
+	byID := map[string]int{}
+	for rows.Next() {
+		var c Campaign
+		var startAt, startedAt, completedAt sql.NullTime
+		err := rows.Scan(&c.ID, &c.Name, &c.TemplateID, &c.Filter.Column, &c.Filter.Tag, &c.Filter.StatusID, &c.Filter.SegmentID, &c.HourlyLimit, &startAt, &c.Status,
+			&c.CreatedBy, &c.CreatedAt, &c.UpdatedAt, &startedAt, &completedAt, &c.Subject, &c.Body)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		scanCampaignTimes(&c, startAt, startedAt, completedAt)
+		c.Counts = map[string]int{}
+		byID[c.ID] = len(campaigns)
+		campaigns = append(campaigns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(campaigns) == 0 {
+		return campaigns, err
+	}
+
+	rows, err = r.q.QueryContext(r.ctx, `
+        SELECT campaign_id, status, COUNT(*) FROM campaign_recipients
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE org_id = ?`+cond+`)
+        GROUP BY campaign_id, status
+    `, append([]interface{}{r.tenant.OrgID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, status string
+		var n int
+		if err := rows.Scan(&id, &status, &n); err != nil {
+			return nil, err
+		}
+		if i, ok := byID[id]; ok {
+			campaigns[i].Counts[status] = n
+		}
+	}
+	return campaigns, rows.Err()
+}
+
+func (r *Repository) Campaigns() ([]Campaign, error) {
+	return r.queryCampaigns("")
+}
+
+func (r *Repository) Campaign(campaignID string) (Campaign, error) {
+	campaigns, err := r.queryCampaigns(" AND id = ?", campaignID)
+	if err != nil {
+		return Campaign{}, err
+	}
+	if len(campaigns) == 0 {
+		return Campaign{}, store.ErrNotFound
+	}
+	return campaigns[0], nil
+}
+
+func utcTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+func (r *Repository) CreateCampaign(campaignID string, in campaignInput) error {
+	now := time.Now().UTC()
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO campaigns (id, org_id, user_id, name, template_id, filter_column, filter_tag, filter_status, filter_segment, hourly_limit, start_at, status, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, campaignID, r.tenant.OrgID, r.tenant.UserID, in.Name, in.TemplateID, in.Filter.Column, in.Filter.Tag, in.Filter.StatusID, in.Filter.SegmentID,
+		in.HourlyLimit, utcTimePtr(in.StartAt), CAMPAIGN_DRAFT, now, now)
+	return err
+}
+
+// UpdateCampaign changes a draft campaign; it returns store.ErrNotFound for one
+// that isn't the tenant's or has started.
+func (r *Repository) UpdateCampaign(campaignID string, in campaignInput) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE campaigns SET name = ?, template_id = ?, filter_column = ?, filter_tag = ?, filter_status = ?, filter_segment = ?, hourly_limit = ?, start_at = ?, updated_at = ?
+        WHERE id = ? AND org_id = ? AND status = ?
+    `, in.Name, in.TemplateID, in.Filter.Column, in.Filter.Tag, in.Filter.StatusID, in.Filter.SegmentID, in.HourlyLimit, utcTimePtr(in.StartAt), time.Now().UTC(),
+		campaignID, r.tenant.OrgID, CAMPAIGN_DRAFT))
+}
+
+func (r *Repository) DeleteCampaign(campaignID string) error {
+	if err := store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM campaigns WHERE id = ? AND org_id = ?", campaignID, r.tenant.OrgID)); err != nil {
+		return err
+	}
+	_, err := r.q.ExecContext(r.ctx, "DELETE FROM campaign_recipients WHERE campaign_id = ?", campaignID)
+	return err
+}
+
+// ScheduleCampaign moves a draft campaign to scheduled with the subject
+// and body it will send.
+func (r *Repository) ScheduleCampaign(campaignID, subject, body string) error {
+	now := time.Now().UTC()
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE campaigns SET status = ?, subject = ?, body = ?, started_at = ?, updated_at = ? WHERE id = ? AND org_id = ? AND status = ?",
+		CAMPAIGN_SCHEDULED, subject, body, now, now, campaignID, r.tenant.OrgID, CAMPAIGN_DRAFT))
+}
+
+// SetCampaignStatus pauses, resumes, cancels or completes a campaign.
+// Cancelling excludes the recipients still queued.
+func (r *Repository) SetCampaignStatus(campaignID, status string) error {
+	now := time.Now().UTC()
+	var completedAt interface{}
+	if status == CAMPAIGN_COMPLETED || status == CAMPAIGN_CANCELLED {
+		completedAt = now
+	}
+	err := store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE campaigns SET status = ?, completed_at = ?, updated_at = ? WHERE id = ? AND org_id = ?",
+		status, completedAt, now, campaignID, r.tenant.OrgID))
+	if err != nil || status != CAMPAIGN_CANCELLED {
+		return err
+	}
+	_, err = r.q.ExecContext(r.ctx, "UPDATE campaign_recipients SET status = ?, reason = ? WHERE campaign_id = ? AND status = ?",
+		RECIPIENT_EXCLUDED, EXCLUDED_CANCELLED, campaignID, RECIPIENT_QUEUED)
+	return err
+}
+
+// CampaignLeads returns the cards on the board that match filter.
+func (r *Repository) CampaignLeads(filter CampaignFilter) ([]CrmLead, error) {
+	cond := ""
+	var args []interface{}
+	if filter.Column != "" {
+		cond += " AND column_id = ?"
+		args = append(args, filter.Column)
+	}
+	if filter.StatusID != "" {
+		cond += " AND status_id = ?"
+		args = append(args, filter.StatusID)
+	}
+	if filter.Tag != "" {
+		cond += " AND EXISTS (SELECT 1 FROM crm_lead_tags t WHERE t.org_id = crm_leads.org_id AND t.lead_id = crm_leads.lead_id AND t.tag = ?)"
+		args = append(args, filter.Tag)
+	}
+	return r.Crm().Cards(cond+" ORDER BY company_name", args...)
+}
+
+// EmailVerification returns the verifier's verdict on one of a lead's
+// addresses, or "" if it hasn't been checked.
+func (r *Repository) EmailVerification(leadID, email string) (string, error) {
+	var verdict string
+	err := r.q.QueryRowContext(r.ctx, "SELECT verification FROM lead_emails WHERE lead_id = ? AND email = ?", leadID, seal(email)).Scan(&verdict)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return verdict, err
+}
+
+func (r *Repository) AddCampaignRecipient(campaignID string, rc CampaignRecipient) error {
+	token, err := newUnsubscribeToken()
+	if err != nil {
+		return err
+	}
+	_, err = r.q.ExecContext(r.ctx, "INSERT INTO campaign_recipients (campaign_id, lead_id, company_name, email, status, reason, unsubscribe_token) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		campaignID, rc.LeadID, rc.CompanyName, seal(rc.Email), rc.Status, rc.Reason, token)
+	return err
+}
+
+func (r *Repository) SetCampaignRecipientMessageID(campaignID, leadID, messageID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE campaign_recipients SET message_id = ?
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE id = ? AND org_id = ?) AND lead_id = ?
+    `, messageID, campaignID, r.tenant.OrgID, leadID))
+}
+
+// MarkCampaignUnsubscribe records that a recipient unsubscribed, excluding
+// them if they were still queued.
+func (r *Repository) MarkCampaignUnsubscribe(campaignID, leadID string, at time.Time) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE campaign_recipients SET unsubscribed_at = ?,
+            reason = CASE WHEN status = ? THEN ? ELSE reason END,
+            status = CASE WHEN status = ? THEN ? ELSE status END
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE id = ? AND org_id = ?) AND lead_id = ?
+    `, at, RECIPIENT_QUEUED, EXCLUDED_SUPPRESSED, RECIPIENT_QUEUED, RECIPIENT_EXCLUDED, campaignID, r.tenant.OrgID, leadID))
+}
+
+func (r *Repository) queryCampaignRecipients(query string, args ...interface{}) ([]CampaignRecipient, error) {
+	rows, err := r.q.QueryContext(r.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipients := []CampaignRecipient{}
+	for rows.Next() {
+		var rc CampaignRecipient
+		var token sql.NullString
+		var sentAt, unsubscribedAt, repliedAt sql.NullTime
+		if err := rows.Scan(&rc.LeadID, &rc.CompanyName, &rc.Email, &rc.Status, &rc.Reason, &rc.Error, &sentAt, &token, &unsubscribedAt, &repliedAt); err != nil {
+			return nil, err
+		}
+		rc.Email = unseal(rc.Email)
+		rc.unsubscribeToken = token.String
+		if sentAt.Valid {
+			rc.SentAt = &sentAt.Time
+		}
+		if unsubscribedAt.Valid {
+			rc.UnsubscribedAt = &unsubscribedAt.Time
+		}
+		if repliedAt.Valid {
+			rc.RepliedAt = &repliedAt.Time
+		}
+		recipients = append(recipients, rc)
+	}
+	return recipients, rows.Err()
+}
+
+// CampaignRecipients pages through a campaign's recipients, all of them
+// or only those with status.
+func (r *Repository) CampaignRecipients(campaignID, status string, limit, offset int) ([]CampaignRecipient, error) {
+	return r.queryCampaignRecipients(`
+        SELECT lead_id, company_name, email, status, reason, error, sent_at, unsubscribe_token, unsubscribed_at, replied_at FROM campaign_recipients
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE id = ? AND org_id = ?) AND (? = '' OR status = ?)
+        ORDER BY company_name, lead_id LIMIT ? OFFSET ?
+    `, campaignID, r.tenant.OrgID, status, status, limit, offset)
+}
+
+// QueuedCampaignRecipients returns the next limit recipients to send to.
+func (r *Repository) QueuedCampaignRecipients(campaignID string, limit int) ([]CampaignRecipient, error) {
+	return r.queryCampaignRecipients(`
+        SELECT lead_id, company_name, email, status, reason, error, sent_at, unsubscribe_token, unsubscribed_at, replied_at FROM campaign_recipients
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE id = ? AND org_id = ?) AND status = ?
+        ORDER BY company_name, lead_id LIMIT ?
+    `, campaignID, r.tenant.OrgID, RECIPIENT_QUEUED, limit)
+}
+
+// CampaignSentSince counts the campaign's emails sent after since.
+func (r *Repository) CampaignSentSince(campaignID string, since time.Time) (int, error) {
+	var n int
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT COUNT(*) FROM campaign_recipients
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE id = ? AND org_id = ?) AND status = ? AND sent_at > ?
+    `, campaignID, r.tenant.OrgID, RECIPIENT_SENT, since.UTC()).Scan(&n)
+	return n, err
+}
+
+// SetCampaignRecipientStatus records what became of one recipient.
+func (r *Repository) SetCampaignRecipientStatus(campaignID, leadID, status, reason, sendErr string) error {
+	var sentAt interface{}
+	if status == RECIPIENT_SENT {
+		sentAt = time.Now().UTC()
+	}
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE campaign_recipients SET status = ?, reason = ?, error = ?, sent_at = ?
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE id = ? AND org_id = ?) AND lead_id = ?
+    `, status, reason, sendErr, sentAt, campaignID, r.tenant.OrgID, leadID))
+}
+
+// --- MAILBOXES AND REPLIES ---
+
+// mailboxTenants returns the tenant of every user with a mailbox.
+func mailboxTenants() ([]Tenant, error) {
+	rows, err := db.Query("SELECT org_id, user_id FROM mailboxes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tenants []Tenant
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.OrgID, &t.UserID); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+func (r *Repository) Mailbox() (Mailbox, error) {
+	var m Mailbox
+	var lastPolledAt sql.NullTime
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT host, port, security, username, password, folder, last_polled_at, last_error, uid_validity, last_uid
+        FROM mailboxes WHERE user_id = ? AND org_id = ?
+    `, r.tenant.UserID, r.tenant.OrgID).Scan(&m.Host, &m.Port, &m.Security, &m.Username, &m.Password, &m.Folder, &lastPolledAt, &m.LastError, &m.uidValidity, &m.lastUID)
+	if err == sql.ErrNoRows {
+		return m, store.ErrNotFound
+	}
+	m.Password = unseal(m.Password)
+	if lastPolledAt.Valid {
+		m.LastPolledAt = &lastPolledAt.Time
+	}
+	return m, err
+}
+
+// SaveMailbox connects the user's mailbox, replacing any other, with
+// replies counted from after lastUID.
+func (r *Repository) SaveMailbox(m Mailbox, uidValidity, lastUID uint32) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO mailboxes (user_id, org_id, host, port, security, username, password, folder, uid_validity, last_uid, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (user_id) DO UPDATE SET org_id = excluded.org_id, host = excluded.host, port = excluded.port, security = excluded.security,
+            username = excluded.username, password = excluded.password, folder = excluded.folder,
+            uid_validity = excluded.uid_validity, last_uid = excluded.last_uid, last_error = ''
+    `, r.tenant.UserID, r.tenant.OrgID, m.Host, m.Port, m.Security, m.Username, seal(m.Password), m.Folder, uidValidity, lastUID, time.Now().UTC())
+	return err
+}
+
+// SaveMailboxPoll records where a check of the mailbox got to, and the
+// error that stopped it, if any.
+func (r *Repository) SaveMailboxPoll(uidValidity, lastUID uint32, lastError string) error {
+	_, err := r.q.ExecContext(r.ctx, "UPDATE mailboxes SET uid_validity = ?, last_uid = ?, last_error = ?, last_polled_at = ? WHERE user_id = ? AND org_id = ?",
+		uidValidity, lastUID, lastError, time.Now().UTC(), r.tenant.UserID, r.tenant.OrgID)
+	return err
+}
+
+func (r *Repository) DeleteMailbox() error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM mailboxes WHERE user_id = ? AND org_id = ?", r.tenant.UserID, r.tenant.OrgID))
+}
+
+// ReplyRecipient finds the campaign email a message answers: the one
+// whose Message-ID it references, or else the latest sent to its sender.
+// It returns store.ErrNotFound when there's neither.
+func (r *Repository) ReplyRecipient(refs []string, from string) (campaignID, leadID string, err error) {
+	if len(refs) > 0 {
+		ids, args := store.InList(refs)
+		err = r.q.QueryRowContext(r.ctx, `
+            SELECT campaign_id, lead_id FROM campaign_recipients
+            WHERE campaign_id IN (SELECT id FROM campaigns WHERE org_id = ?) AND message_id IN (`+ids+`)
+            ORDER BY sent_at DESC LIMIT 1
+        `, append([]interface{}{r.tenant.OrgID}, args...)...).Scan(&campaignID, &leadID)
+		if err != sql.ErrNoRows {
+			return campaignID, leadID, err
+		}
+	}
+	if from == "" {
+		return "", "", store.ErrNotFound
+	}
+	err = r.q.QueryRowContext(r.ctx, `
+        SELECT campaign_id, lead_id FROM campaign_recipients
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE org_id = ?) AND status = ? AND LOWER(unseal(email)) = ?
+        ORDER BY sent_at DESC LIMIT 1
+    `, r.tenant.OrgID, RECIPIENT_SENT, from).Scan(&campaignID, &leadID)
+	if err == sql.ErrNoRows {
+		return "", "", store.ErrNotFound
+	}
+	return campaignID, leadID, err
+}
+
+// RecordEmailReply saves a reply to a campaign email, returning false if
+// the message was already recorded.
+func (r *Repository) RecordEmailReply(messageID, campaignID, leadID, subject string, receivedAt time.Time) (bool, error) {
+	res, err := r.q.ExecContext(r.ctx, "INSERT OR IGNORE INTO email_replies (org_id, message_id, campaign_id, lead_id, subject, received_at) VALUES (?, ?, ?, ?, ?, ?)",
+		r.tenant.OrgID, messageID, campaignID, leadID, subject, receivedAt)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	_, err = r.q.ExecContext(r.ctx, `
+        UPDATE campaign_recipients SET replied_at = COALESCE(replied_at, ?)
+        WHERE campaign_id IN (SELECT id FROM campaigns WHERE id = ? AND org_id = ?) AND lead_id = ?
+    `, receivedAt, campaignID, r.tenant.OrgID, leadID)
+	return err == nil, err
+}
+
+// --- MAIL ACCOUNTS ---
+
+func (r *Repository) MailAccount() (MailAccount, error) {
+	var a MailAccount
+	var sentDay string
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT provider, email, daily_limit, sent_today, sent_day, last_error, calendar_sync, created_at, access_token, refresh_token, token_expires_at
+        FROM mail_accounts WHERE user_id = ? AND org_id = ?
+    `, r.tenant.UserID, r.tenant.OrgID).Scan(&a.Provider, &a.Email, &a.DailyLimit, &a.SentToday, &sentDay, &a.LastError, &a.CalendarSync, &a.ConnectedAt,
+		&a.accessToken, &a.refreshToken, &a.tokenExpiresAt)
+	if err == sql.ErrNoRows {
+		return a, store.ErrNotFound
+	}
+	a.accessToken, a.refreshToken = unseal(a.accessToken), unseal(a.refreshToken)
+	if sentDay != mailDay(time.Now()) {
+		a.SentToday = 0
+	}
+	return a, err
+}
+
+// SaveMailAccount connects the user's mail account, replacing any other.
+// Reconnecting the same provider keeps the daily limit and today's count.
+func (r *Repository) SaveMailAccount(a MailAccount) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO mail_accounts (user_id, org_id, provider, email, access_token, refresh_token, token_expires_at, daily_limit, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (user_id) DO UPDATE SET org_id = excluded.org_id, email = excluded.email,
+            access_token = excluded.access_token, refresh_token = excluded.refresh_token, token_expires_at = excluded.token_expires_at,
+            daily_limit = CASE WHEN provider = excluded.provider THEN daily_limit ELSE excluded.daily_limit END,
+            provider = excluded.provider, last_error = '', created_at = excluded.created_at
+    `, r.tenant.UserID, r.tenant.OrgID, a.Provider, a.Email, seal(a.accessToken), seal(a.refreshToken), a.tokenExpiresAt, a.DailyLimit, time.Now().UTC())
+	return err
+}
+
+// SaveMailAccountTokens stores refreshed tokens, clearing the last error.
+func (r *Repository) SaveMailAccountTokens(accessToken, refreshToken string, expiresAt time.Time) error {
+	_, err := r.q.ExecContext(r.ctx, "UPDATE mail_accounts SET access_token = ?, refresh_token = ?, token_expires_at = ?, last_error = '' WHERE user_id = ? AND org_id = ?",
+		seal(accessToken), seal(refreshToken), expiresAt, r.tenant.UserID, r.tenant.OrgID)
+	return err
+}
+
+func (r *Repository) SetMailAccountError(lastError string) error {
+	_, err := r.q.ExecContext(r.ctx, "UPDATE mail_accounts SET last_error = ? WHERE user_id = ? AND org_id = ?", lastError, r.tenant.UserID, r.tenant.OrgID)
+	return err
+}
+
+func (r *Repository) UpdateMailAccountSettings(dailyLimit int, calendarSync bool) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE mail_accounts SET daily_limit = ?, calendar_sync = ? WHERE user_id = ? AND org_id = ?",
+		dailyLimit, calendarSync, r.tenant.UserID, r.tenant.OrgID))
+}
+
+// ReserveMailAccountSend counts one email against day's limit, returning
+// false without counting it when the limit is reached.
+func (r *Repository) ReserveMailAccountSend(day string) (bool, error) {
+	res, err := r.q.ExecContext(r.ctx, `
+        UPDATE mail_accounts SET sent_today = CASE WHEN sent_day = ? THEN sent_today + 1 ELSE 1 END, sent_day = ?
+        WHERE user_id = ? AND org_id = ? AND (sent_day != ? OR sent_today < daily_limit)
+    `, day, day, r.tenant.UserID, r.tenant.OrgID, day)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ReleaseMailAccountSend uncounts a reserved email that didn't go out.
+func (r *Repository) ReleaseMailAccountSend(day string) error {
+	_, err := r.q.ExecContext(r.ctx, "UPDATE mail_accounts SET sent_today = sent_today - 1 WHERE user_id = ? AND org_id = ? AND sent_day = ? AND sent_today > 0",
+		r.tenant.UserID, r.tenant.OrgID, day)
+	return err
+}
+
+// DeleteMailAccount disconnects the account and forgets the calendar
+// events made in it.
+func (r *Repository) DeleteMailAccount() error {
+	if err := store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM mail_accounts WHERE user_id = ? AND org_id = ?", r.tenant.UserID, r.tenant.OrgID)); err != nil {
+		return err
+	}
+	_, err := r.q.ExecContext(r.ctx, "DELETE FROM calendar_events WHERE user_id = ? AND org_id = ?", r.tenant.UserID, r.tenant.OrgID)
+	return err
+}
+
+// CalendarChanges returns the tenant user's callbacks that were booked or
+// moved since their event was last saved, and the events whose callback
+// has gone, with no callbackAt.
+func (r *Repository) CalendarChanges() ([]calendarChange, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT c.lead_id, COALESCE(c.company_name, ''), c.callback_date, COALESCE(e.event_id, '')
+        FROM crm_leads c
+        LEFT JOIN calendar_events e ON e.user_id = c.user_id AND e.org_id = c.org_id AND e.lead_id = c.lead_id
+        WHERE c.user_id = ? AND c.org_id = ? AND c.deleted_at IS NULL AND c.callback_date IS NOT NULL
+          AND (e.lead_id IS NULL OR e.synced_for IS NOT c.callback_date)
+        UNION ALL
+        SELECT e.lead_id, '', NULL, e.event_id FROM calendar_events e
+        WHERE e.user_id = ? AND e.org_id = ? AND NOT EXISTS (
+            SELECT 1 FROM crm_leads c
+            WHERE c.user_id = e.user_id AND c.org_id = e.org_id AND c.lead_id = e.lead_id AND c.deleted_at IS NULL AND c.callback_date IS NOT NULL
+        )
+    `, r.tenant.UserID, r.tenant.OrgID, r.tenant.UserID, r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var changes []calendarChange
+	for rows.Next() {
+		ch, err := scanCalendarChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, ch)
+	}
+	return changes, rows.Err()
+}
+
+// SaveCalendarEvent records that the card's current callback is in the
+// calendar as eventID; an empty eventID marks a callback that was left out.
+func (r *Repository) SaveCalendarEvent(leadID, eventID string) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO calendar_events (user_id, org_id, lead_id, event_id, synced_for)
+        SELECT user_id, org_id, lead_id, ?, callback_date FROM crm_leads WHERE user_id = ? AND org_id = ? AND lead_id = ?
+        ON CONFLICT (user_id, lead_id) DO UPDATE SET event_id = excluded.event_id, synced_for = excluded.synced_for
+    `, eventID, r.tenant.UserID, r.tenant.OrgID, leadID)
+	return err
+}
+
+func (r *Repository) DeleteCalendarEvent(leadID string) error {
+	_, err := r.q.ExecContext(r.ctx, "DELETE FROM calendar_events WHERE user_id = ? AND org_id = ? AND lead_id = ?", r.tenant.UserID, r.tenant.OrgID, leadID)
+	return err
+}
+
+// --- BOOKING PAGES ---
+const bookingPageSelectColumns = "user_id, org_id, slug, title, intro, duration_minutes, availability, min_notice_hours, horizon_days, enabled"
+
+func scanBookingPage(s store.RowScanner) (BookingPage, error) {
+	var p BookingPage
+	var availability string
+	err := s.Scan(&p.userID, &p.orgID, &p.Slug, &p.Title, &p.Intro, &p.DurationMinutes, &availability, &p.MinNoticeHours, &p.HorizonDays, &p.Enabled)
+	if err == sql.ErrNoRows {
+		return p, store.ErrNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+	json.Unmarshal([]byte(availability), &p.Availability)
+	p.URL = bookingURL + p.Slug
+	return p, nil
+}
+
+func (r *Repository) BookingPage() (BookingPage, error) {
+	return scanBookingPage(r.q.QueryRowContext(r.ctx, "SELECT "+bookingPageSelectColumns+" FROM booking_pages WHERE user_id = ? AND org_id = ?", r.tenant.UserID, r.tenant.OrgID))
+}
+
+// bookingPageBySlug finds a page for the public booking form.
+func bookingPageBySlug(ctx context.Context, slug string) (BookingPage, error) {
+	return scanBookingPage(db.QueryRowContext(ctx, "SELECT "+bookingPageSelectColumns+" FROM booking_pages WHERE slug = ?", strings.ToLower(slug)))
+}
+
+// SaveBookingPage sets up the user's booking page or replaces its
+// settings. A slug another page has fails the UNIQUE constraint.
+func (r *Repository) SaveBookingPage(p BookingPage) error {
+	availability, err := json.Marshal(p.Availability)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err = r.q.ExecContext(r.ctx, `
+        INSERT INTO booking_pages (user_id, org_id, slug, title, intro, duration_minutes, availability, min_notice_hours, horizon_days, enabled, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (user_id) DO UPDATE SET org_id = excluded.org_id, slug = excluded.slug, title = excluded.title, intro = excluded.intro,
+            duration_minutes = excluded.duration_minutes, availability = excluded.availability, min_notice_hours = excluded.min_notice_hours,
+            horizon_days = excluded.horizon_days, enabled = excluded.enabled, updated_at = excluded.updated_at
+    `, r.tenant.UserID, r.tenant.OrgID, p.Slug, strings.TrimSpace(p.Title), strings.TrimSpace(p.Intro), p.DurationMinutes, string(availability),
+		p.MinNoticeHours, p.HorizonDays, p.Enabled, now, now)
+	return err
+}
+
+func (r *Repository) DeleteBookingPage() error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM booking_pages WHERE user_id = ? AND org_id = ?", r.tenant.UserID, r.tenant.OrgID))
+}
+
+// BusyTimes returns the spans taken up in the tenant user's diary from now
+// on: their bookings, and the callbacks on the cards they added.
+func (r *Repository) BusyTimes(now time.Time) ([][2]time.Time, error) {
+	var busy [][2]time.Time
+	rows, err := r.q.QueryContext(r.ctx, "SELECT starts_at, ends_at FROM bookings WHERE user_id = ? AND org_id = ? AND ends_at > ?", r.tenant.UserID, r.tenant.OrgID, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var span [2]time.Time
+		if err := rows.Scan(&span[0], &span[1]); err != nil {
+			return nil, err
+		}
+		busy = append(busy, span)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Callback dates keep the client's offset, so they're compared here
+	// rather than in SQL.
+	callbacks, err := r.q.QueryContext(r.ctx, "SELECT callback_date FROM crm_leads WHERE user_id = ? AND org_id = ? AND deleted_at IS NULL AND callback_date IS NOT NULL",
+		r.tenant.UserID, r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer callbacks.Close()
+	for callbacks.Next() {
+		var at time.Time
+		if err := callbacks.Scan(&at); err != nil {
+			return nil, err
+		}
+		if end := at.Add(CALENDAR_EVENT_DURATION); end.After(now) {
+			busy = append(busy, [2]time.Time{at, end})
+		}
+	}
+	return busy, callbacks.Err()
+}
+
+// HasUpcomingBooking reports whether email has booked a call with the
+// tenant user that hasn't ended yet.
+func (r *Repository) HasUpcomingBooking(email string, now time.Time) (bool, error) {
+	var n int
+	err := r.q.QueryRowContext(r.ctx, "SELECT COUNT(*) FROM bookings WHERE user_id = ? AND org_id = ? AND ends_at > ? AND LOWER(unseal(email)) = ?",
+		r.tenant.UserID, r.tenant.OrgID, now.UTC(), strings.ToLower(email)).Scan(&n)
+	return n > 0, err
+}
+
+// LeadByEmail finds the card on the board with the email address, on the
+// card itself or among its lead's addresses; the latest updated wins.
+func (r *Repository) LeadByEmail(email string) (string, error) {
+	var leadID string
+	email = strings.ToLower(email)
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT c.lead_id FROM crm_leads c
+        WHERE c.org_id = ? AND c.deleted_at IS NULL
+          AND (LOWER(unseal(c.email)) = ? OR EXISTS (SELECT 1 FROM lead_emails e WHERE e.lead_id = c.lead_id AND LOWER(unseal(e.email)) = ?))
+        ORDER BY c.updated_at DESC LIMIT 1
+    `, r.tenant.OrgID, email, email).Scan(&leadID)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	return leadID, err
+}
+
+func (r *Repository) CreateBooking(b Booking) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO bookings (id, org_id, user_id, lead_id, name, email, company, phone, notes, starts_at, ends_at, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, b.ID, r.tenant.OrgID, r.tenant.UserID, b.LeadID, b.Name, seal(b.Email), b.Company, seal(b.Phone), seal(b.Notes), b.StartsAt.UTC(), b.EndsAt.UTC(), b.CreatedAt.UTC())
+	return err
+}
+
+func (r *Repository) SetBookingEvent(bookingID, eventID string) error {
+	_, err := r.q.ExecContext(r.ctx, "UPDATE bookings SET event_id = ? WHERE id = ? AND org_id = ?", eventID, bookingID, r.tenant.OrgID)
+	return err
+}
+
+// Bookings returns the tenant user's bookings that end after from,
+// soonest first.
+func (r *Repository) Bookings(from time.Time) ([]Booking, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT id, lead_id, name, email, company, phone, notes, starts_at, ends_at, created_at
+        FROM bookings WHERE user_id = ? AND org_id = ? AND ends_at > ? ORDER BY starts_at
+    `, r.tenant.UserID, r.tenant.OrgID, from.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bookings := []Booking{}
+	for rows.Next() {
+		var b Booking
+		if err := rows.Scan(&b.ID, &b.LeadID, &b.Name, &b.Email, &b.Company, &b.Phone, &b.Notes, &b.StartsAt, &b.EndsAt, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		b.Email, b.Phone, b.Notes = unseal(b.Email), unseal(b.Phone), unseal(b.Notes)
+		bookings = append(bookings, b)
+	}
+	return bookings, rows.Err()
+}
+
+// --- MEETINGS ---
+const meetingSelectColumns = "id, lead_id, title, starts_at, ends_at, location, attendees, outcome, notes, booking_id, created_by, created_at, updated_at"
+
+func scanMeeting(s store.RowScanner) (Meeting, error) {
+	var m Meeting
+	var attendees string
+	err := s.Scan(&m.ID, &m.LeadID, &m.Title, &m.StartsAt, &m.EndsAt, &m.Location, &attendees, &m.Outcome, &m.Notes, &m.BookingID, &m.CreatedBy, &m.CreatedAt, &m.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return m, store.ErrNotFound
+	}
+	if err != nil {
+		return m, err
+	}
+	m.Notes = unseal(m.Notes)
+	m.Attendees = []string{}
+	if err := json.Unmarshal([]byte(unseal(attendees)), &m.Attendees); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// Meetings returns the organization's meetings, those with leadID's card
+// when it's set and those starting in [from, to) when the bounds are,
+// earliest first.
+func (r *Repository) Meetings(leadID string, from, to *time.Time) ([]Meeting, error) {
+	query := "SELECT " + meetingSelectColumns + " FROM meetings WHERE org_id = ?"
+	args := []interface{}{r.tenant.OrgID}
+	if leadID != "" {
+		query += " AND lead_id = ?"
+		args = append(args, leadID)
+	}
+	if from != nil {
+		query += " AND starts_at >= ?"
+		args = append(args, from.UTC())
+	}
+	if to != nil {
+		query += " AND starts_at < ?"
+		args = append(args, to.UTC())
+	}
+	rows, err := r.q.QueryContext(r.ctx, query+" ORDER BY starts_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	meetings := []Meeting{}
+	for rows.Next() {
+		m, err := scanMeeting(rows)
+		if err != nil {
+			return nil, err
+		}
+		meetings = append(meetings, m)
+	}
+	return meetings, rows.Err()
+}
+
+func (r *Repository) Meeting(meetingID string) (Meeting, error) {
+	return scanMeeting(r.q.QueryRowContext(r.ctx, "SELECT "+meetingSelectColumns+" FROM meetings WHERE id = ? AND org_id = ?", meetingID, r.tenant.OrgID))
+}
+
+func (r *Repository) CreateMeeting(m Meeting) error {
+	attendees, err := json.Marshal(m.Attendees)
+	if err != nil {
+		return err
+	}
+	_, err = r.q.ExecContext(r.ctx, `
+        INSERT INTO meetings (id, org_id, lead_id, title, starts_at, ends_at, location, attendees, outcome, notes, booking_id, created_by, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, m.ID, r.tenant.OrgID, m.LeadID, m.Title, m.StartsAt.UTC(), m.EndsAt.UTC(), m.Location, seal(string(attendees)), m.Outcome, seal(m.Notes), m.BookingID, r.tenant.UserID, m.CreatedAt.UTC(), m.UpdatedAt.UTC())
+	return err
+}
+
+func (r *Repository) UpdateMeeting(meetingID string, in meetingInput) error {
+	attendees, err := json.Marshal(in.Attendees)
+	if err != nil {
+		return err
+	}
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE meetings SET title = ?, starts_at = ?, ends_at = ?, location = ?, attendees = ?, outcome = ?, notes = ?, updated_at = ?
+        WHERE id = ? AND org_id = ?
+    `, in.Title, in.StartsAt.UTC(), in.EndsAt.UTC(), strings.TrimSpace(in.Location), seal(string(attendees)), in.Outcome, seal(in.Notes), time.Now().UTC(), meetingID, r.tenant.OrgID))
+}
+
+func (r *Repository) DeleteMeeting(meetingID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM meetings WHERE id = ? AND org_id = ?", meetingID, r.tenant.OrgID))
+}
+
+// MeetingCounts counts the meetings booked in [from, to) by who booked
+// them and how they went.
+func (r *Repository) MeetingCounts(from, to *time.Time) ([]meetingCount, error) {
+	query := "SELECT created_by, outcome, COUNT(*) FROM meetings WHERE org_id = ?"
+	args := []interface{}{r.tenant.OrgID}
+	if from != nil {
+		query += " AND created_at >= ?"
+		args = append(args, from.UTC())
+	}
+	if to != nil {
+		query += " AND created_at < ?"
+		args = append(args, to.UTC())
+	}
+	rows, err := r.q.QueryContext(r.ctx, query+" GROUP BY created_by, outcome", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []meetingCount
+	for rows.Next() {
+		var mc meetingCount
+		if err := rows.Scan(&mc.userID, &mc.outcome, &mc.n); err != nil {
+			return nil, err
+		}
+		counts = append(counts, mc)
+	}
+	return counts, rows.Err()
+}
+
+// CallCounts counts the calls each user logged in [from, to).
+func (r *Repository) CallCounts(from, to *time.Time) (map[int64]int, error) {
+	query := "SELECT user_id, COUNT(*) FROM crm_calls WHERE org_id = ?"
+	args := []interface{}{r.tenant.OrgID}
+	if from != nil {
+		query += " AND called_at >= ?"
+		args = append(args, from.UTC())
+	}
+	if to != nil {
+		query += " AND called_at < ?"
+		args = append(args, to.UTC())
+	}
+	rows, err := r.q.QueryContext(r.ctx, query+" GROUP BY user_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[int64]int{}
+	for rows.Next() {
+		var userID int64
+		var n int
+		if err := rows.Scan(&userID, &n); err != nil {
+			return nil, err
+		}
+		counts[userID] = n
+	}
+	return counts, rows.Err()
+}
+
+// FeedMeetings returns the meetings the tenant user booked that start
+// after since, earliest first.
+func (r *Repository) FeedMeetings(since time.Time) ([]Meeting, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+meetingSelectColumns+" FROM meetings WHERE org_id = ? AND created_by = ? AND starts_at >= ? ORDER BY starts_at",
+		r.tenant.OrgID, r.tenant.UserID, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	meetings := []Meeting{}
+	for rows.Next() {
+		m, err := scanMeeting(rows)
+		if err != nil {
+			return nil, err
+		}
+		meetings = append(meetings, m)
+	}
+	return meetings, rows.Err()
+}
+
+// --- CALENDAR FEEDS ---
+
+func (r *Repository) CalendarFeedToken() (string, error) {
+	var token string
+	err := r.q.QueryRowContext(r.ctx, "SELECT token FROM calendar_feeds WHERE user_id = ? AND org_id = ?", r.tenant.UserID, r.tenant.OrgID).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	return token, err
+}
+
+func (r *Repository) SaveCalendarFeedToken(token string) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO calendar_feeds (user_id, org_id, token, created_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_id) DO UPDATE SET org_id = excluded.org_id, token = excluded.token, created_at = excluded.created_at
+    `, r.tenant.UserID, r.tenant.OrgID, token, time.Now().UTC())
+	return err
+}
+
+func (r *Repository) DeleteCalendarFeed() error {
+	_, err := r.q.ExecContext(r.ctx, "DELETE FROM calendar_feeds WHERE user_id = ? AND org_id = ?", r.tenant.UserID, r.tenant.OrgID)
+	return err
+}
+
+// calendarFeedTenant finds whose feed token is. It isn't tenant-scoped:
+// the token is the credential.
+func calendarFeedTenant(ctx context.Context, token string) (Tenant, error) {
+	var t Tenant
+	err := db.QueryRowContext(ctx, "SELECT org_id, user_id FROM calendar_feeds WHERE token = ?", token).Scan(&t.OrgID, &t.UserID)
+	if err == sql.ErrNoRows {
+		return t, store.ErrNotFound
+	}
+	return t, err
+}
+
+// FeedCallbacks returns the callbacks on the cards the tenant user put on
+// the board, soonest first.
+func (r *Repository) FeedCallbacks() ([]calendarChange, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT lead_id, COALESCE(company_name, ''), callback_date, '' FROM crm_leads
+        WHERE user_id = ? AND org_id = ? AND deleted_at IS NULL AND callback_date IS NOT NULL
+    `, r.tenant.UserID, r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var callbacks []calendarChange
+	for rows.Next() {
+		ch, err := scanCalendarChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, ch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Callback dates keep the offset they were set with, so they're
+	// ordered here rather than in SQL.
+	sort.Slice(callbacks, func(i, j int) bool { return callbacks[i].callbackAt.Before(*callbacks[j].callbackAt) })
+	return callbacks, nil
+}
+
+// --- TASKS ---
+const taskSelectColumns = "id, title, notes, lead_id, assignee, due_date, repeat_every, repeat_unit, done_at, skipped, next_task_id, created_by, created_at, updated_at"
+
+func scanTask(s store.RowScanner) (Task, error) {
+	var task Task
+	var repeat TaskRepeat
+	var doneAt sql.NullTime
+	err := s.Scan(&task.ID, &task.Title, &task.Notes, &task.LeadID, &task.Assignee, &task.DueDate, &repeat.Every, &repeat.Unit, &doneAt, &task.Skipped,
+		&task.NextTaskID, &task.CreatedBy, &task.CreatedAt, &task.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return task, store.ErrNotFound
+	}
+	if repeat.Every > 0 {
+		task.Repeat = &repeat
+	}
+	if doneAt.Valid {
+		task.Done, task.DoneAt = true, &doneAt.Time
+	}
+	return task, err
+}
+
+// taskFilter narrows Tasks; zero fields don't filter.
+type taskFilter struct {
+	assignee int64
+	leadID   string
+	done     *bool
+	// dueBy keeps tasks due on or before this date.
+	dueBy string
+}
+
+// Tasks returns the organization's tasks matching the filter: open ones
+// first, by due date with undated ones last, then done ones, most
+// recently done first.
+func (r *Repository) Tasks(f taskFilter) ([]Task, error) {
+	query := "SELECT " + taskSelectColumns + " FROM tasks WHERE org_id = ?"
+	args := []interface{}{r.tenant.OrgID}
+	if f.assignee != 0 {
+		query += " AND assignee = ?"
+		args = append(args, f.assignee)
+	}
+	if f.leadID != "" {
+		query += " AND lead_id = ?"
+		args = append(args, f.leadID)
+	}
+	if f.done != nil && *f.done {
+		query += " AND done_at IS NOT NULL"
+	} else if f.done != nil {
+		query += " AND done_at IS NULL"
+	}
+	if f.dueBy != "" {
+		query += " AND due_date != '' AND due_date <= ?"
+		args = append(args, f.dueBy)
+	}
+	query += " ORDER BY done_at IS NOT NULL, done_at DESC, due_date = '', due_date, created_at"
+	rows, err := r.q.QueryContext(r.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tasks := []Task{}
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (r *Repository) Task(taskID string) (Task, error) {
+	return scanTask(r.q.QueryRowContext(r.ctx, "SELECT "+taskSelectColumns+" FROM tasks WHERE id = ? AND org_id = ?", taskID, r.tenant.OrgID))
+}
+
+func (r *Repository) CreateTask(task Task) error {
+	var repeat TaskRepeat
+	if task.Repeat != nil {
+		repeat = *task.Repeat
+	}
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO tasks (id, org_id, title, notes, lead_id, assignee, due_date, repeat_every, repeat_unit, done_at, created_by, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, task.ID, r.tenant.OrgID, task.Title, task.Notes, task.LeadID, task.Assignee, task.DueDate, repeat.Every, repeat.Unit, task.DoneAt, r.tenant.UserID,
+		task.CreatedAt.UTC(), task.UpdatedAt.UTC())
+	return err
+}
+
+// UpdateTask replaces the task's details. done_at is kept while the task
+// stays done and cleared, with skipped, when it's reopened.
+func (r *Repository) UpdateTask(taskID string, in taskInput) error {
+	var repeat TaskRepeat
+	if in.Repeat != nil {
+		repeat = *in.Repeat
+	}
+	now := time.Now().UTC()
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE tasks SET title = ?, notes = ?, lead_id = ?, assignee = ?, due_date = ?, repeat_every = ?, repeat_unit = ?,
+            done_at = CASE WHEN ? THEN COALESCE(done_at, ?) END, skipped = CASE WHEN ? THEN skipped ELSE 0 END, updated_at = ?
+        WHERE id = ? AND org_id = ?
+    `, in.Title, in.Notes, in.LeadID, in.Assignee, in.DueDate, repeat.Every, repeat.Unit, in.Done, now, in.Done, now, taskID, r.tenant.OrgID))
+}
+
+func (r *Repository) SnoozeTask(taskID, until string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE tasks SET due_date = ?, updated_at = ? WHERE id = ? AND org_id = ? AND done_at IS NULL",
+		until, time.Now().UTC(), taskID, r.tenant.OrgID))
+}
+
+// SkipTask closes an open task as skipped.
+func (r *Repository) SkipTask(taskID string) error {
+	now := time.Now().UTC()
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE tasks SET done_at = ?, skipped = 1, updated_at = ? WHERE id = ? AND org_id = ? AND done_at IS NULL",
+		now, now, taskID, r.tenant.OrgID))
+}
+
+func (r *Repository) SetNextTask(taskID, nextTaskID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE tasks SET next_task_id = ? WHERE id = ? AND org_id = ?", nextTaskID, taskID, r.tenant.OrgID))
+}
+
+// EndTaskRepeat drops the task's repeat rule, ending its series.
+func (r *Repository) EndTaskRepeat(taskID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE tasks SET repeat_every = 0, repeat_unit = '' WHERE id = ? AND org_id = ?", taskID, r.tenant.OrgID))
+}
+
+func (r *Repository) DeleteTask(taskID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM tasks WHERE id = ? AND org_id = ?", taskID, r.tenant.OrgID))
+}
+
+// --- TERRITORIES ---
+const territorySelectColumns = "id, name, assignee, polygon, created_at"
+
+func (r *Repository) Territories() ([]Territory, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+territorySelectColumns+" FROM territories WHERE org_id = ? ORDER BY name", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	territories := []Territory{}
+	for rows.Next() {
+		t, err := scanTerritory(rows)
+		if err != nil {
+			log.Printf("Error scanning territory row: %v", err)
+			continue
+		}
+		territories = append(territories, t)
+	}
+	return territories, rows.Err()
+}
+
+func (r *Repository) Territory(territoryID string) (Territory, error) {
+	t, err := scanTerritory(r.q.QueryRowContext(r.ctx, "SELECT "+territorySelectColumns+" FROM territories WHERE id = ? AND org_id = ?", territoryID, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return t, store.ErrNotFound
+	}
+	return t, err
+}
+
+func (r *Repository) CreateTerritory(t Territory) error {
+	rawPolygon, _ := json.Marshal(t.Polygon)
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO territories (id, user_id, org_id, name, assignee, polygon) VALUES (?, ?, ?, ?, ?, ?)",
+		t.ID, r.tenant.UserID, r.tenant.OrgID, t.Name, t.Assignee, string(rawPolygon))
+	return err
+}
+
+func (r *Repository) UpdateTerritory(territoryID string, in territoryInput) error {
+	rawPolygon, _ := json.Marshal(in.Polygon)
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE territories SET name = ?, assignee = ?, polygon = ? WHERE id = ? AND org_id = ?", in.Name, in.Assignee, string(rawPolygon), territoryID, r.tenant.OrgID))
+}
+
+func (r *Repository) DeleteTerritory(territoryID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM territories WHERE id = ? AND org_id = ?", territoryID, r.tenant.OrgID))
+}
+
+// --- SEGMENTS ---
+const segmentSelectColumns = "id, name, conditions, user_id, created_at, updated_at"
+
+func scanSegment(row store.RowScanner) (Segment, error) {
+	var s Segment
+	var conditions string
+	if err := row.Scan(&s.ID, &s.Name, &conditions, &s.CreatedBy, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return s, err
+	}
+	err := json.Unmarshal([]byte(conditions), &s.Conditions)
+	return s, err
+}
+
+func (r *Repository) Segments() ([]Segment, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+segmentSelectColumns+" FROM segments WHERE org_id = ? ORDER BY name COLLATE NOCASE", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := []Segment{}
+	for rows.Next() {
+		s, err := scanSegment(rows)
+		if err != nil {
+			log.Printf("Error scanning segment row: %v", err)
+			continue
+		}
+		segments = append(segments, s)
+	}
+	return segments, rows.Err()
+}
+
+func (r *Repository) Segment(segmentID string) (Segment, error) {
+	s, err := scanSegment(r.q.QueryRowContext(r.ctx, "SELECT "+segmentSelectColumns+" FROM segments WHERE id = ? AND org_id = ?", segmentID, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return s, store.ErrNotFound
+	}
+	return s, err
+}
+
+func (r *Repository) CreateSegment(s Segment) error {
+	conditions, _ := json.Marshal(s.Conditions)
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO segments (id, org_id, user_id, name, conditions, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		s.ID, r.tenant.OrgID, r.tenant.UserID, s.Name, string(conditions), s.CreatedAt, s.UpdatedAt)
+	return err
+}
+
+func (r *Repository) UpdateSegment(segmentID string, in segmentInput) error {
+	conditions, _ := json.Marshal(in.Conditions)
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE segments SET name = ?, conditions = ?, updated_at = ? WHERE id = ? AND org_id = ?",
+		in.Name, string(conditions), time.Now().UTC(), segmentID, r.tenant.OrgID))
+}
+
+func (r *Repository) DeleteSegment(segmentID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM segments WHERE id = ? AND org_id = ?", segmentID, r.tenant.OrgID))
+}
+
+// SegmentInDraftCampaign reports whether a campaign yet to start targets
+// the segment.
+func (r *Repository) SegmentInDraftCampaign(segmentID string) (bool, error) {
+	var n int
+	err := r.q.QueryRowContext(r.ctx, "SELECT COUNT(*) FROM campaigns WHERE org_id = ? AND filter_segment = ? AND status = ?", r.tenant.OrgID, segmentID, CAMPAIGN_DRAFT).Scan(&n)
+	return n > 0, err
+}
+
+// --- SAVED VIEWS ---
+const savedViewSelectColumns = "id, name, filters, created_at, updated_at"
+
+func scanSavedView(row store.RowScanner) (SavedView, error) {
+	var v SavedView
+	var rawFilters string
+	if err := row.Scan(&v.ID, &v.Name, &rawFilters, &v.CreatedAt, &v.UpdatedAt); err != nil {
+		return v, err
+	}
+	err := json.Unmarshal([]byte(rawFilters), &v.Filters)
+	return v, err
+}
+
+// SavedViews returns the tenant user's views by name.
+func (r *Repository) SavedViews() ([]SavedView, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+savedViewSelectColumns+" FROM saved_views WHERE org_id = ? AND user_id = ? ORDER BY name COLLATE NOCASE", r.tenant.OrgID, r.tenant.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []SavedView{}
+	for rows.Next() {
+		v, err := scanSavedView(rows)
+		if err != nil {
+			log.Printf("Error scanning saved view row: %v", err)
+			continue
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
+
+func (r *Repository) SavedView(viewID string) (SavedView, error) {
+	v, err := scanSavedView(r.q.QueryRowContext(r.ctx, "SELECT "+savedViewSelectColumns+" FROM saved_views WHERE id = ? AND org_id = ? AND user_id = ?", viewID, r.tenant.OrgID, r.tenant.UserID))
+	if err == sql.ErrNoRows {
+		return v, store.ErrNotFound
+	}
+	return v, err
+}
+
+func (r *Repository) CreateSavedView(v SavedView) error {
+	rawFilters, _ := json.Marshal(v.Filters)
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO saved_views (id, org_id, user_id, name, filters, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		v.ID, r.tenant.OrgID, r.tenant.UserID, v.Name, string(rawFilters), v.CreatedAt, v.UpdatedAt)
+	return err
+}
+
+func (r *Repository) UpdateSavedView(viewID string, in viewInput) error {
+	rawFilters, _ := json.Marshal(in.Filters)
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE saved_views SET name = ?, filters = ?, updated_at = ? WHERE id = ? AND org_id = ? AND user_id = ?",
+		in.Name, string(rawFilters), time.Now().UTC(), viewID, r.tenant.OrgID, r.tenant.UserID))
+}
+
+func (r *Repository) DeleteSavedView(viewID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM saved_views WHERE id = ? AND org_id = ? AND user_id = ?", viewID, r.tenant.OrgID, r.tenant.UserID))
+}
+
+// --- LEAD LISTS ---
+
+// leadListSearches returns the live searches of each of the tenant's
+// lists, in the order they were given.
+func (r *Repository) leadListSearches(listID string) (map[string][]string, error) {
+	query := `
+        SELECT m.list_id, m.search_id FROM lead_list_searches m
+        JOIN lead_lists l ON l.id = m.list_id
+        JOIN searches s ON s.id = m.search_id AND s.deleted_at IS NULL
+        WHERE l.org_id = ?`
+	args := []interface{}{r.tenant.OrgID}
+	if listID != "" {
+		query += " AND m.list_id = ?"
+		args = append(args, listID)
+	}
+	rows, err := r.q.QueryContext(r.ctx, query+" ORDER BY m.position", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	searches := map[string][]string{}
+	for rows.Next() {
+		var listID, searchID string
+		if err := rows.Scan(&listID, &searchID); err != nil {
+			return nil, err
+		}
+		searches[listID] = append(searches[listID], searchID)
+	}
+	return searches, rows.Err()
+}
+
+func (r *Repository) LeadLists() ([]LeadList, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT id, name, created_at FROM lead_lists WHERE org_id = ? ORDER BY name", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	lists := []LeadList{}
+	for rows.Next() {
+		var l LeadList
+		if err := rows.Scan(&l.ID, &l.Name, &l.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	searches, err := r.leadListSearches("")
+	if err != nil {
+		return nil, err
+	}
+	for i := range lists {
+		lists[i].SearchIDs = append([]string{}, searches[lists[i].ID]...)
+	}
+	return lists, nil
+}
+
+func (r *Repository) LeadList(listID string) (LeadList, error) {
+	var l LeadList
+	err := r.q.QueryRowContext(r.ctx, "SELECT id, name, created_at FROM lead_lists WHERE id = ? AND org_id = ?", listID, r.tenant.OrgID).Scan(&l.ID, &l.Name, &l.CreatedAt)
+	if err == sql.ErrNoRows {
+		return l, store.ErrNotFound
+	}
+	if err != nil {
+		return l, err
+	}
+	searches, err := r.leadListSearches(listID)
+	l.SearchIDs = append([]string{}, searches[listID]...)
+	return l, err
+}
+
+// setLeadListSearches replaces a list's searches. It fails with
+// store.ErrNotFound if any of them isn't one of the tenant's live searches.
+func (r *Repository) setLeadListSearches(listID string, searchIDs []string) error {
+	if _, err := r.q.ExecContext(r.ctx, "DELETE FROM lead_list_searches WHERE list_id = ?", listID); err != nil {
+		return err
+	}
+	for i, searchID := range searchIDs {
+		err := store.ExpectOne(r.q.ExecContext(r.ctx, "INSERT INTO lead_list_searches (list_id, search_id, position) SELECT ?, id, ? FROM searches WHERE id = ? AND org_id = ? AND deleted_at IS NULL",
+			listID, i, searchID, r.tenant.OrgID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) CreateLeadList(l LeadList) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO lead_lists (id, org_id, user_id, name) VALUES (?, ?, ?, ?)", l.ID, r.tenant.OrgID, r.tenant.UserID, l.Name)
+	if err != nil {
+		return err
+	}
+	return r.setLeadListSearches(l.ID, l.SearchIDs)
+}
+
+func (r *Repository) UpdateLeadList(listID string, in leadListInput) error {
+	if err := store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE lead_lists SET name = ? WHERE id = ? AND org_id = ?", in.Name, listID, r.tenant.OrgID)); err != nil {
+		return err
+	}
+	return r.setLeadListSearches(listID, in.SearchIDs)
+}
+
+func (r *Repository) DeleteLeadList(listID string) error {
+	if err := store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM lead_lists WHERE id = ? AND org_id = ?", listID, r.tenant.OrgID)); err != nil {
+		return err
+	}
+	_, err := r.q.ExecContext(r.ctx, "DELETE FROM lead_list_searches WHERE list_id = ?", listID)
+	return err
+}
+
+// --- TRASH ---
+
+func (r *Repository) TrashedSearches() ([]TrashedSearch, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT id, keyword, deleted_at FROM searches WHERE org_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []TrashedSearch{}
+	for rows.Next() {
+		var s TrashedSearch
+		if err := rows.Scan(&s.ID, &s.Keyword, &s.DeletedAt); err != nil {
+			log.Printf("Error scanning trashed search: %v", err)
+			continue
+		}
+		searches = append(searches, s)
+	}
+	return searches, rows.Err()
+}
+
+// TrashedLeads lists individually deleted leads; leads inside a trashed
+// search come back with the search, so they aren't included.
+func (r *Repository) TrashedLeads() ([]TrashedLead, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT id, search_id, company_name, deleted_at FROM leads
+        WHERE deleted_at IS NOT NULL AND search_id IN (`+ownedSearchIDs+`)
+        ORDER BY deleted_at DESC`, r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leads := []TrashedLead{}
+	for rows.Next() {
+		var l TrashedLead
+		if err := rows.Scan(&l.ID, &l.SearchID, &l.CompanyName, &l.DeletedAt); err != nil {
+			log.Printf("Error scanning trashed lead: %v", err)
+			continue
+		}
+		leads = append(leads, l)
+	}
+	return leads, rows.Err()
+}
+
+func (r *Repository) TrashedCrmLeads() ([]TrashedLead, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT lead_id, company_name, deleted_at FROM crm_leads WHERE org_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	crmLeads := []TrashedLead{}
+	for rows.Next() {
+		var l TrashedLead
+		if err := rows.Scan(&l.ID, &l.CompanyName, &l.DeletedAt); err != nil {
+			log.Printf("Error scanning trashed CRM lead: %v", err)
+			continue
+		}
+		crmLeads = append(crmLeads, l)
+	}
+	return crmLeads, rows.Err()
+}
+
+// --- FULL-TEXT SEARCH ---
+
+func (r *Repository) FullTextSearch(q string, limit int) ([]FullTextResult, error) {
+	if fullTextEnabled {
+		return searchFullTextIndex(r.ctx, r.tenant.OrgID, q, limit)
+	}
+	return searchFullTextFallback(r.ctx, r.tenant.OrgID, q, limit)
+}
+
+// --- FORGETTING ---
+
+// inList returns "?, ?, ..." for values and the matching arguments.
+
+// ForgetLead wipes a business's phones, emails and social profiles from
+// the lead and from every lead and card in the organization that shares
+// one of them, along with their CRM notes, call notes, note history and
+// mentions in scraper logs. The phones and emails then go on the
+// suppression list. It returns store.ErrNotFound if the lead isn't the
+// tenant's; run it in a transaction.
+func (r *Repository) ForgetLead(leadID, reason string) (ForgetResult, error) {
+	var result ForgetResult
+	var exists bool
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT EXISTS(SELECT 1 FROM leads WHERE id = ?1 AND search_id IN (SELECT id FROM searches WHERE org_id = ?2))
+            OR EXISTS(SELECT 1 FROM crm_leads WHERE lead_id = ?1 AND org_id = ?2)
+    `, leadID, r.tenant.OrgID).Scan(&exists)
+	if err != nil {
+		return result, err
+	}
+	if !exists {
+		return result, store.ErrNotFound
+	}
+
+	// Copies of the business can share a phone with one lead and an email
+	// with another, so widen the net until it stops growing.
+	leadIDs := []string{leadID}
+	var phones, emails []string
+	for {
+		if phones, emails, err = r.leadContacts(leadIDs); err != nil {
+			return result, err
+		}
+		more, err := r.leadsWithContacts(phones, emails)
+		if err != nil {
+			return result, err
+		}
+		seen := map[string]bool{}
+		for _, id := range leadIDs {
+			seen[id] = true
+		}
+		grown := false
+		for _, id := range more {
+			if !seen[id] {
+				leadIDs, grown = append(leadIDs, id), true
+			}
+		}
+		if !grown {
+			break
+		}
+	}
+
+	ids, idArgs := store.InList(leadIDs)
+	orgArgs := append([]interface{}{r.tenant.OrgID}, idArgs...)
+	now := time.Now().UTC()
+	res, err := r.q.ExecContext(r.ctx, `
+        UPDATE leads SET phone = NULL, email = NULL, facebook_url = NULL, instagram_url = NULL, linkedin_url = NULL, forgotten_at = ?
+        WHERE search_id IN (SELECT id FROM searches WHERE org_id = ?) AND id IN (`+ids+`)
+    `, append([]interface{}{now}, orgArgs...)...)
+	if err != nil {
+		return result, err
+	}
+	n, _ := res.RowsAffected()
+	result.LeadsRedacted = int(n)
+	res, err = r.q.ExecContext(r.ctx, "UPDATE crm_leads SET phone = NULL, email = NULL, notes = '', updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND lead_id IN ("+ids+")", orgArgs...)
+	if err != nil {
+		return result, err
+	}
+	n, _ = res.RowsAffected()
+	result.CrmLeadsRedacted = int(n)
+
+	// Every ID here is the tenant's, so the per-lead tables need no
+	// further scoping.
+	for _, stmt := range []string{
+		"DELETE FROM lead_phones WHERE lead_id IN (" + ids + ")",
+		"DELETE FROM lead_emails WHERE lead_id IN (" + ids + ")",
+	} {
+		if _, err := r.q.ExecContext(r.ctx, stmt, idArgs...); err != nil {
+			return result, err
+		}
+	}
+	for _, stmt := range []string{
+		"DELETE FROM crm_note_revisions WHERE org_id = ? AND lead_id IN (" + ids + ")",
+		"UPDATE crm_calls SET notes = '' WHERE org_id = ? AND lead_id IN (" + ids + ")",
+		"UPDATE campaign_recipients SET email = '' WHERE campaign_id IN (SELECT id FROM campaigns WHERE org_id = ?) AND lead_id IN (" + ids + ")",
+		"UPDATE email_replies SET subject = '' WHERE org_id = ? AND lead_id IN (" + ids + ")",
+		"UPDATE bookings SET name = '', email = '', company = '', phone = '', notes = '' WHERE org_id = ? AND lead_id IN (" + ids + ")",
+		"UPDATE meetings SET attendees = '[]', notes = '' WHERE org_id = ? AND lead_id IN (" + ids + ")",
+		"UPDATE share_links SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE org_id = ? AND lead_id IN (" + ids + ")",
+	} {
+		if _, err := r.q.ExecContext(r.ctx, stmt, orgArgs...); err != nil {
+			return result, err
+		}
+	}
+	for _, value := range append(append([]string{}, phones...), emails...) {
+		_, err := r.q.ExecContext(r.ctx, "UPDATE search_logs SET output = REPLACE(output, ?, ?) WHERE search_id IN (SELECT id FROM searches WHERE org_id = ?) AND INSTR(output, ?) > 0",
+			value, REDACTED, r.tenant.OrgID, value)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.SuppressedPhones, result.SuppressedEmails, err = r.suppress(phones, emails, reason)
+	return result, err
+}
+
+// leadContacts returns every phone and email recorded for the leads, on
+// the leads themselves, their contact lists and their CRM cards.
+func (r *Repository) leadContacts(leadIDs []string) ([]string, []string, error) {
+	ids, idArgs := store.InList(leadIDs)
+	args := append([]interface{}{r.tenant.OrgID}, idArgs...)
+	args = append(args, r.tenant.OrgID)
+	args = append(args, idArgs...)
+	args = append(args, idArgs...)
+	args = append(args, idArgs...)
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT phone, email FROM leads WHERE search_id IN (SELECT id FROM searches WHERE org_id = ?) AND id IN (`+ids+`)
+        UNION SELECT phone, email FROM crm_leads WHERE org_id = ? AND lead_id IN (`+ids+`)
+        UNION SELECT phone, NULL FROM lead_phones WHERE lead_id IN (`+ids+`)
+        UNION SELECT NULL, email FROM lead_emails WHERE lead_id IN (`+ids+`)
+    `, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	phoneSet, emailSet := map[string]bool{}, map[string]bool{}
+	for rows.Next() {
+		var phone, email sql.NullString
+		if err := rows.Scan(&phone, &email); err != nil {
+			return nil, nil, err
+		}
+		if p := unseal(phone.String); strings.TrimSpace(p) != "" {
+			phoneSet[p] = true
+		}
+		if e := unseal(email.String); strings.TrimSpace(e) != "" {
+			emailSet[e] = true
+		}
+	}
+	phones, emails := []string{}, []string{}
+	for p := range phoneSet {
+		phones = append(phones, p)
+	}
+	for e := range emailSet {
+		emails = append(emails, e)
+	}
+	sort.Strings(phones)
+	sort.Strings(emails)
+	return phones, emails, rows.Err()
+}
+
+// leadsWithContacts returns the tenant's leads and cards that have any of
+// the phones or emails, matched the way duplicates are.
+func (r *Repository) leadsWithContacts(phones, emails []string) ([]string, error) {
+	phoneKeys, emailKeys := []string{}, []string{}
+	for _, p := range phones {
+		if k := normalizePhone(p); k != "" {
+			phoneKeys = append(phoneKeys, k)
+		}
+	}
+	for _, e := range emails {
+		emailKeys = append(emailKeys, strings.ToLower(strings.TrimSpace(e)))
+	}
+	if len(phoneKeys) == 0 && len(emailKeys) == 0 {
+		return nil, nil
+	}
+	ps, phoneArgs := store.InList(phoneKeys)
+	es, emailArgs := store.InList(emailKeys)
+	args := []interface{}{r.tenant.OrgID}
+	for _, group := range [][]interface{}{phoneArgs, emailArgs, phoneArgs, emailArgs, {r.tenant.OrgID}, phoneArgs, emailArgs} {
+		args = append(args, group...)
+	}
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT id FROM leads WHERE search_id IN (SELECT id FROM searches WHERE org_id = ?) AND (
+            normalize_phone(COALESCE(phone, '')) IN (`+ps+`) OR LOWER(unseal(COALESCE(email, ''))) IN (`+es+`)
+            OR id IN (SELECT lead_id FROM lead_phones WHERE normalize_phone(phone) IN (`+ps+`))
+            OR id IN (SELECT lead_id FROM lead_emails WHERE LOWER(unseal(email)) IN (`+es+`)))
+        UNION SELECT lead_id FROM crm_leads WHERE org_id = ? AND (
+            normalize_phone(COALESCE(phone, '')) IN (`+ps+`) OR LOWER(unseal(COALESCE(email, ''))) IN (`+es+`))
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// suppress puts phones and emails on the organization's suppression list,
+// returning how many of each were new to it.
+func (r *Repository) suppress(phones, emails []string, reason string) (int, int, error) {
+	newPhones, err := r.suppressValues(SUPPRESS_PHONE, phones, reason)
+	if err != nil {
+		return 0, 0, err
+	}
+	newEmails, err := r.suppressValues(SUPPRESS_EMAIL, emails, reason)
+	return newPhones, newEmails, err
+}
+
+func (r *Repository) suppressValues(kind string, values []string, reason string) (int, error) {
+	added := 0
+	for _, v := range values {
+		h := suppressionHash(kind, v)
+		if h == "" {
+			continue
+		}
+		// Entries nobody added by hand, like unsubscribes, have no creator.
+		var createdBy interface{}
+		if r.tenant.UserID != 0 {
+			createdBy = r.tenant.UserID
+		}
+		res, err := r.q.ExecContext(r.ctx, "INSERT OR IGNORE INTO suppressions (org_id, kind, value_hash, keyed, reason, created_by, created_at) VALUES (?, ?, ?, 1, ?, ?, ?)",
+			r.tenant.OrgID, kind, h, reason, createdBy, time.Now().UTC())
+		if err != nil {
+			return added, err
+		}
+		n, _ := res.RowsAffected()
+		added += int(n)
+	}
+	return added, nil
+}
+
+// AddSuppressions puts phones and emails on the suppression list by hand
+// and returns how many were new to it.
+func (r *Repository) AddSuppressions(phones, emails []string, reason string) (int, error) {
+	p, e, err := r.suppress(phones, emails, reason)
+	return p + e, err
+}
+
+// Suppressions lists the organization's suppression list, newest first.
+// Only hashes of the values are kept, so entries say what kind of contact
+// they are but not which.
+func (r *Repository) Suppressions() ([]Suppression, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT kind, reason, created_by, created_at FROM suppressions WHERE org_id = ? ORDER BY created_at DESC", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	suppressions := []Suppression{}
+	for rows.Next() {
+		var s Suppression
+		var createdBy sql.NullInt64
+		if err := rows.Scan(&s.Kind, &s.Reason, &createdBy, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		if createdBy.Valid {
+			s.CreatedBy = &createdBy.Int64
+		}
+		suppressions = append(suppressions, s)
+	}
+	return suppressions, rows.Err()
+}
+
+// --- DELTA SYNC ---
+
+// SyncChanges returns up to limit entities that changed after the since
+// cursor, as they are now, with tombstones for the ones that are gone.
+func (r *Repository) SyncChanges(since int64, limit int) (SyncPage, error) {
+	page := SyncPage{Cursor: since, Leads: []leads.Lead{}, CrmLeads: []CrmLead{}, Columns: []crm.Column{}, Calls: []Call{}, Tombstones: []SyncTombstone{}}
+	rows, err := r.q.QueryContext(r.ctx, "SELECT seq, entity, entity_id FROM sync_changes WHERE org_id = ? AND seq > ? ORDER BY seq LIMIT ?", r.tenant.OrgID, since, limit+1)
+	if err != nil {
+		return page, err
+	}
+	var changed []SyncTombstone
+	ids := map[string][]string{}
+	for rows.Next() {
+		var seq int64
+		var t SyncTombstone
+		if err := rows.Scan(&seq, &t.Type, &t.ID); err != nil {
+			rows.Close()
+			return page, err
+		}
+		if len(changed) == limit {
+			page.HasMore = true
+			break
+		}
+		page.Cursor = seq
+		changed = append(changed, t)
+		ids[t.Type] = append(ids[t.Type], t.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	found := map[SyncTombstone]bool{}
+	if len(ids[SYNC_LEAD]) > 0 {
+		in, args := store.InList(ids[SYNC_LEAD])
+		rows, err := r.q.QueryContext(r.ctx, "SELECT "+leads.SELECT_COLUMNS+" FROM leads WHERE deleted_at IS NULL AND search_id IN ("+ownedSearchIDs+") AND id IN ("+in+")",
+			append([]interface{}{r.tenant.OrgID}, args...)...)
+		if err != nil {
+			return page, err
+		}
+		for rows.Next() {
+			l, err := leads.Scan(rows, fieldCodec{})
+			if err != nil {
+				rows.Close()
+				return page, err
+			}
+			page.Leads = append(page.Leads, l)
+			found[SyncTombstone{SYNC_LEAD, l.ID}] = true
+		}
+		rows.Close()
+		if err := r.Leads().AttachContacts(page.Leads); err != nil {
+			return page, err
+		}
+	}
+	if len(ids[SYNC_CRM_LEAD]) > 0 {
+		in, args := store.InList(ids[SYNC_CRM_LEAD])
+		crmLeads, err := r.Crm().Cards(" AND lead_id IN ("+in+")", args...)
+		if err != nil {
+			return page, err
+		}
+		for _, cl := range crmLeads {
+			page.CrmLeads = append(page.CrmLeads, cl)
+			found[SyncTombstone{SYNC_CRM_LEAD, cl.ID}] = true
+		}
+	}
+	if len(ids[SYNC_COLUMN]) > 0 {
+		columns, err := r.Crm().Columns()
+		if err != nil {
+			return page, err
+		}
+		wanted := map[string]bool{}
+		for _, id := range ids[SYNC_COLUMN] {
+			wanted[id] = true
+		}
+		for _, col := range columns {
+			if wanted[col.ID] {
+				page.Columns = append(page.Columns, col)
+				found[SyncTombstone{SYNC_COLUMN, col.ID}] = true
+			}
+		}
+	}
+	if len(ids[SYNC_CALL]) > 0 {
+		in, args := store.InList(ids[SYNC_CALL])
+		rows, err := r.q.QueryContext(r.ctx, "SELECT id, lead_id, user_id, disposition, notes, duration_seconds, session_id, called_at FROM crm_calls WHERE org_id = ? AND id IN ("+in+")",
+			append([]interface{}{r.tenant.OrgID}, args...)...)
+		if err != nil {
+			return page, err
+		}
+		for rows.Next() {
+			var call Call
+			if err := rows.Scan(&call.ID, &call.LeadID, &call.UserID, &call.Disposition, &call.Notes, &call.DurationSeconds, &call.SessionID, &call.CalledAt); err != nil {
+				rows.Close()
+				return page, err
+			}
+			call.Notes = unseal(call.Notes)
+			page.Calls = append(page.Calls, call)
+			found[SyncTombstone{SYNC_CALL, strconv.FormatInt(call.ID, 10)}] = true
+		}
+		rows.Close()
+	}
+
+	for _, t := range changed {
+		if !found[t] {
+			page.Tombstones = append(page.Tombstones, t)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,1844 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/scraper"
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+)
+
+// setupTestDB points the package at a fresh database for one test.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	prevFile, prevDB := DB_FILE, db
+	DB_FILE = filepath.Join(t.TempDir(), "test.db")
+	t.Setenv("SUPPRESSION_KEY", "test-suppression-key-of-32-bytes")
+	initDB()
+	t.Cleanup(func() {
+		searchWork.Wait()
+		db.Close()
+		DB_FILE, db = prevFile, prevDB
+	})
+}
+
+func createTestTenant(t *testing.T, email string) *Repository {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	orgID, err := createOrganization(tx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tx.Exec("INSERT INTO users (name, email, password_hash, org_id) VALUES (?, ?, '', ?)", email, email, orgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := res.LastInsertId()
+	return newRepository(Tenant{OrgID: orgID, UserID: userID})
+}
+
+// createTestLead gives repo a search with a single lead and returns both IDs.
+func createTestLead(t *testing.T, repo *Repository) (searchID, leadID string) {
+	t.Helper()
+	searchID, leadID = uuid.New().String(), uuid.New().String()
+	err := repo.Searches().Insert(searches.Search{ID: searchID, Keyword: "plumbers", Source: DEFAULT_SOURCE, Status: "Completed", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO leads (id, search_id, company_name) VALUES (?, ?, 'Acme Plumbing')", leadID, searchID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO lead_emails (lead_id, email) VALUES (?, 'owner@acme.test')", leadID); err != nil {
+		t.Fatal(err)
+	}
+	return searchID, leadID
+}
+
+// TestTenantsAreIsolated checks, area by area, that one organization can
+// neither see nor change another's data. Each case gets a fresh database
+// with alice, who owns the data, and mallory, who goes looking for it.
+func TestTenantsAreIsolated(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(t *testing.T, alice, mallory *Repository)
+	}{
+		{"searches and leads", func(t *testing.T, alice, mallory *Repository) {
+			searchID, leadID := createTestLead(t, alice)
+			if !alice.Searches().Owns(searchID) {
+				t.Fatal("owner should own their search")
+			}
+			if mallory.Searches().Owns(searchID) {
+				t.Error("another tenant owns the search")
+			}
+			q, _ := searches.ParseListQuery(url.Values{})
+			if list, total, err := mallory.Searches().List(q); err != nil || total != 0 || len(list) != 0 {
+				t.Errorf("another tenant listed %d searches (total %d, err %v)", len(list), total, err)
+			}
+			lq, err := buildLeadQuery(mallory, searchID, url.Values{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if leads, err := mallory.Leads().List(lq); err != nil || len(leads) != 0 {
+				t.Errorf("another tenant read %d leads (err %v)", len(leads), err)
+			}
+			if err := mallory.Leads().Trash(searchID, leadID); err != store.ErrNotFound {
+				t.Errorf("Leads().Trash across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if err := mallory.Searches().Trash(searchID); err != store.ErrNotFound {
+				t.Errorf("TrashSearch across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if !alice.Searches().Owns(searchID) {
+				t.Error("search was deleted by another tenant")
+			}
+		}},
+		{"search labels", func(t *testing.T, alice, mallory *Repository) {
+			searchID, _ := createTestLead(t, alice)
+			title := "Manchester trades"
+			if err := alice.Searches().Update(searchID, searches.Update{Title: &title, Labels: []string{"q1"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := mallory.Searches().SetLabelColor("q1", "#000000"); err != nil {
+				t.Fatal(err)
+			}
+			stolen := "Stolen"
+			if err := mallory.Searches().Update(searchID, searches.Update{Title: &stolen, Labels: []string{}}); err != store.ErrNotFound {
+				t.Errorf("UpdateSearch across tenants: got %v, want store.ErrNotFound", err)
+			}
+			search, err := alice.Searches().Get(searchID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if search.Title != title || len(search.Labels) != 1 || search.Labels[0].Color == "#000000" {
+				t.Errorf("search after another tenant's changes: %+v", search)
+			}
+			if labels, err := mallory.Searches().Labels(); err != nil || len(labels) != 0 {
+				t.Errorf("another tenant saw labels %+v (err %v)", labels, err)
+			}
+			q, _ := searches.ParseListQuery(url.Values{"label": {"q1"}})
+			if list, total, err := mallory.Searches().List(q); err != nil || total != 0 {
+				t.Errorf("another tenant listed %d labelled searches (err %v)", len(list), err)
+			}
+		}},
+		{"trash", func(t *testing.T, alice, mallory *Repository) {
+			searchID, _ := createTestLead(t, alice)
+			if err := alice.Searches().Trash(searchID); err != nil {
+				t.Fatal(err)
+			}
+			if trashed, err := mallory.TrashedSearches(); err != nil || len(trashed) != 0 {
+				t.Errorf("another tenant sees %d trashed searches (err %v)", len(trashed), err)
+			}
+			if err := mallory.Searches().Restore(searchID); err != store.ErrNotFound {
+				t.Errorf("RestoreSearch across tenants: got %v, want store.ErrNotFound", err)
+			}
+		}},
+		{"full-text search", func(t *testing.T, alice, mallory *Repository) {
+			createTestLead(t, alice)
+			if results, err := alice.FullTextSearch("acme", 10); err != nil || len(results) != 1 {
+				t.Fatalf("owner found %d results (err %v), want 1", len(results), err)
+			}
+			if results, err := mallory.FullTextSearch("acme", 10); err != nil || len(results) != 0 {
+				t.Errorf("another tenant found %d results (err %v)", len(results), err)
+			}
+		}},
+		{"lead lists", func(t *testing.T, alice, mallory *Repository) {
+			searchID, _ := createTestLead(t, alice)
+			list := LeadList{ID: uuid.New().String(), Name: "Q1", SearchIDs: []string{searchID}}
+			if err := alice.CreateLeadList(list); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := mallory.LeadList(list.ID); err != store.ErrNotFound {
+				t.Errorf("LeadList across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if lists, err := mallory.LeadLists(); err != nil || len(lists) != 0 {
+				t.Errorf("another tenant saw %d lists (err %v)", len(lists), err)
+			}
+			stolen := LeadList{ID: uuid.New().String(), Name: "Stolen", SearchIDs: []string{searchID}}
+			if err := mallory.CreateLeadList(stolen); err != store.ErrNotFound {
+				t.Errorf("CreateLeadList with another tenant's search: got %v, want store.ErrNotFound", err)
+			}
+			if added, err := mallory.ImportLeadList(list, searchImportFilter{}); err != nil || len(added) != 0 {
+				t.Errorf("another tenant imported %v (err %v)", added, err)
+			}
+		}},
+		{"duplicate clusters", func(t *testing.T, alice, mallory *Repository) {
+			_, first := createTestLead(t, alice)
+			_, second := createTestLead(t, alice)
+			_, stranger := createTestLead(t, mallory)
+			for _, id := range []string{first, second, stranger} {
+				if _, err := db.Exec("UPDATE leads SET phone = '01632 960001' WHERE id = ?", id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if clusters, err := alice.DuplicateClusters(false); err != nil || len(clusters) != 1 || len(clusters[0].Leads) != 2 {
+				t.Errorf("clusters: got %+v (err %v), want one of alice's two leads", clusters, err)
+			}
+			if clusters, err := mallory.DuplicateClusters(false); err != nil || len(clusters) != 0 {
+				t.Errorf("another tenant's leads joined a cluster: %+v (err %v)", clusters, err)
+			}
+			if err := mallory.Leads().Merge(stranger, []string{first}); err != store.ErrNotFound {
+				t.Errorf("Leads().Merge across tenants: got %v, want store.ErrNotFound", err)
+			}
+		}},
+		{"territories", func(t *testing.T, alice, mallory *Repository) {
+			territory := Territory{ID: uuid.New().String(), Name: "North", Polygon: polygon{{0, 0}, {1, 0}, {1, 1}}}
+			if err := alice.CreateTerritory(territory); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := mallory.Territory(territory.ID); err != store.ErrNotFound {
+				t.Errorf("Territory across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if list, err := mallory.Territories(); err != nil || len(list) != 0 {
+				t.Errorf("another tenant listed %d territories (err %v)", len(list), err)
+			}
+			input := territoryInput{Name: "Stolen", Polygon: territory.Polygon}
+			if err := mallory.UpdateTerritory(territory.ID, input); err != store.ErrNotFound {
+				t.Errorf("UpdateTerritory across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if err := mallory.DeleteTerritory(territory.ID); err != store.ErrNotFound {
+				t.Errorf("DeleteTerritory across tenants: got %v, want store.ErrNotFound", err)
+			}
+			// A territory filter naming another tenant's territory must not resolve.
+			searchID, _ := createTestLead(t, mallory)
+			if _, err := buildLeadQuery(mallory, searchID, url.Values{"territory": {territory.ID}}); err == nil {
+				t.Error("lead query accepted another tenant's territory")
+			}
+		}},
+		{"crm board", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			// Adding somebody else's lead would expose its contact details.
+			if _, err := mallory.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != store.ErrNotFound {
+				t.Fatalf("AddCrmLeads with another tenant's lead: got %v, want store.ErrNotFound", err)
+			}
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+				t.Fatal(err)
+			}
+			if board, err := mallory.CrmLeads(); err != nil || len(board) != 0 {
+				t.Errorf("another tenant saw %d CRM leads (err %v)", len(board), err)
+			}
+			if mallory.Crm().HasCard(leadID) {
+				t.Error("another tenant has the CRM lead")
+			}
+			email := "owner@acme.test"
+			for name, err := range map[string]error{
+				"MoveCrmLead":   mallory.MoveCrmLead(leadID, "contacted"),
+				"UpdateCrmLead": mallory.UpdateCrmLead(leadID, CrmLead{Notes: "mine now"}),
+				"SetContact":    mallory.Crm().SetContact(leadID, &email, nil),
+				"AddCrmTag":     mallory.AddCrmTag(leadID, "stolen", nil),
+				"Trash":         mallory.Crm().Trash(leadID),
+			} {
+				if err != store.ErrNotFound {
+					t.Errorf("%s across tenants: got %v, want store.ErrNotFound", name, err)
+				}
+			}
+			if _, err := mallory.Crm().CreateColumn("Cold"); err != nil {
+				t.Fatal(err)
+			}
+			if alice.Crm().HasColumn("cold") {
+				t.Error("another tenant's column is visible")
+			}
+			board, err := alice.CrmLeads()
+			if err != nil || len(board) != 1 {
+				t.Fatalf("owner's board has %d leads (err %v)", len(board), err)
+			}
+			if board[0].ColumnID != "tobe-called" || board[0].Notes != "" || len(board[0].Tags) != 0 {
+				t.Errorf("owner's CRM lead was modified by another tenant: %+v", board[0])
+			}
+		}},
+		{"crm board versions", func(t *testing.T, alice, mallory *Repository) {
+			if _, err := alice.Crm().BumpVersion(); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := mallory.Crm().Version(); err != nil || v != 0 {
+				t.Errorf("another tenant's board version is %d (err %v), want 0", v, err)
+			}
+		}},
+		{"crm statuses", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+				t.Fatal(err)
+			}
+			hot, err := alice.Crm().CreateStatus("Hot prospect", "#f97316")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := alice.SetCrmLeadStatus(leadID, hot.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := mallory.SetCrmLeadStatus(leadID, "bad-fit"); err != store.ErrNotFound {
+				t.Errorf("SetCrmLeadStatus across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if mallory.Crm().HasStatus(hot.ID) {
+				t.Error("another tenant sees the new status")
+			}
+			if err := mallory.Crm().DeleteStatus(hot.ID); err != store.ErrNotFound {
+				t.Errorf("DeleteCrmStatus across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if statuses, err := mallory.Crm().Statuses(); err != nil || len(statuses) != len(crm.DefaultStatuses) {
+				t.Errorf("another tenant's statuses %+v (err %v)", statuses, err)
+			}
+			if card, err := alice.Crm().Card(leadID); err != nil || card.StatusID != hot.ID {
+				t.Errorf("card status %q (err %v), want %q", card.StatusID, err, hot.ID)
+			}
+		}},
+		{"board history", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := alice.MoveCrmLead(leadID, "contacted"); err != nil {
+				t.Fatal(err)
+			}
+			snapshotBoards()
+			today := time.Now().UTC().Format("2006-01-02")
+			if snapshots, err := alice.BoardSnapshots(today, today); err != nil || snapshots[today]["contacted"] != 1 {
+				t.Errorf("owner's snapshot: got %v (err %v)", snapshots, err)
+			}
+			if snapshots, err := mallory.BoardSnapshots(today, today); err != nil || snapshots[today]["contacted"] != 0 {
+				t.Errorf("another tenant's snapshot counted the card: %v (err %v)", snapshots, err)
+			}
+			if moves, err := mallory.ColumnMoves(today, today); err != nil || len(moves) != 0 {
+				t.Errorf("another tenant saw %d moves (err %v)", len(moves), err)
+			}
+			if moves, err := alice.ColumnMoves(today, today); err != nil || len(moves) != 1 {
+				t.Errorf("owner saw %d moves (err %v)", len(moves), err)
+			}
+		}},
+		{"calls", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := mallory.RecordCall(leadID, "interested", "", 0, "contacted"); err != store.ErrNotFound {
+				t.Fatalf("RecordCall across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if _, err := mallory.LeadCalls(leadID); err != store.ErrNotFound {
+				t.Errorf("LeadCalls across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if err := mallory.SetDispositionRules(map[string]string{"voicemail": "contacted"}); err != nil {
+				t.Fatal(err)
+			}
+			if rules, err := alice.DispositionRules(); err != nil || rules["voicemail"] != "" {
+				t.Errorf("another tenant's rules leaked: %v (err %v)", rules, err)
+			}
+			if _, _, err := alice.RecordCall(leadID, "voicemail", "left a message", 0, ""); err != nil {
+				t.Fatal(err)
+			}
+			if counts, err := mallory.DispositionCounts(nil, nil); err != nil || counts["voicemail"] != 0 {
+				t.Errorf("another tenant counted calls: %v (err %v)", counts, err)
+			}
+		}},
+		{"dialer claims", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Phone: "01467 268847"}}); err != nil {
+				t.Fatal(err)
+			}
+			if candidates, err := mallory.DialerCandidates([]string{"tobe-called"}); err != nil || len(candidates) != 0 {
+				t.Errorf("another tenant's dialer saw %d leads (err %v)", len(candidates), err)
+			}
+			until := time.Now().Add(DIALER_CLAIM_TTL).UTC()
+			if claimed, err := mallory.Crm().Claim(leadID, until); err != nil || claimed {
+				t.Errorf("another tenant claimed the lead (err %v)", err)
+			}
+			if claimed, err := alice.Crm().Claim(leadID, until); err != nil || !claimed {
+				t.Errorf("owner couldn't claim the lead (err %v)", err)
+			}
+		}},
+		{"dialer sessions", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, started, err := alice.StartDialerSession(); err != nil || !started {
+				t.Fatalf("couldn't start a session (err %v)", err)
+			}
+			if _, started, err := mallory.StartDialerSession(); err != nil || !started {
+				t.Fatalf("another tenant's open session blocked a new one (err %v)", err)
+			}
+			if _, _, err := alice.RecordCall(leadID, "interested", "", 60, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := mallory.StopDialerSession(); err != nil {
+				t.Fatal(err)
+			}
+			if sessions, err := mallory.DialerSessions(50); err != nil || len(sessions) != 1 || sessions[0].Dials != 0 {
+				t.Errorf("another tenant's session counted the call: %+v (err %v)", sessions, err)
+			}
+			if sessions, err := mallory.OrgDialerSessions(nil, nil); err != nil || len(sessions) != 1 {
+				t.Errorf("another tenant's analytics saw %d sessions (err %v)", len(sessions), err)
+			}
+		}},
+		{"performance", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := alice.RecordCall(leadID, "interested", "", 0, ""); err != nil {
+				t.Fatal(err)
+			}
+			from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+			if stats, err := mallory.Performance(from, to); err != nil || len(stats) != 0 {
+				t.Errorf("another tenant saw stats for %d reps (err %v)", len(stats), err)
+			}
+		}},
+		{"teams", func(t *testing.T, alice, mallory *Repository) {
+			if err := mallory.SetLeaderboardEnabled(false); err != nil {
+				t.Fatal(err)
+			}
+			team, err := alice.Team()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !team.LeaderboardEnabled {
+				t.Error("another tenant turned off the leaderboard")
+			}
+			if len(team.Members) != 1 || team.Members[0].ID != alice.Tenant().UserID {
+				t.Errorf("members: got %+v, want just alice", team.Members)
+			}
+		}},
+		{"automation rules", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := mallory.Crm().CreateColumn("Cold"); err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			rule := AutomationRule{
+				ID:         "cold-rule",
+				Name:       "Everything goes cold",
+				Enabled:    true,
+				Conditions: []RuleCondition{{Field: "timesCalled", Op: ">=", Value: 0.0}},
+				Action:     RuleAction{Type: "move", Column: "cold"},
+				CreatedAt:  now,
+				UpdatedAt:  now,
+			}
+			if err := mallory.CreateAutomationRule(rule); err != nil {
+				t.Fatal(err)
+			}
+			if applied, err := applyAutomationRules(context.Background(), mallory.Tenant().OrgID); err != nil || applied != 0 {
+				t.Errorf("another tenant's rule took %d actions (err %v)", applied, err)
+			}
+			if _, err := alice.AutomationRule(rule.ID); err != store.ErrNotFound {
+				t.Errorf("AutomationRule across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if err := alice.DeleteAutomationRule(rule.ID); err != store.ErrNotFound {
+				t.Errorf("DeleteAutomationRule across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if card, err := alice.Crm().Card(leadID); err != nil || card.ColumnID != "tobe-called" {
+				t.Errorf("another tenant's rule moved the card to %q (err %v)", card.ColumnID, err)
+			}
+			rule.ID = "tag-rule"
+			rule.Action = RuleAction{Type: "tag", Tag: "fresh"}
+			if err := alice.CreateAutomationRule(rule); err != nil {
+				t.Fatal(err)
+			}
+			if applied, err := applyAutomationRules(context.Background(), alice.Tenant().OrgID); err != nil || applied != 1 {
+				t.Fatalf("owner's rule took %d actions (err %v), want 1", applied, err)
+			}
+			if runs, err := mallory.RuleRuns("", 10); err != nil || len(runs) != 0 {
+				t.Errorf("another tenant sees rule runs: %v (err %v)", runs, err)
+			}
+		}},
+		{"forgetting a lead", func(t *testing.T, alice, mallory *Repository) {
+			_, leadID := createTestLead(t, alice)
+			_, theirs := createTestLead(t, mallory)
+			for _, id := range []string{leadID, theirs} {
+				if _, err := db.Exec("UPDATE leads SET phone = '01632 960001' WHERE id = ?", id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := mallory.ForgetLead(leadID, ""); err != store.ErrNotFound {
+				t.Fatalf("ForgetLead across tenants: got %v, want store.ErrNotFound", err)
+			}
+			if _, err := alice.ForgetLead(leadID, "asked by phone"); err != nil {
+				t.Fatal(err)
+			}
+			var phone sql.NullString
+			if err := db.QueryRow("SELECT phone FROM leads WHERE id = ?", theirs).Scan(&phone); err != nil || !phone.Valid {
+				t.Errorf("another tenant's copy of the lead lost its phone (err %v)", err)
+			}
+			if list, err := mallory.Suppressions(); err != nil || len(list) != 0 {
+				t.Errorf("another tenant has %d suppressions (err %v)", len(list), err)
+			}
+		}},
+		{"sync changes", func(t *testing.T, alice, mallory *Repository) {
+			searchID, leadID := createTestLead(t, alice)
+			page, err := alice.SyncChanges(0, SYNC_MAX_LIMIT)
+			if err != nil {
+				t.Fatal(err)
+			}
+			theirs, err := mallory.SyncChanges(0, SYNC_MAX_LIMIT)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range theirs.Leads {
+				if l.ID == leadID {
+					t.Fatal("another organization's lead was synced")
+				}
+			}
+			if theirs.Cursor >= page.Cursor {
+				t.Errorf("cursor %d covers only their own changes, expected below %d", theirs.Cursor, page.Cursor)
+			}
+			if err := mallory.Leads().Trash(searchID, leadID); err != store.ErrNotFound {
+				t.Errorf("trashing another organization's lead: %v", err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			alice := createTestTenant(t, "alice@example.com")
+			mallory := createTestTenant(t, "mallory@example.com")
+			tt.check(t, alice, mallory)
+		})
+	}
+}
+
+func TestCallsAreCountedOnTheCard(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, columnID, err := alice.RecordCall(leadID, "voicemail", "left a message", 0, ""); err != nil || columnID != "tobe-called" {
+		t.Fatalf("RecordCall moved lead to %q (err %v)", columnID, err)
+	}
+	if counts, err := alice.DispositionCounts(nil, nil); err != nil || counts["voicemail"] != 1 {
+		t.Errorf("owner's counts: %v (err %v)", counts, err)
+	}
+	board, err := alice.CrmLeads()
+	if err != nil || len(board) != 1 || board[0].TimesCalled != 1 || board[0].LastDisposition != "voicemail" {
+		t.Errorf("owner's CRM lead after one call: %+v (err %v)", board, err)
+	}
+}
+
+func TestDialerClaimsHoldUntilReleased(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Phone: "01467 268847"}}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO users (name, email, password_hash, org_id) VALUES ('bob', 'bob@example.com', '', ?)", alice.Tenant().OrgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID, _ := res.LastInsertId()
+	bob := newRepository(Tenant{OrgID: alice.Tenant().OrgID, UserID: bobID})
+
+	until := time.Now().Add(DIALER_CLAIM_TTL).UTC()
+	if claimed, err := alice.Crm().Claim(leadID, until); err != nil || !claimed {
+		t.Fatalf("owner couldn't claim the lead (err %v)", err)
+	}
+	if candidates, err := bob.DialerCandidates([]string{"tobe-called"}); err != nil || len(candidates) != 0 {
+		t.Errorf("teammate's dialer offered a claimed lead: %d (err %v)", len(candidates), err)
+	}
+	if claimed, err := bob.Crm().Claim(leadID, until); err != nil || claimed {
+		t.Errorf("teammate took over a live claim (err %v)", err)
+	}
+	if holder, err := bob.Crm().ClaimHolder(leadID); err != nil || holder != alice.Tenant().UserID {
+		t.Errorf("claim holder: got %d, want %d (err %v)", holder, alice.Tenant().UserID, err)
+	}
+
+	if err := alice.Crm().ReleaseClaims(); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := bob.Crm().Claim(leadID, until); err != nil || !claimed {
+		t.Errorf("teammate couldn't claim a released lead (err %v)", err)
+	}
+}
+
+func TestDialerSessionsCountTheirCalls(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, started, err := alice.StartDialerSession(); err != nil || !started {
+		t.Fatalf("couldn't start a session (err %v)", err)
+	}
+	if _, _, err := alice.RecordCall(leadID, "interested", "", 60, ""); err != nil {
+		t.Fatal(err)
+	}
+	session, err := alice.StopDialerSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Dials != 1 || session.Connects != 1 || session.TalkSeconds != 60 {
+		t.Errorf("session stats: got %+v", session.DialerStats)
+	}
+	if _, err := alice.StopDialerSession(); err != store.ErrNotFound {
+		t.Errorf("stopping twice: got %v, want store.ErrNotFound", err)
+	}
+}
+
+func TestPerformanceCountsEachRepsWork(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := alice.RecordCall(leadID, "interested", "", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	won := true
+	if err := alice.Crm().UpdateColumn("contacted", crm.ColumnUpdate{Won: &won}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.MoveCrmLead(leadID, "contacted"); err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	stats, err := alice.Performance(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := stats[alice.Tenant().UserID]
+	if got == nil || got.Searches != 1 || got.LeadsAdded != 1 || got.Dials != 1 || got.Contacts != 1 || got.DealsWon != 1 {
+		t.Errorf("owner's stats: got %+v", got)
+	}
+}
+
+func TestAutomationTagRulesApplyOnce(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	rule := AutomationRule{
+		ID:         "tag-rule",
+		Name:       "Tag everything fresh",
+		Enabled:    true,
+		Conditions: []RuleCondition{{Field: "timesCalled", Op: ">=", Value: 0.0}},
+		Action:     RuleAction{Type: "tag", Tag: "fresh"},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := alice.CreateAutomationRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	for pass, want := range []int{1, 0} {
+		if applied, err := applyAutomationRules(context.Background(), alice.Tenant().OrgID); err != nil || applied != want {
+			t.Errorf("pass %d took %d actions (err %v), want %d", pass+1, applied, err, want)
+		}
+	}
+	board, err := alice.CrmLeads()
+	if err != nil || len(board) != 1 || len(board[0].Tags) != 1 || board[0].Tags[0] != "fresh" {
+		t.Errorf("owner's board after rules: %+v (err %v)", board, err)
+	}
+}
+
+func TestIgnoredDuplicateClustersAreHidden(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, first := createTestLead(t, alice)
+	_, second := createTestLead(t, alice)
+	for _, id := range []string{first, second} {
+		if _, err := db.Exec("UPDATE leads SET phone = '01632 960001' WHERE id = ?", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clusters, err := alice.DuplicateClusters(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || len(clusters[0].Leads) != 2 {
+		t.Fatalf("clusters: got %+v, want one of alice's two leads", clusters)
+	}
+	if err := alice.IgnoreDuplicateCluster(clusters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if clusters, err := alice.DuplicateClusters(false); err != nil || len(clusters) != 0 {
+		t.Errorf("ignored cluster still listed: %+v (err %v)", clusters, err)
+	}
+}
+
+func TestSearchesFilterByLabel(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	labelled, _ := createTestLead(t, alice)
+	createTestLead(t, alice)
+	title := "Manchester trades"
+	if err := alice.Searches().Update(labelled, searches.Update{Title: &title, Labels: []string{"q1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := searches.ParseListQuery(url.Values{"label": {"q1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, total, err := alice.Searches().List(q)
+	if err != nil || total != 1 || len(list) != 1 || list[0].ID != labelled {
+		t.Errorf("label filter: got %d searches %+v (err %v), want just %s", total, list, err, labelled)
+	}
+}
+
+func TestForgetLeadRedactsEveryCopy(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	_, copyID := createTestLead(t, alice)
+	for _, id := range []string{leadID, copyID} {
+		if _, err := db.Exec("UPDATE leads SET phone = '01632 960001' WHERE id = ?", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, Phone: "01632 960001"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.UpdateCrmLead(leadID, CrmLead{Notes: "Spoke to Jane, the owner"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := alice.ForgetLead(leadID, "asked by phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LeadsRedacted != 2 || result.CrmLeadsRedacted != 1 || result.SuppressedPhones != 1 || result.SuppressedEmails != 1 {
+		t.Errorf("ForgetLead = %+v", result)
+	}
+	for _, id := range []string{leadID, copyID} {
+		var phone sql.NullString
+		if err := db.QueryRow("SELECT phone FROM leads WHERE id = ?", id).Scan(&phone); err != nil {
+			t.Fatal(err)
+		}
+		if phone.Valid {
+			t.Errorf("lead %s kept its phone %q", id, phone.String)
+		}
+	}
+	board, err := alice.CrmLeads()
+	if err != nil || len(board) != 1 || board[0].Notes != "" {
+		t.Errorf("CRM card not redacted: %+v (err %v)", board, err)
+	}
+
+	scraped := []scraper.Lead{{Phone: "+44 1632 960001"}, {Phone: "01632 960002"}}
+	set, err := loadSuppressions(db, alice.Tenant().OrgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.suppressesLead(scraped[0]) || set.suppressesLead(scraped[1]) {
+		t.Error("suppression list doesn't match the forgotten phone")
+	}
+}
+
+func TestSyncChangesSendOnlyWhatChanged(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	searchID, leadID := createTestLead(t, alice)
+
+	page, err := alice.SyncChanges(0, SYNC_MAX_LIMIT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Leads) != 1 || page.Leads[0].ID != leadID || len(page.Leads[0].Emails) != 1 {
+		t.Fatalf("expected the lead with its email, got %+v", page.Leads)
+	}
+	if len(page.Columns) == 0 {
+		t.Fatal("expected the board's columns")
+	}
+
+	// Nothing changed, nothing to send.
+	again, err := alice.SyncChanges(page.Cursor, SYNC_MAX_LIMIT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Leads)+len(again.Tombstones) != 0 || again.Cursor != page.Cursor {
+		t.Fatalf("expected no changes, got %+v", again)
+	}
+
+	if err := alice.Leads().Trash(searchID, leadID); err != nil {
+		t.Fatal(err)
+	}
+	after, err := alice.SyncChanges(page.Cursor, SYNC_MAX_LIMIT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Leads) != 0 || len(after.Tombstones) != 1 || after.Tombstones[0] != (SyncTombstone{SYNC_LEAD, leadID}) {
+		t.Fatalf("expected a tombstone for the trashed lead, got %+v", after)
+	}
+}
+
+func TestDeletingAStatusClearsItFromCards(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	lead, err := alice.Leads().Get(leadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.AddCrmLeads([]leads.Lead{lead}); err != nil {
+		t.Fatal(err)
+	}
+	hot, err := alice.Crm().CreateStatus("Hot prospect", "#f97316")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetCrmLeadStatus(leadID, hot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if card, err := alice.Crm().Card(leadID); err != nil || card.StatusID != hot.ID {
+		t.Fatalf("card status %q (err %v), want %q", card.StatusID, err, hot.ID)
+	}
+
+	if err := alice.Crm().DeleteStatus(hot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if card, _ := alice.Crm().Card(leadID); card.StatusID != "" {
+		t.Errorf("card kept deleted status %q", card.StatusID)
+	}
+}
+
+func TestUndoHistoryIsPerUser(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	mallory := createTestTenant(t, "mallory@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.MoveCrmLead(leadID, "contacted"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mallory.UndoCrmMove(); err != store.ErrNotFound {
+		t.Errorf("another tenant undid a move: got %v, want store.ErrNotFound", err)
+	}
+	move, err := alice.UndoCrmMove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if move.LeadID != leadID || move.ColumnID != "tobe-called" {
+		t.Errorf("undo: got %+v", move)
+	}
+	if lead, err := alice.Crm().Card(leadID); err != nil || lead.ColumnID != "tobe-called" {
+		t.Errorf("card not moved back: %q (err %v)", lead.ColumnID, err)
+	}
+	if _, err := alice.UndoCrmMove(); err != store.ErrNotFound {
+		t.Errorf("undoing twice: got %v, want store.ErrNotFound", err)
+	}
+}
+
+func TestCrmDuplicatesAreMatchedWithinTenant(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	mallory := createTestTenant(t, "mallory@example.com")
+	_, aliceFirst := createTestLead(t, alice)
+	_, aliceSecond := createTestLead(t, alice)
+	_, aliceThird := createTestLead(t, alice)
+	_, malloryLead := createTestLead(t, mallory)
+
+	if _, err := mallory.AddCrmLeads([]leads.Lead{{ID: malloryLead, Phone: "020 7946 0000"}}); err != nil {
+		t.Fatal(err)
+	}
+	dups, err := alice.AddCrmLeads([]leads.Lead{
+		{ID: aliceFirst, Phone: "+44 20 7946 0000", Website: "https://www.acme.co.uk/contact"},
+		{ID: aliceSecond, Phone: "01632 960000", Website: "http://acme.co.uk"},
+		{ID: aliceThird, Phone: "(020) 7946-0000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CrmDuplicate{
+		{LeadID: aliceSecond, DuplicateOf: aliceFirst, MatchedOn: "domain"},
+		{LeadID: aliceThird, DuplicateOf: aliceFirst, MatchedOn: "phone"},
+	}
+	if len(dups) != len(want) || dups[0] != want[0] || dups[1] != want[1] {
+		t.Errorf("duplicates = %+v, want %+v", dups, want)
+	}
+	if board, err := alice.CrmLeads(); err != nil || len(board) != 1 || board[0].ID != aliceFirst {
+		t.Errorf("owner's board after dedupe: %+v (err %v)", board, err)
+	}
+}
+
+func TestImportSearchSkipsDuplicatesWithinTenant(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	mallory := createTestTenant(t, "mallory@example.com")
+	searchID, first := createTestLead(t, alice)
+	_, onBoard := createTestLead(t, alice)
+	for id, phone := range map[string]string{first: "01632 960001", onBoard: "01632 960002"} {
+		if _, err := db.Exec("UPDATE leads SET phone = ? WHERE id = ?", phone, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: onBoard, Phone: "01632 960002"}}); err != nil {
+		t.Fatal(err)
+	}
+	extra := map[string]string{"repeat": "+44 1632 960001", "board": "(01632) 960002", "nophone": ""}
+	for id, phone := range extra {
+		if _, err := db.Exec("INSERT INTO leads (id, search_id, company_name, phone) VALUES (?, ?, 'Acme Plumbing', ?)", id, searchID, phone); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if added, err := mallory.ImportSearch(searchID, searchImportFilter{}); err != nil || len(added) != 0 {
+		t.Fatalf("another tenant imported %v (err %v)", added, err)
+	}
+	added, err := alice.ImportSearch(searchID, searchImportFilter{HasPhone: true, ExcludeDuplicates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != first {
+		t.Errorf("imported %v, want only %s", added, first)
+	}
+}
+
+func TestRerunMarksOnlyNetNewLeads(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	mallory := createTestTenant(t, "mallory@example.com")
+	firstRun, _ := createTestLead(t, alice)
+	if _, err := db.Exec("UPDATE leads SET phone = '01632 960001' WHERE search_id = ?", firstRun); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mallory.Searches().Get(firstRun); err != store.ErrNotFound {
+		t.Errorf("another tenant loaded the search: got %v, want store.ErrNotFound", err)
+	}
+
+	rerun := uuid.New().String()
+	if err := alice.Searches().Insert(searches.Search{ID: rerun, Keyword: "plumbers", Source: DEFAULT_SOURCE, Status: "In Progress", RerunOf: firstRun}); err != nil {
+		t.Fatal(err)
+	}
+	for id, phone := range map[string]string{"known": "+44 1632 960001", "fresh": "01632 960099"} {
+		if _, err := db.Exec("INSERT INTO leads (id, search_id, company_name, phone) VALUES (?, ?, ?, ?)", id, rerun, id, phone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := markNewLeads(tx, rerun); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	search, err := alice.Searches().Get(rerun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if search.NewLeads == nil || *search.NewLeads != 1 {
+		t.Errorf("newLeads: got %v, want 1", search.NewLeads)
+	}
+	for id, want := range map[string]bool{"known": false, "fresh": true} {
+		lead, err := alice.Leads().Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lead.IsNew == nil || *lead.IsNew != want {
+			t.Errorf("lead %s: isNew %v, want %v", id, lead.IsNew, want)
+		}
+	}
+}
+
+func TestArchivedSearchesAreHiddenByDefault(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	mallory := createTestTenant(t, "mallory@example.com")
+	searchID, _ := createTestLead(t, alice)
+	if _, err := searches.NewService(mallory.Searches()).Archive(searchID, true); err != store.ErrNotFound {
+		t.Errorf("ArchiveSearch across tenants: got %v, want store.ErrNotFound", err)
+	}
+	if _, err := searches.NewService(alice.Searches()).Archive(searchID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for archived, want := range map[string]int{"": 0, "true": 1, "all": 1} {
+		q, err := searches.ParseListQuery(url.Values{"archived": {archived}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, total, err := alice.Searches().List(q); err != nil || total != want {
+			t.Errorf("archived=%q: got %d searches (err %v), want %d", archived, total, err, want)
+		}
+	}
+	if !alice.Searches().Owns(searchID) {
+		t.Error("archived search's leads are no longer reachable")
+	}
+}
+
+func TestSuppressionListIsKeyed(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	if _, err := alice.AddSuppressions([]string{"01632 960001"}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	unkeyed := sha256.Sum256([]byte(SUPPRESS_PHONE + ":" + normalizePhone("01632 960001")))
+	var stored string
+	if err := db.QueryRow("SELECT value_hash FROM suppressions WHERE org_id = ?", alice.Tenant().OrgID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == hex.EncodeToString(unkeyed[:]) {
+		t.Error("stored the unkeyed hash")
+	}
+	prevKey := suppressionKey
+	suppressionKey = []byte("another-suppression-key-32-bytes")
+	if suppressionHash(SUPPRESS_PHONE, "01632 960001") == stored {
+		t.Error("hash doesn't depend on the key")
+	}
+	suppressionKey = prevKey
+
+	// Entries from before the list was keyed are rekeyed at startup.
+	legacy := sha256.Sum256([]byte(SUPPRESS_EMAIL + ":owner@acme.test"))
+	_, err := db.Exec("INSERT INTO suppressions (org_id, kind, value_hash, created_at) VALUES (?, ?, ?, ?)",
+		alice.Tenant().OrgID, SUPPRESS_EMAIL, hex.EncodeToString(legacy[:]), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekeySuppressions()
+	set, err := loadSuppressions(db, alice.Tenant().OrgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.has(SUPPRESS_PHONE, "+44 1632 960001") || !set.has(SUPPRESS_EMAIL, "Owner@Acme.test") {
+		t.Errorf("suppressions after rekeying don't match: %v", set)
+	}
+}
+
+func TestContactDetailsAreSealedAtRest(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("FIELD_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	initFieldEncryption()
+	t.Cleanup(func() { sealer = nil })
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	_, copyID := createTestLead(t, alice)
+	for _, id := range []string{leadID, copyID} {
+		if _, err := db.Exec("UPDATE leads SET phone = ? WHERE id = ?", seal("01632 960001"), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, Phone: "01632 960001", Email: "owner@acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.UpdateCrmLead(leadID, CrmLead{Notes: "Spoke to Jane"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var phone, email, notes string
+	if err := db.QueryRow("SELECT phone, email, notes FROM crm_leads WHERE lead_id = ?", leadID).Scan(&phone, &email, &notes); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{phone, email, notes} {
+		if !strings.HasPrefix(v, SEALED_PREFIX) {
+			t.Errorf("stored %q in the clear", v)
+		}
+	}
+	board, err := alice.CrmLeads()
+	if err != nil || len(board) != 1 {
+		t.Fatalf("board has %d cards (err %v)", len(board), err)
+	}
+	if board[0].Phone != "01632 960001" || board[0].Email != "owner@acme.test" || board[0].Notes != "Spoke to Jane" {
+		t.Errorf("card wasn't unsealed: %+v", board[0])
+	}
+	// Matching duplicates in SQL has to see through the sealing.
+	clusters, err := alice.DuplicateClusters(true)
+	if err != nil || len(clusters) != 1 {
+		t.Errorf("found %d duplicate clusters (err %v), want 1", len(clusters), err)
+	}
+
+	// Details written before the key was set are sealed at startup.
+	if _, err := db.Exec("UPDATE leads SET email = 'info@acme.test' WHERE id = ?", copyID); err != nil {
+		t.Fatal(err)
+	}
+	sealExistingFields()
+	if err := db.QueryRow("SELECT email FROM leads WHERE id = ?", copyID).Scan(&email); err != nil {
+		t.Fatal(err)
+	}
+	if unseal(email) != "info@acme.test" || email == "info@acme.test" {
+		t.Errorf("existing email stored as %q", email)
+	}
+}
+
+func TestMailCredentialsAreSealedAtRest(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("FIELD_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	initFieldEncryption()
+	t.Cleanup(func() { sealer = nil })
+	alice := createTestTenant(t, "alice@example.com")
+
+	if err := alice.SaveMailbox(Mailbox{Host: "imap.example.com", Port: 993, Security: IMAP_TLS, Username: "alice", Password: "hunter2", Folder: "INBOX"}, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	var password string
+	if err := db.QueryRow("SELECT password FROM mailboxes WHERE user_id = ?", alice.Tenant().UserID).Scan(&password); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(password, SEALED_PREFIX) {
+		t.Errorf("stored mailbox password %q in the clear", password)
+	}
+	if m, err := alice.Mailbox(); err != nil || m.Password != "hunter2" {
+		t.Errorf("mailbox password = %q (err %v), want it unsealed", m.Password, err)
+	}
+
+	// Passwords saved before the key was set are sealed at startup.
+	if _, err := db.Exec("UPDATE mailboxes SET password = 'hunter2' WHERE user_id = ?", alice.Tenant().UserID); err != nil {
+		t.Fatal(err)
+	}
+	sealExistingFields()
+	if err := db.QueryRow("SELECT password FROM mailboxes WHERE user_id = ?", alice.Tenant().UserID).Scan(&password); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(password, SEALED_PREFIX) {
+		t.Errorf("existing mailbox password %q wasn't sealed", password)
+	}
+
+	// OAuth tokens stay sealed through a refresh.
+	microsoft := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("refresh_token") != "refresh-1" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"fresh","refresh_token":"refresh-2","expires_in":3600}`)
+	}))
+	defer microsoft.Close()
+	prevTokenURL := microsoftProvider.tokenURL
+	microsoftProvider.tokenURL = microsoft.URL
+	t.Cleanup(func() { microsoftProvider.tokenURL = prevTokenURL })
+	err := alice.SaveMailAccount(MailAccount{Provider: MAIL_MICROSOFT, Email: "alice@contoso.test", DailyLimit: 300,
+		accessToken: "stale", refreshToken: "refresh-1", tokenExpiresAt: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedTokens := func() (string, string) {
+		var access, refresh string
+		if err := db.QueryRow("SELECT access_token, refresh_token FROM mail_accounts WHERE user_id = ?", alice.Tenant().UserID).Scan(&access, &refresh); err != nil {
+			t.Fatal(err)
+		}
+		return access, refresh
+	}
+	if access, refresh := storedTokens(); !strings.HasPrefix(access, SEALED_PREFIX) || !strings.HasPrefix(refresh, SEALED_PREFIX) {
+		t.Errorf("stored OAuth tokens %q, %q in the clear", access, refresh)
+	}
+	account, err := alice.MailAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := mailAccountToken(alice, microsoftProvider, account)
+	if err != nil || token != "fresh" {
+		t.Fatalf("refreshed token = %q (err %v), want fresh", token, err)
+	}
+	if access, refresh := storedTokens(); !strings.HasPrefix(access, SEALED_PREFIX) || !strings.HasPrefix(refresh, SEALED_PREFIX) {
+		t.Errorf("refreshed OAuth tokens %q, %q stored in the clear", access, refresh)
+	}
+	if account, err := alice.MailAccount(); err != nil || account.accessToken != "fresh" || account.refreshToken != "refresh-2" {
+		t.Errorf("refreshed tokens = %q, %q (err %v), want them unsealed", account.accessToken, account.refreshToken, err)
+	}
+}
+
+func TestRequeueSearchesSkipsSearchesWithLeads(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	withLeads, _ := createTestLead(t, alice)
+	empty := uuid.New().String()
+	if err := alice.Searches().Insert(searches.Search{ID: empty, Keyword: "roofers", Source: DEFAULT_SOURCE, Status: "Failed"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE searches SET status = 'Failed' WHERE id = ?", withLeads); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := lmctlRequeueSearches([]string{"-failed"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{empty: searches.QUEUED, withLeads: "Failed"} {
+		s, err := alice.Searches().Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Status != want {
+			t.Errorf("search %s: expected %q, got %q", id, want, s.Status)
+		}
+	}
+}
+
+func TestSeedDemoDataOnlyOnce(t *testing.T) {
+	setupTestDB(t)
+	for i := 0; i < 2; i++ {
+		if err := seedDemoData(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var users, searches, cards int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", DEMO_EMAIL).Scan(&users)
+	db.QueryRow("SELECT COUNT(*) FROM searches WHERE status = 'Completed' AND leads_found > 0").Scan(&searches)
+	db.QueryRow("SELECT COUNT(*) FROM crm_leads").Scan(&cards)
+	if users != 1 || searches != len(demoCities) || cards == 0 {
+		t.Fatalf("expected one demo user with %d searches and a board, got %d users, %d searches, %d cards", len(demoCities), users, searches, cards)
+	}
+}
+
+func TestCampaignExcludesUnusableAddressesAndThrottles(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	mallory := createTestTenant(t, "mallory@example.com")
+	searchID, acmeID := createTestLead(t, alice)
+
+	found := []leads.Lead{{ID: acmeID, CompanyName: "Acme Plumbing", Email: "owner@acme.test"}}
+	for _, l := range []leads.Lead{
+		{CompanyName: "Acme Plumbing Ltd", Email: "OWNER@acme.test"},
+		{CompanyName: "Bad Address", Email: "not-an-email"},
+		{CompanyName: "Bounce Ltd", Email: "info@bounce.test"},
+		{CompanyName: "Gone Co", Email: "info@gone.test"},
+		{CompanyName: "No Mail"},
+	} {
+		l.ID = uuid.New().String()
+		if _, err := db.Exec("INSERT INTO leads (id, search_id, company_name) VALUES (?, ?, ?)", l.ID, searchID, l.CompanyName); err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, l)
+	}
+	if _, err := db.Exec("INSERT INTO lead_emails (lead_id, email, verification) VALUES (?, 'info@bounce.test', ?)", found[3].ID, EMAIL_INVALID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.AddSuppressions(nil, []string{"info@gone.test"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.AddCrmLeads(found); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := MessageTemplate{ID: uuid.New().String(), Name: "Intro", Channel: TEMPLATE_EMAIL, Subject: "Hello {{companyName}}", Body: "Hi", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := alice.CreateMessageTemplate(tpl); err != nil {
+		t.Fatal(err)
+	}
+	campaignID := uuid.New().String()
+	if err := alice.CreateCampaign(campaignID, campaignInput{Name: "Spring", TemplateID: tpl.ID, HourlyLimit: 60}); err != nil {
+		t.Fatal(err)
+	}
+	campaign, err := alice.Campaign(campaignID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mallory.Campaign(campaignID); err != store.ErrNotFound {
+		t.Errorf("Campaign across tenants: got %v, want store.ErrNotFound", err)
+	}
+	if err := startCampaign(alice, campaign, tpl); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := alice.CampaignRecipients(campaignID, "", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Acme Plumbing": "", "Acme Plumbing Ltd": EXCLUDED_DUPLICATE, "Bad Address": EXCLUDED_INVALID_EMAIL,
+		"Bounce Ltd": EXCLUDED_UNDELIVERABLE, "Gone Co": EXCLUDED_SUPPRESSED, "No Mail": EXCLUDED_NO_EMAIL,
+	}
+	if len(recipients) != len(want) {
+		t.Fatalf("got %d recipients, want %d", len(recipients), len(want))
+	}
+	for _, r := range recipients {
+		if r.Reason != want[r.CompanyName] {
+			t.Errorf("%s excluded for %q, want %q", r.CompanyName, r.Reason, want[r.CompanyName])
+		}
+	}
+
+	var sent []string
+	send := func(to, subject, body string, headers map[string]string) error {
+		if !strings.Contains(body, unsubscribeURL) || headers["List-Unsubscribe"] == "" {
+			t.Errorf("email to %s has no unsubscribe link", to)
+		}
+		sent = append(sent, to+": "+subject)
+		return nil
+	}
+	now := time.Now().UTC()
+	for i := 0; i < 2; i++ {
+		if err := sendCampaignBatch(alice, campaignID, now, send); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 1 || sent[0] != "owner@acme.test: Hello Acme Plumbing" {
+		t.Errorf("sent %v", sent)
+	}
+	if campaign, _ := alice.Campaign(campaignID); campaign.Status != CAMPAIGN_COMPLETED || campaign.Counts[RECIPIENT_SENT] != 1 {
+		t.Errorf("campaign %s with counts %v after sending", campaign.Status, campaign.Counts)
+	}
+
+	for _, c := range []struct{ limit, sent, want int }{{50, 0, 1}, {50, 50, 0}, {1000, 0, 17}, {1000, 995, 5}} {
+		if got := campaignBatchSize(c.limit, c.sent); got != c.want {
+			t.Errorf("campaignBatchSize(%d, %d) = %d, want %d", c.limit, c.sent, got, c.want)
+		}
+	}
+}
+
+// fakeIMAPServer answers IMAP connections with one folder holding
+// messages, keyed by UID, and returns its port.
+func fakeIMAPServer(t *testing.T, messages map[uint32]string) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprint(conn, "* OK fake IMAP ready\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					tag, cmd := fields[0], strings.ToUpper(fields[1])
+					switch cmd {
+					case "EXAMINE":
+						fmt.Fprint(conn, "* OK [UIDVALIDITY 7] UIDs valid\r\n* OK [UIDNEXT 3] Predicted next UID\r\n")
+					case "UID":
+						for uid, header := range messages {
+							fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[HEADER.FIELDS (FROM)] {%d}\r\n%s)\r\n", uid, uid, len(header), header)
+						}
+					case "LOGOUT":
+						fmt.Fprintf(conn, "* BYE\r\n%s OK done\r\n", tag)
+						return
+					}
+					fmt.Fprintf(conn, "%s OK done\r\n", tag)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestReplyDetectionMovesCardToReplied(t *testing.T) {
+	setupTestDB(t)
+	prevAllow := imapAllowPrivate
+	imapAllowPrivate = true
+	t.Cleanup(func() { imapAllowPrivate = prevAllow })
+
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing", Email: "owner@acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	tpl := MessageTemplate{ID: uuid.New().String(), Name: "Intro", Channel: TEMPLATE_EMAIL, Subject: "Hello", Body: "Hi", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := alice.CreateMessageTemplate(tpl); err != nil {
+		t.Fatal(err)
+	}
+	campaignID := uuid.New().String()
+	if err := alice.CreateCampaign(campaignID, campaignInput{Name: "Spring", TemplateID: tpl.ID, HourlyLimit: 50}); err != nil {
+		t.Fatal(err)
+	}
+	campaign, _ := alice.Campaign(campaignID)
+	if err := startCampaign(alice, campaign, tpl); err != nil {
+		t.Fatal(err)
+	}
+	var messageID string
+	err := sendCampaignBatch(alice, campaignID, time.Now().UTC(), func(to, subject, body string, headers map[string]string) error {
+		messageID = headers["Message-ID"]
+		return nil
+	})
+	if err != nil || messageID == "" {
+		t.Fatalf("sending: %v, Message-ID %q", err, messageID)
+	}
+
+	// UID 1 was there before the mailbox was connected; UID 2 is a reply
+	// from a different address, matched by its threading headers.
+	port := fakeIMAPServer(t, map[uint32]string{
+		1: "From: owner@acme.test\r\nSubject: Old\r\n",
+		2: "From: Office <office@acme.test>\r\nMessage-ID: <reply-1@acme.test>\r\nIn-Reply-To: " + messageID + "\r\nSubject: Re: Hello\r\n",
+	})
+	if err := alice.SaveMailbox(Mailbox{Host: "127.0.0.1", Port: port, Security: IMAP_NONE, Username: "alice", Password: "secret", Folder: "INBOX"}, 7, 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := pollMailbox(alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, _ := alice.Mailbox(); m.LastError != "" || m.lastUID != 2 {
+		t.Errorf("mailbox after polling: last UID %d, error %q", m.lastUID, m.LastError)
+	}
+
+	card, err := alice.Crm().Card(leadID)
+	if err != nil || card.ColumnID != "replied" {
+		t.Errorf("card column %q (err %v), want replied", card.ColumnID, err)
+	}
+	var replies int
+	db.QueryRow("SELECT COUNT(*) FROM crm_activity WHERE lead_id = ? AND kind = 'email_reply'", leadID).Scan(&replies)
+	if replies != 1 {
+		t.Errorf("%d email_reply activities, want 1", replies)
+	}
+	if recipients, _ := alice.CampaignRecipients(campaignID, "", 10, 0); recipients[0].RepliedAt == nil {
+		t.Error("recipient has no repliedAt")
+	}
+}
+
+func TestGmailAccountRefreshesTokenAndKeepsToDailyLimit(t *testing.T) {
+	setupTestDB(t)
+	var refreshes int
+	var sent []string
+	google := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh-1" {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			refreshes++
+			fmt.Fprint(w, `{"access_token":"fresh","expires_in":3600}`)
+		case "/gmail/v1/users/me/messages/send":
+			if r.Header.Get("Authorization") != "Bearer fresh" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			var body struct {
+				Raw string `json:"raw"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			raw, _ := base64.URLEncoding.DecodeString(body.Raw)
+			sent = append(sent, string(raw))
+			fmt.Fprint(w, `{"id":"1"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer google.Close()
+	prevTokenURL, prevAPIURL := gmailProvider.tokenURL, gmailAPIURL
+	gmailProvider.tokenURL, gmailAPIURL = google.URL+"/token", google.URL
+	t.Cleanup(func() { gmailProvider.tokenURL, gmailAPIURL = prevTokenURL, prevAPIURL })
+
+	alice := createTestTenant(t, "alice@example.com")
+	err := alice.SaveMailAccount(MailAccount{Provider: MAIL_GMAIL, Email: "alice@gmail.test", DailyLimit: 1,
+		accessToken: "stale", refreshToken: "refresh-1", tokenExpiresAt: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendUserMail(alice, "owner@acme.test", "Hello", "Hi there", nil); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	if refreshes != 1 || len(sent) != 1 {
+		t.Fatalf("got %d refreshes and %d sends, want 1 of each", refreshes, len(sent))
+	}
+	if !strings.Contains(sent[0], "From: alice@gmail.test\r\n") || !strings.Contains(sent[0], "To: owner@acme.test\r\n") {
+		t.Errorf("message headers wrong:\n%s", sent[0])
+	}
+	account, _ := alice.MailAccount()
+	if account.SentToday != 1 || account.accessToken != "fresh" {
+		t.Errorf("account = %d sent today with token %q, want 1 with the refreshed one", account.SentToday, account.accessToken)
+	}
+
+	if err := sendUserMail(alice, "owner@acme.test", "Hello", "Again", nil); err != errMailAccountDailyLimit {
+		t.Errorf("second send = %v, want the daily limit", err)
+	}
+	if refreshes != 1 || len(sent) != 1 {
+		t.Errorf("got %d refreshes and %d sends after the limit, want 1 of each", refreshes, len(sent))
+	}
+}
+
+func TestOutlookCalendarFollowsCallbacks(t *testing.T) {
+	setupTestDB(t)
+	var calls []string
+	var starts []string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		var ev graphEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		switch r.Method {
+		case http.MethodPost:
+			starts = append(starts, ev.Start.DateTime)
+			fmt.Fprint(w, `{"id":"event-1"}`)
+		case http.MethodPatch:
+			starts = append(starts, ev.Start.DateTime)
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer graph.Close()
+	prevURL := graphAPIURL
+	graphAPIURL = graph.URL
+	t.Cleanup(func() { graphAPIURL = prevURL })
+
+	alice := createTestTenant(t, "alice@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	err := alice.SaveMailAccount(MailAccount{Provider: MAIL_MICROSOFT, Email: "alice@contoso.test", DailyLimit: 300,
+		accessToken: "token", refreshToken: "refresh", tokenExpiresAt: time.Now().Add(time.Hour)})
+	if err == nil {
+		err = alice.UpdateMailAccountSettings(300, true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCallback := func(at *time.Time) {
+		t.Helper()
+		if err := alice.UpdateCrmLead(leadID, CrmLead{CallBackDate: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func() {
+		t.Helper()
+		if err := syncCalendar(alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	setCallback(&first)
+	sync()
+	sync()
+	second := first.Add(2 * time.Hour)
+	setCallback(&second)
+	sync()
+	setCallback(nil)
+	sync()
+
+	want := []string{"POST /me/events", "PATCH /me/events/event-1", "DELETE /me/events/event-1"}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if len(starts) != 2 || starts[0] != first.Format("2006-01-02T15:04:05") || starts[1] != second.Format("2006-01-02T15:04:05") {
+		t.Errorf("event starts = %v, want %s then %s", starts, first, second)
+	}
+	if changes, _ := alice.CalendarChanges(); len(changes) != 0 {
+		t.Errorf("%d changes left after syncing", len(changes))
+	}
+}
+
+func TestRepeatingTaskSchedulesNextOnceClosed(t *testing.T) {
+	setupTestDB(t)
+	repo := createTestTenant(t, "rep@example.com")
+
+	monthly := TaskRepeat{Every: 1, Unit: REPEAT_MONTH}
+	for _, tc := range []struct{ due, today, want string }{
+		{"2026-01-31", "2026-01-31", "2026-02-28"},
+		{"2026-01-31", "2026-03-15", "2026-03-31"},
+		{"2026-05-10", "2026-04-01", "2026-06-10"},
+	} {
+		if got, _ := monthly.after(tc.due, tc.today); got != tc.want {
+			t.Errorf("monthly after(%s, %s) = %s, want %s", tc.due, tc.today, got, tc.want)
+		}
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	now := time.Now().UTC()
+	task := Task{ID: uuid.New().String(), Title: "Check in", Assignee: repo.Tenant().UserID, DueDate: today, Repeat: &TaskRepeat{Every: 30, Unit: REPEAT_DAY}, CreatedAt: now, UpdatedAt: now}
+	if err := repo.CreateTask(task); err != nil {
+		t.Fatal(err)
+	}
+	scheduleRepeatingTasks()
+	if tasks, _ := repo.Tasks(taskFilter{}); len(tasks) != 1 {
+		t.Fatalf("%d tasks before the first is closed, want 1", len(tasks))
+	}
+
+	if err := repo.SkipTask(task.ID); err != nil {
+		t.Fatal(err)
+	}
+	scheduleRepeatingTasks()
+	scheduleRepeatingTasks()
+	notDone := false
+	open, err := repo.Tasks(taskFilter{done: &notDone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := now.AddDate(0, 0, 30).Format("2006-01-02")
+	if len(open) != 1 || open[0].DueDate != want || open[0].Repeat == nil || open[0].Repeat.Every != 30 {
+		t.Fatalf("open tasks after skipping = %+v, want one due %s", open, want)
+	}
+	skipped, _ := repo.Task(task.ID)
+	if !skipped.Skipped || skipped.NextTaskID != open[0].ID {
+		t.Errorf("skipped task = %+v", skipped)
+	}
+}
+
+func TestPriorityRuleMovesLeadUpTheDialerQueue(t *testing.T) {
+	setupTestDB(t)
+	repo := createTestTenant(t, "rep@example.com")
+	_, first := createTestLead(t, repo)
+	_, second := createTestLead(t, repo)
+	if _, err := repo.AddCrmLeads([]leads.Lead{{ID: first, CompanyName: "Acme Plumbing", Phone: "01467 268847"}, {ID: second, CompanyName: "Acme Plumbing", Phone: "01467 268848"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AddCrmTag(second, "referral", nil); err != nil {
+		t.Fatal(err)
+	}
+	queue := func() []string {
+		t.Helper()
+		candidates, err := repo.DialerCandidates([]string{"tobe-called"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, cand := range candidates {
+			ids = append(ids, cand.LeadID)
+		}
+		return ids
+	}
+	if q := queue(); len(q) != 2 || q[0] != first {
+		t.Fatalf("queue before = %v, want %s first", q, first)
+	}
+
+	now := time.Now()
+	rule := AutomationRule{
+		ID: "hot-referrals", Name: "Referrals are hot", Enabled: true, CreatedBy: repo.Tenant().UserID, CreatedAt: now, UpdatedAt: now,
+		Conditions: []RuleCondition{{Field: "tag", Op: "has", Value: "referral"}, {Field: "priority", Op: "!=", Value: PRIORITY_HOT}},
+		Action:     RuleAction{Type: "priority", Priority: PRIORITY_HOT},
+	}
+	if err := repo.CreateAutomationRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	for pass, want := range []int{1, 0} {
+		if applied, err := applyAutomationRules(context.Background(), repo.Tenant().OrgID); err != nil || applied != want {
+			t.Errorf("pass %d took %d actions (err %v), want %d", pass+1, applied, err, want)
+		}
+	}
+	if q := queue(); len(q) != 2 || q[0] != second {
+		t.Errorf("queue after = %v, want %s first", q, second)
+	}
+	var logged int
+	db.QueryRow("SELECT COUNT(*) FROM crm_activity WHERE lead_id = ? AND kind = 'priority_change'", second).Scan(&logged)
+	if logged != 1 {
+		t.Errorf("%d priority_change activities, want 1", logged)
+	}
+	if err := repo.SetCrmPriority(first, PRIORITY_COLD, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lead, err := repo.Crm().Card(first); err != nil || lead.Priority != PRIORITY_COLD {
+		t.Errorf("priority after setting it = %q (err %v)", lead.Priority, err)
+	}
+}
+
+func TestContactWarningNamesTeammateWhoJustCalled(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	res, err := db.Exec("INSERT INTO users (name, email, password_hash, org_id) VALUES ('bob', 'bob@example.com', '', ?)", alice.Tenant().OrgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID, _ := res.LastInsertId()
+	bob := newRepository(Tenant{OrgID: alice.Tenant().OrgID, UserID: bobID})
+	_, aliceLead := createTestLead(t, alice)
+	_, bobLead := createTestLead(t, bob)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: aliceLead, CompanyName: "Acme Plumbing", Phone: "01467 268847"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.AddCrmLeads([]leads.Lead{{ID: bobLead, CompanyName: "Acme Plumbing Ltd", Phone: "020 7946 0000"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	card, err := alice.Crm().Card(aliceLead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings, err := contactWarnings(alice, card, time.Now()); err != nil || len(warnings) != 0 {
+		t.Fatalf("different numbers shouldn't warn: %+v %v", warnings, err)
+	}
+
+	// The same number, written another way, edited onto Bob's card.
+	if _, err := db.Exec("UPDATE crm_leads SET phone = ? WHERE lead_id = ?", seal("+44 1467 268847"), bobLead); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bob.RecordCall(bobLead, "no_answer", "", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	warnings, err := contactWarnings(alice, card, time.Now())
+	if err != nil || len(warnings) != 1 {
+		t.Fatalf("expected one warning, got %+v %v", warnings, err)
+	}
+	w := warnings[0]
+	if w.LeadID != bobLead || w.MatchedOn != "phone" || w.Assignee != bobID || w.AssigneeName != "bob" || w.LastCalledBy != bobID || !w.CalledRecently {
+		t.Fatalf("unexpected warning %+v", w)
+	}
+	if warnings, _ := contactWarnings(alice, card, time.Now().Add(CONTACT_WARNING_WINDOW+time.Hour)); len(warnings) != 1 || warnings[0].CalledRecently {
+		t.Fatalf("a call over a week ago isn't recent: %+v", warnings)
+	}
+}
+
+type fakeFirmographicsProvider struct{ calls int }
+
+func (p *fakeFirmographicsProvider) Info() VerifierInfo {
+	return VerifierInfo{ID: "fake", Name: "Fake", RequiresAPIKey: true}
+}
+
+func (p *fakeFirmographicsProvider) Lookup(ctx context.Context, apiKey, domain, companyName string) (leads.Firmographics, bool, error) {
+	p.calls++
+	if domain != "acme.co.uk" {
+		return leads.Firmographics{}, false, nil
+	}
+	return leads.Firmographics{LegalName: "ACME PLUMBING LTD", EmployeeCount: 42, IncorporatedOn: "2009-03-01"}, true, nil
+}
+
+func TestFirmographicsFillInCompanySize(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	searchID, leadID := createTestLead(t, alice)
+	provider := &fakeFirmographicsProvider{}
+	firmographicsProviders["fake"] = provider
+	t.Cleanup(func() { delete(firmographicsProviders, "fake") })
+	if _, err := db.Exec("INSERT INTO user_settings (user_id, firmographics_provider, firmographics_api_key) VALUES (?, 'fake', 'key')", alice.Tenant().UserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE leads SET website = 'https://www.acme.co.uk/contact' WHERE id = ?", leadID); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := lookupFirmographics(context.Background(), alice.Tenant().UserID, []string{leadID}); err != nil || found != 1 {
+		t.Fatalf("expected one company found, got %d (err %v)", found, err)
+	}
+	// A lead is looked up once.
+	if _, err := lookupFirmographics(context.Background(), alice.Tenant().UserID, []string{leadID}); err != nil || provider.calls != 1 {
+		t.Fatalf("looked up %d times (err %v)", provider.calls, err)
+	}
+
+	for _, tc := range []struct {
+		params url.Values
+		want   int
+	}{
+		{url.Values{"minEmployees": {"10"}}, 1},
+		{url.Values{"minEmployees": {"50"}}, 0},
+		{url.Values{"maxEmployees": {"50"}}, 1},
+		{url.Values{"maxEmployees": {"10"}}, 0},
+	} {
+		lq, err := buildLeadQuery(alice, searchID, tc.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leads, err := alice.Leads().List(lq)
+		if err != nil || len(leads) != tc.want {
+			t.Fatalf("%v: got %d leads, want %d (err %v)", tc.params, len(leads), tc.want, err)
+		}
+		if tc.want == 1 && (leads[0].Firmographics == nil || leads[0].Firmographics.LegalName != "ACME PLUMBING LTD") {
+			t.Fatalf("unexpected firmographics %+v", leads[0].Firmographics)
+		}
+	}
+}
+
+func TestSiteFeaturesBuildPitchLists(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	searchID, booked := createTestLead(t, alice)
+	unbooked, unanalysed := uuid.New().String(), uuid.New().String()
+	if _, err := db.Exec("INSERT INTO leads (id, search_id, company_name) VALUES (?1, ?2, 'Bolt Electrics'), (?3, ?2, 'Crane Roofing')", unbooked, searchID, unanalysed); err != nil {
+		t.Fatal(err)
+	}
+
+	saveSiteFeatures(booked, detectSiteFeatures(`<html><head>
+        <meta content="width=device-width, initial-scale=1" name="viewport">
+        <script async src="https://www.googletagmanager.com/gtag/js?id=G-1"></script></head>
+        <body><a href="https://calendly.com/acme/visit">Book a visit</a></body></html>`))
+	saveSiteFeatures(unbooked, detectSiteFeatures(`<html><body><script src="//embed.tawk.to/abc/default"></script>
+        <button class="add-to-cart">Buy</button></body></html>`))
+
+	lead, err := alice.Leads().Get(booked)
+	if err != nil || lead.Features == nil {
+		t.Fatalf("lead features %+v (err %v)", lead.Features, err)
+	}
+	if want := (leads.SiteFeatures{OnlineBooking: true, Analytics: true, MobileFriendly: true}); *lead.Features != want {
+		t.Errorf("got %+v, want %+v", *lead.Features, want)
+	}
+
+	lq, err := buildLeadQuery(alice, searchID, url.Values{"onlineBooking": {"false"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := alice.Leads().List(lq)
+	if err != nil || len(found) != 1 || found[0].ID != unbooked {
+		t.Fatalf("no online booking: got %+v (err %v)", found, err)
+	}
+	if want := (leads.SiteFeatures{LiveChat: true, ECommerce: true}); *found[0].Features != want {
+		t.Errorf("got %+v, want %+v", *found[0].Features, want)
+	}
+	if _, err := buildLeadQuery(alice, searchID, url.Values{"liveChat": {"maybe"}}); err == nil {
+		t.Error("expected an error for a non-boolean feature filter")
+	}
+}
+
+func TestLighthouseAuditUpdatesLeadAndCard(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestTenant(t, "alice@example.com")
+	mallory := createTestTenant(t, "mallory@example.com")
+	_, leadID := createTestLead(t, alice)
+	if _, err := alice.AddCrmLeads([]leads.Lead{{ID: leadID, CompanyName: "Acme Plumbing"}}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := alice.Crm().Version()
+
+	previous := runLighthouse
+	t.Cleanup(func() { runLighthouse = previous })
+	performance, seo := 38, 91
+	runLighthouse = func(ctx context.Context, website string) (LighthouseAudit, error) {
+		return LighthouseAudit{
+			Performance: &performance, SEO: &seo, Strategy: LIGHTHOUSE_STRATEGY,
+			Opportunities: []LighthouseOpportunity{{ID: "render-blocking-resources", Title: "Eliminate render-blocking resources", SavingsMs: 2400}},
+		}, nil
+	}
+	if _, err := auditLead(context.Background(), leadID, "acme.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err := alice.LeadAudit(leadID)
+	if err != nil || *audit.Performance != 38 || *audit.SEO != 91 || audit.Accessibility != nil || len(audit.Opportunities) != 1 || audit.Opportunities[0].SavingsMs != 2400 {
+		t.Fatalf("unexpected audit %+v (err %v)", audit, err)
+	}
+	if lead, _ := alice.Leads().Get(leadID); lead.PageSpeed != 38 {
+		t.Errorf("lead pageSpeed %d, want 38", lead.PageSpeed)
+	}
+	if card, _ := alice.Crm().Card(leadID); card.PageSpeed != 38 {
+		t.Errorf("card pageSpeed %d, want 38", card.PageSpeed)
+	}
+	if after, _ := alice.Crm().Version(); after <= before {
+		t.Error("the board version should move when a card's score changes")
+	}
+	if _, err := mallory.LeadAudit(leadID); err != store.ErrNotFound {
+		t.Errorf("another tenant read the audit: %v", err)
+	}
+}
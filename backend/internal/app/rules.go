@@ -0,0 +1,559 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/store"
+)
+
+// --- AUTOMATION RULES ---
+//
+// A rule is a list of conditions that must all hold for a CRM lead, and one
+// action to take when they do, e.g. "timesCalled >= 5 and not reached:
+// move to Cold". A background job evaluates every organization's enabled
+// rules against its board. Actions only run when they would change
+// something, so a rule fires once per lead rather than on every pass.
+
+const RULES_CHECK_INTERVAL = 5 * time.Minute
+const RULE_LOG_DEFAULT_LIMIT = 100
+
+// ruleFields maps each condition field to its value type.
+var ruleFields = map[string]string{
+	"column":            "string",
+	"lastDisposition":   "string",
+	"timesCalled":       "number",
+	"daysSinceUpdate":   "number",
+	"daysSinceLastCall": "number", // never-called leads don't match
+	"reached":           "bool",   // a call ended interested or not interested
+	"callbackOverdue":   "bool",   // the callback time passed with no update since
+	"hasEmail":          "bool",
+	"hasPhone":          "bool",
+	"pageSpeed":         "number", // leads without a score don't match
+	"tag":               "tag",
+	"priority":          "string",
+}
+
+var ruleOps = map[string][]string{
+	"string": {"==", "!="},
+	"number": {"==", "!=", ">", ">=", "<", "<="},
+	"bool":   {"=="},
+	"tag":    {"has", "lacks"},
+}
+
+type RuleCondition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// RuleAction is what a rule does: move (to Column), tag or untag (Tag), or
+// set the priority (Priority).
+type RuleAction struct {
+	Type     string `json:"type"`
+	Column   string `json:"column,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Priority string `json:"priority,omitempty"`
+}
+
+type AutomationRule struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Enabled    bool            `json:"enabled"`
+	Conditions []RuleCondition `json:"conditions"`
+	Action     RuleAction      `json:"action"`
+	CreatedBy  int64           `json:"createdBy"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+}
+
+type RuleRun struct {
+	ID          int64     `json:"id"`
+	RuleID      string    `json:"ruleId"`
+	RuleName    string    `json:"ruleName"`
+	LeadID      string    `json:"leadId"`
+	CompanyName string    `json:"companyName"`
+	Action      string    `json:"action"`
+	ExecutedAt  time.Time `json:"executedAt"`
+}
+
+type automationRuleInput struct {
+	Name       string          `json:"name" binding:"required"`
+	Enabled    *bool           `json:"enabled"`
+	Conditions []RuleCondition `json:"conditions" binding:"required"`
+	Action     RuleAction      `json:"action" binding:"required"`
+}
+
+func (in *automationRuleInput) validate(repo *Repository) error {
+	if len(in.Conditions) == 0 {
+		return fmt.Errorf("a rule needs at least one condition")
+	}
+	if err := validateRuleConditions(repo, in.Conditions); err != nil {
+		return err
+	}
+	return in.Action.validate(repo)
+}
+
+// validateRuleConditions checks conditions for rules and segments.
+func validateRuleConditions(repo *Repository, conditions []RuleCondition) error {
+	for i, cond := range conditions {
+		kind, ok := ruleFields[cond.Field]
+		if !ok {
+			return fmt.Errorf("condition %d: unknown field '%s'", i+1, cond.Field)
+		}
+		if !containsString(ruleOps[kind], cond.Op) {
+			return fmt.Errorf("condition %d: %s supports %s", i+1, cond.Field, strings.Join(ruleOps[kind], ", "))
+		}
+		switch kind {
+		case "number":
+			if _, ok := cond.Value.(float64); !ok {
+				return fmt.Errorf("condition %d: %s needs a number", i+1, cond.Field)
+			}
+		case "bool":
+			if _, ok := cond.Value.(bool); !ok {
+				return fmt.Errorf("condition %d: %s needs true or false", i+1, cond.Field)
+			}
+		case "string", "tag":
+			s, ok := cond.Value.(string)
+			if !ok {
+				return fmt.Errorf("condition %d: %s needs a string", i+1, cond.Field)
+			}
+			if cond.Field == "column" && !repo.Crm().HasColumn(s) {
+				return fmt.Errorf("condition %d: unknown column '%s'", i+1, s)
+			}
+			if cond.Field == "lastDisposition" && s != "" && !isDisposition(s) {
+				return fmt.Errorf("condition %d: unknown disposition '%s'", i+1, s)
+			}
+			if cond.Field == "priority" && !containsString(priorities, s) {
+				return fmt.Errorf("condition %d: priority must be one of %s", i+1, strings.Join(priorities, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the action and clears the fields its type doesn't use.
+func (a *RuleAction) validate(repo *Repository) error {
+	switch a.Type {
+	case "move":
+		if !repo.Crm().HasColumn(a.Column) {
+			return fmt.Errorf("action: unknown column '%s'", a.Column)
+		}
+		a.Tag, a.Priority = "", ""
+	case "tag", "untag":
+		tag, err := crm.NormalizeTag(a.Tag)
+		if err != nil {
+			return fmt.Errorf("action: %v", err)
+		}
+		a.Tag, a.Column, a.Priority = tag, "", ""
+	case "priority":
+		if !containsString(priorities, a.Priority) {
+			return fmt.Errorf("action: priority must be one of %s", strings.Join(priorities, ", "))
+		}
+		a.Column, a.Tag = "", ""
+	default:
+		return fmt.Errorf("action type must be move, tag, untag or priority")
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleFacts is what conditions are evaluated against for one lead.
+type ruleFacts struct {
+	lead    *CrmLead
+	reached bool
+	now     time.Time
+}
+
+func (f ruleFacts) matches(cond RuleCondition) bool {
+	days := func(since *time.Time) (float64, bool) {
+		if since == nil {
+			return 0, false
+		}
+		return f.now.Sub(*since).Hours() / 24, true
+	}
+
+	switch cond.Field {
+	case "column":
+		return compareStrings(f.lead.ColumnID, cond.Op, cond.Value.(string))
+	case "lastDisposition":
+		return compareStrings(f.lead.LastDisposition, cond.Op, cond.Value.(string))
+	case "priority":
+		return compareStrings(f.lead.Priority, cond.Op, cond.Value.(string))
+	case "timesCalled":
+		return compareNumbers(float64(f.lead.TimesCalled), cond.Op, cond.Value.(float64))
+	case "daysSinceUpdate":
+		d, ok := days(f.lead.UpdatedAt)
+		return ok && compareNumbers(d, cond.Op, cond.Value.(float64))
+	case "daysSinceLastCall":
+		d, ok := days(f.lead.LastCalledAt)
+		return ok && compareNumbers(d, cond.Op, cond.Value.(float64))
+	case "reached":
+		return f.reached == cond.Value.(bool)
+	case "callbackOverdue":
+		overdue := f.lead.CallBackDate != nil && f.lead.CallBackDate.Before(f.now) &&
+			(f.lead.UpdatedAt == nil || !f.lead.UpdatedAt.After(*f.lead.CallBackDate))
+		return overdue == cond.Value.(bool)
+	case "hasEmail":
+		return (f.lead.Email != "") == cond.Value.(bool)
+	case "hasPhone":
+		return (f.lead.Phone != "") == cond.Value.(bool)
+	case "pageSpeed":
+		return f.lead.PageSpeed > 0 && compareNumbers(float64(f.lead.PageSpeed), cond.Op, cond.Value.(float64))
+	case "tag":
+		has := containsString(f.lead.Tags, cond.Value.(string))
+		return has == (cond.Op == "has")
+	}
+	return false
+}
+
+func compareStrings(a, op, b string) bool {
+	if op == "!=" {
+		return a != b
+	}
+	return a == b
+}
+
+func compareNumbers(a float64, op string, b float64) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+func (rule AutomationRule) matches(f ruleFacts) bool {
+	return f.matchesAll(rule.Conditions)
+}
+
+func (f ruleFacts) matchesAll(conditions []RuleCondition) bool {
+	for _, cond := range conditions {
+		if !f.matches(cond) {
+			return false
+		}
+	}
+	return true
+}
+
+// pending reports whether the rule's action would change the lead.
+func (a RuleAction) pending(lead *CrmLead) bool {
+	switch a.Type {
+	case "move":
+		return lead.ColumnID != a.Column
+	case "tag":
+		return !containsString(lead.Tags, a.Tag)
+	case "untag":
+		return containsString(lead.Tags, a.Tag)
+	case "priority":
+		return lead.Priority != a.Priority
+	}
+	return false
+}
+
+func (a RuleAction) String() string {
+	switch a.Type {
+	case "move":
+		return "move to " + a.Column
+	case "priority":
+		return "set priority " + a.Priority
+	}
+	return a.Type + " " + a.Tag
+}
+
+// applyAutomationRules runs an organization's enabled rules over its board
+// once and returns how many actions were taken. Rules run in the order they
+// were created, and each sees the changes made by the ones before it.
+// Cancelling ctx rolls the whole pass back.
+func applyAutomationRules(ctx context.Context, orgID int64) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	orgRepo := newRepository(Tenant{OrgID: orgID}).WithTx(tx)
+	rules, err := orgRepo.AutomationRules()
+	if err != nil {
+		return 0, err
+	}
+	leads, err := orgRepo.CrmLeads()
+	if err != nil {
+		return 0, err
+	}
+	reached, err := orgRepo.ReachedLeadIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	applied := 0
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		// Actions are attributed to whoever created the rule.
+		repo := newRepository(Tenant{OrgID: orgID, UserID: rule.CreatedBy}).WithTx(tx)
+		if rule.Action.Type == "move" && !repo.Crm().HasColumn(rule.Action.Column) {
+			continue
+		}
+		detail := func() map[string]interface{} {
+			return map[string]interface{}{"ruleId": rule.ID, "ruleName": rule.Name}
+		}
+
+		for i := range leads {
+			lead := &leads[i]
+			if !rule.Action.pending(lead) || !rule.matches(ruleFacts{lead: lead, reached: reached[lead.ID], now: now}) {
+				continue
+			}
+			// Full columns that reject moves are retried on the next pass.
+			done, err := rule.Action.apply(repo, lead, detail(), now)
+			if err == nil && done {
+				err = repo.LogRuleRun(rule.ID, lead.ID, rule.Action.String())
+			}
+			if err != nil {
+				return 0, fmt.Errorf("rule %s on lead %s: %w", rule.ID, lead.ID, err)
+			}
+			if done {
+				applied++
+			}
+		}
+	}
+
+	if applied > 0 {
+		if _, err := orgRepo.Crm().BumpVersion(); err != nil {
+			return 0, err
+		}
+	}
+	return applied, tx.Commit()
+}
+
+// apply takes the action on lead, updating it to match, and reports
+// whether it did: a move into a full column that rejects moves is skipped.
+func (a RuleAction) apply(repo *Repository, lead *CrmLead, detail map[string]interface{}, now time.Time) (bool, error) {
+	var err error
+	switch a.Type {
+	case "move":
+		wip, wipErr := repo.Crm().CheckWIP(a.Column, lead.ID)
+		if wipErr != nil {
+			return false, wipErr
+		}
+		if wip.Rejects() {
+			return false, nil
+		}
+		err = repo.moveCrmLead(lead.ID, a.Column, detail)
+		lead.ColumnID = a.Column
+		lead.UpdatedAt = &now
+	case "tag":
+		err = repo.AddCrmTag(lead.ID, a.Tag, detail)
+		lead.Tags = append(lead.Tags, a.Tag)
+	case "untag":
+		err = repo.RemoveCrmTag(lead.ID, a.Tag, detail)
+		lead.Tags = removeString(lead.Tags, a.Tag)
+	case "priority":
+		err = repo.SetCrmPriority(lead.ID, a.Priority, detail)
+		lead.Priority = a.Priority
+	}
+	return err == nil, err
+}
+
+func removeString(list []string, s string) []string {
+	out := list[:0]
+	for _, item := range list {
+		if item != s {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// runAllAutomationRules is the background job.
+func runAllAutomationRules() {
+	rows, err := db.Query("SELECT DISTINCT org_id FROM automation_rules WHERE enabled = 1")
+	if err != nil {
+		log.Printf("Failed to load organizations with automation rules: %v", err)
+		return
+	}
+	var orgIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Error scanning organization: %v", err)
+			continue
+		}
+		orgIDs = append(orgIDs, id)
+	}
+	rows.Close()
+
+	for _, orgID := range orgIDs {
+		applied, err := applyAutomationRules(context.Background(), orgID)
+		if err != nil {
+			log.Printf("Automation rules failed for organization %d: %v", orgID, err)
+			continue
+		}
+		if applied > 0 {
+			log.Printf("Automation rules took %d actions for organization %d", applied, orgID)
+		}
+	}
+}
+
+// --- AUTOMATION RULE HANDLERS ---
+func getAutomationRulesHandler(c *gin.Context) {
+	rules, err := repoFrom(c).AutomationRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load rules"})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func createAutomationRuleHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input automationRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(repo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	rule := AutomationRule{
+		ID:         uuid.New().String(),
+		Name:       input.Name,
+		Enabled:    input.Enabled == nil || *input.Enabled,
+		Conditions: input.Conditions,
+		Action:     input.Action,
+		CreatedBy:  repo.Tenant().UserID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := repo.CreateAutomationRule(rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rule"})
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+func updateAutomationRuleHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	ruleID := c.Param("ruleId")
+
+	var input automationRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(repo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := repo.UpdateAutomationRule(ruleID, input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update rule"})
+		return
+	}
+	rule, err := repo.AutomationRule(ruleID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load rule"})
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func deleteAutomationRuleHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteAutomationRule(c.Param("ruleId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete rule"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getAutomationRuleLogHandler lists recent rule executions, optionally for
+// one rule.
+func getAutomationRuleLogHandler(c *gin.Context) {
+	limit := RULE_LOG_DEFAULT_LIMIT
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+	runs, err := repoFrom(c).RuleRuns(c.Query("ruleId"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load rule log"})
+		return
+	}
+	c.JSON(http.StatusOK, runs)
+}
+
+// runAutomationRulesHandler evaluates the organization's rules now instead
+// of waiting for the next background pass.
+func runAutomationRulesHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	applied, err := applyAutomationRules(c.Request.Context(), repo.Tenant().OrgID)
+	if err != nil {
+		log.Printf("Automation rules failed for organization %d: %v", repo.Tenant().OrgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run rules"})
+		return
+	}
+	version, err := repo.Crm().Version()
+	if err == nil {
+		c.Header("ETag", crmETag(version))
+	}
+	c.JSON(http.StatusOK, gin.H{"applied": applied, "version": version})
+}
+
+func scanAutomationRule(row store.RowScanner) (AutomationRule, error) {
+	var rule AutomationRule
+	var conditions, action string
+	err := row.Scan(&rule.ID, &rule.Name, &rule.Enabled, &conditions, &action, &rule.CreatedBy, &rule.CreatedAt, &rule.UpdatedAt)
+	if err != nil {
+		return rule, err
+	}
+	if err := json.Unmarshal([]byte(conditions), &rule.Conditions); err != nil {
+		return rule, err
+	}
+	return rule, json.Unmarshal([]byte(action), &rule.Action)
+}
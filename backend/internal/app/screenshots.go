@@ -0,0 +1,275 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- WEBSITE SCREENSHOTS ---
+//
+// Each lead with a website gets a picture of its homepage after a search
+// finishes, so reps can glance at the prospect's site while they dial.
+// Pictures come from a screenshot API when SCREENSHOT_API_URL is set ({url}
+// in it is replaced with the site's escaped address), or else from headless
+// Chrome at SCREENSHOT_CHROME; with neither, screenshots are off. They're
+// kept as attachments, and a lead's or card's `screenshot` is the path to
+// fetch the image from.
+
+const SCREENSHOT_WORKERS = 2
+const SCREENSHOT_TIMEOUT = 25 * time.Second
+const SCREENSHOT_MAX_BYTES = 5 * 1024 * 1024
+
+var screenshotAPIURL = os.Getenv("SCREENSHOT_API_URL")
+var screenshotChrome = os.Getenv("SCREENSHOT_CHROME")
+
+var screenshotClient = &http.Client{Timeout: SCREENSHOT_TIMEOUT}
+
+// captureScreenshot takes the picture of a website; tests replace it.
+var captureScreenshot = captureWebsite
+
+func screenshotsEnabled() bool {
+	return screenshotAPIURL != "" || screenshotChrome != ""
+}
+
+func screenshotKey(leadID string) string {
+	return "screenshots/" + leadID
+}
+
+// captureWebsite returns a PNG or JPEG of the website's homepage.
+func captureWebsite(ctx context.Context, website string) ([]byte, error) {
+	if !strings.HasPrefix(website, "http://") && !strings.HasPrefix(website, "https://") {
+		website = "http://" + website
+	}
+	ctx, cancel := context.WithTimeout(ctx, SCREENSHOT_TIMEOUT)
+	defer cancel()
+
+	var image []byte
+	var err error
+	if screenshotAPIURL != "" {
+		image, err = captureWithAPI(ctx, website)
+	} else if screenshotChrome != "" {
+		image, err = captureWithChrome(ctx, website)
+	} else {
+		return nil, fmt.Errorf("screenshots are not configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kind := http.DetectContentType(image); kind != "image/png" && kind != "image/jpeg" {
+		return nil, fmt.Errorf("screenshot is %s, not an image", kind)
+	}
+	return image, nil
+}
+
+func captureWithAPI(ctx context.Context, website string) ([]byte, error) {
+	endpoint := strings.ReplaceAll(screenshotAPIURL, "{url}", url.QueryEscape(website))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := screenshotClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("screenshot API returned %s", resp.Status)
+	}
+	image, err := io.ReadAll(io.LimitReader(resp.Body, SCREENSHOT_MAX_BYTES+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > SCREENSHOT_MAX_BYTES {
+		return nil, fmt.Errorf("screenshot is over %d bytes", SCREENSHOT_MAX_BYTES)
+	}
+	return image, nil
+}
+
+func captureWithChrome(ctx context.Context, website string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "screenshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "page.png")
+	cmd := exec.CommandContext(ctx, screenshotChrome, "--headless=new", "--disable-gpu", "--no-sandbox", "--hide-scrollbars",
+		"--window-size=1280,800", "--user-data-dir="+dir, "--screenshot="+out, website)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("chrome failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.ReadFile(out)
+}
+
+// screenshotLead takes and stores the lead's screenshot. A lead is marked
+// as tried either way, so a site that won't load isn't tried after every
+// search.
+func screenshotLead(ctx context.Context, leadID, website string) error {
+	image, captureErr := captureScreenshot(ctx, website)
+	key := ""
+	if captureErr == nil {
+		key = screenshotKey(leadID)
+		if err := putAttachment(key, image); err != nil {
+			return fmt.Errorf("storing screenshot: %w", err)
+		}
+	}
+	// A failed retake keeps the picture there already.
+	_, err := db.ExecContext(ctx, "UPDATE leads SET screenshot = CASE WHEN ?1 = '' THEN screenshot ELSE ?1 END, screenshot_at = ?2 WHERE id = ?3", key, time.Now(), leadID)
+	if err != nil {
+		return err
+	}
+	return captureErr
+}
+
+// captureSearchScreenshots screenshots the search's leads that have a
+// website and haven't been tried yet, a few at a time.
+func captureSearchScreenshots(searchID string) {
+	if !screenshotsEnabled() {
+		return
+	}
+	rows, err := db.Query("SELECT id, website FROM leads WHERE search_id = ? AND deleted_at IS NULL AND screenshot_at IS NULL AND COALESCE(website, '') != ''", searchID)
+	if err != nil {
+		log.Printf("Failed to load leads to screenshot for search %s: %v", searchID, err)
+		return
+	}
+	type target struct{ id, website string }
+	var targets []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.id, &t.website); err != nil {
+			log.Printf("Error scanning lead to screenshot: %v", err)
+			continue
+		}
+		// A social profile isn't the business's own site.
+		if extractSocialProfiles(t.website).Empty() {
+			targets = append(targets, t)
+		}
+	}
+	rows.Close()
+
+	jobs := make(chan target)
+	var wg sync.WaitGroup
+	for i := 0; i < SCREENSHOT_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				if err := screenshotLead(context.Background(), t.id, t.website); err != nil {
+					log.Printf("Failed to screenshot website for lead %s: %v", t.id, err)
+				}
+			}
+		}()
+	}
+	for _, t := range targets {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+	log.Printf("Screenshotted %d leads for search %s", len(targets), searchID)
+}
+
+// screenshotResponse writes the image whose key is stored on the lead.
+func screenshotResponse(c *gin.Context, key string) {
+	if key == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No screenshot yet"})
+		return
+	}
+	image, err := readAttachment(key)
+	if os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No screenshot yet"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load screenshot"})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(http.StatusOK, http.DetectContentType(image), image)
+}
+
+func getLeadScreenshotHandler(c *gin.Context) {
+	lead, err := repoFrom(c).Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	key := ""
+	if lead.Screenshot != "" {
+		key = screenshotKey(lead.ID)
+	}
+	screenshotResponse(c, key)
+}
+
+// getCrmScreenshotHandler serves a card's screenshot, which stays on the
+// board after its lead is trashed.
+func getCrmScreenshotHandler(c *gin.Context) {
+	key, err := repoFrom(c).CrmScreenshot(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load screenshot"})
+		return
+	}
+	screenshotResponse(c, key)
+}
+
+// captureLeadScreenshotHandler takes the lead's screenshot again now, e.g.
+// after the business redesigns its site.
+func captureLeadScreenshotHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	lead, err := repo.Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	if !screenshotsEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Screenshots are not configured"})
+		return
+	}
+	if lead.Website == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The lead has no website"})
+		return
+	}
+
+	if err := screenshotLead(c.Request.Context(), lead.ID, lead.Website); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Screenshot failed", "details": err.Error()})
+		return
+	}
+	if lead, err = repo.Leads().Get(lead.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"screenshot": lead.Screenshot})
+}
+
+// deleteScreenshots removes the screenshots stored under the keys.
+func deleteScreenshots(keys []string) {
+	for _, key := range keys {
+		if err := deleteAttachment(key); err != nil {
+			log.Printf("Failed to delete screenshot %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- CALL SCRIPTS ---
+//
+// Scripts are plain text with {{variable}} placeholders that are filled in
+// from the lead when a rep opens the script on a CRM card. A fallback can
+// follow a pipe, as in {{companyName|your business}}, for leads that lack
+// the value.
+
+var scriptVariablePattern = regexp.MustCompile(`\{\{\s*([a-zA-Z]+)\s*(?:\|([^}]*))?\}\}`)
+
+// scriptVariables lists the placeholders a script may use.
+var scriptVariables = []string{
+	"companyName", "category", "address", "website", "phone", "email",
+	"rating", "reviewCount", "pageSpeed", "tech", "repName",
+}
+
+type CallScript struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type callScriptInput struct {
+	Name string `json:"name" binding:"required"`
+	Body string `json:"body" binding:"required"`
+}
+
+func (in callScriptInput) validate() error {
+	return validateScriptVariables(in.Body)
+}
+
+// validateScriptVariables rejects text with placeholders that aren't in
+// scriptVariables.
+func validateScriptVariables(text string) error {
+	known := make(map[string]bool, len(scriptVariables))
+	for _, v := range scriptVariables {
+		known[v] = true
+	}
+	for _, m := range scriptVariablePattern.FindAllStringSubmatch(text, -1) {
+		if !known[m[1]] {
+			return fmt.Errorf("unknown variable '%s'; available: %s", m[1], strings.Join(scriptVariables, ", "))
+		}
+	}
+	return nil
+}
+
+// scriptValues collects the placeholder values for one lead. Values the
+// lead doesn't have are left out rather than rendered as zero.
+func scriptValues(crmLead CrmLead, lead leads.Lead, repName string) map[string]string {
+	values := map[string]string{
+		"companyName": crmLead.CompanyName,
+		"category":    lead.Category,
+		"address":     lead.Address,
+		"website":     crmLead.Website,
+		"phone":       crmLead.Phone,
+		"email":       crmLead.Email,
+		"tech":        strings.Join(lead.Tech, ", "),
+		"repName":     repName,
+	}
+	if lead.Rating > 0 {
+		values["rating"] = strconv.FormatFloat(lead.Rating, 'f', 1, 64)
+	}
+	if lead.ReviewCount > 0 {
+		values["reviewCount"] = strconv.Itoa(lead.ReviewCount)
+	}
+	if crmLead.PageSpeed > 0 {
+		values["pageSpeed"] = strconv.Itoa(crmLead.PageSpeed)
+	}
+	return values
+}
+
+// renderScript substitutes values into body. missing lists variables that
+// had neither a value nor a fallback, so the UI can flag them.
+func renderScript(body string, values map[string]string) (rendered string, missing []string) {
+	seen := map[string]bool{}
+	rendered = scriptVariablePattern.ReplaceAllStringFunc(body, func(match string) string {
+		m := scriptVariablePattern.FindStringSubmatch(match)
+		if v := values[m[1]]; v != "" {
+			return v
+		}
+		if fallback := strings.TrimSpace(m[2]); fallback != "" {
+			return fallback
+		}
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			missing = append(missing, m[1])
+		}
+		return ""
+	})
+	sort.Strings(missing)
+	return rendered, missing
+}
+
+func getCallScriptsHandler(c *gin.Context) {
+	scripts, err := repoFrom(c).CallScripts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve call scripts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"scripts": scripts, "variables": scriptVariables})
+}
+
+func getCallScriptHandler(c *gin.Context) {
+	s, err := repoFrom(c).CallScript(c.Param("scriptId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call script not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load call script"})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func createCallScriptHandler(c *gin.Context) {
+	var input callScriptInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	s := CallScript{ID: uuid.New().String(), Name: input.Name, Body: input.Body, CreatedAt: now, UpdatedAt: now}
+	if err := repoFrom(c).CreateCallScript(s); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create call script"})
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+func updateCallScriptHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	scriptID := c.Param("scriptId")
+
+	var input callScriptInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := repo.UpdateCallScript(scriptID, input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call script not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update call script"})
+		return
+	}
+
+	s, err := repo.CallScript(scriptID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load call script"})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func deleteCallScriptHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteCallScript(c.Param("scriptId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call script not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete call script"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// renderCallScriptHandler returns a script personalized for a CRM lead.
+func renderCallScriptHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	leadID := c.Param("leadId")
+
+	crmLead, err := repo.Crm().Card(leadID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	script, err := repo.CallScript(c.Param("scriptId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call script not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load call script"})
+		return
+	}
+
+	// The source lead may since have been trashed; the CRM copy still renders.
+	lead, err := repo.Leads().Get(leadID)
+	if err != nil && err != store.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	var repName string
+	if err := db.QueryRowContext(c.Request.Context(), "SELECT name FROM users WHERE id = ?", repo.Tenant().UserID).Scan(&repName); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	rendered, missing := renderScript(script.Body, scriptValues(crmLead, lead, repName))
+	if missing == nil {
+		missing = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"scriptId": script.ID, "name": script.Name, "leadId": leadID, "rendered": rendered, "missing": missing})
+}
@@ -0,0 +1,368 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+)
+
+// --- SEARCH STATISTICS ---
+
+// SearchStats summarizes how callable a search's leads are. Percentages are
+// of the search's live leads. A lead counts as a duplicate when its phone or
+// domain matches a lead in another of the tenant's searches or an earlier
+// lead in the same one.
+type SearchStats struct {
+	Leads          int      `json:"leads"`
+	WithEmailPct   float64  `json:"withEmailPct"`
+	WithWebsitePct float64  `json:"withWebsitePct"`
+	WithPhonePct   float64  `json:"withPhonePct"`
+	AvgPageSpeed   *float64 `json:"avgPageSpeed"`
+	Duplicates     int      `json:"duplicates"`
+	DuplicateRate  float64  `json:"duplicateRate"`
+}
+
+// percentOf returns n as a percentage of total, to one decimal place.
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)*1000/float64(total)) / 10
+}
+
+func getSearchStatsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	searchID := c.Param("searchId")
+
+	if !repo.Searches().Owns(searchID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	stats, err := repo.SearchStats(searchID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute search statistics"})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// recordScraperRun saves the scraper process's exit code and how much
+// output it wrote.
+func recordScraperRun(searchID string, exitCode int, outputBytes int64) {
+	if _, err := db.Exec("UPDATE searches SET exit_code = ?, output_bytes = ? WHERE id = ?", exitCode, outputBytes, searchID); err != nil {
+		log.Printf("Failed to record scraper metrics for search %s: %v", searchID, err)
+	}
+}
+
+// searchService serves the request's tenant.
+func searchService(c *gin.Context) searches.Service {
+	return searches.NewService(repoFrom(c).Searches())
+}
+
+func getSearchHandler(c *gin.Context) {
+	search, err := searchService(c).Get(c.Param("searchId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load search"})
+		return
+	}
+	c.JSON(http.StatusOK, search)
+}
+
+// --- RE-RUNS ---
+//
+// Re-running a search scrapes the same query again as a new search that
+// remembers the one it re-ran. Once its leads are in, each is marked new
+// or already known against every earlier run in the chain, deleted leads
+// included, so a periodic re-scrape of a territory surfaces only the
+// businesses that weren't there before.
+
+// rerunSearchHandler starts a fresh run of a search's query.
+func rerunSearchHandler(c *gin.Context) {
+	previous, err := searchService(c).Get(c.Param("searchId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load search"})
+		return
+	}
+	if previous.Running() {
+		c.JSON(http.StatusConflict, gin.H{"error": "This search is still running"})
+		return
+	}
+	launchSearch(c, searches.Search{Keyword: previous.Keyword, Source: previous.Source, Location: previous.Location, RerunOf: previous.ID})
+}
+
+// businessKey identifies a lead with no phone or website to match on by
+// its name and address.
+func businessKey(name, address string) string {
+	name, address = strings.ToLower(strings.TrimSpace(name)), strings.ToLower(strings.TrimSpace(address))
+	if name == "" || address == "" {
+		return ""
+	}
+	return name + "|" + address
+}
+
+// markNewLeads flags each lead of a re-run search as new or already known
+// and records how many were new. Searches that aren't re-runs are left
+// alone.
+func markNewLeads(tx *sql.Tx, searchID string) error {
+	var rerunOf sql.NullString
+	if err := tx.QueryRow("SELECT rerun_of FROM searches WHERE id = ?", searchID).Scan(&rerunOf); err != nil || !rerunOf.Valid {
+		return err
+	}
+
+	rows, err := tx.Query(`
+        WITH RECURSIVE runs(id) AS (
+            SELECT ?
+            UNION
+            SELECT s.rerun_of FROM searches s JOIN runs ON s.id = runs.id WHERE s.rerun_of IS NOT NULL
+        )
+        SELECT id, COALESCE(phone, ''), COALESCE(website, ''), COALESCE(company_name, ''), COALESCE(address, '')
+        FROM leads WHERE search_id IN (SELECT id FROM runs)
+    `, rerunOf.String)
+	if err != nil {
+		return err
+	}
+	known, names := newDuplicateIndex(), map[string]bool{}
+	for rows.Next() {
+		var id, phone, website, name, address string
+		if err := rows.Scan(&id, &phone, &website, &name, &address); err != nil {
+			rows.Close()
+			return err
+		}
+		known.add(id, unseal(phone), website)
+		if key := businessKey(name, address); key != "" {
+			names[key] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.Query("SELECT id, COALESCE(phone, ''), COALESCE(website, ''), COALESCE(company_name, ''), COALESCE(address, '') FROM leads WHERE search_id = ?", searchID)
+	if err != nil {
+		return err
+	}
+	isNew := map[string]bool{}
+	for rows.Next() {
+		var id, phone, website, name, address string
+		if err := rows.Scan(&id, &phone, &website, &name, &address); err != nil {
+			rows.Close()
+			return err
+		}
+		_, _, seen := known.match(id, unseal(phone), website)
+		key := businessKey(name, address)
+		isNew[id] = !seen && (key == "" || !names[key])
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	count := 0
+	for id, n := range isNew {
+		if _, err := tx.Exec("UPDATE leads SET is_new = ? WHERE id = ?", n, id); err != nil {
+			return err
+		}
+		if n {
+			count++
+		}
+	}
+	_, err = tx.Exec("UPDATE searches SET new_leads = ? WHERE id = ?", count, searchID)
+	return err
+}
+
+// --- SEARCH DETAILS ---
+//
+// Besides the keyword it was run with, a search can have a title, notes
+// and labels to tell it apart. Labels are shared across the tenant's
+// searches; each has a color, picked from a palette until someone sets
+// one.
+
+// updateSearchHandler sets a search's title, notes or labels; fields left
+// out are unchanged, and labels replace the current set.
+func updateSearchHandler(c *gin.Context) {
+	var input searches.Update
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	search, err := searchService(c).Update(c.Param("searchId"), input)
+	respondSearch(c, search, err, "Failed to update search")
+}
+
+// respondSearch writes a search the service returned, or its error.
+func respondSearch(c *gin.Context, search searches.Search, err error, failure string) {
+	var invalid searches.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+	case err == store.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search not found"})
+	case err == searches.ErrRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": "This search is still running"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": failure})
+	default:
+		c.JSON(http.StatusOK, search)
+	}
+}
+
+func getSearchLabelsHandler(c *gin.Context) {
+	labels, err := searchService(c).Labels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve labels"})
+		return
+	}
+	c.JSON(http.StatusOK, labels)
+}
+
+// updateSearchLabelHandler sets a label's color, as #rrggbb.
+func updateSearchLabelHandler(c *gin.Context) {
+	var input struct {
+		Color string `json:"color" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	label, err := searchService(c).SetLabelColor(c.Param("label"), input.Color)
+	var invalid searches.ValidationError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update label"})
+		return
+	}
+	c.JSON(http.StatusOK, label)
+}
+
+// --- ARCHIVE ---
+//
+// Archiving takes a finished search off the default searches list without
+// touching its leads, which can still be listed and imported.
+
+func archiveSearchHandler(c *gin.Context) {
+	search, err := searchService(c).Archive(c.Param("searchId"), true)
+	respondSearch(c, search, err, "Failed to update search")
+}
+
+func unarchiveSearchHandler(c *gin.Context) {
+	search, err := searchService(c).Archive(c.Param("searchId"), false)
+	respondSearch(c, search, err, "Failed to update search")
+}
+
+// --- SEARCH LOGS ---
+//
+// Each search keeps a log of how its scrape went: our own progress and
+// failure lines, and whatever the scraper printed. Only the most recent
+// SEARCH_LOG_MAX_BYTES are kept, since the end is where failures show.
+
+var searchLogMaxBytes = envInt("SEARCH_LOG_MAX_BYTES", 64*1024)
+
+// appendSearchLog adds text to the search's log, dropping the oldest
+// output once it's over the cap.
+func appendSearchLog(searchID, text string) {
+	if text == "" {
+		return
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	var current string
+	var truncated bool
+	err := db.QueryRow("SELECT output, truncated FROM search_logs WHERE search_id = ?", searchID).Scan(&current, &truncated)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to load log for search %s: %v", searchID, err)
+		return
+	}
+	output := current + text
+	if len(output) > searchLogMaxBytes {
+		output = strings.ToValidUTF8(output[len(output)-searchLogMaxBytes:], "")
+		truncated = true
+	}
+	_, err = db.Exec(`
+        INSERT INTO search_logs (search_id, output, truncated, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+        ON CONFLICT (search_id) DO UPDATE SET output = excluded.output, truncated = excluded.truncated, updated_at = excluded.updated_at
+    `, searchID, output, truncated)
+	if err != nil {
+		log.Printf("Failed to save log for search %s: %v", searchID, err)
+	}
+}
+
+// searchLogf writes a line to both the server log and the search's log.
+func searchLogf(searchID, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	log.Print(line)
+	appendSearchLog(searchID, time.Now().UTC().Format(time.RFC3339)+" "+line)
+}
+
+// searchLog is the scraper.Log a provider reports to while it runs the
+// search with this ID.
+type searchLog string
+
+func (id searchLog) Printf(format string, args ...interface{}) {
+	searchLogf(string(id), format, args...)
+}
+
+func (id searchLog) Output(text string) {
+	appendSearchLog(string(id), text)
+}
+
+func (id searchLog) Exited(exitCode int, outputBytes int64) {
+	recordScraperRun(string(id), exitCode, outputBytes)
+}
+
+// SEARCH_ERROR_SAMPLES is how many skipped rows a search keeps errors for.
+const SEARCH_ERROR_SAMPLES = 5
+
+// logSkippedLeads notes in the search's log how many scraped rows were
+// skipped, with the sample errors.
+func logSkippedLeads(searchID string, skipped int, samples []string) {
+	if skipped == 0 {
+		return
+	}
+	searchLogf(searchID, "Skipped %d leads for search %s that could not be stored", skipped, searchID)
+	for _, s := range samples {
+		searchLogf(searchID, "Skipped lead %s", s)
+	}
+}
+
+// failSearch logs why a search failed and marks it so.
+func failSearch(searchID, format string, args ...interface{}) {
+	searchLogf(searchID, format, args...)
+	updateSearchStatus(searchID, "Failed")
+}
+
+func getSearchLogsHandler(c *gin.Context) {
+	l, err := searchService(c).Log(c.Param("searchId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load search log"})
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
@@ -0,0 +1,335 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- SEGMENTS ---
+//
+// A segment is a named list of conditions on the board's cards, in the
+// automation rules' terms ("pageSpeed > 70 and hasEmail == false and
+// column == tobe-called"). Nothing is stored per card: membership is
+// worked out whenever a segment is used, so it follows the board as it
+// changes. A segment can be listed, exported as CSV, given a bulk action
+// (any rule action) and picked as a campaign's audience. Snoozed cards are
+// never members, as they're out of rules' reach too.
+
+const MAX_SEGMENT_CONDITIONS = 20
+
+type Segment struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Conditions []RuleCondition `json:"conditions"`
+	// Members is how many cards are in the segment right now.
+	Members   int       `json:"members"`
+	CreatedBy int64     `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type segmentInput struct {
+	Name       string          `json:"name" binding:"required"`
+	Conditions []RuleCondition `json:"conditions" binding:"required"`
+}
+
+func (in *segmentInput) validate(repo *Repository, fe fieldErrors) {
+	in.Name = strings.TrimSpace(in.Name)
+	checkLength(fe, "name", in.Name, 1, 100)
+	fe.check(len(in.Conditions) >= 1 && len(in.Conditions) <= MAX_SEGMENT_CONDITIONS, "conditions", fmt.Sprintf("must have between 1 and %d conditions", MAX_SEGMENT_CONDITIONS))
+	if err := validateRuleConditions(repo, in.Conditions); err != nil {
+		fe.check(false, "conditions", err.Error())
+	}
+}
+
+// segmentBoard is the board as segments see it, loaded once to evaluate
+// any number of them.
+type segmentBoard struct {
+	leads   []CrmLead
+	reached map[string]bool
+	now     time.Time
+}
+
+func loadSegmentBoard(repo *Repository) (*segmentBoard, error) {
+	leads, err := repo.CrmLeads()
+	if err != nil {
+		return nil, err
+	}
+	reached, err := repo.ReachedLeadIDs()
+	if err != nil {
+		return nil, err
+	}
+	return &segmentBoard{leads: leads, reached: reached, now: time.Now()}, nil
+}
+
+// members returns the cards in the segment, by company name.
+func (b *segmentBoard) members(s Segment) []CrmLead {
+	members := []CrmLead{}
+	for i := range b.leads {
+		lead := &b.leads[i]
+		if (ruleFacts{lead: lead, reached: b.reached[lead.ID], now: b.now}).matchesAll(s.Conditions) {
+			members = append(members, *lead)
+		}
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return strings.ToLower(members[i].CompanyName) < strings.ToLower(members[j].CompanyName)
+	})
+	return members
+}
+
+// segmentMembers returns the cards in the tenant's segment right now.
+func segmentMembers(repo *Repository, segmentID string) (Segment, []CrmLead, error) {
+	s, err := repo.Segment(segmentID)
+	if err != nil {
+		return s, nil, err
+	}
+	board, err := loadSegmentBoard(repo)
+	if err != nil {
+		return s, nil, err
+	}
+	members := board.members(s)
+	s.Members = len(members)
+	return s, members, nil
+}
+
+// segmentResponse loads the segment and its members, writing the error
+// response when it isn't the organization's.
+func segmentResponse(c *gin.Context, repo *Repository) (Segment, []CrmLead, bool) {
+	s, members, err := segmentMembers(repo, c.Param("segmentId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return s, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load segment"})
+		return s, nil, false
+	}
+	return s, members, true
+}
+
+// listSegmentsHandler returns the organization's segments with their
+// member counts.
+func listSegmentsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	segments, err := repo.Segments()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load segments"})
+		return
+	}
+	if len(segments) > 0 {
+		board, err := loadSegmentBoard(repo)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load segments"})
+			return
+		}
+		for i := range segments {
+			segments[i].Members = len(board.members(segments[i]))
+		}
+	}
+	c.JSON(http.StatusOK, segments)
+}
+
+func getSegmentHandler(c *gin.Context) {
+	if s, _, ok := segmentResponse(c, repoFrom(c)); ok {
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+func createSegmentHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input segmentInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(repo, fe)
+	if fe.respond(c) {
+		return
+	}
+
+	now := time.Now().UTC()
+	s := Segment{ID: uuid.New().String(), Name: input.Name, Conditions: input.Conditions, CreatedBy: repo.Tenant().UserID, CreatedAt: now, UpdatedAt: now}
+	if err := repo.CreateSegment(s); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create segment"})
+		return
+	}
+	s, _, err := segmentMembers(repo, s.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load segment"})
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+func updateSegmentHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input segmentInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(repo, fe)
+	if fe.respond(c) {
+		return
+	}
+	err := repo.UpdateSegment(c.Param("segmentId"), input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update segment"})
+		return
+	}
+	if s, _, ok := segmentResponse(c, repo); ok {
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+// deleteSegmentHandler deletes a segment no draft campaign is waiting to
+// send to.
+func deleteSegmentHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	segmentID := c.Param("segmentId")
+	inUse, err := repo.SegmentInDraftCampaign(segmentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete segment"})
+		return
+	}
+	if inUse {
+		c.JSON(http.StatusConflict, gin.H{"error": "A draft campaign uses this segment"})
+		return
+	}
+	err = repo.DeleteSegment(segmentID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete segment"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func getSegmentLeadsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	fields, err := requestedFields(c, CrmLead{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	_, members, ok := segmentResponse(c, repo)
+	if !ok {
+		return
+	}
+	body, err := fields.trimList(members)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load segment"})
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// exportSegmentHandler downloads the segment's cards as CSV.
+func exportSegmentHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	s, members, ok := segmentResponse(c, repo)
+	if !ok {
+		return
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"Company", "Phone", "Email", "Website", "Column", "Tags", "Priority", "Times called", "Last called"})
+	for _, l := range members {
+		lastCalled := ""
+		if l.LastCalledAt != nil {
+			lastCalled = l.LastCalledAt.UTC().Format(time.RFC3339)
+		}
+		w.Write([]string{
+			csvCell(l.CompanyName), csvCell(l.Phone), csvCell(l.Email), csvCell(l.Website), l.ColumnID,
+			csvCell(strings.Join(l.Tags, ", ")), l.Priority, strconv.Itoa(l.TimesCalled), lastCalled,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export segment"})
+		return
+	}
+	log.Printf("User %d exported segment %s (%d leads)", repo.Tenant().UserID, s.ID, len(members))
+	filename := fmt.Sprintf("segment-%s.csv", time.Now().UTC().Format("2006-01-02"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// csvCell keeps a value from being read as a formula by spreadsheet apps.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// segmentActionHandler takes a rule action ({"type": "tag", "tag": ...})
+// on every card in the segment at once. Cards the action wouldn't change,
+// and moves into a full column that rejects them, are skipped.
+func segmentActionHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var action RuleAction
+	if !bindJSON(c, &action) {
+		return
+	}
+	if err := action.validate(repo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s, members, ok := segmentResponse(c, repo)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+	now := time.Now()
+	applied := 0
+	for i := range members {
+		lead := &members[i]
+		if !action.pending(lead) {
+			continue
+		}
+		done, err := action.apply(txRepo, lead, map[string]interface{}{"segmentId": s.ID, "segmentName": s.Name}, now)
+		if err != nil {
+			log.Printf("Segment action %s failed on lead %s: %v", action, lead.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update segment's leads"})
+			return
+		}
+		if done {
+			applied++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update segment's leads"})
+		return
+	}
+	if applied > 0 {
+		crmChanged(c, repo)
+	}
+	c.JSON(http.StatusOK, gin.H{"applied": applied, "skipped": len(members) - applied})
+}
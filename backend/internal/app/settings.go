@@ -0,0 +1,293 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezone settings must work on hosts without a zoneinfo database
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- USER SETTINGS ---
+type UserSettings struct {
+	GooglePlacesAPIKey string `json:"googlePlacesApiKey"`
+	Timezone           string `json:"timezone"`
+	DigestEnabled      bool   `json:"digestEnabled"`
+	DigestHour         int    `json:"digestHour"`
+	StaleAfterDays     int    `json:"staleAfterDays"`
+
+	EmailVerifier             string `json:"emailVerifier"`
+	EmailVerifierAPIKey       string `json:"emailVerifierApiKey"`
+	EmailVerifierMonthlyLimit int    `json:"emailVerifierMonthlyLimit"`
+
+	PhoneLookupProvider string `json:"phoneLookupProvider"`
+	PhoneLookupAPIKey   string `json:"phoneLookupApiKey"`
+
+	FirmographicsProvider string `json:"firmographicsProvider"`
+	FirmographicsAPIKey   string `json:"firmographicsApiKey"`
+
+	// Hours in each business's local time when it may be called.
+	CallingHoursStart int  `json:"callingHoursStart"`
+	CallingHoursEnd   int  `json:"callingHoursEnd"`
+	CallOnWeekends    bool `json:"callOnWeekends"`
+
+	// WeeklySummary is off, me or team; see weekly.go.
+	WeeklySummary string `json:"weeklySummary"`
+
+	// DailyDialGoal is how many calls the user aims to make a day, 0 for
+	// no target.
+	DailyDialGoal int `json:"dailyDialGoal"`
+
+	// SearchWebhookURL gets a signed POST when a search finishes; see
+	// webhooks.go.
+	SearchWebhookURL    string `json:"searchWebhookUrl"`
+	SearchWebhookSecret string `json:"searchWebhookSecret"`
+}
+
+var defaultUserSettings = UserSettings{Timezone: "UTC", DigestEnabled: true, DigestHour: 8, StaleAfterDays: 7, EmailVerifier: DEFAULT_EMAIL_VERIFIER,
+	CallingHoursStart: 9, CallingHoursEnd: 17, WeeklySummary: WEEKLY_SUMMARY_OFF}
+
+func getUserSettings(ctx context.Context, userID int64) (UserSettings, error) {
+	s := defaultUserSettings
+	err := db.QueryRowContext(ctx, `
+        SELECT google_places_api_key, timezone, digest_enabled, digest_hour, stale_after_days,
+               email_verifier, email_verifier_api_key, email_verifier_monthly_limit,
+               phone_lookup_provider, phone_lookup_api_key, calling_hours_start, calling_hours_end, call_on_weekends,
+               weekly_summary, daily_dial_goal, search_webhook_url, search_webhook_secret, firmographics_provider, firmographics_api_key
+        FROM user_settings WHERE user_id = ?
+    `, userID).Scan(&s.GooglePlacesAPIKey, &s.Timezone, &s.DigestEnabled, &s.DigestHour, &s.StaleAfterDays,
+		&s.EmailVerifier, &s.EmailVerifierAPIKey, &s.EmailVerifierMonthlyLimit,
+		&s.PhoneLookupProvider, &s.PhoneLookupAPIKey, &s.CallingHoursStart, &s.CallingHoursEnd, &s.CallOnWeekends,
+		&s.WeeklySummary, &s.DailyDialGoal, &s.SearchWebhookURL, &s.SearchWebhookSecret, &s.FirmographicsProvider, &s.FirmographicsAPIKey)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	return s, err
+}
+
+// placesAPIKey is the Google Places key the user saved, for the Places
+// source.
+func placesAPIKey(ctx context.Context, userID int64) (string, error) {
+	settings, err := getUserSettings(ctx, userID)
+	return settings.GooglePlacesAPIKey, err
+}
+
+// location returns the user's timezone, falling back to UTC if it has
+// become unknown.
+func (s UserSettings) location() *time.Location {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// maskSecret hides all but the last four characters of an API key.
+func maskSecret(secret string) string {
+	if len(secret) <= 4 {
+		return strings.Repeat("*", len(secret))
+	}
+	return strings.Repeat("*", len(secret)-4) + secret[len(secret)-4:]
+}
+
+func getSettingsHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	settings, err := getUserSettings(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	settings.GooglePlacesAPIKey = maskSecret(settings.GooglePlacesAPIKey)
+	settings.EmailVerifierAPIKey = maskSecret(settings.EmailVerifierAPIKey)
+	settings.PhoneLookupAPIKey = maskSecret(settings.PhoneLookupAPIKey)
+	settings.FirmographicsAPIKey = maskSecret(settings.FirmographicsAPIKey)
+	settings.SearchWebhookSecret = maskSecret(settings.SearchWebhookSecret)
+	c.JSON(http.StatusOK, settings)
+}
+
+func updateSettingsHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	var input struct {
+		GooglePlacesAPIKey *string `json:"googlePlacesApiKey"`
+		Timezone           *string `json:"timezone"`
+		DigestEnabled      *bool   `json:"digestEnabled"`
+		DigestHour         *int    `json:"digestHour"`
+		StaleAfterDays     *int    `json:"staleAfterDays"`
+
+		EmailVerifier             *string `json:"emailVerifier"`
+		EmailVerifierAPIKey       *string `json:"emailVerifierApiKey"`
+		EmailVerifierMonthlyLimit *int    `json:"emailVerifierMonthlyLimit"`
+
+		PhoneLookupProvider *string `json:"phoneLookupProvider"`
+		PhoneLookupAPIKey   *string `json:"phoneLookupApiKey"`
+
+		FirmographicsProvider *string `json:"firmographicsProvider"`
+		FirmographicsAPIKey   *string `json:"firmographicsApiKey"`
+
+		CallingHoursStart *int  `json:"callingHoursStart"`
+		CallingHoursEnd   *int  `json:"callingHoursEnd"`
+		CallOnWeekends    *bool `json:"callOnWeekends"`
+
+		WeeklySummary *string `json:"weeklySummary"`
+		DailyDialGoal *int    `json:"dailyDialGoal"`
+
+		SearchWebhookURL    *string `json:"searchWebhookUrl"`
+		SearchWebhookSecret *string `json:"searchWebhookSecret"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	settings, err := getUserSettings(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	if input.GooglePlacesAPIKey != nil {
+		settings.GooglePlacesAPIKey = strings.TrimSpace(*input.GooglePlacesAPIKey)
+	}
+	if input.Timezone != nil {
+		if _, err := time.LoadLocation(*input.Timezone); err != nil || *input.Timezone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timezone must be an IANA name such as Europe/London"})
+			return
+		}
+		settings.Timezone = *input.Timezone
+	}
+	if input.DigestEnabled != nil {
+		settings.DigestEnabled = *input.DigestEnabled
+	}
+	if input.DigestHour != nil {
+		if *input.DigestHour < 0 || *input.DigestHour > 23 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "digestHour must be between 0 and 23"})
+			return
+		}
+		settings.DigestHour = *input.DigestHour
+	}
+	if input.StaleAfterDays != nil {
+		if *input.StaleAfterDays < 1 || *input.StaleAfterDays > 365 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "staleAfterDays must be between 1 and 365"})
+			return
+		}
+		settings.StaleAfterDays = *input.StaleAfterDays
+	}
+	if input.EmailVerifier != nil {
+		if _, ok := emailVerifiers[*input.EmailVerifier]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown emailVerifier; see GET /api/verifiers"})
+			return
+		}
+		settings.EmailVerifier = *input.EmailVerifier
+	}
+	if input.EmailVerifierAPIKey != nil {
+		settings.EmailVerifierAPIKey = strings.TrimSpace(*input.EmailVerifierAPIKey)
+	}
+	if input.EmailVerifierMonthlyLimit != nil {
+		if *input.EmailVerifierMonthlyLimit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "emailVerifierMonthlyLimit cannot be negative"})
+			return
+		}
+		settings.EmailVerifierMonthlyLimit = *input.EmailVerifierMonthlyLimit
+	}
+	if input.PhoneLookupProvider != nil {
+		if _, ok := phoneLookupProviders[*input.PhoneLookupProvider]; !ok && *input.PhoneLookupProvider != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown phoneLookupProvider; see GET /api/phone-lookup-providers"})
+			return
+		}
+		settings.PhoneLookupProvider = *input.PhoneLookupProvider
+	}
+	if input.PhoneLookupAPIKey != nil {
+		settings.PhoneLookupAPIKey = strings.TrimSpace(*input.PhoneLookupAPIKey)
+	}
+	if input.FirmographicsProvider != nil {
+		if _, ok := firmographicsProviders[*input.FirmographicsProvider]; !ok && *input.FirmographicsProvider != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown firmographicsProvider; see GET /api/firmographics-providers"})
+			return
+		}
+		settings.FirmographicsProvider = *input.FirmographicsProvider
+	}
+	if input.FirmographicsAPIKey != nil {
+		settings.FirmographicsAPIKey = strings.TrimSpace(*input.FirmographicsAPIKey)
+	}
+	if input.CallingHoursStart != nil {
+		settings.CallingHoursStart = *input.CallingHoursStart
+	}
+	if input.CallingHoursEnd != nil {
+		settings.CallingHoursEnd = *input.CallingHoursEnd
+	}
+	if settings.CallingHoursStart < 0 || settings.CallingHoursEnd > 24 || settings.CallingHoursStart >= settings.CallingHoursEnd {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "callingHoursStart must be before callingHoursEnd, both between 0 and 24"})
+		return
+	}
+	if input.CallOnWeekends != nil {
+		settings.CallOnWeekends = *input.CallOnWeekends
+	}
+	if input.WeeklySummary != nil {
+		switch *input.WeeklySummary {
+		case WEEKLY_SUMMARY_OFF, WEEKLY_SUMMARY_ME, WEEKLY_SUMMARY_TEAM:
+			settings.WeeklySummary = *input.WeeklySummary
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "weeklySummary must be off, me or team"})
+			return
+		}
+	}
+	if input.DailyDialGoal != nil {
+		if *input.DailyDialGoal < 0 || *input.DailyDialGoal > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "dailyDialGoal must be between 0 and 1000"})
+			return
+		}
+		settings.DailyDialGoal = *input.DailyDialGoal
+	}
+	if input.SearchWebhookURL != nil {
+		settings.SearchWebhookURL = strings.TrimSpace(*input.SearchWebhookURL)
+		if settings.SearchWebhookURL != "" {
+			if problem := checkWebhookURL(settings.SearchWebhookURL); problem != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+				return
+			}
+		}
+	}
+	if input.SearchWebhookSecret != nil {
+		settings.SearchWebhookSecret = strings.TrimSpace(*input.SearchWebhookSecret)
+	}
+	if settings.SearchWebhookURL != "" && len(settings.SearchWebhookSecret) < MIN_WEBHOOK_SECRET_LENGTH {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("searchWebhookSecret must be at least %d characters", MIN_WEBHOOK_SECRET_LENGTH)})
+		return
+	}
+
+	_, err = db.ExecContext(c.Request.Context(), `
+        INSERT INTO user_settings (user_id, google_places_api_key, timezone, digest_enabled, digest_hour, stale_after_days,
+            email_verifier, email_verifier_api_key, email_verifier_monthly_limit,
+            phone_lookup_provider, phone_lookup_api_key, calling_hours_start, calling_hours_end, call_on_weekends,
+            weekly_summary, daily_dial_goal, search_webhook_url, search_webhook_secret, firmographics_provider, firmographics_api_key)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(user_id) DO UPDATE SET google_places_api_key = excluded.google_places_api_key, timezone = excluded.timezone,
+            digest_enabled = excluded.digest_enabled, digest_hour = excluded.digest_hour, stale_after_days = excluded.stale_after_days,
+            email_verifier = excluded.email_verifier, email_verifier_api_key = excluded.email_verifier_api_key,
+            email_verifier_monthly_limit = excluded.email_verifier_monthly_limit,
+            phone_lookup_provider = excluded.phone_lookup_provider, phone_lookup_api_key = excluded.phone_lookup_api_key,
+            calling_hours_start = excluded.calling_hours_start, calling_hours_end = excluded.calling_hours_end,
+            call_on_weekends = excluded.call_on_weekends, weekly_summary = excluded.weekly_summary,
+            daily_dial_goal = excluded.daily_dial_goal, search_webhook_url = excluded.search_webhook_url,
+            search_webhook_secret = excluded.search_webhook_secret, firmographics_provider = excluded.firmographics_provider,
+            firmographics_api_key = excluded.firmographics_api_key
+    `, userID, settings.GooglePlacesAPIKey, settings.Timezone, settings.DigestEnabled, settings.DigestHour, settings.StaleAfterDays,
+		settings.EmailVerifier, settings.EmailVerifierAPIKey, settings.EmailVerifierMonthlyLimit,
+		settings.PhoneLookupProvider, settings.PhoneLookupAPIKey, settings.CallingHoursStart, settings.CallingHoursEnd, settings.CallOnWeekends,
+		settings.WeeklySummary, settings.DailyDialGoal, settings.SearchWebhookURL, settings.SearchWebhookSecret,
+		settings.FirmographicsProvider, settings.FirmographicsAPIKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings", "details": err.Error()})
+		return
+	}
+
+	settings.GooglePlacesAPIKey = maskSecret(settings.GooglePlacesAPIKey)
+	settings.EmailVerifierAPIKey = maskSecret(settings.EmailVerifierAPIKey)
+	settings.PhoneLookupAPIKey = maskSecret(settings.PhoneLookupAPIKey)
+	settings.FirmographicsAPIKey = maskSecret(settings.FirmographicsAPIKey)
+	settings.SearchWebhookSecret = maskSecret(settings.SearchWebhookSecret)
+	c.JSON(http.StatusOK, settings)
+}
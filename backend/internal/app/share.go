@@ -0,0 +1,357 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- SHARE LINKS ---
+//
+// A share link lets a prospect open a card's audit report, or a summary of
+// their business as we see it, without an account: /share/<token> shows
+// the page under the branding of whoever made the link. A link can expire
+// after a number of days and can be revoked at any time, after which it
+// stops working for good. Views are counted, and the first is logged on
+// the card as share_viewed so the rep knows the prospect has looked.
+
+const (
+	SHARE_AUDIT_REPORT = "audit_report"
+	SHARE_LEAD_SUMMARY = "lead_summary"
+
+	MAX_SHARE_EXPIRY_DAYS = 365
+)
+
+var shareKinds = []string{SHARE_AUDIT_REPORT, SHARE_LEAD_SUMMARY}
+
+// shareURL is this server's public /share/ address, which links are built
+// on.
+var shareURL = envOrDefault("SHARE_URL", "http://localhost:8080/share/")
+
+type ShareLink struct {
+	ID     string `json:"id"`
+	LeadID string `json:"leadId"`
+	// Kind is audit_report or lead_summary.
+	Kind      string     `json:"kind"`
+	URL       string     `json:"url"`
+	CreatedBy int64      `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	Views     int        `json:"views"`
+
+	LastViewedAt *time.Time `json:"lastViewedAt"`
+
+	token string
+	orgID int64
+}
+
+// active reports whether the link still opens.
+func (l ShareLink) active(now time.Time) bool {
+	return l.RevokedAt == nil && (l.ExpiresAt == nil || now.Before(*l.ExpiresAt))
+}
+
+func newShareToken() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// shareCard loads the card in :leadId, writing the error response when it
+// isn't on the board.
+func shareCard(c *gin.Context, repo *Repository) (CrmLead, bool) {
+	card, err := repo.Crm().Card(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return card, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return card, false
+	}
+	return card, true
+}
+
+func listShareLinksHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	card, ok := shareCard(c, repo)
+	if !ok {
+		return
+	}
+	links, err := repo.ShareLinks(card.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load share links"})
+		return
+	}
+	c.JSON(http.StatusOK, links)
+}
+
+// createShareLinkHandler makes a link to the card's audit report or
+// summary. expiresInDays is optional; without it the link lasts until it's
+// revoked. A site shared before it's been audited is audited now, so the
+// prospect never waits on Lighthouse.
+func createShareLinkHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Kind          string `json:"kind" binding:"required"`
+		ExpiresInDays *int   `json:"expiresInDays"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	fe.check(containsString(shareKinds, input.Kind), "kind", "must be one of "+strings.Join(shareKinds, ", "))
+	if input.ExpiresInDays != nil {
+		fe.check(*input.ExpiresInDays >= 1 && *input.ExpiresInDays <= MAX_SHARE_EXPIRY_DAYS, "expiresInDays", fmt.Sprintf("must be between 1 and %d", MAX_SHARE_EXPIRY_DAYS))
+	}
+	if fe.respond(c) {
+		return
+	}
+	card, ok := shareCard(c, repo)
+	if !ok {
+		return
+	}
+	if input.Kind == SHARE_AUDIT_REPORT {
+		if card.Website == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The lead has no website"})
+			return
+		}
+		_, err := repo.LeadAudit(card.ID)
+		if err == store.ErrNotFound {
+			if _, err := auditLead(c.Request.Context(), card.ID, card.Website); err != nil {
+				log.Printf("Failed to audit website for lead %s: %v", card.ID, err)
+			}
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+			return
+		}
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+	now := time.Now().UTC()
+	link := ShareLink{ID: uuid.New().String(), LeadID: card.ID, Kind: input.Kind, URL: shareURL + token, CreatedBy: repo.Tenant().UserID, CreatedAt: now, token: token}
+	if input.ExpiresInDays != nil {
+		expires := now.AddDate(0, 0, *input.ExpiresInDays)
+		link.ExpiresAt = &expires
+	}
+	if err := repo.CreateShareLink(link); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+	if err := repo.logActivity(card.ID, "shared", map[string]interface{}{"kind": link.Kind, "linkId": link.ID}); err != nil {
+		log.Printf("Failed to log share link for lead %s: %v", card.ID, err)
+	}
+	c.JSON(http.StatusCreated, link)
+}
+
+func revokeShareLinkHandler(c *gin.Context) {
+	link, err := repoFrom(c).RevokeShareLink(c.Param("linkId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+	c.JSON(http.StatusOK, link)
+}
+
+// --- PUBLIC SHARE PAGES ---
+
+var shareMessageTemplate = template.Must(template.New("share-message").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title></head>
+<body style="font-family: sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+func renderShareMessage(c *gin.Context, status int, title, message string) {
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := shareMessageTemplate.Execute(c.Writer, struct{ Title, Message string }{title, message}); err != nil {
+		log.Printf("Failed to render share page: %v", err)
+	}
+}
+
+// sharePageHandler shows the page a share link is for.
+func sharePageHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Robots-Tag", "noindex, nofollow")
+	c.Header("Referrer-Policy", "no-referrer")
+	now := time.Now()
+	link, err := shareLinkByToken(c.Request.Context(), c.Param("token"))
+	if err == store.ErrNotFound {
+		renderShareMessage(c, http.StatusNotFound, "Link not recognised", "This link isn't valid. Please check you have the whole address.")
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	repo := newRepository(Tenant{OrgID: link.orgID, UserID: link.CreatedBy})
+	card, err := repo.Crm().Card(link.LeadID)
+	if err == nil && !link.active(now) {
+		err = store.ErrNotFound
+	}
+	if err == store.ErrNotFound {
+		renderShareMessage(c, http.StatusGone, "Link no longer available", "This link has expired or been withdrawn. Please ask whoever sent it for a new one.")
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+
+	var page []byte
+	if link.Kind == SHARE_AUDIT_REPORT {
+		var report auditReport
+		report, err = buildAuditReport(c.Request.Context(), repo, card, now, false)
+		if err == nil {
+			page, err = report.renderHTML()
+		}
+	} else {
+		var summary leadSummary
+		summary, err = buildLeadSummary(repo, card, now)
+		if err == nil {
+			page, err = summary.renderHTML()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to render share link %s: %v", link.ID, err)
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+
+	views, err := repo.RecordShareView(link.ID)
+	if err != nil {
+		log.Printf("Failed to count view of share link %s: %v", link.ID, err)
+	} else if views == 1 {
+		if err := repo.logActivity(card.ID, "share_viewed", map[string]interface{}{"kind": link.Kind, "linkId": link.ID}); err != nil {
+			log.Printf("Failed to log view of share link %s: %v", link.ID, err)
+		}
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
+
+// leadSummary is a one-page overview of a business for the business
+// itself: its listing, its website and how the site scores. Nothing from
+// the CRM, such as notes, calls or tags, goes on it.
+type leadSummary struct {
+	Branding   Branding
+	Card       CrmLead
+	Lead       *leads.Lead
+	Audit      *LighthouseAudit
+	Screenshot []byte
+	Generated  time.Time
+}
+
+func buildLeadSummary(repo *Repository, card CrmLead, now time.Time) (leadSummary, error) {
+	s := leadSummary{Card: card, Generated: now}
+	var err error
+	if s.Branding, err = repo.Branding(); err != nil {
+		return s, err
+	}
+	// A card whose lead was trashed only has what's on the card.
+	lead, err := repo.Leads().Get(card.ID)
+	if err == nil {
+		s.Lead = &lead
+	} else if err != store.ErrNotFound {
+		return s, err
+	}
+	audit, err := repo.LeadAudit(card.ID)
+	if err == nil {
+		s.Audit = &audit
+	} else if err != store.ErrNotFound {
+		return s, err
+	}
+	if key, err := repo.CrmScreenshot(card.ID); err == nil && key != "" {
+		s.Screenshot, _ = readAttachment(key)
+	}
+	return s, nil
+}
+
+var leadSummaryTemplate = template.Must(template.New("lead-summary").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Company}}</title></head>
+<body style="font-family: sans-serif; max-width: 44rem; margin: 3rem auto; padding: 0 1rem; color: #222">
+{{if .Logo}}<img src="{{.Logo}}" alt="{{.Brand}}" style="max-height: 4rem; max-width: 15rem">{{end}}
+<h1 style="color: {{.Primary}}">{{.Company}}</h1>
+{{if or .Category .Address}}<p>{{.Category}}{{if and .Category .Address}} · {{end}}{{.Address}}</p>{{end}}
+<table style="border-collapse: collapse">
+{{range .Details}}<tr><td style="padding: 0.25rem 1rem 0.25rem 0; color: #555">{{.Label}}</td><td style="padding: 0.25rem 0">{{.Value}}</td></tr>
+{{end}}</table>
+{{if .Screenshot}}<img src="{{.Screenshot}}" alt="Your homepage" style="max-width: 100%; margin-top: 1rem; border: 1px solid #ddd">{{end}}
+{{if .Scores}}
+<h2 style="color: {{.Primary}}">Google Lighthouse scores (mobile)</h2>
+<table style="border-collapse: collapse">
+{{range .Scores}}<tr><td style="padding: 0.25rem 1rem 0.25rem 0">{{.Label}}</td><td style="padding: 0.25rem 1rem 0.25rem 0"><strong>{{.Score}}</strong> / 100</td><td>{{.Rating}}</td></tr>
+{{end}}</table>
+{{end}}
+<p style="color: #555">Prepared by {{.Brand}} on {{.Date}}.</p>
+{{if .Footer}}<p style="margin-top: 2rem; padding-top: 1rem; border-top: 1px solid {{.Accent}}; color: #555; font-size: 0.875rem">{{.Footer}}</p>{{end}}
+</body>
+</html>
+`))
+
+func (s leadSummary) renderHTML() ([]byte, error) {
+	type detail struct{ Label, Value string }
+	type score struct {
+		auditScore
+		Rating string
+	}
+	data := struct {
+		Brand, Company, Category, Address, Date string
+		Primary, Accent, Footer                 string
+		Logo, Screenshot                        template.URL
+		Details                                 []detail
+		Scores                                  []score
+	}{Brand: s.Branding.name(), Company: s.Card.CompanyName, Date: s.Generated.Format("2 January 2006"),
+		Primary: s.Branding.primary(), Accent: s.Branding.accent(), Footer: s.Branding.FooterText,
+		Logo: dataURI(s.Branding.logoImage()), Screenshot: dataURI(s.Screenshot)}
+
+	if s.Card.Phone != "" {
+		data.Details = append(data.Details, detail{"Phone", s.Card.Phone})
+	}
+	website := s.Card.Website
+	if website == "" {
+		website = "None listed"
+	}
+	data.Details = append(data.Details, detail{"Website", website})
+	if l := s.Lead; l != nil {
+		data.Category, data.Address = l.Category, l.Address
+		if l.ReviewCount > 0 {
+			data.Details = append(data.Details, detail{"Google rating", fmt.Sprintf("%.1f from %d reviews", l.Rating, l.ReviewCount)})
+		}
+		if len(l.Tech) > 0 {
+			data.Details = append(data.Details, detail{"Built with", strings.Join(l.Tech, ", ")})
+		}
+	}
+	for _, sc := range (auditReport{Audit: s.Audit}).scores() {
+		data.Scores = append(data.Scores, score{sc, scoreRating(sc.Score)})
+	}
+	var buf bytes.Buffer
+	err := leadSummaryTemplate.Execute(&buf, data)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- SNOOZE ---
+//
+// Snoozing takes a lead off the board until a date without promising the
+// prospect a call back, which is what callback_date is for. When the
+// snooze runs out the lead reappears and whoever snoozed it gets a push
+// notification.
+
+const SNOOZE_CHECK_INTERVAL = time.Minute
+
+func getSnoozedCrmLeadsHandler(c *gin.Context) {
+	leads, err := repoFrom(c).SnoozedCrmLeads()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch snoozed leads"})
+		return
+	}
+	if leads == nil {
+		leads = []CrmLead{}
+	}
+	c.JSON(http.StatusOK, leads)
+}
+
+// snoozeCrmLeadHandler takes until as an RFC 3339 time, or a YYYY-MM-DD
+// date meaning the start of that day in the user's timezone.
+func snoozeCrmLeadHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Until string `json:"until" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	until, err := parseSnoozeUntil(c.Request.Context(), repo.Tenant().UserID, input.Until)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !until.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "until must be in the future"})
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	err = txRepo.SnoozeCrmLead(c.Param("leadId"), until)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to snooze lead"})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to snooze lead"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"snoozedUntil": until.UTC(), "version": version})
+}
+
+func unsnoozeCrmLeadHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	err = txRepo.UnsnoozeCrmLead(c.Param("leadId"), false)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Snoozed lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unsnooze lead"})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unsnooze lead"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Lead is back on the board", "version": version})
+}
+
+func parseSnoozeUntil(ctx context.Context, userID int64, value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	settings, err := getUserSettings(ctx, userID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to load settings")
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, settings.location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("until must be a date (YYYY-MM-DD) or an RFC 3339 time")
+	}
+	return t, nil
+}
+
+// resurfaceSnoozedLeads returns leads whose snooze has run out to the
+// board, bumping each organization's board version so open boards reload.
+func resurfaceSnoozedLeads() {
+	rows, err := db.Query(`
+        SELECT org_id, lead_id, COALESCE(snoozed_by, user_id), COALESCE(company_name, '') FROM crm_leads
+        WHERE snoozed_until <= ? AND deleted_at IS NULL
+    `, time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to load snoozed leads: %v", err)
+		return
+	}
+	type woken struct {
+		tenant      Tenant
+		leadID      string
+		companyName string
+	}
+	var due []woken
+	for rows.Next() {
+		var w woken
+		if err := rows.Scan(&w.tenant.OrgID, &w.leadID, &w.tenant.UserID, &w.companyName); err != nil {
+			log.Printf("Error scanning snoozed lead: %v", err)
+			continue
+		}
+		due = append(due, w)
+	}
+	rows.Close()
+
+	for _, w := range due {
+		if err := resurfaceSnoozedLead(w.tenant, w.leadID); err != nil {
+			log.Printf("Failed to resurface snoozed lead %s: %v", w.leadID, err)
+			continue
+		}
+		notifyUser(w.tenant.UserID, pushMessage{
+			Title: "Lead back on your board",
+			Body:  fmt.Sprintf("%s is no longer snoozed", w.companyName),
+			URL:   "/crm?lead=" + w.leadID,
+			Tag:   "snooze-" + w.leadID,
+		})
+	}
+}
+
+func resurfaceSnoozedLead(t Tenant, leadID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	repo := newRepository(t).WithTx(tx)
+	if err := repo.UnsnoozeCrmLead(leadID, true); err != nil {
+		return err
+	}
+	if _, err := repo.Crm().BumpVersion(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,787 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"blueleads-backend/internal/auth"
+	"blueleads-backend/internal/store"
+)
+
+// --- SINGLE SIGN-ON ---
+//
+// A team can sign its members in through its own OpenID Connect identity
+// provider (Okta, Entra ID, Google Workspace, Keycloak, ...). A manager
+// registers the provider with the email domains it vouches for, and proves
+// control of each domain with a DNS TXT record. Signing in with a verified
+// domain goes through the provider, and the first sign-in creates the
+// account in the team. Every sign-in sets the member's team role from their
+// IdP groups, so the IdP stays in charge of who is a manager. SAML isn't
+// supported; the common IdPs all speak OIDC too.
+//
+// SSO never signs anyone into an account outside the team, nor into one
+// with a password unless its owner has linked it, so a provider can only
+// vouch for the team's own SSO members. SSO sessions never get site-admin
+// access.
+
+var ssoCallbackURL = envOrDefault("SSO_CALLBACK_URL", "http://localhost:8080/sso/callback")
+
+// ssoReturnURL is where the browser goes after signing in, with
+// #ssoToken=... or #ssoError=... for the frontend to pick up.
+var ssoReturnURL = envOrDefault("SSO_RETURN_URL", "http://localhost:5173/")
+
+const SSO_STATE_TTL = 10 * time.Minute
+
+// SSO_METADATA_TTL is how long a provider's discovery document and keys
+// are cached.
+const SSO_METADATA_TTL = time.Hour
+
+// SSO_ROLE_NONE as the default role turns away users in none of the
+// mapped groups.
+const SSO_ROLE_NONE = "none"
+
+var ssoClient = &http.Client{Timeout: 10 * time.Second}
+
+// SSO_DOMAIN_RECORD_PREFIX names the TXT record that proves control of a
+// domain: _blueleads-sso.<domain>.
+const SSO_DOMAIN_RECORD_PREFIX = "_blueleads-sso."
+
+// SSO_DOMAIN_RECORD_VALUE_PREFIX starts the TXT record's value; the
+// claim's token follows it.
+const SSO_DOMAIN_RECORD_VALUE_PREFIX = "blueleads-sso-verification="
+
+// lookupTXT is swapped out by tests.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+type SSOConfig struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"clientId"`
+	// ClientSecret is never sent back; leaving it out of an update keeps
+	// the saved one.
+	ClientSecret string   `json:"clientSecret,omitempty"`
+	Domains      []string `json:"domains"`
+	// GroupsClaim names the ID token claim listing the user's groups.
+	GroupsClaim string `json:"groupsClaim"`
+	// GroupRoles maps IdP groups to team roles. A user in several gets the
+	// highest; one in none gets DefaultRole.
+	GroupRoles  map[string]string `json:"groupRoles"`
+	DefaultRole string            `json:"defaultRole"`
+	// DomainStatus says which of Domains are verified, and what TXT record
+	// proves the rest. It's ignored in updates.
+	DomainStatus []SSODomain `json:"domainStatus"`
+}
+
+// SSODomain is one of an SSO configuration's email domains. Until it's
+// verified, RecordName and RecordValue give the TXT record to publish.
+type SSODomain struct {
+	Domain      string `json:"domain"`
+	Verified    bool   `json:"verified"`
+	RecordName  string `json:"recordName,omitempty"`
+	RecordValue string `json:"recordValue,omitempty"`
+}
+
+// verified reports whether domain is one of cfg's verified domains.
+func (cfg SSOConfig) verified(domain string) bool {
+	for _, d := range cfg.DomainStatus {
+		if d.Domain == domain && d.Verified {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSSODomainRecord looks for the TXT record proving control of domain.
+func hasSSODomainRecord(ctx context.Context, domain, token string) (bool, error) {
+	records, err := lookupTXT(ctx, SSO_DOMAIN_RECORD_PREFIX+domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		if strings.TrimSpace(r) == SSO_DOMAIN_RECORD_VALUE_PREFIX+token {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// roleFor works out the team role for a user in groups.
+func (cfg SSOConfig) roleFor(groups []string) string {
+	role := ""
+	for _, g := range groups {
+		switch cfg.GroupRoles[g] {
+		case TEAM_ROLE_MANAGER:
+			return TEAM_ROLE_MANAGER
+		case TEAM_ROLE_MEMBER:
+			role = TEAM_ROLE_MEMBER
+		}
+	}
+	if role == "" {
+		return cfg.DefaultRole
+	}
+	return role
+}
+
+// checkSSOConfig normalizes cfg and reports what's wrong with it.
+func checkSSOConfig(fe fieldErrors, cfg *SSOConfig) {
+	cfg.Issuer = strings.TrimSuffix(strings.TrimSpace(cfg.Issuer), "/")
+	u, err := url.Parse(cfg.Issuer)
+	localhost := err == nil && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1")
+	fe.check(err == nil && u.Host != "" && (u.Scheme == "https" || localhost && u.Scheme == "http"), "issuer", "must be an https URL")
+	fe.check(strings.TrimSpace(cfg.ClientID) != "", "clientId", "is required")
+
+	fe.check(len(cfg.Domains) > 0, "domains", "must list at least one email domain")
+	for i, d := range cfg.Domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		fe.check(strings.Contains(d, ".") && !strings.ContainsAny(d, "@/ ") && !strings.HasPrefix(d, "."), "domains", fmt.Sprintf("%q is not a domain", d))
+		cfg.Domains[i] = d
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.GroupRoles == nil {
+		cfg.GroupRoles = map[string]string{}
+	}
+	for group, role := range cfg.GroupRoles {
+		fe.check(role == TEAM_ROLE_MANAGER || role == TEAM_ROLE_MEMBER, "groupRoles", fmt.Sprintf("%q must map to manager or member", group))
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = TEAM_ROLE_MEMBER
+	}
+	fe.check(cfg.DefaultRole == TEAM_ROLE_MANAGER || cfg.DefaultRole == TEAM_ROLE_MEMBER || cfg.DefaultRole == SSO_ROLE_NONE, "defaultRole", "must be manager, member or none")
+}
+
+// --- PROVIDER METADATA ---
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+var oidcProviders = struct {
+	sync.Mutex
+	m map[string]*oidcProvider
+}{m: map[string]*oidcProvider{}}
+
+func ssoGetJSON(ctx context.Context, target string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ssoClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discoverProvider loads the issuer's discovery document and signing
+// keys, or returns the cached copy.
+func discoverProvider(ctx context.Context, issuer string) (*oidcProvider, error) {
+	oidcProviders.Lock()
+	p := oidcProviders.m[issuer]
+	oidcProviders.Unlock()
+	if p != nil && time.Since(p.fetched) < SSO_METADATA_TTL {
+		return p, nil
+	}
+
+	p = &oidcProvider{}
+	if err := ssoGetJSON(ctx, issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+	keys, err := fetchJWKS(ctx, p.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	p.keys, p.fetched = keys, time.Now()
+
+	oidcProviders.Lock()
+	oidcProviders.m[issuer] = p
+	oidcProviders.Unlock()
+	return p, nil
+}
+
+// fetchJWKS loads the RSA and EC keys of a JSON Web Key Set by key ID.
+func fetchJWKS(ctx context.Context, jwksURI string) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := ssoGetJSON(ctx, jwksURI, &set); err != nil {
+		return nil, err
+	}
+	num := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		return new(big.Int).SetBytes(b)
+	}
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			keys[k.Kid] = &rsa.PublicKey{N: num(k.N), E: int(num(k.E).Int64())}
+		case "EC":
+			if curve, ok := curves[k.Crv]; ok {
+				keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: num(k.X), Y: num(k.Y)}
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no signing keys", jwksURI)
+	}
+	return keys, nil
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry
+// and nonce, and returns its claims. Keys are refetched when the token
+// names one we haven't seen, since providers rotate them.
+func verifyIDToken(ctx context.Context, p *oidcProvider, cfg SSOConfig, idToken, nonce string) (jwt.MapClaims, error) {
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if key := signingKey(p.keys, kid); key != nil {
+			return key, nil
+		}
+		keys, err := fetchJWKS(ctx, p.JWKSURI)
+		if err != nil {
+			return nil, err
+		}
+		refreshed := *p
+		refreshed.keys = keys
+		oidcProviders.Lock()
+		oidcProviders.m[cfg.Issuer] = &refreshed
+		oidcProviders.Unlock()
+		if key := signingKey(keys, kid); key != nil {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("ID token nonce doesn't match")
+	}
+	return claims, nil
+}
+
+// signingKey picks the key a token names. A token that names none can use
+// the only key there is.
+func signingKey(keys map[string]interface{}, kid string) interface{} {
+	if key, ok := keys[kid]; ok || kid != "" {
+		return key
+	}
+	if len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// exchangeSSOCode trades the authorization code for an ID token.
+func exchangeSSOCode(ctx context.Context, p *oidcProvider, cfg SSOConfig, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {ssoCallbackURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	resp, err := ssoClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", result.Error, result.ErrorDescription)
+	}
+	if result.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned no ID token")
+	}
+	return result.IDToken, nil
+}
+
+// --- SIGN-IN ---
+
+func randomSSOValue() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// loadSSOConfig returns the organization's SSO settings, or store.ErrNotFound.
+func loadSSOConfig(ctx context.Context, q store.Querier, orgID int64) (SSOConfig, error) {
+	var cfg SSOConfig
+	var groupRoles string
+	err := q.QueryRowContext(ctx, "SELECT issuer, client_id, client_secret, groups_claim, group_roles, default_role FROM sso_configs WHERE org_id = ?", orgID).
+		Scan(&cfg.Issuer, &cfg.ClientID, &cfg.ClientSecret, &cfg.GroupsClaim, &groupRoles, &cfg.DefaultRole)
+	if err == sql.ErrNoRows {
+		return cfg, store.ErrNotFound
+	}
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ClientSecret = unseal(cfg.ClientSecret)
+	if err := json.Unmarshal([]byte(groupRoles), &cfg.GroupRoles); err != nil {
+		return cfg, err
+	}
+	rows, err := q.QueryContext(ctx, `
+        SELECT domain, '' FROM sso_domains WHERE org_id = ?
+        UNION ALL
+        SELECT domain, token FROM sso_domain_claims WHERE org_id = ?
+        ORDER BY domain
+    `, orgID, orgID)
+	if err != nil {
+		return cfg, err
+	}
+	defer rows.Close()
+	cfg.Domains, cfg.DomainStatus = []string{}, []SSODomain{}
+	for rows.Next() {
+		var d SSODomain
+		var token string
+		if err := rows.Scan(&d.Domain, &token); err != nil {
+			return cfg, err
+		}
+		d.Verified = token == ""
+		if !d.Verified {
+			d.RecordName = SSO_DOMAIN_RECORD_PREFIX + d.Domain
+			d.RecordValue = SSO_DOMAIN_RECORD_VALUE_PREFIX + token
+		}
+		cfg.Domains = append(cfg.Domains, d.Domain)
+		cfg.DomainStatus = append(cfg.DomainStatus, d)
+	}
+	return cfg, rows.Err()
+}
+
+// startSSOHandler looks up the provider for the email's domain and returns
+// the URL to send the browser to.
+func startSSOHandler(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	ctx := c.Request.Context()
+	_, domain, _ := strings.Cut(strings.ToLower(strings.TrimSpace(input.Email)), "@")
+	var orgID int64
+	err := db.QueryRowContext(ctx, "SELECT org_id FROM sso_domains WHERE domain = ?", domain).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on isn't set up for this email domain"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	cfg, err := loadSSOConfig(ctx, db, orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	p, err := discoverProvider(ctx, cfg.Issuer)
+	if err != nil {
+		log.Printf("SSO discovery for organization %d failed: %v", orgID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Couldn't reach your identity provider"})
+		return
+	}
+
+	now := time.Now().UTC()
+	state, nonce, verifier := randomSSOValue(), randomSSOValue(), randomSSOValue()
+	db.ExecContext(ctx, "DELETE FROM sso_states WHERE expires_at <= ?", now)
+	if _, err := db.ExecContext(ctx, "INSERT INTO sso_states (state, org_id, nonce, verifier, expires_at) VALUES (?, ?, ?, ?, ?)", state, orgID, nonce, verifier, now.Add(SSO_STATE_TTL)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {ssoCallbackURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"login_hint":            {input.Email},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	c.JSON(http.StatusOK, gin.H{"url": p.AuthorizationEndpoint + sep + query.Encode()})
+}
+
+// ssoFail sends the browser back to the frontend with an error to show.
+func ssoFail(c *gin.Context, message string) {
+	c.Redirect(http.StatusFound, ssoReturnURL+"#ssoError="+url.QueryEscape(message))
+}
+
+// ssoCallbackHandler finishes a sign-in: it checks the provider's answer,
+// creates or updates the user, and hands the frontend a token.
+func ssoCallbackHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	if e := c.Query("error"); e != "" {
+		ssoFail(c, "Your identity provider refused the sign-in: "+e)
+		return
+	}
+	var orgID int64
+	var nonce, verifier string
+	err := db.QueryRowContext(ctx, "DELETE FROM sso_states WHERE state = ? AND expires_at > ? RETURNING org_id, nonce, verifier", c.Query("state"), time.Now().UTC()).Scan(&orgID, &nonce, &verifier)
+	if err != nil {
+		ssoFail(c, "That sign-in link has expired; try again")
+		return
+	}
+	cfg, err := loadSSOConfig(ctx, db, orgID)
+	if err != nil {
+		ssoFail(c, "Single sign-on is no longer set up for your team")
+		return
+	}
+	claims, err := ssoClaims(ctx, cfg, c.Query("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("SSO sign-in for organization %d failed: %v", orgID, err)
+		ssoFail(c, "Couldn't sign you in with your identity provider")
+		return
+	}
+	finishSSOSignIn(c, orgID, cfg, claims)
+}
+
+// ssoClaims redeems the authorization code and returns the verified
+// claims of the ID token it gets back.
+func ssoClaims(ctx context.Context, cfg SSOConfig, code, verifier, nonce string) (jwt.MapClaims, error) {
+	p, err := discoverProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := exchangeSSOCode(ctx, p, cfg, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	return verifyIDToken(ctx, p, cfg, idToken, nonce)
+}
+
+// ssoGroups reads the groups claim, which providers send as a list or, for
+// a single group, a string.
+func ssoGroups(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		groups := make([]string, 0, len(v))
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+func finishSSOSignIn(c *gin.Context, orgID int64, cfg SSOConfig, claims jwt.MapClaims) {
+	ctx := c.Request.Context()
+	email, _ := claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); email == "" || (ok && !verified) {
+		ssoFail(c, "Your identity provider didn't give a verified email address")
+		return
+	}
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	if !cfg.verified(domain) {
+		ssoFail(c, "Your email domain isn't one your team signs in with")
+		return
+	}
+	role := cfg.roleFor(ssoGroups(claims, cfg.GroupsClaim))
+	if role == SSO_ROLE_NONE {
+		ssoFail(c, "You're not in a group that's allowed to use BlueLeads")
+		return
+	}
+
+	var userID, userOrgID int64
+	var disabled, hasPassword, linked bool
+	err := db.QueryRowContext(ctx, "SELECT id, org_id, disabled_at IS NOT NULL, password_hash != '', sso_linked_at IS NOT NULL FROM users WHERE email = ? COLLATE NOCASE", email).
+		Scan(&userID, &userOrgID, &disabled, &hasPassword, &linked)
+	switch {
+	case err == sql.ErrNoRows:
+		name, _ := claims["name"].(string)
+		if strings.TrimSpace(name) == "" {
+			name = email
+		}
+		// No password: SSO users can only sign in through their provider.
+		res, err := db.ExecContext(ctx, "INSERT INTO users (name, email, password_hash, org_id, team_role) VALUES (?, ?, '', ?, ?)", name, email, orgID, role)
+		if err != nil {
+			log.Printf("Failed to create SSO user: %v", err)
+			ssoFail(c, "Couldn't create your account")
+			return
+		}
+		userID, _ = res.LastInsertId()
+		log.Printf("Created user %d in organization %d through single sign-on", userID, orgID)
+	case err != nil:
+		ssoFail(c, "Couldn't sign you in")
+		return
+	case userOrgID != orgID:
+		ssoFail(c, "This email already has an account outside your team")
+		return
+	case disabled:
+		ssoFail(c, "Account is disabled")
+		return
+	case hasPassword && !linked:
+		ssoFail(c, "This email has a password account; sign in with your password and link single sign-on in your settings first")
+		return
+	default:
+		if _, err := db.ExecContext(ctx, "UPDATE users SET team_role = ? WHERE id = ?", role, userID); err != nil {
+			ssoFail(c, "Couldn't sign you in")
+			return
+		}
+	}
+
+	token, err := authService(ctx).IssueSSO(userID)
+	if err != nil {
+		ssoFail(c, "Couldn't sign you in")
+		return
+	}
+	c.Redirect(http.StatusFound, ssoReturnURL+"#ssoToken="+url.QueryEscape(token))
+}
+
+// --- SETTINGS ---
+
+func getSSOConfigHandler(c *gin.Context) {
+	repo, _, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	cfg, err := repo.SSOConfig()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on isn't set up"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load single sign-on settings"})
+		return
+	}
+	cfg.ClientSecret = ""
+	c.JSON(http.StatusOK, cfg)
+}
+
+// updateSSOConfigHandler saves the team's provider after checking its
+// discovery document can be loaded.
+func updateSSOConfigHandler(c *gin.Context) {
+	repo, team, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	var cfg SSOConfig
+	if !bindJSON(c, &cfg) {
+		return
+	}
+	saved, err := repo.SSOConfig()
+	if err != nil && err != store.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load single sign-on settings"})
+		return
+	}
+	fe := fieldErrors{}
+	checkSSOConfig(fe, &cfg)
+	// Whoever controls the provider can sign in as any member, so only the
+	// owner may point the team at a different one.
+	if (cfg.Issuer != saved.Issuer || cfg.ClientID != saved.ClientID) && team.OwnerID != repo.Tenant().UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the team owner can change the identity provider"})
+		return
+	}
+	if cfg.ClientSecret == "" {
+		fe.check(err == nil, "clientSecret", "is required")
+		cfg.ClientSecret = saved.ClientSecret
+	}
+	if fe.respond(c) {
+		return
+	}
+	if _, err := discoverProvider(c.Request.Context(), cfg.Issuer); err != nil {
+		log.Printf("SSO discovery for organization %d failed: %v", repo.Tenant().OrgID, err)
+		fieldErrors{"issuer": "couldn't load its OpenID configuration"}.respond(c)
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save single sign-on settings"})
+		return
+	}
+	defer tx.Rollback()
+	err = repo.WithTx(tx).SaveSSOConfig(cfg)
+	if err == errDomainTaken {
+		fieldErrors{"domains": "one of these domains is already used by another team"}.respond(c)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save single sign-on settings"})
+		return
+	}
+	log.Printf("User %d set up single sign-on for organization %d with %s", repo.Tenant().UserID, repo.Tenant().OrgID, cfg.Issuer)
+	saved, err = repo.SSOConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load single sign-on settings"})
+		return
+	}
+	saved.ClientSecret = ""
+	c.JSON(http.StatusOK, saved)
+}
+
+// verifySSODomainHandler checks a claimed domain's TXT record and, if it's
+// there, lets the team's members sign in with that domain.
+func verifySSODomainHandler(c *gin.Context) {
+	repo, _, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	domain := strings.ToLower(c.Param("domain"))
+	err := repo.VerifySSODomain(domain)
+	switch err {
+	case nil:
+	case store.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "That domain isn't waiting for verification"})
+		return
+	case errDomainUnverified:
+		c.JSON(http.StatusConflict, gin.H{"error": "The verification TXT record wasn't found; DNS changes can take a while to show up"})
+		return
+	case errDomainTaken:
+		c.JSON(http.StatusConflict, gin.H{"error": "That domain is already used by another team"})
+		return
+	default:
+		log.Printf("Verifying SSO domain %s for organization %d failed: %v", domain, repo.Tenant().OrgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify domain"})
+		return
+	}
+	log.Printf("User %d verified SSO domain %s for organization %d", repo.Tenant().UserID, domain, repo.Tenant().OrgID)
+	cfg, err := repo.SSOConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load single sign-on settings"})
+		return
+	}
+	cfg.ClientSecret = ""
+	c.JSON(http.StatusOK, cfg)
+}
+
+// linkSSOHandler lets the owner of a password account allow single sign-on
+// into it. They confirm with their password, so a session alone can't do it.
+func linkSSOHandler(c *gin.Context) {
+	var input struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	ctx := c.Request.Context()
+	userID := c.GetInt64("userID")
+	var passwordHash string
+	if err := db.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link single sign-on"})
+		return
+	}
+	if passwordHash == "" || !auth.CheckPassword(input.Password, passwordHash) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE users SET sso_linked_at = CURRENT_TIMESTAMP WHERE id = ?", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link single sign-on"})
+		return
+	}
+	log.Printf("User %d linked their account to single sign-on", userID)
+	c.Status(http.StatusNoContent)
+}
+
+// unlinkSSOHandler stops single sign-on into a password account.
+func unlinkSSOHandler(c *gin.Context) {
+	if _, err := db.ExecContext(c.Request.Context(), "UPDATE users SET sso_linked_at = NULL WHERE id = ?", c.GetInt64("userID")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink single sign-on"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func deleteSSOConfigHandler(c *gin.Context) {
+	repo, _, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	err := repo.DeleteSSOConfig()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on isn't set up"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to turn off single sign-on"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
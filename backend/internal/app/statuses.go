@@ -0,0 +1,157 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/store"
+)
+
+// --- LEAD STATUSES ---
+
+// checkStatusInput answers a 400 listing the fields of a new or changed
+// status that don't validate, and reports whether it did.
+func checkStatusInput(c *gin.Context, u crm.StatusUpdate) bool {
+	fe, ok := u.Validate().(crm.FieldErrors)
+	return ok && fieldErrors(fe).respond(c)
+}
+
+func getCrmStatusesHandler(c *gin.Context) {
+	statuses, err := crmService(c).Statuses()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load statuses"})
+		return
+	}
+	c.JSON(http.StatusOK, statuses)
+}
+
+func createCrmStatusHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Title string `json:"title" binding:"required"`
+		Color string `json:"color" binding:"required"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	if checkStatusInput(c, crm.StatusUpdate{Title: &input.Title, Color: &input.Color}) {
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	status, err := crmService(c).CreateStatus(input.Title, input.Color)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create status"})
+		return
+	}
+	crmChanged(c, repo)
+	c.JSON(http.StatusCreated, status)
+}
+
+// updateCrmStatusHandler renames or recolors a status and/or moves it to
+// a new zero-based position in the list.
+func updateCrmStatusHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input crm.StatusUpdate
+	if !bindJSON(c, &input) {
+		return
+	}
+	if checkStatusInput(c, input) {
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	statuses, err := crmService(c).UpdateStatus(c.Param("statusId"), input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Status not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update status"})
+		return
+	}
+	crmChanged(c, repo)
+	c.JSON(http.StatusOK, statuses)
+}
+
+func deleteCrmStatusHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	err = crm.NewService(txRepo.Crm()).DeleteStatus(c.Param("statusId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Status not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete status"})
+		return
+	}
+	crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete status"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// setCrmLeadStatusHandler gives a card a status, or clears it when
+// statusId is empty.
+func setCrmLeadStatusHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		StatusID *string `json:"statusId" binding:"required"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	statusID := strings.TrimSpace(*input.StatusID)
+	fe := fieldErrors{}
+	fe.check(statusID == "" || txRepo.Crm().HasStatus(statusID), "statusId", "must be one of the board's statuses")
+	if fe.respond(c) {
+		return
+	}
+	err = txRepo.SetCrmLeadStatus(c.Param("leadId"), statusID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set status"})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set status"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"statusId": statusID, "version": version})
+}
@@ -0,0 +1,302 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/scraper"
+	"blueleads-backend/internal/store"
+)
+
+// --- FORGETTING LEADS AND THE SUPPRESSION LIST ---
+//
+// POST /api/leads/:leadId/forget honours a business's request to be
+// forgotten. Its phone numbers, emails and social profiles are wiped from
+// every copy of the business in the organization: other searches' leads
+// that share a phone or email, the CRM card, contact lists, call notes and
+// note history, and scraper logs. CRM notes are wiped whole, since there's
+// no telling which mention people. This can't be undone.
+//
+// The phones and emails also go on the organization's suppression list,
+// so later searches leave the business out and enrichment doesn't find
+// its addresses again. The list keeps only hashes of the normalized
+// values, keyed with SUPPRESSION_KEY so a copy of the database can't be
+// checked against a list of known phones and emails.
+
+const (
+	SUPPRESS_PHONE = "phone"
+	SUPPRESS_EMAIL = "email"
+)
+
+// REDACTED replaces forgotten details in free text such as scraper logs.
+const REDACTED = "[redacted]"
+
+const MIN_SUPPRESSION_KEY_LENGTH = 32
+
+var suppressionKey []byte
+
+// loadSuppressionKey reads SUPPRESSION_KEY from the environment and stops
+// the server if it's missing or too short to resist guessing.
+func loadSuppressionKey() {
+	key := os.Getenv("SUPPRESSION_KEY")
+	if key == "" {
+		log.Fatal("SUPPRESSION_KEY must be set; generate one with `openssl rand -base64 48`")
+	}
+	if len(key) < MIN_SUPPRESSION_KEY_LENGTH {
+		log.Fatalf("SUPPRESSION_KEY must be at least %d bytes long", MIN_SUPPRESSION_KEY_LENGTH)
+	}
+	suppressionKey = []byte(key)
+}
+
+type Suppression struct {
+	Kind      string    `json:"kind"`
+	Reason    string    `json:"reason"`
+	CreatedBy *int64    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ForgetResult says how much a forget request touched.
+type ForgetResult struct {
+	LeadsRedacted    int `json:"leadsRedacted"`
+	CrmLeadsRedacted int `json:"crmLeadsRedacted"`
+	SuppressedPhones int `json:"suppressedPhones"`
+	SuppressedEmails int `json:"suppressedEmails"`
+}
+
+// suppressionHash is how a phone or email is stored on the list; "" means
+// the value can't be matched (a phone too short to be real, say).
+func suppressionHash(kind, value string) string {
+	switch kind {
+	case SUPPRESS_PHONE:
+		value = normalizePhone(value)
+	case SUPPRESS_EMAIL:
+		value = strings.ToLower(strings.TrimSpace(value))
+	}
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(kind + ":" + value))
+	return keySuppressionHash(hex.EncodeToString(sum[:]))
+}
+
+// keySuppressionHash keys the plain SHA-256 digest the list used to store,
+// which lets rekeySuppressions move old entries over without the values.
+func keySuppressionHash(digest string) string {
+	mac := hmac.New(sha256.New, suppressionKey)
+	mac.Write([]byte(digest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// rekeySuppressions replaces the unkeyed hashes of entries added before the
+// list was keyed.
+func rekeySuppressions() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal("Failed to rekey suppressions:", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT org_id, value_hash FROM suppressions WHERE keyed = 0")
+	if err != nil {
+		log.Fatal("Failed to rekey suppressions:", err)
+	}
+	type entry struct {
+		orgID int64
+		hash  string
+	}
+	var legacy []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.orgID, &e.hash); err != nil {
+			log.Fatal("Failed to rekey suppressions:", err)
+		}
+		legacy = append(legacy, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Fatal("Failed to rekey suppressions:", err)
+	}
+	for _, e := range legacy {
+		if _, err := tx.Exec("UPDATE suppressions SET value_hash = ?, keyed = 1 WHERE org_id = ? AND value_hash = ?", keySuppressionHash(e.hash), e.orgID, e.hash); err != nil {
+			log.Fatal("Failed to rekey suppressions:", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal("Failed to rekey suppressions:", err)
+	}
+	if len(legacy) > 0 {
+		log.Printf("Rekeyed %d suppression list entries", len(legacy))
+	}
+}
+
+// suppressionSet holds an organization's suppressed hashes.
+type suppressionSet map[string]bool
+
+func loadSuppressions(q store.Querier, orgID int64) (suppressionSet, error) {
+	rows, err := q.Query("SELECT value_hash FROM suppressions WHERE org_id = ?", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := suppressionSet{}
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		set[h] = true
+	}
+	return set, rows.Err()
+}
+
+func (s suppressionSet) has(kind, value string) bool {
+	h := suppressionHash(kind, value)
+	return h != "" && s[h]
+}
+
+// suppressesLead reports whether any of a scraped lead's contacts are on
+// the list.
+func (s suppressionSet) suppressesLead(sl scraper.Lead) bool {
+	if s.has(SUPPRESS_PHONE, sl.Phone) {
+		return true
+	}
+	for _, e := range sl.Emails {
+		if s.has(SUPPRESS_EMAIL, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutSuppressedLeads drops scraped leads for businesses the search's
+// organization has been asked to forget, returning the rest and how many
+// were dropped.
+func withoutSuppressedLeads(tx *sql.Tx, searchID string, leads []scraper.Lead) ([]scraper.Lead, int, error) {
+	var orgID int64
+	if err := tx.QueryRow("SELECT org_id FROM searches WHERE id = ?", searchID).Scan(&orgID); err != nil {
+		return nil, 0, err
+	}
+	set, err := loadSuppressions(tx, orgID)
+	if err != nil || len(set) == 0 {
+		return leads, 0, err
+	}
+	kept := make([]scraper.Lead, 0, len(leads))
+	for _, sl := range leads {
+		if !set.suppressesLead(sl) {
+			kept = append(kept, sl)
+		}
+	}
+	return kept, len(leads) - len(kept), nil
+}
+
+// unsuppressedEmails filters out the emails a lead's organization has
+// suppressed, for enrichment to save.
+func unsuppressedEmails(ctx context.Context, leadID string, emails []string) []string {
+	var orgID int64
+	err := db.QueryRowContext(ctx, "SELECT s.org_id FROM leads l JOIN searches s ON s.id = l.search_id WHERE l.id = ?", leadID).Scan(&orgID)
+	if err != nil {
+		log.Printf("Failed to find the organization of lead %s: %v", leadID, err)
+		return nil
+	}
+	set, err := loadSuppressions(db, orgID)
+	if err != nil {
+		log.Printf("Failed to load suppressions for lead %s: %v", leadID, err)
+		return nil
+	}
+	kept := []string{}
+	for _, e := range emails {
+		if !set.has(SUPPRESS_EMAIL, e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// forgetLeadHandler redacts a business everywhere in the organization and
+// suppresses its contacts.
+func forgetLeadHandler(c *gin.Context) {
+	// The route shares /leads/:searchId's wildcard, so the lead ID comes
+	// through under that name.
+	leadID := c.Param("searchId")
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 && !bindJSON(c, &input) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forget lead"})
+		return
+	}
+	defer tx.Rollback()
+	repo := repoFrom(c).WithTx(tx)
+
+	result, err := repo.ForgetLead(leadID, strings.TrimSpace(input.Reason))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to forget lead %s: %v", leadID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forget lead"})
+		return
+	}
+	log.Printf("User %d forgot lead %s: %d leads and %d CRM cards redacted", repo.Tenant().UserID, leadID, result.LeadsRedacted, result.CrmLeadsRedacted)
+	if result.CrmLeadsRedacted > 0 {
+		crmChanged(c, repo)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func getSuppressionsHandler(c *gin.Context) {
+	suppressions, err := repoFrom(c).Suppressions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load suppressions"})
+		return
+	}
+	c.JSON(http.StatusOK, suppressions)
+}
+
+// addSuppressionsHandler puts phones and emails on the list by hand, for
+// do-not-contact requests about businesses that aren't leads yet.
+func addSuppressionsHandler(c *gin.Context) {
+	var input struct {
+		Phones []string `json:"phones"`
+		Emails []string `json:"emails"`
+		Reason string   `json:"reason"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	for _, p := range input.Phones {
+		fe.check(suppressionHash(SUPPRESS_PHONE, p) != "", "phones", "must be phone numbers")
+	}
+	for _, e := range input.Emails {
+		fe.check(validEmail(strings.TrimSpace(e)), "emails", "must be email addresses")
+	}
+	fe.check(len(input.Phones)+len(input.Emails) > 0, "phones", "or emails are required")
+	if fe.respond(c) {
+		return
+	}
+	added, err := repoFrom(c).AddSuppressions(input.Phones, input.Emails, strings.TrimSpace(input.Reason))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add suppressions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
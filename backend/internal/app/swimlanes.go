@@ -0,0 +1,101 @@
+package app
+
+import (
+	"sort"
+	"strconv"
+
+	"blueleads-backend/internal/crm"
+)
+
+// --- SWIMLANES ---
+//
+// GET /api/crm?lanes= groups the board's cards into horizontal lanes
+// across the columns, so a team board stays readable: by assignee (the
+// member who put the card on the board), by tag or by priority. A card
+// with several tags is in each of their lanes, and untagged cards share a
+// last lane with an empty id.
+
+const (
+	LANES_ASSIGNEE = "assignee"
+	LANES_TAG      = "tag"
+	LANES_PRIORITY = "priority"
+)
+
+var swimlaneGroupings = []string{LANES_ASSIGNEE, LANES_TAG, LANES_PRIORITY}
+
+type crmLane struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	// Columns holds the lane's card IDs under each column ID, in board
+	// order; every column is present.
+	Columns map[string][]string `json:"columns"`
+}
+
+func validSwimlaneGrouping(by string) bool {
+	for _, g := range swimlaneGroupings {
+		if g == by {
+			return true
+		}
+	}
+	return false
+}
+
+// crmSwimlanes groups the board into lanes by the grouping, naming
+// assignee lanes from names. Lanes are ordered by title, with the
+// catch-all lane last.
+func crmSwimlanes(by string, board []CrmLead, columns []crm.Column, names map[int64]string) []crmLane {
+	lanes := map[string]*crmLane{}
+	var order []*crmLane
+	lane := func(id, title string) *crmLane {
+		l, ok := lanes[id]
+		if !ok {
+			l = &crmLane{ID: id, Title: title, Columns: make(map[string][]string, len(columns))}
+			for _, col := range columns {
+				l.Columns[col.ID] = []string{}
+			}
+			lanes[id] = l
+			order = append(order, l)
+		}
+		return l
+	}
+	place := func(l *crmLane, cl CrmLead) {
+		if ids, ok := l.Columns[cl.ColumnID]; ok {
+			l.Columns[cl.ColumnID] = append(ids, cl.ID)
+		}
+	}
+
+	for _, cl := range board {
+		switch by {
+		case LANES_ASSIGNEE:
+			title, ok := names[cl.Assignee]
+			if !ok {
+				title = "Former member"
+			}
+			place(lane(strconv.FormatInt(cl.Assignee, 10), title), cl)
+		case LANES_TAG:
+			if len(cl.Tags) == 0 {
+				place(lane("", "No tag"), cl)
+			}
+			for _, tag := range cl.Tags {
+				place(lane(tag, tag), cl)
+			}
+		case LANES_PRIORITY:
+			place(lane(cl.Priority, priorityTitles[cl.Priority]), cl)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		if by == LANES_PRIORITY {
+			return priorityRank(order[i].ID) < priorityRank(order[j].ID)
+		}
+		if (order[i].ID == "") != (order[j].ID == "") {
+			return order[j].ID == ""
+		}
+		return order[i].Title < order[j].Title
+	})
+	result := make([]crmLane, len(order))
+	for i, l := range order {
+		result[i] = *l
+	}
+	return result
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/leads"
+)
+
+// --- DELTA SYNC ---
+//
+// GET /api/sync?since=<cursor> lets a client that keeps its own copy of the
+// organization's data, such as a mobile app used offline on the road, catch
+// up on what changed since it last synced: leads, CRM cards (with their
+// notes and tags), board columns and calls (with their notes). Anything it
+// can no longer see comes back as a tombstone.
+//
+// Triggers keep sync_changes up to date, one row per entity holding the
+// sequence number of its latest change, so the cursor is just the highest
+// sequence number a client has seen. Without since, the client gets
+// everything it can see.
+
+const SYNC_DEFAULT_LIMIT = 500
+const SYNC_MAX_LIMIT = 1000
+
+const (
+	SYNC_LEAD     = "lead"
+	SYNC_CRM_LEAD = "crmLead"
+	SYNC_COLUMN   = "column"
+	SYNC_CALL     = "call"
+)
+
+type SyncTombstone struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type SyncPage struct {
+	// Cursor goes in since on the next request.
+	Cursor     int64           `json:"cursor"`
+	HasMore    bool            `json:"hasMore"`
+	Leads      []leads.Lead    `json:"leads"`
+	CrmLeads   []CrmLead       `json:"crmLeads"`
+	Columns    []crm.Column    `json:"columns"`
+	Calls      []Call          `json:"calls"`
+	Tombstones []SyncTombstone `json:"tombstones"`
+}
+
+// syncSource is a table whose writes mark an entity changed. org and id
+// are SQL expressions over ROW, which stands for new or old.
+type syncSource struct {
+	table, entity, org, id string
+}
+
+const leadOrgExpr = "(SELECT s.org_id FROM leads l JOIN searches s ON s.id = l.search_id WHERE l.id = ROW.lead_id)"
+
+var syncSources = []syncSource{
+	{"leads", SYNC_LEAD, "(SELECT org_id FROM searches WHERE id = ROW.search_id)", "ROW.id"},
+	{"lead_emails", SYNC_LEAD, leadOrgExpr, "ROW.lead_id"},
+	{"lead_phones", SYNC_LEAD, leadOrgExpr, "ROW.lead_id"},
+	{"crm_leads", SYNC_CRM_LEAD, "ROW.org_id", "ROW.lead_id"},
+	{"crm_lead_tags", SYNC_CRM_LEAD, "ROW.org_id", "ROW.lead_id"},
+	{"crm_columns", SYNC_COLUMN, "ROW.org_id", "ROW.id"},
+	{"crm_calls", SYNC_CALL, "ROW.org_id", "ROW.id"},
+}
+
+// markChanged is the trigger body that moves an entity to the end of the
+// log. It deletes and reinserts rather than upserting, since an OR IGNORE
+// on the statement that fired the trigger would otherwise apply here too.
+func (s syncSource) markChanged(row string) string {
+	org := strings.ReplaceAll(s.org, "ROW", row)
+	id := strings.ReplaceAll(s.id, "ROW", row)
+	return fmt.Sprintf(`
+        DELETE FROM sync_changes WHERE org_id = %[1]s AND entity = '%[2]s' AND entity_id = %[3]s;
+        INSERT INTO sync_changes (org_id, entity, entity_id) VALUES (%[1]s, '%[2]s', %[3]s);`, org, s.entity, id)
+}
+
+// syncTriggers returns the name and SQL of every sync trigger.
+func syncTriggers() map[string]string {
+	triggers := map[string]string{}
+	for _, s := range syncSources {
+		triggers["sync_"+s.table+"_insert"] = "AFTER INSERT ON " + s.table + " BEGIN" + s.markChanged("new") + "\nEND"
+		// The old row too, in case the update moved it to another entity.
+		triggers["sync_"+s.table+"_update"] = "AFTER UPDATE ON " + s.table + " BEGIN" + s.markChanged("old") + s.markChanged("new") + "\nEND"
+		triggers["sync_"+s.table+"_delete"] = "AFTER DELETE ON " + s.table + " BEGIN" + s.markChanged("old") + "\nEND"
+	}
+	// Trashing or restoring a search hides or shows all its leads.
+	triggers["sync_searches_trash"] = `AFTER UPDATE OF deleted_at ON searches BEGIN
+        DELETE FROM sync_changes WHERE org_id = new.org_id AND entity = 'lead' AND entity_id IN (SELECT id FROM leads WHERE search_id = new.id);
+        INSERT INTO sync_changes (org_id, entity, entity_id) SELECT new.org_id, 'lead', id FROM leads WHERE search_id = new.id;
+    END`
+	return triggers
+}
+
+// initSyncLog creates the change log and its triggers. When any trigger
+// was missing, changes may have gone unrecorded, so the log is rebuilt
+// from the live rows; clients then get everything again on their next
+// sync, as sequence numbers only go up.
+func initSyncLog() {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS sync_changes (
+            seq INTEGER PRIMARY KEY AUTOINCREMENT,
+            org_id INTEGER,
+            entity TEXT NOT NULL,
+            entity_id TEXT NOT NULL,
+            UNIQUE (org_id, entity, entity_id)
+        );
+    `)
+	if err != nil {
+		log.Fatal("Failed to create sync_changes table:", err)
+	}
+
+	triggers := syncTriggers()
+	var existing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'sync_%'").Scan(&existing); err != nil {
+		log.Fatal("Failed to inspect schema:", err)
+	}
+	for name, body := range triggers {
+		if _, err := db.Exec("CREATE TRIGGER IF NOT EXISTS " + name + " " + body); err != nil {
+			log.Fatal("Failed to create sync trigger:", err)
+		}
+	}
+	if existing >= len(triggers) {
+		return
+	}
+
+	// Columns come first so a client can place cards as they arrive.
+	statements := []string{
+		"DELETE FROM sync_changes",
+		"INSERT INTO sync_changes (org_id, entity, entity_id) SELECT org_id, 'column', id FROM crm_columns ORDER BY position",
+		`INSERT INTO sync_changes (org_id, entity, entity_id)
+         SELECT s.org_id, 'lead', l.id FROM leads l JOIN searches s ON s.id = l.search_id
+         WHERE l.deleted_at IS NULL AND s.deleted_at IS NULL AND s.org_id IS NOT NULL`,
+		"INSERT INTO sync_changes (org_id, entity, entity_id) SELECT org_id, 'crmLead', lead_id FROM crm_leads WHERE deleted_at IS NULL AND org_id IS NOT NULL",
+		"INSERT INTO sync_changes (org_id, entity, entity_id) SELECT org_id, 'call', id FROM crm_calls ORDER BY id",
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Fatal("Failed to build sync_changes:", err)
+		}
+	}
+}
+
+func syncHandler(c *gin.Context) {
+	var since int64
+	if v := c.Query("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a cursor from an earlier sync"})
+			return
+		}
+		since = n
+	}
+	limit := SYNC_DEFAULT_LIMIT
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > SYNC_MAX_LIMIT {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", SYNC_MAX_LIMIT)})
+			return
+		}
+		limit = n
+	}
+
+	page, err := repoFrom(c).SyncChanges(since, limit)
+	if err != nil {
+		log.Printf("Failed to sync changes since %d: %v", since, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load changes"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
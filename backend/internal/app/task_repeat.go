@@ -0,0 +1,206 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// --- RECURRING TASKS ---
+//
+// A task with a repeat rule ("every 30 days") keeps a long-nurture prospect
+// from falling through the cracks: once it's done or skipped, the
+// scheduler adds the next one, due one interval after this one, or the
+// first such date after today when that's already past. Snoozing moves an
+// open task's due date, and so the rest of the series with it. A series
+// on a card ends when the card leaves the board, and editing a task's
+// rule changes it from that task on.
+
+const TASK_REPEAT_INTERVAL = time.Minute
+
+const (
+	REPEAT_DAY   = "day"
+	REPEAT_WEEK  = "week"
+	REPEAT_MONTH = "month"
+)
+
+type TaskRepeat struct {
+	Every int    `json:"every"`
+	Unit  string `json:"unit"`
+}
+
+func (r *TaskRepeat) validate(fe fieldErrors, dueDate string) {
+	fe.check(r.Every >= 1 && r.Every <= 365, "repeat.every", "must be between 1 and 365")
+	fe.check(r.Unit == REPEAT_DAY || r.Unit == REPEAT_WEEK || r.Unit == REPEAT_MONTH, "repeat.unit", "must be day, week or month")
+	fe.check(dueDate != "", "dueDate", "is required on a repeating task")
+}
+
+// after returns the first date in the series from due that falls after
+// today, both YYYY-MM-DD dates.
+func (r TaskRepeat) after(due, today string) (string, error) {
+	d, err := time.Parse("2006-01-02", due)
+	if err != nil {
+		return "", err
+	}
+	for next := 1; ; next++ {
+		var t time.Time
+		switch r.Unit {
+		case REPEAT_WEEK:
+			t = d.AddDate(0, 0, 7*r.Every*next)
+		case REPEAT_MONTH:
+			// From the first due date each time, so the 31st doesn't
+			// drift to the 1st after a short month.
+			t = d.AddDate(0, r.Every*next, 0)
+			if t.Day() != d.Day() {
+				t = t.AddDate(0, 0, -t.Day())
+			}
+		default:
+			t = d.AddDate(0, 0, r.Every*next)
+		}
+		if s := t.Format("2006-01-02"); s > today {
+			return s, nil
+		}
+	}
+}
+
+// snoozeTaskHandler moves an open task's due date to until, a YYYY-MM-DD
+// date after today in the caller's timezone.
+func snoozeTaskHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input struct {
+		Until string `json:"until" binding:"required"`
+	}
+	if !bindJSON(c, &input) {
+		return
+	}
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	today := time.Now().In(settings.location()).Format("2006-01-02")
+	fe := fieldErrors{}
+	_, err = time.Parse("2006-01-02", input.Until)
+	fe.check(err == nil, "until", "must be a date (YYYY-MM-DD)")
+	fe.check(input.Until > today, "until", "must be after today")
+	if fe.respond(c) {
+		return
+	}
+	task, ok := taskResponse(c, repo, c.Param("taskId"))
+	if !ok {
+		return
+	}
+	if task.Done {
+		c.JSON(http.StatusConflict, gin.H{"error": "The task is already done"})
+		return
+	}
+	if err := repo.SnoozeTask(task.ID, input.Until); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to snooze task"})
+		return
+	}
+	if task, ok := taskResponse(c, repo, task.ID); ok {
+		c.JSON(http.StatusOK, task)
+	}
+}
+
+// skipTaskHandler closes an open repeating task without doing it, so the
+// series moves on to the next one.
+func skipTaskHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	task, ok := taskResponse(c, repo, c.Param("taskId"))
+	if !ok {
+		return
+	}
+	if task.Repeat == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only repeating tasks can be skipped"})
+		return
+	}
+	if task.Done {
+		c.JSON(http.StatusConflict, gin.H{"error": "The task is already done"})
+		return
+	}
+	if err := repo.SkipTask(task.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to skip task"})
+		return
+	}
+	if task, ok := taskResponse(c, repo, task.ID); ok {
+		c.JSON(http.StatusOK, task)
+	}
+}
+
+// scheduleRepeatingTasks is the background job that adds the next task of
+// every series whose latest one is closed.
+func scheduleRepeatingTasks() {
+	rows, err := db.Query("SELECT org_id, created_by, id FROM tasks WHERE repeat_every > 0 AND done_at IS NOT NULL AND next_task_id = ''")
+	if err != nil {
+		log.Printf("Failed to load repeating tasks: %v", err)
+		return
+	}
+	type closed struct {
+		tenant Tenant
+		taskID string
+	}
+	var due []closed
+	for rows.Next() {
+		var cl closed
+		if err := rows.Scan(&cl.tenant.OrgID, &cl.tenant.UserID, &cl.taskID); err != nil {
+			log.Printf("Error scanning repeating task: %v", err)
+			continue
+		}
+		due = append(due, cl)
+	}
+	rows.Close()
+
+	for _, cl := range due {
+		if err := scheduleNextTask(newRepository(cl.tenant), cl.taskID); err != nil {
+			log.Printf("Failed to schedule the task after %s: %v", cl.taskID, err)
+		}
+	}
+}
+
+// scheduleNextTask adds the task after taskID in its series, as its
+// creator, or ends the series when its card has left the board.
+func scheduleNextTask(repo *Repository, taskID string) error {
+	task, err := repo.Task(taskID)
+	if err != nil {
+		return err
+	}
+	if task.LeadID != "" && !repo.Crm().HasCard(task.LeadID) {
+		return repo.EndTaskRepeat(task.ID)
+	}
+	settings, err := getUserSettings(repo.ctx, task.Assignee)
+	if err != nil {
+		return err
+	}
+	nextDue, err := task.Repeat.after(task.DueDate, time.Now().In(settings.location()).Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(repo.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+	now := time.Now().UTC()
+	next := Task{
+		ID: uuid.New().String(), Title: task.Title, Notes: task.Notes, LeadID: task.LeadID, Assignee: task.Assignee, DueDate: nextDue,
+		Repeat: task.Repeat, CreatedAt: now, UpdatedAt: now,
+	}
+	if err := txRepo.CreateTask(next); err != nil {
+		return err
+	}
+	if err := txRepo.SetNextTask(task.ID, next.ID); err != nil {
+		return err
+	}
+	if next.LeadID != "" {
+		if _, err := txRepo.Crm().BumpVersion(); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
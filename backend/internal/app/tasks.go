@@ -0,0 +1,302 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- TASKS ---
+//
+// Tasks track the follow-ups that aren't calls: send the proposal, check
+// the new site. A task has a title, an optional due date and card, and an
+// assignee from the organization, who gets a push notification when
+// someone else gives them one. GET /api/tasks/today is the assignee's
+// list for the day: what's due today or overdue and not yet done.
+// Completing a task on a card logs it in the card's activity.
+
+type Task struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Notes    string `json:"notes"`
+	LeadID   string `json:"leadId"`
+	Assignee int64  `json:"assignee"`
+	// DueDate is a date (YYYY-MM-DD) in the assignee's timezone, or empty.
+	DueDate string      `json:"dueDate"`
+	Repeat  *TaskRepeat `json:"repeat"`
+	Done    bool        `json:"done"`
+	// Skipped is set on a repeating task closed without being done.
+	Skipped bool       `json:"skipped"`
+	DoneAt  *time.Time `json:"doneAt"`
+	// NextTaskID is the task the scheduler added after this one.
+	NextTaskID string    `json:"nextTaskId,omitempty"`
+	CreatedBy  int64     `json:"createdBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+type taskInput struct {
+	Title  string `json:"title" binding:"required"`
+	Notes  string `json:"notes"`
+	LeadID string `json:"leadId"`
+	// Assignee defaults to the caller.
+	Assignee int64       `json:"assignee"`
+	DueDate  string      `json:"dueDate"`
+	Repeat   *TaskRepeat `json:"repeat"`
+	Done     bool        `json:"done"`
+}
+
+func (in *taskInput) validate(fe fieldErrors) {
+	in.Title = strings.TrimSpace(in.Title)
+	checkLength(fe, "title", in.Title, 1, 200)
+	checkLength(fe, "notes", in.Notes, 0, 5000)
+	if in.LeadID != "" {
+		_, err := uuid.Parse(in.LeadID)
+		fe.check(err == nil, "leadId", "must be a valid UUID")
+	}
+	if in.DueDate != "" {
+		_, err := time.Parse("2006-01-02", in.DueDate)
+		fe.check(err == nil, "dueDate", "must be a date (YYYY-MM-DD)")
+	}
+	if in.Repeat != nil {
+		in.Repeat.validate(fe, in.DueDate)
+	}
+}
+
+// checkTaskLinks writes the error response when the input's card or
+// assignee isn't the organization's, filling in the default assignee.
+func checkTaskLinks(c *gin.Context, repo *Repository, in *taskInput) bool {
+	if in.Assignee == 0 {
+		in.Assignee = repo.Tenant().UserID
+	}
+	if in.LeadID != "" && !repo.Crm().HasCard(in.LeadID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return false
+	}
+	isMember, err := repo.HasMember(in.Assignee)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check assignee"})
+		return false
+	}
+	if !isMember {
+		fe := fieldErrors{}
+		fe.check(false, "assignee", "must be an active member of your team")
+		fe.respond(c)
+		return false
+	}
+	return true
+}
+
+func taskResponse(c *gin.Context, repo *Repository, taskID string) (Task, bool) {
+	task, err := repo.Task(taskID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return task, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load task"})
+		return task, false
+	}
+	return task, true
+}
+
+// listTasksHandler returns the organization's tasks, filtered by
+// ?assignee=, ?leadId= and ?done=true|false, open ones by due date first.
+func listTasksHandler(c *gin.Context) {
+	var filter taskFilter
+	if v := c.Query("assignee"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "assignee must be a user ID"})
+			return
+		}
+		filter.assignee = id
+	}
+	if v := c.Query("leadId"); v != "" {
+		if _, err := uuid.Parse(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "leadId must be a valid UUID"})
+			return
+		}
+		filter.leadID = v
+	}
+	if v := c.Query("done"); v != "" {
+		done, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "done must be true or false"})
+			return
+		}
+		filter.done = &done
+	}
+	tasks, err := repoFrom(c).Tasks(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tasks"})
+		return
+	}
+	c.JSON(http.StatusOK, tasks)
+}
+
+func listLeadTasksHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	leadID := c.Param("leadId")
+	if !repo.Crm().HasCard(leadID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	tasks, err := repo.Tasks(taskFilter{leadID: leadID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tasks"})
+		return
+	}
+	c.JSON(http.StatusOK, tasks)
+}
+
+// getTodayTasksHandler returns the caller's open tasks due today or
+// earlier in their timezone, most overdue first.
+func getTodayTasksHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	today := time.Now().In(settings.location()).Format("2006-01-02")
+	notDone := false
+	tasks, err := repo.Tasks(taskFilter{assignee: repo.Tenant().UserID, done: &notDone, dueBy: today})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tasks"})
+		return
+	}
+	overdue := 0
+	for _, task := range tasks {
+		if task.DueDate < today {
+			overdue++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"date": today, "overdue": overdue, "tasks": tasks})
+}
+
+func getTaskHandler(c *gin.Context) {
+	if task, ok := taskResponse(c, repoFrom(c), c.Param("taskId")); ok {
+		c.JSON(http.StatusOK, task)
+	}
+}
+
+func createTaskHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input taskInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) || !checkTaskLinks(c, repo, &input) {
+		return
+	}
+
+	now := time.Now().UTC()
+	task := Task{
+		ID: uuid.New().String(), Title: input.Title, Notes: input.Notes, LeadID: input.LeadID, Assignee: input.Assignee, DueDate: input.DueDate,
+		Repeat: input.Repeat, Done: input.Done, CreatedBy: repo.Tenant().UserID, CreatedAt: now, UpdatedAt: now,
+	}
+	if task.Done {
+		task.DoneAt = &now
+	}
+	if err := repo.CreateTask(task); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
+		return
+	}
+	if task.LeadID != "" {
+		crmChanged(c, repo)
+	}
+	notifyTaskAssignee(repo, task)
+	c.JSON(http.StatusCreated, task)
+}
+
+// updateTaskHandler replaces a task's details. Marking a task on a card
+// done logs it in the card's activity.
+func updateTaskHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	taskID := c.Param("taskId")
+	var input taskInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) || !checkTaskLinks(c, repo, &input) {
+		return
+	}
+	before, ok := taskResponse(c, repo, taskID)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+	if err := txRepo.UpdateTask(taskID, input); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		return
+	}
+	if input.Done && !before.Done && input.LeadID != "" {
+		if err := txRepo.logActivity(input.LeadID, "task_completed", map[string]interface{}{"taskId": taskID, "title": input.Title}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		return
+	}
+	if before.LeadID != "" || input.LeadID != "" {
+		crmChanged(c, repo)
+	}
+	task, ok := taskResponse(c, repo, taskID)
+	if !ok {
+		return
+	}
+	if task.Assignee != before.Assignee {
+		notifyTaskAssignee(repo, task)
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+func deleteTaskHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	task, ok := taskResponse(c, repo, c.Param("taskId"))
+	if !ok {
+		return
+	}
+	if err := repo.DeleteTask(task.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete task"})
+		return
+	}
+	if task.LeadID != "" {
+		crmChanged(c, repo)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// notifyTaskAssignee tells the assignee about a task someone else gave
+// them.
+func notifyTaskAssignee(repo *Repository, task Task) {
+	if task.Assignee == repo.Tenant().UserID || task.Done {
+		return
+	}
+	body := task.Title
+	if task.DueDate != "" {
+		body = fmt.Sprintf("%s (due %s)", task.Title, task.DueDate)
+	}
+	notifyUser(task.Assignee, pushMessage{Title: "New task", Body: body, URL: "/tasks", Tag: "task-" + task.ID})
+}
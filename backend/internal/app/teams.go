@@ -0,0 +1,230 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- TEAMS ---
+//
+// A team is an organization seen by its members. Whoever created it is
+// its owner. Other members are managers or plain members; the owner and
+// managers can change the team's settings. The leaderboard ranks members
+// against each other, so teams that would rather not can turn it off;
+// the owner and managers can still see it.
+
+// Team is an organization with its active members.
+type Team struct {
+	ID                 int64        `json:"id"`
+	Name               string       `json:"name"`
+	OwnerID            int64        `json:"ownerId"`
+	LeaderboardEnabled bool         `json:"leaderboardEnabled"`
+	Members            []TeamMember `json:"members"`
+}
+
+type TeamMember struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Team roles. Single sign-on sets them from the member's IdP groups.
+const (
+	TEAM_ROLE_MANAGER = "manager"
+	TEAM_ROLE_MEMBER  = "member"
+)
+
+// canManage reports whether userID may change the team's settings.
+func (t Team) canManage(userID int64) bool {
+	if t.OwnerID == userID {
+		return true
+	}
+	for _, m := range t.Members {
+		if m.ID == userID {
+			return m.Role == TEAM_ROLE_MANAGER
+		}
+	}
+	return false
+}
+
+// LeaderboardEntry is one member's standing over the period.
+type LeaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	UserID   int64  `json:"userId"`
+	Name     string `json:"name"`
+	Dials    int    `json:"dials"`
+	Contacts int    `json:"contacts"`
+	Wins     int    `json:"wins"`
+}
+
+// leaderboardSorts are the stats a leaderboard can be ranked by.
+var leaderboardSorts = map[string]func(e LeaderboardEntry) int{
+	"dials":    func(e LeaderboardEntry) int { return e.Dials },
+	"contacts": func(e LeaderboardEntry) int { return e.Contacts },
+	"wins":     func(e LeaderboardEntry) int { return e.Wins },
+}
+
+// teamFor loads the caller's team if :teamId names it. Other teams are
+// reported as not found rather than forbidden.
+func teamFor(c *gin.Context) (*Repository, Team, bool) {
+	repo := repoFrom(c)
+	id, err := strconv.ParseInt(c.Param("teamId"), 10, 64)
+	if err != nil || id != repo.Tenant().OrgID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return nil, Team{}, false
+	}
+	team, err := repo.Team()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return nil, Team{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load team"})
+		return nil, Team{}, false
+	}
+	return repo, team, true
+}
+
+func getTeamHandler(c *gin.Context) {
+	if _, team, ok := teamFor(c); ok {
+		c.JSON(http.StatusOK, team)
+	}
+}
+
+// teamManagerFor is teamFor for things only the owner and managers may do.
+func teamManagerFor(c *gin.Context) (*Repository, Team, bool) {
+	repo, team, ok := teamFor(c)
+	if !ok {
+		return nil, team, false
+	}
+	if !team.canManage(repo.Tenant().UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the team owner or a manager can do that"})
+		return nil, team, false
+	}
+	return repo, team, true
+}
+
+// updateTeamHandler changes the team's settings.
+func updateTeamHandler(c *gin.Context) {
+	repo, team, ok := teamManagerFor(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		LeaderboardEnabled *bool `json:"leaderboardEnabled"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.LeaderboardEnabled != nil {
+		if err := repo.SetLeaderboardEnabled(*input.LeaderboardEnabled); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update team"})
+			return
+		}
+		team.LeaderboardEnabled = *input.LeaderboardEnabled
+	}
+	c.JSON(http.StatusOK, team)
+}
+
+// leaderboardPeriod works out [from, to) from ?period, or from ?from and
+// ?to as dates in the caller's timezone. The default is this week.
+func leaderboardPeriod(c *gin.Context, loc *time.Location, now time.Time) (string, time.Time, time.Time, bool) {
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	tomorrow := today.AddDate(0, 0, 1)
+
+	if c.Query("from") != "" || c.Query("to") != "" {
+		from, err := time.ParseInLocation("2006-01-02", c.Query("from"), loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date (YYYY-MM-DD)"})
+			return "", from, from, false
+		}
+		to := tomorrow
+		if v := c.Query("to"); v != "" {
+			t, err := time.ParseInLocation("2006-01-02", v, loc)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date (YYYY-MM-DD)"})
+				return "", from, from, false
+			}
+			to = t.AddDate(0, 0, 1)
+		}
+		if !from.Before(to) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+			return "", from, from, false
+		}
+		return "custom", from, to, true
+	}
+
+	period := c.DefaultQuery("period", "week")
+	switch period {
+	case "today":
+		return period, today, tomorrow, true
+	case "week":
+		return period, weekStarting(local), tomorrow, true
+	case "month":
+		return period, time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc), tomorrow, true
+	case "all":
+		return period, time.Unix(0, 0), tomorrow, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "period must be today, week, month or all"})
+	return "", today, today, false
+}
+
+// getLeaderboardHandler ranks the team's members by dials, contacts or
+// wins over a period. Members who did nothing are listed at the bottom.
+func getLeaderboardHandler(c *gin.Context) {
+	repo, team, ok := teamFor(c)
+	if !ok {
+		return
+	}
+	if !team.LeaderboardEnabled && !team.canManage(repo.Tenant().UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The leaderboard has been turned off for this team"})
+		return
+	}
+	sortBy := c.DefaultQuery("sort", "dials")
+	key, ok := leaderboardSorts[sortBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be dials, contacts or wins"})
+		return
+	}
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	period, from, to, ok := leaderboardPeriod(c, settings.location(), time.Now())
+	if !ok {
+		return
+	}
+
+	stats, err := repo.Performance(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load leaderboard"})
+		return
+	}
+	entries := []LeaderboardEntry{}
+	for _, m := range team.Members {
+		e := LeaderboardEntry{UserID: m.ID, Name: m.Name}
+		if s := stats[m.ID]; s != nil {
+			e.Dials, e.Contacts, e.Wins = s.Dials, s.Contacts, s.DealsWon
+		}
+		entries = append(entries, e)
+	}
+	// Members are already in name order, which breaks ties.
+	sort.SliceStable(entries, func(i, j int) bool { return key(entries[i]) > key(entries[j]) })
+	for i := range entries {
+		entries[i].Rank = i + 1
+		if i > 0 && key(entries[i]) == key(entries[i-1]) {
+			entries[i].Rank = entries[i-1].Rank
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"period": period, "from": from, "to": to, "sort": sortBy, "entries": entries})
+}
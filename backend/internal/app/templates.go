@@ -0,0 +1,289 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- MESSAGE TEMPLATES ---
+//
+// Templates are the emails and text messages reps send to leads. They use
+// the same {{variable|fallback}} placeholders as call scripts. Before a
+// template goes to real leads it can be previewed against one of them,
+// which lists the variables that lead would leave blank, and test-sent to
+// the user's own email address.
+
+const (
+	TEMPLATE_EMAIL = "email"
+	TEMPLATE_SMS   = "sms"
+)
+
+const MAX_TEMPLATE_SUBJECT_LENGTH = 200
+const MAX_TEMPLATE_BODY_LENGTH = 20000
+
+type MessageTemplate struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	// Subject is only used by email templates.
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type templateInput struct {
+	Name    string `json:"name" binding:"required"`
+	Channel string `json:"channel" binding:"required"`
+	Subject string `json:"subject"`
+	Body    string `json:"body" binding:"required"`
+}
+
+func (in templateInput) validate(fe fieldErrors) {
+	checkLength(fe, "name", in.Name, 1, 100)
+	fe.check(in.Channel == TEMPLATE_EMAIL || in.Channel == TEMPLATE_SMS, "channel", "must be email or sms")
+	if in.Channel == TEMPLATE_EMAIL {
+		checkLength(fe, "subject", in.Subject, 1, MAX_TEMPLATE_SUBJECT_LENGTH)
+		if err := validateScriptVariables(in.Subject); err != nil {
+			fe.check(false, "subject", err.Error())
+		}
+	}
+	checkLength(fe, "body", in.Body, 1, MAX_TEMPLATE_BODY_LENGTH)
+	if err := validateScriptVariables(in.Body); err != nil {
+		fe.check(false, "body", err.Error())
+	}
+}
+
+// TemplatePreview is a template filled in for one lead.
+type TemplatePreview struct {
+	TemplateID string `json:"templateId"`
+	LeadID     string `json:"leadId"`
+	Channel    string `json:"channel"`
+	Subject    string `json:"subject,omitempty"`
+	Body       string `json:"body"`
+	// Missing lists variables the lead has no value for and the template
+	// gives no fallback for, so they'd come out blank.
+	Missing []string `json:"missing"`
+}
+
+// renderTemplate fills in tpl for values.
+func renderTemplate(tpl MessageTemplate, leadID string, values map[string]string) TemplatePreview {
+	p := TemplatePreview{TemplateID: tpl.ID, LeadID: leadID, Channel: tpl.Channel, Missing: []string{}}
+	var missingSubject, missingBody []string
+	if tpl.Channel == TEMPLATE_EMAIL {
+		p.Subject, missingSubject = renderScript(tpl.Subject, values)
+	}
+	p.Body, missingBody = renderScript(tpl.Body, values)
+	seen := map[string]bool{}
+	for _, v := range append(missingSubject, missingBody...) {
+		if !seen[v] {
+			seen[v] = true
+			p.Missing = append(p.Missing, v)
+		}
+	}
+	return p
+}
+
+// leadTemplateValues collects the placeholder values for a lead, from its
+// card when it's on the board and from the search result otherwise.
+func leadTemplateValues(ctx context.Context, repo *Repository, leadID string) (map[string]string, error) {
+	lead, err := repo.Leads().Get(leadID)
+	if err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	crmLead, crmErr := repo.Crm().Card(leadID)
+	if crmErr == store.ErrNotFound {
+		if err == store.ErrNotFound {
+			return nil, store.ErrNotFound
+		}
+		crmLead = CrmLead{ID: lead.ID, CompanyName: lead.CompanyName, Phone: lead.Phone, Website: lead.Website, Email: lead.Email, PageSpeed: lead.PageSpeed}
+	} else if crmErr != nil {
+		return nil, crmErr
+	}
+	var repName string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM users WHERE id = ?", repo.Tenant().UserID).Scan(&repName); err != nil {
+		return nil, err
+	}
+	return scriptValues(crmLead, lead, repName), nil
+}
+
+func getTemplatesHandler(c *gin.Context) {
+	templates, err := repoFrom(c).MessageTemplates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve templates"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": templates, "variables": scriptVariables})
+}
+
+func getTemplateHandler(c *gin.Context) {
+	tpl, err := repoFrom(c).MessageTemplate(c.Param("templateId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load template"})
+		return
+	}
+	c.JSON(http.StatusOK, tpl)
+}
+
+func createTemplateHandler(c *gin.Context) {
+	var input templateInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) {
+		return
+	}
+
+	now := time.Now()
+	tpl := MessageTemplate{ID: uuid.New().String(), Name: strings.TrimSpace(input.Name), Channel: input.Channel, Body: input.Body, CreatedAt: now, UpdatedAt: now}
+	if input.Channel == TEMPLATE_EMAIL {
+		tpl.Subject = input.Subject
+	}
+	if err := repoFrom(c).CreateMessageTemplate(tpl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create template"})
+		return
+	}
+	c.JSON(http.StatusCreated, tpl)
+}
+
+func updateTemplateHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	templateID := c.Param("templateId")
+	var input templateInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(fe)
+	if fe.respond(c) {
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Channel != TEMPLATE_EMAIL {
+		input.Subject = ""
+	}
+
+	err := repo.UpdateMessageTemplate(templateID, input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update template"})
+		return
+	}
+	tpl, err := repo.MessageTemplate(templateID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load template"})
+		return
+	}
+	c.JSON(http.StatusOK, tpl)
+}
+
+func deleteTemplateHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteMessageTemplate(c.Param("templateId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete template"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// loadTemplatePreview renders the :templateId template for the lead named
+// in the request body, writing the error response itself when it can't.
+func loadTemplatePreview(c *gin.Context) (TemplatePreview, bool) {
+	repo := repoFrom(c)
+	var input struct {
+		LeadID string `json:"leadId" binding:"required,uuid"`
+	}
+	if !bindJSON(c, &input) {
+		return TemplatePreview{}, false
+	}
+	tpl, err := repo.MessageTemplate(c.Param("templateId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return TemplatePreview{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load template"})
+		return TemplatePreview{}, false
+	}
+	values, err := leadTemplateValues(c.Request.Context(), repo, input.LeadID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return TemplatePreview{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return TemplatePreview{}, false
+	}
+	return renderTemplate(tpl, input.LeadID, values), true
+}
+
+// previewTemplateHandler shows a template as a lead would get it.
+func previewTemplateHandler(c *gin.Context) {
+	preview, ok := loadTemplatePreview(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// testSendTemplateHandler emails a template, filled in for a lead, to the
+// user instead of the lead. Text messages come as an email too, so nothing
+// is sent to a phone.
+func testSendTemplateHandler(c *gin.Context) {
+	if !canSendMail(repoFrom(c)) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email is not configured"})
+		return
+	}
+	preview, ok := loadTemplatePreview(c)
+	if !ok {
+		return
+	}
+	var to string
+	if err := db.QueryRowContext(c.Request.Context(), "SELECT email FROM users WHERE id = ?", tenantFrom(c).UserID).Scan(&to); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	branding, err := repoFrom(c).Branding()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load branding"})
+		return
+	}
+	subject := "[Test] " + preview.Subject
+	body := preview.Body + branding.emailFooter()
+	if preview.Channel == TEMPLATE_SMS {
+		subject = "[Test text message]"
+		body = preview.Body
+	}
+	err = sendUserMail(repoFrom(c), to, subject, body, nil)
+	if err == errMailAccountDailyLimit {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Your email account has reached its daily sending limit"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to send test of template %s to %s: %v", preview.TemplateID, to, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send test email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sentTo": to, "preview": preview})
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/auth"
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/store"
+)
+
+// --- TENANTS ---
+//
+// Searches, leads, the CRM board and territories belong to an organization
+// rather than to the user who created them. Every user belongs to exactly
+// one organization; new users get one of their own on registration.
+// Account-level data (settings, billing, idempotency keys) stays per user.
+
+type Tenant = store.Tenant
+
+// tenantFrom returns the tenant authMiddleware resolved for the request.
+func tenantFrom(c *gin.Context) Tenant {
+	t, _ := c.Get("tenant")
+	return t.(Tenant)
+}
+
+// createOrganization adds an organization for a new user, with a board
+// ready to use.
+func createOrganization(tx *sql.Tx, name string) (int64, error) {
+	res, err := tx.Exec("INSERT INTO organizations (name) VALUES (?)", name)
+	if err != nil {
+		return 0, err
+	}
+	orgID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return orgID, crm.Seed(tx, orgID)
+}
+
+// createOwner adds a user along with an organization of their own, returning
+// both IDs. A duplicate email comes back as auth.ErrEmailTaken.
+func createOwner(tx *sql.Tx, name, email, passwordHash string, isAdmin bool) (userID, orgID int64, err error) {
+	if orgID, err = createOrganization(tx, name); err != nil {
+		return 0, 0, err
+	}
+	userID, err = auth.NewRepository(context.Background(), tx).Create(auth.User{Name: name, Email: email, PasswordHash: passwordHash, OrgID: orgID, IsAdmin: isAdmin})
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = tx.Exec("UPDATE organizations SET owner_id = ? WHERE id = ?", userID, orgID)
+	return userID, orgID, err
+}
+
+// backfillTenants gives users from before organizations existed one each
+// and moves their data into it.
+func backfillTenants() {
+	rows, err := db.Query("SELECT id, name FROM users WHERE org_id IS NULL")
+	if err != nil {
+		log.Fatal("Failed to load users without an organization:", err)
+	}
+	type pending struct {
+		id   int64
+		name string
+	}
+	var users []pending
+	for rows.Next() {
+		var u pending
+		if err := rows.Scan(&u.id, &u.name); err != nil {
+			log.Fatal("Failed to load users without an organization:", err)
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal("Failed to start tenant backfill:", err)
+	}
+	defer tx.Rollback()
+
+	for _, u := range users {
+		orgID, err := createOrganization(tx, u.name)
+		if err == nil {
+			_, err = tx.Exec("UPDATE users SET org_id = ? WHERE id = ?", orgID, u.id)
+		}
+		if err != nil {
+			log.Fatal("Failed to create organization for user:", err)
+		}
+	}
+
+	statements := []string{
+		"UPDATE searches SET org_id = (SELECT org_id FROM users WHERE users.id = searches.user_id) WHERE org_id IS NULL",
+		"UPDATE crm_leads SET org_id = (SELECT org_id FROM users WHERE users.id = crm_leads.user_id) WHERE org_id IS NULL",
+		"UPDATE territories SET org_id = (SELECT org_id FROM users WHERE users.id = territories.user_id) WHERE org_id IS NULL",
+		"CREATE INDEX IF NOT EXISTS searches_org_id ON searches (org_id)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS crm_leads_org_lead ON crm_leads (org_id, lead_id)",
+		"CREATE INDEX IF NOT EXISTS territories_org_id ON territories (org_id)",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			log.Fatal("Failed to backfill tenant data:", err)
+		}
+	}
+
+	// Board versions used to be kept per user.
+	var legacyVersions int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'crm_board_versions'").Scan(&legacyVersions); err != nil {
+		log.Fatal("Failed to inspect schema:", err)
+	}
+	if legacyVersions > 0 {
+		_, err := tx.Exec(`
+            INSERT OR IGNORE INTO org_crm_versions (org_id, version)
+            SELECT u.org_id, v.version FROM crm_board_versions v JOIN users u ON u.id = v.user_id
+        `)
+		if err == nil {
+			_, err = tx.Exec("DROP TABLE crm_board_versions")
+		}
+		if err != nil {
+			log.Fatal("Failed to migrate CRM board versions:", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatal("Failed to commit tenant backfill:", err)
+	}
+	if len(users) > 0 {
+		log.Printf("Created organizations for %d existing users", len(users))
+	}
+}
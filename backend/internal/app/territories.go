@@ -0,0 +1,202 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- GEOMETRY ---
+const EARTH_RADIUS_KM = 6371.0
+
+type latLng struct {
+	lat, lng float64
+}
+
+type bbox struct {
+	minLat, maxLat, minLng, maxLng float64
+}
+
+func parseLatLng(s string) (latLng, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return latLng{}, fmt.Errorf("expected lat,lng")
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return latLng{}, err
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return latLng{}, err
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return latLng{}, fmt.Errorf("coordinates out of range")
+	}
+	return latLng{lat, lng}, nil
+}
+
+func haversineKm(a, b latLng) float64 {
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := toRad(b.lat - a.lat)
+	dLng := toRad(b.lng - a.lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(a.lat))*math.Cos(toRad(b.lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Sqrt(h))
+}
+
+// boundingBox returns a box that fully contains the circle of radiusKm
+// around center, so SQL can discard far-away leads before the exact check.
+func boundingBox(center latLng, radiusKm float64) bbox {
+	dLat := radiusKm / EARTH_RADIUS_KM * 180 / math.Pi
+	dLng := 180.0
+	if cos := math.Cos(center.lat * math.Pi / 180); cos > 1e-6 {
+		dLng = math.Min(dLat/cos, 180)
+	}
+	return bbox{center.lat - dLat, center.lat + dLat, center.lng - dLng, center.lng + dLng}
+}
+
+// polygon is a ring of [lng, lat] positions, matching GeoJSON ordering.
+type polygon [][2]float64
+
+func (p polygon) bounds() bbox {
+	b := bbox{math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)}
+	for _, pt := range p {
+		b.minLng = math.Min(b.minLng, pt[0])
+		b.maxLng = math.Max(b.maxLng, pt[0])
+		b.minLat = math.Min(b.minLat, pt[1])
+		b.maxLat = math.Max(b.maxLat, pt[1])
+	}
+	return b
+}
+
+// contains uses ray casting; points exactly on an edge may fall either way.
+func (p polygon) contains(pt latLng) bool {
+	inside := false
+	for i, j := 0, len(p)-1; i < len(p); j, i = i, i+1 {
+		xi, yi := p[i][0], p[i][1]
+		xj, yj := p[j][0], p[j][1]
+		if (yi > pt.lat) != (yj > pt.lat) && pt.lng < (xj-xi)*(pt.lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// --- TERRITORIES ---
+type Territory struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Assignee  string    `json:"assignee"`
+	Polygon   polygon   `json:"polygon"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type territoryInput struct {
+	Name     string  `json:"name" binding:"required"`
+	Assignee string  `json:"assignee"`
+	Polygon  polygon `json:"polygon" binding:"required"`
+}
+
+func (in territoryInput) validate() error {
+	if len(in.Polygon) < 3 {
+		return fmt.Errorf("polygon needs at least three points")
+	}
+	for _, pt := range in.Polygon {
+		if pt[0] < -180 || pt[0] > 180 || pt[1] < -90 || pt[1] > 90 {
+			return fmt.Errorf("polygon points must be [lng, lat] within range")
+		}
+	}
+	return nil
+}
+
+func scanTerritory(row store.RowScanner) (Territory, error) {
+	var t Territory
+	var rawPolygon string
+	if err := row.Scan(&t.ID, &t.Name, &t.Assignee, &rawPolygon, &t.CreatedAt); err != nil {
+		return t, err
+	}
+	err := json.Unmarshal([]byte(rawPolygon), &t.Polygon)
+	return t, err
+}
+
+func getTerritoriesHandler(c *gin.Context) {
+	territories, err := repoFrom(c).Territories()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve territories"})
+		return
+	}
+	c.JSON(http.StatusOK, territories)
+}
+
+func createTerritoryHandler(c *gin.Context) {
+	var input territoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	t := Territory{ID: uuid.New().String(), Name: input.Name, Assignee: input.Assignee, Polygon: input.Polygon, CreatedAt: time.Now()}
+	if err := repoFrom(c).CreateTerritory(t); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create territory", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, t)
+}
+
+func updateTerritoryHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	territoryID := c.Param("territoryId")
+
+	var input territoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := repo.UpdateTerritory(territoryID, input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Territory not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update territory", "details": err.Error()})
+		return
+	}
+
+	t, err := repo.Territory(territoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load territory"})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func deleteTerritoryHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteTerritory(c.Param("territoryId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Territory not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete territory"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,262 @@
+package app
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/leads"
+)
+
+// --- LEAD TIMEZONES ---
+//
+// Each lead's timezone is inferred once, from its coordinates where we know
+// the region well enough, otherwise from the phone number's country.
+
+// zoneRegions are coarse boxes checked in order, so smaller regions come
+// first. Ireland's box clips the west of Northern Ireland, but both sides
+// of the border keep the same clock.
+var zoneRegions = []struct {
+	box  bbox
+	zone string
+}{
+	{bbox{51.3, 55.4, -10.7, -6.0}, "Europe/Dublin"},
+	{bbox{49.8, 60.9, -8.7, 1.8}, "Europe/London"},
+	// Arizona stays on standard time all year.
+	{bbox{31.3, 37.0, -114.8, -109.05}, "America/Phoenix"},
+	{bbox{24.5, 49.0, -125.0, -114.5}, "America/Los_Angeles"},
+	{bbox{24.5, 49.0, -114.5, -102.0}, "America/Denver"},
+	{bbox{24.5, 49.0, -102.0, -87.5}, "America/Chicago"},
+	{bbox{24.5, 49.0, -87.5, -66.9}, "America/New_York"},
+	{bbox{49.0, 60.0, -139.0, -120.0}, "America/Vancouver"},
+	{bbox{49.0, 60.0, -120.0, -110.0}, "America/Edmonton"},
+	{bbox{49.0, 60.0, -110.0, -102.0}, "America/Regina"},
+	{bbox{49.0, 60.0, -102.0, -90.0}, "America/Winnipeg"},
+	{bbox{41.7, 60.0, -90.0, -63.0}, "America/Toronto"},
+	{bbox{43.0, 60.0, -63.0, -52.0}, "America/Halifax"},
+}
+
+// countryZones covers countries that keep one clock, keyed by ISO code
+// with their international dialling code.
+var countryZones = map[string]struct {
+	callingCode string
+	zone        string
+}{
+	"GB": {"44", "Europe/London"},
+	"IE": {"353", "Europe/Dublin"},
+	"FR": {"33", "Europe/Paris"},
+	"DE": {"49", "Europe/Berlin"},
+	"ES": {"34", "Europe/Madrid"},
+	"IT": {"39", "Europe/Rome"},
+	"NL": {"31", "Europe/Amsterdam"},
+	"BE": {"32", "Europe/Brussels"},
+	"CH": {"41", "Europe/Zurich"},
+	"AT": {"43", "Europe/Vienna"},
+	"DK": {"45", "Europe/Copenhagen"},
+	"SE": {"46", "Europe/Stockholm"},
+	"NO": {"47", "Europe/Oslo"},
+	"PL": {"48", "Europe/Warsaw"},
+	"PT": {"351", "Europe/Lisbon"},
+	"FI": {"358", "Europe/Helsinki"},
+	"GR": {"30", "Europe/Athens"},
+	"ZA": {"27", "Africa/Johannesburg"},
+	"AE": {"971", "Asia/Dubai"},
+	"IN": {"91", "Asia/Kolkata"},
+	"SG": {"65", "Asia/Singapore"},
+	"JP": {"81", "Asia/Tokyo"},
+	"NZ": {"64", "Pacific/Auckland"},
+}
+
+// inferTimezone returns an IANA zone for a lead, or "" if it can't tell.
+func inferTimezone(lat, lng *float64, phone string) string {
+	if lat != nil && lng != nil {
+		for _, r := range zoneRegions {
+			if *lat >= r.box.minLat && *lat <= r.box.maxLat && *lng >= r.box.minLng && *lng <= r.box.maxLng {
+				return r.zone
+			}
+		}
+	}
+
+	phone = strings.TrimSpace(phone)
+	international := strings.HasPrefix(phone, "+") || strings.HasPrefix(phone, "00")
+	if international {
+		digits := strings.TrimPrefix(strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, phone), "00")
+		// Dialling codes are prefix-free, so at most one can match.
+		for _, c := range countryZones {
+			if strings.HasPrefix(digits, c.callingCode) {
+				return c.zone
+			}
+		}
+		return ""
+	}
+	if phone != "" {
+		if c, ok := countryZones[phoneDefaultCountry]; ok {
+			return c.zone
+		}
+	}
+	return ""
+}
+
+// assignLeadTimezones infers a timezone for every lead that hasn't had one
+// worked out yet; leads it can't place are stored with an empty zone.
+func assignLeadTimezones() {
+	rows, err := db.Query("SELECT id, latitude, longitude, COALESCE(phone, '') FROM leads WHERE timezone IS NULL")
+	if err != nil {
+		log.Printf("Failed to load leads needing a timezone: %v", err)
+		return
+	}
+	zones := map[string]string{}
+	for rows.Next() {
+		var id, phone string
+		var lat, lng sql.NullFloat64
+		if err := rows.Scan(&id, &lat, &lng, &phone); err != nil {
+			log.Printf("Error scanning lead for timezone: %v", err)
+			continue
+		}
+		var latp, lngp *float64
+		if lat.Valid && lng.Valid {
+			latp, lngp = &lat.Float64, &lng.Float64
+		}
+		zones[id] = inferTimezone(latp, lngp, unseal(phone))
+	}
+	rows.Close()
+	if len(zones) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to store lead timezones: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for id, zone := range zones {
+		if _, err := tx.Exec("UPDATE leads SET timezone = ? WHERE id = ?", zone, id); err != nil {
+			log.Printf("Failed to store timezone for lead %s: %v", id, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to store lead timezones: %v", err)
+		return
+	}
+	log.Printf("Assigned timezones to %d leads", len(zones))
+}
+
+// --- CALLING WINDOWS ---
+
+// callingWindow is the part of each day a user is willing to call
+// businesses, in the business's own time. Leads with no known timezone are
+// assumed to share the user's.
+type callingWindow struct {
+	start, end int // hours, end exclusive
+	weekends   bool
+	fallback   *time.Location
+}
+
+func (s UserSettings) callingWindow() callingWindow {
+	return callingWindow{start: s.CallingHoursStart, end: s.CallingHoursEnd, weekends: s.CallOnWeekends, fallback: s.location()}
+}
+
+func (w callingWindow) location(zone string) *time.Location {
+	if zone == "" {
+		return w.fallback
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return w.fallback
+	}
+	return loc
+}
+
+// nextCallable returns the earliest moment from now, in the business's
+// time, that falls inside the window and, if they're known, its opening
+// hours. It returns now itself when the business can be called right away.
+func (w callingWindow) nextCallable(zone string, hours leads.OpeningHours, now time.Time) (time.Time, bool) {
+	local := now.In(w.location(zone))
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	for offset := 0; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		if !w.weekends && (day.Weekday() == time.Saturday || day.Weekday() == time.Sunday) {
+			continue
+		}
+		spans := [][2]int{{w.start * 60, w.end * 60}}
+		if len(hours) > 0 {
+			spans = intersectSpans(spans[0], hours.IntervalsOn(day.Weekday()))
+		}
+		for _, s := range spans {
+			start := time.Date(day.Year(), day.Month(), day.Day(), 0, s[0], 0, 0, day.Location())
+			end := time.Date(day.Year(), day.Month(), day.Day(), 0, s[1], 0, 0, day.Location())
+			if !end.After(local) {
+				continue
+			}
+			if start.After(local) {
+				return start, true
+			}
+			return local, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (w callingWindow) callableAt(zone string, hours leads.OpeningHours, now time.Time) bool {
+	next, ok := w.nextCallable(zone, hours, now)
+	return ok && next.Equal(now)
+}
+
+func intersectSpans(window [2]int, spans [][2]int) [][2]int {
+	var out [][2]int
+	for _, s := range spans {
+		start, end := max(window[0], s[0]), min(window[1], s[1])
+		if start < end {
+			out = append(out, [2]int{start, end})
+		}
+	}
+	return out
+}
+
+// CallableLead says when a card on the board can next be called.
+type CallableLead struct {
+	LeadID         string     `json:"leadId"`
+	Timezone       string     `json:"timezone"`
+	CallableNow    bool       `json:"callableNow"`
+	NextCallableAt *time.Time `json:"nextCallableAt"`
+}
+
+// getCallableLeadsHandler works out, for every card on the board, whether
+// it's inside the user's calling window right now and when it next will be.
+func getCallableLeadsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	settings, err := getUserSettings(c.Request.Context(), repo.Tenant().UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	targets, err := repo.CallTargets()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load CRM leads"})
+		return
+	}
+
+	window := settings.callingWindow()
+	now := time.Now()
+	callable := make([]CallableLead, 0, len(targets))
+	for _, t := range targets {
+		cl := CallableLead{LeadID: t.LeadID, Timezone: t.Timezone}
+		if next, ok := window.nextCallable(t.Timezone, t.Hours, now); ok {
+			cl.CallableNow = next.Equal(now)
+			cl.NextCallableAt = &next
+		}
+		callable = append(callable, cl)
+	}
+	c.JSON(http.StatusOK, callable)
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// --- TLS ---
+//
+// With TLS_DOMAINS set the server gets its own certificates from Let's
+// Encrypt and serves HTTPS, for running the binary on a VPS with nothing in
+// front of it. Without it the server speaks plain HTTP and leaves TLS to a
+// reverse proxy.
+
+// autocertManager returns nil when TLS_DOMAINS is unset.
+func autocertManager() *autocert.Manager {
+	var domains []string
+	for _, d := range strings.Split(os.Getenv("TLS_DOMAINS"), ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(envOrDefault("TLS_CACHE_DIR", "certs")),
+		Email:      os.Getenv("TLS_EMAIL"),
+	}
+}
+
+// serve runs srv until it's shut down, over TLS if it has a TLS config.
+func serve(srv *http.Server) {
+	var err error
+	if srv.TLSConfig != nil {
+		log.Printf("Serving HTTPS on %s", srv.Addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Serving HTTP on %s", srv.Addr)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Server on %s failed: %v", srv.Addr, err)
+	}
+}
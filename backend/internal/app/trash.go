@@ -0,0 +1,202 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- TRASH ---
+var trashRetentionDays = envInt("TRASH_RETENTION_DAYS", 30)
+
+type TrashedSearch struct {
+	ID        string    `json:"id"`
+	Keyword   string    `json:"keyword"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+type TrashedLead struct {
+	ID          string    `json:"id"`
+	SearchID    string    `json:"searchId,omitempty"`
+	CompanyName string    `json:"companyName"`
+	DeletedAt   time.Time `json:"deletedAt"`
+}
+
+func deleteSearchHandler(c *gin.Context) {
+	err := repoFrom(c).Searches().Trash(c.Param("searchId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete search"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func deleteLeadHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	searchID := c.Param("searchId")
+	if !repo.Searches().Owns(searchID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	err := leadService(c).Trash(searchID, c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete lead"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func deleteCrmLeadHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+	err := repo.Crm().Trash(c.Param("leadId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found in CRM"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete CRM lead"})
+		return
+	}
+	crmChanged(c, repo)
+	c.Status(http.StatusNoContent)
+}
+
+func getTrashHandler(c *gin.Context) {
+	repo := repoFrom(c)
+
+	searches, err := repo.TrashedSearches()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve trash"})
+		return
+	}
+	leads, err := repo.TrashedLeads()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve trash"})
+		return
+	}
+	crmLeads, err := repo.TrashedCrmLeads()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"searches":      searches,
+		"leads":         leads,
+		"crmLeads":      crmLeads,
+		"retentionDays": trashRetentionDays,
+	})
+}
+
+func restoreFromTrashHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	id := c.Param("id")
+
+	var restore func(string) error
+	switch c.Param("kind") {
+	case "searches":
+		restore = repo.Searches().Restore
+	case "leads":
+		restore = leadService(c).Restore
+	case "crm-leads":
+		restore = repo.Crm().Restore
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown trash kind; use searches, leads or crm-leads"})
+		return
+	}
+
+	err := restore(id)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore item"})
+		return
+	}
+	if c.Param("kind") == "crm-leads" {
+		version := crmChanged(c, repo)
+		c.JSON(http.StatusOK, gin.H{"message": "Item restored", "version": version})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Item restored"})
+}
+
+// purgeTrash permanently removes anything that has sat in the trash longer
+// than the retention period.
+func purgeTrash() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -trashRetentionDays).Format("2006-01-02 15:04:05")
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to begin trash purge: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Screenshots are files, so they go once the rows are gone.
+	var screenshots []string
+	rows, err := tx.Query(`SELECT screenshot FROM leads WHERE screenshot != ''
+        AND (deleted_at < ?1 OR search_id IN (SELECT id FROM searches WHERE deleted_at < ?1))`, cutoff)
+	if err != nil {
+		log.Printf("Trash purge failed: %v", err)
+		return
+	}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			screenshots = append(screenshots, key)
+		}
+	}
+	rows.Close()
+
+	statements := []string{
+		`DELETE FROM lead_emails WHERE lead_id IN (SELECT id FROM leads WHERE deleted_at < ?1
+            OR search_id IN (SELECT id FROM searches WHERE deleted_at < ?1))`,
+		`DELETE FROM lead_phones WHERE lead_id IN (SELECT id FROM leads WHERE deleted_at < ?1
+            OR search_id IN (SELECT id FROM searches WHERE deleted_at < ?1))`,
+		`DELETE FROM lead_audits WHERE lead_id IN (SELECT id FROM leads WHERE deleted_at < ?1
+            OR search_id IN (SELECT id FROM searches WHERE deleted_at < ?1))`,
+		`DELETE FROM leads WHERE deleted_at < ?1 OR search_id IN (SELECT id FROM searches WHERE deleted_at < ?1)`,
+		`DELETE FROM searches WHERE deleted_at < ?1`,
+		`DELETE FROM crm_note_revisions WHERE (org_id, lead_id) IN (SELECT org_id, lead_id FROM crm_leads WHERE deleted_at < ?1)`,
+		`DELETE FROM crm_activity WHERE (org_id, lead_id) IN (SELECT org_id, lead_id FROM crm_leads WHERE deleted_at < ?1)`,
+		`DELETE FROM crm_lead_tags WHERE (org_id, lead_id) IN (SELECT org_id, lead_id FROM crm_leads WHERE deleted_at < ?1)`,
+		`DELETE FROM share_links WHERE (org_id, lead_id) IN (SELECT org_id, lead_id FROM crm_leads WHERE deleted_at < ?1)`,
+		`DELETE FROM crm_leads WHERE deleted_at < ?1`,
+	}
+	var purged int64
+	for _, stmt := range statements {
+		res, err := tx.Exec(stmt, cutoff)
+		if err != nil {
+			log.Printf("Trash purge failed: %v", err)
+			return
+		}
+		n, _ := res.RowsAffected()
+		purged += n
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit trash purge: %v", err)
+		return
+	}
+	deleteScreenshots(screenshots)
+	if purged > 0 {
+		log.Printf("Purged %d rows from the trash", purged)
+	}
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- UNDO ---
+//
+// Each user keeps a short history of the cards they've dragged between
+// columns, so a slip on the board can be put right without remembering
+// where the card came from. Moves made by dispositions and automation
+// rules aren't part of it.
+
+const (
+	CRM_UNDO_TTL   = 15 * time.Minute
+	CRM_UNDO_DEPTH = 20
+)
+
+var errUndoStale = errors.New("card has moved since")
+
+// UndoneMove is a move that was reverted: the card went back from
+// FromColumnID to ColumnID.
+type UndoneMove struct {
+	LeadID       string `json:"leadId"`
+	ColumnID     string `json:"columnId"`
+	FromColumnID string `json:"fromColumnId"`
+}
+
+// undoCrmMoveHandler reverts the user's last column move. Calling it again
+// steps further back through the history.
+func undoCrmMoveHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	if !checkCrmIfMatch(c, repo) {
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	txRepo := repo.WithTx(tx)
+
+	move, err := txRepo.UndoCrmMove()
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Nothing to undo"})
+		return
+	}
+	if err == errUndoStale {
+		// The stale entry is dropped so the next undo can go further back.
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to undo move"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "The card has been moved or removed since, so that move can't be undone", "leadId": move.LeadID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to undo move"})
+		return
+	}
+	version := crmChanged(c, txRepo)
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to undo move"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"undone": move, "version": version})
+}
+
+// purgeUndoHistory forgets moves too old to undo.
+func purgeUndoHistory() {
+	if _, err := db.Exec("DELETE FROM crm_undo_moves WHERE created_at < ?", time.Now().UTC().Add(-CRM_UNDO_TTL)); err != nil {
+		log.Printf("Failed to purge undo history: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- UNSUBSCRIBING ---
+//
+// Every campaign email ends with a link to /u/<token>, personal to the
+// recipient, and carries List-Unsubscribe headers so mail clients can
+// offer one-click unsubscribing (RFC 8058). Opening the link shows a
+// confirmation page; the opt-out is only recorded when it's submitted,
+// since mail scanners open links too. Unsubscribing puts the address on
+// the organization's suppression list, which every campaign checks before
+// each send.
+
+// unsubscribeURL is this server's public /u/ address, which links are
+// built on.
+var unsubscribeURL = envOrDefault("UNSUBSCRIBE_URL", "http://localhost:8080/u/")
+
+func newUnsubscribeToken() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// unsubscribeFooter is appended to each campaign email's body.
+func unsubscribeFooter(token string) string {
+	return "\n\n--\nDon't want these emails? Unsubscribe: " + unsubscribeURL + token + "\n"
+}
+
+// unsubscribeHeaders let mail clients unsubscribe with one click.
+func unsubscribeHeaders(token string) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeURL + token + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+// pendingUnsubscribe is the campaign recipient an unsubscribe token
+// belongs to.
+type pendingUnsubscribe struct {
+	orgID        int64
+	campaignID   string
+	campaignName string
+	leadID       string
+	email        string
+	done         bool
+}
+
+func findUnsubscribe(ctx context.Context, token string) (pendingUnsubscribe, error) {
+	var u pendingUnsubscribe
+	var unsubscribedAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+        SELECT c.org_id, c.id, c.name, r.lead_id, r.email, r.unsubscribed_at
+        FROM campaign_recipients r JOIN campaigns c ON c.id = r.campaign_id
+        WHERE r.unsubscribe_token = ?
+    `, token).Scan(&u.orgID, &u.campaignID, &u.campaignName, &u.leadID, &u.email, &unsubscribedAt)
+	if err == sql.ErrNoRows || token == "" {
+		return u, store.ErrNotFound
+	}
+	u.email = unseal(u.email)
+	u.done = unsubscribedAt.Valid
+	return u, err
+}
+
+// recordUnsubscribe suppresses the recipient's address, excludes them from
+// the rest of the campaign and notes it in the lead's activity. An address
+// wiped since, by forgetting the lead, is already suppressed.
+func recordUnsubscribe(ctx context.Context, u pendingUnsubscribe) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	repo := newRepository(Tenant{OrgID: u.orgID}).WithTx(tx)
+
+	if u.email != "" {
+		if _, err := repo.AddSuppressions(nil, []string{u.email}, "Unsubscribed from "+u.campaignName); err != nil {
+			return err
+		}
+	}
+	if err := repo.MarkCampaignUnsubscribe(u.campaignID, u.leadID, time.Now().UTC()); err != nil {
+		return err
+	}
+	if repo.Crm().HasCard(u.leadID) {
+		if err := repo.logActivity(u.leadID, "unsubscribed", map[string]interface{}{"campaignId": u.campaignID}); err != nil {
+			return err
+		}
+	}
+	log.Printf("Recipient %s of campaign %s unsubscribed", u.leadID, u.campaignID)
+	return tx.Commit()
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Unsubscribe</title></head>
+<body style="font-family: sans-serif; max-width: 32rem; margin: 4rem auto; padding: 0 1rem">
+{{if not .Found}}
+<h1>Link not recognised</h1>
+<p>This unsubscribe link isn't valid. Reply to the email you received and ask to be removed instead.</p>
+{{else if .Done}}
+<h1>You're unsubscribed</h1>
+<p>{{.Email}} won't get any more of these emails.</p>
+{{else}}
+<h1>Unsubscribe</h1>
+<p>Stop sending emails to {{.Email}}?</p>
+<form method="post"><button type="submit">Unsubscribe</button></form>
+{{end}}
+</body>
+</html>
+`))
+
+type unsubscribePageData struct {
+	Found bool
+	Done  bool
+	Email string
+}
+
+func renderUnsubscribePage(c *gin.Context, status int, data unsubscribePageData) {
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	if err := unsubscribePage.Execute(c.Writer, data); err != nil {
+		log.Printf("Failed to render unsubscribe page: %v", err)
+	}
+}
+
+// unsubscribePageHandler asks the recipient to confirm.
+func unsubscribePageHandler(c *gin.Context) {
+	u, err := findUnsubscribe(c.Request.Context(), c.Param("token"))
+	if err == store.ErrNotFound {
+		renderUnsubscribePage(c, http.StatusNotFound, unsubscribePageData{})
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	renderUnsubscribePage(c, http.StatusOK, unsubscribePageData{Found: true, Done: u.done, Email: u.email})
+}
+
+// unsubscribeHandler records the opt-out, from the confirmation page or a
+// mail client's one-click request. Repeating it is harmless.
+func unsubscribeHandler(c *gin.Context) {
+	u, err := findUnsubscribe(c.Request.Context(), c.Param("token"))
+	if err == store.ErrNotFound {
+		renderUnsubscribePage(c, http.StatusNotFound, unsubscribePageData{})
+		return
+	}
+	if err == nil && !u.done {
+		err = recordUnsubscribe(c.Request.Context(), u)
+	}
+	if err != nil {
+		log.Printf("Failed to unsubscribe campaign %s recipient %s: %v", u.campaignID, u.leadID, err)
+		c.String(http.StatusInternalServerError, "Something went wrong; please try again later.")
+		return
+	}
+	renderUnsubscribePage(c, http.StatusOK, unsubscribePageData{Found: true, Done: true, Email: u.email})
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+// --- INPUT VALIDATION ---
+//
+// Binding only checks that required fields are there. The checks here go
+// further and report problems per field, so the frontend can show each one
+// next to its input:
+//
+//	{"error": "Some fields are invalid", "fields": {"email": "must be a valid email address"}}
+
+const MIN_PASSWORD_LENGTH = 8
+
+// MAX_PASSWORD_BYTES is as much of a password as bcrypt looks at.
+const MAX_PASSWORD_BYTES = 72
+const MAX_EMAIL_LENGTH = 254
+const MAX_NAME_LENGTH = 100
+const MAX_KEYWORD_LENGTH = 100
+const MAX_LOCATION_LENGTH = 100
+
+// uuidParams are the path parameters that always hold a UUID.
+var uuidParams = []string{"searchId", "leadId", "listId", "scriptId", "templateId", "campaignId", "territoryId", "ruleId", "invitationId", "meetingId", "taskId", "viewId", "segmentId", "linkId"}
+
+func init() {
+	// Name fields in binding errors the way clients see them.
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// fieldErrors maps a field's JSON name to what's wrong with it.
+type fieldErrors map[string]string
+
+// check records message for field unless ok. Only the first problem with a
+// field is kept.
+func (fe fieldErrors) check(ok bool, field, message string) {
+	if _, seen := fe[field]; !ok && !seen {
+		fe[field] = message
+	}
+}
+
+// respond answers a 400 listing the field errors, if there are any, and
+// reports whether it did.
+func (fe fieldErrors) respond(c *gin.Context) bool {
+	if len(fe) == 0 {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Some fields are invalid", "fields": fe})
+	return true
+}
+
+// bindJSON binds the request body into input. Missing required fields are
+// reported per field; a body that isn't valid JSON gets a plain 400.
+func bindJSON(c *gin.Context, input interface{}) bool {
+	err := c.ShouldBindJSON(input)
+	if err == nil {
+		return true
+	}
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	fe := fieldErrors{}
+	for _, e := range invalid {
+		message := "is invalid"
+		if e.Tag() == "required" {
+			message = "is required"
+		}
+		fe.check(false, e.Field(), message)
+	}
+	fe.respond(c)
+	return false
+}
+
+// validEmail accepts a bare RFC 5322 address whose domain has a dot in it.
+func validEmail(email string) bool {
+	if len(email) > MAX_EMAIL_LENGTH {
+		return false
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return false
+	}
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	return strings.Contains(domain, ".") && !strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+// checkPassword applies the password policy: at least MIN_PASSWORD_LENGTH
+// characters, no more than bcrypt reads, and a mix of letters and digits
+// or symbols.
+func checkPassword(fe fieldErrors, field, password string) {
+	fe.check(utf8.RuneCountInString(password) >= MIN_PASSWORD_LENGTH, field, "must be at least 8 characters")
+	fe.check(len(password) <= MAX_PASSWORD_BYTES, field, "must be at most 72 bytes")
+	var letter, other bool
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			letter = true
+		} else if !unicode.IsSpace(r) {
+			other = true
+		}
+	}
+	fe.check(letter && other, field, "must contain a letter and a digit or symbol")
+}
+
+// checkLength requires value, trimmed, to be between min and max characters.
+func checkLength(fe fieldErrors, field, value string, min, max int) {
+	n := utf8.RuneCountInString(strings.TrimSpace(value))
+	fe.check(n >= min, field, "is required")
+	fe.check(n <= max, field, "is too long")
+}
+
+// uuidParamsMiddleware rejects requests whose ID path parameters aren't
+// UUIDs before they reach a handler or the database.
+func uuidParamsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fe := fieldErrors{}
+		for _, name := range uuidParams {
+			if v, ok := c.Params.Get(name); ok {
+				_, err := uuid.Parse(v)
+				fe.check(err == nil && len(v) == 36, name, "must be a UUID")
+			}
+		}
+		if fe.respond(c) {
+			c.Abort()
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"blueleads-backend/internal/store"
+)
+
+// --- EMAIL VERIFIERS ---
+//
+// Users pick how addresses are verified in their settings: the built-in
+// SMTP check, or a paid service with their own API key. Every check is
+// counted per user, provider and month, and users can cap their monthly
+// checks so a runaway guess doesn't spend their credits.
+
+// EmailVerifier returns a verdict (EMAIL_VALID etc.) for each address.
+type EmailVerifier interface {
+	Info() VerifierInfo
+	Verify(ctx context.Context, apiKey string, emails []string) (map[string]string, error)
+}
+
+// VerifierInfo describes a verifier. Paid verifiers charge per address, so
+// guesses are checked one at a time and stop at the first hit.
+type VerifierInfo struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	RequiresAPIKey bool   `json:"requiresApiKey"`
+	Paid           bool   `json:"paid"`
+}
+
+const DEFAULT_EMAIL_VERIFIER = "smtp"
+
+var emailVerifiers = map[string]EmailVerifier{}
+
+func registerEmailVerifier(v EmailVerifier) {
+	emailVerifiers[v.Info().ID] = v
+}
+
+func registerEmailVerifiers() {
+	client := &http.Client{Timeout: 30 * time.Second}
+	registerEmailVerifier(smtpVerifier{})
+	registerEmailVerifier(&zeroBounceVerifier{client: client})
+	registerEmailVerifier(&neverBounceVerifier{client: client})
+}
+
+// verifierFor returns the chosen verifier, or the built-in one if the
+// choice is no longer available.
+func verifierFor(id string) EmailVerifier {
+	if v, ok := emailVerifiers[id]; ok {
+		return v
+	}
+	return smtpVerifier{}
+}
+
+var errVerificationQuota = errors.New("monthly email verification limit reached")
+
+// verifyEmails checks addresses with the user's chosen verifier, within
+// their monthly limit, and records the usage.
+func verifyEmails(ctx context.Context, userID int64, emails []string) (map[string]string, error) {
+	settings, err := getUserSettings(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %w", err)
+	}
+	v := verifierFor(settings.EmailVerifier)
+	info := v.Info()
+	if info.RequiresAPIKey && settings.EmailVerifierAPIKey == "" {
+		return nil, fmt.Errorf("add a %s API key in settings", info.Name)
+	}
+
+	used, err := verificationsThisMonth(ctx, userID, info.ID)
+	if err != nil {
+		return nil, err
+	}
+	if limit := settings.EmailVerifierMonthlyLimit; limit > 0 && used+len(emails) > limit {
+		return nil, errVerificationQuota
+	}
+
+	verdicts, verifyErr := v.Verify(ctx, settings.EmailVerifierAPIKey, emails)
+	if len(verdicts) > 0 {
+		if err := recordVerifications(ctx, userID, info.ID, len(verdicts)); err != nil {
+			return verdicts, err
+		}
+	}
+	return verdicts, verifyErr
+}
+
+func verificationPeriod() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+func verificationsThisMonth(ctx context.Context, userID int64, provider string) (int, error) {
+	var checked int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(checked), 0) FROM email_verification_usage WHERE user_id = ? AND provider = ? AND period = ?",
+		userID, provider, verificationPeriod()).Scan(&checked)
+	return checked, err
+}
+
+func recordVerifications(ctx context.Context, userID int64, provider string, n int) error {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO email_verification_usage (user_id, provider, period, checked) VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_id, provider, period) DO UPDATE SET checked = checked + excluded.checked
+    `, userID, provider, verificationPeriod(), n)
+	return err
+}
+
+// getVerifiersHandler lists the verifiers with the user's usage of each
+// this month; the limit applies to the selected one.
+func getVerifiersHandler(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	settings, err := getUserSettings(c.Request.Context(), userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	selected := verifierFor(settings.EmailVerifier).Info().ID
+
+	type verifierStatus struct {
+		VerifierInfo
+		Selected bool         `json:"selected"`
+		Usage    usageCounter `json:"usage"`
+	}
+	verifiers := make([]verifierStatus, 0, len(emailVerifiers))
+	for _, v := range emailVerifiers {
+		info := v.Info()
+		used, err := verificationsThisMonth(c.Request.Context(), userID.(int64), info.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load verification usage"})
+			return
+		}
+		limit := 0
+		if info.ID == selected {
+			limit = settings.EmailVerifierMonthlyLimit
+		}
+		verifiers = append(verifiers, verifierStatus{VerifierInfo: info, Selected: info.ID == selected, Usage: newUsageCounter(used, limit)})
+	}
+	sort.Slice(verifiers, func(i, j int) bool { return verifiers[i].ID < verifiers[j].ID })
+	c.JSON(http.StatusOK, verifiers)
+}
+
+// verifyLeadEmailsHandler re-checks every address stored for a lead and
+// saves the verdicts.
+func verifyLeadEmailsHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	lead, err := repo.Leads().Get(c.Param("leadId"))
+	if err == store.ErrNotFound || (err == nil && lead.SearchID != c.Param("searchId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead"})
+		return
+	}
+	contacts, err := repo.Leads().Contacts([]string{lead.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead emails"})
+		return
+	}
+	emails := []string{}
+	for _, e := range contacts.Emails[lead.ID] {
+		emails = append(emails, e.Email)
+	}
+	if len(emails) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Lead has no emails to verify"})
+		return
+	}
+
+	verdicts, err := verifyEmails(c.Request.Context(), repo.Tenant().UserID, emails)
+	if err == errVerificationQuota {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Monthly email verification limit reached"})
+		return
+	}
+	if err != nil && len(verdicts) == 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Email verification failed", "details": err.Error()})
+		return
+	}
+	for email, verdict := range verdicts {
+		if _, err := db.ExecContext(c.Request.Context(), "UPDATE lead_emails SET verification = ? WHERE lead_id = ? AND email = ?", verdict, lead.ID, seal(email)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save verification"})
+			return
+		}
+	}
+
+	contacts, err = repo.Leads().Contacts([]string{lead.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load lead emails"})
+		return
+	}
+	c.JSON(http.StatusOK, contacts.Emails[lead.ID])
+}
+
+// --- BUILT-IN SMTP VERIFIER ---
+type smtpVerifier struct{}
+
+func (smtpVerifier) Info() VerifierInfo {
+	return VerifierInfo{ID: "smtp", Name: "Built-in SMTP check"}
+}
+
+// Verify opens one SMTP session per domain.
+func (smtpVerifier) Verify(ctx context.Context, _ string, emails []string) (map[string]string, error) {
+	byDomain := map[string][]string{}
+	for _, email := range emails {
+		at := strings.LastIndex(email, "@")
+		if at < 1 {
+			continue
+		}
+		domain := strings.ToLower(email[at+1:])
+		byDomain[domain] = append(byDomain[domain], email[:at])
+	}
+
+	verdicts := map[string]string{}
+	var firstErr error
+	for domain, locals := range byDomain {
+		found, err := verifyMailboxes(ctx, domain, locals)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for email, verdict := range found {
+			verdicts[email] = verdict
+		}
+	}
+	return verdicts, firstErr
+}
+
+// --- ZEROBOUNCE ---
+const ZEROBOUNCE_VALIDATE_URL = "https://api.zerobounce.net/v2/validate"
+
+type zeroBounceVerifier struct {
+	client *http.Client
+}
+
+func (v *zeroBounceVerifier) Info() VerifierInfo {
+	return VerifierInfo{ID: "zerobounce", Name: "ZeroBounce", RequiresAPIKey: true, Paid: true}
+}
+
+// ZeroBounce statuses that mean "don't mail this" count as invalid.
+var zeroBounceVerdicts = map[string]string{
+	"valid":       EMAIL_VALID,
+	"invalid":     EMAIL_INVALID,
+	"catch-all":   EMAIL_CATCH_ALL,
+	"spamtrap":    EMAIL_INVALID,
+	"abuse":       EMAIL_INVALID,
+	"do_not_mail": EMAIL_INVALID,
+}
+
+func (v *zeroBounceVerifier) Verify(ctx context.Context, apiKey string, emails []string) (map[string]string, error) {
+	verdicts := map[string]string{}
+	for _, email := range emails {
+		params := url.Values{}
+		params.Set("api_key", apiKey)
+		params.Set("email", email)
+		params.Set("ip_address", "")
+
+		var resp struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := getJSON(ctx, v.client, ZEROBOUNCE_VALIDATE_URL+"?"+params.Encode(), &resp); err != nil {
+			return verdicts, err
+		}
+		if resp.Error != "" {
+			return verdicts, fmt.Errorf("ZeroBounce: %s", resp.Error)
+		}
+		verdicts[email] = verdictOr(zeroBounceVerdicts, resp.Status)
+	}
+	return verdicts, nil
+}
+
+// --- NEVERBOUNCE ---
+const NEVERBOUNCE_CHECK_URL = "https://api.neverbounce.com/v4/single/check"
+
+type neverBounceVerifier struct {
+	client *http.Client
+}
+
+func (v *neverBounceVerifier) Info() VerifierInfo {
+	return VerifierInfo{ID: "neverbounce", Name: "NeverBounce", RequiresAPIKey: true, Paid: true}
+}
+
+var neverBounceVerdicts = map[string]string{
+	"valid":      EMAIL_VALID,
+	"invalid":    EMAIL_INVALID,
+	"disposable": EMAIL_INVALID,
+	"catchall":   EMAIL_CATCH_ALL,
+}
+
+func (v *neverBounceVerifier) Verify(ctx context.Context, apiKey string, emails []string) (map[string]string, error) {
+	verdicts := map[string]string{}
+	for _, email := range emails {
+		params := url.Values{}
+		params.Set("key", apiKey)
+		params.Set("email", email)
+
+		var resp struct {
+			Status  string `json:"status"`
+			Result  string `json:"result"`
+			Message string `json:"message"`
+		}
+		if err := getJSON(ctx, v.client, NEVERBOUNCE_CHECK_URL+"?"+params.Encode(), &resp); err != nil {
+			return verdicts, err
+		}
+		if resp.Status != "success" {
+			return verdicts, fmt.Errorf("NeverBounce: %s", resp.Message)
+		}
+		verdicts[email] = verdictOr(neverBounceVerdicts, resp.Result)
+	}
+	return verdicts, nil
+}
+
+func verdictOr(verdicts map[string]string, status string) string {
+	if v, ok := verdicts[strings.ToLower(status)]; ok {
+		return v
+	}
+	return EMAIL_UNKNOWN
+}
+
+func getJSON(ctx context.Context, client *http.Client, endpoint string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
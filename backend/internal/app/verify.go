@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- EMAIL VERIFICATION ---
+//
+// The built-in verifier asks the domain's mail server whether it would
+// accept each address, without sending anything: it stops after RCPT TO.
+// Many networks block outbound port 25, in which case every address comes
+// back unknown.
+
+const (
+	EMAIL_VALID     = "valid"
+	EMAIL_INVALID   = "invalid"
+	EMAIL_CATCH_ALL = "catch_all" // the server accepts any address, so it proves nothing
+	EMAIL_UNKNOWN   = "unknown"
+)
+
+const SMTP_VERIFY_TIMEOUT = 20 * time.Second
+
+var smtpVerifyPort = "25"
+
+var emailVerifyFrom = envOrDefault("EMAIL_VERIFY_FROM", envelopeAddress(mailFrom))
+var emailVerifyHelo = envOrDefault("EMAIL_VERIFY_HELO", hostnameOrLocalhost())
+
+func hostnameOrLocalhost() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
+}
+
+// mailHosts returns the domain's mail servers in preference order, or the
+// domain itself when it has no MX records.
+func mailHosts(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := net.DefaultResolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, err
+	}
+	var hosts []string
+	for _, mx := range mxs {
+		if host := strings.TrimSuffix(mx.Host, "."); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		if _, err := net.DefaultResolver.LookupHost(ctx, domain); err != nil {
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return nil, nil
+			}
+			return nil, err
+		}
+		hosts = []string{domain}
+	}
+	return hosts, nil
+}
+
+// verifyMailboxes checks local@domain for each local part over a single
+// SMTP session and returns a verdict for each address.
+func verifyMailboxes(ctx context.Context, domain string, locals []string) (map[string]string, error) {
+	verdicts := make(map[string]string, len(locals))
+	setAll := func(verdict string) map[string]string {
+		for _, local := range locals {
+			verdicts[local+"@"+domain] = verdict
+		}
+		return verdicts
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, SMTP_VERIFY_TIMEOUT)
+	defer cancel()
+
+	hosts, err := mailHosts(ctx, domain)
+	if err != nil {
+		return setAll(EMAIL_UNKNOWN), err
+	}
+	if len(hosts) == 0 {
+		return setAll(EMAIL_INVALID), nil
+	}
+
+	var client *smtp.Client
+	for _, host := range hosts[:min(len(hosts), 2)] {
+		client, err = dialSMTP(ctx, host)
+		if err == nil {
+			break
+		}
+	}
+	if client == nil {
+		return setAll(EMAIL_UNKNOWN), fmt.Errorf("connecting to mail server for %s: %w", domain, err)
+	}
+	defer client.Close()
+
+	if err := client.Hello(emailVerifyHelo); err != nil {
+		return setAll(EMAIL_UNKNOWN), err
+	}
+	if err := client.Mail(emailVerifyFrom); err != nil {
+		return setAll(EMAIL_UNKNOWN), err
+	}
+
+	// An address nobody would have tells us whether the server accepts
+	// everything.
+	switch rcptVerdict(client.Rcpt(strings.ReplaceAll(uuid.New().String(), "-", "") + "@" + domain)) {
+	case EMAIL_VALID:
+		client.Quit()
+		return setAll(EMAIL_CATCH_ALL), nil
+	case EMAIL_UNKNOWN:
+		client.Quit()
+		return setAll(EMAIL_UNKNOWN), nil
+	}
+
+	for _, local := range locals {
+		verdicts[local+"@"+domain] = rcptVerdict(client.Rcpt(local + "@" + domain))
+	}
+	client.Quit()
+	return verdicts, nil
+}
+
+func dialSMTP(ctx context.Context, host string) (*smtp.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, smtpVerifyPort))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// rcptVerdict maps a RCPT TO reply onto a verdict: permanent failures mean
+// the mailbox doesn't exist, temporary ones (greylisting) tell us nothing.
+func rcptVerdict(err error) string {
+	if err == nil {
+		return EMAIL_VALID
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		return EMAIL_INVALID
+	}
+	return EMAIL_UNKNOWN
+}
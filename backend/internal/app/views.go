@@ -0,0 +1,266 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"blueleads-backend/internal/crm"
+	"blueleads-backend/internal/store"
+)
+
+// --- SAVED VIEWS ---
+//
+// A saved view is a named set of filters ("No website, Manchester, not
+// called yet") a user can come back to. The same view applies to the
+// leads list and the CRM board: GET /api/leads/:searchId?view=,
+// /api/lists/:listId/leads?view= and /api/crm?view= start from the view's
+// filters, which any filter given alongside overrides, and each ignores
+// the filters it doesn't have (the board has no sort; the leads list has
+// no tag).
+
+// leadViewFilters and boardViewFilters are the filters a view can hold for
+// each of the places it applies.
+var (
+	leadViewFilters  = []string{"minRating", "minReviews", "category", "lineType", "hasWebsite", "address", "called", "minEmployees", "maxEmployees", "liveChat", "onlineBooking", "ecommerce", "analytics", "mobileFriendly", "new", "callableNow", "near", "radiusKm", "territory", "sort", "order"}
+	boardViewFilters = []string{"minRating", "category", "hasWebsite", "address", "called", "liveChat", "onlineBooking", "ecommerce", "analytics", "mobileFriendly", "tag", "priority"}
+)
+
+const MAX_VIEW_FILTERS = 20
+
+type SavedView struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Filters   map[string]string `json:"filters"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+type viewInput struct {
+	Name    string            `json:"name" binding:"required"`
+	Filters map[string]string `json:"filters"`
+}
+
+// validate checks the input's filters the way the leads list and the board
+// would read them, so a view that saves always applies.
+func (in *viewInput) validate(repo *Repository, fe fieldErrors) {
+	in.Name = strings.TrimSpace(in.Name)
+	checkLength(fe, "name", in.Name, 1, 100)
+	if in.Filters == nil {
+		in.Filters = map[string]string{}
+	}
+	fe.check(len(in.Filters) <= MAX_VIEW_FILTERS, "filters", fmt.Sprintf("can hold at most %d filters", MAX_VIEW_FILTERS))
+	for key, value := range in.Filters {
+		in.Filters[key] = strings.TrimSpace(value)
+		if !containsString(leadViewFilters, key) && !containsString(boardViewFilters, key) {
+			fe.check(false, "filters."+key, "is not a filter")
+		}
+	}
+	if len(fe) > 0 {
+		return
+	}
+	if _, err := buildLeadQueryIn(repo, nil, viewParams(in.Filters, leadViewFilters)); err != nil {
+		fe.check(false, "filters", err.Error())
+	}
+	if _, err := buildCrmFilter(viewParams(in.Filters, boardViewFilters)); err != nil {
+		fe.check(false, "filters", err.Error())
+	}
+}
+
+// viewParams returns the filters among keys as query parameters.
+func viewParams(filters map[string]string, keys []string) url.Values {
+	params := url.Values{}
+	for key, value := range filters {
+		if value != "" && containsString(keys, key) {
+			params.Set(key, value)
+		}
+	}
+	return params
+}
+
+// applyView returns the request's query parameters with the filters among
+// keys of the view in ?view= filled in underneath them, writing the error
+// response when the view isn't the caller's.
+func applyView(c *gin.Context, repo *Repository, keys []string) (url.Values, bool) {
+	params := c.Request.URL.Query()
+	viewID := params.Get("view")
+	if viewID == "" {
+		return params, true
+	}
+	if _, err := uuid.Parse(viewID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "view must be a UUID"})
+		return nil, false
+	}
+	view, ok := viewResponse(c, repo, viewID)
+	if !ok {
+		return nil, false
+	}
+	merged := viewParams(view.Filters, keys)
+	for key, values := range params {
+		if key != "view" {
+			merged[key] = values
+		}
+	}
+	return merged, true
+}
+
+// crmFilter is the extra condition the board's filters put on crm_leads.
+type crmFilter struct {
+	cond string
+	args []interface{}
+}
+
+// buildCrmFilter turns the board's filter parameters into SQL: minRating,
+// category, hasWebsite, address, called and the site features, which mean
+// what they do on the leads list, plus tag and priority.
+func buildCrmFilter(params url.Values) (crmFilter, error) {
+	var f crmFilter
+	add := func(cond string, args ...interface{}) {
+		f.cond += " AND " + cond
+		f.args = append(f.args, args...)
+	}
+	if v := params.Get("minRating"); v != "" {
+		minRating, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return f, fmt.Errorf("minRating must be a number")
+		}
+		add("EXISTS (SELECT 1 FROM leads l WHERE l.id = crm_leads.lead_id AND l.rating >= ?)", minRating)
+	}
+	if v := params.Get("category"); v != "" {
+		add("EXISTS (SELECT 1 FROM leads l WHERE l.id = crm_leads.lead_id AND l.category = ? COLLATE NOCASE)", v)
+	}
+	if v := params.Get("hasWebsite"); v != "" {
+		hasWebsite, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("hasWebsite must be true or false")
+		}
+		add("(COALESCE(website, '') != '') = ?", hasWebsite)
+	}
+	if v := strings.TrimSpace(params.Get("address")); v != "" {
+		add(`EXISTS (SELECT 1 FROM leads l WHERE l.id = crm_leads.lead_id AND l.address LIKE ? ESCAPE '\')`, "%"+store.EscapeLike(v)+"%")
+	}
+	if v := params.Get("called"); v != "" {
+		called, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("called must be true or false")
+		}
+		add("(COALESCE(times_called, 0) > 0) = ?", called)
+	}
+	for _, sf := range siteFeatureFilters {
+		if v := params.Get(sf.param); v != "" {
+			has, err := strconv.ParseBool(v)
+			if err != nil {
+				return f, fmt.Errorf("%s must be true or false", sf.param)
+			}
+			add("EXISTS (SELECT 1 FROM leads l WHERE l.id = crm_leads.lead_id AND l."+sf.column+" = ?)", has)
+		}
+	}
+	if v := params.Get("tag"); v != "" {
+		tag, err := crm.NormalizeTag(v)
+		if err != nil {
+			return f, err
+		}
+		add("EXISTS (SELECT 1 FROM crm_lead_tags t WHERE t.org_id = crm_leads.org_id AND t.lead_id = crm_leads.lead_id AND t.tag = ?)", tag)
+	}
+	if v := params.Get("priority"); v != "" {
+		if !containsString(priorities, v) {
+			return f, fmt.Errorf("priority must be one of %s", strings.Join(priorities, ", "))
+		}
+		add("priority = ?", v)
+	}
+	return f, nil
+}
+
+func viewResponse(c *gin.Context, repo *Repository, viewID string) (SavedView, bool) {
+	view, err := repo.SavedView(viewID)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "View not found"})
+		return view, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load view"})
+		return view, false
+	}
+	return view, true
+}
+
+func listViewsHandler(c *gin.Context) {
+	views, err := repoFrom(c).SavedViews()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load views"})
+		return
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+func getViewHandler(c *gin.Context) {
+	if view, ok := viewResponse(c, repoFrom(c), c.Param("viewId")); ok {
+		c.JSON(http.StatusOK, view)
+	}
+}
+
+func createViewHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	var input viewInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(repo, fe)
+	if fe.respond(c) {
+		return
+	}
+
+	now := time.Now().UTC()
+	view := SavedView{ID: uuid.New().String(), Name: input.Name, Filters: input.Filters, CreatedAt: now, UpdatedAt: now}
+	if err := repo.CreateSavedView(view); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create view"})
+		return
+	}
+	c.JSON(http.StatusCreated, view)
+}
+
+func updateViewHandler(c *gin.Context) {
+	repo := repoFrom(c)
+	viewID := c.Param("viewId")
+	var input viewInput
+	if !bindJSON(c, &input) {
+		return
+	}
+	fe := fieldErrors{}
+	input.validate(repo, fe)
+	if fe.respond(c) {
+		return
+	}
+	err := repo.UpdateSavedView(viewID, input)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "View not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update view"})
+		return
+	}
+	if view, ok := viewResponse(c, repo, viewID); ok {
+		c.JSON(http.StatusOK, view)
+	}
+}
+
+func deleteViewHandler(c *gin.Context) {
+	err := repoFrom(c).DeleteSavedView(c.Param("viewId"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "View not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete view"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
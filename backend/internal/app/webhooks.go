@@ -0,0 +1,177 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// --- SEARCH WEBHOOK ---
+//
+// Each user can set a callback URL that gets a POST whenever one of their
+// searches finishes, so outside automations can pick up new leads straight
+// away. The body is signed with the user's webhook secret the way Stripe
+// signs its events:
+//
+//	X-BlueLeads-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// Receivers should recompute the HMAC and reject old timestamps. Failed
+// deliveries are retried a couple of times and then dropped.
+
+const SEARCH_WEBHOOK_EVENT = "search.finished"
+const MIN_WEBHOOK_SECRET_LENGTH = 16
+
+// appURL is the frontend's address, for links in webhook payloads.
+var appURL = envOrDefault("APP_URL", "http://localhost:5173")
+
+// webhookRetryDelays are the waits before each retry of a failed delivery.
+var webhookRetryDelays = []time.Duration{10 * time.Second, time.Minute}
+
+// WEBHOOK_ALLOW_PRIVATE lets webhooks reach private and loopback addresses,
+// for self-hosted automations on the same network.
+var webhookAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+
+var errPrivateWebhookAddress = errors.New("webhook URL resolves to a private address")
+
+// webhookClient refuses to connect to internal addresses, so a user can't
+// use their webhook to probe the server's network.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if !webhookAllowPrivate && internalAddress(address) {
+					return errPrivateWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	// Following a redirect would send the signed body somewhere the user
+	// didn't configure.
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// internalAddress says whether a dialed host:port is loopback, private,
+// link-local or otherwise not on the public internet.
+func internalAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+type SearchWebhookPayload struct {
+	Event      string    `json:"event"`
+	SearchID   string    `json:"searchId"`
+	Keyword    string    `json:"keyword"`
+	Location   string    `json:"location"`
+	Status     string    `json:"status"`
+	LeadsFound int       `json:"leadsFound"`
+	FinishedAt time.Time `json:"finishedAt"`
+	URL        string    `json:"url"`
+}
+
+// checkWebhookURL reports what's wrong with a webhook URL, or "" if it's
+// usable. Whether it resolves somewhere public is only known on delivery.
+func checkWebhookURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "searchWebhookUrl must be an http or https URL"
+	}
+	if u.User != nil {
+		return "searchWebhookUrl can't contain credentials; use searchWebhookSecret to check requests instead"
+	}
+	return ""
+}
+
+// signWebhook returns the X-BlueLeads-Signature header for body.
+func signWebhook(secret string, at time.Time, body []byte) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifySearchWebhook posts a finished search to its owner's webhook, if
+// they have one.
+func notifySearchWebhook(searchID string) {
+	p := SearchWebhookPayload{Event: SEARCH_WEBHOOK_EVENT, SearchID: searchID, URL: appURL + "/searches/" + searchID}
+	var userID int64
+	var finishedAt sql.NullTime
+	err := db.QueryRow("SELECT user_id, keyword, location, status, leads_found, finished_at FROM searches WHERE id = ?", searchID).
+		Scan(&userID, &p.Keyword, &p.Location, &p.Status, &p.LeadsFound, &finishedAt)
+	if err != nil {
+		log.Printf("Failed to load search %s for webhook: %v", searchID, err)
+		return
+	}
+	settings, err := getUserSettings(context.Background(), userID)
+	if err != nil {
+		log.Printf("Failed to load settings of user %d for search webhook: %v", userID, err)
+		return
+	}
+	if settings.SearchWebhookURL == "" {
+		return
+	}
+	p.FinishedAt = time.Now().UTC()
+	if finishedAt.Valid {
+		p.FinishedAt = finishedAt.Time.UTC()
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Failed to encode webhook for search %s: %v", searchID, err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = deliverWebhook(settings.SearchWebhookURL, settings.SearchWebhookSecret, body)
+		if err == nil {
+			return
+		}
+		if attempt == len(webhookRetryDelays) || errors.Is(err, errPrivateWebhookAddress) {
+			log.Printf("Giving up on webhook for search %s: %v", searchID, err)
+			return
+		}
+		time.Sleep(webhookRetryDelays[attempt])
+	}
+}
+
+func deliverWebhook(target, secret string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "BlueLeads-Webhook/1")
+	req.Header.Set("X-BlueLeads-Event", SEARCH_WEBHOOK_EVENT)
+	req.Header.Set("X-BlueLeads-Signature", signWebhook(secret, time.Now(), body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- WEEKLY SUMMARY ---
+//
+// Users who opt in get a Monday email, at their digest hour, of what was
+// done the week before: just their own numbers, or with "team" the whole
+// organization's with a line per rep. Anyone on the team can ask for the
+// team version, whatever their role.
+
+const (
+	WEEKLY_SUMMARY_OFF  = "off"
+	WEEKLY_SUMMARY_ME   = "me"
+	WEEKLY_SUMMARY_TEAM = "team"
+)
+
+func (s *PerformanceStats) add(o PerformanceStats) {
+	s.Searches += o.Searches
+	s.LeadsAdded += o.LeadsAdded
+	s.Dials += o.Dials
+	s.Contacts += o.Contacts
+	s.DealsWon += o.DealsWon
+}
+
+func (s PerformanceStats) render(b *strings.Builder, indent string) {
+	fmt.Fprintf(b, "%sSearches run:     %d\n", indent, s.Searches)
+	fmt.Fprintf(b, "%sLeads added:      %d\n", indent, s.LeadsAdded)
+	fmt.Fprintf(b, "%sDials made:       %d\n", indent, s.Dials)
+	fmt.Fprintf(b, "%sContacts reached: %d (%.1f%%)\n", indent, s.Contacts, percentOf(s.Contacts, s.Dials))
+	fmt.Fprintf(b, "%sDeals won:        %d\n", indent, s.DealsWon)
+}
+
+// weekStarting returns midnight on the Monday of the week holding t, in
+// t's location.
+func weekStarting(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// weeklySummary is one user's email for the week starting from.
+type weeklySummary struct {
+	from  time.Time
+	scope string
+	own   PerformanceStats
+	team  []repPerformance
+}
+
+type repPerformance struct {
+	name string
+	PerformanceStats
+}
+
+func buildWeeklySummary(repo *Repository, scope string, from time.Time) (weeklySummary, error) {
+	w := weeklySummary{from: from, scope: scope}
+	stats, err := repo.Performance(from, from.AddDate(0, 0, 7))
+	if err != nil {
+		return w, err
+	}
+	if own := stats[repo.Tenant().UserID]; own != nil {
+		w.own = *own
+	}
+	if scope != WEEKLY_SUMMARY_TEAM {
+		return w, nil
+	}
+
+	team, err := repo.Team()
+	if err != nil {
+		return w, err
+	}
+	for _, m := range team.Members {
+		rep := repPerformance{name: m.Name}
+		if s := stats[m.ID]; s != nil {
+			rep.PerformanceStats = *s
+		}
+		w.team = append(w.team, rep)
+	}
+	sort.SliceStable(w.team, func(i, j int) bool { return w.team[i].Dials > w.team[j].Dials })
+	return w, nil
+}
+
+func (w weeklySummary) render(name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\nHere's your week from %s to %s.\n\n", name,
+		w.from.Format("Monday 2 January"), w.from.AddDate(0, 0, 6).Format("Sunday 2 January"))
+	w.own.render(&b, "  ")
+
+	if w.scope == WEEKLY_SUMMARY_TEAM && len(w.team) > 0 {
+		var total PerformanceStats
+		for _, rep := range w.team {
+			total.add(rep.PerformanceStats)
+		}
+		b.WriteString("\nYour team\n")
+		total.render(&b, "  ")
+		for _, rep := range w.team {
+			fmt.Fprintf(&b, "\n  %s\n", rep.name)
+			rep.render(&b, "    ")
+		}
+	}
+
+	b.WriteString("\nYou can turn these emails off in Settings.\n")
+	return b.String()
+}
+
+// sendDueWeeklySummaries emails every opted-in user whose Monday digest
+// hour has passed and who hasn't had last week's summary yet. A week is
+// sent late rather than skipped if the server was down on Monday.
+func sendDueWeeklySummaries() {
+	if !mailConfigured() {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT u.id, u.org_id, u.name, u.email, s.last_weekly_summary
+        FROM users u JOIN user_settings s ON s.user_id = u.id
+        WHERE u.disabled_at IS NULL AND s.weekly_summary != ?
+    `, WEEKLY_SUMMARY_OFF)
+	if err != nil {
+		log.Printf("Failed to load weekly summary recipients: %v", err)
+		return
+	}
+	type recipient struct {
+		tenant      Tenant
+		name, email string
+		lastSent    string
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.tenant.UserID, &r.tenant.OrgID, &r.name, &r.email, &r.lastSent); err != nil {
+			log.Printf("Error scanning weekly summary recipient: %v", err)
+			continue
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, r := range recipients {
+		settings, err := getUserSettings(context.Background(), r.tenant.UserID)
+		if err != nil {
+			log.Printf("Failed to load settings for user %d: %v", r.tenant.UserID, err)
+			continue
+		}
+		thisWeek := weekStarting(now.In(settings.location()))
+		if now.Before(thisWeek.Add(time.Duration(settings.DigestHour)*time.Hour)) || r.lastSent == thisWeek.Format("2006-01-02") {
+			continue
+		}
+
+		lastWeek := thisWeek.AddDate(0, 0, -7)
+		summary, err := buildWeeklySummary(newRepository(r.tenant), settings.WeeklySummary, lastWeek)
+		if err != nil {
+			log.Printf("Failed to build weekly summary for user %d: %v", r.tenant.UserID, err)
+			continue
+		}
+		subject := fmt.Sprintf("Your week of %s", lastWeek.Format("2 January"))
+		if err := sendMail(r.email, subject, summary.render(r.name)); err != nil {
+			// Leave the week unmarked so the next run tries again.
+			log.Printf("Failed to send weekly summary to user %d: %v", r.tenant.UserID, err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE user_settings SET last_weekly_summary = ? WHERE user_id = ?", thisWeek.Format("2006-01-02"), r.tenant.UserID); err != nil {
+			log.Printf("Failed to record weekly summary for user %d: %v", r.tenant.UserID, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"blueleads-backend/internal/store"
+	"blueleads-backend/internal/store/storetest"
+)
+
+var testSecret = []byte("test-secret-that-is-at-least-32-bytes")
+
+// newTestService returns a service with one user, alice, whose password is
+// "correct horse".
+func newTestService(t *testing.T) (Service, Repository, store.Querier, int64) {
+	t.Helper()
+	db := storetest.Open(t, Migrate)
+	repo := NewRepository(context.Background(), db)
+	// The lowest cost keeps the tests fast; CheckPassword reads the cost
+	// from the hash.
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := repo.Create(User{Name: "Alice", Email: "alice@example.com", PasswordHash: string(hash), OrgID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(repo, testSecret), repo, db, id
+}
+
+func TestLoadSecret(t *testing.T) {
+	if _, err := LoadSecret(""); err == nil {
+		t.Error("an empty secret was accepted")
+	}
+	if _, err := LoadSecret("too-short"); err == nil {
+		t.Error("a short secret was accepted")
+	}
+	if secret, err := LoadSecret(string(testSecret)); err != nil || string(secret) != string(testSecret) {
+		t.Errorf("LoadSecret = %q, %v", secret, err)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	claims := Claims{UserID: 7, ImpersonatedBy: 3, SSO: true, TokenVersion: 2}
+	token, err := Sign(testSecret, claims, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Verify(testSecret, token); err != nil || got != claims {
+		t.Errorf("Verify = %+v, %v; want %+v", got, err, claims)
+	}
+	if _, err := Verify([]byte("some-other-secret-of-32-bytes-or-more"), token); err != ErrInvalidToken {
+		t.Errorf("a token signed with another secret gave %v", err)
+	}
+	expired, _ := Sign(testSecret, claims, time.Now().Add(-time.Minute))
+	if _, err := Verify(testSecret, expired); err != ErrInvalidToken {
+		t.Errorf("an expired token gave %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	svc, repo, _, id := newTestService(t)
+	if u, err := svc.Authenticate("alice@example.com", "correct horse"); err != nil || u.ID != id {
+		t.Fatalf("Authenticate = %+v, %v", u, err)
+	}
+	if _, err := svc.Authenticate("alice@example.com", "wrong"); err != ErrBadCredentials {
+		t.Errorf("a wrong password gave %v", err)
+	}
+	if _, err := svc.Authenticate("nobody@example.com", "correct horse"); err != ErrBadCredentials {
+		t.Errorf("an unknown email gave %v", err)
+	}
+	if _, err := repo.Create(User{Name: "Alice again", Email: "alice@example.com", PasswordHash: "x", OrgID: 1}); err != ErrEmailTaken {
+		t.Errorf("a second alice@example.com gave %v", err)
+	}
+
+	if err := svc.SetPassword(id, "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Authenticate("alice@example.com", "battery staple"); err != nil {
+		t.Errorf("the new password was refused: %v", err)
+	}
+}
+
+func TestSessionsAndAdminRights(t *testing.T) {
+	svc, _, q, id := newTestService(t)
+	if _, err := q.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := svc.Issue(id)
+	session, err := svc.Session(token)
+	if err != nil || session.Tenant != (store.Tenant{OrgID: 1, UserID: id}) {
+		t.Fatalf("Session = %+v, %v", session, err)
+	}
+	if admin, err := svc.IsAdmin(session); err != nil || !admin {
+		t.Errorf("IsAdmin = %v, %v for an admin's own session", admin, err)
+	}
+	for name, issue := range map[string]func() (string, error){
+		"single sign-on": func() (string, error) { return svc.IssueSSO(id) },
+		"impersonation": func() (string, error) {
+			token, _, err := svc.Impersonate(99, id)
+			return token, err
+		},
+	} {
+		token, _ := issue()
+		session, err := svc.Session(token)
+		if err != nil {
+			t.Fatalf("%s Session: %v", name, err)
+		}
+		if admin, _ := svc.IsAdmin(session); admin {
+			t.Errorf("a %s session got admin rights", name)
+		}
+	}
+
+	if _, err := q.Exec("UPDATE users SET disabled_at = CURRENT_TIMESTAMP WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Session(token); err != ErrDisabled {
+		t.Errorf("a disabled user's session gave %v", err)
+	}
+	if _, err := svc.Authenticate("alice@example.com", "correct horse"); err != ErrDisabled {
+		t.Errorf("a disabled user signing in gave %v", err)
+	}
+	if _, err := svc.Session("not-a-token"); err != ErrInvalidToken {
+		t.Errorf("garbage gave %v", err)
+	}
+}
+
+func TestRevokedSessionsAreRefused(t *testing.T) {
+	svc, _, _, id := newTestService(t)
+	token, _ := svc.Issue(id)
+	impersonation, _, _ := svc.Impersonate(99, id)
+	if err := svc.SetPassword(id, "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"session": token, "impersonation": impersonation} {
+		if _, err := svc.Session(token); err != ErrRevoked {
+			t.Errorf("a %s from before the password change gave %v", name, err)
+		}
+	}
+
+	token, _ = svc.Issue(id)
+	if _, err := svc.Session(token); err != nil {
+		t.Fatalf("a session issued after the change gave %v", err)
+	}
+	if err := svc.RevokeSessions(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Session(token); err != ErrRevoked {
+		t.Errorf("a revoked session gave %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"blueleads-backend/internal/store"
+)
+
+// ErrEmailTaken is returned when creating a user whose email is in use.
+var ErrEmailTaken = errors.New("email already in use")
+
+type User struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	PasswordHash string `json:"-"`
+	OrgID        int64  `json:"-"`
+	Disabled     bool   `json:"-"`
+	IsAdmin      bool   `json:"-"`
+	// TokenVersion goes up whenever the user's sessions are revoked; tokens
+	// carrying an older one are refused.
+	TokenVersion int64 `json:"-"`
+}
+
+// Repository reads and writes user accounts. Users aren't scoped to a
+// tenant; they're what tenants are worked out from.
+type Repository interface {
+	Get(userID int64) (User, error)
+	ByEmail(email string) (User, error)
+	// Create adds a user to an organization, returning its ID. It fails
+	// with ErrEmailTaken when the email is in use.
+	Create(u User) (int64, error)
+	// SetPasswordHash changes a user's password and revokes their sessions.
+	SetPasswordHash(userID int64, hash string) error
+	// RevokeSessions signs a user out everywhere.
+	RevokeSessions(userID int64) error
+}
+
+type sqlRepository struct {
+	q   store.Querier
+	ctx context.Context
+}
+
+// NewRepository returns the SQL repository for users, running its queries
+// on q under ctx.
+func NewRepository(ctx context.Context, q store.Querier) Repository {
+	return &sqlRepository{q: q, ctx: ctx}
+}
+
+const selectUser = "SELECT id, name, email, password_hash, COALESCE(org_id, 0), disabled_at IS NOT NULL, is_admin, token_version FROM users "
+
+func scanUser(row store.RowScanner) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.OrgID, &u.Disabled, &u.IsAdmin, &u.TokenVersion)
+	if err == sql.ErrNoRows {
+		return u, store.ErrNotFound
+	}
+	return u, err
+}
+
+func (r *sqlRepository) Get(userID int64) (User, error) {
+	return scanUser(r.q.QueryRowContext(r.ctx, selectUser+"WHERE id = ?", userID))
+}
+
+func (r *sqlRepository) ByEmail(email string) (User, error) {
+	return scanUser(r.q.QueryRowContext(r.ctx, selectUser+"WHERE email = ?", email))
+}
+
+func (r *sqlRepository) Create(u User) (int64, error) {
+	res, err := r.q.ExecContext(r.ctx, "INSERT INTO users (name, email, password_hash, org_id, is_admin) VALUES (?, ?, ?, ?, ?)", u.Name, u.Email, u.PasswordHash, u.OrgID, u.IsAdmin)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return 0, ErrEmailTaken
+		}
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *sqlRepository) SetPasswordHash(userID int64, hash string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE users SET password_hash = ?, token_version = token_version + 1 WHERE id = ?", hash, userID))
+}
+
+func (r *sqlRepository) RevokeSessions(userID int64) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE users SET token_version = token_version + 1 WHERE id = ?", userID))
+}
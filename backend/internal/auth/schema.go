@@ -0,0 +1,38 @@
+package auth
+
+import "blueleads-backend/internal/store"
+
+// Migrate creates the users table and adds the columns introduced since
+// the first schema, in the order they were added. Some of them, such as
+// the plan and Stripe IDs, are read by billing rather than here.
+func Migrate(q store.Querier) error {
+	err := store.Statements(q, `
+        CREATE TABLE IF NOT EXISTS users (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            email TEXT UNIQUE NOT NULL,
+            password_hash TEXT NOT NULL
+        );
+    `)
+	if err != nil {
+		return err
+	}
+	columns := [][2]string{
+		{"is_admin", "INTEGER NOT NULL DEFAULT 0"},
+		{"disabled_at", "DATETIME"},
+		{"plan_id", "TEXT NOT NULL DEFAULT 'free'"},
+		{"stripe_customer_id", "TEXT"},
+		{"stripe_subscription_id", "TEXT"},
+		{"subscription_status", "TEXT NOT NULL DEFAULT ''"},
+		{"org_id", "INTEGER REFERENCES organizations (id)"},
+		{"team_role", "TEXT NOT NULL DEFAULT 'member'"},
+		{"sso_linked_at", "DATETIME"},
+		{"token_version", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := store.AddColumnIfMissing(q, "users", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"blueleads-backend/internal/store"
+)
+
+var (
+	// ErrBadCredentials is an unknown email or a wrong password; callers
+	// can't tell which, by design.
+	ErrBadCredentials = errors.New("invalid credentials")
+	ErrDisabled       = errors.New("account is disabled")
+	// ErrRevoked is a token issued before its user's password was changed
+	// or their sessions were otherwise revoked.
+	ErrRevoked = errors.New("session has been revoked")
+)
+
+// Session is who a request is from: the token's claims and the tenant
+// they act in.
+type Session struct {
+	Claims
+	Tenant store.Tenant
+}
+
+// Service is how the API signs people in and checks who they are.
+type Service interface {
+	// Authenticate checks an email and password. A disabled account gets
+	// ErrDisabled, but only once the password is right.
+	Authenticate(email, password string) (User, error)
+	// Session reads a token and checks its user is still allowed in. A
+	// missing or disabled user gets ErrDisabled, a token from before the
+	// user's sessions were revoked gets ErrRevoked, and a bad token gets
+	// ErrInvalidToken or ErrNoUserID.
+	Session(token string) (Session, error)
+	// IsAdmin looks up whether a session has site-admin rights.
+	// Impersonation and single sign-on sessions never do, even for an
+	// admin.
+	IsAdmin(s Session) (bool, error)
+	Issue(userID int64) (string, error)
+	// IssueSSO signs a session token for a single sign-on.
+	IssueSSO(userID int64) (string, error)
+	// Impersonate signs a short-lived token for an admin to act as
+	// another user.
+	Impersonate(adminID, userID int64) (string, time.Time, error)
+	// SetPassword changes a user's password, signing them out everywhere.
+	SetPassword(userID int64, password string) error
+	// RevokeSessions signs a user out everywhere, impersonations included.
+	RevokeSessions(userID int64) error
+}
+
+type service struct {
+	repo   Repository
+	secret []byte
+}
+
+// NewService returns the service for repo's users, signing tokens with
+// secret.
+func NewService(repo Repository, secret []byte) Service {
+	return &service{repo: repo, secret: secret}
+}
+
+func (s *service) Authenticate(email, password string) (User, error) {
+	u, err := s.repo.ByEmail(email)
+	if err == store.ErrNotFound || (err == nil && !CheckPassword(password, u.PasswordHash)) {
+		return User{}, ErrBadCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if u.Disabled {
+		return u, ErrDisabled
+	}
+	return u, nil
+}
+
+func (s *service) Session(token string) (Session, error) {
+	claims, err := Verify(s.secret, token)
+	if err != nil {
+		return Session{}, err
+	}
+	u, err := s.repo.Get(claims.UserID)
+	// Every account belongs to an organization; one that doesn't can't be
+	// scoped, so it's kept out like a disabled one.
+	if err == store.ErrNotFound || (err == nil && (u.Disabled || u.OrgID == 0)) {
+		return Session{}, ErrDisabled
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if claims.TokenVersion != u.TokenVersion {
+		return Session{}, ErrRevoked
+	}
+	return Session{Claims: claims, Tenant: store.Tenant{OrgID: u.OrgID, UserID: u.ID}}, nil
+}
+
+func (s *service) IsAdmin(session Session) (bool, error) {
+	if session.ImpersonatedBy != 0 || session.SSO {
+		return false, nil
+	}
+	u, err := s.repo.Get(session.UserID)
+	if err != nil {
+		return false, err
+	}
+	return u.IsAdmin, nil
+}
+
+func (s *service) Issue(userID int64) (string, error) {
+	return s.sign(Claims{UserID: userID}, time.Now().Add(SESSION_TTL))
+}
+
+func (s *service) IssueSSO(userID int64) (string, error) {
+	return s.sign(Claims{UserID: userID, SSO: true}, time.Now().Add(SESSION_TTL))
+}
+
+func (s *service) Impersonate(adminID, userID int64) (string, time.Time, error) {
+	expiresAt := time.Now().Add(IMPERSONATION_TTL)
+	token, err := s.sign(Claims{UserID: userID, ImpersonatedBy: adminID}, expiresAt)
+	return token, expiresAt, err
+}
+
+// sign stamps claims with the user's current token version and signs them.
+func (s *service) sign(claims Claims, expiresAt time.Time) (string, error) {
+	u, err := s.repo.Get(claims.UserID)
+	if err != nil {
+		return "", err
+	}
+	claims.TokenVersion = u.TokenVersion
+	return Sign(s.secret, claims, expiresAt)
+}
+
+func (s *service) SetPassword(userID int64, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.repo.SetPasswordHash(userID, hash)
+}
+
+func (s *service) RevokeSessions(userID int64) error {
+	return s.repo.RevokeSessions(userID)
+}
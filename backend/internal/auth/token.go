@@ -0,0 +1,114 @@
+// Package auth signs people in: it checks passwords, issues and reads the
+// session tokens the API is called with, and looks up the user behind
+// each one.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MIN_SECRET_LENGTH is the shortest token signing secret accepted, in
+// bytes.
+const MIN_SECRET_LENGTH = 32
+
+// SESSION_TTL is how long a sign-in lasts.
+const SESSION_TTL = 72 * time.Hour
+
+// Impersonation tokens are short-lived and never carry the admin claim, so
+// support staff see exactly what the user sees and nothing more.
+const IMPERSONATION_TTL = time.Hour
+
+// BCRYPT_COST is the work factor passwords are hashed with.
+const BCRYPT_COST = 14
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrNoUserID is a validly signed token that doesn't name a user.
+	ErrNoUserID = errors.New("invalid user ID in token")
+)
+
+// LoadSecret checks a token signing secret, such as the JWT_SECRET
+// environment variable, is there and too long to guess.
+func LoadSecret(secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, errors.New("JWT_SECRET must be set; generate one with `openssl rand -base64 48`")
+	}
+	if len(secret) < MIN_SECRET_LENGTH {
+		return nil, fmt.Errorf("JWT_SECRET must be at least %d bytes long", MIN_SECRET_LENGTH)
+	}
+	return []byte(secret), nil
+}
+
+// Claims are what a session token says about its bearer. Admin rights are
+// never among them; they're looked up on every request instead.
+type Claims struct {
+	UserID int64
+	// ImpersonatedBy is the admin acting as the user, or 0.
+	ImpersonatedBy int64
+	// SSO marks a single sign-on, which can't grant site-admin access.
+	SSO bool
+	// TokenVersion is the user's token version when the token was issued.
+	TokenVersion int64
+}
+
+// Sign issues a token for claims that expires at expiresAt.
+func Sign(secret []byte, claims Claims, expiresAt time.Time) (string, error) {
+	mc := jwt.MapClaims{
+		"user_id": claims.UserID,
+		"exp":     expiresAt.Unix(),
+	}
+	if claims.ImpersonatedBy != 0 {
+		mc["impersonated_by"] = claims.ImpersonatedBy
+	}
+	if claims.SSO {
+		mc["sso"] = true
+	}
+	if claims.TokenVersion != 0 {
+		mc["token_version"] = claims.TokenVersion
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, mc).SignedString(secret)
+}
+
+// Verify checks a token's signature and expiry and returns its claims.
+func Verify(secret []byte, token string) (Claims, error) {
+	parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return secret, nil
+	})
+	if err != nil || !parsed.Valid {
+		return Claims{}, ErrInvalidToken
+	}
+	mc, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok {
+		return Claims{}, ErrInvalidToken
+	}
+	userID, ok := mc["user_id"].(float64)
+	if !ok {
+		return Claims{}, ErrNoUserID
+	}
+	claims := Claims{UserID: int64(userID)}
+	if adminID, ok := mc["impersonated_by"].(float64); ok {
+		claims.ImpersonatedBy = int64(adminID)
+	}
+	claims.SSO, _ = mc["sso"].(bool)
+	if version, ok := mc["token_version"].(float64); ok {
+		claims.TokenVersion = int64(version)
+	}
+	return claims, nil
+}
+
+func HashPassword(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
+	return string(bytes), err
+}
+
+func CheckPassword(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,215 @@
+// Package crm stores each organization's board: the cards on it, the
+// columns they move through, with their WIP limits, the statuses a card
+// can be given, and the version that goes up with every board change. The
+// activity log, undo history and note revisions that go with card changes
+// are kept by the server.
+package crm
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"blueleads-backend/internal/leads"
+	"blueleads-backend/internal/store"
+)
+
+// --- COLUMNS ---
+//
+// Each organization arranges its own board. Every board has the two
+// built-in columns: new leads land in "tobe-called" and call rules and the
+// digest treat "contacted" specially, so those can be renamed and moved
+// but not deleted.
+
+// Column is one board column. WIPLimit caps how many cards it should hold
+// (0 for no limit); WIPPolicy says whether moves past the cap are rejected
+// or just come back with a warning. Cards moved into a Won column count as
+// deals won in reports.
+type Column struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Position  int    `json:"position"`
+	BuiltIn   bool   `json:"builtIn"`
+	WIPLimit  int    `json:"wipLimit"`
+	WIPPolicy string `json:"wipPolicy"`
+	Won       bool   `json:"won"`
+}
+
+var defaultColumns = []Column{
+	{ID: "tobe-called", Title: "To Be Called", Position: 0, BuiltIn: true},
+	{ID: "contacted", Title: "Contacted", Position: 1, BuiltIn: true},
+}
+
+var ErrColumnInUse = errors.New("column still has leads")
+var ErrBuiltInColumn = errors.New("built-in column")
+
+func IsBuiltInColumn(id string) bool {
+	for _, col := range defaultColumns {
+		if col.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ColumnUpdate holds the column fields a PUT may change; nil leaves a
+// field alone.
+type ColumnUpdate struct {
+	Title     *string `json:"title"`
+	Position  *int    `json:"position"`
+	WIPLimit  *int    `json:"wipLimit"`
+	WIPPolicy *string `json:"wipPolicy"`
+	Won       *bool   `json:"won"`
+}
+
+// Validate checks u before it's applied.
+func (u ColumnUpdate) Validate() error {
+	if u.Title != nil && strings.TrimSpace(*u.Title) == "" {
+		return ValidationError("title cannot be empty")
+	}
+	if u.WIPLimit != nil && *u.WIPLimit < 0 {
+		return ValidationError("wipLimit cannot be negative")
+	}
+	if u.WIPPolicy != nil && *u.WIPPolicy != WIP_WARN && *u.WIPPolicy != WIP_REJECT {
+		return ValidationError("wipPolicy must be warn or reject")
+	}
+	return nil
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slug makes a readable column or status ID from its title.
+func Slug(title string) string {
+	slug := strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if slug == "" {
+		slug = "column"
+	}
+	return slug
+}
+
+// --- CARDS ---
+
+// Card is a lead on the board, with the copy of its contact details the
+// team works from. Emails and Phones are the lead's own and are only
+// filled in when asked for.
+type Card struct {
+	ID           string        `json:"id"`
+	CompanyName  string        `json:"companyName"`
+	Phone        string        `json:"phone"`
+	Website      string        `json:"website"`
+	Email        string        `json:"email"`
+	PageSpeed    int           `json:"pageSpeed"`
+	ColumnID     string        `json:"columnId"`
+	StatusID     string        `json:"statusId"`
+	Notes        string        `json:"notes"`
+	TimesCalled  int           `json:"timesCalled"`
+	CallBackDate *time.Time    `json:"callBackDate"`
+	UpdatedAt    *time.Time    `json:"updatedAt"`
+	Emails       []leads.Email `json:"emails"`
+	Phones       []leads.Phone `json:"phones"`
+
+	LastDisposition string     `json:"lastDisposition"`
+	LastCalledAt    *time.Time `json:"lastCalledAt"`
+	SnoozedUntil    *time.Time `json:"snoozedUntil"`
+	Tags            []string   `json:"tags"`
+	ColumnChangedAt *time.Time `json:"columnChangedAt"`
+	DaysInColumn    int        `json:"daysInColumn"`
+	Timezone        string     `json:"timezone"`
+	// Assignee is the member who put the card on the board, who gets its
+	// callback notifications.
+	Assignee   int64  `json:"assignee"`
+	Priority   string `json:"priority"`
+	Screenshot string `json:"screenshot"`
+}
+
+// --- WIP LIMITS ---
+const (
+	WIP_WARN   = "warn"
+	WIP_REJECT = "reject"
+)
+
+// WIPCheck is where a column stands against its WIP limit before one more
+// card is moved in.
+type WIPCheck struct {
+	Title  string
+	Limit  int
+	Count  int
+	Policy string
+}
+
+func (w WIPCheck) Exceeded() bool {
+	return w.Limit > 0 && w.Count >= w.Limit
+}
+
+func (w WIPCheck) Rejects() bool {
+	return w.Exceeded() && w.Policy == WIP_REJECT
+}
+
+func (w WIPCheck) Message() string {
+	return fmt.Sprintf("%s is at its limit of %d cards", w.Title, w.Limit)
+}
+
+// --- STATUSES ---
+//
+// A card's column says where it is in the calling workflow; its status
+// says what the team makes of the business, such as qualified, bad fit or
+// client. Each organization defines its own statuses, with colors, and a
+// card has at most one. Deleting a status clears it from the cards that
+// had it.
+
+const MAX_STATUS_TITLE_LENGTH = 40
+
+type Status struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Color    string `json:"color"`
+	Position int    `json:"position"`
+}
+
+// DefaultStatuses are what a new organization starts with.
+var DefaultStatuses = []Status{
+	{ID: "qualified", Title: "Qualified", Color: "#16a34a"},
+	{ID: "bad-fit", Title: "Bad fit", Color: "#dc2626"},
+	{ID: "client", Title: "Client", Color: "#2563eb"},
+}
+
+// StatusUpdate holds the status fields a PUT may change; nil leaves a
+// field alone.
+type StatusUpdate struct {
+	Title    *string `json:"title"`
+	Color    *string `json:"color"`
+	Position *int    `json:"position"`
+}
+
+// Validate checks the fields of a new or changed status.
+func (u StatusUpdate) Validate() error {
+	fe := FieldErrors{}
+	if u.Title != nil {
+		n := utf8.RuneCountInString(strings.TrimSpace(*u.Title))
+		fe.check(n >= 1, "title", "is required")
+		fe.check(n <= MAX_STATUS_TITLE_LENGTH, "title", "is too long")
+	}
+	if u.Color != nil {
+		fe.check(store.ValidColor(*u.Color), "color", "must be a hex color like #2563eb")
+	}
+	if len(fe) == 0 {
+		return nil
+	}
+	return fe
+}
+
+// --- TAGS ---
+const MAX_TAG_LENGTH = 40
+
+// NormalizeTag trims a tag and checks it can be stored; tags are kept
+// comma-free so they can be listed with GROUP_CONCAT.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" || len(tag) > MAX_TAG_LENGTH || strings.Contains(tag, ",") {
+		return "", fmt.Errorf("tags must be 1-%d characters without commas", MAX_TAG_LENGTH)
+	}
+	return tag, nil
+}
@@ -0,0 +1,264 @@
+package crm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"blueleads-backend/internal/store"
+	"blueleads-backend/internal/store/storetest"
+)
+
+// boardTables stands in for the server's tables the board queries touch.
+func boardTables(q store.Querier) error {
+	return store.Statements(q,
+		"CREATE TABLE organizations (id INTEGER PRIMARY KEY, statuses_seeded BOOLEAN NOT NULL DEFAULT 0)",
+		"CREATE TABLE leads (id TEXT PRIMARY KEY, timezone TEXT, screenshot TEXT NOT NULL DEFAULT '')",
+		"CREATE TABLE crm_lead_tags (org_id INTEGER, lead_id TEXT, tag TEXT)",
+		"CREATE TABLE disposition_rules (org_id INTEGER, column_id TEXT)",
+	)
+}
+
+func newTestBoards(t *testing.T) (*sql.DB, Repository, Repository) {
+	t.Helper()
+	db := storetest.Open(t, boardTables, Migrate)
+	for _, orgID := range []int64{1, 2} {
+		if _, err := db.Exec("INSERT INTO organizations (id) VALUES (?)", orgID); err != nil {
+			t.Fatal(err)
+		}
+		if err := Seed(db, orgID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := NewRepository(context.Background(), db, store.Tenant{OrgID: 1, UserID: 1}, store.PlainCodec{})
+	mallory := NewRepository(context.Background(), db, store.Tenant{OrgID: 2, UserID: 2}, store.PlainCodec{})
+	return db, alice, mallory
+}
+
+func TestColumnsAreOrderedAndScoped(t *testing.T) {
+	db, alice, mallory := newTestBoards(t)
+	svc := NewService(alice)
+
+	col, err := svc.CreateColumn("  Meeting booked ")
+	if err != nil || col.ID != "meeting-booked" || col.Position != 2 {
+		t.Fatalf("CreateColumn = %+v (err %v)", col, err)
+	}
+	if again, _ := svc.CreateColumn("Meeting Booked"); again.ID != "meeting-booked-2" {
+		t.Errorf("second column with the same title got ID %q", again.ID)
+	}
+
+	first := 0
+	columns, err := svc.UpdateColumn(col.ID, ColumnUpdate{Position: &first})
+	if err != nil || len(columns) != 4 || columns[0].ID != col.ID || columns[1].ID != "tobe-called" {
+		t.Fatalf("after the move: %+v (err %v)", columns, err)
+	}
+	if err := mallory.UpdateColumn(col.ID, ColumnUpdate{Position: &first}); err != store.ErrNotFound {
+		t.Errorf("update across tenants: got %v, want ErrNotFound", err)
+	}
+
+	if err := svc.DeleteColumn("contacted"); err != ErrBuiltInColumn {
+		t.Errorf("deleting a built-in column: got %v, want ErrBuiltInColumn", err)
+	}
+	if _, err := db.Exec("INSERT INTO crm_leads (user_id, org_id, lead_id, column_id) VALUES (1, 1, 'l1', ?)", col.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.DeleteColumn(col.ID); err != ErrColumnInUse {
+		t.Errorf("deleting a column with cards: got %v, want ErrColumnInUse", err)
+	}
+	if err := svc.DeleteColumn("meeting-booked-2"); err != nil {
+		t.Errorf("deleting an empty column: %v", err)
+	}
+	if columns, _ := mallory.Columns(); len(columns) != 2 {
+		t.Errorf("mallory's board has %d columns, want the two built-in ones", len(columns))
+	}
+}
+
+func TestWIPLimits(t *testing.T) {
+	db, alice, _ := newTestBoards(t)
+	svc := NewService(alice)
+
+	negative := -1
+	var invalid ValidationError
+	if _, err := svc.UpdateColumn("contacted", ColumnUpdate{WIPLimit: &negative}); !errors.As(err, &invalid) {
+		t.Errorf("negative limit: got %v, want a ValidationError", err)
+	}
+	limit, policy := 1, WIP_REJECT
+	if _, err := svc.UpdateColumn("contacted", ColumnUpdate{WIPLimit: &limit, WIPPolicy: &policy}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err := alice.CheckWIP("contacted", "l2"); err != nil || w.Exceeded() {
+		t.Errorf("empty column: %+v (err %v)", w, err)
+	}
+	if _, err := db.Exec("INSERT INTO crm_leads (user_id, org_id, lead_id, column_id) VALUES (1, 1, 'l1', 'contacted')"); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := alice.CheckWIP("contacted", "l2"); !w.Rejects() || w.Message() != "Contacted is at its limit of 1 cards" {
+		t.Errorf("full column: %+v", w)
+	}
+	if w, _ := alice.CheckWIP("contacted", "l1"); w.Exceeded() {
+		t.Error("a card already in the column counted against it")
+	}
+	if _, err := alice.CheckWIP("nope", "l1"); err != store.ErrNotFound {
+		t.Errorf("unknown column: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	db, alice, mallory := newTestBoards(t)
+	svc := NewService(alice)
+
+	_, err := svc.CreateStatus("Hot lead", "red")
+	var fe FieldErrors
+	if !errors.As(err, &fe) || fe["color"] == "" {
+		t.Errorf("bad color: got %v, want a color field error", err)
+	}
+	status, err := svc.CreateStatus(" Hot lead ", "#ff0000")
+	if err != nil || status.ID != "hot-lead" || status.Title != "Hot lead" || status.Position != len(DefaultStatuses) {
+		t.Fatalf("CreateStatus = %+v (err %v)", status, err)
+	}
+
+	if _, err := db.Exec("INSERT INTO crm_leads (user_id, org_id, lead_id, column_id, status_id) VALUES (1, 1, 'l1', 'contacted', 'hot-lead')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mallory.DeleteStatus("hot-lead"); err != store.ErrNotFound {
+		t.Errorf("delete across tenants: got %v, want ErrNotFound", err)
+	}
+	if err := svc.DeleteStatus("hot-lead"); err != nil {
+		t.Fatal(err)
+	}
+	var statusID string
+	db.QueryRow("SELECT status_id FROM crm_leads WHERE lead_id = 'l1'").Scan(&statusID)
+	if statusID != "" {
+		t.Errorf("deleted status still on a card: %q", statusID)
+	}
+}
+
+// sealed marks values the way a real codec would, so a test can see what
+// was stored sealed.
+type sealed struct{}
+
+func (sealed) Seal(value string) string   { return "sealed:" + value }
+func (sealed) Unseal(value string) string { return strings.TrimPrefix(value, "sealed:") }
+
+func TestCards(t *testing.T) {
+	db, _, mallory := newTestBoards(t)
+	alice := NewRepository(context.Background(), db, store.Tenant{OrgID: 1, UserID: 1}, sealed{})
+	if _, err := db.Exec("INSERT INTO crm_leads (user_id, org_id, lead_id, column_id, company_name, phone) VALUES (1, 1, 'l1', 'tobe-called', 'Acme', 'sealed:0111')"); err != nil {
+		t.Fatal(err)
+	}
+
+	card, err := alice.Card("l1")
+	if err != nil || card.CompanyName != "Acme" || card.Phone != "0111" || len(card.Tags) != 0 {
+		t.Fatalf("Card = %+v (err %v)", card, err)
+	}
+	if _, err := mallory.Card("l1"); err != store.ErrNotFound {
+		t.Errorf("card across tenants: got %v, want ErrNotFound", err)
+	}
+	if mallory.HasCard("l1") {
+		t.Error("mallory sees alice's card")
+	}
+
+	if from, err := alice.MoveCard("l1", "contacted"); err != nil || from != "tobe-called" {
+		t.Errorf("MoveCard = %q (err %v)", from, err)
+	}
+	if _, err := mallory.MoveCard("l1", "tobe-called"); err != store.ErrNotFound {
+		t.Errorf("move across tenants: got %v, want ErrNotFound", err)
+	}
+	if column, changedAt, _ := alice.CardColumn("l1"); column != "contacted" || !changedAt.Valid {
+		t.Errorf("after the move the card is in %q (changed at %v)", column, changedAt)
+	}
+
+	if err := alice.SetNotes("l1", "call after 3"); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	db.QueryRow("SELECT notes FROM crm_leads WHERE lead_id = 'l1'").Scan(&stored)
+	if stored != "sealed:call after 3" {
+		t.Errorf("notes stored as %q, want them sealed", stored)
+	}
+	if notes, _ := alice.Notes("l1"); notes != "call after 3" {
+		t.Errorf("Notes = %q", notes)
+	}
+
+	if from, err := alice.SetPriority("l1", "hot"); err != nil || from != "warm" {
+		t.Errorf("SetPriority = %q (err %v)", from, err)
+	}
+	if from, _ := alice.SetPriority("l1", "hot"); from != "hot" {
+		t.Errorf("setting the same priority again returned %q", from)
+	}
+
+	until := time.Now().Add(time.Hour)
+	if claimed, err := alice.Claim("l1", until); err != nil || !claimed {
+		t.Fatalf("Claim = %v (err %v)", claimed, err)
+	}
+	if holder, _ := alice.ClaimHolder("l1"); holder != 1 {
+		t.Errorf("claim holder = %d, want 1", holder)
+	}
+	if err := alice.ReleaseClaims(); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := alice.ClaimHolder("l1"); holder != 0 {
+		t.Errorf("claim holder after release = %d", holder)
+	}
+
+	if err := mallory.Trash("l1"); err != store.ErrNotFound {
+		t.Errorf("trash across tenants: got %v, want ErrNotFound", err)
+	}
+	if err := alice.Trash("l1"); err != nil {
+		t.Fatal(err)
+	}
+	if alice.HasCard("l1") {
+		t.Error("a trashed card is still on the board")
+	}
+	if _, err := db.Exec("UPDATE crm_leads SET column_id = 'gone' WHERE lead_id = 'l1'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Restore("l1"); err != nil {
+		t.Fatal(err)
+	}
+	if column, _, _ := alice.CardColumn("l1"); column != "tobe-called" {
+		t.Errorf("a card whose column was deleted came back to %q", column)
+	}
+}
+
+func TestBackfillAndVersions(t *testing.T) {
+	db, alice, mallory := newTestBoards(t)
+	// Organization 3 predates configurable boards; alice deleted every
+	// status and shouldn't get them back.
+	if _, err := db.Exec("INSERT INTO organizations (id) VALUES (3)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range DefaultStatuses {
+		if err := alice.DeleteStatus(s.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Backfill(db); err != nil {
+		t.Fatal(err)
+	}
+	third := NewRepository(context.Background(), db, store.Tenant{OrgID: 3}, store.PlainCodec{})
+	if columns, _ := third.Columns(); len(columns) != 2 {
+		t.Errorf("backfilled board has %d columns, want 2", len(columns))
+	}
+	if statuses, _ := third.Statuses(); len(statuses) != len(DefaultStatuses) {
+		t.Errorf("backfilled board has %d statuses", len(statuses))
+	}
+	if statuses, _ := alice.Statuses(); len(statuses) != 0 {
+		t.Errorf("backfill brought back %d deleted statuses", len(statuses))
+	}
+
+	if v, err := alice.Version(); err != nil || v != 0 {
+		t.Errorf("fresh board version = %d (err %v)", v, err)
+	}
+	alice.BumpVersion()
+	if v, _ := alice.BumpVersion(); v != 2 {
+		t.Errorf("version after two bumps = %d", v)
+	}
+	if v, _ := mallory.Version(); v != 0 {
+		t.Errorf("mallory's version moved with alice's: %d", v)
+	}
+}
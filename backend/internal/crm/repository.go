@@ -0,0 +1,649 @@
+package crm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"blueleads-backend/internal/store"
+)
+
+// Repository reads and writes one organization's board layout.
+type Repository interface {
+	// Version returns the board's version; it starts at 0 and goes up by
+	// one with every CRM write.
+	Version() (int64, error)
+	BumpVersion() (int64, error)
+
+	Columns() ([]Column, error)
+	HasColumn(columnID string) bool
+	// CreateColumn adds a column at the right-hand end of the board.
+	CreateColumn(title string) (Column, error)
+	// UpdateColumn applies the non-nil fields of u. Moving a column shifts
+	// the others along; a WIP limit of 0 removes the limit.
+	UpdateColumn(columnID string, u ColumnUpdate) error
+	// CheckWIP reports how full a column is before leadID is moved into
+	// it. Snoozed cards don't count, and neither does the lead itself if
+	// it is already there.
+	CheckWIP(columnID, leadID string) (WIPCheck, error)
+	// DeleteColumn removes an empty column. Built-in columns can't go, and
+	// dispositions that moved cards there leave them put from then on.
+	DeleteColumn(columnID string) error
+
+	Statuses() ([]Status, error)
+	HasStatus(statusID string) bool
+	// CreateStatus adds a status at the end of the list.
+	CreateStatus(title, color string) (Status, error)
+	// UpdateStatus applies the non-nil fields of u. Moving a status shifts
+	// the others along.
+	UpdateStatus(statusID string, u StatusUpdate) error
+	// DeleteStatus removes a status and clears it from the cards that had
+	// it. Run it in a transaction.
+	DeleteStatus(statusID string) error
+
+	// Cards returns the live cards on the board, snoozed ones included.
+	// where is ANDed to the tenant scope, with args for its placeholders,
+	// and may end in an ORDER BY.
+	Cards(where string, args ...interface{}) ([]Card, error)
+	Card(leadID string) (Card, error)
+	HasCard(leadID string) bool
+	// CardColumn returns the column a card is in and when it moved there.
+	CardColumn(leadID string) (columnID string, changedAt sql.NullTime, err error)
+	// MoveCard puts a card in columnID, returning the column it left. The
+	// time in its column only restarts when the column changes.
+	MoveCard(leadID, columnID string) (from string, err error)
+	// SetColumnChangedAt backdates a card's time in its column, as when a
+	// move is undone.
+	SetColumnChangedAt(leadID string, at sql.NullTime) error
+	Notes(leadID string) (string, error)
+	SetNotes(leadID, notes string) error
+	// UpdateCard saves the fields a user edits on the card itself.
+	UpdateCard(leadID, notes string, callbackDate *time.Time) error
+	// SetContact changes the email and/or phone the card uses; nil leaves
+	// that field alone.
+	SetContact(leadID string, email, phone *string) error
+	// Snooze hides a card until the given time; the tenant's user is the
+	// one notified when it comes back.
+	Snooze(leadID string, until time.Time) error
+	// Unsnooze puts a snoozed card back. It fails with ErrNotFound for a
+	// card that isn't snoozed.
+	Unsnooze(leadID string) error
+	// SetStatus changes a card's status, "" for none, returning the one it
+	// had. Setting the status it has changes nothing.
+	SetStatus(leadID, statusID string) (from string, err error)
+	// SetPriority works like SetStatus for the card's priority.
+	SetPriority(leadID, priority string) (from string, err error)
+	Trash(leadID string) error
+	// Restore brings a card back from the trash, into the first column if
+	// the one it was in has since been deleted.
+	Restore(leadID string) error
+
+	// Claim marks a card as being called by the tenant's user until the
+	// given time, unless someone else holds a live claim on it.
+	Claim(leadID string, until time.Time) (bool, error)
+	// ReleaseClaims drops every claim the tenant's user holds.
+	ReleaseClaims() error
+	// ClaimHolder returns who has a live claim on a card, or 0.
+	ClaimHolder(leadID string) (int64, error)
+}
+
+type sqlRepository struct {
+	tenant store.Tenant
+	q      store.Querier
+	ctx    context.Context
+	codec  store.Codec
+}
+
+// NewRepository returns the SQL repository for the tenant's board,
+// running its queries on q under ctx. codec seals the contact details and
+// notes on cards.
+func NewRepository(ctx context.Context, q store.Querier, tenant store.Tenant, codec store.Codec) Repository {
+	return &sqlRepository{tenant: tenant, q: q, ctx: ctx, codec: codec}
+}
+
+// Seed gives a new organization the built-in columns and the default
+// statuses.
+func Seed(q store.Executor, orgID int64) error {
+	if err := seedColumns(q, orgID); err != nil {
+		return err
+	}
+	return seedStatuses(q, orgID)
+}
+
+func seedColumns(q store.Executor, orgID int64) error {
+	for _, col := range defaultColumns {
+		_, err := q.Exec("INSERT OR IGNORE INTO crm_columns (org_id, id, title, position) VALUES (?, ?, ?, ?)", orgID, col.ID, col.Title, col.Position)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedStatuses gives an organization the default statuses, once.
+func seedStatuses(q store.Executor, orgID int64) error {
+	for i, s := range DefaultStatuses {
+		_, err := q.Exec("INSERT OR IGNORE INTO crm_statuses (org_id, id, title, color, position) VALUES (?, ?, ?, ?, ?)", orgID, s.ID, s.Title, s.Color, i)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := q.Exec("UPDATE organizations SET statuses_seeded = 1 WHERE id = ?", orgID)
+	return err
+}
+
+// Backfill seeds boards for organizations created before columns were
+// configurable, and statuses for those created before there were any. An
+// organization that has since deleted all its statuses keeps none.
+func Backfill(q store.Querier) error {
+	if err := forEachOrg(q, "SELECT id FROM organizations WHERE id NOT IN (SELECT org_id FROM crm_columns)", seedColumns); err != nil {
+		return fmt.Errorf("seeding board columns: %w", err)
+	}
+	if err := forEachOrg(q, "SELECT id FROM organizations WHERE NOT statuses_seeded", seedStatuses); err != nil {
+		return fmt.Errorf("seeding statuses: %w", err)
+	}
+	return nil
+}
+
+func forEachOrg(q store.Querier, query string, seed func(store.Executor, int64) error) error {
+	rows, err := q.Query(query)
+	if err != nil {
+		return err
+	}
+	var orgIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		orgIDs = append(orgIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range orgIDs {
+		if err := seed(q, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- VERSION ---
+
+func (r *sqlRepository) Version() (int64, error) {
+	var version int64
+	err := r.q.QueryRowContext(r.ctx, "SELECT version FROM org_crm_versions WHERE org_id = ?", r.tenant.OrgID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (r *sqlRepository) BumpVersion() (int64, error) {
+	var version int64
+	err := r.q.QueryRowContext(r.ctx, `
+        INSERT INTO org_crm_versions (org_id, version) VALUES (?, 1)
+        ON CONFLICT(org_id) DO UPDATE SET version = version + 1
+        RETURNING version
+    `, r.tenant.OrgID).Scan(&version)
+	return version, err
+}
+
+// --- COLUMNS ---
+
+func (r *sqlRepository) Columns() ([]Column, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT id, title, position, COALESCE(wip_limit, 0), wip_policy, won FROM crm_columns WHERE org_id = ? ORDER BY position, id", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []Column{}
+	for rows.Next() {
+		var col Column
+		if err := rows.Scan(&col.ID, &col.Title, &col.Position, &col.WIPLimit, &col.WIPPolicy, &col.Won); err != nil {
+			return nil, err
+		}
+		col.BuiltIn = IsBuiltInColumn(col.ID)
+		columns = append(columns, col)
+	}
+	return columns, rows.Err()
+}
+
+func (r *sqlRepository) HasColumn(columnID string) bool {
+	var exists bool
+	err := r.q.QueryRowContext(r.ctx, "SELECT EXISTS(SELECT 1 FROM crm_columns WHERE org_id = ? AND id = ?)", r.tenant.OrgID, columnID).Scan(&exists)
+	return err == nil && exists
+}
+
+func (r *sqlRepository) CreateColumn(title string) (Column, error) {
+	col := Column{Title: title, WIPPolicy: WIP_WARN}
+	base := Slug(title)
+	col.ID = base
+	for n := 2; r.HasColumn(col.ID); n++ {
+		col.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	err := r.q.QueryRowContext(r.ctx, `
+        INSERT INTO crm_columns (org_id, id, title, position)
+        VALUES (?, ?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM crm_columns WHERE org_id = ?))
+        RETURNING position
+    `, r.tenant.OrgID, col.ID, title, r.tenant.OrgID).Scan(&col.Position)
+	return col, err
+}
+
+func (r *sqlRepository) UpdateColumn(columnID string, u ColumnUpdate) error {
+	columns, err := r.Columns()
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, col := range columns {
+		if col.ID == columnID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return store.ErrNotFound
+	}
+
+	if u.Title != nil {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_columns SET title = ? WHERE org_id = ? AND id = ?", strings.TrimSpace(*u.Title), r.tenant.OrgID, columnID); err != nil {
+			return err
+		}
+	}
+	if u.WIPLimit != nil {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_columns SET wip_limit = NULLIF(?, 0) WHERE org_id = ? AND id = ?", *u.WIPLimit, r.tenant.OrgID, columnID); err != nil {
+			return err
+		}
+	}
+	if u.WIPPolicy != nil {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_columns SET wip_policy = ? WHERE org_id = ? AND id = ?", *u.WIPPolicy, r.tenant.OrgID, columnID); err != nil {
+			return err
+		}
+	}
+	if u.Won != nil {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_columns SET won = ? WHERE org_id = ? AND id = ?", *u.Won, r.tenant.OrgID, columnID); err != nil {
+			return err
+		}
+	}
+	if u.Position == nil {
+		return nil
+	}
+	moved := columns[index]
+	columns = append(columns[:index], columns[index+1:]...)
+	to := min(max(*u.Position, 0), len(columns))
+	columns = append(columns[:to], append([]Column{moved}, columns[to:]...)...)
+	for i, col := range columns {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_columns SET position = ? WHERE org_id = ? AND id = ?", i, r.tenant.OrgID, col.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlRepository) CheckWIP(columnID, leadID string) (WIPCheck, error) {
+	var w WIPCheck
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT title, COALESCE(wip_limit, 0), wip_policy,
+               (SELECT COUNT(*) FROM crm_leads cl
+                WHERE cl.org_id = crm_columns.org_id AND cl.column_id = crm_columns.id AND cl.lead_id != ?
+                  AND cl.deleted_at IS NULL AND (cl.snoozed_until IS NULL OR cl.snoozed_until <= ?))
+        FROM crm_columns WHERE org_id = ? AND id = ?
+    `, leadID, time.Now().UTC(), r.tenant.OrgID, columnID).Scan(&w.Title, &w.Limit, &w.Policy, &w.Count)
+	if err == sql.ErrNoRows {
+		return w, store.ErrNotFound
+	}
+	return w, err
+}
+
+func (r *sqlRepository) DeleteColumn(columnID string) error {
+	if IsBuiltInColumn(columnID) {
+		if r.HasColumn(columnID) {
+			return ErrBuiltInColumn
+		}
+		return store.ErrNotFound
+	}
+	var inUse bool
+	err := r.q.QueryRowContext(r.ctx, "SELECT EXISTS(SELECT 1 FROM crm_leads WHERE org_id = ? AND column_id = ? AND deleted_at IS NULL)", r.tenant.OrgID, columnID).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrColumnInUse
+	}
+	if err := store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM crm_columns WHERE org_id = ? AND id = ?", r.tenant.OrgID, columnID)); err != nil {
+		return err
+	}
+	// Calls with a disposition that moved leads here now leave them put.
+	_, err = r.q.ExecContext(r.ctx, "UPDATE disposition_rules SET column_id = '' WHERE org_id = ? AND column_id = ?", r.tenant.OrgID, columnID)
+	return err
+}
+
+// --- STATUSES ---
+
+func (r *sqlRepository) Statuses() ([]Status, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT id, title, color, position FROM crm_statuses WHERE org_id = ? ORDER BY position, id", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []Status{}
+	for rows.Next() {
+		var s Status
+		if err := rows.Scan(&s.ID, &s.Title, &s.Color, &s.Position); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+func (r *sqlRepository) HasStatus(statusID string) bool {
+	var exists bool
+	err := r.q.QueryRowContext(r.ctx, "SELECT EXISTS(SELECT 1 FROM crm_statuses WHERE org_id = ? AND id = ?)", r.tenant.OrgID, statusID).Scan(&exists)
+	return err == nil && exists
+}
+
+func (r *sqlRepository) CreateStatus(title, color string) (Status, error) {
+	s := Status{Title: title, Color: color}
+	base := Slug(title)
+	s.ID = base
+	for n := 2; r.HasStatus(s.ID); n++ {
+		s.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	err := r.q.QueryRowContext(r.ctx, `
+        INSERT INTO crm_statuses (org_id, id, title, color, position)
+        VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM crm_statuses WHERE org_id = ?))
+        RETURNING position
+    `, r.tenant.OrgID, s.ID, title, color, r.tenant.OrgID).Scan(&s.Position)
+	return s, err
+}
+
+func (r *sqlRepository) UpdateStatus(statusID string, u StatusUpdate) error {
+	statuses, err := r.Statuses()
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, s := range statuses {
+		if s.ID == statusID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return store.ErrNotFound
+	}
+
+	if u.Title != nil {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_statuses SET title = ? WHERE org_id = ? AND id = ?", strings.TrimSpace(*u.Title), r.tenant.OrgID, statusID); err != nil {
+			return err
+		}
+	}
+	if u.Color != nil {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_statuses SET color = ? WHERE org_id = ? AND id = ?", *u.Color, r.tenant.OrgID, statusID); err != nil {
+			return err
+		}
+	}
+	if u.Position == nil {
+		return nil
+	}
+	moved := statuses[index]
+	statuses = append(statuses[:index], statuses[index+1:]...)
+	to := min(max(*u.Position, 0), len(statuses))
+	statuses = append(statuses[:to], append([]Status{moved}, statuses[to:]...)...)
+	for i, s := range statuses {
+		if _, err := r.q.ExecContext(r.ctx, "UPDATE crm_statuses SET position = ? WHERE org_id = ? AND id = ?", i, r.tenant.OrgID, s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlRepository) DeleteStatus(statusID string) error {
+	if err := store.ExpectOne(r.q.ExecContext(r.ctx, "DELETE FROM crm_statuses WHERE org_id = ? AND id = ?", r.tenant.OrgID, statusID)); err != nil {
+		return err
+	}
+	_, err := r.q.ExecContext(r.ctx, "UPDATE crm_leads SET status_id = '', updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND status_id = ?", r.tenant.OrgID, statusID)
+	return err
+}
+
+// --- CARDS ---
+
+func (r *sqlRepository) Cards(where string, args ...interface{}) ([]Card, error) {
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT lead_id, company_name, phone, website, email, page_speed, column_id, notes, times_called, callback_date, updated_at,
+               last_disposition, last_called_at, snoozed_until, column_changed_at, status_id,
+               (SELECT GROUP_CONCAT(tag, ',') FROM crm_lead_tags t WHERE t.org_id = crm_leads.org_id AND t.lead_id = crm_leads.lead_id),
+               (SELECT timezone FROM leads WHERE leads.id = crm_leads.lead_id), user_id, priority,
+               (SELECT screenshot FROM leads WHERE leads.id = crm_leads.lead_id)
+        FROM crm_leads
+        WHERE org_id = ? AND deleted_at IS NULL`+where, append([]interface{}{r.tenant.OrgID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cards []Card
+	for rows.Next() {
+		var c Card
+		var leadID, companyName, phone, website, email, columnID, notes, lastDisposition, statusID, tags, timezone, screenshot sql.NullString
+		var pageSpeed, timesCalled sql.NullInt64
+		var callbackDate, updatedAt, lastCalledAt, snoozedUntil, columnChangedAt sql.NullTime
+
+		err := rows.Scan(&leadID, &companyName, &phone, &website, &email, &pageSpeed, &columnID, &notes, &timesCalled, &callbackDate, &updatedAt, &lastDisposition, &lastCalledAt, &snoozedUntil, &columnChangedAt, &statusID, &tags, &timezone, &c.Assignee, &c.Priority, &screenshot)
+		if err != nil {
+			log.Printf("Error scanning CRM lead: %v", err)
+			continue
+		}
+
+		c.ID = leadID.String
+		c.CompanyName = companyName.String
+		c.Phone = r.codec.Unseal(phone.String)
+		c.Website = website.String
+		c.Email = r.codec.Unseal(email.String)
+		c.PageSpeed = int(pageSpeed.Int64)
+		c.ColumnID = columnID.String
+		c.StatusID = statusID.String
+		c.Notes = r.codec.Unseal(notes.String)
+		c.TimesCalled = int(timesCalled.Int64)
+		if callbackDate.Valid {
+			c.CallBackDate = &callbackDate.Time
+		}
+		if updatedAt.Valid {
+			c.UpdatedAt = &updatedAt.Time
+		}
+		c.LastDisposition = lastDisposition.String
+		if lastCalledAt.Valid {
+			c.LastCalledAt = &lastCalledAt.Time
+		}
+		if snoozedUntil.Valid {
+			c.SnoozedUntil = &snoozedUntil.Time
+		}
+		if columnChangedAt.Valid {
+			c.ColumnChangedAt = &columnChangedAt.Time
+			c.DaysInColumn = int(time.Since(columnChangedAt.Time).Hours() / 24)
+		}
+		c.Timezone = timezone.String
+		if screenshot.String != "" {
+			c.Screenshot = "/api/crm/leads/" + c.ID + "/screenshot"
+		}
+		c.Tags = []string{}
+		if tags.String != "" {
+			c.Tags = strings.Split(tags.String, ",")
+			sort.Strings(c.Tags)
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}
+
+func (r *sqlRepository) Card(leadID string) (Card, error) {
+	cards, err := r.Cards(" AND lead_id = ?", leadID)
+	if err != nil {
+		return Card{}, err
+	}
+	if len(cards) == 0 {
+		return Card{}, store.ErrNotFound
+	}
+	return cards[0], nil
+}
+
+func (r *sqlRepository) HasCard(leadID string) bool {
+	var exists bool
+	err := r.q.QueryRowContext(r.ctx, "SELECT EXISTS(SELECT 1 FROM crm_leads WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL)", r.tenant.OrgID, leadID).Scan(&exists)
+	return err == nil && exists
+}
+
+func (r *sqlRepository) CardColumn(leadID string) (string, sql.NullTime, error) {
+	var columnID string
+	var changedAt sql.NullTime
+	err := r.q.QueryRowContext(r.ctx, "SELECT column_id, column_changed_at FROM crm_leads WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL",
+		r.tenant.OrgID, leadID).Scan(&columnID, &changedAt)
+	if err == sql.ErrNoRows {
+		return "", changedAt, store.ErrNotFound
+	}
+	return columnID, changedAt, err
+}
+
+func (r *sqlRepository) MoveCard(leadID, columnID string) (string, error) {
+	from, _, err := r.CardColumn(leadID)
+	if err != nil {
+		return "", err
+	}
+	return from, store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE crm_leads
+        SET column_id = ?1, updated_at = CURRENT_TIMESTAMP,
+            column_changed_at = CASE WHEN column_id = ?1 THEN column_changed_at ELSE CURRENT_TIMESTAMP END
+        WHERE org_id = ?2 AND lead_id = ?3 AND deleted_at IS NULL
+    `, columnID, r.tenant.OrgID, leadID))
+}
+
+func (r *sqlRepository) SetColumnChangedAt(leadID string, at sql.NullTime) error {
+	_, err := r.q.ExecContext(r.ctx, "UPDATE crm_leads SET column_changed_at = ? WHERE org_id = ? AND lead_id = ?", at, r.tenant.OrgID, leadID)
+	return err
+}
+
+func (r *sqlRepository) Notes(leadID string) (string, error) {
+	var notes sql.NullString
+	err := r.q.QueryRowContext(r.ctx, "SELECT notes FROM crm_leads WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL", r.tenant.OrgID, leadID).Scan(&notes)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	return r.codec.Unseal(notes.String), err
+}
+
+func (r *sqlRepository) SetNotes(leadID, notes string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE crm_leads SET notes = ?, updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL",
+		r.codec.Seal(notes), r.tenant.OrgID, leadID))
+}
+
+func (r *sqlRepository) UpdateCard(leadID, notes string, callbackDate *time.Time) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE crm_leads
+        SET notes = ?, callback_date = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL
+    `, r.codec.Seal(notes), callbackDate, r.tenant.OrgID, leadID))
+}
+
+func (r *sqlRepository) SetContact(leadID string, email, phone *string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE crm_leads SET email = COALESCE(?, email), phone = COALESCE(?, phone), updated_at = CURRENT_TIMESTAMP
+        WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL
+    `, r.sealPtr(email), r.sealPtr(phone), r.tenant.OrgID, leadID))
+}
+
+// sealPtr seals an optional value, leaving nil alone.
+func (r *sqlRepository) sealPtr(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	sealed := r.codec.Seal(*value)
+	return &sealed
+}
+
+func (r *sqlRepository) Snooze(leadID string, until time.Time) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE crm_leads SET snoozed_until = ?, snoozed_by = ?, updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL",
+		until.UTC(), r.tenant.UserID, r.tenant.OrgID, leadID))
+}
+
+func (r *sqlRepository) Unsnooze(leadID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE crm_leads SET snoozed_until = NULL, snoozed_by = NULL, updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL AND snoozed_until IS NOT NULL",
+		r.tenant.OrgID, leadID))
+}
+
+func (r *sqlRepository) SetStatus(leadID, statusID string) (string, error) {
+	return r.setCardField(leadID, "status_id", statusID)
+}
+
+func (r *sqlRepository) SetPriority(leadID, priority string) (string, error) {
+	return r.setCardField(leadID, "priority", priority)
+}
+
+// setCardField sets one of the card's text columns, returning its old
+// value. column is always a constant from this package.
+func (r *sqlRepository) setCardField(leadID, column, value string) (string, error) {
+	var from string
+	err := r.q.QueryRowContext(r.ctx, "SELECT "+column+" FROM crm_leads WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL", r.tenant.OrgID, leadID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return "", store.ErrNotFound
+	}
+	if err != nil || from == value {
+		return from, err
+	}
+	_, err = r.q.ExecContext(r.ctx, "UPDATE crm_leads SET "+column+" = ?, updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND lead_id = ?", value, r.tenant.OrgID, leadID)
+	return from, err
+}
+
+func (r *sqlRepository) Trash(leadID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE crm_leads SET deleted_at = CURRENT_TIMESTAMP WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL", r.tenant.OrgID, leadID))
+}
+
+func (r *sqlRepository) Restore(leadID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, `
+        UPDATE crm_leads SET deleted_at = NULL,
+            column_changed_at = CASE WHEN column_id IN (SELECT id FROM crm_columns WHERE org_id = crm_leads.org_id) THEN column_changed_at ELSE CURRENT_TIMESTAMP END,
+            column_id = CASE WHEN column_id IN (SELECT id FROM crm_columns WHERE org_id = crm_leads.org_id) THEN column_id ELSE 'tobe-called' END
+        WHERE org_id = ? AND lead_id = ? AND deleted_at IS NOT NULL
+    `, r.tenant.OrgID, leadID))
+}
+
+// --- DIALER CLAIMS ---
+
+func (r *sqlRepository) Claim(leadID string, until time.Time) (bool, error) {
+	res, err := r.q.ExecContext(r.ctx, `
+        UPDATE crm_leads SET claimed_by = ?, claimed_until = ?
+        WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL
+          AND (claimed_until IS NULL OR claimed_until <= ? OR claimed_by = ?)
+    `, r.tenant.UserID, until, r.tenant.OrgID, leadID, time.Now().UTC(), r.tenant.UserID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *sqlRepository) ReleaseClaims() error {
+	_, err := r.q.ExecContext(r.ctx, "UPDATE crm_leads SET claimed_by = NULL, claimed_until = NULL WHERE org_id = ? AND claimed_by = ?", r.tenant.OrgID, r.tenant.UserID)
+	return err
+}
+
+func (r *sqlRepository) ClaimHolder(leadID string) (int64, error) {
+	var holder sql.NullInt64
+	err := r.q.QueryRowContext(r.ctx, `
+        SELECT CASE WHEN claimed_until > ? THEN claimed_by END FROM crm_leads
+        WHERE org_id = ? AND lead_id = ? AND deleted_at IS NULL
+    `, time.Now().UTC(), r.tenant.OrgID, leadID).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return 0, store.ErrNotFound
+	}
+	return holder.Int64, err
+}
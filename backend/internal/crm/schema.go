@@ -0,0 +1,79 @@
+package crm
+
+import "blueleads-backend/internal/store"
+
+// Migrate creates the board tables and adds the columns introduced since
+// the first schema, in the order they were added.
+func Migrate(q store.Querier) error {
+	err := store.Statements(q, `
+        CREATE TABLE IF NOT EXISTS crm_leads (
+            user_id INTEGER NOT NULL,
+            lead_id TEXT NOT NULL,
+            column_id TEXT NOT NULL,
+            notes TEXT,
+            times_called INTEGER DEFAULT 0,
+            callback_date DATETIME,
+            company_name TEXT,
+            phone TEXT,
+            website TEXT,
+            email TEXT,
+            page_speed INTEGER,
+            PRIMARY KEY (user_id, lead_id),
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS org_crm_versions (
+            org_id INTEGER PRIMARY KEY,
+            version INTEGER NOT NULL DEFAULT 0,
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS crm_columns (
+            org_id INTEGER NOT NULL,
+            id TEXT NOT NULL,
+            title TEXT NOT NULL,
+            position INTEGER NOT NULL,
+            PRIMARY KEY (org_id, id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS crm_statuses (
+            org_id INTEGER NOT NULL,
+            id TEXT NOT NULL,
+            title TEXT NOT NULL,
+            color TEXT NOT NULL,
+            position INTEGER NOT NULL,
+            PRIMARY KEY (org_id, id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `)
+	if err != nil {
+		return err
+	}
+	columns := [][3]string{
+		{"crm_leads", "deleted_at", "DATETIME"},
+		{"crm_leads", "org_id", "INTEGER REFERENCES organizations (id)"},
+		{"crm_leads", "updated_at", "DATETIME"},
+		{"crm_leads", "callback_pushed_for", "DATETIME"},
+		{"crm_leads", "last_disposition", "TEXT"},
+		{"crm_leads", "last_called_at", "DATETIME"},
+		{"crm_leads", "snoozed_until", "DATETIME"},
+		{"crm_leads", "snoozed_by", "INTEGER REFERENCES users (id)"},
+		{"crm_leads", "column_changed_at", "DATETIME"},
+		{"crm_columns", "wip_limit", "INTEGER"},
+		{"crm_columns", "wip_policy", "TEXT NOT NULL DEFAULT 'warn'"},
+		{"crm_columns", "won", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"crm_leads", "claimed_by", "INTEGER"},
+		{"crm_leads", "claimed_until", "DATETIME"},
+		{"crm_leads", "status_id", "TEXT NOT NULL DEFAULT ''"},
+		{"crm_leads", "priority", "TEXT NOT NULL DEFAULT 'warm'"},
+	}
+	for _, c := range columns {
+		if err := store.AddColumnIfMissing(q, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	// Cards added before updated_at existed count as updated now.
+	_, err = q.Exec("UPDATE crm_leads SET updated_at = CURRENT_TIMESTAMP WHERE updated_at IS NULL")
+	return err
+}
@@ -0,0 +1,99 @@
+package crm
+
+import "strings"
+
+// ValidationError is a change the service refused; its text says why and
+// is safe to show the user.
+type ValidationError string
+
+func (e ValidationError) Error() string { return string(e) }
+
+// FieldErrors are the problems with a change, by field, in the form the
+// API reports them.
+type FieldErrors map[string]string
+
+func (fe FieldErrors) Error() string { return "some fields are invalid" }
+
+// check records message for field unless ok. Only the first problem with a
+// field is kept.
+func (fe FieldErrors) check(ok bool, field, message string) {
+	if _, seen := fe[field]; !ok && !seen {
+		fe[field] = message
+	}
+}
+
+// Service is what the API does with the board layout, on top of storing
+// it. Bumping the board version is left to the caller, which may have more
+// to change in the same write.
+type Service interface {
+	Columns() ([]Column, error)
+	CreateColumn(title string) (Column, error)
+	// UpdateColumn validates and applies u, returning the board's columns
+	// in their new order.
+	UpdateColumn(columnID string, u ColumnUpdate) ([]Column, error)
+	DeleteColumn(columnID string) error
+
+	Statuses() ([]Status, error)
+	// CreateStatus validates and adds a status. Validation failures are
+	// FieldErrors.
+	CreateStatus(title, color string) (Status, error)
+	// UpdateStatus validates and applies u, returning the statuses in their
+	// new order.
+	UpdateStatus(statusID string, u StatusUpdate) ([]Status, error)
+	DeleteStatus(statusID string) error
+}
+
+type service struct {
+	repo Repository
+}
+
+func NewService(repo Repository) Service {
+	return &service{repo: repo}
+}
+
+func (s *service) Columns() ([]Column, error) {
+	return s.repo.Columns()
+}
+
+func (s *service) CreateColumn(title string) (Column, error) {
+	return s.repo.CreateColumn(strings.TrimSpace(title))
+}
+
+func (s *service) UpdateColumn(columnID string, u ColumnUpdate) ([]Column, error) {
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.repo.UpdateColumn(columnID, u); err != nil {
+		return nil, err
+	}
+	return s.repo.Columns()
+}
+
+func (s *service) DeleteColumn(columnID string) error {
+	return s.repo.DeleteColumn(columnID)
+}
+
+func (s *service) Statuses() ([]Status, error) {
+	return s.repo.Statuses()
+}
+
+func (s *service) CreateStatus(title, color string) (Status, error) {
+	if err := (StatusUpdate{Title: &title, Color: &color}).Validate(); err != nil {
+		return Status{}, err
+	}
+	return s.repo.CreateStatus(strings.TrimSpace(title), color)
+}
+
+func (s *service) UpdateStatus(statusID string, u StatusUpdate) ([]Status, error) {
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.repo.UpdateStatus(statusID, u); err != nil {
+		return nil, err
+	}
+	return s.repo.Statuses()
+}
+
+func (s *service) DeleteStatus(statusID string) error {
+	return s.repo.DeleteStatus(statusID)
+}
@@ -0,0 +1,220 @@
+package leads
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- OPENING HOURS ---
+
+// OpeningHours holds the open intervals for each weekday in minutes after
+// midnight. An interval that runs past midnight has an end beyond 24*60.
+type OpeningHours map[time.Weekday][][2]int
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// ParseWeekday reads a day name in any case, as used for opening hours.
+func ParseWeekday(day string) (time.Weekday, bool) {
+	weekday, ok := weekdayNames[strings.ToLower(strings.TrimSpace(day))]
+	return weekday, ok
+}
+
+var hoursTimeRe = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?\s*(am|pm)?$`)
+
+// normalizeHoursText folds the assorted dashes and thin spaces Google uses
+// into plain ASCII.
+func normalizeHoursText(s string) string {
+	r := strings.NewReplacer("\u2013", "-", "\u2014", "-", "\u202f", " ", "\u2009", " ", "\u00a0", " ", " to ", "-")
+	return strings.ToLower(strings.TrimSpace(r.Replace(s)))
+}
+
+// ParseOpeningHours accepts the scraper's weekday -> ranges map, e.g.
+// {"Monday": ["8:30 am–12:30 pm", "1:30–5 pm"], "Sunday": ["Closed"]}.
+func ParseOpeningHours(raw map[string][]string) OpeningHours {
+	hours := OpeningHours{}
+	for day, ranges := range raw {
+		weekday, ok := ParseWeekday(day)
+		if !ok {
+			continue
+		}
+		for _, r := range ranges {
+			for _, part := range strings.Split(r, ",") {
+				if interval, ok := ParseHoursRange(part); ok {
+					hours[weekday] = append(hours[weekday], interval)
+				}
+			}
+		}
+	}
+	return hours
+}
+
+// ParseStoredHours reads the hours stored with a lead as JSON; anything
+// unreadable counts as unknown.
+func ParseStoredHours(rawHours string) OpeningHours {
+	var raw map[string][]string
+	if rawHours == "" || json.Unmarshal([]byte(rawHours), &raw) != nil {
+		return nil
+	}
+	return ParseOpeningHours(raw)
+}
+
+// ParseHoursRange reads one range such as "9:00-17:00" or "1:30–5 pm"
+// into minutes after midnight.
+func ParseHoursRange(s string) ([2]int, bool) {
+	s = normalizeHoursText(s)
+	if strings.Contains(s, "24 hours") {
+		return [2]int{0, 24 * 60}, true
+	}
+	startText, endText, ok := strings.Cut(s, "-")
+	if !ok {
+		return [2]int{}, false
+	}
+
+	end, endMeridiem, ok := parseHoursTime(endText, "")
+	if !ok {
+		return [2]int{}, false
+	}
+	// "1:30–5 pm" leaves the meridiem off the start; borrow the end's, unless
+	// that would put the start after the end (as in "11–2 pm").
+	start, _, ok := parseHoursTime(startText, endMeridiem)
+	if !ok {
+		return [2]int{}, false
+	}
+	if endMeridiem == "pm" && !strings.Contains(startText, "m") && start > end {
+		start -= 12 * 60
+	}
+	if end <= start {
+		end += 24 * 60
+	}
+	return [2]int{start, end}, true
+}
+
+func parseHoursTime(s, defaultMeridiem string) (int, string, bool) {
+	m := hoursTimeRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, "", false
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute := 0
+	if m[2] != "" {
+		minute, _ = strconv.Atoi(m[2])
+	}
+	meridiem := m[3]
+	if meridiem == "" {
+		meridiem = defaultMeridiem
+	}
+	if hour > 23 || minute > 59 {
+		return 0, "", false
+	}
+	switch meridiem {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	return hour*60 + minute, meridiem, true
+}
+
+// isOpenAt reports whether the business is open at t, including intervals
+// carried over from the previous day past midnight.
+func (h OpeningHours) isOpenAt(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	for _, iv := range h[t.Weekday()] {
+		if minute >= iv[0] && minute < iv[1] {
+			return true
+		}
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	for _, iv := range h[yesterday] {
+		if minute+24*60 < iv[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// IntervalsOn returns the day's open intervals, including the tail of the
+// previous day's late ones, clipped to that day and sorted.
+func (h OpeningHours) IntervalsOn(day time.Weekday) [][2]int {
+	var out [][2]int
+	for _, iv := range h[(day+6)%7] {
+		if iv[1] > 24*60 {
+			out = append(out, [2]int{0, iv[1] - 24*60})
+		}
+	}
+	for _, iv := range h[day] {
+		out = append(out, [2]int{iv[0], min(iv[1], 24*60)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// nextOpening returns the start of the next open interval after t.
+func (h OpeningHours) nextOpening(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for offset := 0; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		best := -1
+		for _, iv := range h[day.Weekday()] {
+			start := day.Add(time.Duration(iv[0]) * time.Minute)
+			if start.After(t) && (best < 0 || iv[0] < best) {
+				best = iv[0]
+			}
+		}
+		if best >= 0 {
+			return day.Add(time.Duration(best) * time.Minute), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// annotateOpeningHours fills in the derived isOpenNow and bestTimeToCall
+// fields on a lead from its stored opening hours.
+func annotateOpeningHours(l *Lead, rawHours string, now time.Time) {
+	if rawHours == "" {
+		return
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal([]byte(rawHours), &raw); err != nil || len(raw) == 0 {
+		return
+	}
+	l.OpenHours = raw
+
+	hours := ParseOpeningHours(raw)
+	if len(hours) == 0 {
+		return
+	}
+	open := hours.isOpenAt(now)
+	l.IsOpenNow = &open
+	if open {
+		l.BestTimeToCall = "now"
+		return
+	}
+	if next, ok := hours.nextOpening(now); ok {
+		l.BestTimeToCall = formatNextOpening(next, now)
+	}
+}
+
+func formatNextOpening(next, now time.Time) string {
+	clock := next.Format("15:04")
+	switch {
+	case next.YearDay() == now.YearDay() && next.Year() == now.Year():
+		return fmt.Sprintf("today at %s", clock)
+	case next.Sub(now) < 48*time.Hour && next.Weekday() == (now.Weekday()+1)%7:
+		return fmt.Sprintf("tomorrow at %s", clock)
+	default:
+		return fmt.Sprintf("%s at %s", next.Weekday(), clock)
+	}
+}
@@ -0,0 +1,99 @@
+// Package leads stores the businesses a search found: their contact
+// details, what enrichment has learned about them, and when they're open
+// to take a call.
+package leads
+
+type Lead struct {
+	ID             string              `json:"id"`
+	SearchID       string              `json:"searchId"`
+	CompanyName    string              `json:"companyName"`
+	Phone          string              `json:"phone"`
+	Website        string              `json:"website"`
+	Email          string              `json:"email"`
+	PageSpeed      int                 `json:"pageSpeed"`
+	Rating         float64             `json:"rating"`
+	ReviewCount    int                 `json:"reviewCount"`
+	Category       string              `json:"category"`
+	Address        string              `json:"address"`
+	Latitude       *float64            `json:"latitude"`
+	Longitude      *float64            `json:"longitude"`
+	Timezone       string              `json:"timezone,omitempty"`
+	OpenHours      map[string][]string `json:"openHours,omitempty"`
+	IsOpenNow      *bool               `json:"isOpenNow,omitempty"`
+	BestTimeToCall string              `json:"bestTimeToCall,omitempty"`
+	Socials        SocialProfiles      `json:"socials"`
+	Tech           []string            `json:"tech"`
+	// Firmographics is null until a provider has found the company.
+	Firmographics *Firmographics `json:"firmographics"`
+	// Features is null until the lead's website has been analysed.
+	Features *SiteFeatures `json:"features"`
+	// Screenshot is where to fetch a picture of the lead's homepage from,
+	// empty until one has been taken.
+	Screenshot string  `json:"screenshot"`
+	Emails     []Email `json:"emails"`
+	Phones     []Phone `json:"phones"`
+	IsNew      *bool   `json:"isNew,omitempty"`
+	// Forgotten leads have had their contact details redacted for good.
+	Forgotten bool `json:"forgotten,omitempty"`
+}
+
+// --- CONTACT DETAILS ---
+
+// Email is one of a lead's addresses. Type says where it came from
+// (scraped, website or guessed); Verification is set for checked ones.
+type Email struct {
+	Email        string `json:"email"`
+	Type         string `json:"type"`
+	Verification string `json:"verification,omitempty"`
+}
+
+// Phone is one of a lead's numbers. Valid, LineType and Carrier are
+// only set once the number has been looked up.
+type Phone struct {
+	Phone    string `json:"phone"`
+	Type     string `json:"type"`
+	Valid    *bool  `json:"valid,omitempty"`
+	LineType string `json:"lineType,omitempty"`
+	Carrier  string `json:"carrier,omitempty"`
+}
+
+// Contacts are the emails and phones of a set of leads, by lead ID.
+type Contacts struct {
+	Emails map[string][]Email
+	Phones map[string][]Phone
+}
+
+// --- ENRICHMENT ---
+
+type SocialProfiles struct {
+	Facebook  string `json:"facebook,omitempty"`
+	Instagram string `json:"instagram,omitempty"`
+	LinkedIn  string `json:"linkedin,omitempty"`
+}
+
+func (s SocialProfiles) Empty() bool {
+	return s.Facebook == "" && s.Instagram == "" && s.LinkedIn == ""
+}
+
+// Firmographics is what a provider knows about one company.
+type Firmographics struct {
+	LegalName     string `json:"legalName"`
+	EmployeeCount int    `json:"employeeCount"` // 0 when unknown
+	// IncorporatedOn is a date (YYYY-MM-DD), or just the year when that's
+	// all the provider has.
+	IncorporatedOn string `json:"incorporatedOn"`
+}
+
+func (f Firmographics) Empty() bool {
+	return f.LegalName == "" && f.EmployeeCount == 0 && f.IncorporatedOn == ""
+}
+
+// SiteFeatures says what a business's homepage offers, for pitch angles:
+// a booking-system reseller wants the sites without online booking.
+type SiteFeatures struct {
+	LiveChat       bool `json:"liveChat"`
+	OnlineBooking  bool `json:"onlineBooking"`
+	ECommerce      bool `json:"ecommerce"`
+	Analytics      bool `json:"analytics"`
+	MobileFriendly bool `json:"mobileFriendly"`
+}
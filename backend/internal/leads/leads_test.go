@@ -0,0 +1,158 @@
+package leads
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+	"blueleads-backend/internal/store/storetest"
+)
+
+// newTestRepos returns repositories for two organizations, each with one
+// search: s1 for alice and s2 for mallory.
+func newTestRepos(t *testing.T) (alice, mallory Repository, q store.Querier) {
+	t.Helper()
+	db := storetest.Open(t, searches.Migrate, Migrate)
+	for i, id := range []string{"s1", "s2"} {
+		tenant := store.Tenant{OrgID: int64(i + 1), UserID: int64(i + 1)}
+		if err := searches.NewRepository(context.Background(), db, tenant).Insert(searches.Search{ID: id, Keyword: "plumbers", Status: searches.COMPLETED}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice = NewRepository(context.Background(), db, store.Tenant{OrgID: 1, UserID: 1}, store.PlainCodec{})
+	mallory = NewRepository(context.Background(), db, store.Tenant{OrgID: 2, UserID: 2}, store.PlainCodec{})
+	return alice, mallory, db
+}
+
+func insertLead(t *testing.T, q store.Querier, id, searchID, name, phone, website string) {
+	t.Helper()
+	if _, err := q.Exec("INSERT INTO leads (id, search_id, company_name, phone, website, rating) VALUES (?, ?, ?, ?, ?, ?)", id, searchID, name, phone, website, 4.5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListScopesToTenantAndFilters(t *testing.T) {
+	alice, mallory, q := newTestRepos(t)
+	insertLead(t, q, "l1", "s1", "Acme Plumbing", "0113 496 0000", "acme.example")
+	insertLead(t, q, "l2", "s1", "Bolt Plumbing", "", "")
+	insertLead(t, q, "l3", "s2", "Mallory's", "", "")
+	if _, err := q.Exec("INSERT INTO lead_emails (lead_id, email, type) VALUES ('l1', 'hi@acme.example', 'website')"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := alice.List(Query{SearchIDs: []string{"s1", "s2"}})
+	if err != nil || len(found) != 2 {
+		t.Fatalf("List = %+v (err %v), want alice's two leads", found, err)
+	}
+	if len(found[0].Emails) != 1 || found[0].Emails[0].Email != "hi@acme.example" {
+		t.Errorf("contacts weren't attached: %+v", found[0].Emails)
+	}
+
+	found, err = alice.List(Query{
+		SearchIDs: []string{"s1"},
+		Where:     []string{"rating >= ?"},
+		Args:      []interface{}{4},
+		Filters:   []func(Lead) bool{func(l Lead) bool { return l.Website != "" }},
+	})
+	if err != nil || len(found) != 1 || found[0].ID != "l1" {
+		t.Errorf("filtered List = %+v (err %v), want just l1", found, err)
+	}
+
+	if _, err := mallory.Get("l1"); err != store.ErrNotFound {
+		t.Errorf("Get across tenants: got %v, want ErrNotFound", err)
+	}
+	if owns, _ := mallory.Owns("l1"); owns {
+		t.Error("mallory owns alice's lead")
+	}
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	alice, mallory, q := newTestRepos(t)
+	insertLead(t, q, "l1", "s1", "Acme Plumbing", "", "")
+
+	if err := mallory.Trash("s1", "l1"); err != store.ErrNotFound {
+		t.Errorf("Trash across tenants: got %v, want ErrNotFound", err)
+	}
+	svc := NewService(alice)
+	if err := svc.Trash("s1", "l1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Get("l1"); err != store.ErrNotFound {
+		t.Errorf("Get of a trashed lead: got %v, want ErrNotFound", err)
+	}
+	if err := mallory.Restore("l1"); err != store.ErrNotFound {
+		t.Errorf("Restore across tenants: got %v, want ErrNotFound", err)
+	}
+	if err := svc.Restore("l1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Get("l1"); err != nil {
+		t.Errorf("restored lead: %v", err)
+	}
+}
+
+func TestMergeFillsBlanksAndTrashesOthers(t *testing.T) {
+	alice, mallory, q := newTestRepos(t)
+	insertLead(t, q, "keep", "s1", "Acme Plumbing", "", "acme.example")
+	insertLead(t, q, "dup", "s1", "Acme Plumbing Ltd", "0113 496 0000", "other.example")
+	insertLead(t, q, "theirs", "s2", "Mallory's", "", "")
+	if _, err := q.Exec("INSERT INTO lead_phones (lead_id, phone, type) VALUES ('dup', '0113 496 0000', 'main')"); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(alice)
+	if err := svc.Merge("keep", []string{"keep"}); err != ErrBadMerge {
+		t.Errorf("merging a lead into itself: got %v, want ErrBadMerge", err)
+	}
+	if err := svc.Merge("keep", []string{"theirs"}); err != store.ErrNotFound {
+		t.Errorf("merging another tenant's lead: got %v, want ErrNotFound", err)
+	}
+	if err := mallory.Merge("theirs", []string{"dup"}); err != store.ErrNotFound {
+		t.Errorf("merging across tenants: got %v, want ErrNotFound", err)
+	}
+	if err := svc.Merge("keep", []string{"dup"}); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := alice.List(Query{SearchIDs: []string{"s1"}})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("after merge: %+v (err %v), want one lead", found, err)
+	}
+	kept := found[0]
+	if kept.Phone != "0113 496 0000" || kept.Website != "acme.example" || len(kept.Phones) != 1 {
+		t.Errorf("kept lead = %+v, want the blank phone filled and the number moved across", kept)
+	}
+}
+
+func TestOpeningHours(t *testing.T) {
+	if r, ok := ParseHoursRange("1:30–5 pm"); !ok || r != [2]int{13*60 + 30, 17 * 60} {
+		t.Errorf("ParseHoursRange = %v, %v", r, ok)
+	}
+	if r, ok := ParseHoursRange("11–2 pm"); !ok || r != [2]int{11 * 60, 14 * 60} {
+		t.Errorf("ParseHoursRange across noon = %v, %v", r, ok)
+	}
+	if _, ok := ParseHoursRange("by appointment"); ok {
+		t.Error("ParseHoursRange accepted free text")
+	}
+
+	hours := ParseOpeningHours(map[string][]string{
+		"Friday":   {"6 pm–2 am"},
+		"Saturday": {"Closed"},
+	})
+	if got := hours.IntervalsOn(time.Saturday); len(got) != 1 || got[0] != [2]int{0, 2 * 60} {
+		t.Errorf("Saturday picks up Friday's late hours: got %v", got)
+	}
+
+	// Friday 1 January 2021, at 5pm and again just after midnight.
+	var l Lead
+	annotateOpeningHours(&l, `{"Friday": ["6 pm–2 am"]}`, time.Date(2021, 1, 1, 17, 0, 0, 0, time.UTC))
+	if l.IsOpenNow == nil || *l.IsOpenNow || l.BestTimeToCall != "today at 18:00" {
+		t.Errorf("before opening: open %v, best %q", l.IsOpenNow, l.BestTimeToCall)
+	}
+	annotateOpeningHours(&l, `{"Friday": ["6 pm–2 am"]}`, time.Date(2021, 1, 2, 1, 0, 0, 0, time.UTC))
+	if l.IsOpenNow == nil || !*l.IsOpenNow || l.BestTimeToCall != "now" {
+		t.Errorf("after midnight: open %v, best %q", l.IsOpenNow, l.BestTimeToCall)
+	}
+}
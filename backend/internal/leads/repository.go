@@ -0,0 +1,275 @@
+package leads
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"blueleads-backend/internal/searches"
+	"blueleads-backend/internal/store"
+)
+
+// Repository reads and writes the leads in one tenant's searches. Every
+// method but Contacts adds the organization scope itself.
+type Repository interface {
+	// Get returns a live lead from one of the tenant's searches.
+	Get(leadID string) (Lead, error)
+	// Owns reports whether a live lead is in one of the tenant's searches.
+	Owns(leadID string) (bool, error)
+	// List returns the leads q matches, with their contact details.
+	List(q Query) ([]Lead, error)
+	// Contacts loads the emails and phones of leads the caller has
+	// already checked are the tenant's.
+	Contacts(leadIDs []string) (Contacts, error)
+	// AttachContacts fills in each lead's emails and phones.
+	AttachContacts(leads []Lead) error
+	Trash(searchID, leadID string) error
+	Restore(leadID string) error
+	// Merge folds others into keep: keep's blank phone, website, email
+	// and address are filled from them, their extra emails and phones
+	// move across, and they go to the trash.
+	Merge(keep string, others []string) error
+}
+
+// Query picks leads out of some of the tenant's searches. Where and Args
+// narrow it further in SQL; Filters run on each lead once it's read, for
+// the checks SQL can't do. OrderBy defaults to the order leads were
+// stored in.
+type Query struct {
+	SearchIDs []string
+	Where     []string
+	Args      []interface{}
+	Filters   []func(Lead) bool
+	OrderBy   string
+}
+
+const SELECT_COLUMNS = "id, search_id, company_name, phone, website, email, page_speed, rating, review_count, category, address, latitude, longitude, open_hours, facebook_url, instagram_url, linkedin_url, tech, timezone, is_new, forgotten_at IS NOT NULL, legal_name, employee_count, incorporated_on, screenshot, " +
+	"has_live_chat, has_online_booking, has_ecommerce, has_analytics, mobile_friendly"
+
+// Scan reads a lead selected with SELECT_COLUMNS, opening its sealed
+// contact details with codec. Emails and phones are left for
+// AttachContacts.
+func Scan(row store.RowScanner, codec store.Codec) (Lead, error) {
+	var l Lead
+	var companyName, email, website, phone, category, address, openHours sql.NullString
+	var facebook, instagram, linkedIn, tech, timezone, legalName, incorporatedOn, screenshot sql.NullString
+	var pageSpeed, reviewCount, employeeCount sql.NullInt64
+	var liveChat, onlineBooking, ecommerce, analytics, mobileFriendly sql.NullBool
+	var rating, latitude, longitude sql.NullFloat64
+	var isNew sql.NullBool
+	if err := row.Scan(&l.ID, &l.SearchID, &companyName, &phone, &website, &email, &pageSpeed, &rating, &reviewCount, &category, &address, &latitude, &longitude, &openHours, &facebook, &instagram, &linkedIn, &tech, &timezone, &isNew, &l.Forgotten, &legalName, &employeeCount, &incorporatedOn, &screenshot, &liveChat, &onlineBooking, &ecommerce, &analytics, &mobileFriendly); err != nil {
+		return l, err
+	}
+	if isNew.Valid {
+		l.IsNew = &isNew.Bool
+	}
+	l.CompanyName = companyName.String
+	l.Email = codec.Unseal(email.String)
+	l.Website = website.String
+	l.Phone = codec.Unseal(phone.String)
+	l.PageSpeed = int(pageSpeed.Int64)
+	l.Rating = rating.Float64
+	l.ReviewCount = int(reviewCount.Int64)
+	l.Category = category.String
+	l.Address = address.String
+	if latitude.Valid && longitude.Valid {
+		l.Latitude = &latitude.Float64
+		l.Longitude = &longitude.Float64
+	}
+	l.Socials = SocialProfiles{Facebook: facebook.String, Instagram: instagram.String, LinkedIn: linkedIn.String}
+	if f := (Firmographics{LegalName: legalName.String, EmployeeCount: int(employeeCount.Int64), IncorporatedOn: incorporatedOn.String}); !f.Empty() {
+		l.Firmographics = &f
+	}
+	if liveChat.Valid {
+		l.Features = &SiteFeatures{LiveChat: liveChat.Bool, OnlineBooking: onlineBooking.Bool, ECommerce: ecommerce.Bool, Analytics: analytics.Bool, MobileFriendly: mobileFriendly.Bool}
+	}
+	if screenshot.String != "" {
+		l.Screenshot = "/api/searches/" + l.SearchID + "/leads/" + l.ID + "/screenshot"
+	}
+	l.Tech = []string{}
+	if tech.String != "" {
+		l.Tech = strings.Split(tech.String, ",")
+	}
+	// Opening hours are in the business's own time.
+	now := time.Now()
+	l.Timezone = timezone.String
+	if l.Timezone != "" {
+		if loc, err := time.LoadLocation(l.Timezone); err == nil {
+			now = now.In(loc)
+		}
+	}
+	annotateOpeningHours(&l, openHours.String, now)
+	return l, nil
+}
+
+type sqlRepository struct {
+	tenant store.Tenant
+	q      store.Querier
+	ctx    context.Context
+	codec  store.Codec
+}
+
+// NewRepository returns the SQL repository for the leads in the tenant's
+// searches, running its queries on q under ctx. codec opens the contact
+// details sealed at rest.
+func NewRepository(ctx context.Context, q store.Querier, tenant store.Tenant, codec store.Codec) Repository {
+	return &sqlRepository{tenant: tenant, q: q, ctx: ctx, codec: codec}
+}
+
+func (r *sqlRepository) Get(leadID string) (Lead, error) {
+	l, err := Scan(r.q.QueryRowContext(r.ctx, "SELECT "+SELECT_COLUMNS+" FROM leads WHERE id = ? AND deleted_at IS NULL AND search_id IN ("+searches.OWNED_IDS+")", leadID, r.tenant.OrgID), r.codec)
+	if err == sql.ErrNoRows {
+		return l, store.ErrNotFound
+	}
+	return l, err
+}
+
+func (r *sqlRepository) Owns(leadID string) (bool, error) {
+	var exists bool
+	err := r.q.QueryRowContext(r.ctx, "SELECT EXISTS(SELECT 1 FROM leads WHERE id = ? AND deleted_at IS NULL AND search_id IN ("+searches.OWNED_IDS+"))", leadID, r.tenant.OrgID).Scan(&exists)
+	return exists, err
+}
+
+func (r *sqlRepository) List(q Query) ([]Lead, error) {
+	ids, args := store.InList(q.SearchIDs)
+	where := append([]string{"search_id IN (" + ids + ")", "deleted_at IS NULL", "search_id IN (" + searches.OWNED_IDS + ")"}, q.Where...)
+	args = append(append(args, r.tenant.OrgID), q.Args...)
+	orderBy := q.OrderBy
+	if orderBy == "" {
+		orderBy = "rowid ASC"
+	}
+
+	rows, err := r.q.QueryContext(r.ctx, fmt.Sprintf("SELECT %s FROM leads WHERE %s ORDER BY %s", SELECT_COLUMNS, strings.Join(where, " AND "), orderBy), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leads []Lead
+rowLoop:
+	for rows.Next() {
+		l, err := Scan(rows, r.codec)
+		if err != nil {
+			log.Printf("Error scanning lead row: %v", err)
+			continue
+		}
+		for _, keep := range q.Filters {
+			if !keep(l) {
+				continue rowLoop
+			}
+		}
+		leads = append(leads, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return leads, r.AttachContacts(leads)
+}
+
+// Contacts fetches the emails and phones in a couple of queries per few
+// hundred leads rather than one per lead.
+func (r *sqlRepository) Contacts(leadIDs []string) (Contacts, error) {
+	contacts := Contacts{Emails: map[string][]Email{}, Phones: map[string][]Phone{}}
+	const chunkSize = 500
+	for start := 0; start < len(leadIDs); start += chunkSize {
+		end := min(start+chunkSize, len(leadIDs))
+		placeholders, args := store.InList(leadIDs[start:end])
+
+		rows, err := r.q.QueryContext(r.ctx, "SELECT lead_id, email, type, verification FROM lead_emails WHERE lead_id IN ("+placeholders+") ORDER BY id", args...)
+		if err != nil {
+			return contacts, err
+		}
+		for rows.Next() {
+			var leadID string
+			var e Email
+			if err := rows.Scan(&leadID, &e.Email, &e.Type, &e.Verification); err != nil {
+				log.Printf("Error scanning lead email: %v", err)
+				continue
+			}
+			e.Email = r.codec.Unseal(e.Email)
+			contacts.Emails[leadID] = append(contacts.Emails[leadID], e)
+		}
+		rows.Close()
+
+		rows, err = r.q.QueryContext(r.ctx, "SELECT lead_id, phone, type, valid, line_type, carrier FROM lead_phones WHERE lead_id IN ("+placeholders+") ORDER BY id", args...)
+		if err != nil {
+			return contacts, err
+		}
+		for rows.Next() {
+			var leadID string
+			var p Phone
+			var valid sql.NullBool
+			if err := rows.Scan(&leadID, &p.Phone, &p.Type, &valid, &p.LineType, &p.Carrier); err != nil {
+				log.Printf("Error scanning lead phone: %v", err)
+				continue
+			}
+			p.Phone = r.codec.Unseal(p.Phone)
+			if valid.Valid {
+				p.Valid = &valid.Bool
+			}
+			contacts.Phones[leadID] = append(contacts.Phones[leadID], p)
+		}
+		rows.Close()
+	}
+	return contacts, nil
+}
+
+func (r *sqlRepository) AttachContacts(leads []Lead) error {
+	ids := make([]string, len(leads))
+	for i, l := range leads {
+		ids[i] = l.ID
+	}
+	contacts, err := r.Contacts(ids)
+	if err != nil {
+		return err
+	}
+	for i := range leads {
+		leads[i].Emails = contacts.Emails[leads[i].ID]
+		leads[i].Phones = contacts.Phones[leads[i].ID]
+	}
+	return nil
+}
+
+func (r *sqlRepository) Trash(searchID, leadID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE leads SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND search_id = ? AND deleted_at IS NULL AND search_id IN ("+searches.OWNED_IDS+")", leadID, searchID, r.tenant.OrgID))
+}
+
+func (r *sqlRepository) Restore(leadID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE leads SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL AND search_id IN ("+searches.OWNED_IDS+")", leadID, r.tenant.OrgID))
+}
+
+func (r *sqlRepository) Merge(keep string, others []string) error {
+	return store.InTx(r.ctx, r.q, func(q store.Querier) error {
+		for _, id := range others {
+			res, err := q.ExecContext(r.ctx, `
+                UPDATE leads SET
+                    phone = COALESCE(NULLIF(leads.phone, ''), o.phone),
+                    website = COALESCE(NULLIF(leads.website, ''), o.website),
+                    email = COALESCE(NULLIF(leads.email, ''), o.email),
+                    address = COALESCE(NULLIF(leads.address, ''), o.address)
+                FROM (SELECT phone, website, email, address FROM leads WHERE id = ? AND deleted_at IS NULL AND search_id IN (`+searches.OWNED_IDS+`)) AS o
+                WHERE leads.id = ? AND leads.search_id IN (`+searches.OWNED_IDS+`)
+            `, id, r.tenant.OrgID, keep, r.tenant.OrgID)
+			if err := store.ExpectOne(res, err); err != nil {
+				return err
+			}
+			if _, err := q.ExecContext(r.ctx, "INSERT OR IGNORE INTO lead_emails (lead_id, email, type, verification) SELECT ?, email, type, verification FROM lead_emails WHERE lead_id = ?", keep, id); err != nil {
+				return err
+			}
+			if _, err := q.ExecContext(r.ctx, `
+                INSERT OR IGNORE INTO lead_phones (lead_id, phone, type, valid, line_type, carrier, looked_up_at)
+                SELECT ?, phone, type, valid, line_type, carrier, looked_up_at FROM lead_phones WHERE lead_id = ?
+            `, keep, id); err != nil {
+				return err
+			}
+			if err := store.ExpectOne(q.ExecContext(r.ctx, "UPDATE leads SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL AND search_id IN ("+searches.OWNED_IDS+")", id, r.tenant.OrgID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
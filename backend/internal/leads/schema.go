@@ -0,0 +1,82 @@
+package leads
+
+import "blueleads-backend/internal/store"
+
+// Migrate creates the lead tables and adds the columns introduced since
+// the first schema, in the order they were added. It expects the search
+// tables to exist.
+func Migrate(q store.Querier) error {
+	err := store.Statements(q, `
+        CREATE TABLE IF NOT EXISTS leads (
+            id TEXT PRIMARY KEY,
+            search_id TEXT NOT NULL,
+            company_name TEXT,
+            phone TEXT,
+            website TEXT,
+            email TEXT,
+            page_speed INTEGER,
+            scraped_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (search_id) REFERENCES searches (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS lead_emails (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            lead_id TEXT NOT NULL,
+            email TEXT NOT NULL,
+            type TEXT NOT NULL DEFAULT 'scraped',
+            UNIQUE (lead_id, email),
+            FOREIGN KEY (lead_id) REFERENCES leads (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS lead_phones (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            lead_id TEXT NOT NULL,
+            phone TEXT NOT NULL,
+            type TEXT NOT NULL DEFAULT 'main',
+            UNIQUE (lead_id, phone),
+            FOREIGN KEY (lead_id) REFERENCES leads (id)
+        );
+    `)
+	if err != nil {
+		return err
+	}
+	columns := [][3]string{
+		{"leads", "rating", "REAL"},
+		{"leads", "review_count", "INTEGER"},
+		{"leads", "category", "TEXT"},
+		{"leads", "address", "TEXT"},
+		{"leads", "latitude", "REAL"},
+		{"leads", "longitude", "REAL"},
+		{"leads", "open_hours", "TEXT"},
+		{"leads", "facebook_url", "TEXT"},
+		{"leads", "instagram_url", "TEXT"},
+		{"leads", "linkedin_url", "TEXT"},
+		{"leads", "deleted_at", "DATETIME"},
+		{"leads", "tech", "TEXT"},
+		{"lead_emails", "verification", "TEXT NOT NULL DEFAULT ''"},
+		{"lead_phones", "valid", "BOOLEAN"},
+		{"lead_phones", "line_type", "TEXT NOT NULL DEFAULT ''"},
+		{"lead_phones", "carrier", "TEXT NOT NULL DEFAULT ''"},
+		{"lead_phones", "looked_up_at", "DATETIME"},
+		{"leads", "timezone", "TEXT"},
+		{"leads", "is_new", "BOOLEAN"},
+		{"leads", "forgotten_at", "DATETIME"},
+		{"leads", "legal_name", "TEXT NOT NULL DEFAULT ''"},
+		{"leads", "employee_count", "INTEGER"},
+		{"leads", "incorporated_on", "TEXT NOT NULL DEFAULT ''"},
+		{"leads", "firmographics_at", "DATETIME"},
+		{"leads", "screenshot", "TEXT NOT NULL DEFAULT ''"},
+		{"leads", "screenshot_at", "DATETIME"},
+		{"leads", "has_live_chat", "BOOLEAN"},
+		{"leads", "has_online_booking", "BOOLEAN"},
+		{"leads", "has_ecommerce", "BOOLEAN"},
+		{"leads", "has_analytics", "BOOLEAN"},
+		{"leads", "mobile_friendly", "BOOLEAN"},
+	}
+	for _, c := range columns {
+		if err := store.AddColumnIfMissing(q, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package leads
+
+import "errors"
+
+// ErrBadMerge is returned for a merge with nothing to fold in, or one that
+// would fold a lead into itself.
+var ErrBadMerge = errors.New("merge needs other leads than the one kept")
+
+// Service is what the API does with leads, on top of storing them.
+type Service interface {
+	Get(leadID string) (Lead, error)
+	List(q Query) ([]Lead, error)
+	Trash(searchID, leadID string) error
+	Restore(leadID string) error
+	// Merge folds others into keep; see Repository.Merge. It fails with
+	// ErrBadMerge when others is empty or includes keep.
+	Merge(keep string, others []string) error
+}
+
+type service struct {
+	repo Repository
+}
+
+func NewService(repo Repository) Service {
+	return &service{repo: repo}
+}
+
+func (s *service) Get(leadID string) (Lead, error) {
+	return s.repo.Get(leadID)
+}
+
+func (s *service) List(q Query) ([]Lead, error) {
+	return s.repo.List(q)
+}
+
+func (s *service) Trash(searchID, leadID string) error {
+	return s.repo.Trash(searchID, leadID)
+}
+
+func (s *service) Restore(leadID string) error {
+	return s.repo.Restore(leadID)
+}
+
+func (s *service) Merge(keep string, others []string) error {
+	if len(others) == 0 {
+		return ErrBadMerge
+	}
+	for _, id := range others {
+		if id == keep {
+			return ErrBadMerge
+		}
+	}
+	return s.repo.Merge(keep, others)
+}
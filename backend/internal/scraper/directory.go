@@ -0,0 +1,212 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --- DIRECTORY SITE PROVIDERS ---
+const DIRECTORY_MAX_PAGES = 10
+const DIRECTORY_REQUEST_INTERVAL = 3 * time.Second
+
+// directoryProvider scrapes business listings from a paginated directory site
+// such as Yell.com or YellowPages.com. Requests are rate limited per source
+// and checked against the site's robots.txt before being issued.
+type directoryProvider struct {
+	info      Info
+	pageURL   func(q Query, page int) string
+	parsePage func(body string) []Lead
+	client    *http.Client
+	limiter   *RateLimiter
+}
+
+// DirectoryProviders returns the Yell.com and YellowPages.com sources.
+func DirectoryProviders() []Provider {
+	return []Provider{
+		&directoryProvider{
+			info:      Info{ID: "yell", Name: "Yell.com", RequiresLocation: true},
+			pageURL:   yellPageURL,
+			parsePage: parseYellPage,
+			client:    &http.Client{Timeout: 30 * time.Second},
+			limiter:   NewRateLimiter(DIRECTORY_REQUEST_INTERVAL),
+		},
+		&directoryProvider{
+			info:      Info{ID: "yellow_pages", Name: "Yellow Pages", RequiresLocation: true},
+			pageURL:   yellowPagesPageURL,
+			parsePage: parseYellowPagesPage,
+			client:    &http.Client{Timeout: 30 * time.Second},
+			limiter:   NewRateLimiter(DIRECTORY_REQUEST_INTERVAL),
+		},
+	}
+}
+
+func (p *directoryProvider) Info() Info {
+	return p.info
+}
+
+func (p *directoryProvider) Search(ctx context.Context, q Query) ([]Lead, error) {
+	var leads []Lead
+	seen := make(map[string]bool)
+
+	for page := 1; page <= DIRECTORY_MAX_PAGES; page++ {
+		body, err := p.fetch(ctx, p.pageURL(q, page))
+		if err != nil {
+			if page == 1 {
+				return nil, err
+			}
+			log.Printf("Stopping %s pagination for search %s at page %d: %v", p.info.ID, q.SearchID, page, err)
+			break
+		}
+
+		pageLeads := p.parsePage(body)
+		if len(pageLeads) == 0 {
+			break
+		}
+
+		added := 0
+		for _, l := range pageLeads {
+			key := strings.ToLower(l.Title + "|" + l.Phone)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			leads = append(leads, l)
+			added++
+		}
+		if added == 0 {
+			break
+		}
+	}
+	return leads, nil
+}
+
+func (p *directoryProvider) fetch(ctx context.Context, rawURL string) (string, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	allowed, err := RobotsAllowed(ctx, p.client, target)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", fmt.Errorf("robots.txt disallows %s", target.Path)
+	}
+
+	if err := p.limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned status %d", target.Host, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 5*1024*1024))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// --- YELL.COM ---
+var (
+	yellCapsuleRe = regexp.MustCompile(`(?s)<div[^>]+class="[^"]*businessCapsule--mainRow[^"]*"`)
+	yellNameRe    = regexp.MustCompile(`(?s)<h2[^>]+class="[^"]*businessCapsule--name[^"]*"[^>]*>(.*?)</h2>`)
+	yellPhoneRe   = regexp.MustCompile(`(?s)<span[^>]+class="[^"]*business--telephoneNumber[^"]*"[^>]*>(.*?)</span>`)
+	yellWebsiteRe = regexp.MustCompile(`(?s)<a[^>]+href="(https?://[^"]+)"[^>]+data-tracking="[^"]*:WL:[^"]*"`)
+)
+
+func yellPageURL(q Query, page int) string {
+	params := url.Values{}
+	params.Set("keywords", q.Keyword)
+	params.Set("location", q.Location)
+	params.Set("pageNum", fmt.Sprint(page))
+	return "https://www.yell.com/ucs/UcsSearchAction.do?" + params.Encode()
+}
+
+func parseYellPage(body string) []Lead {
+	return parseListingBlocks(body, yellCapsuleRe, yellNameRe, yellPhoneRe, yellWebsiteRe)
+}
+
+// --- YELLOWPAGES.COM ---
+var (
+	ypResultRe  = regexp.MustCompile(`(?s)<div[^>]+class="[^"]*\bv-card\b[^"]*"`)
+	ypNameRe    = regexp.MustCompile(`(?s)<a[^>]+class="[^"]*business-name[^"]*"[^>]*>(.*?)</a>`)
+	ypPhoneRe   = regexp.MustCompile(`(?s)<div[^>]+class="[^"]*phones phone primary[^"]*"[^>]*>(.*?)</div>`)
+	ypWebsiteRe = regexp.MustCompile(`(?s)<a[^>]+class="[^"]*track-visit-website[^"]*"[^>]+href="(https?://[^"]+)"`)
+)
+
+func yellowPagesPageURL(q Query, page int) string {
+	params := url.Values{}
+	params.Set("search_terms", q.Keyword)
+	params.Set("geo_location_terms", q.Location)
+	params.Set("page", fmt.Sprint(page))
+	return "https://www.yellowpages.com/search?" + params.Encode()
+}
+
+func parseYellowPagesPage(body string) []Lead {
+	return parseListingBlocks(body, ypResultRe, ypNameRe, ypPhoneRe, ypWebsiteRe)
+}
+
+// --- LISTING PARSING HELPERS ---
+var htmlTagRe = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// parseListingBlocks splits a results page on the listing block marker and
+// pulls the name, phone and website out of each block.
+func parseListingBlocks(body string, blockRe, nameRe, phoneRe, websiteRe *regexp.Regexp) []Lead {
+	starts := blockRe.FindAllStringIndex(body, -1)
+	var leads []Lead
+	for i, start := range starts {
+		end := len(body)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		block := body[start[0]:end]
+
+		name := firstSubmatchText(nameRe, block)
+		if name == "" {
+			continue
+		}
+		leads = append(leads, Lead{
+			Title:   name,
+			Phone:   firstSubmatchText(phoneRe, block),
+			Website: html.UnescapeString(firstSubmatch(websiteRe, block)),
+		})
+	}
+	return leads
+}
+
+func firstSubmatch(re *regexp.Regexp, s string) string {
+	m := re.FindStringSubmatch(s)
+	if len(m) < 2 {
+		return ""
+	}
+	return m[1]
+}
+
+func firstSubmatchText(re *regexp.Regexp, s string) string {
+	text := htmlTagRe.ReplaceAllString(firstSubmatch(re, s), "")
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
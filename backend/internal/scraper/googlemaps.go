@@ -0,0 +1,80 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// GOOGLE_MAPS_COMMAND is the gosom/google-maps-scraper binary, looked up on
+// the PATH.
+const GOOGLE_MAPS_COMMAND = "google-maps-scraper"
+
+// GoogleMapsProvider shells out to the gosom/google-maps-scraper binary.
+type GoogleMapsProvider struct{}
+
+func (GoogleMapsProvider) Info() Info {
+	return Info{ID: "google_maps", Name: "Google Maps"}
+}
+
+func (GoogleMapsProvider) Search(ctx context.Context, q Query) ([]Lead, error) {
+	tmpDir := os.TempDir()
+	inputFile, err := os.Create(filepath.Join(tmpDir, fmt.Sprintf("input_%s.txt", q.SearchID)))
+	if err != nil {
+		return nil, fmt.Errorf("creating temp input file: %w", err)
+	}
+	defer os.Remove(inputFile.Name())
+
+	outputFileName := filepath.Join(tmpDir, fmt.Sprintf("output_%s.json", q.SearchID))
+	defer os.Remove(outputFileName)
+
+	if _, err := inputFile.WriteString(q.Text()); err != nil {
+		inputFile.Close()
+		return nil, fmt.Errorf("writing temp input file: %w", err)
+	}
+	inputFile.Close()
+
+	cmd := exec.CommandContext(ctx, GOOGLE_MAPS_COMMAND, "-input", inputFile.Name(), "-results", outputFileName, "-json", "-email")
+	output, err := cmd.CombinedOutput()
+	q.log().Output(string(output))
+	var outputBytes int64
+	if info, statErr := os.Stat(outputFileName); statErr == nil {
+		outputBytes = info.Size()
+	}
+	if cmd.ProcessState != nil {
+		q.log().Exited(cmd.ProcessState.ExitCode(), outputBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scraper command failed: %w", err)
+	}
+
+	log.Printf("Scraper finished for search ID %s.", q.SearchID)
+	return decodeScraperOutput(outputFileName)
+}
+
+// decodeScraperOutput reads the newline-delimited JSON objects written by the scraper.
+func decodeScraperOutput(outputFileName string) ([]Lead, error) {
+	file, err := os.Open(outputFileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading scraper output file %s: %w", outputFileName, err)
+	}
+	defer file.Close()
+
+	var scrapedLeads []Lead
+	decoder := json.NewDecoder(file)
+	for {
+		var lead Lead
+		if err := decoder.Decode(&lead); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("decoding JSON object: %w", err)
+		}
+		scrapedLeads = append(scrapedLeads, lead)
+	}
+	return scrapedLeads, nil
+}
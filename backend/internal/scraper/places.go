@@ -0,0 +1,212 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// --- GOOGLE PLACES API PROVIDER ---
+const PLACES_TEXT_SEARCH_URL = "https://maps.googleapis.com/maps/api/place/textsearch/json"
+const PLACES_DETAILS_URL = "https://maps.googleapis.com/maps/api/place/details/json"
+const PLACES_MAX_PAGES = 3
+const PLACES_RESULTS_PER_PAGE = 20
+
+// Google bills per request; these are the list prices in USD.
+const PLACES_TEXT_SEARCH_COST = 0.032
+const PLACES_DETAILS_COST = 0.020
+
+// googlePlacesProvider uses the official Places API with the user's own key,
+// for users who can't run the scraper binary.
+type googlePlacesProvider struct {
+	client *http.Client
+	apiKey func(ctx context.Context, userID int64) (string, error)
+}
+
+// NewPlacesProvider returns the Google Places source. apiKey looks up the
+// key a user has saved in their settings.
+func NewPlacesProvider(apiKey func(ctx context.Context, userID int64) (string, error)) Provider {
+	return &googlePlacesProvider{client: &http.Client{Timeout: 30 * time.Second}, apiKey: apiKey}
+}
+
+type placesTextSearchResponse struct {
+	Status        string `json:"status"`
+	ErrorMessage  string `json:"error_message"`
+	NextPageToken string `json:"next_page_token"`
+	Results       []struct {
+		PlaceID string `json:"place_id"`
+	} `json:"results"`
+}
+
+type placesDetailsResponse struct {
+	Status       string `json:"status"`
+	ErrorMessage string `json:"error_message"`
+	Result       struct {
+		Name                     string   `json:"name"`
+		FormattedPhoneNumber     string   `json:"formatted_phone_number"`
+		InternationalPhoneNumber string   `json:"international_phone_number"`
+		Website                  string   `json:"website"`
+		FormattedAddress         string   `json:"formatted_address"`
+		Rating                   float64  `json:"rating"`
+		UserRatingsTotal         int      `json:"user_ratings_total"`
+		Types                    []string `json:"types"`
+		OpeningHours             struct {
+			WeekdayText []string `json:"weekday_text"`
+		} `json:"opening_hours"`
+		Geometry struct {
+			Location struct {
+				Lat float64 `json:"lat"`
+				Lng float64 `json:"lng"`
+			} `json:"location"`
+		} `json:"geometry"`
+	} `json:"result"`
+}
+
+func (p *googlePlacesProvider) Info() Info {
+	return Info{ID: "google_places", Name: "Google Places API"}
+}
+
+func (p *googlePlacesProvider) Validate(ctx context.Context, userID int64) error {
+	apiKey, err := p.apiKey(ctx, userID)
+	if err != nil {
+		return errors.New("Failed to load settings")
+	}
+	if apiKey == "" {
+		return errors.New("Add a Google Places API key in settings to use this source")
+	}
+	return nil
+}
+
+// EstimateCost assumes a full result set: every text search page plus one
+// details lookup per place.
+func (p *googlePlacesProvider) EstimateCost() float64 {
+	return PLACES_MAX_PAGES*PLACES_TEXT_SEARCH_COST + PLACES_MAX_PAGES*PLACES_RESULTS_PER_PAGE*PLACES_DETAILS_COST
+}
+
+func (p *googlePlacesProvider) Search(ctx context.Context, q Query) ([]Lead, error) {
+	apiKey, err := p.apiKey(ctx, q.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %w", err)
+	}
+	if apiKey == "" {
+		return nil, errors.New("no Google Places API key configured")
+	}
+
+	query := q.Text()
+
+	var placeIDs []string
+	pageToken := ""
+	for page := 0; page < PLACES_MAX_PAGES; page++ {
+		params := url.Values{}
+		params.Set("key", apiKey)
+		if pageToken == "" {
+			params.Set("query", query)
+		} else {
+			params.Set("pagetoken", pageToken)
+		}
+
+		var resp placesTextSearchResponse
+		if err := p.get(ctx, PLACES_TEXT_SEARCH_URL, params, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Status == "ZERO_RESULTS" {
+			break
+		}
+		if resp.Status != "OK" {
+			return nil, fmt.Errorf("places text search returned %s: %s", resp.Status, resp.ErrorMessage)
+		}
+		for _, r := range resp.Results {
+			placeIDs = append(placeIDs, r.PlaceID)
+		}
+
+		pageToken = resp.NextPageToken
+		if pageToken == "" {
+			break
+		}
+		// Page tokens take a moment to become valid on Google's side.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	leads := make([]Lead, 0, len(placeIDs))
+	for _, placeID := range placeIDs {
+		params := url.Values{}
+		params.Set("key", apiKey)
+		params.Set("place_id", placeID)
+		params.Set("fields", "name,formatted_phone_number,international_phone_number,website,formatted_address,rating,user_ratings_total,types,geometry,opening_hours")
+
+		var resp placesDetailsResponse
+		if err := p.get(ctx, PLACES_DETAILS_URL, params, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Status != "OK" {
+			return nil, fmt.Errorf("places details returned %s: %s", resp.Status, resp.ErrorMessage)
+		}
+
+		phone := resp.Result.FormattedPhoneNumber
+		if phone == "" {
+			phone = resp.Result.InternationalPhoneNumber
+		}
+		category := ""
+		if len(resp.Result.Types) > 0 {
+			category = strings.ReplaceAll(resp.Result.Types[0], "_", " ")
+		}
+		leads = append(leads, Lead{
+			Title:       resp.Result.Name,
+			Phone:       phone,
+			Website:     resp.Result.Website,
+			Rating:      resp.Result.Rating,
+			ReviewCount: resp.Result.UserRatingsTotal,
+			Category:    category,
+			Address:     resp.Result.FormattedAddress,
+			Latitude:    resp.Result.Geometry.Location.Lat,
+			Longitude:   resp.Result.Geometry.Location.Lng,
+			OpenHours:   placesHoursToMap(resp.Result.OpeningHours.WeekdayText),
+		})
+	}
+	return leads, nil
+}
+
+func (p *googlePlacesProvider) get(ctx context.Context, endpoint string, params url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("places API returned status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// placesHoursToMap converts Places API weekday_text ("Monday: 9:00 AM – 5:00 PM")
+// into the scraper's weekday -> ranges shape.
+func placesHoursToMap(weekdayText []string) map[string][]string {
+	if len(weekdayText) == 0 {
+		return nil
+	}
+	hours := map[string][]string{}
+	for _, line := range weekdayText {
+		day, ranges, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		for _, r := range strings.Split(ranges, ",") {
+			hours[strings.TrimSpace(day)] = append(hours[strings.TrimSpace(day)], strings.TrimSpace(r))
+		}
+	}
+	return hours
+}
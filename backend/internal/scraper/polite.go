@@ -0,0 +1,190 @@
+package scraper
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- RATE LIMITING ---
+
+// RateLimiter spaces out requests to a single source so that at most one
+// request is issued per interval.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	return &RateLimiter{interval: interval}
+}
+
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	r.mu.Lock()
+	now := time.Now()
+	wait := r.next.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	r.next = now.Add(wait + r.interval)
+	r.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// --- ROBOTS.TXT ---
+const ROBOTS_CACHE_TTL = 24 * time.Hour
+
+type robotsRules struct {
+	allow     []string
+	disallow  []string
+	fetchedAt time.Time
+}
+
+// allowed applies the longest-match rule: the most specific matching
+// Allow/Disallow prefix wins, with Allow winning ties.
+func (r *robotsRules) allowed(path string) bool {
+	bestAllow, bestDisallow := -1, -1
+	for _, p := range r.allow {
+		if strings.HasPrefix(path, p) && len(p) > bestAllow {
+			bestAllow = len(p)
+		}
+	}
+	for _, p := range r.disallow {
+		if strings.HasPrefix(path, p) && len(p) > bestDisallow {
+			bestDisallow = len(p)
+		}
+	}
+	return bestDisallow < 0 || bestAllow >= bestDisallow
+}
+
+var robotsCache = struct {
+	sync.Mutex
+	rules map[string]*robotsRules
+}{rules: map[string]*robotsRules{}}
+
+// RobotsAllowed reports whether our crawler may fetch the given URL. A
+// missing robots.txt allows everything; an unreachable one denies.
+func RobotsAllowed(ctx context.Context, client *http.Client, target *url.URL) (bool, error) {
+	host := target.Scheme + "://" + target.Host
+
+	robotsCache.Lock()
+	rules, ok := robotsCache.rules[host]
+	robotsCache.Unlock()
+
+	if !ok || time.Since(rules.fetchedAt) > ROBOTS_CACHE_TTL {
+		var err error
+		rules, err = fetchRobots(ctx, client, host)
+		if err != nil {
+			return false, err
+		}
+		robotsCache.Lock()
+		robotsCache.rules[host] = rules
+		robotsCache.Unlock()
+	}
+
+	path := target.EscapedPath()
+	if target.RawQuery != "" {
+		path += "?" + target.RawQuery
+	}
+	return rules.allowed(path), nil
+}
+
+func fetchRobots(ctx context.Context, client *http.Client, host string) (*robotsRules, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, host+"/robots.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching robots.txt for %s: %w", host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return &robotsRules{fetchedAt: time.Now()}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching robots.txt for %s: status %d", host, resp.StatusCode)
+	}
+	return parseRobots(io.LimitReader(resp.Body, 512*1024), "blueleadsbot"), nil
+}
+
+// parseRobots collects the rules that apply to the given user agent token,
+// falling back to the "*" group when no group names us specifically.
+func parseRobots(r io.Reader, agent string) *robotsRules {
+	specific := &robotsRules{}
+	wildcard := &robotsRules{}
+	var current []*robotsRules
+	foundSpecific := false
+	inAgentLine := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !inAgentLine {
+				current = nil
+			}
+			inAgentLine = true
+			ua := strings.ToLower(value)
+			if ua == "*" {
+				current = append(current, wildcard)
+			} else if strings.Contains(agent, ua) {
+				current = append(current, specific)
+				foundSpecific = true
+			}
+		case "allow", "disallow":
+			inAgentLine = false
+			if value == "" {
+				continue
+			}
+			for _, group := range current {
+				if key == "allow" {
+					group.allow = append(group.allow, value)
+				} else {
+					group.disallow = append(group.disallow, value)
+				}
+			}
+		default:
+			inAgentLine = false
+		}
+	}
+
+	rules := wildcard
+	if foundSpecific {
+		rules = specific
+	}
+	rules.fetchedAt = time.Now()
+	return rules
+}
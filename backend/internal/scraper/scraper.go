@@ -0,0 +1,145 @@
+// Package scraper finds leads for a search: the sources a search can run
+// against, the registry the server picks them from, and the politeness
+// rules (rate limits and robots.txt) the crawling sources keep to.
+package scraper
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+const UserAgent = "BlueLeadsBot/1.0 (+https://github.com/RangerVinven/Cold-Call-Lead-Manager)"
+
+// Lead is one business as a source found it, before it's cleaned up and
+// stored.
+type Lead struct {
+	Title       string              `json:"title"`
+	Phone       string              `json:"phone"`
+	Website     string              `json:"web_site"`
+	Emails      []string            `json:"emails"`
+	Rating      float64             `json:"review_rating"`
+	ReviewCount int                 `json:"review_count"`
+	Category    string              `json:"category"`
+	Address     string              `json:"address"`
+	Latitude    float64             `json:"latitude"`
+	Longitude   float64             `json:"longtitude"` // sic, as spelled by the scraper
+	OpenHours   map[string][]string `json:"open_hours"`
+}
+
+// Query is what a provider is asked to find.
+type Query struct {
+	SearchID string
+	UserID   int64
+	Keyword  string
+	Location string
+	// Log is where the provider reports progress; nil discards it.
+	Log Log
+}
+
+// Text is the query as typed into a search box: the keyword, in the
+// location when there is one.
+func (q Query) Text() string {
+	if q.Location == "" {
+		return q.Keyword
+	}
+	return q.Keyword + " in " + q.Location
+}
+
+// Log records what happens during a search, for the search's log view.
+type Log interface {
+	Printf(format string, args ...interface{})
+	// Output appends raw output from an external scraper.
+	Output(text string)
+	// Exited records how an external scraper process finished.
+	Exited(exitCode int, outputBytes int64)
+}
+
+type discardLog struct{}
+
+func (discardLog) Printf(string, ...interface{}) {}
+func (discardLog) Output(string)                 {}
+func (discardLog) Exited(int, int64)             {}
+
+func (q Query) log() Log {
+	if q.Log == nil {
+		return discardLog{}
+	}
+	return q.Log
+}
+
+// Logf adds a line to the search's log.
+func (q Query) Logf(format string, args ...interface{}) {
+	q.log().Printf(format, args...)
+}
+
+// Provider is a source of leads that a search can be run against.
+type Provider interface {
+	Info() Info
+	Search(ctx context.Context, q Query) ([]Lead, error)
+}
+
+// Validator is implemented by providers that need per-user configuration
+// (such as an API key) before a search can start.
+type Validator interface {
+	Validate(ctx context.Context, userID int64) error
+}
+
+// CostEstimator is implemented by paid providers to report the expected
+// cost of a single search in US dollars.
+type CostEstimator interface {
+	EstimateCost() float64
+}
+
+type Info struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	RequiresLocation bool    `json:"requiresLocation"`
+	EstimatedCost    float64 `json:"estimatedCost,omitempty"`
+}
+
+// Registry holds the providers the server offers, by ID.
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: map[string]Provider{}}
+}
+
+// Register adds p, replacing any provider with the same ID.
+func (r *Registry) Register(p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[p.Info().ID] = p
+}
+
+func (r *Registry) Unregister(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.providers, id)
+}
+
+func (r *Registry) Get(id string) (Provider, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.providers[id]
+	return p, ok
+}
+
+// Sources describes every provider, with its estimated cost, in ID order.
+func (r *Registry) Sources() []Info {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sources := make([]Info, 0, len(r.providers))
+	for _, p := range r.providers {
+		info := p.Info()
+		if e, ok := p.(CostEstimator); ok {
+			info.EstimatedCost = e.EstimateCost()
+		}
+		sources = append(sources, info)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].ID < sources[j].ID })
+	return sources
+}
@@ -0,0 +1,113 @@
+package scraper
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type fakeProvider struct {
+	info Info
+	cost float64
+}
+
+func (p fakeProvider) Info() Info { return p.info }
+
+func (p fakeProvider) Search(ctx context.Context, q Query) ([]Lead, error) {
+	return []Lead{{Title: q.Text()}}, nil
+}
+
+func (p fakeProvider) EstimateCost() float64 { return p.cost }
+
+func TestRegistryListsSourcesInOrder(t *testing.T) {
+	r := NewRegistry()
+	r.Register(fakeProvider{info: Info{ID: "yell", Name: "Yell.com"}})
+	r.Register(fakeProvider{info: Info{ID: "google_places", Name: "Places"}, cost: 1.5})
+	r.Register(fakeProvider{info: Info{ID: "yell", Name: "Yell.com again"}})
+
+	sources := r.Sources()
+	if len(sources) != 2 || sources[0].ID != "google_places" || sources[1].Name != "Yell.com again" {
+		t.Fatalf("sources = %+v", sources)
+	}
+	if sources[0].EstimatedCost != 1.5 {
+		t.Errorf("estimated cost = %v, want 1.5", sources[0].EstimatedCost)
+	}
+
+	r.Unregister("yell")
+	if _, ok := r.Get("yell"); ok {
+		t.Error("yell still registered")
+	}
+	p, ok := r.Get("google_places")
+	if !ok {
+		t.Fatal("google_places missing")
+	}
+	leads, _ := p.Search(context.Background(), Query{Keyword: "roofers", Location: "York"})
+	if leads[0].Title != "roofers in York" {
+		t.Errorf("query text = %q", leads[0].Title)
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	robots := `
+User-agent: *
+Disallow: /
+
+User-agent: BlueLeadsBot
+Disallow: /search
+Allow: /search/public
+`
+	rules := parseRobots(strings.NewReader(robots), "blueleadsbot")
+	for path, want := range map[string]bool{
+		"/":                  true,
+		"/search?q=roofers":  false,
+		"/search/public?q=1": true,
+	} {
+		if got := rules.allowed(path); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	rules = parseRobots(strings.NewReader(robots), "otherbot")
+	if rules.allowed("/anything") {
+		t.Error("the wildcard group should apply to other agents")
+	}
+}
+
+func TestParseYellPage(t *testing.T) {
+	body := `
+<div class="row businessCapsule--mainRow">
+  <h2 class="businessCapsule--name text-h2">Smith &amp; Sons <span>Roofing</span></h2>
+  <span class="business--telephoneNumber">01632 960001</span>
+  <a href="https://smithroofing.example/?a=1&amp;b=2" data-tracking="FLE:WL:CLOSED">Website</a>
+</div>
+<div class="row businessCapsule--mainRow">
+  <h2 class="businessCapsule--name">York Roofers</h2>
+</div>
+<div class="row businessCapsule--mainRow">
+  <p>An advert with no name</p>
+</div>`
+	leads := parseYellPage(body)
+	if len(leads) != 2 {
+		t.Fatalf("got %d leads, want 2: %+v", len(leads), leads)
+	}
+	first := leads[0]
+	if first.Title != "Smith & Sons Roofing" || first.Phone != "01632 960001" || first.Website != "https://smithroofing.example/?a=1&b=2" {
+		t.Errorf("first lead = %+v", first)
+	}
+	if leads[1].Title != "York Roofers" || leads[1].Phone != "" {
+		t.Errorf("second lead = %+v", leads[1])
+	}
+}
+
+func TestPlacesHoursToMap(t *testing.T) {
+	hours := placesHoursToMap([]string{"Monday: 9:00 AM – 12:00 PM, 1:00 – 5:00 PM", "Sunday: Closed"})
+	if got := hours["Monday"]; len(got) != 2 || got[1] != "1:00 – 5:00 PM" {
+		t.Errorf("Monday = %q", got)
+	}
+	if got := hours["Sunday"]; len(got) != 1 || got[0] != "Closed" {
+		t.Errorf("Sunday = %q", got)
+	}
+	if placesHoursToMap(nil) != nil {
+		t.Error("no weekday text should give no hours")
+	}
+}
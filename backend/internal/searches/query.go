@@ -0,0 +1,105 @@
+package searches
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"blueleads-backend/internal/store"
+)
+
+const DEFAULT_PAGE_SIZE = 50
+const MAX_PAGE_SIZE = 200
+
+type ListQuery struct {
+	where    string
+	args     []interface{}
+	page     int
+	pageSize int
+}
+
+// ParseListQuery reads the searches list parameters: page, pageSize,
+// status, q (keyword or title text), label (repeatable; a search needs
+// every label given), archived (false by default, true or all) and from/to
+// dates (YYYY-MM-DD or RFC 3339). The tenant scope is added by the
+// repository.
+func ParseListQuery(params url.Values) (*ListQuery, error) {
+	q := &ListQuery{page: 1, pageSize: DEFAULT_PAGE_SIZE}
+	where := []string{"deleted_at IS NULL"}
+
+	if v := params.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return nil, fmt.Errorf("page must be a positive integer")
+		}
+		q.page = page
+	}
+	if v := params.Get("pageSize"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 || size > MAX_PAGE_SIZE {
+			return nil, fmt.Errorf("pageSize must be between 1 and %d", MAX_PAGE_SIZE)
+		}
+		q.pageSize = size
+	}
+	switch params.Get("archived") {
+	case "", "false":
+		where = append(where, "archived_at IS NULL")
+	case "true":
+		where = append(where, "archived_at IS NOT NULL")
+	case "all":
+	default:
+		return nil, fmt.Errorf("archived must be true, false or all")
+	}
+	if v := params.Get("status"); v != "" {
+		where = append(where, "status = ?")
+		q.args = append(q.args, v)
+	}
+	if v := strings.TrimSpace(params.Get("q")); v != "" {
+		where = append(where, "(keyword LIKE ? ESCAPE '\\' OR title LIKE ? ESCAPE '\\')")
+		q.args = append(q.args, "%"+store.EscapeLike(v)+"%", "%"+store.EscapeLike(v)+"%")
+	}
+	for _, label := range params["label"] {
+		where = append(where, "EXISTS (SELECT 1 FROM search_labels sl WHERE sl.search_id = searches.id AND sl.label = ?)")
+		q.args = append(q.args, strings.TrimSpace(label))
+	}
+	if v := params.Get("from"); v != "" {
+		from, err := parseDate(v, false)
+		if err != nil {
+			return nil, fmt.Errorf("from must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+		}
+		where = append(where, "created_at >= ?")
+		q.args = append(q.args, from.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if v := params.Get("to"); v != "" {
+		to, err := parseDate(v, true)
+		if err != nil {
+			return nil, fmt.Errorf("to must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+		}
+		where = append(where, "created_at < ?")
+		q.args = append(q.args, to.UTC().Format("2006-01-02 15:04:05"))
+	}
+
+	q.where = strings.Join(where, " AND ")
+	return q, nil
+}
+
+// parseDate accepts a bare date or a full timestamp. A bare date used
+// as an upper bound covers the whole day.
+func parseDate(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func (q *ListQuery) Page() int     { return q.page }
+func (q *ListQuery) PageSize() int { return q.pageSize }
@@ -0,0 +1,292 @@
+package searches
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+
+	"blueleads-backend/internal/store"
+)
+
+// Repository reads and writes one tenant's searches. Every method adds the
+// organization scope itself.
+type Repository interface {
+	// Owns reports whether the search is one of the tenant's live ones.
+	Owns(searchID string) bool
+	Insert(s Search) error
+	Get(searchID string) (Search, error)
+	// List returns one page of searches matching q and the total number
+	// of matches.
+	List(q *ListQuery) ([]Search, int, error)
+	// Update changes the fields of in that are set. Labels replace the
+	// search's current ones.
+	Update(searchID string, in Update) error
+	// Labels returns every label in use on the tenant's live searches,
+	// with how many searches have it.
+	Labels() ([]Label, error)
+	SetLabelColor(label, color string) error
+	// Log returns the search's scrape log, empty if nothing was logged.
+	Log(searchID string) (Log, error)
+	SetArchived(searchID string, archived bool) error
+	Trash(searchID string) error
+	Restore(searchID string) error
+}
+
+// OWNED_IDS is a subquery for the tenant's live searches, for scoping
+// the rows that hang off them; its single argument is the organization ID.
+const OWNED_IDS = "SELECT id FROM searches WHERE org_id = ? AND deleted_at IS NULL"
+
+// SELECT_COLUMNS are the columns Scan reads, in order.
+const SELECT_COLUMNS = "id, keyword, source, location, status, leads_found, estimated_cost, created_at, COALESCE(rerun_of, ''), new_leads, title, notes, archived_at, started_at, finished_at, exit_code, output_bytes, error_count, error_samples, ingest_seconds"
+
+// Scan reads a search selected with SELECT_COLUMNS. Its labels are left
+// empty.
+func Scan(row store.RowScanner) (Search, error) {
+	var s Search
+	var newLeads sql.NullInt64
+	var archivedAt, startedAt, finishedAt sql.NullTime
+	var exitCode, outputBytes sql.NullInt64
+	var errorSamples sql.NullString
+	var ingestSeconds sql.NullFloat64
+	err := row.Scan(&s.ID, &s.Keyword, &s.Source, &s.Location, &s.Status, &s.LeadsFound, &s.EstimatedCost, &s.CreatedAt, &s.RerunOf, &newLeads, &s.Title, &s.Notes, &archivedAt,
+		&startedAt, &finishedAt, &exitCode, &outputBytes, &s.ErrorCount, &errorSamples, &ingestSeconds)
+	if errorSamples.Valid {
+		json.Unmarshal([]byte(errorSamples.String), &s.ErrorSamples)
+	}
+	s.Metrics = newMetrics(startedAt, finishedAt, exitCode, outputBytes)
+	if ingestSeconds.Valid {
+		secs := math.Round(ingestSeconds.Float64*1000) / 1000
+		s.Metrics.IngestSeconds = &secs
+		rate := math.Round(LeadsPerSecond(s.LeadsFound, ingestSeconds.Float64))
+		s.Metrics.LeadsPerSecond = &rate
+	}
+	s.Labels = []Label{}
+	if archivedAt.Valid {
+		s.ArchivedAt = &archivedAt.Time
+	}
+	if newLeads.Valid {
+		n := int(newLeads.Int64)
+		s.NewLeads = &n
+	}
+	return s, err
+}
+
+type sqlRepository struct {
+	tenant store.Tenant
+	q      store.Querier
+	ctx    context.Context
+}
+
+// NewRepository returns the SQL repository for the tenant's searches,
+// running its queries on q under ctx.
+func NewRepository(ctx context.Context, q store.Querier, tenant store.Tenant) Repository {
+	return &sqlRepository{tenant: tenant, q: q, ctx: ctx}
+}
+
+func (r *sqlRepository) Owns(searchID string) bool {
+	var exists bool
+	err := r.q.QueryRowContext(r.ctx, "SELECT EXISTS(SELECT 1 FROM searches WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", searchID, r.tenant.OrgID).Scan(&exists)
+	return err == nil && exists
+}
+
+func (r *sqlRepository) Insert(s Search) error {
+	_, err := r.q.ExecContext(r.ctx, "INSERT INTO searches (id, user_id, org_id, keyword, source, location, status, estimated_cost, rerun_of) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))",
+		s.ID, r.tenant.UserID, r.tenant.OrgID, s.Keyword, s.Source, s.Location, s.Status, s.EstimatedCost, s.RerunOf)
+	return err
+}
+
+func (r *sqlRepository) Get(searchID string) (Search, error) {
+	s, err := Scan(r.q.QueryRowContext(r.ctx, "SELECT "+SELECT_COLUMNS+" FROM searches WHERE id = ? AND org_id = ? AND deleted_at IS NULL", searchID, r.tenant.OrgID))
+	if err == sql.ErrNoRows {
+		return s, store.ErrNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	searches := []Search{s}
+	err = r.attachLabels(searches)
+	return searches[0], err
+}
+
+// attachLabels fills in each search's labels, with their colors.
+func (r *sqlRepository) attachLabels(searches []Search) error {
+	if len(searches) == 0 {
+		return nil
+	}
+	colors, err := r.labelColors()
+	if err != nil {
+		return err
+	}
+	index := map[string]*Search{}
+	args := []interface{}{r.tenant.OrgID}
+	for i := range searches {
+		index[searches[i].ID] = &searches[i]
+		args = append(args, searches[i].ID)
+	}
+	rows, err := r.q.QueryContext(r.ctx, "SELECT search_id, label FROM search_labels WHERE org_id = ? AND search_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(searches)), ",")+") ORDER BY label", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var searchID, label string
+		if err := rows.Scan(&searchID, &label); err != nil {
+			return err
+		}
+		s := index[searchID]
+		s.Labels = append(s.Labels, Label{Name: label, Color: labelColor(label, colors)})
+	}
+	return rows.Err()
+}
+
+func (r *sqlRepository) labelColors() (map[string]string, error) {
+	rows, err := r.q.QueryContext(r.ctx, "SELECT label, color FROM search_label_colors WHERE org_id = ?", r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	colors := map[string]string{}
+	for rows.Next() {
+		var label, color string
+		if err := rows.Scan(&label, &color); err != nil {
+			return nil, err
+		}
+		colors[label] = color
+	}
+	return colors, rows.Err()
+}
+
+func (r *sqlRepository) List(q *ListQuery) ([]Search, int, error) {
+	where := "org_id = ? AND " + q.where
+	args := append([]interface{}{r.tenant.OrgID}, q.args...)
+
+	var total int
+	if err := r.q.QueryRowContext(r.ctx, "SELECT COUNT(*) FROM searches WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, q.pageSize, (q.page-1)*q.pageSize)
+	rows, err := r.q.QueryContext(r.ctx, "SELECT "+SELECT_COLUMNS+" FROM searches WHERE "+where+" ORDER BY created_at DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var searches []Search
+	for rows.Next() {
+		s, err := Scan(rows)
+		if err != nil {
+			log.Printf("Error scanning search row: %v", err)
+			continue
+		}
+		searches = append(searches, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+	return searches, total, r.attachLabels(searches)
+}
+
+func (r *sqlRepository) Update(searchID string, in Update) error {
+	if !r.Owns(searchID) {
+		return store.ErrNotFound
+	}
+	return store.InTx(r.ctx, r.q, func(q store.Querier) error {
+		if in.Title != nil {
+			if _, err := q.ExecContext(r.ctx, "UPDATE searches SET title = ? WHERE id = ?", *in.Title, searchID); err != nil {
+				return err
+			}
+		}
+		if in.Notes != nil {
+			if _, err := q.ExecContext(r.ctx, "UPDATE searches SET notes = ? WHERE id = ?", *in.Notes, searchID); err != nil {
+				return err
+			}
+		}
+		if in.Labels != nil {
+			if _, err := q.ExecContext(r.ctx, "DELETE FROM search_labels WHERE search_id = ?", searchID); err != nil {
+				return err
+			}
+			for _, label := range in.Labels {
+				if _, err := q.ExecContext(r.ctx, "INSERT OR IGNORE INTO search_labels (search_id, org_id, label) VALUES (?, ?, ?)", searchID, r.tenant.OrgID, label); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (r *sqlRepository) Labels() ([]Label, error) {
+	colors, err := r.labelColors()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.q.QueryContext(r.ctx, `
+        SELECT sl.label, COUNT(*) FROM search_labels sl
+        JOIN searches s ON s.id = sl.search_id AND s.deleted_at IS NULL
+        WHERE sl.org_id = ?
+        GROUP BY sl.label ORDER BY sl.label
+    `, r.tenant.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	labels := []Label{}
+	for rows.Next() {
+		var l Label
+		var n int
+		if err := rows.Scan(&l.Name, &n); err != nil {
+			return nil, err
+		}
+		l.Color = labelColor(l.Name, colors)
+		l.Searches = &n
+		labels = append(labels, l)
+	}
+	return labels, rows.Err()
+}
+
+func (r *sqlRepository) SetLabelColor(label, color string) error {
+	_, err := r.q.ExecContext(r.ctx, `
+        INSERT INTO search_label_colors (org_id, label, color) VALUES (?, ?, ?)
+        ON CONFLICT (org_id, label) DO UPDATE SET color = excluded.color
+    `, r.tenant.OrgID, label, color)
+	return err
+}
+
+func (r *sqlRepository) Log(searchID string) (Log, error) {
+	var l Log
+	if !r.Owns(searchID) {
+		return l, store.ErrNotFound
+	}
+	var updatedAt sql.NullTime
+	err := r.q.QueryRowContext(r.ctx, "SELECT output, truncated, updated_at FROM search_logs WHERE search_id = ?", searchID).Scan(&l.Output, &l.Truncated, &updatedAt)
+	if err == sql.ErrNoRows {
+		return l, nil
+	}
+	if updatedAt.Valid {
+		l.UpdatedAt = &updatedAt.Time
+	}
+	return l, err
+}
+
+// SetArchived archives the search, keeping the first archive time, or
+// unarchives it.
+func (r *sqlRepository) SetArchived(searchID string, archived bool) error {
+	query := "UPDATE searches SET archived_at = NULL WHERE id = ? AND org_id = ? AND deleted_at IS NULL"
+	if archived {
+		query = "UPDATE searches SET archived_at = COALESCE(archived_at, CURRENT_TIMESTAMP) WHERE id = ? AND org_id = ? AND deleted_at IS NULL"
+	}
+	return store.ExpectOne(r.q.ExecContext(r.ctx, query, searchID, r.tenant.OrgID))
+}
+
+func (r *sqlRepository) Trash(searchID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE searches SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND org_id = ? AND deleted_at IS NULL", searchID, r.tenant.OrgID))
+}
+
+func (r *sqlRepository) Restore(searchID string) error {
+	return store.ExpectOne(r.q.ExecContext(r.ctx, "UPDATE searches SET deleted_at = NULL WHERE id = ? AND org_id = ? AND deleted_at IS NOT NULL", searchID, r.tenant.OrgID))
+}
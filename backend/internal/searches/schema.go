@@ -0,0 +1,72 @@
+package searches
+
+import "blueleads-backend/internal/store"
+
+// Migrate creates the search tables and adds the columns introduced since
+// the first schema, in the order they were added.
+func Migrate(q store.Querier) error {
+	err := store.Statements(q, `
+        CREATE TABLE IF NOT EXISTS searches (
+            id TEXT PRIMARY KEY,
+            user_id INTEGER NOT NULL,
+            keyword TEXT NOT NULL,
+            status TEXT NOT NULL,
+            leads_found INTEGER DEFAULT 0,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (user_id) REFERENCES users (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS search_labels (
+            search_id TEXT NOT NULL,
+            org_id INTEGER NOT NULL,
+            label TEXT NOT NULL,
+            PRIMARY KEY (search_id, label),
+            FOREIGN KEY (search_id) REFERENCES searches (id),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS search_label_colors (
+            org_id INTEGER NOT NULL,
+            label TEXT NOT NULL,
+            color TEXT NOT NULL,
+            PRIMARY KEY (org_id, label),
+            FOREIGN KEY (org_id) REFERENCES organizations (id)
+        );
+    `, `
+        CREATE TABLE IF NOT EXISTS search_logs (
+            search_id TEXT PRIMARY KEY,
+            output TEXT NOT NULL DEFAULT '',
+            truncated BOOLEAN NOT NULL DEFAULT 0,
+            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (search_id) REFERENCES searches (id)
+        );
+    `)
+	if err != nil {
+		return err
+	}
+	columns := [][2]string{
+		{"source", "TEXT NOT NULL DEFAULT 'google_maps'"},
+		{"location", "TEXT NOT NULL DEFAULT ''"},
+		{"estimated_cost", "REAL NOT NULL DEFAULT 0"},
+		{"deleted_at", "DATETIME"},
+		{"org_id", "INTEGER REFERENCES organizations (id)"},
+		{"rerun_of", "TEXT REFERENCES searches (id)"},
+		{"new_leads", "INTEGER"},
+		{"title", "TEXT NOT NULL DEFAULT ''"},
+		{"notes", "TEXT NOT NULL DEFAULT ''"},
+		{"archived_at", "DATETIME"},
+		{"started_at", "DATETIME"},
+		{"finished_at", "DATETIME"},
+		{"exit_code", "INTEGER"},
+		{"output_bytes", "INTEGER"},
+		{"error_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"error_samples", "TEXT"},
+		{"ingest_seconds", "REAL"},
+	}
+	for _, c := range columns {
+		if err := store.AddColumnIfMissing(q, "searches", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Package searches records the searches a tenant runs: what was asked for,
+// how the scrape went, and the title, notes and labels people add to tell
+// them apart. Scraping itself is the scraper package's job.
+package searches
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+)
+
+// Statuses a search moves through. Queued marks a search lmctl has handed
+// back to the server to run again.
+const (
+	IN_PROGRESS = "In Progress"
+	QUEUED      = "Queued"
+	COMPLETED   = "Completed"
+	FAILED      = "Failed"
+)
+
+type Search struct {
+	ID            string     `json:"id"`
+	UserID        int64      `json:"-"`
+	Keyword       string     `json:"keyword"`
+	Source        string     `json:"source"`
+	Location      string     `json:"location"`
+	Status        string     `json:"status"`
+	LeadsFound    int        `json:"leadsFound"`
+	EstimatedCost float64    `json:"estimatedCost"`
+	CreatedAt     time.Time  `json:"date"`
+	RerunOf       string     `json:"rerunOf,omitempty"`
+	NewLeads      *int       `json:"newLeads,omitempty"`
+	Title         string     `json:"title"`
+	Notes         string     `json:"notes"`
+	Labels        []Label    `json:"labels"`
+	ArchivedAt    *time.Time `json:"archivedAt,omitempty"`
+	Metrics       Metrics    `json:"metrics"`
+	ErrorCount    int        `json:"errorCount"`
+	ErrorSamples  []string   `json:"errorSamples,omitempty"`
+}
+
+// Running reports whether the search is still being scraped or waiting
+// to be.
+func (s Search) Running() bool {
+	return s.Status == IN_PROGRESS || s.Status == QUEUED
+}
+
+// --- METRICS ---
+
+// Metrics is how a search's scrape went. Exit code and output size are
+// only known for sources that run the scraper binary; the rest leave them
+// null, as does a search that hasn't finished.
+type Metrics struct {
+	StartedAt       *time.Time `json:"startedAt"`
+	FinishedAt      *time.Time `json:"finishedAt"`
+	DurationSeconds *float64   `json:"durationSeconds"`
+	ExitCode        *int       `json:"exitCode"`
+	OutputBytes     *int64     `json:"outputBytes"`
+	IngestSeconds   *float64   `json:"ingestSeconds"`
+	LeadsPerSecond  *float64   `json:"leadsPerSecond"`
+}
+
+func newMetrics(startedAt, finishedAt sql.NullTime, exitCode, outputBytes sql.NullInt64) Metrics {
+	var m Metrics
+	if startedAt.Valid {
+		m.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		m.FinishedAt = &finishedAt.Time
+	}
+	if startedAt.Valid && finishedAt.Valid {
+		d := math.Round(finishedAt.Time.Sub(startedAt.Time).Seconds()*10) / 10
+		m.DurationSeconds = &d
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		m.ExitCode = &code
+	}
+	if outputBytes.Valid {
+		m.OutputBytes = &outputBytes.Int64
+	}
+	return m
+}
+
+// LeadsPerSecond is how fast leads were stored. A near-instant ingest is
+// treated as taking a millisecond rather than dividing by zero.
+func LeadsPerSecond(leads int, seconds float64) float64 {
+	return float64(leads) / math.Max(seconds, 0.001)
+}
+
+// --- TITLES, NOTES AND LABELS ---
+//
+// Besides the keyword it was run with, a search can have a title, notes
+// and labels to tell it apart. Labels are shared across the tenant's
+// searches; each has a color, picked from a palette until someone sets
+// one.
+
+const (
+	MAX_TITLE_LENGTH = 200
+	MAX_NOTES_LENGTH = 10000
+	// MAX_LABEL_LENGTH matches the CRM's tags, which labels are kept like.
+	MAX_LABEL_LENGTH = 40
+)
+
+var labelPalette = []string{"#2563eb", "#16a34a", "#dc2626", "#d97706", "#7c3aed", "#db2777", "#0891b2", "#65a30d"}
+
+type Label struct {
+	Name     string `json:"name"`
+	Color    string `json:"color"`
+	Searches *int   `json:"searches,omitempty"`
+}
+
+// labelColor returns the label's chosen color, or the same palette color
+// every time if it hasn't got one.
+func labelColor(label string, colors map[string]string) string {
+	if color, ok := colors[label]; ok {
+		return color
+	}
+	h := fnv.New32a()
+	h.Write([]byte(label))
+	return labelPalette[h.Sum32()%uint32(len(labelPalette))]
+}
+
+// NormalizeLabel trims a label and checks it can be stored; like tags,
+// labels are kept comma-free.
+func NormalizeLabel(label string) (string, error) {
+	label = strings.TrimSpace(label)
+	if label == "" || len(label) > MAX_LABEL_LENGTH || strings.Contains(label, ",") {
+		return "", ValidationError(fmt.Sprintf("labels must be 1-%d characters without commas", MAX_LABEL_LENGTH))
+	}
+	return label, nil
+}
+
+// Update sets a search's title, notes or labels; fields left nil are
+// unchanged, and labels replace the current set.
+type Update struct {
+	Title  *string  `json:"title"`
+	Notes  *string  `json:"notes"`
+	Labels []string `json:"labels"`
+}
+
+// Validate trims and checks the update, normalizing its labels.
+func (in *Update) Validate() error {
+	if in.Title != nil {
+		title := strings.TrimSpace(*in.Title)
+		if len(title) > MAX_TITLE_LENGTH {
+			return ValidationError(fmt.Sprintf("title must be at most %d characters", MAX_TITLE_LENGTH))
+		}
+		in.Title = &title
+	}
+	if in.Notes != nil && len(*in.Notes) > MAX_NOTES_LENGTH {
+		return ValidationError(fmt.Sprintf("notes must be at most %d characters", MAX_NOTES_LENGTH))
+	}
+	for i, label := range in.Labels {
+		label, err := NormalizeLabel(label)
+		if err != nil {
+			return err
+		}
+		in.Labels[i] = label
+	}
+	return nil
+}
+
+// --- LOGS ---
+
+// Log is how a search's scrape went, as our own progress lines and
+// whatever the scraper printed.
+type Log struct {
+	Output    string     `json:"output"`
+	Truncated bool       `json:"truncated"`
+	UpdatedAt *time.Time `json:"updatedAt"`
+}
@@ -0,0 +1,136 @@
+package searches
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"blueleads-backend/internal/store"
+	"blueleads-backend/internal/store/storetest"
+)
+
+func newTestService(t *testing.T) (Service, Repository, Repository) {
+	t.Helper()
+	db := storetest.Open(t, Migrate)
+	alice := NewRepository(context.Background(), db, store.Tenant{OrgID: 1, UserID: 1})
+	mallory := NewRepository(context.Background(), db, store.Tenant{OrgID: 2, UserID: 2})
+	return NewService(alice), alice, mallory
+}
+
+func TestUpdateValidatesAndReplacesLabels(t *testing.T) {
+	svc, alice, mallory := newTestService(t)
+	if err := alice.Insert(Search{ID: "s1", Keyword: "plumbers", Source: "google_maps", Status: COMPLETED}); err != nil {
+		t.Fatal(err)
+	}
+
+	title := "  Leeds plumbers  "
+	search, err := svc.Update("s1", Update{Title: &title, Labels: []string{" q1 ", "trades"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if search.Title != "Leeds plumbers" || len(search.Labels) != 2 || search.Labels[0].Name != "q1" {
+		t.Errorf("updated search = %+v", search)
+	}
+	search, err = svc.Update("s1", Update{Labels: []string{"trades"}})
+	if err != nil || len(search.Labels) != 1 || search.Title != "Leeds plumbers" {
+		t.Errorf("labels weren't replaced: %+v (err %v)", search, err)
+	}
+
+	var invalid ValidationError
+	long := strings.Repeat("x", MAX_TITLE_LENGTH+1)
+	if _, err := svc.Update("s1", Update{Title: &long}); !errors.As(err, &invalid) {
+		t.Errorf("long title: got %v, want a ValidationError", err)
+	}
+	if _, err := svc.Update("s1", Update{Labels: []string{"a,b"}}); !errors.As(err, &invalid) {
+		t.Errorf("label with a comma: got %v, want a ValidationError", err)
+	}
+	if _, err := NewService(mallory).Update("s1", Update{Title: &title}); err != store.ErrNotFound {
+		t.Errorf("update across tenants: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestLabelColors(t *testing.T) {
+	svc, alice, _ := newTestService(t)
+	alice.Insert(Search{ID: "s1", Keyword: "roofers", Status: COMPLETED})
+	if _, err := svc.Update("s1", Update{Labels: []string{"q1"}}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := svc.Labels()
+	if len(before) != 1 || !store.ValidColor(before[0].Color) || *before[0].Searches != 1 {
+		t.Fatalf("labels = %+v", before)
+	}
+
+	var invalid ValidationError
+	if _, err := svc.SetLabelColor("q1", "blue"); !errors.As(err, &invalid) {
+		t.Errorf("named color: got %v, want a ValidationError", err)
+	}
+	label, err := svc.SetLabelColor(" q1 ", "#AABBCC")
+	if err != nil || label != (Label{Name: "q1", Color: "#aabbcc"}) {
+		t.Fatalf("SetLabelColor = %+v (err %v)", label, err)
+	}
+	search, _ := svc.Get("s1")
+	if search.Labels[0].Color != "#aabbcc" {
+		t.Errorf("search label color = %q", search.Labels[0].Color)
+	}
+}
+
+func TestArchiveRefusesRunningSearches(t *testing.T) {
+	svc, alice, _ := newTestService(t)
+	alice.Insert(Search{ID: "running", Keyword: "roofers", Status: IN_PROGRESS})
+	alice.Insert(Search{ID: "queued", Keyword: "roofers", Status: QUEUED})
+	alice.Insert(Search{ID: "done", Keyword: "roofers", Status: COMPLETED})
+
+	for _, id := range []string{"running", "queued"} {
+		if _, err := svc.Archive(id, true); err != ErrRunning {
+			t.Errorf("archive %s: got %v, want ErrRunning", id, err)
+		}
+	}
+	search, err := svc.Archive("done", true)
+	if err != nil || search.ArchivedAt == nil {
+		t.Fatalf("archive = %+v (err %v)", search, err)
+	}
+
+	list := func(archived string) int {
+		q, err := ParseListQuery(url.Values{"archived": {archived}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, total, err := svc.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	if got := list(""); got != 2 {
+		t.Errorf("default list has %d searches, want 2", got)
+	}
+	if got := list("true"); got != 1 {
+		t.Errorf("archived list has %d searches, want 1", got)
+	}
+	if _, err := svc.Archive("done", false); err != nil || list("true") != 0 {
+		t.Errorf("unarchive failed (err %v)", err)
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	for _, params := range []url.Values{
+		{"page": {"0"}},
+		{"pageSize": {"500"}},
+		{"archived": {"maybe"}},
+		{"from": {"yesterday"}},
+	} {
+		if _, err := ParseListQuery(params); err == nil {
+			t.Errorf("ParseListQuery(%v) should fail", params)
+		}
+	}
+	q, err := ParseListQuery(url.Values{"page": {"3"}, "pageSize": {"20"}, "to": {"2026-01-31"}})
+	if err != nil || q.Page() != 3 || q.PageSize() != 20 {
+		t.Fatalf("ParseListQuery = %+v (err %v)", q, err)
+	}
+	// A bare end date covers the whole day.
+	if got := q.args[len(q.args)-1]; got != "2026-02-01 00:00:00" {
+		t.Errorf("to bound = %v", got)
+	}
+}
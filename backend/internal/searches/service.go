@@ -0,0 +1,96 @@
+package searches
+
+import (
+	"errors"
+	"strings"
+
+	"blueleads-backend/internal/store"
+)
+
+// ErrRunning is returned when archiving a search that's still in progress.
+var ErrRunning = errors.New("search still in progress")
+
+// ValidationError is a change the service refused; its text says why and
+// is safe to show the user.
+type ValidationError string
+
+func (e ValidationError) Error() string { return string(e) }
+
+// Service is what the API does with searches, on top of storing them.
+type Service interface {
+	Get(searchID string) (Search, error)
+	List(q *ListQuery) ([]Search, int, error)
+	// Update validates and applies in, returning the updated search.
+	Update(searchID string, in Update) (Search, error)
+	Labels() ([]Label, error)
+	// SetLabelColor sets a label's color, as #rrggbb.
+	SetLabelColor(label, color string) (Label, error)
+	// Archive takes a finished search off the default list without
+	// touching its leads, or puts it back. It fails with ErrRunning for a
+	// search still in progress.
+	Archive(searchID string, archive bool) (Search, error)
+	Log(searchID string) (Log, error)
+}
+
+type service struct {
+	repo Repository
+}
+
+func NewService(repo Repository) Service {
+	return &service{repo: repo}
+}
+
+func (s *service) Get(searchID string) (Search, error) {
+	return s.repo.Get(searchID)
+}
+
+func (s *service) List(q *ListQuery) ([]Search, int, error) {
+	return s.repo.List(q)
+}
+
+func (s *service) Update(searchID string, in Update) (Search, error) {
+	if err := in.Validate(); err != nil {
+		return Search{}, err
+	}
+	if err := s.repo.Update(searchID, in); err != nil {
+		return Search{}, err
+	}
+	return s.repo.Get(searchID)
+}
+
+func (s *service) Labels() ([]Label, error) {
+	return s.repo.Labels()
+}
+
+func (s *service) SetLabelColor(label, color string) (Label, error) {
+	label, err := NormalizeLabel(label)
+	if err != nil {
+		return Label{}, err
+	}
+	if !store.ValidColor(color) {
+		return Label{}, ValidationError("color must be a hex color like #2563eb")
+	}
+	color = strings.ToLower(color)
+	if err := s.repo.SetLabelColor(label, color); err != nil {
+		return Label{}, err
+	}
+	return Label{Name: label, Color: color}, nil
+}
+
+func (s *service) Archive(searchID string, archive bool) (Search, error) {
+	search, err := s.repo.Get(searchID)
+	if err != nil {
+		return search, err
+	}
+	if archive && search.Running() {
+		return search, ErrRunning
+	}
+	if err := s.repo.SetArchived(searchID, archive); err != nil {
+		return search, err
+	}
+	return s.repo.Get(searchID)
+}
+
+func (s *service) Log(searchID string) (Log, error) {
+	return s.repo.Log(searchID)
+}
@@ -0,0 +1,151 @@
+// Package store holds what the storage packages share: the tenant scope
+// their queries run under, the database interfaces they're written
+// against, and the few SQL helpers they all need.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrNotFound is returned when a row doesn't exist or belongs to another
+// tenant; callers can't tell the two apart, by design.
+var ErrNotFound = errors.New("not found")
+
+// Tenant is the organization a repository works for, and the member of it
+// acting. Searches, leads and the CRM board belong to the organization;
+// account-level data stays per user.
+type Tenant struct {
+	OrgID  int64
+	UserID int64
+}
+
+// Executor is satisfied by both *sql.DB and *sql.Tx.
+type Executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Executor
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// RowScanner is a *sql.Row or *sql.Rows.
+type RowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Codec seals contact details before they're written and opens them again
+// when they're read. The server's field encryption is one; tests use
+// PlainCodec.
+type Codec interface {
+	Seal(value string) string
+	Unseal(value string) string
+}
+
+// PlainCodec stores values as they are.
+type PlainCodec struct{}
+
+func (PlainCodec) Seal(value string) string   { return value }
+func (PlainCodec) Unseal(value string) string { return value }
+
+// ExpectOne turns an UPDATE or DELETE that matched nothing into ErrNotFound.
+func ExpectOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// EscapeLike escapes s for a LIKE pattern with ESCAPE '\'.
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// InList returns placeholders and arguments for an IN (...) of values.
+func InList(values []string) (string, []interface{}) {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", "), args
+}
+
+var hexColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// ValidColor reports whether s is a #rrggbb color, the form label and
+// status colors are stored in.
+func ValidColor(s string) bool {
+	return hexColorPattern.MatchString(s)
+}
+
+// InTx runs fn inside a transaction: a new one when q is a *sql.DB, or q
+// itself when the caller already started one.
+func InTx(ctx context.Context, q Querier, fn func(q Querier) error) error {
+	db, ok := q.(*sql.DB)
+	if !ok {
+		return fn(q)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddColumnIfMissing adds a column to a table created before it existed.
+func AddColumnIfMissing(q Querier, table, column, definition string) error {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("inspecting %s: %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("inspecting %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("inspecting %s: %w", table, err)
+	}
+	rows.Close()
+	if _, err := q.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// Migration creates or upgrades a package's tables.
+type Migration func(q Querier) error
+
+// Statements runs each statement in turn, for migrations made of plain DDL.
+func Statements(q Querier, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := q.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
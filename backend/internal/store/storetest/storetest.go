@@ -0,0 +1,36 @@
+// Package storetest opens in-memory SQLite databases for the storage
+// packages' tests.
+package storetest
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"blueleads-backend/internal/store"
+)
+
+var databases atomic.Int64
+
+// Open returns a fresh in-memory database with the migrations applied. It
+// is closed when the test ends.
+func Open(t testing.TB, migrations ...store.Migration) *sql.DB {
+	t.Helper()
+	// A named shared-cache database, so every pooled connection sees the
+	// same tables.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:storetest%d?mode=memory&cache=shared", databases.Add(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	for _, m := range migrations {
+		if err := m(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
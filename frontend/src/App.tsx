@@ -21,6 +21,9 @@ const apiFetch = async (path, options = {}) => {
 
     if (!response.ok) {
         const errorData = await response.json().catch(() => ({ error: 'An unknown error occurred' }));
+        if (errorData.fields) {
+            throw new Error(Object.entries(errorData.fields).map(([field, problem]) => `${field} ${problem}`).join('; '));
+        }
         throw new Error(errorData.error || `HTTP error! status: ${response.status}`);
     }
     
@@ -39,8 +42,28 @@ const AuthProvider = ({ children }) => {
     const [user, setUser] = useState(JSON.parse(localStorage.getItem('user')));
     const [token, setToken] = useState(localStorage.getItem('authToken'));
     const [isAuthLoading, setIsAuthLoading] = useState(true);
+    const [ssoError, setSsoError] = useState('');
 
     useEffect(() => {
+        // Single sign-on comes back with #ssoToken=... or #ssoError=...
+        const sso = new URLSearchParams(window.location.hash.slice(1));
+        if (sso.has('ssoToken') || sso.has('ssoError')) {
+            window.history.replaceState(null, '', window.location.pathname + window.location.search);
+        }
+        if (sso.get('ssoError')) setSsoError(sso.get('ssoError'));
+        if (sso.get('ssoToken')) {
+            localStorage.setItem('authToken', sso.get('ssoToken'));
+            apiFetch('/api/me').then(me => {
+                const ssoUser = { id: me.id, name: me.name, email: me.email };
+                localStorage.setItem('user', JSON.stringify(ssoUser));
+                setToken(sso.get('ssoToken'));
+                setUser(ssoUser);
+            }).catch(err => {
+                localStorage.removeItem('authToken');
+                setSsoError(err.message);
+            }).finally(() => setIsAuthLoading(false));
+            return;
+        }
         const storedToken = localStorage.getItem('authToken');
         const storedUser = localStorage.getItem('user');
         if (storedToken && storedUser) {
@@ -62,10 +85,10 @@ const AuthProvider = ({ children }) => {
         return true;
     };
 
-    const register = async (name, email, password) => {
+    const register = async (name, email, password, captchaToken, inviteCode) => {
         const data = await apiFetch('/register', {
             method: 'POST',
-            body: JSON.stringify({ name, email, password }),
+            body: JSON.stringify({ name, email, password, captchaToken, inviteCode }),
         });
         localStorage.setItem('authToken', data.token);
         localStorage.setItem('user', JSON.stringify(data.user));
@@ -81,7 +104,15 @@ const AuthProvider = ({ children }) => {
         setUser(null);
     };
 
-    const value = { user, token, login, logout, register, isAuthLoading };
+    const loginWithSSO = async (email) => {
+        const data = await apiFetch('/sso/start', {
+            method: 'POST',
+            body: JSON.stringify({ email }),
+        });
+        window.location.assign(data.url);
+    };
+
+    const value = { user, token, login, loginWithSSO, logout, register, isAuthLoading, ssoError };
 
     return <AuthContext.Provider value={value}>{children}</AuthContext.Provider>;
 };
@@ -320,14 +351,14 @@ function Searches({ onSelectSearch }) {
                             {searches.map(search => (
                                 <TableRow key={search.id}>
                                     <TableCell className="font-medium">{search.keyword}</TableCell>
-                                    <TableCell><span className={`px-2 inline-flex text-xs leading-5 font-semibold rounded-full ${search.status === 'Completed' ? 'bg-green-100 text-green-800' : 'bg-yellow-100 text-yellow-800'}`}>{search.status}</span></TableCell>
+                                    <TableCell><span className={`px-2 inline-flex text-xs leading-5 font-semibold rounded-full ${search.status.startsWith('Completed') ? 'bg-green-100 text-green-800' : 'bg-yellow-100 text-yellow-800'}`}>{search.status}</span></TableCell>
                                     <TableCell>{search.leadsFound}</TableCell>
                                     <TableCell>{format(new Date(search.date), 'PPpp')}</TableCell>
                                     <TableCell className="text-right">
                                         <Button 
                                             variant="outline" 
                                             size="sm" 
-                                            disabled={search.status !== 'Completed'} 
+                                            disabled={!search.status.startsWith('Completed')} 
                                             onClick={() => onSelectSearch(search)}
                                         >
                                             <Eye className="mr-2 h-4 w-4" />
@@ -442,6 +473,31 @@ function CRM() {
 
     useEffect(() => { fetchCrmData(); }, [fetchCrmData]);
 
+    // Refetch when a teammate or another tab changes the board.
+    useEffect(() => {
+        const token = localStorage.getItem('authToken');
+        if (!token) return;
+        let socket;
+        let retry;
+        let stopped = false;
+        const connect = () => {
+            socket = new WebSocket(`${API_BASE_URL.replace(/^http/, 'ws')}/api/crm/ws`, ['bearer', token]);
+            socket.onmessage = (e) => {
+                const event = JSON.parse(e.data);
+                if (event.type === 'crm_changed') fetchCrmData();
+            };
+            socket.onclose = () => {
+                if (!stopped) retry = setTimeout(() => { fetchCrmData(); connect(); }, 5000);
+            };
+        };
+        connect();
+        return () => {
+            stopped = true;
+            clearTimeout(retry);
+            socket.close();
+        };
+    }, [fetchCrmData]);
+
     const handleDrop = async (e, targetColumnId) => {
         const leadId = e.dataTransfer.getData("leadId");
         const sourceColumnId = e.dataTransfer.getData("sourceColumnId");
@@ -547,21 +603,65 @@ function LeadModal({ lead, onClose, onUpdate }) {
     );
 }
 
+// Scripts for the sign-up captcha; the backend says which one, if any, to use.
+const CAPTCHA_SCRIPTS = {
+    hcaptcha: 'https://js.hcaptcha.com/1/api.js?render=explicit',
+    turnstile: 'https://challenges.cloudflare.com/turnstile/v0/api.js?render=explicit',
+};
+
+function CaptchaWidget({ onToken }) {
+    const container = React.useRef(null);
+    useEffect(() => {
+        let cancelled = false;
+        apiFetch('/captcha').then(config => {
+            if (cancelled || !config?.provider) return;
+            const render = () => window[config.provider].render(container.current, { sitekey: config.siteKey, callback: onToken });
+            if (window[config.provider]) { render(); return; }
+            const script = document.createElement('script');
+            script.src = CAPTCHA_SCRIPTS[config.provider];
+            script.onload = render;
+            document.head.appendChild(script);
+        }).catch(() => {});
+        return () => { cancelled = true; };
+    }, []);
+    return <div ref={container} />;
+}
+
 function AuthPage() {
-    const { login, register } = useAuth();
+    const { login, loginWithSSO, register, ssoError } = useAuth();
     const [isLogin, setIsLogin] = useState(true);
     const [name, setName] = useState('');
     const [email, setEmail] = useState('');
     const [password, setPassword] = useState('');
-    const [error, setError] = useState('');
+    const [captchaToken, setCaptchaToken] = useState('');
+    // Invitation links carry the code as ?invite=.
+    const [inviteCode, setInviteCode] = useState(() => new URLSearchParams(window.location.search).get('invite') || '');
+    const [inviteOnly, setInviteOnly] = useState(false);
+    useEffect(() => {
+        apiFetch('/registration').then(config => setInviteOnly(!!config?.inviteOnly)).catch(() => {});
+        if (inviteCode) setIsLogin(false);
+    }, []);
+    const [error, setError] = useState(ssoError);
     const [isLoading, setIsLoading] = useState(false);
+    useEffect(() => { if (ssoError) setError(ssoError); }, [ssoError]);
+
+    const handleSSO = async () => {
+        if (!email) { setError('Enter your work email to sign in with SSO'); return; }
+        setError(''); setIsLoading(true);
+        try {
+            await loginWithSSO(email);
+        } catch (err) {
+            setError(err.message);
+            setIsLoading(false);
+        }
+    };
 
     const handleSubmit = async (e) => {
         e.preventDefault();
         setError(''); setIsLoading(true);
         try {
             if (isLogin) { await login(email, password); }
-            else { await register(name, email, password); }
+            else { await register(name, email, password, captchaToken, inviteCode); }
         } catch (err) {
             setError(err.message);
         } finally {
@@ -578,8 +678,11 @@ function AuthPage() {
                         {!isLogin && <Input type="text" placeholder="Full Name" value={name} onChange={e => setName(e.target.value)} required />}
                         <Input type="email" placeholder="Email Address" value={email} onChange={e => setEmail(e.target.value)} required />
                         <Input type="password" placeholder="Password" value={password} onChange={e => setPassword(e.target.value)} required />
+                        {!isLogin && (inviteOnly || inviteCode) && <Input type="text" placeholder="Invitation Code" value={inviteCode} onChange={e => setInviteCode(e.target.value)} required={inviteOnly} />}
+                        {!isLogin && <CaptchaWidget onToken={setCaptchaToken} />}
                         {error && <p className="text-red-500 text-sm">{error}</p>}
                         <Button type="submit" className="w-full py-3" disabled={isLoading}>{isLogin ? 'Login' : 'Register'}</Button>
+                        {isLogin && <Button type="button" variant="outline" className="w-full py-3" disabled={isLoading} onClick={handleSSO}>Sign in with SSO</Button>}
                     </form>
                     <p className="mt-6 text-center text-sm text-gray-600">
                         {isLogin ? "Don't have an account?" : "Already have an account?"}